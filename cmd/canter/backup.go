@@ -0,0 +1,177 @@
+/*
+Copyright 2024 Andrew Meredith
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/kendru/canter/internal/config"
+	"github.com/kendru/canter/internal/store"
+	badgerImpl "github.com/kendru/canter/internal/store/badger"
+	"github.com/spf13/cobra"
+)
+
+// backupCmd represents the backup command
+var backupCmd = &cobra.Command{
+	Use:   "backup",
+	Short: "Write a consistent backup of a store.",
+	Long: `Writes a backup of a store as of a single point in time, which restore loads
+into a new store. With --server, the backup is streamed from the /backup
+endpoint of a running canter server, so a live store can be backed up without
+downtime while writes continue. Otherwise the store is opened read-only.
+
+Backups are written in Badger's backup format.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		var out io.Writer = os.Stdout
+		if path := cmd.Flag("out").Value.String(); path != "" && path != "-" {
+			f, err := os.Create(path)
+			if err != nil {
+				log.Fatalf("error creating output file: %v", err)
+			}
+			defer f.Close()
+			out = f
+		}
+		w := bufio.NewWriter(out)
+
+		var err error
+		if server, _ := cmd.Flags().GetString("server"); server != "" {
+			err = fetchBackup(w, server)
+		} else {
+			cfg := loadConfig(cmd)
+			cfg.Storage.ReadOnly = true
+			err = writeBackup(w, cfg)
+		}
+		if err == nil {
+			err = w.Flush()
+		}
+		if err != nil {
+			log.Fatalf("error backing up: %v", err)
+		}
+	},
+}
+
+// restoreCmd represents the restore command
+var restoreCmd = &cobra.Command{
+	Use:   "restore",
+	Short: "Restore a backup into a new store.",
+	Long: `Loads a backup written by the backup command into the store directory, which
+must not hold a store already.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		cfg := loadConfig(cmd)
+		if cfg.Storage.Backend != config.BackendBadger {
+			log.Fatalf("backups can only be restored into badger stores")
+		}
+		opts, err := cfg.BadgerOptions()
+		if err != nil {
+			log.Fatalf("invalid configuration: %v", err)
+		}
+		var in io.Reader = os.Stdin
+		if path := cmd.Flag("in").Value.String(); path != "" && path != "-" {
+			f, err := os.Open(path)
+			if err != nil {
+				log.Fatalf("error opening backup: %v", err)
+			}
+			defer f.Close()
+			in = f
+		}
+		if err := badgerImpl.RestoreDir(cfg.Storage.Dir, bufio.NewReader(in), opts); err != nil {
+			log.Fatalf("error restoring: %v", err)
+		}
+	},
+}
+
+// writeBackup writes a backup of the configured store to w.
+func writeBackup(w io.Writer, cfg config.Config) error {
+	conn, err := cfg.Open()
+	if err != nil {
+		return fmt.Errorf("opening store: %w", err)
+	}
+	defer conn.Close(context.Background())
+	rt, err := conn.ReadTxn()
+	if err != nil {
+		return err
+	}
+	defer rt.Close()
+	return rt.Backup(w)
+}
+
+// fetchBackup copies a backup from the /backup endpoint of a server to w.
+func fetchBackup(w io.Writer, server string) error {
+	resp, err := http.Get(strings.TrimSuffix(server, "/") + "/backup")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("server responded with %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	if _, err := io.Copy(w, resp.Body); err != nil {
+		return err
+	}
+	if basis := resp.Header.Get(basisHeader); basis != "" {
+		logger.Info("backup complete", "basis", basis)
+	}
+	return nil
+}
+
+// basisHeader is the response header in which the /backup endpoint reports the
+// basis of the backup.
+const basisHeader = "Canter-Basis"
+
+// backupHandler streams a backup of the store as of the moment that the
+// request is received. Writes continue while the backup is streamed.
+func backupHandler(conn *store.Connection) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		rt, err := conn.ReadTxn()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		defer rt.Close()
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set(basisHeader, strconv.FormatInt(int64(rt.DB().Basis.ID()), 10))
+		// The status has been sent by the time the backup fails, so the
+		// failure can only be logged, and the client sees a truncated body.
+		if err := rt.Backup(w); err != nil {
+			logger.Error("error streaming backup", "error", err)
+		}
+	})
+}
+
+func init() {
+	rootCmd.AddCommand(backupCmd)
+	rootCmd.AddCommand(restoreCmd)
+
+	backupCmd.Flags().StringP("dir", "d", "", "Directory of the store to back up")
+	backupCmd.Flags().String("server", "", "URL of a running server to back up instead of a store directory")
+	backupCmd.Flags().StringP("out", "o", "", "File to write to, or - for standard output (default)")
+	restoreCmd.Flags().StringP("dir", "d", "", "Directory of the store to restore into")
+	restoreCmd.Flags().StringP("in", "i", "", "File to read the backup from, or - for standard input (default)")
+}
@@ -0,0 +1,340 @@
+/*
+Copyright 2024 Andrew Meredith
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/kendru/canter/internal/store"
+	"github.com/kendru/canter/internal/store/query"
+	"github.com/spf13/cobra"
+)
+
+// browsePageSize is the number of entries that the browser shows at a time.
+const browsePageSize = 20
+
+// browseCmd represents the browse command
+var browseCmd = &cobra.Command{
+	Use:   "browse",
+	Short: "Interactively explore the data in a store.",
+	Long: `Starts an interactive browser for the data in a store. The browser begins
+with a list of namespaces and navigates from a namespace to its attributes,
+from an attribute to the entities that have it, and from an entity to the
+entities that it refers to or to its history. Numbered entries are opened by
+entering their number. Other commands are:
+
+  b          go back to the previous screen
+  n, p       show the next or previous page of entries
+  g ENTITY   go to an entity, written as in "canter entity"
+  q          quit
+
+The store is opened read-only.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		cfg := loadConfig(cmd)
+		cfg.Storage.ReadOnly = true
+		conn, err := cfg.Open()
+		if err != nil {
+			log.Fatalf("error opening store: %v", err)
+		}
+		defer conn.Close(cmd.Context())
+
+		b := &browser{
+			conn: conn,
+			db:   conn.DB(),
+			f:    newFormatter(conn),
+			in:   bufio.NewScanner(cmd.InOrStdin()),
+			out:  cmd.OutOrStdout(),
+		}
+		if err := b.run(namespacesScreen{}); err != nil {
+			log.Fatalf("error browsing store: %v", err)
+		}
+	},
+}
+
+// A screen is a place in the browser, which is shown as a view of the
+// database.
+type screen interface {
+	show(b *browser) (view, error)
+}
+
+// view is the content of a screen: a title and a list of entries, each of
+// which may open another screen.
+type view struct {
+	title   string
+	entries []entry
+}
+
+// entry is a line of a view. Entries with a screen are numbered so that they
+// can be opened.
+type entry struct {
+	label string
+	open  screen
+}
+
+// browser runs the interactive loop of the browse command.
+type browser struct {
+	conn *store.Connection
+	db   store.Database
+	f    *formatter
+	in   *bufio.Scanner
+	out  io.Writer
+}
+
+// run shows screens, starting with start, until the user quits or input ends.
+func (b *browser) run(start screen) error {
+	stack := []screen{start}
+	var v view
+	page := 0
+	reload := true
+	for {
+		if reload {
+			var err error
+			if v, err = stack[len(stack)-1].show(b); err != nil {
+				// The screen could not be shown, so return to the last
+				// one that could.
+				fmt.Fprintf(b.out, "error: %v\n", err)
+				if len(stack) == 1 {
+					return err
+				}
+				stack = stack[:len(stack)-1]
+				continue
+			}
+			page = 0
+			reload = false
+		}
+		links := b.render(v, page)
+
+		fmt.Fprint(b.out, "> ")
+		if !b.in.Scan() {
+			fmt.Fprintln(b.out)
+			return b.in.Err()
+		}
+		cmd, arg, _ := strings.Cut(strings.TrimSpace(b.in.Text()), " ")
+		switch cmd {
+		case "":
+		case "q":
+			return nil
+		case "b":
+			if len(stack) > 1 {
+				stack = stack[:len(stack)-1]
+				reload = true
+			}
+		case "n":
+			if (page+1)*browsePageSize < len(v.entries) {
+				page++
+			}
+		case "p":
+			if page > 0 {
+				page--
+			}
+		case "g":
+			ent, err := query.ParseEntity(arg)
+			if err != nil {
+				fmt.Fprintf(b.out, "error: %v\n", err)
+				continue
+			}
+			stack = append(stack, entityScreen{ent: ent})
+			reload = true
+		default:
+			n, err := strconv.Atoi(cmd)
+			if err != nil || n < 1 || n > len(links) {
+				fmt.Fprintf(b.out, "unknown command %q\n", cmd)
+				continue
+			}
+			stack = append(stack, links[n-1])
+			reload = true
+		}
+	}
+}
+
+// render prints a page of a view and returns the screens that its numbered
+// entries open, in order.
+func (b *browser) render(v view, page int) []screen {
+	fmt.Fprintf(b.out, "\n%s\n", v.title)
+	start := page * browsePageSize
+	end := min(start+browsePageSize, len(v.entries))
+	var links []screen
+	for _, e := range v.entries[start:end] {
+		if e.open == nil {
+			fmt.Fprintf(b.out, "      %s\n", e.label)
+			continue
+		}
+		links = append(links, e.open)
+		fmt.Fprintf(b.out, "  %2d. %s\n", len(links), e.label)
+	}
+	if len(v.entries) == 0 {
+		fmt.Fprintln(b.out, "  (none)")
+	}
+	if len(v.entries) > browsePageSize {
+		fmt.Fprintf(b.out, "  entries %d-%d of %d\n", start+1, end, len(v.entries))
+	}
+	return links
+}
+
+// namespacesScreen lists every namespace.
+type namespacesScreen struct{}
+
+func (namespacesScreen) show(b *browser) (view, error) {
+	namespaces, err := b.db.Namespaces()
+	if err != nil {
+		return view{}, err
+	}
+	v := view{title: "Namespaces"}
+	for _, ns := range namespaces {
+		label := fmt.Sprintf("%s (%d attributes)", ns.Name, len(ns.Attributes))
+		if ns.Deprecated {
+			label += " [deprecated]"
+		}
+		v.entries = append(v.entries, entry{label: label, open: attributesScreen{namespace: ns.Name}})
+	}
+	return v, nil
+}
+
+// attributesScreen lists the attributes of a namespace.
+type attributesScreen struct {
+	namespace string
+}
+
+func (s attributesScreen) show(b *browser) (view, error) {
+	ns, err := b.db.Namespace(s.namespace)
+	if err != nil {
+		return view{}, err
+	}
+	v := view{title: fmt.Sprintf("Attributes of %s", ns.Name)}
+	if ns.Doc != "" {
+		v.entries = append(v.entries, entry{label: ns.Doc})
+	}
+	deprecations := make(map[store.ID]store.Deprecation, len(ns.Deprecations))
+	for _, d := range ns.Deprecations {
+		deprecations[d.Attribute.ID] = d
+	}
+	for _, attr := range ns.Attributes {
+		label := attr.Name
+		if d, ok := deprecations[attr.ID]; ok {
+			label += " [deprecated]"
+			if d.ReplacedBy.Name != "" {
+				label += " use " + d.ReplacedBy.Name
+			}
+		}
+		v.entries = append(v.entries, entry{label: label, open: entitiesScreen{attr: attr}})
+	}
+	return v, nil
+}
+
+// entitiesScreen lists the entities that have a value for an attribute.
+type entitiesScreen struct {
+	attr store.Ident
+}
+
+func (s entitiesScreen) show(b *browser) (view, error) {
+	rows, err := b.db.Query(store.Query{
+		Find: []store.Var{"?e", "?v"},
+		Where: []store.Clause{
+			store.Pattern{Entity: store.Var("?e"), Attribute: s.attr.Name, Value: store.Var("?v")},
+		},
+	})
+	if err != nil {
+		return view{}, err
+	}
+	sort.Slice(rows, func(i, j int) bool { return rows[i][0].(store.ID) < rows[j][0].(store.ID) })
+	v := view{title: fmt.Sprintf("Entities with %s", s.attr.Name)}
+	for _, row := range rows {
+		eid := row[0].(store.ID)
+		v.entries = append(v.entries, entry{
+			label: fmt.Sprintf("%d\t%v", eid, b.f.value(row[1])),
+			open:  entityScreen{ent: eid},
+		})
+	}
+	return v, nil
+}
+
+// entityScreen shows the current attributes of an entity. References to other
+// entities can be followed.
+type entityScreen struct {
+	ent store.Resolver
+}
+
+func (s entityScreen) show(b *browser) (view, error) {
+	entity, err := b.db.GetEntity(s.ent)
+	if err != nil {
+		return view{}, err
+	}
+	data, err := entity.GetData(b.conn)
+	if err != nil {
+		return view{}, err
+	}
+	attrs := make([]string, 0, len(data))
+	for attr := range data {
+		attrs = append(attrs, attr)
+	}
+	sort.Strings(attrs)
+
+	v := view{title: fmt.Sprintf("Entity %d", entity.ID())}
+	addValue := func(attr string, val store.Value) {
+		e := entry{label: fmt.Sprintf("%s\t%v", attr, b.f.value(val))}
+		// The value of db/ident is the entity itself.
+		if ref, ok := val.(store.ID); ok && ref != entity.ID() {
+			e.open = entityScreen{ent: ref}
+		}
+		v.entries = append(v.entries, e)
+	}
+	for _, attr := range attrs {
+		if vals, ok := data[attr].([]store.Value); ok {
+			for _, val := range vals {
+				addValue(attr, val)
+			}
+			continue
+		}
+		addValue(attr, data[attr])
+	}
+	v.entries = append(v.entries, entry{label: "history", open: historyScreen{id: entity.ID()}})
+	return v, nil
+}
+
+// historyScreen lists every assertion and retraction about an entity.
+type historyScreen struct {
+	id store.ID
+}
+
+func (s historyScreen) show(b *browser) (view, error) {
+	history, err := b.db.EntityHistory(s.id)
+	if err != nil {
+		return view{}, err
+	}
+	v := view{title: fmt.Sprintf("History of entity %d", s.id)}
+	for _, ra := range history {
+		label := fmt.Sprintf("%d\t%s %s\t%v", ra.Tx, modeSymbol(ra.Mode()), b.f.name(ra.Attribute), b.f.value(ra.Value))
+		e := entry{label: label}
+		if ref, ok := ra.Value.(store.ID); ok {
+			e.open = entityScreen{ent: ref}
+		}
+		v.entries = append(v.entries, e)
+	}
+	return v, nil
+}
+
+func init() {
+	rootCmd.AddCommand(browseCmd)
+
+	browseCmd.Flags().StringP("dir", "d", "", "Directory of the store to browse")
+}
@@ -0,0 +1,136 @@
+/*
+Copyright 2024 Andrew Meredith
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+
+	"github.com/kendru/canter/internal/store"
+	"github.com/kendru/canter/internal/store/query"
+	"github.com/spf13/cobra"
+)
+
+// entityCmd represents the entity command
+var entityCmd = &cobra.Command{
+	Use:   "entity ENTITY",
+	Short: "Print the attributes of an entity.",
+	Long: `Prints the current attributes of an entity, one per line. The entity is
+written as it would be in a query: an entity ID, an ident such as
+:person/email, or a lookup such as '[:person/email "alice@example.com"]'.
+
+With --history, every fact that has been asserted or retracted about the
+entity is printed instead, in transaction order, with + for an assertion or -
+for a retraction. With --as-of, the entity is read as of an earlier
+transaction. References to entities with idents are printed as the idents. The
+store is opened read-only.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		ent, err := query.ParseEntity(args[0])
+		if err != nil {
+			log.Fatalf("error parsing entity: %v", err)
+		}
+
+		cfg := loadConfig(cmd)
+		cfg.Storage.ReadOnly = true
+		conn, err := cfg.Open()
+		if err != nil {
+			log.Fatalf("error opening store: %v", err)
+		}
+		defer conn.Close(cmd.Context())
+		db := conn.DB()
+		if cmd.Flags().Changed("as-of") {
+			asOf, _ := cmd.Flags().GetInt64("as-of")
+			db = db.AsOf(store.ID(asOf))
+		}
+
+		f := newFormatter(conn)
+		asJSON, _ := cmd.Flags().GetBool("json")
+		enc := json.NewEncoder(os.Stdout)
+		if history, _ := cmd.Flags().GetBool("history"); history {
+			assertions, err := db.EntityHistory(ent)
+			if err != nil {
+				log.Fatalf("error reading entity history: %v", err)
+			}
+			for _, ra := range assertions {
+				if asJSON {
+					err := enc.Encode(historyFact{
+						Tx:        ra.Tx,
+						Attribute: f.name(ra.Attribute),
+						Value:     f.value(ra.Value),
+						Added:     ra.Mode() == store.AssertModeAddition,
+					})
+					if err != nil {
+						log.Fatalf("error writing entity history: %v", err)
+					}
+					continue
+				}
+				fmt.Printf("%d\t%s\t%s\t%v\n", ra.Tx, modeSymbol(ra.Mode()), f.name(ra.Attribute), f.value(ra.Value))
+			}
+			return
+		}
+
+		entity, err := db.GetEntity(ent)
+		if err != nil {
+			log.Fatalf("error reading entity: %v", err)
+		}
+		data, err := entity.GetData(conn)
+		if err != nil {
+			log.Fatalf("error reading entity: %v", err)
+		}
+		if asJSON {
+			out := map[string]any{"db/id": entity.ID()}
+			for attr, val := range data {
+				out[attr] = f.value(val)
+			}
+			if err := enc.Encode(out); err != nil {
+				log.Fatalf("error writing entity: %v", err)
+			}
+			return
+		}
+		attrs := make([]string, 0, len(data))
+		for attr := range data {
+			attrs = append(attrs, attr)
+		}
+		sort.Strings(attrs)
+		fmt.Printf("db/id\t%d\n", entity.ID())
+		for _, attr := range attrs {
+			fmt.Printf("%s\t%v\n", attr, f.value(data[attr]))
+		}
+	},
+}
+
+// historyFact is the JSON representation of a fact in the history of an
+// entity.
+type historyFact struct {
+	Tx        store.ID `json:"tx"`
+	Attribute string   `json:"a"`
+	Value     any      `json:"v"`
+	Added     bool     `json:"added"`
+}
+
+func init() {
+	rootCmd.AddCommand(entityCmd)
+
+	entityCmd.Flags().StringP("dir", "d", "", "Directory of the store to read")
+	entityCmd.Flags().Bool("history", false, "Print every assertion and retraction about the entity")
+	entityCmd.Flags().Int64("as-of", 0, "ID of the transaction to read the entity as of")
+	entityCmd.Flags().Bool("json", false, "Print the entity as a JSON object, or the history as a JSON object per fact")
+}
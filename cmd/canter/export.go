@@ -0,0 +1,97 @@
+/*
+Copyright 2024 Andrew Meredith
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"log"
+	"os"
+
+	"github.com/kendru/canter/internal/store/export"
+	"github.com/spf13/cobra"
+)
+
+// exportCmd represents the export command
+var exportCmd = &cobra.Command{
+	Use:   "export",
+	Short: "Export data for use by other tools.",
+}
+
+// exportParquetCmd represents the export parquet command
+var exportParquetCmd = &cobra.Command{
+	Use:   "parquet",
+	Short: "Export attributes as a Parquet file.",
+	Long: `Writes a Parquet file with a row per entity that has a value for any of the
+given attributes. The file has a db/id column with the ID of the entity, a
+column per attribute, and db/tx and db.tx/commitTime columns that identify the
+transaction that last changed the row. The file can be read directly by tools
+such as DuckDB and Spark. The store is opened read-only, and the export reads
+from a single snapshot of it.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		attrs, _ := cmd.Flags().GetStringSlice("attrs")
+		if len(attrs) == 0 {
+			log.Fatalf("no attributes specified")
+		}
+		batchSize, _ := cmd.Flags().GetInt("batch-size")
+
+		cfg := loadConfig(cmd)
+		cfg.Storage.ReadOnly = true
+		conn, err := cfg.Open()
+		if err != nil {
+			log.Fatalf("error opening store: %v", err)
+		}
+		defer conn.Close(context.Background())
+		rt, err := conn.ReadTxn()
+		if err != nil {
+			log.Fatalf("error opening read transaction: %v", err)
+		}
+		defer rt.Close()
+
+		var out io.Writer = os.Stdout
+		if path := cmd.Flag("out").Value.String(); path != "" && path != "-" {
+			f, err := os.Create(path)
+			if err != nil {
+				log.Fatalf("error creating output file: %v", err)
+			}
+			defer f.Close()
+			out = f
+		}
+		w := bufio.NewWriter(out)
+		err = export.WriteParquet(w, conn, rt.DB(), export.Options{
+			Attributes: attrs,
+			BatchSize:  batchSize,
+		})
+		if err == nil {
+			err = w.Flush()
+		}
+		if err != nil {
+			log.Fatalf("error exporting: %v", err)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(exportCmd)
+	exportCmd.AddCommand(exportParquetCmd)
+
+	exportParquetCmd.Flags().StringP("dir", "d", "", "Directory of the store to export from")
+	exportParquetCmd.Flags().StringSlice("attrs", nil, "Comma-separated idents of the attributes to export")
+	exportParquetCmd.Flags().StringP("out", "o", "", "File to write to, or - for standard output (default)")
+	exportParquetCmd.Flags().Int("batch-size", export.DefaultBatchSize, "Maximum number of rows per row group")
+}
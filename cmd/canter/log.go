@@ -0,0 +1,211 @@
+/*
+Copyright 2024 Andrew Meredith
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/kendru/canter/internal/store"
+	"github.com/spf13/cobra"
+)
+
+// logCmd represents the log command
+var logCmd = &cobra.Command{
+	Use:   "log",
+	Short: "Print committed transactions.",
+	Long: `Prints committed transactions in commit order, starting with the transaction
+given by --from-tx, along with every fact that each transaction asserted or
+retracted. Each transaction is printed as a line with its ID and commit time,
+followed by a line per fact with + for an assertion or - for a retraction, the
+entity, the attribute, and the value. References to entities with idents are
+printed as the idents. The store is opened read-only.
+
+With --export, the transactions are written to a file that the replay command
+reads instead of being printed, and every transaction is written unless
+--limit is given.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		fromTx, _ := cmd.Flags().GetInt64("from-tx")
+		limit, _ := cmd.Flags().GetInt("limit")
+		exportPath, _ := cmd.Flags().GetString("export")
+		if exportPath != "" && !cmd.Flags().Changed("limit") {
+			limit = 0
+		}
+
+		cfg := loadConfig(cmd)
+		cfg.Storage.ReadOnly = true
+		conn, err := cfg.Open()
+		if err != nil {
+			log.Fatalf("error opening store: %v", err)
+		}
+		defer conn.Close(cmd.Context())
+		entries, err := conn.DB().TxLog(store.ID(fromTx), limit)
+		if err != nil {
+			log.Fatalf("error reading transaction log: %v", err)
+		}
+
+		if exportPath != "" {
+			if err := exportTxLog(exportPath, entries); err != nil {
+				log.Fatalf("error exporting transaction log: %v", err)
+			}
+			return
+		}
+
+		f := newFormatter(conn)
+		asJSON, _ := cmd.Flags().GetBool("json")
+		enc := json.NewEncoder(os.Stdout)
+		for _, entry := range entries {
+			if asJSON {
+				err := enc.Encode(logEntryJSON(entry, f))
+				if err != nil {
+					log.Fatalf("error writing transaction log: %v", err)
+				}
+				continue
+			}
+			fmt.Printf("tx %d\t%s\n", entry.Tx, entry.CommitTime.UTC().Format(time.RFC3339Nano))
+			for _, ra := range entry.Data {
+				fmt.Printf("  %s\t%d\t%s\t%v\n", modeSymbol(ra.Mode()), ra.EntityID, f.name(ra.Attribute), f.value(ra.Value))
+			}
+		}
+	},
+}
+
+// exportTxLog writes transactions to a file that the replay command reads.
+func exportTxLog(path string, entries []store.TxLogEntry) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+	txLog := store.NewTxLogWriter(w)
+	for _, entry := range entries {
+		if err := txLog.Write(entry); err != nil {
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// logFact is the JSON representation of a fact in the transaction log.
+type logFact struct {
+	Entity    store.ID `json:"e"`
+	Attribute string   `json:"a"`
+	Value     any      `json:"v"`
+	Added     bool     `json:"added"`
+}
+
+// logEntryJSON converts a transaction to its JSON representation.
+func logEntryJSON(entry store.TxLogEntry, f *formatter) any {
+	facts := make([]logFact, len(entry.Data))
+	for i, ra := range entry.Data {
+		facts[i] = logFact{
+			Entity:    ra.EntityID,
+			Attribute: f.name(ra.Attribute),
+			Value:     f.value(ra.Value),
+			Added:     ra.Mode() == store.AssertModeAddition,
+		}
+	}
+	return struct {
+		Tx         store.ID  `json:"tx"`
+		CommitTime string    `json:"commitTime"`
+		Facts      []logFact `json:"facts"`
+	}{entry.Tx, entry.CommitTime.UTC().Format(time.RFC3339Nano), facts}
+}
+
+// modeSymbol returns the symbol that the log prints for an assertion mode.
+func modeSymbol(mode store.AssertMode) string {
+	if mode == store.AssertModeRetraction {
+		return "-"
+	}
+	return "+"
+}
+
+// formatter prints the facts of a store for people, naming attributes and
+// referenced entities by their idents.
+type formatter struct {
+	conn *store.Connection
+	// names caches the ident of each entity, or "" for an entity without one.
+	names map[store.ID]string
+}
+
+func newFormatter(conn *store.Connection) *formatter {
+	return &formatter{conn: conn, names: make(map[store.ID]string)}
+}
+
+// ident returns the ident of an entity, if it has one.
+func (f *formatter) ident(id store.ID) (string, bool) {
+	name, ok := f.names[id]
+	if !ok {
+		if ident, err := store.ResolveIdent(f.conn, id); err == nil {
+			name = ident.Name
+		}
+		f.names[id] = name
+	}
+	return name, name != ""
+}
+
+// name returns the ident of an attribute, or its ID if it has none.
+func (f *formatter) name(id store.ID) string {
+	if name, ok := f.ident(id); ok {
+		return name
+	}
+	return fmt.Sprint(id)
+}
+
+// value formats a value for printing. References to entities with idents are
+// replaced by the idents, and times are formatted as RFC 3339 in UTC.
+func (f *formatter) value(val store.Value) any {
+	switch v := val.(type) {
+	case store.ID:
+		if name, ok := f.ident(v); ok {
+			return name
+		}
+	case time.Time:
+		return v.UTC().Format(time.RFC3339Nano)
+	case []store.Value:
+		out := make([]any, len(v))
+		for i, elem := range v {
+			out[i] = f.value(elem)
+		}
+		return out
+	case store.Tuple:
+		out := make([]any, len(v))
+		for i, elem := range v {
+			out[i] = f.value(elem)
+		}
+		return out
+	}
+	return val
+}
+
+func init() {
+	rootCmd.AddCommand(logCmd)
+
+	logCmd.Flags().StringP("dir", "d", "", "Directory of the store to read")
+	logCmd.Flags().Int64("from-tx", 0, "ID of the first transaction to print")
+	logCmd.Flags().Int("limit", 20, "Maximum number of transactions to print, or 0 for no limit")
+	logCmd.Flags().Bool("json", false, "Print each transaction as a JSON object instead of text")
+	logCmd.Flags().String("export", "", "File to write the transactions to for the replay command instead of printing them")
+}
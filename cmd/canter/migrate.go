@@ -0,0 +1,99 @@
+/*
+Copyright 2024 Andrew Meredith
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+
+	"github.com/kendru/canter/internal/config"
+	badgerImpl "github.com/kendru/canter/internal/store/badger"
+	"github.com/spf13/cobra"
+)
+
+// migrateCmd represents the migrate command
+var migrateCmd = &cobra.Command{
+	Use:   "migrate",
+	Short: "Upgrade a store to the current storage format.",
+	Long: `Inspects the storage format version of a store and applies any pending
+migrations in order. Progress is checkpointed in the store, so an interrupted
+migration resumes where it left off when the command is run again. Stores that
+were written by a newer version of canter are refused.`,
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cfg := loadConfig(cmd)
+		if cfg.Storage.Backend != config.BackendBadger {
+			return errors.New("only badger stores can be migrated")
+		}
+		opts, err := cfg.BadgerOptions()
+		if err != nil {
+			return fmt.Errorf("invalid configuration: %w", err)
+		}
+
+		// A dry run never writes, so it opens the store read-only.
+		dryRun, _ := cmd.Flags().GetBool("dry-run")
+		sto, err := badgerImpl.Open(cfg.Storage.Dir, dryRun, opts)
+		if err != nil {
+			return fmt.Errorf("opening store: %w", err)
+		}
+		defer sto.Close()
+
+		version, err := sto.FormatVersion()
+		if err != nil {
+			return fmt.Errorf("reading format version: %w", err)
+		}
+		pending, err := sto.PendingMigrations()
+		if err != nil {
+			return fmt.Errorf("listing migrations: %w", err)
+		}
+		log.Printf("store format version: %d", version)
+		if len(pending) == 0 {
+			log.Printf("store is up to date")
+			return nil
+		}
+		for _, m := range pending {
+			log.Printf("pending migration %d: %s", m.Version, m.Description)
+		}
+		if dryRun {
+			return nil
+		}
+
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+		defer stop()
+		err = sto.Migrate(ctx, func(p badgerImpl.MigrationProgress) {
+			if p.Done {
+				log.Printf("migration %d complete: %d records rewritten", p.Version, p.Records)
+			} else {
+				log.Printf("migration %d: %d records rewritten", p.Version, p.Records)
+			}
+		})
+		if err != nil {
+			return fmt.Errorf("migrating store: %w", err)
+		}
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(migrateCmd)
+
+	migrateCmd.Flags().StringP("dir", "d", "", "Directory of the store to migrate")
+	migrateCmd.Flags().Bool("dry-run", false, "List pending migrations without applying them")
+}
@@ -0,0 +1,106 @@
+/*
+Copyright 2024 Andrew Meredith
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/kendru/canter/internal/store"
+	"github.com/kendru/canter/internal/store/query"
+	"github.com/spf13/cobra"
+)
+
+// queryCmd represents the query command
+var queryCmd = &cobra.Command{
+	Use:   "query QUERY",
+	Short: "Run a query against a store.",
+	Long: `Runs a query against the current state of a store and prints the results, one
+row per line. The query is written in canter's EDN-like query syntax, e.g.
+
+  canter query -d data '[:find ?email :where [?e :person/email ?email]]'
+
+Pass - to read the query from standard input. The store is opened read-only.`,
+	Args:         cobra.ExactArgs(1),
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		src := args[0]
+		if src == "-" {
+			b, err := io.ReadAll(os.Stdin)
+			if err != nil {
+				return fmt.Errorf("reading query: %w", err)
+			}
+			src = string(b)
+		}
+		q, err := query.Parse(src)
+		if err != nil {
+			return fmt.Errorf("parsing query: %w", err)
+		}
+
+		cfg := loadConfig(cmd)
+		cfg.Storage.ReadOnly = true
+		conn, err := cfg.Open()
+		if err != nil {
+			return fmt.Errorf("opening store: %w", err)
+		}
+		defer conn.Close(cmd.Context())
+		rows, err := conn.DB().Query(q)
+		if err != nil {
+			return fmt.Errorf("running query: %w", err)
+		}
+
+		asJSON, _ := cmd.Flags().GetBool("json")
+		enc := json.NewEncoder(os.Stdout)
+		for _, row := range rows {
+			if asJSON {
+				if err := enc.Encode(row); err != nil {
+					return fmt.Errorf("writing results: %w", err)
+				}
+				continue
+			}
+			cols := make([]string, len(row))
+			for i, val := range row {
+				if cols[i], err = formatColumn(val); err != nil {
+					return fmt.Errorf("writing results: %w", err)
+				}
+			}
+			fmt.Println(strings.Join(cols, "\t"))
+		}
+		return nil
+	},
+}
+
+// formatColumn formats a value as a column of tab-separated output. Values are
+// encoded as JSON, as they are by the /query endpoint of the serve command,
+// except that strings are printed without quotes.
+func formatColumn(val store.Value) (string, error) {
+	if s, ok := val.(string); ok {
+		return s, nil
+	}
+	b, err := json.Marshal(val)
+	return string(b), err
+}
+
+func init() {
+	rootCmd.AddCommand(queryCmd)
+
+	queryCmd.Flags().StringP("dir", "d", "", "Directory of the store to query")
+	queryCmd.Flags().Bool("json", false, "Print each row as a JSON array instead of tab-separated values")
+}
@@ -0,0 +1,101 @@
+/*
+Copyright 2024 Andrew Meredith
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"log"
+	"os"
+
+	"github.com/kendru/canter/internal/store"
+	"github.com/spf13/cobra"
+)
+
+// replayCmd represents the replay command
+var replayCmd = &cobra.Command{
+	Use:   "replay",
+	Short: "Reconstruct a store from an exported transaction log.",
+	Long: `Replays a transaction log written by log --export into the store given by
+--target, committing every transaction with the IDs, commit time, and facts
+that it was originally committed with. With --until-tx, the transactions after
+the given one are not replayed, which reconstructs the store as it was at that
+transaction for reproducing bugs.
+
+The target must be empty, or must have been reconstructed from an earlier part
+of the same log, in which case the replay resumes after the latest transaction
+in it. Since the indexes of the target are rebuilt from the log alone,
+comparing the output of the log command for the original store and the
+reconstructed one validates that the indexes are a function of the log.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		logPath, _ := cmd.Flags().GetString("log")
+		target, _ := cmd.Flags().GetString("target")
+		untilTx, _ := cmd.Flags().GetInt64("until-tx")
+		if logPath == "" || target == "" {
+			log.Fatalf("--log and --target are required")
+		}
+
+		f, err := os.Open(logPath)
+		if err != nil {
+			log.Fatalf("error opening transaction log: %v", err)
+		}
+		defer f.Close()
+
+		cfg := loadConfig(cmd)
+		cfg.Storage.ReadOnly = false
+		conn, err := cfg.OpenUninitialized()
+		if err != nil {
+			log.Fatalf("error opening store: %v", err)
+		}
+		defer conn.Close(cmd.Context())
+
+		var replayed int
+		r := store.NewTxLogReader(bufio.NewReader(f))
+		for {
+			entry, err := r.Read()
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				log.Fatalf("error replaying: %v", err)
+			}
+			if untilTx > 0 && entry.Tx > store.ID(untilTx) {
+				break
+			}
+			err = conn.Replay(entry)
+			if errors.Is(err, store.ErrReplayed) {
+				// The target was reconstructed from an earlier part
+				// of the log.
+				continue
+			}
+			if err != nil {
+				log.Fatalf("error replaying: %v", err)
+			}
+			replayed++
+		}
+		logger.Info("replay complete", "transactions", replayed, "basis", conn.DB().Basis.ID())
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(replayCmd)
+
+	replayCmd.Flags().String("log", "", "Transaction log written by log --export")
+	replayCmd.Flags().String("target", "", "Directory of the store to reconstruct")
+	replayCmd.Flags().Int64("until-tx", 0, "ID of the last transaction to replay, or 0 to replay every transaction")
+}
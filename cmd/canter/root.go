@@ -0,0 +1,80 @@
+/*
+Copyright 2024 Andrew Meredith
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"log"
+	"log/slog"
+	"os"
+
+	"github.com/kendru/canter/internal/config"
+	"github.com/spf13/cobra"
+)
+
+// rootCmd represents the base command when called without any subcommands
+var rootCmd = &cobra.Command{
+	Use:   "canter",
+	Short: "Administer Canter databases",
+}
+
+func init() {
+	rootCmd.PersistentFlags().String("config", "", "Configuration file (settings may also be given by CANTER_* environment variables)")
+}
+
+// logger is the logger configured by loadConfig. Fatal errors are reported
+// with the log package before the configuration is loaded and after.
+var logger = slog.Default()
+
+// loadConfig loads the configuration given by the --config flag and the
+// environment, applies any of the command's flags that were set explicitly,
+// and configures logger. It exits if the configuration is invalid.
+func loadConfig(cmd *cobra.Command) config.Config {
+	path, _ := cmd.Flags().GetString("config")
+	cfg, err := config.Load(path, os.LookupEnv, func(cfg *config.Config) {
+		flags := cmd.Flags()
+		if flags.Changed("dir") {
+			cfg.Storage.Backend = config.BackendBadger
+			cfg.Storage.Dir, _ = flags.GetString("dir")
+		}
+		if flags.Changed("target") {
+			cfg.Storage.Backend = config.BackendBadger
+			cfg.Storage.Dir, _ = flags.GetString("target")
+		}
+		if flags.Changed("read-only") {
+			cfg.Storage.ReadOnly, _ = flags.GetBool("read-only")
+		}
+		if flags.Changed("addr") {
+			cfg.Server.Addr, _ = flags.GetString("addr")
+		}
+		if flags.Changed("max-lag") {
+			cfg.Server.MaxLag, _ = flags.GetDuration("max-lag")
+		}
+		if flags.Changed("history-collection-interval") {
+			cfg.Server.HistoryCollectionInterval, _ = flags.GetDuration("history-collection-interval")
+		}
+		if flags.Changed("warmup") {
+			cfg.Server.Warmup, _ = flags.GetBool("warmup")
+		}
+		if flags.Changed("warmup-attribute") {
+			cfg.Server.WarmupAttributes, _ = flags.GetStringSlice("warmup-attribute")
+		}
+	})
+	if err != nil {
+		log.Fatalf("invalid configuration: %v", err)
+	}
+	logger = cfg.Log.NewLogger(os.Stderr)
+	return cfg
+}
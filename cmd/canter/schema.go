@@ -0,0 +1,134 @@
+/*
+Copyright 2024 Andrew Meredith
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+// schemaCmd represents the schema command
+var schemaCmd = &cobra.Command{
+	Use:   "schema",
+	Short: "Export and apply schema files, and review inferred schema.",
+}
+
+// schemaExportCmd represents the schema export command
+var schemaExportCmd = &cobra.Command{
+	Use:   "export",
+	Short: "Write the schema of a store as an EDN file.",
+	Long: `Writes every attribute, namespace, and enumerated value of a store as an
+EDN vector of maps. Entities are written after the entities that they refer to,
+so the file can be applied to another store with "canter schema apply". The
+store is opened read-only.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		cfg := loadConfig(cmd)
+		cfg.Storage.ReadOnly = true
+		conn, err := cfg.Open()
+		if err != nil {
+			log.Fatalf("error opening store: %v", err)
+		}
+		defer conn.Close(context.Background())
+
+		var out io.Writer = os.Stdout
+		if path := cmd.Flag("out").Value.String(); path != "" && path != "-" {
+			f, err := os.Create(path)
+			if err != nil {
+				log.Fatalf("error creating output file: %v", err)
+			}
+			defer f.Close()
+			out = f
+		}
+		w := bufio.NewWriter(out)
+		err = conn.DB().ExportSchema(w)
+		if err == nil {
+			err = w.Flush()
+		}
+		if err != nil {
+			log.Fatalf("error exporting schema: %v", err)
+		}
+	},
+}
+
+// schemaApplyCmd represents the schema apply command
+var schemaApplyCmd = &cobra.Command{
+	Use:   "apply FILE",
+	Short: "Apply a schema file to a store.",
+	Long: `Applies a schema file, such as one written by "canter schema export", in a
+single transaction. Entities that already exist are matched by their idents, so
+applying the same file again leaves the schema unchanged.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		cfg := loadConfig(cmd)
+		conn, err := cfg.Open()
+		if err != nil {
+			log.Fatalf("error opening store: %v", err)
+		}
+		defer conn.Close(context.Background())
+
+		res, err := conn.ApplySchemaFile(args[0])
+		if err != nil {
+			log.Fatalf("error applying schema: %v", err)
+		}
+		log.Printf("applied schema in transaction %d", res.TxID())
+	},
+}
+
+// schemaInferredCmd represents the schema inferred command
+var schemaInferredCmd = &cobra.Command{
+	Use:   "inferred",
+	Short: "List the attributes created by schema inference.",
+	Long: `Lists every attribute that was created in soft schema mode (schema.infer) and
+is still marked as inferred, with its type and the transaction that created it.
+An attribute is hardened once it has been reviewed by retracting its
+db/inferred. The store is opened read-only.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		cfg := loadConfig(cmd)
+		cfg.Storage.ReadOnly = true
+		conn, err := cfg.Open()
+		if err != nil {
+			log.Fatalf("error opening store: %v", err)
+		}
+		defer conn.Close(context.Background())
+
+		inferred, err := conn.DB().InferredSchema()
+		if err != nil {
+			log.Fatalf("error reading inferred schema: %v", err)
+		}
+		for _, attr := range inferred {
+			fmt.Printf("%s\t%s\t%d\n", attr.Attribute.Name, attr.Type.Name, attr.Tx)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(schemaCmd)
+	schemaCmd.AddCommand(schemaExportCmd)
+	schemaCmd.AddCommand(schemaApplyCmd)
+	schemaCmd.AddCommand(schemaInferredCmd)
+
+	schemaExportCmd.Flags().StringP("dir", "d", "", "Directory of the store to export from")
+	schemaExportCmd.Flags().StringP("out", "o", "", "File to write to, or - for standard output (default)")
+	schemaApplyCmd.Flags().StringP("dir", "d", "", "Directory of the store to apply the schema to")
+	schemaInferredCmd.Flags().StringP("dir", "d", "", "Directory of the store to read")
+}
@@ -0,0 +1,134 @@
+/*
+Copyright 2024 Andrew Meredith
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"time"
+
+	"github.com/kendru/canter/internal/health"
+	"github.com/kendru/canter/internal/store"
+	"github.com/kendru/canter/internal/store/query"
+	"github.com/spf13/cobra"
+)
+
+// serveCmd represents the serve command
+var serveCmd = &cobra.Command{
+	Use:   "serve",
+	Short: "Serve a store over HTTP.",
+	Long: `Opens a store and serves it over HTTP until interrupted. The server exposes
+/healthz and /readyz endpoints for orchestrators, which respond with 503 when
+the store is unreachable or not ready to serve, and a /metrics endpoint in the
+Prometheus text format. Queries written in canter's query syntax may be POSTed
+to /query, which responds with their results as JSON. GET /backup streams a
+consistent backup of the store, which the restore command loads.
+
+With --warmup, the server preloads the idents and schema of the store, and the
+index entries of each --warmup-attribute, before it starts listening, so that
+its first requests do not pay for cold caches.
+
+Unless the store is read-only, the server discards expired history every
+--history-collection-interval, as declared by db/historyRetention in the
+schema.
+
+Settings are read from the --config file and CANTER_* environment variables;
+flags that are given override them.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		cfg := loadConfig(cmd)
+		conn, err := cfg.Open()
+		if err != nil {
+			log.Fatalf("error opening store: %v", err)
+		}
+
+		if cfg.Server.Warmup {
+			spec := store.WarmupSpec{Entities: cfg.Cache.Entities > 0}
+			for _, name := range cfg.Server.WarmupAttributes {
+				spec.Attributes = append(spec.Attributes, store.WarmupAttribute{Attribute: name})
+			}
+			stats, err := conn.Warmup(context.Background(), spec)
+			if err != nil {
+				log.Fatalf("error warming up: %v", err)
+			}
+			logger.Info("warmed up",
+				"idents", stats.Idents,
+				"schemaEntities", stats.SchemaEntities,
+				"entries", stats.Entries,
+				"entities", stats.Entities,
+				"duration", stats.Duration)
+		}
+
+		mux := http.NewServeMux()
+		mux.Handle("/", health.Handler(conn, health.Options{
+			RequireTransactor: !cfg.Storage.ReadOnly,
+			MaxLag:            cfg.Server.MaxLag,
+		}))
+		mux.Handle("/query", query.Handler(conn))
+		mux.Handle("/backup", backupHandler(conn))
+		srv := &http.Server{
+			Addr:              cfg.Server.Addr,
+			Handler:           mux,
+			ReadHeaderTimeout: 10 * time.Second,
+		}
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+		defer stop()
+		shutdown := make(chan struct{})
+		go func() {
+			defer close(shutdown)
+			<-ctx.Done()
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			if err := srv.Shutdown(shutdownCtx); err != nil {
+				logger.Error("error shutting down", "error", err)
+			}
+			if err := conn.Close(shutdownCtx); err != nil {
+				logger.Error("error closing store", "error", err)
+			}
+		}()
+
+		if interval := cfg.Server.HistoryCollectionInterval; interval > 0 && !cfg.Storage.ReadOnly {
+			go func() {
+				err := conn.NewHistoryCollector(interval).Run(ctx)
+				if err != nil && !errors.Is(err, context.Canceled) && !errors.Is(err, store.ErrClosed) {
+					logger.Error("error collecting history", "error", err)
+				}
+			}()
+		}
+
+		logger.Info("serving", "addr", cfg.Server.Addr)
+		if err := srv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+			log.Fatalf("error serving: %v", err)
+		}
+		<-shutdown
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(serveCmd)
+
+	serveCmd.Flags().StringP("dir", "d", "", "Directory of the store to serve")
+	serveCmd.Flags().String("addr", ":7070", "Address to listen on")
+	serveCmd.Flags().Bool("read-only", false, "Open the store read-only")
+	serveCmd.Flags().Duration("max-lag", 0, "Replication lag beyond which the server is not ready (0 disables)")
+	serveCmd.Flags().Duration("history-collection-interval", 0, "How often to discard expired history (0 disables)")
+	serveCmd.Flags().Bool("warmup", false, "Preload idents, schema, and hot attributes before serving")
+	serveCmd.Flags().StringSlice("warmup-attribute", nil, "Hot attribute to preload with --warmup (may be repeated)")
+}
@@ -0,0 +1,113 @@
+/*
+Copyright 2024 Andrew Meredith
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/kendru/canter/internal/store"
+	"github.com/spf13/cobra"
+)
+
+// verifyCmd represents the verify command
+var verifyCmd = &cobra.Command{
+	Use:   "verify",
+	Short: "Verify the transaction log against the roots of its transactions.",
+	Long: `Recomputes the Merkle root of the facts of every transaction in the store and
+compares it with the root that was recorded when the transaction was
+committed, printing each transaction whose facts have changed since. The store
+is opened read-only.
+
+The last line printed is the root of the whole log, which is the same for any
+two stores with the same transactions, so a replica may be compared with its
+source by running verify against both. Transactions committed before roots
+were recorded are counted as unrooted, and the command exits with status 1 if
+any transaction fails to verify.
+
+With --log, the store is verified against a transaction log written by log
+--export instead, such as one kept with a backup: every transaction of the log
+must match its root and the same transaction of the store, and every
+transaction of the store up to the end of the log must be in the log. If the
+store has no later transactions, the facts of its indexes must also be the
+facts that the log leaves current, which proves that the store holds exactly
+the history that the log records.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		cfg := loadConfig(cmd)
+		cfg.Storage.ReadOnly = true
+		conn, err := cfg.Open()
+		if err != nil {
+			log.Fatalf("error opening store: %v", err)
+		}
+		defer conn.Close(cmd.Context())
+
+		if logPath, _ := cmd.Flags().GetString("log"); logPath != "" {
+			if !verifyAgainstLog(conn.DB(), logPath) {
+				conn.Close(cmd.Context())
+				os.Exit(1)
+			}
+			return
+		}
+		res, err := conn.DB().VerifyTxLog()
+		if err != nil {
+			log.Fatalf("error verifying transaction log: %v", err)
+		}
+		for _, err := range res.Failed {
+			fmt.Println(err)
+		}
+		fmt.Printf("%d verified, %d unrooted, %d failed\n", res.Verified, res.Unrooted, len(res.Failed))
+		fmt.Printf("root %x\n", res.Root)
+		if len(res.Failed) > 0 {
+			conn.Close(cmd.Context())
+			os.Exit(1)
+		}
+	},
+}
+
+// verifyAgainstLog verifies a store against an exported transaction log and
+// reports whether it matched.
+func verifyAgainstLog(db store.Database, logPath string) bool {
+	f, err := os.Open(logPath)
+	if err != nil {
+		log.Fatalf("error opening transaction log: %v", err)
+	}
+	defer f.Close()
+	res, err := db.VerifyLog(store.NewTxLogReader(bufio.NewReader(f)))
+	if err != nil {
+		log.Fatalf("error verifying store against transaction log: %v", err)
+	}
+	for _, err := range res.Failed {
+		fmt.Println(err)
+	}
+	fmt.Printf("%d verified, %d later, %d failed\n", res.Verified, res.Later, len(res.Failed))
+	if res.IndexesChecked {
+		fmt.Printf("state %x\n", res.StateRoot)
+	} else {
+		fmt.Println("indexes not checked: the store has transactions after the log")
+	}
+	fmt.Printf("root %x\n", res.Root)
+	return len(res.Failed) == 0
+}
+
+func init() {
+	rootCmd.AddCommand(verifyCmd)
+
+	verifyCmd.Flags().StringP("dir", "d", "", "Directory of the store to verify")
+	verifyCmd.Flags().String("log", "", "Transaction log written by log --export to verify the store against")
+}
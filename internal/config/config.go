@@ -0,0 +1,571 @@
+/*
+Copyright 2024 Andrew Meredith
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package config loads the configuration of a canter process from a YAML
+// file and the environment.
+//
+// A configuration file looks like:
+//
+//	storage:
+//	  backend: badger
+//	  dir: /var/lib/canter
+//	  compression: zstd
+//	cache:
+//	  entities: 10000
+//	limits:
+//	  maxTxFacts: 100000
+//	log:
+//	  level: info
+//	  format: json
+//	server:
+//	  addr: ":7070"
+//	  maxLag: 5s
+//	  historyCollectionInterval: 1h
+//
+// Every setting may also be given by an environment variable named after its
+// path in the file, e.g. CANTER_STORAGE_DIR or CANTER_LIMITS_MAX_TX_FACTS.
+// Environment variables take precedence over the file, which takes precedence
+// over the defaults.
+package config
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/kendru/canter/internal/store"
+	badgerImpl "github.com/kendru/canter/internal/store/badger"
+	"github.com/kendru/canter/internal/store/partitioned"
+	"gopkg.in/yaml.v3"
+)
+
+// EnvPrefix is the prefix of the environment variables that configure canter.
+const EnvPrefix = "CANTER"
+
+// Storage backends.
+const (
+	BackendBadger = "badger"
+	BackendMemory = "memory"
+)
+
+type Config struct {
+	Storage Storage `yaml:"storage"`
+	Cache   Cache   `yaml:"cache"`
+	Limits  Limits  `yaml:"limits"`
+	Log     Log     `yaml:"log"`
+	SlowLog SlowLog `yaml:"slowLog"`
+	Schema  Schema  `yaml:"schema"`
+	Server  Server  `yaml:"server"`
+}
+
+type Storage struct {
+	// Backend is BackendBadger, which stores data in Dir, or BackendMemory,
+	// which holds data in memory until the process exits.
+	Backend  string `yaml:"backend"`
+	Dir      string `yaml:"dir"`
+	ReadOnly bool   `yaml:"readOnly"`
+	// Compression is the compression of every table that holds large values:
+	// "none", "snappy", or "zstd".
+	Compression string `yaml:"compression"`
+	// MaxInlineValueSize is the largest value, in bytes, that is stored
+	// inline in index entries.
+	MaxInlineValueSize int `yaml:"maxInlineValueSize"`
+	// EncryptionKeyFile is a file that holds the 16, 24, or 32 byte key with
+	// which the database is encrypted at rest. If empty, the database is not
+	// encrypted.
+	EncryptionKeyFile string `yaml:"encryptionKeyFile"`
+	// ValueLogGCInterval is how often the storage engine reclaims the space
+	// of overwritten values. If zero, space is never reclaimed.
+	ValueLogGCInterval time.Duration `yaml:"valueLogGCInterval"`
+	// Partitions is the number of entity partitions, numbered from 1, whose
+	// entities are kept in stores of their own, each in a subdirectory of
+	// Dir/partitions. Partition 0 is always kept in Dir. Partitions may be
+	// added later but not removed. If zero, every entity is kept in Dir.
+	Partitions int `yaml:"partitions"`
+}
+
+type Cache struct {
+	// Entities is the number of recently read entities that a connection
+	// caches. If zero, entities are not cached.
+	Entities int `yaml:"entities"`
+	// Idents bounds the number of idents that a connection caches. If zero,
+	// every ident is loaded into the cache when the connection is opened.
+	Idents int `yaml:"idents"`
+	// BlockBytes is the size of the storage engine's block cache. If zero,
+	// the engine's default is used.
+	BlockBytes int64 `yaml:"blockBytes"`
+}
+
+type Limits struct {
+	// MaxTxFacts limits the number of facts that a single transaction may
+	// assert. If zero, transactions are unlimited.
+	MaxTxFacts int `yaml:"maxTxFacts"`
+	// TxRate is the number of transactions per second that a connection
+	// may commit on average, and TxBurst is the number that it may commit at
+	// once after it has been idle. If TxRate is zero, the rate is not
+	// limited. If TxBurst is zero, it is TxRate rounded up.
+	TxRate  float64 `yaml:"txRate"`
+	TxBurst int     `yaml:"txBurst"`
+	// MaxTxInFlight caps the number of transactions that may be committing at
+	// once. If zero, it is not capped.
+	MaxTxInFlight int `yaml:"maxTxInFlight"`
+	// MaxTxWait is how long a transaction may wait to be admitted by the
+	// limits above before it is rejected as throttled.
+	MaxTxWait time.Duration `yaml:"maxTxWait"`
+	// MemoryBudget is the number of bytes that a connection's entity cache
+	// and its scans and queries in progress may hold at once. If zero, it is
+	// unlimited.
+	MemoryBudget int64 `yaml:"memoryBudget"`
+}
+
+type Log struct {
+	// Level is "debug", "info", "warn", or "error".
+	Level string `yaml:"level"`
+	// Format is "text" or "json".
+	Format string `yaml:"format"`
+}
+
+type SlowLog struct {
+	// TxThreshold is the duration beyond which a transaction is logged as
+	// slow. If zero, transactions are not logged.
+	TxThreshold time.Duration `yaml:"txThreshold"`
+	// QueryThreshold is the duration beyond which a query is logged as slow.
+	// If zero, queries are not logged.
+	QueryThreshold time.Duration `yaml:"queryThreshold"`
+	// Size is the number of slow operations that a connection keeps in
+	// memory. If zero, the store's default is used.
+	Size int `yaml:"size"`
+}
+
+type Schema struct {
+	// Infer enables soft schema mode: asserting an unknown attribute creates
+	// it with a type inferred from its value instead of failing. It suits
+	// exploratory data, whose inferred schema is reviewed later.
+	Infer bool `yaml:"infer"`
+}
+
+type Server struct {
+	// Addr is the address that the server listens on.
+	Addr string `yaml:"addr"`
+	// MaxLag is how far a server may trail its transactor and remain ready.
+	// If zero, lag does not affect readiness.
+	MaxLag time.Duration `yaml:"maxLag"`
+	// HistoryCollectionInterval is how often a writable server discards the
+	// history that the retention policies of its schema no longer require. If
+	// zero, history is kept forever.
+	HistoryCollectionInterval time.Duration `yaml:"historyCollectionInterval"`
+	// Warmup preloads the idents and schema of the store before the server
+	// starts listening, along with the index entries of WarmupAttributes.
+	Warmup bool `yaml:"warmup"`
+	// WarmupAttributes are the names of hot attributes to preload when
+	// Warmup is set. In the environment, names are separated by commas.
+	WarmupAttributes []string `yaml:"warmupAttributes"`
+}
+
+// Default returns the configuration used for settings that are not given.
+func Default() Config {
+	defaults := badgerImpl.DefaultOptions()
+	return Config{
+		Storage: Storage{
+			Backend:            BackendBadger,
+			Compression:        badgerImpl.CompressionNone.String(),
+			MaxInlineValueSize: defaults.MaxInlineValueSize,
+		},
+		Log: Log{
+			Level:  "info",
+			Format: "text",
+		},
+		Server: Server{
+			Addr: ":7070",
+		},
+	}
+}
+
+// Load reads the configuration file at path, if path is not empty, applies
+// the environment variables found by lookupEnv and then the overrides, and
+// validates the result. lookupEnv is typically os.LookupEnv, and overrides
+// typically apply command-line flags.
+func Load(path string, lookupEnv func(string) (string, bool), overrides ...func(*Config)) (Config, error) {
+	cfg := Default()
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return Config{}, fmt.Errorf("reading config file: %w", err)
+		}
+		if err := cfg.decode(data); err != nil {
+			return Config{}, fmt.Errorf("config file %s: %w", path, err)
+		}
+	}
+	if lookupEnv != nil {
+		if err := applyEnv(reflect.ValueOf(&cfg).Elem(), EnvPrefix, lookupEnv); err != nil {
+			return Config{}, err
+		}
+	}
+	for _, override := range overrides {
+		override(&cfg)
+	}
+	if err := cfg.Validate(); err != nil {
+		return Config{}, err
+	}
+	return cfg, nil
+}
+
+// decode overlays the settings in a YAML document onto the configuration.
+// Unknown settings are rejected, so that misspellings are not ignored.
+func (cfg *Config) decode(data []byte) error {
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	return nil
+}
+
+// applyEnv sets each field of v from the environment variable named after its
+// YAML path.
+func applyEnv(v reflect.Value, prefix string, lookupEnv func(string) (string, bool)) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := prefix + "_" + envName(field.Tag.Get("yaml"))
+		fv := v.Field(i)
+		if field.Type.Kind() == reflect.Struct {
+			if err := applyEnv(fv, name, lookupEnv); err != nil {
+				return err
+			}
+			continue
+		}
+		s, ok := lookupEnv(name)
+		if !ok {
+			continue
+		}
+		if err := setField(fv, s); err != nil {
+			return fmt.Errorf("environment variable %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// envName converts a camel-case YAML key to the upper snake case of an
+// environment variable.
+func envName(key string) string {
+	var b strings.Builder
+	for i, r := range key {
+		if unicode.IsUpper(r) && i > 0 {
+			b.WriteByte('_')
+		}
+		b.WriteRune(unicode.ToUpper(r))
+	}
+	return b.String()
+}
+
+func setField(v reflect.Value, s string) error {
+	if v.Type() == reflect.TypeOf(time.Duration(0)) {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(d))
+		return nil
+	}
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return err
+		}
+		v.SetFloat(f)
+	case reflect.Slice:
+		if v.Type().Elem().Kind() != reflect.String {
+			return fmt.Errorf("unsupported setting type %s", v.Type())
+		}
+		var elems []string
+		for _, elem := range strings.Split(s, ",") {
+			if elem = strings.TrimSpace(elem); elem != "" {
+				elems = append(elems, elem)
+			}
+		}
+		v.Set(reflect.ValueOf(elems))
+	default:
+		return fmt.Errorf("unsupported setting type %s", v.Type())
+	}
+	return nil
+}
+
+// Validate checks that every setting has a valid value.
+func (cfg Config) Validate() error {
+	var errs []error
+	switch cfg.Storage.Backend {
+	case BackendBadger:
+		if cfg.Storage.Dir == "" {
+			errs = append(errs, errors.New("storage.dir is required for the badger backend"))
+		}
+	case BackendMemory:
+		if cfg.Storage.ReadOnly {
+			errs = append(errs, errors.New("storage.readOnly is not supported by the memory backend"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("storage.backend: unknown backend %q", cfg.Storage.Backend))
+	}
+	if _, err := badgerImpl.ParseCompression(cfg.Storage.Compression); err != nil {
+		errs = append(errs, fmt.Errorf("storage.compression: %w", err))
+	}
+	if cfg.Storage.ValueLogGCInterval < 0 {
+		errs = append(errs, errors.New("storage.valueLogGCInterval must not be negative"))
+	}
+	if cfg.Storage.Partitions < 0 || cfg.Storage.Partitions > int(store.MaxPartition) {
+		errs = append(errs, fmt.Errorf("storage.partitions must be between 0 and %d", store.MaxPartition))
+	}
+	if cfg.Storage.MaxInlineValueSize <= 0 {
+		errs = append(errs, errors.New("storage.maxInlineValueSize must be positive"))
+	}
+	if cfg.Cache.Entities < 0 {
+		errs = append(errs, errors.New("cache.entities must not be negative"))
+	}
+	if cfg.Cache.Idents < 0 {
+		errs = append(errs, errors.New("cache.idents must not be negative"))
+	}
+	if cfg.Cache.BlockBytes < 0 {
+		errs = append(errs, errors.New("cache.blockBytes must not be negative"))
+	}
+	if cfg.Limits.MaxTxFacts < 0 {
+		errs = append(errs, errors.New("limits.maxTxFacts must not be negative"))
+	}
+	if cfg.Limits.TxRate < 0 {
+		errs = append(errs, errors.New("limits.txRate must not be negative"))
+	}
+	if cfg.Limits.TxBurst < 0 {
+		errs = append(errs, errors.New("limits.txBurst must not be negative"))
+	}
+	if cfg.Limits.MaxTxInFlight < 0 {
+		errs = append(errs, errors.New("limits.maxTxInFlight must not be negative"))
+	}
+	if cfg.Limits.MaxTxWait < 0 {
+		errs = append(errs, errors.New("limits.maxTxWait must not be negative"))
+	}
+	if cfg.Limits.MemoryBudget < 0 {
+		errs = append(errs, errors.New("limits.memoryBudget must not be negative"))
+	}
+	if _, err := cfg.Log.level(); err != nil {
+		errs = append(errs, err)
+	}
+	if cfg.Log.Format != "text" && cfg.Log.Format != "json" {
+		errs = append(errs, fmt.Errorf("log.format: unknown format %q", cfg.Log.Format))
+	}
+	if cfg.SlowLog.TxThreshold < 0 {
+		errs = append(errs, errors.New("slowLog.txThreshold must not be negative"))
+	}
+	if cfg.SlowLog.QueryThreshold < 0 {
+		errs = append(errs, errors.New("slowLog.queryThreshold must not be negative"))
+	}
+	if cfg.SlowLog.Size < 0 {
+		errs = append(errs, errors.New("slowLog.size must not be negative"))
+	}
+	if cfg.Server.Addr == "" {
+		errs = append(errs, errors.New("server.addr is required"))
+	}
+	if cfg.Server.MaxLag < 0 {
+		errs = append(errs, errors.New("server.maxLag must not be negative"))
+	}
+	if cfg.Server.HistoryCollectionInterval < 0 {
+		errs = append(errs, errors.New("server.historyCollectionInterval must not be negative"))
+	}
+	return errors.Join(errs...)
+}
+
+// Open opens the configured storage and returns a connection to it. Writable
+// databases are initialized. Closing the connection closes the storage.
+func (cfg Config) Open() (*store.Connection, error) {
+	conn, err := cfg.OpenUninitialized()
+	if err != nil {
+		return nil, err
+	}
+	if !cfg.Storage.ReadOnly {
+		if err := conn.InitializeDB(); err != nil {
+			return nil, errors.Join(fmt.Errorf("initializing database: %w", err), conn.Close(context.Background()))
+		}
+	}
+	return conn, nil
+}
+
+// OpenUninitialized is like Open, except that the system schema of a writable
+// database is neither initialized nor upgraded. It is for tools that write
+// the system schema themselves, such as replaying a transaction log.
+func (cfg Config) OpenUninitialized() (*store.Connection, error) {
+	opts, err := cfg.BadgerOptions()
+	if err != nil {
+		return nil, err
+	}
+
+	sto, err := cfg.openStore(cfg.Storage.Dir, opts)
+	if err != nil {
+		return nil, fmt.Errorf("opening store: %w", err)
+	}
+	var (
+		ids     store.IDManager = sto
+		indexer store.Indexer   = sto
+	)
+	if cfg.Storage.Partitions > 0 {
+		ix, err := cfg.openPartitions(sto, opts)
+		if err != nil {
+			return nil, errors.Join(err, sto.Close())
+		}
+		ids, indexer = ix, ix
+	}
+
+	var admission *store.AdmissionController
+	if cfg.Limits.TxRate > 0 || cfg.Limits.MaxTxInFlight > 0 {
+		admission = store.NewAdmissionController(store.AdmissionConfig{
+			Rate:        cfg.Limits.TxRate,
+			Burst:       cfg.Limits.TxBurst,
+			MaxInFlight: cfg.Limits.MaxTxInFlight,
+			MaxWait:     cfg.Limits.MaxTxWait,
+		})
+	}
+	conn := store.NewConnection(store.Config{
+		IdentManager:    sto,
+		IDManager:       ids,
+		Indexer:         indexer,
+		BlobStore:       sto,
+		MaxTxFacts:      cfg.Limits.MaxTxFacts,
+		ReadOnly:        cfg.Storage.ReadOnly,
+		EntityCacheSize: cfg.Cache.Entities,
+		IdentCacheSize:  cfg.Cache.Idents,
+		MemoryBudget:    cfg.Limits.MemoryBudget,
+		Admission:       admission,
+		InferSchema:     cfg.Schema.Infer,
+		SlowLog: store.SlowLogConfig{
+			TxThreshold:    cfg.SlowLog.TxThreshold,
+			QueryThreshold: cfg.SlowLog.QueryThreshold,
+			Size:           cfg.SlowLog.Size,
+			Logger:         cfg.Log.NewLogger(os.Stderr),
+		},
+	})
+	return conn, nil
+}
+
+// openStore opens the badger store in dir, or in memory for the memory
+// backend.
+func (cfg Config) openStore(dir string, opts badgerImpl.Options) (badgerStore, error) {
+	if cfg.Storage.Backend == BackendMemory {
+		return badgerImpl.OpenInMemory(opts)
+	}
+	return badgerImpl.Open(dir, cfg.Storage.ReadOnly, opts)
+}
+
+// openPartitions opens the store of each configured partition and routes the
+// partitions to them, keeping partition 0 in home.
+func (cfg Config) openPartitions(home badgerStore, opts badgerImpl.Options) (*partitioned.Indexer, error) {
+	parts := make(map[store.Partition]partitioned.Store, cfg.Storage.Partitions)
+	closeAll := func() error {
+		var errs []error
+		for _, sto := range parts {
+			errs = append(errs, sto.(badgerStore).Close())
+		}
+		return errors.Join(errs...)
+	}
+	for p := 1; p <= cfg.Storage.Partitions; p++ {
+		dir := filepath.Join(cfg.Storage.Dir, "partitions", strconv.Itoa(p))
+		sto, err := cfg.openStore(dir, opts)
+		if err != nil {
+			return nil, errors.Join(fmt.Errorf("opening partition %d: %w", p, err), closeAll())
+		}
+		parts[store.Partition(p)] = sto
+	}
+	ix, err := partitioned.New(home, parts)
+	if err != nil {
+		return nil, errors.Join(err, closeAll())
+	}
+	return ix, nil
+}
+
+// badgerStore is the interface of the stores opened by the badger package.
+type badgerStore interface {
+	store.IdentManager
+	store.IDManager
+	store.IDReserver
+	store.Indexer
+	store.BlobStore
+	Close() error
+}
+
+// BadgerOptions returns the options of the badger store. It reads the
+// encryption key, if one is configured.
+func (cfg Config) BadgerOptions() (badgerImpl.Options, error) {
+	compression, err := badgerImpl.ParseCompression(cfg.Storage.Compression)
+	if err != nil {
+		return badgerImpl.Options{}, err
+	}
+	opts := badgerImpl.DefaultOptions()
+	opts.MaxInlineValueSize = cfg.Storage.MaxInlineValueSize
+	opts.Compression.Index = compression
+	opts.Compression.History = compression
+	opts.Compression.ValueBlobs = compression
+	opts.Compression.Blobs = compression
+	opts.BlockCacheSize = cfg.Cache.BlockBytes
+	opts.ValueLogGCInterval = cfg.Storage.ValueLogGCInterval
+	if cfg.Storage.EncryptionKeyFile != "" {
+		key, err := os.ReadFile(cfg.Storage.EncryptionKeyFile)
+		if err != nil {
+			return badgerImpl.Options{}, fmt.Errorf("reading encryption key: %w", err)
+		}
+		opts.EncryptionKey = key
+	}
+	return opts, nil
+}
+
+func (l Log) level() (slog.Level, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(l.Level)); err != nil {
+		return level, fmt.Errorf("log.level: unknown level %q", l.Level)
+	}
+	return level, nil
+}
+
+// NewLogger returns a logger that writes to w at the configured level and in
+// the configured format.
+func (l Log) NewLogger(w io.Writer) *slog.Logger {
+	level, _ := l.level()
+	opts := &slog.HandlerOptions{Level: level}
+	if l.Format == "json" {
+		return slog.New(slog.NewJSONHandler(w, opts))
+	}
+	return slog.New(slog.NewTextHandler(w, opts))
+}
@@ -0,0 +1,229 @@
+/*
+Copyright 2024 Andrew Meredith
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/kendru/canter/internal/config"
+	"github.com/kendru/canter/internal/store"
+	"github.com/stretchr/testify/assert"
+)
+
+func writeFile(t *testing.T, contents string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "canter.yaml")
+	if err := os.WriteFile(path, []byte(contents), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func env(vars map[string]string) func(string) (string, bool) {
+	return func(name string) (string, bool) {
+		val, ok := vars[name]
+		return val, ok
+	}
+}
+
+func TestLoad(t *testing.T) {
+	path := writeFile(t, `
+storage:
+  dir: /var/lib/canter
+  compression: zstd
+cache:
+  entities: 1000
+  idents: 5000
+limits:
+  maxTxFacts: 500
+  txRate: 2.5
+  memoryBudget: 67108864
+  maxTxWait: 50ms
+slowLog:
+  txThreshold: 100ms
+  size: 50
+server:
+  maxLag: 5s
+  historyCollectionInterval: 1h
+  warmup: true
+  warmupAttributes: [person/email]
+`)
+
+	cfg, err := config.Load(path, env(map[string]string{
+		"CANTER_CACHE_ENTITIES":           "2000",
+		"CANTER_CACHE_BLOCK_BYTES":        "1048576",
+		"CANTER_STORAGE_READ_ONLY":        "true",
+		"CANTER_LOG_FORMAT":               "json",
+		"CANTER_SERVER_MAX_LAG":           "1m",
+		"CANTER_SLOW_LOG_QUERY_THRESHOLD": "2s",
+		"CANTER_LIMITS_MAX_TX_IN_FLIGHT":  "4",
+		"CANTER_SCHEMA_INFER":             "true",
+		"CANTER_SERVER_WARMUP_ATTRIBUTES": "person/email, person/name",
+		"CANTER_UNRELATED_VARIABLE":       "ignored",
+	}), func(cfg *config.Config) {
+		cfg.Server.Addr = ":8080"
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	expected := config.Default()
+	expected.Storage.Dir = "/var/lib/canter"
+	expected.Storage.Compression = "zstd"
+	expected.Storage.ReadOnly = true
+	expected.Cache.Entities = 2000
+	expected.Cache.Idents = 5000
+	expected.Cache.BlockBytes = 1 << 20
+	expected.Limits.MaxTxFacts = 500
+	expected.Limits.TxRate = 2.5
+	expected.Limits.MaxTxInFlight = 4
+	expected.Limits.MaxTxWait = 50 * time.Millisecond
+	expected.Limits.MemoryBudget = 64 << 20
+	expected.Log.Format = "json"
+	expected.SlowLog.TxThreshold = 100 * time.Millisecond
+	expected.SlowLog.QueryThreshold = 2 * time.Second
+	expected.SlowLog.Size = 50
+	expected.Schema.Infer = true
+	expected.Server.Addr = ":8080"
+	expected.Server.MaxLag = time.Minute
+	expected.Server.HistoryCollectionInterval = time.Hour
+	expected.Server.Warmup = true
+	expected.Server.WarmupAttributes = []string{"person/email", "person/name"}
+	assert.Equal(t, expected, cfg)
+}
+
+func TestLoadErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		file     string
+		env      map[string]string
+		contains string
+	}{
+		{
+			name:     "missing dir",
+			file:     "storage:\n  backend: badger\n",
+			contains: "storage.dir is required",
+		},
+		{
+			name:     "unknown setting",
+			file:     "storage:\n  dir: /tmp/canter\n  direcotry: /tmp/canter\n",
+			contains: "field direcotry not found",
+		},
+		{
+			name:     "unknown backend",
+			file:     "storage:\n  backend: postgres\n",
+			contains: `unknown backend "postgres"`,
+		},
+		{
+			name:     "invalid env",
+			env:      map[string]string{"CANTER_CACHE_ENTITIES": "many"},
+			contains: "CANTER_CACHE_ENTITIES",
+		},
+		{
+			name:     "several invalid settings",
+			file:     "storage:\n  backend: memory\n  compression: lz4\nlog:\n  level: loud\n",
+			env:      map[string]string{"CANTER_LIMITS_MAX_TX_FACTS": "-1"},
+			contains: "storage.compression",
+		},
+		{
+			name:     "negative slow log threshold",
+			env:      map[string]string{"CANTER_STORAGE_DIR": "/tmp/canter", "CANTER_SLOW_LOG_TX_THRESHOLD": "-1s"},
+			contains: "slowLog.txThreshold",
+		},
+		{
+			name:     "negative partitions",
+			env:      map[string]string{"CANTER_STORAGE_DIR": "/tmp/canter", "CANTER_STORAGE_PARTITIONS": "-1"},
+			contains: "storage.partitions",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := ""
+			if tt.file != "" {
+				path = writeFile(t, tt.file)
+			}
+			_, err := config.Load(path, env(tt.env))
+			if assert.Error(t, err) {
+				assert.Contains(t, err.Error(), tt.contains)
+			}
+		})
+	}
+}
+
+func TestOpen(t *testing.T) {
+	cfg := config.Default()
+	cfg.Storage.Backend = config.BackendMemory
+	cfg.Cache.Entities = 10
+	cfg.Cache.Idents = 1
+	cfg.Limits.MaxTxFacts = 2
+	if !assert.NoError(t, cfg.Validate()) {
+		return
+	}
+
+	conn, err := cfg.Open()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close(context.Background())
+
+	_, err = conn.Assert(store.EntityData{"db/ident": "color/red"})
+	assert.NoError(t, err)
+	_, err = conn.Assert(
+		store.EntityData{"db/ident": "color/blue"},
+		store.EntityData{"db/ident": "color/cyan"},
+		store.EntityData{"db/ident": "color/magenta"},
+	)
+	assert.ErrorIs(t, err, store.ErrTxTooLarge)
+}
+
+func TestOpenPartitions(t *testing.T) {
+	cfg := config.Default()
+	cfg.Storage.Dir = t.TempDir()
+	cfg.Storage.Partitions = 2
+
+	conn, err := cfg.Open()
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = conn.Assert(store.EntityData{"db/ident": "color/name", "db/type": "db.type/string"})
+	assert.NoError(t, err)
+	res, err := conn.Assert(store.WithPartition(2), store.EntityData{"db/id": store.NamedTempID("red"), "color/name": "red"})
+	assert.NoError(t, err)
+	red := res.Names["red"]
+	assert.Equal(t, store.Partition(2), red.Partition())
+	assert.NoError(t, conn.Close(context.Background()))
+
+	// Partitions may be added to an existing store.
+	cfg.Storage.Partitions = 3
+	conn, err = cfg.Open()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close(context.Background())
+	ent, err := conn.DB().GetEntity(red)
+	if assert.NoError(t, err) {
+		name, err := ent.Get(conn, "color/name")
+		assert.NoError(t, err)
+		assert.Equal(t, "red", name)
+	}
+	_, err = conn.Assert(store.WithPartition(3), store.EntityData{"color/name": "blue"})
+	assert.NoError(t, err)
+}
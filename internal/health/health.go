@@ -0,0 +1,177 @@
+/*
+Copyright 2024 Andrew Meredith
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package health serves the liveness, readiness, and metrics endpoints that
+// orchestrators use to manage a canter server.
+package health
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/kendru/canter/internal/store"
+)
+
+// Options configures the readiness checks.
+type Options struct {
+	// RequireTransactor makes a connection that is not the transactor, such
+	// as a peer, unready. It should be set for servers that accept writes
+	// and are not able to forward them.
+	RequireTransactor bool
+	// MaxLag is how far a peer may trail its transactor and remain ready. If
+	// zero, lag does not affect readiness.
+	MaxLag time.Duration
+}
+
+// check is a named condition of the connection's health.
+type check struct {
+	name string
+	run  func(status store.Status) error
+}
+
+// Handler serves the health of a connection:
+//
+//   - /healthz reports whether the process is alive, which requires its
+//     storage to be reachable.
+//   - /readyz reports whether the process should receive traffic. In addition
+//     to the liveness checks, the ident cache must be loaded, and the
+//     transactor and replication lag checks configured by opts must pass.
+//   - /metrics reports the same state as gauges in the Prometheus text
+//     exposition format.
+//
+// /healthz and /readyz respond with 200 if every check passes and 503
+// otherwise. The body lists the result of each check, one per line.
+func Handler(conn *store.Connection, opts Options) http.Handler {
+	liveness := []check{
+		{name: "storage", run: func(store.Status) error { return conn.Ping() }},
+	}
+	readiness := append(liveness,
+		check{name: "idents", run: func(status store.Status) error {
+			if !status.IdentsLoaded {
+				return errors.New("idents are still loading")
+			}
+			return nil
+		}},
+		check{name: "transactor", run: func(status store.Status) error {
+			if opts.RequireTransactor && !status.Transactor {
+				return errors.New("connection is not the transactor")
+			}
+			return nil
+		}},
+		check{name: "replication", run: func(status store.Status) error {
+			if opts.MaxLag > 0 && status.Lag > opts.MaxLag {
+				return fmt.Errorf("lag of %s exceeds %s", status.Lag, opts.MaxLag)
+			}
+			return nil
+		}},
+	)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		serveChecks(w, conn, "healthz", liveness)
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		serveChecks(w, conn, "readyz", readiness)
+	})
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		serveMetrics(w, conn, liveness, readiness)
+	})
+	return mux
+}
+
+// runChecks runs the checks against the current status of the connection and
+// returns the error of each, along with whether they all passed.
+func runChecks(conn *store.Connection, checks []check) ([]error, bool) {
+	status, statusErr := conn.Status()
+	errs := make([]error, len(checks))
+	ok := true
+	for i, c := range checks {
+		if statusErr != nil {
+			errs[i] = statusErr
+		} else {
+			errs[i] = c.run(status)
+		}
+		if errs[i] != nil {
+			ok = false
+		}
+	}
+	return errs, ok
+}
+
+func serveChecks(w http.ResponseWriter, conn *store.Connection, endpoint string, checks []check) {
+	errs, ok := runChecks(conn, checks)
+	var body strings.Builder
+	for i, c := range checks {
+		if errs[i] != nil {
+			fmt.Fprintf(&body, "[-]%s failed: %v\n", c.name, errs[i])
+		} else {
+			fmt.Fprintf(&body, "[+]%s ok\n", c.name)
+		}
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	if ok {
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(&body, "%s check passed\n", endpoint)
+	} else {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintf(&body, "%s check failed\n", endpoint)
+	}
+	w.Write([]byte(body.String()))
+}
+
+func serveMetrics(w http.ResponseWriter, conn *store.Connection, liveness, readiness []check) {
+	_, live := runChecks(conn, liveness)
+	_, ready := runChecks(conn, readiness)
+	status, _ := conn.Status()
+
+	var body strings.Builder
+	gauge := func(name, help string, val float64) {
+		fmt.Fprintf(&body, "# HELP %s %s\n# TYPE %s gauge\n%s %g\n", name, help, name, name, val)
+	}
+	gauge("canter_up", "Whether the connection's storage is reachable.", boolGauge(live))
+	gauge("canter_ready", "Whether every readiness check passes.", boolGauge(ready))
+	gauge("canter_idents_loaded", "Whether the ident cache has been loaded from storage.", boolGauge(status.IdentsLoaded))
+	counter := func(name, help string, val uint64) {
+		fmt.Fprintf(&body, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", name, help, name, name, val)
+	}
+	gauge("canter_ident_cache_size", "Number of idents in the ident cache.", float64(status.IdentCache.Size))
+	counter("canter_ident_cache_hits_total", "Ident lookups answered by the ident cache.", status.IdentCache.Hits)
+	counter("canter_ident_cache_misses_total", "Ident lookups that the ident cache could not answer.", status.IdentCache.Misses)
+	counter("canter_ident_cache_evictions_total", "Idents evicted from the ident cache.", status.IdentCache.Evictions)
+	gauge("canter_transactor", "Whether the connection is the transactor.", boolGauge(status.Transactor))
+	gauge("canter_basis_tx", "ID of the latest transaction observed by the connection.", float64(status.Basis))
+	gauge("canter_replication_lag_seconds", "Time by which the connection trails its transactor.", status.Lag.Seconds())
+	counter("canter_tx_admitted_total", "Transactions admitted by the write limits.", status.Admission.Admitted)
+	counter("canter_tx_throttled_total", "Transactions rejected as throttled by the write limits.", status.Admission.Throttled)
+	gauge("canter_tx_in_flight", "Admitted transactions that are committing.", float64(status.Admission.InFlight))
+	gauge("canter_memory_used_bytes", "Estimated memory held by the entity cache and by scans and queries in progress.", float64(status.Memory.Used))
+	gauge("canter_memory_budget_bytes", "Memory budget of the connection, or 0 if it is unlimited.", float64(status.Memory.Budget))
+	counter("canter_memory_rejected_total", "Scans and queries that failed because they would exceed the memory budget.", status.Memory.Rejected)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write([]byte(body.String()))
+}
+
+func boolGauge(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,92 @@
+/*
+Copyright 2024 Andrew Meredith
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package health_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/kendru/canter/internal/health"
+	"github.com/kendru/canter/internal/store"
+	badgerImpl "github.com/kendru/canter/internal/store/badger"
+	"github.com/stretchr/testify/assert"
+)
+
+func get(t *testing.T, h http.Handler, path string) (int, string) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+	body, _ := io.ReadAll(rec.Body)
+	return rec.Code, string(body)
+}
+
+func TestHandler(t *testing.T) {
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true).WithLogger(nil))
+	if !assert.NoError(t, err) {
+		return
+	}
+	sto, err := badgerImpl.New(db)
+	if !assert.NoError(t, err) {
+		return
+	}
+	conn := store.NewConnection(store.Config{IdentManager: sto, IDManager: sto, Indexer: sto, BlobStore: sto})
+	if !assert.NoError(t, conn.InitializeDB()) {
+		return
+	}
+
+	h := health.Handler(conn, health.Options{RequireTransactor: true})
+	code, body := get(t, h, "/healthz")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Contains(t, body, "[+]storage ok")
+
+	// The connection becomes ready once its idents have loaded.
+	assert.Eventually(t, func() bool {
+		code, _ := get(t, h, "/readyz")
+		return code == http.StatusOK
+	}, time.Second, 10*time.Millisecond)
+	_, body = get(t, h, "/readyz")
+	for _, line := range []string{"[+]storage ok", "[+]idents ok", "[+]transactor ok", "[+]replication ok", "readyz check passed"} {
+		assert.Contains(t, body, line)
+	}
+	_, body = get(t, h, "/metrics")
+	assert.Contains(t, body, "# TYPE canter_up gauge\ncanter_up 1\n")
+	assert.Contains(t, body, "canter_ready 1\n")
+	assert.Contains(t, body, "canter_transactor 1\n")
+	assert.Contains(t, body, "# TYPE canter_ident_cache_hits_total counter\n")
+	assert.Contains(t, body, "canter_tx_throttled_total 0\n")
+
+	// A peer cannot serve writes on its own.
+	peer, stop := conn.NewPeer(store.PeerConfig{})
+	defer stop()
+	code, body = get(t, health.Handler(peer, health.Options{RequireTransactor: true}), "/readyz")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Contains(t, body, "[-]transactor failed")
+
+	// Unreachable storage fails both checks.
+	db.Close()
+	code, body = get(t, h, "/healthz")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Contains(t, body, "[-]storage failed")
+	code, _ = get(t, h, "/readyz")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	_, body = get(t, h, "/metrics")
+	assert.Contains(t, body, "canter_up 0\n")
+}
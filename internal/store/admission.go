@@ -0,0 +1,227 @@
+/*
+Copyright 2024 Andrew Meredith
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// AdmissionConfig configures an AdmissionController.
+type AdmissionConfig struct {
+	// Rate is the number of transactions per second that each admission key
+	// may commit on average. If zero, the rate is not limited.
+	Rate float64
+	// Burst is the number of transactions that a key may commit at once
+	// after it has been idle. If zero, it is Rate rounded up, or 1 if that is
+	// less.
+	Burst int
+	// MaxInFlight caps the number of transactions that may be committing at
+	// once across every key. If zero, it is not capped.
+	MaxInFlight int
+	// MaxWait is how long a transaction may wait to be admitted before it
+	// fails with ErrThrottled. If zero, transactions that cannot be admitted
+	// immediately fail at once.
+	MaxWait time.Duration
+}
+
+// AdmissionStats describes the decisions of an AdmissionController.
+type AdmissionStats struct {
+	// Admitted and Throttled are the numbers of transactions that were
+	// admitted and that failed with ErrThrottled.
+	Admitted, Throttled uint64
+	// InFlight is the number of admitted transactions that are committing.
+	InFlight int64
+}
+
+// An AdmissionController limits the rate at which transactions are committed.
+// Each transaction is admitted under a key, which is the AdmissionKey of its
+// connection unless the transaction sets its own with WithAdmissionKey. Keys
+// separate the traffic of different tenants or workloads, so that a bulk
+// loader using one key cannot starve interactive transactions using another:
+// every key has its own token bucket, while a cap on the number of
+// transactions in flight bounds the load on storage as a whole.
+//
+// A controller may be shared by several connections, in which case its cap
+// applies to all of them together. It keeps a bucket for every key that it has
+// seen, so keys should be drawn from a small set.
+type AdmissionController struct {
+	cfg   AdmissionConfig
+	burst float64
+	// slots holds a value for every transaction in flight. It is nil if the
+	// number of transactions in flight is not capped.
+	slots chan struct{}
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+
+	admitted, throttled atomic.Uint64
+	inFlight            atomic.Int64
+}
+
+// tokenBucket holds the tokens of a key as of last. Tokens may be negative
+// when transactions are waiting for tokens that they have reserved.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// NewAdmissionController returns a controller configured by cfg.
+func NewAdmissionController(cfg AdmissionConfig) *AdmissionController {
+	ac := &AdmissionController{
+		cfg:     cfg,
+		burst:   float64(cfg.Burst),
+		buckets: make(map[string]*tokenBucket),
+	}
+	if cfg.Burst <= 0 {
+		ac.burst = math.Max(1, math.Ceil(cfg.Rate))
+	}
+	if cfg.MaxInFlight > 0 {
+		ac.slots = make(chan struct{}, cfg.MaxInFlight)
+	}
+	return ac
+}
+
+// Stats returns the controller's counts of its decisions.
+func (ac *AdmissionController) Stats() AdmissionStats {
+	return AdmissionStats{
+		Admitted:  ac.admitted.Load(),
+		Throttled: ac.throttled.Load(),
+		InFlight:  ac.inFlight.Load(),
+	}
+}
+
+// admit waits until a transaction under key may be committed, or fails with
+// a *ThrottledError if that would take longer than the controller's MaxWait.
+// Once admitted, the transaction must call release when it has committed.
+func (ac *AdmissionController) admit(key string) (release func(), err error) {
+	start := time.Now()
+	wait, ok := ac.reserve(key, start)
+	if !ok {
+		ac.throttled.Add(1)
+		return nil, &ThrottledError{Key: key, RetryAfter: wait}
+	}
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+
+	if ac.slots != nil {
+		select {
+		case ac.slots <- struct{}{}:
+		default:
+			if !ac.waitForSlot(ac.cfg.MaxWait - time.Since(start)) {
+				ac.refund(key)
+				ac.throttled.Add(1)
+				return nil, &ThrottledError{Key: key, InFlight: true}
+			}
+		}
+	}
+	ac.admitted.Add(1)
+	ac.inFlight.Add(1)
+	return func() {
+		ac.inFlight.Add(-1)
+		if ac.slots != nil {
+			<-ac.slots
+		}
+	}, nil
+}
+
+// waitForSlot waits up to d for a transaction in flight to finish and takes
+// its slot. It reports whether a slot was taken.
+func (ac *AdmissionController) waitForSlot(d time.Duration) bool {
+	if d <= 0 {
+		return false
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case ac.slots <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// reserve takes a token from the bucket of key and returns how long the
+// caller must wait before the token is available. If that is longer than
+// MaxWait, no token is taken and reserve reports false along with the wait.
+func (ac *AdmissionController) reserve(key string, now time.Time) (time.Duration, bool) {
+	if ac.cfg.Rate <= 0 {
+		return 0, true
+	}
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	b, ok := ac.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: ac.burst, last: now}
+		ac.buckets[key] = b
+	}
+	if now.After(b.last) {
+		b.tokens = math.Min(ac.burst, b.tokens+now.Sub(b.last).Seconds()*ac.cfg.Rate)
+		b.last = now
+	}
+	var wait time.Duration
+	if b.tokens < 1 {
+		wait = time.Duration((1 - b.tokens) / ac.cfg.Rate * float64(time.Second))
+		if wait > ac.cfg.MaxWait {
+			return wait, false
+		}
+	}
+	b.tokens--
+	return wait, true
+}
+
+// refund returns a token to the bucket of key, for a transaction that took a
+// token but was not admitted.
+func (ac *AdmissionController) refund(key string) {
+	if ac.cfg.Rate <= 0 {
+		return
+	}
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	if b, ok := ac.buckets[key]; ok {
+		b.tokens = math.Min(ac.burst, b.tokens+1)
+	}
+}
+
+// ThrottledError is returned when a transaction is not admitted by the
+// connection's AdmissionController. It matches ErrThrottled. The transaction
+// is not committed, and it may be committed again later.
+type ThrottledError struct {
+	// Key is the admission key of the transaction.
+	Key string
+	// InFlight is set if the transaction was throttled because too many
+	// transactions were in flight, rather than by the rate limit of its key.
+	InFlight bool
+	// RetryAfter is how long the transaction would have had to wait for the
+	// rate limit of its key. It is zero if InFlight is set.
+	RetryAfter time.Duration
+}
+
+func (e *ThrottledError) Error() string {
+	if e.InFlight {
+		return "transaction throttled: too many transactions in flight"
+	}
+	return fmt.Sprintf("transaction throttled: rate limit of key %q exceeded; retry after %s", e.Key, e.RetryAfter)
+}
+
+func (e *ThrottledError) Unwrap() error {
+	return ErrThrottled
+}
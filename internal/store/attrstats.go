@@ -0,0 +1,235 @@
+/*
+Copyright 2024 Andrew Meredith
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/bits"
+	"sync"
+	"time"
+
+	"github.com/kendru/canter/pkg/dataflow"
+)
+
+// AttrStats summarizes the values of an attribute.
+//
+// Statistics are collected when they are first requested for an attribute,
+// from its current values, and are then updated by every transaction that
+// the connection observes. They are not reduced when values are retracted or
+// replaced, so they overestimate attributes whose values churn until the
+// connection is reopened.
+type AttrStats struct {
+	// Count is the number of values.
+	Count int64
+	// Distinct is an estimate of the number of distinct values. It is
+	// typically within 2% of the true number.
+	Distinct int64
+	// Min and Max are the least and greatest values. They are nil if the
+	// attribute has no values or its values are not ordered. Numbers,
+	// strings, timestamps, dates, and refs are ordered.
+	Min, Max Value
+}
+
+// AttrStats returns statistics about the values of an attribute, which may be
+// given as an ident name or an ID.
+func (conn *Connection) AttrStats(attribute any) (AttrStats, error) {
+	ident, err := ResolveIdent(conn, attribute)
+	if err != nil {
+		return AttrStats{}, fmt.Errorf("resolving attribute ident: %w", err)
+	}
+	return conn.attrStats.get(conn, ident.ID)
+}
+
+// attrStatsRegistry holds the statistics of every attribute for which they
+// have been requested.
+type attrStatsRegistry struct {
+	mu    sync.Mutex
+	attrs map[ID]*attrStats
+}
+
+func newAttrStatsRegistry() *attrStatsRegistry {
+	return &attrStatsRegistry{attrs: make(map[ID]*attrStats)}
+}
+
+// get returns the statistics of an attribute, collecting them from the
+// attribute's current values the first time they are requested.
+func (r *attrStatsRegistry) get(conn *Connection, attrID ID) (AttrStats, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	stats, ok := r.attrs[attrID]
+	if !ok {
+		stats = &attrStats{}
+		scan, err := conn.indexer.ScanAEVT(attrID, nil)
+		if err != nil {
+			return AttrStats{}, fmt.Errorf("scanning AEVT index: %w", err)
+		}
+		err = scan.Produce(dataflow.NewContext(context.Background()), func(_ dataflow.DataflowCtx, fct *Fact) error {
+			if fct != nil {
+				stats.add(fct.Value)
+			}
+			return nil
+		})
+		if err != nil {
+			return AttrStats{}, fmt.Errorf("collecting statistics for attribute %d: %w", attrID, err)
+		}
+		r.attrs[attrID] = stats
+	}
+	return stats.summary(), nil
+}
+
+// observe adds the values asserted by a transaction to the statistics of
+// their attributes. Attributes whose statistics have not been requested are
+// skipped, since their statistics will be collected from the indexes, which
+// already hold the values.
+func (r *attrStatsRegistry) observe(assertions []ResolvedAssertion) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, assertion := range assertions {
+		if assertion.Mode() != AssertModeAddition {
+			continue
+		}
+		if stats, ok := r.attrs[assertion.Attribute]; ok {
+			stats.add(assertion.Value)
+		}
+	}
+}
+
+type attrStats struct {
+	count    int64
+	distinct hyperLogLog
+	min, max Value
+}
+
+func (s *attrStats) add(val Value) {
+	s.count++
+	s.distinct.add(hashValue(val))
+	if s.count == 1 {
+		if _, ok := compareValues(val, val); ok {
+			s.min, s.max = val, val
+		}
+		return
+	}
+	if cmp, ok := compareValues(val, s.min); ok && cmp < 0 {
+		s.min = val
+	}
+	if cmp, ok := compareValues(val, s.max); ok && cmp > 0 {
+		s.max = val
+	}
+}
+
+func (s *attrStats) summary() AttrStats {
+	distinct := s.distinct.estimate()
+	if distinct > s.count {
+		distinct = s.count
+	}
+	return AttrStats{
+		Count:    s.count,
+		Distinct: distinct,
+		Min:      s.min,
+		Max:      s.max,
+	}
+}
+
+// compareValues compares two values of the same ordered type. It reports
+// false if the values are not ordered or are of different types.
+func compareValues(a, b Value) (int, bool) {
+	switch rank := valueRank(a); rank {
+	case rankInt8, rankInt16, rankInt32, rankInt64, rankFloat32, rankFloat64,
+		rankString, rankTime, rankID:
+		if valueRank(b) != rank {
+			return 0, false
+		}
+		return CompareValues(a, b), true
+	default:
+		return 0, false
+	}
+}
+
+// hashValue hashes a value for distinct counting. Equal values hash equally.
+func hashValue(val Value) uint64 {
+	h := fnv.New64a()
+	switch v := val.(type) {
+	case time.Time:
+		// Times that are equal may differ in their location.
+		fmt.Fprintf(h, "time:%d", v.UnixNano())
+	case []byte:
+		h.Write([]byte("bytes:"))
+		h.Write(v)
+	default:
+		fmt.Fprintf(h, "%T:%v", v, v)
+	}
+	return mix64(h.Sum64())
+}
+
+// mix64 is the finalizer of SplitMix64. FNV hashes of similar inputs differ
+// mostly in their low bits, which would bias the register and rank that a
+// HyperLogLog derives from the high and low bits of the hash.
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// hllPrecision is the number of bits of a hash that select a register. With
+// 4096 registers, estimates have a standard error of about 1.6%.
+const hllPrecision = 12
+
+// hyperLogLog estimates the number of distinct hashes added to it. The zero
+// value is an empty estimator.
+type hyperLogLog struct {
+	registers *[1 << hllPrecision]uint8
+}
+
+func (h *hyperLogLog) add(hash uint64) {
+	if h.registers == nil {
+		h.registers = new([1 << hllPrecision]uint8)
+	}
+	idx := hash >> (64 - hllPrecision)
+	// The rank is the position of the first set bit in the remaining bits.
+	rank := uint8(bits.LeadingZeros64(hash<<hllPrecision|1<<(hllPrecision-1)) + 1)
+	if rank > h.registers[idx] {
+		h.registers[idx] = rank
+	}
+}
+
+func (h *hyperLogLog) estimate() int64 {
+	if h.registers == nil {
+		return 0
+	}
+	const m = float64(1 << hllPrecision)
+	var sum float64
+	var zeros int
+	for _, r := range h.registers {
+		sum += math.Ldexp(1, -int(r))
+		if r == 0 {
+			zeros++
+		}
+	}
+	alpha := 0.7213 / (1 + 1.079/m)
+	est := alpha * m * m / sum
+	if est <= 2.5*m && zeros > 0 {
+		// Linear counting is more accurate for small cardinalities.
+		est = m * math.Log(m/float64(zeros))
+	}
+	return int64(math.Round(est))
+}
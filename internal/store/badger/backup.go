@@ -0,0 +1,124 @@
+/*
+Copyright 2024 Andrew Meredith
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package badger
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/dgraph-io/badger/v4/pb"
+	"github.com/golang/protobuf/proto"
+)
+
+// backupListSize is the number of bytes of keys and values after which a
+// backup starts a new list of entries.
+const backupListSize = 4 << 20
+
+// Backup writes every key that the snapshot observes to w, in the format of
+// Badger's own backups, so that a backup may be loaded by Restore or by the
+// badger restore command. The ID leases of the running stores are omitted,
+// since they belong to those stores rather than to the data.
+//
+// The snapshot is pinned to a single Badger transaction, so the backup is
+// consistent across every table even if writes continue while it is written.
+func (s snapshot) Backup(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	list := &pb.KVList{}
+	var size int
+	flush := func() error {
+		if len(list.Kv) == 0 {
+			return nil
+		}
+		buf, err := proto.Marshal(list)
+		if err != nil {
+			return err
+		}
+		if err := binary.Write(bw, binary.LittleEndian, uint64(len(buf))); err != nil {
+			return err
+		}
+		if _, err := bw.Write(buf); err != nil {
+			return err
+		}
+		list.Kv = list.Kv[:0]
+		size = 0
+		return nil
+	}
+
+	it := s.txn.NewIterator(s.iteratorOptions())
+	defer it.Close()
+	for it.Rewind(); it.Valid(); it.Next() {
+		item := it.Item()
+		if item.Key()[0] == tblPrefixIDLeases {
+			continue
+		}
+		val, err := item.ValueCopy(nil)
+		if err != nil {
+			return fmt.Errorf("reading key %x: %w", item.Key(), err)
+		}
+		list.Kv = append(list.Kv, &pb.KV{
+			Key:       item.KeyCopy(nil),
+			Value:     val,
+			UserMeta:  []byte{item.UserMeta()},
+			Version:   item.Version(),
+			ExpiresAt: item.ExpiresAt(),
+		})
+		size += len(item.Key()) + len(val)
+		if size >= backupListSize {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// RestoreDir restores a backup written by Backup into a new Badger database in
+// dir, configured with opts as Open would configure it.
+func RestoreDir(dir string, r io.Reader, opts Options) error {
+	db, err := badger.Open(configure(badger.DefaultOptions(dir), opts))
+	if err != nil {
+		return fmt.Errorf("opening database: %w", err)
+	}
+	return errors.Join(Restore(db, r), db.Close())
+}
+
+// Restore loads a backup written by Backup into db, which must be empty. Open
+// a store on db once the backup has been restored.
+func Restore(db *badger.DB, r io.Reader) error {
+	err := db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.IteratorOptions{})
+		defer it.Close()
+		if it.Rewind(); it.Valid() {
+			return errors.New("database is not empty")
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("restoring backup: %w", err)
+	}
+	if err := db.Load(r, 256); err != nil {
+		return fmt.Errorf("restoring backup: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+/*
+Copyright 2024 Andrew Meredith
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package badger
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/kendru/canter/internal/store"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackup(t *testing.T) {
+	newConn := func(db *badger.DB) *store.Connection {
+		sto, err := New(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return store.NewConnection(store.Config{
+			IdentManager: sto,
+			IDManager:    sto,
+			Indexer:      sto,
+			BlobStore:    sto,
+		})
+	}
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true).WithLogger(nil))
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer db.Close()
+	conn := newConn(db)
+	if !assert.NoError(t, conn.InitializeDB()) {
+		return
+	}
+	_, err = conn.Assert(store.EntityData{"db/ident": "item/name", "db/type": "db.type/string", "db/unique": "db.unique/identity"})
+	if !assert.NoError(t, err) {
+		return
+	}
+	res, err := conn.Assert(store.EntityData{"item/name": "before"})
+	if !assert.NoError(t, err) {
+		return
+	}
+	before := res.DB.Basis.ID()
+
+	// Writes that are committed after the read transaction is opened are not
+	// part of the backup.
+	rt, err := conn.ReadTxn()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer rt.Close()
+	_, err = conn.Assert(store.EntityData{"item/name": "after"})
+	if !assert.NoError(t, err) {
+		return
+	}
+	var backup bytes.Buffer
+	if !assert.NoError(t, rt.Backup(&backup)) {
+		return
+	}
+
+	restoredDB, err := badger.Open(badger.DefaultOptions("").WithInMemory(true).WithLogger(nil))
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer restoredDB.Close()
+	if !assert.NoError(t, Restore(restoredDB, bytes.NewReader(backup.Bytes()))) {
+		return
+	}
+	assert.Error(t, Restore(restoredDB, bytes.NewReader(backup.Bytes())), "restoring into a database that is not empty")
+
+	restored := newConn(restoredDB)
+	assert.NoError(t, restored.InitializeDB())
+	_, err = restored.GetEntity(store.NewLookup("item/name", "before"))
+	assert.NoError(t, err)
+	_, err = restored.GetEntity(store.NewLookup("item/name", "after"))
+	assert.ErrorIs(t, err, store.ErrNoSuchEntity)
+	txID, err := restored.TxAt(time.Now())
+	if assert.NoError(t, err) {
+		assert.Equal(t, before, txID)
+	}
+
+	// The restored store allocates IDs after those in the backup.
+	res, err = restored.Assert(store.EntityData{"item/name": "restored"})
+	if assert.NoError(t, err) {
+		assert.Greater(t, res.DB.Basis.ID(), before)
+	}
+}
@@ -31,9 +31,13 @@ limitations under the License.
 package badger
 
 import (
+	"errors"
 	"fmt"
+	"sync"
+	"time"
 
 	"github.com/dgraph-io/badger/v4"
+	"github.com/kendru/canter/internal/store"
 )
 
 const (
@@ -44,23 +48,321 @@ const (
 	tblPrefixAVET
 	tblPrefixVAET
 	seqID
+	tblPrefixEAVTHistory
+	tblPrefixAEVTHistory
+	tblPrefixValueBlobs
+	tblPrefixBlobManifests
+	tblPrefixBlobChunks
+	tblPrefixMeta
+	tblPrefixValueDict
+	tblPrefixValueDictByDigest
+	tblPrefixIDLeases
 )
 
 const seqIDPrefetchCount uint64 = 100
 
+// DefaultEncryptedIndexCacheSize is the index cache size used for encrypted
+// databases when Options.IndexCacheSize is zero. Badger requires an index
+// cache when encryption is enabled.
+const DefaultEncryptedIndexCacheSize int64 = 64 << 20
+
+// defaultValueLogGCDiscardRatio is the discard ratio of value log garbage
+// collection when Options.ValueLogGCDiscardRatio is zero.
+const defaultValueLogGCDiscardRatio = 0.5
+
+// Options configures how a store lays out data in Badger and, for databases
+// opened by Open and OpenInMemory, how Badger itself is configured.
+type Options struct {
+	// MaxInlineValueSize is the largest encoded value, in bytes, that is
+	// stored inline in index entries. Larger values are stored once in the
+	// value blob table and referenced by their SHA-256 digest.
+	MaxInlineValueSize int
+	// MaxKeyValueSize is the largest encoded value, in bytes, that is embedded
+	// in an AVET key. Larger values are replaced in the key by their SHA-256
+	// digest.
+	MaxKeyValueSize int
+	// Compression configures which tables are compressed. By default,
+	// nothing is compressed.
+	Compression CompressionOptions
+	// IDPrefetch is the number of IDs that are leased from the ID sequence
+	// at a time. If zero, 100 IDs are leased.
+	IDPrefetch uint64
+	// IDLeaseTTL is how long a lease of IDs is held without being renewed.
+	// The unused IDs of a process that exits without closing the store are
+	// reclaimed once its lease expires. If zero, leases last one minute. See
+	// NOTE [ID-LEASES].
+	IDLeaseTTL time.Duration
+	// IteratorPrefetchSize is the number of entries that index scans read
+	// ahead of the caller. If zero, Badger's default is used.
+	IteratorPrefetchSize int
+
+	// The remaining options only apply to databases opened by Open and
+	// OpenInMemory.
+
+	// BlockCacheSize is the size, in bytes, of Badger's cache of decompressed
+	// table blocks. If zero, Badger's default is used.
+	BlockCacheSize int64
+	// IndexCacheSize is the size, in bytes, of Badger's cache of table
+	// indexes and bloom filters. If zero, they are all kept in memory, unless
+	// EncryptionKey is set, in which case DefaultEncryptedIndexCacheSize is
+	// used.
+	IndexCacheSize int64
+	// EncryptionKey, if set, encrypts the database at rest with AES. It must
+	// be 16, 24, or 32 bytes long. A database that was created with a key can
+	// only be opened with the same key.
+	EncryptionKey []byte
+	// EncryptionKeyRotation is how often the data keys, which are encrypted
+	// by EncryptionKey, are rotated. If zero, Badger's default is used.
+	EncryptionKeyRotation time.Duration
+	// ValueLogFileSize is the size, in bytes, at which value log files are
+	// rotated. If zero, Badger's default is used.
+	ValueLogFileSize int64
+	// ValueLogGCInterval is how often the value log is garbage collected,
+	// which reclaims the space of values that were overwritten or deleted.
+	// If zero, the value log is never collected. It does not apply to
+	// read-only or in-memory databases.
+	ValueLogGCInterval time.Duration
+	// ValueLogGCDiscardRatio is the fraction of a value log file that must be
+	// reclaimable for garbage collection to rewrite the file. If zero, 0.5 is
+	// used.
+	ValueLogGCDiscardRatio float64
+}
+
+// DefaultOptions returns the options used by New.
+func DefaultOptions() Options {
+	return Options{
+		MaxInlineValueSize: 1024,
+		MaxKeyValueSize:    256,
+		Compression: CompressionOptions{
+			MinSize: 256,
+		},
+		IDPrefetch: seqIDPrefetchCount,
+	}
+}
+
 func New(db *badger.DB) (*badgerStore, error) {
-	idSeq, err := db.GetSequence([]byte{seqID}, seqIDPrefetchCount)
+	return NewWithOptions(db, DefaultOptions())
+}
+
+// NewWithOptions opens a store in db. It refuses to open a store whose format
+// version is newer than this code supports.
+//
+// If db was opened read-only, the store serves reads but every write fails
+// with store.ErrReadOnly.
+func NewWithOptions(db *badger.DB, opts Options) (*badgerStore, error) {
+	if db.Opts().ReadOnly {
+		if err := checkFormatVersion(db); err != nil {
+			return nil, err
+		}
+		return &badgerStore{
+			reader: reader{db: db, opts: opts},
+			db:     db,
+		}, nil
+	}
+
+	if err := initFormatVersion(db); err != nil {
+		return nil, err
+	}
+
+	prefetch := opts.IDPrefetch
+	if prefetch == 0 {
+		prefetch = seqIDPrefetchCount
+	}
+	ids, err := newIDLeaser(db, prefetch, opts.IDLeaseTTL)
 	if err != nil {
-		return nil, fmt.Errorf("getting sequence for IDs: %w", err)
+		return nil, err
 	}
 
 	return &badgerStore{
-		db:    db,
-		idSeq: idSeq,
+		reader: reader{db: db, opts: opts},
+		db:     db,
+		ids:    ids,
 	}, nil
 }
 
+// Open opens the Badger database in dir and a store within it. The returned
+// store owns the database, which is closed by Close.
+func Open(dir string, readOnly bool, opts Options) (*badgerStore, error) {
+	return open(badger.DefaultOptions(dir).WithReadOnly(readOnly), opts)
+}
+
+// OpenInMemory is like Open, but the database is held in memory and is lost
+// when the store is closed.
+func OpenInMemory(opts Options) (*badgerStore, error) {
+	return open(badger.DefaultOptions("").WithInMemory(true), opts)
+}
+
+// configure applies the options that a store sets on the Badger database
+// that it opens.
+func configure(dbOpts badger.Options, opts Options) badger.Options {
+	dbOpts = dbOpts.WithLoggingLevel(badger.WARNING)
+	if opts.BlockCacheSize > 0 {
+		dbOpts = dbOpts.WithBlockCacheSize(opts.BlockCacheSize)
+	}
+	if opts.IndexCacheSize > 0 {
+		dbOpts = dbOpts.WithIndexCacheSize(opts.IndexCacheSize)
+	}
+	if len(opts.EncryptionKey) > 0 {
+		dbOpts = dbOpts.WithEncryptionKey(opts.EncryptionKey)
+		if opts.IndexCacheSize == 0 {
+			dbOpts = dbOpts.WithIndexCacheSize(DefaultEncryptedIndexCacheSize)
+		}
+		if opts.EncryptionKeyRotation > 0 {
+			dbOpts = dbOpts.WithEncryptionKeyRotationDuration(opts.EncryptionKeyRotation)
+		}
+	}
+	if opts.ValueLogFileSize > 0 {
+		dbOpts = dbOpts.WithValueLogFileSize(opts.ValueLogFileSize)
+	}
+	return dbOpts
+}
+
+func open(dbOpts badger.Options, opts Options) (*badgerStore, error) {
+	dbOpts = configure(dbOpts, opts)
+	db, err := badger.Open(dbOpts)
+	if err != nil {
+		return nil, fmt.Errorf("opening database: %w", err)
+	}
+	sto, err := NewWithOptions(db, opts)
+	if err != nil {
+		return nil, errors.Join(err, db.Close())
+	}
+	sto.ownsDB = true
+	if opts.ValueLogGCInterval > 0 && !dbOpts.ReadOnly && !dbOpts.InMemory {
+		sto.startValueLogGC(opts.ValueLogGCInterval, opts.ValueLogGCDiscardRatio)
+	}
+	return sto, nil
+}
+
+// startValueLogGC garbage collects the value log every interval until the
+// store is closed.
+func (sto *badgerStore) startValueLogGC(interval time.Duration, discardRatio float64) {
+	if discardRatio == 0 {
+		discardRatio = defaultValueLogGCDiscardRatio
+	}
+	sto.gcStop = make(chan struct{})
+	sto.gcDone = make(chan struct{})
+	go func() {
+		defer close(sto.gcDone)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-sto.gcStop:
+				return
+			case <-ticker.C:
+			}
+			// Each run rewrites at most one file, so run until there is
+			// nothing left to rewrite.
+			for sto.db.RunValueLogGC(discardRatio) == nil {
+				select {
+				case <-sto.gcStop:
+					return
+				default:
+				}
+			}
+		}
+	}()
+}
+
 type badgerStore struct {
-	db    *badger.DB
-	idSeq *badger.Sequence
+	// The embedded reader serves reads from the latest state of the store.
+	reader
+	db *badger.DB
+	// ids is nil if the store is read-only.
+	ids *idLeaser
+	// ownsDB is set if the store was created by Open or OpenInMemory.
+	ownsDB bool
+
+	// gcStop and gcDone stop and await the value log garbage collector. They
+	// are nil if the value log is not collected.
+	gcStop, gcDone chan struct{}
+
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// ReadOnly reports whether the store was opened read-only.
+func (sto *badgerStore) ReadOnly() bool {
+	return sto.ids == nil
+}
+
+// Close releases the store's lease of IDs and, if the store was created
+// by Open or OpenInMemory, stops garbage collection and closes the database.
+// Calls after the first return the result of the first.
+func (sto *badgerStore) Close() error {
+	sto.closeOnce.Do(func() {
+		if sto.gcStop != nil {
+			close(sto.gcStop)
+			<-sto.gcDone
+		}
+		if sto.ids != nil {
+			sto.closeErr = sto.ids.release()
+		}
+		if sto.ownsDB {
+			sto.closeErr = errors.Join(sto.closeErr, sto.db.Close())
+		}
+	})
+	return sto.closeErr
+}
+
+// guardWritable returns store.ErrReadOnly if the store was opened read-only.
+func (sto *badgerStore) guardWritable() error {
+	if sto.ReadOnly() {
+		return store.ErrReadOnly
+	}
+	return nil
+}
+
+// Snapshot implements store.Indexer.
+func (sto *badgerStore) Snapshot() (store.IndexSnapshot, error) {
+	return snapshot{
+		reader: reader{
+			db:   sto.db,
+			txn:  sto.db.NewTransaction(false),
+			opts: sto.opts,
+		},
+	}, nil
+}
+
+// reader performs reads against the latest state of the store or, if txn is
+// set, against the snapshot pinned by that transaction.
+type reader struct {
+	db   *badger.DB
+	txn  *badger.Txn
+	opts Options
+}
+
+// iteratorOptions returns the options of iterators that scan an index.
+func (r reader) iteratorOptions() badger.IteratorOptions {
+	opts := badger.DefaultIteratorOptions
+	if r.opts.IteratorPrefetchSize > 0 {
+		opts.PrefetchSize = r.opts.IteratorPrefetchSize
+	}
+	return opts
+}
+
+func (r reader) view(fn func(txn *badger.Txn) error) error {
+	if r.txn != nil {
+		return fn(r.txn)
+	}
+	return r.db.View(fn)
+}
+
+// snapshot is a store.IndexSnapshot backed by a read-only Badger transaction.
+type snapshot struct {
+	reader
+}
+
+func (s snapshot) Release() {
+	s.txn.Discard()
+}
+
+// classifyErr marks errors from Badger that may succeed if the operation is
+// retried as transient.
+func classifyErr(err error) error {
+	if errors.Is(err, badger.ErrConflict) || errors.Is(err, badger.ErrBlockedWrites) {
+		return errors.Join(err, store.ErrTransient)
+	}
+	return err
 }
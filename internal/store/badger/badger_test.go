@@ -0,0 +1,69 @@
+/*
+Copyright 2024 Andrew Meredith
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package badger
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOpenWithOptions(t *testing.T) {
+	dir := t.TempDir()
+	opts := DefaultOptions()
+	opts.EncryptionKey = bytes.Repeat([]byte{7}, 32)
+	opts.IDPrefetch = 10
+	opts.IteratorPrefetchSize = 8
+	opts.ValueLogFileSize = 1 << 20
+	opts.ValueLogGCInterval = time.Millisecond
+
+	sto, err := Open(dir, false, opts)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NotNil(t, sto.gcStop, "the value log is collected")
+	assert.Equal(t, 8, sto.iteratorOptions().PrefetchSize)
+	id, err := sto.NextID()
+	assert.NoError(t, err)
+	time.Sleep(5 * time.Millisecond)
+	assert.NoError(t, sto.Close())
+	assert.NoError(t, sto.Close(), "closing again is a no-op")
+
+	// An encrypted database cannot be opened without its key.
+	wrongKey := DefaultOptions()
+	wrongKey.EncryptionKey = bytes.Repeat([]byte{8}, 32)
+	_, err = Open(dir, false, wrongKey)
+	assert.Error(t, err)
+
+	sto, err = Open(dir, true, opts)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Nil(t, sto.gcStop, "read-only databases are not collected")
+	assert.NoError(t, sto.Close())
+
+	sto, err = Open(dir, false, opts)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer sto.Close()
+	next, err := sto.NextID()
+	assert.NoError(t, err)
+	assert.Equal(t, id+1, next, "unused IDs were released")
+}
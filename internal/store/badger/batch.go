@@ -0,0 +1,160 @@
+/*
+Copyright 2024 Andrew Meredith
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package badger
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sort"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/kendru/canter/internal/store"
+)
+
+// indexBatch collects the entries that a transaction writes to the indexes.
+// Keys and records are carved from shared arenas rather than allocated one at
+// a time, and the entries are inserted into the Badger transaction in key
+// order, which is the order in which Badger writes them out.
+type indexBatch struct {
+	arena   []byte
+	entries []batchEntry
+}
+
+type batchEntry struct {
+	key, value []byte
+}
+
+// batchArenaSize is the size of each arena from which keys and records are
+// carved. Larger records get an arena of their own.
+const batchArenaSize = 64 << 10
+
+// newIndexBatch returns a batch for the entries of n assertions.
+func newIndexBatch(n int) *indexBatch {
+	// Each assertion writes two current-state entries, an AVET entry, and
+	// two history entries.
+	return &indexBatch{entries: make([]batchEntry, 0, 5*n)}
+}
+
+// alloc returns an empty slice with capacity for n bytes from the arena.
+// Arenas are never reused, so the slices that they hold may be retained by the
+// Badger transaction.
+func (b *indexBatch) alloc(n int) []byte {
+	if cap(b.arena)-len(b.arena) < n {
+		b.arena = make([]byte, 0, max(n, batchArenaSize))
+	}
+	start := len(b.arena)
+	b.arena = b.arena[:start+n]
+	return b.arena[start : start : start+n]
+}
+
+// seal is like sealCompressedRecord, except that the record is carved from
+// the arena.
+func (b *indexBatch) seal(payload []byte, c Compression, minSize int) ([]byte, error) {
+	compressed, applied, err := c.compress(payload, minSize)
+	if err != nil {
+		return nil, err
+	}
+	return appendRecord(b.alloc(recordHeaderSize+len(compressed)), compressed, applied), nil
+}
+
+func (b *indexBatch) set(key, value []byte) {
+	b.entries = append(b.entries, batchEntry{key: key, value: value})
+}
+
+// write inserts the entries into txn in key order. The sort is stable, so a
+// key that was set more than once keeps the value that was set last.
+func (b *indexBatch) write(txn *badger.Txn) error {
+	sort.SliceStable(b.entries, func(i, j int) bool {
+		return bytes.Compare(b.entries[i].key, b.entries[j].key) < 0
+	})
+	for _, e := range b.entries {
+		if err := txn.Set(e.key, e.value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *indexBatch) setEAVT(assertion store.ResolvedAssertion, record []byte) {
+	// Key layout:
+	// | table prefix | entity  | attribute | valid from |
+	// |   1 byte     | 8 bytes |  8 bytes  |  8 bytes   |
+	//
+	// The valid-from time is part of the key so that an entity may hold
+	// different values of an attribute over distinct valid-time periods.
+	key := append(b.alloc(25), tblPrefixEAVT)
+	key = binary.BigEndian.AppendUint64(key, uint64(assertion.EntityID))
+	key = binary.BigEndian.AppendUint64(key, uint64(assertion.Attribute))
+	key = binary.BigEndian.AppendUint64(key, encodeValidFrom(assertion.ValidFrom))
+	b.set(key, record)
+}
+
+func (b *indexBatch) setAEVT(assertion store.ResolvedAssertion, record []byte) {
+	// Key layout:
+	// | table prefix | attribute | entity  | valid from |
+	// |   1 byte     |  8 bytes  | 8 bytes |  8 bytes   |
+	key := append(b.alloc(25), tblPrefixAEVT)
+	key = binary.BigEndian.AppendUint64(key, uint64(assertion.Attribute))
+	key = binary.BigEndian.AppendUint64(key, uint64(assertion.EntityID))
+	key = binary.BigEndian.AppendUint64(key, encodeValidFrom(assertion.ValidFrom))
+	b.set(key, record)
+}
+
+func (b *indexBatch) setAVET(assertion store.ResolvedAssertion, keyVal []byte) {
+	// Key layout:
+	// | table prefix | attribute | value |
+	// |   1 byte     |  8 bytes  |  ...  |
+	//
+	// See NOTE [VALUE-ENCODING].
+	key := append(b.alloc(9+len(keyVal)), tblPrefixAVET)
+	key = binary.BigEndian.AppendUint64(key, uint64(assertion.Attribute))
+	key = append(key, keyVal...)
+
+	// Value layout:
+	// | mode   |   tx    | entity  | valid from | valid to |
+	// | 1 byte | 8 bytes | 8 bytes |  8 bytes   | 8 bytes  |
+	record := appendRecordHeader(b.alloc(recordHeaderSize+33), CompressionNone)
+	record = append(record, uint8(assertion.Mode()))
+	record = binary.BigEndian.AppendUint64(record, uint64(assertion.Tx))
+	record = binary.BigEndian.AppendUint64(record, uint64(assertion.EntityID))
+	record = binary.BigEndian.AppendUint64(record, encodeValidFrom(assertion.ValidFrom))
+	record = binary.BigEndian.AppendUint64(record, encodeValidTo(assertion.ValidTo))
+	b.set(key, record)
+}
+
+// setHistory sets a sealed history record in both history indexes. The
+// position of the assertion within its transaction is part of the key so that
+// multiple assertions about the same entity and attribute within a single
+// transaction do not overwrite each other.
+func (b *indexBatch) setHistory(seq uint32, assertion store.ResolvedAssertion, record []byte) {
+	// Key layout:
+	// | table prefix | entity/attribute | attribute/entity |   tx    |   seq   |
+	// |   1 byte     |     8 bytes      |     8 bytes      | 8 bytes | 4 bytes |
+	eavtKey := append(b.alloc(29), tblPrefixEAVTHistory)
+	eavtKey = binary.BigEndian.AppendUint64(eavtKey, uint64(assertion.EntityID))
+	eavtKey = binary.BigEndian.AppendUint64(eavtKey, uint64(assertion.Attribute))
+	eavtKey = binary.BigEndian.AppendUint64(eavtKey, uint64(assertion.Tx))
+	eavtKey = binary.BigEndian.AppendUint32(eavtKey, seq)
+
+	aevtKey := append(b.alloc(29), tblPrefixAEVTHistory)
+	aevtKey = binary.BigEndian.AppendUint64(aevtKey, uint64(assertion.Attribute))
+	aevtKey = binary.BigEndian.AppendUint64(aevtKey, uint64(assertion.EntityID))
+	aevtKey = append(aevtKey, eavtKey[17:]...)
+
+	b.set(eavtKey, record)
+	b.set(aevtKey, record)
+}
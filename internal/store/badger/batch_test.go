@@ -0,0 +1,70 @@
+/*
+Copyright 2024 Andrew Meredith
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package badger
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIndexBatch(t *testing.T) {
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true).WithLogger(nil))
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer db.Close()
+
+	batch := newIndexBatch(1)
+	key := func(s string) []byte { return append(batch.alloc(len(s)), s...) }
+	batch.set(key("c"), []byte("1"))
+	batch.set(key("a"), []byte("2"))
+	batch.set(key("b"), []byte("3"))
+	// A key that is set more than once keeps the value that was set last.
+	batch.set(key("a"), []byte("4"))
+	// Values larger than an arena are carved from an arena of their own.
+	large := bytes.Repeat([]byte("x"), 2*batchArenaSize)
+	record, err := batch.seal(large, CompressionNone, 0)
+	if !assert.NoError(t, err) {
+		return
+	}
+	batch.set(key("d"), record)
+
+	assert.NoError(t, db.Update(batch.write))
+	var keys []string
+	values := make(map[string]string)
+	assert.NoError(t, db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			val, err := it.Item().ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			keys = append(keys, string(it.Item().Key()))
+			values[string(it.Item().Key())] = string(val)
+		}
+		return nil
+	}))
+	assert.Equal(t, []string{"a", "b", "c", "d"}, keys)
+	assert.Equal(t, "4", values["a"])
+	payload, err := openRecord([]byte(values["d"]))
+	assert.NoError(t, err)
+	assert.Equal(t, large, payload)
+}
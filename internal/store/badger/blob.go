@@ -0,0 +1,250 @@
+/*
+Copyright 2024 Andrew Meredith
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package badger
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/kendru/canter/internal/store"
+	"github.com/oklog/ulid/v2"
+)
+
+// blobChunkSize is the largest chunk of blob contents stored under a single
+// key.
+const blobChunkSize = 64 << 10
+
+// PutBlob implements store.BlobStore. The contents are streamed into chunks
+// that are keyed by a unique upload ID, since the digest is not known until
+// every chunk has been read. Once the digest is known, a manifest maps it to
+// the upload. If the blob already exists, the chunks of the new upload are
+// discarded.
+func (sto *badgerStore) PutBlob(r io.Reader) (store.BlobDigest, error) {
+	if err := sto.guardWritable(); err != nil {
+		return store.BlobDigest{}, err
+	}
+	var digest store.BlobDigest
+	upload := ulid.Make()
+	hash := sha256.New()
+
+	wb := sto.db.NewWriteBatch()
+	defer wb.Cancel()
+	var size int64
+	var chunks uint32
+	// Compressed chunks begin with the Compression that was applied to them,
+	// since chunks that do not shrink are stored uncompressed.
+	compression := sto.opts.Compression.Blobs
+	compressChunks := compression != CompressionNone
+	buf := make([]byte, blobChunkSize)
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			hash.Write(buf[:n])
+			chunk := append([]byte(nil), buf[:n]...)
+			if compressChunks {
+				compressed, applied, cerr := compression.compress(chunk, sto.opts.Compression.MinSize)
+				if cerr != nil {
+					return digest, fmt.Errorf("compressing blob chunk: %w", cerr)
+				}
+				chunk = append([]byte{byte(applied)}, compressed...)
+			}
+			if err := wb.Set(blobChunkKey(upload, chunks), chunk); err != nil {
+				return digest, fmt.Errorf("writing blob chunk: %w", err)
+			}
+			chunks++
+			size += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return digest, fmt.Errorf("reading blob: %w", err)
+		}
+	}
+	if err := wb.Flush(); err != nil {
+		return digest, fmt.Errorf("writing blob chunks: %w", err)
+	}
+	copy(digest[:], hash.Sum(nil))
+
+	var exists bool
+	err := sto.db.Update(func(txn *badger.Txn) error {
+		key := blobManifestKey(digest)
+		_, err := txn.Get(key)
+		switch {
+		case err == nil:
+			exists = true
+			return nil
+		case errors.Is(err, badger.ErrKeyNotFound):
+			// Value layout:
+			// | upload ID |  size   | chunks  | compressed |
+			// | 16 bytes  | 8 bytes | 4 bytes |   1 byte   |
+			//
+			// Manifests written before chunks could be compressed omit
+			// the compressed flag.
+			val := make([]byte, 29)
+			copy(val, upload[:])
+			binary.BigEndian.PutUint64(val[16:], uint64(size))
+			binary.BigEndian.PutUint32(val[24:], chunks)
+			if compressChunks {
+				val[28] = 1
+			}
+			return txn.Set(key, val)
+		default:
+			return err
+		}
+	})
+	if err != nil || exists {
+		if delErr := sto.deleteBlobChunks(upload, chunks); delErr != nil {
+			err = errors.Join(err, delErr)
+		}
+	}
+	if err != nil {
+		return digest, fmt.Errorf("writing blob manifest: %w", classifyErr(err))
+	}
+
+	return digest, nil
+}
+
+func (sto *badgerStore) deleteBlobChunks(upload ulid.ULID, chunks uint32) error {
+	wb := sto.db.NewWriteBatch()
+	defer wb.Cancel()
+	for idx := uint32(0); idx < chunks; idx++ {
+		if err := wb.Delete(blobChunkKey(upload, idx)); err != nil {
+			return err
+		}
+	}
+	return wb.Flush()
+}
+
+// OpenBlob implements store.BlobStore.
+func (sto *badgerStore) OpenBlob(digest store.BlobDigest) (io.ReadCloser, error) {
+	m, err := sto.blobManifest(digest)
+	if err != nil {
+		return nil, err
+	}
+	return &blobReader{
+		db:       sto.db,
+		manifest: m,
+	}, nil
+}
+
+// BlobSize implements store.BlobStore.
+func (sto *badgerStore) BlobSize(digest store.BlobDigest) (int64, error) {
+	m, err := sto.blobManifest(digest)
+	if err != nil {
+		return 0, err
+	}
+	return m.size, nil
+}
+
+type blobManifest struct {
+	upload ulid.ULID
+	size   int64
+	chunks uint32
+	// compressed is set if each chunk begins with its Compression.
+	compressed bool
+}
+
+func (sto *badgerStore) blobManifest(digest store.BlobDigest) (blobManifest, error) {
+	var m blobManifest
+	err := sto.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(blobManifestKey(digest))
+		if errors.Is(err, badger.ErrKeyNotFound) {
+			return errors.Join(
+				fmt.Errorf("no blob with digest %s", digest),
+				store.ErrNoSuchBlob,
+			)
+		}
+		if err != nil {
+			return err
+		}
+		return item.Value(func(val []byte) error {
+			copy(m.upload[:], val[:16])
+			m.size = int64(binary.BigEndian.Uint64(val[16:]))
+			m.chunks = binary.BigEndian.Uint32(val[24:])
+			m.compressed = len(val) > 28 && val[28] != 0
+			return nil
+		})
+	})
+	return m, err
+}
+
+// blobReader streams the chunks of a blob, reading one chunk at a time.
+type blobReader struct {
+	db       *badger.DB
+	manifest blobManifest
+	next     uint32
+	buf      []byte
+}
+
+func (br *blobReader) Read(p []byte) (int, error) {
+	for len(br.buf) == 0 {
+		if br.next >= br.manifest.chunks {
+			return 0, io.EOF
+		}
+		err := br.db.View(func(txn *badger.Txn) error {
+			item, err := txn.Get(blobChunkKey(br.manifest.upload, br.next))
+			if err != nil {
+				return err
+			}
+			br.buf, err = item.ValueCopy(br.buf[:0])
+			if err != nil || !br.manifest.compressed {
+				return err
+			}
+			if len(br.buf) == 0 {
+				return fmt.Errorf("empty compressed chunk")
+			}
+			br.buf, err = Compression(br.buf[0]).decompress(br.buf[1:])
+			return err
+		})
+		if err != nil {
+			return 0, fmt.Errorf("reading blob chunk %d: %w", br.next, err)
+		}
+		br.next++
+	}
+	n := copy(p, br.buf)
+	br.buf = br.buf[n:]
+	return n, nil
+}
+
+func (br *blobReader) Close() error {
+	br.buf = nil
+	br.next = br.manifest.chunks
+	return nil
+}
+
+func blobManifestKey(digest store.BlobDigest) []byte {
+	// Key layout:
+	// | table prefix |  digest  |
+	// |   1 byte     | 32 bytes |
+	return append([]byte{tblPrefixBlobManifests}, digest[:]...)
+}
+
+func blobChunkKey(upload ulid.ULID, idx uint32) []byte {
+	// Key layout:
+	// | table prefix | upload ID |  chunk  |
+	// |   1 byte     | 16 bytes  | 4 bytes |
+	key := make([]byte, 21)
+	key[0] = tblPrefixBlobChunks
+	copy(key[1:], upload[:])
+	binary.BigEndian.PutUint32(key[17:], idx)
+	return key
+}
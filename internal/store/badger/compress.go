@@ -0,0 +1,148 @@
+/*
+Copyright 2024 Andrew Meredith
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package badger
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression identifies the algorithm used to compress stored data. The
+// algorithm is recorded alongside the data, so changing the compression of a
+// table only affects data that is written afterwards.
+type Compression uint8
+
+const (
+	CompressionNone Compression = iota
+	CompressionSnappy
+	CompressionZstd
+)
+
+func (c Compression) String() string {
+	switch c {
+	case CompressionNone:
+		return "none"
+	case CompressionSnappy:
+		return "snappy"
+	case CompressionZstd:
+		return "zstd"
+	default:
+		return fmt.Sprintf("Compression(%d)", uint8(c))
+	}
+}
+
+// ParseCompression returns the compression with the given name, as returned by
+// String.
+func ParseCompression(name string) (Compression, error) {
+	for _, c := range []Compression{CompressionNone, CompressionSnappy, CompressionZstd} {
+		if c.String() == name {
+			return c, nil
+		}
+	}
+	return CompressionNone, fmt.Errorf("unknown compression %q", name)
+}
+
+// CompressionOptions configures compression for each table that may hold
+// large values.
+type CompressionOptions struct {
+	// Index compresses records in the current EAVT and AEVT indexes.
+	Index Compression
+	// History compresses records in the history indexes.
+	History Compression
+	// ValueBlobs compresses values that are too large to store inline.
+	ValueBlobs Compression
+	// Blobs compresses the chunks of db.type/blob contents.
+	Blobs Compression
+	// MinSize is the smallest payload, in bytes, that is compressed. Smaller
+	// payloads are stored uncompressed, as are payloads that do not shrink.
+	MinSize int
+}
+
+var (
+	zstdOnce    sync.Once
+	zstdEncoder *zstd.Encoder
+	zstdDecoder *zstd.Decoder
+	zstdErr     error
+)
+
+// zstdCodec returns an encoder and decoder that are shared by every store.
+// Both are safe for concurrent use with EncodeAll and DecodeAll.
+func zstdCodec() (*zstd.Encoder, *zstd.Decoder, error) {
+	zstdOnce.Do(func() {
+		zstdEncoder, zstdErr = zstd.NewWriter(nil)
+		if zstdErr != nil {
+			return
+		}
+		zstdDecoder, zstdErr = zstd.NewReader(nil)
+	})
+	return zstdEncoder, zstdDecoder, zstdErr
+}
+
+// compress compresses data if it is at least minSize bytes long and
+// compression shrinks it. It returns the data and the compression that was
+// actually applied.
+func (c Compression) compress(data []byte, minSize int) ([]byte, Compression, error) {
+	if c == CompressionNone || len(data) < minSize {
+		return data, CompressionNone, nil
+	}
+	var out []byte
+	switch c {
+	case CompressionSnappy:
+		out = snappy.Encode(nil, data)
+	case CompressionZstd:
+		enc, _, err := zstdCodec()
+		if err != nil {
+			return nil, CompressionNone, fmt.Errorf("initializing zstd: %w", err)
+		}
+		out = enc.EncodeAll(data, nil)
+	default:
+		return nil, CompressionNone, fmt.Errorf("unsupported compression: %s", c)
+	}
+	if len(out) >= len(data) {
+		return data, CompressionNone, nil
+	}
+	return out, c, nil
+}
+
+// decompress reverses compress.
+func (c Compression) decompress(data []byte) ([]byte, error) {
+	switch c {
+	case CompressionNone:
+		return data, nil
+	case CompressionSnappy:
+		out, err := snappy.Decode(nil, data)
+		if err != nil {
+			return nil, fmt.Errorf("decompressing snappy data: %w", err)
+		}
+		return out, nil
+	case CompressionZstd:
+		_, dec, err := zstdCodec()
+		if err != nil {
+			return nil, fmt.Errorf("initializing zstd: %w", err)
+		}
+		out, err := dec.DecodeAll(data, nil)
+		if err != nil {
+			return nil, fmt.Errorf("decompressing zstd data: %w", err)
+		}
+		return out, nil
+	default:
+		return nil, fmt.Errorf("unsupported compression: %s", c)
+	}
+}
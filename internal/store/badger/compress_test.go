@@ -0,0 +1,120 @@
+/*
+Copyright 2024 Andrew Meredith
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package badger
+
+import (
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/kendru/canter/internal/store"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompressedRecords(t *testing.T) {
+	payload := []byte(strings.Repeat("canter", 100))
+	for _, c := range []Compression{CompressionNone, CompressionSnappy, CompressionZstd} {
+		sealed, err := sealCompressedRecord(payload, c, 16)
+		if !assert.NoError(t, err) {
+			continue
+		}
+		assert.Equal(t, uint8(c), sealed[1], c.String())
+		opened, err := openRecord(sealed)
+		assert.NoError(t, err)
+		assert.Equal(t, payload, opened, c.String())
+	}
+
+	// Payloads below the minimum size are not compressed.
+	sealed, err := sealCompressedRecord(payload, CompressionZstd, len(payload)+1)
+	assert.NoError(t, err)
+	assert.Equal(t, sealRecord(payload), sealed)
+}
+
+func TestCompressedStore(t *testing.T) {
+	for _, c := range []Compression{CompressionSnappy, CompressionZstd} {
+		db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true).WithLogger(nil))
+		if !assert.NoError(t, err) {
+			return
+		}
+		opts := DefaultOptions()
+		opts.Compression = CompressionOptions{
+			Index:      c,
+			History:    c,
+			ValueBlobs: c,
+			Blobs:      c,
+			MinSize:    16,
+		}
+		sto, err := NewWithOptions(db, opts)
+		if !assert.NoError(t, err) {
+			return
+		}
+		conn := store.NewConnection(store.Config{
+			IdentManager: sto,
+			IDManager:    sto,
+			Indexer:      sto,
+			BlobStore:    sto,
+		})
+		if !assert.NoError(t, conn.InitializeDB()) {
+			return
+		}
+		_, err = conn.Assert(
+			store.EntityData{"db/ident": "doc/id", "db/type": "db.type/string", "db/unique": true},
+			store.EntityData{"db/ident": "doc/body", "db/type": "db.type/string"},
+			store.EntityData{"db/ident": "doc/attachment", "db/type": "db.type/blob"},
+		)
+		if !assert.NoError(t, err) {
+			return
+		}
+
+		// Large values are stored in the value blob table, and blobs span
+		// several chunks.
+		inline := strings.Repeat("inline ", 10)
+		large := strings.Repeat("large ", 1000)
+		contents := strings.Repeat("blob contents ", 10000)
+		digest, err := conn.PutBlob(strings.NewReader(contents))
+		if !assert.NoError(t, err) {
+			return
+		}
+		_, err = conn.Assert(
+			store.EntityData{"doc/id": "a", "doc/body": inline},
+			store.EntityData{"doc/id": "b", "doc/body": large, "doc/attachment": digest},
+		)
+		if !assert.NoError(t, err) {
+			return
+		}
+
+		for id, body := range map[string]string{"a": inline, "b": large} {
+			entity, err := conn.GetEntity(store.NewLookup("doc/id", id))
+			if !assert.NoError(t, err) {
+				continue
+			}
+			val, err := entity.Get(conn, "doc/body")
+			assert.NoError(t, err)
+			assert.Equal(t, body, val, c.String())
+		}
+		r, err := conn.OpenBlob(digest)
+		if !assert.NoError(t, err) {
+			return
+		}
+		read, err := io.ReadAll(r)
+		assert.NoError(t, err)
+		assert.Equal(t, contents, string(read), c.String())
+		assert.NoError(t, sto.Close())
+		assert.NoError(t, db.Close())
+	}
+}
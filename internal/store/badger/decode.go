@@ -0,0 +1,280 @@
+/*
+Copyright 2024 Andrew Meredith
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package badger
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"math"
+	"math/bits"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/gofrs/uuid/v5"
+	"github.com/kendru/canter/internal/store"
+	"github.com/oklog/ulid/v2"
+)
+
+// factDecoder decodes the values of the facts read by a single scan. It
+// remembers the type of each attribute that it has seen, so the schema is read
+// once per attribute rather than once per fact, and it decodes scalar values
+// without gob (see decodeScalar). A factDecoder is not safe for concurrent use.
+type factDecoder struct {
+	types map[store.ID]store.ID
+	rd    bytes.Reader
+}
+
+func newFactDecoder() *factDecoder {
+	return &factDecoder{types: make(map[store.ID]store.ID)}
+}
+
+// decodeValue decodes a value that was written with storedValue. Binary
+// values may share memory with data, so they are only valid for as long as
+// data is.
+func (d *factDecoder) decodeValue(txn *badger.Txn, attribute store.ID, data []byte) (store.Value, error) {
+	encoded, err := loadValue(txn, data)
+	if err != nil {
+		return nil, err
+	}
+	if attribute == store.IDUnique {
+		return decodeUnique(encoded)
+	}
+	// We could either encode a type in the value, or we could look
+	// up the attribute's type in the schema. This would require us
+	// to look up the schema on a "smart path" that does not rely on
+	// ScanEAVT itself. We could also cache the schema in the store,
+	// assuming that the type of an attribute is immutable or we
+	// have a way to invalidate the cache.
+	// If we store a type tag in the value, we could support schema
+	// evolution by deferring rewriting the value until it is read.
+	attrType, ok := d.types[attribute]
+	if !ok {
+		if attrType, err = attributeType(txn, attribute); err != nil {
+			return nil, err
+		}
+		d.types[attribute] = attrType
+	}
+	if val, ok := decodeScalar(encoded, attrType); ok {
+		return val, nil
+	}
+
+	d.rd.Reset(encoded)
+	dec := gob.NewDecoder(&d.rd)
+	switch attrType {
+	case store.IDTypeRef:
+		return decodeAs[store.ID](dec, "ref")
+	case store.IDTypeString:
+		return decodeAs[string](dec, "string")
+	case store.IDTypeInt64:
+		return decodeAs[int64](dec, "int64")
+	case store.IDTypeInt32:
+		return decodeAs[int32](dec, "int32")
+	case store.IDTypeInt16:
+		return decodeAs[int16](dec, "int16")
+	case store.IDTypeInt8:
+		return decodeAs[int8](dec, "int8")
+	case store.IDTypeFloat64:
+		return decodeAs[float64](dec, "float64")
+	case store.IDTypeFloat32:
+		return decodeAs[float32](dec, "float32")
+	case store.IDTypeBoolean:
+		return decodeAs[bool](dec, "bool")
+	case store.IDTypeTimestamp, store.IDTypeDate:
+		return decodeAs[time.Time](dec, "time")
+	case store.IDTypeBinary:
+		return decodeAs[[]byte](dec, "binary")
+	case store.IDTypeUUID:
+		return decodeAs[uuid.UUID](dec, "uuid")
+	case store.IDTypeULID:
+		return decodeAs[ulid.ULID](dec, "ulid")
+	case store.IDTypeBlob:
+		return decodeAs[store.BlobDigest](dec, "blob")
+	case store.IDTypeTuple, store.IDTypeComposite:
+		return decodeAs[store.Tuple](dec, "tuple")
+	default:
+		return nil, fmt.Errorf("unsupported value type for attribute %q: %q", attribute, attrType)
+	}
+}
+
+// The ids that gob assigns to its basic types, as they appear on the wire.
+const (
+	gobWireBool   = 1 << 1
+	gobWireInt    = 2 << 1
+	gobWireFloat  = 4 << 1
+	gobWireBytes  = 5 << 1
+	gobWireString = 6 << 1
+)
+
+// decodeScalar decodes a value of a scalar type directly from its gob
+// encoding, which avoids the reflection and allocations of a gob.Decoder. A
+// gob stream holding a single scalar has the layout
+//
+//	| message length | type id | 0 | value |
+//
+// where the length and value are encoded as gob integers. It reports false if
+// the type is not a scalar or the encoding is not of this form, in which case
+// the value should be decoded with gob. Binary values share memory with
+// encoded.
+func decodeScalar(encoded []byte, attrType store.ID) (store.Value, bool) {
+	var wireType uint64
+	switch attrType {
+	case store.IDTypeRef, store.IDTypeInt64, store.IDTypeInt32, store.IDTypeInt16, store.IDTypeInt8:
+		wireType = gobWireInt
+	case store.IDTypeFloat64, store.IDTypeFloat32:
+		wireType = gobWireFloat
+	case store.IDTypeBoolean:
+		wireType = gobWireBool
+	case store.IDTypeString:
+		wireType = gobWireString
+	case store.IDTypeBinary:
+		wireType = gobWireBytes
+	default:
+		return nil, false
+	}
+
+	n, msg, ok := gobUint(encoded)
+	if !ok || n != uint64(len(msg)) {
+		return nil, false
+	}
+	typeID, msg, ok := gobUint(msg)
+	if !ok || typeID != wireType || len(msg) == 0 || msg[0] != 0 {
+		return nil, false
+	}
+	u, rest, ok := gobUint(msg[1:])
+	if !ok {
+		return nil, false
+	}
+
+	switch wireType {
+	case gobWireString, gobWireBytes:
+		if u != uint64(len(rest)) {
+			return nil, false
+		}
+		if wireType == gobWireString {
+			return string(rest), true
+		}
+		return rest[:u:u], true
+	}
+	if len(rest) != 0 {
+		return nil, false
+	}
+
+	switch attrType {
+	case store.IDTypeRef:
+		return store.ID(gobInt(u)), true
+	case store.IDTypeInt64:
+		return gobInt(u), true
+	case store.IDTypeInt32:
+		return intAs[int32](gobInt(u), math.MinInt32, math.MaxInt32)
+	case store.IDTypeInt16:
+		return intAs[int16](gobInt(u), math.MinInt16, math.MaxInt16)
+	case store.IDTypeInt8:
+		return intAs[int8](gobInt(u), math.MinInt8, math.MaxInt8)
+	case store.IDTypeFloat64:
+		return math.Float64frombits(bits.ReverseBytes64(u)), true
+	case store.IDTypeFloat32:
+		f := math.Float64frombits(bits.ReverseBytes64(u))
+		if f32 := float32(f); float64(f32) == f || math.IsNaN(f) {
+			return f32, true
+		}
+		return nil, false
+	case store.IDTypeBoolean:
+		if u > 1 {
+			return nil, false
+		}
+		return u == 1, true
+	}
+	return nil, false
+}
+
+// gobUint decodes an unsigned integer from the front of buf. Integers below
+// 128 are a single byte; larger integers are preceded by their negated byte
+// count.
+func gobUint(buf []byte) (uint64, []byte, bool) {
+	if len(buf) == 0 {
+		return 0, nil, false
+	}
+	if buf[0] < 0x80 {
+		return uint64(buf[0]), buf[1:], true
+	}
+	n := -int(int8(buf[0]))
+	if n > 8 || len(buf) < 1+n {
+		return 0, nil, false
+	}
+	var x uint64
+	for _, b := range buf[1 : 1+n] {
+		x = x<<8 | uint64(b)
+	}
+	return x, buf[1+n:], true
+}
+
+// gobInt decodes a signed integer from its gob encoding, which stores the
+// sign in the low bit.
+func gobInt(u uint64) int64 {
+	if u&1 != 0 {
+		return ^int64(u >> 1)
+	}
+	return int64(u >> 1)
+}
+
+// intAs converts i to a narrower integer type, reporting false if it does not
+// fit.
+func intAs[T int32 | int16 | int8](i, lo, hi int64) (store.Value, bool) {
+	if i < lo || i > hi {
+		return nil, false
+	}
+	return T(i), true
+}
+
+// attributeType returns the type of the attribute, as visible to txn.
+func attributeType(txn *badger.Txn, attribute store.ID) (store.ID, error) {
+	typeID := int64(store.IDType)
+	// Schema facts are never bounded in valid time.
+	key := make([]byte, 25)
+	key[0] = tblPrefixEAVT
+	binary.BigEndian.PutUint64(key[1:], uint64(attribute))
+	binary.BigEndian.PutUint64(key[9:], uint64(typeID))
+	binary.BigEndian.PutUint64(key[17:], encodeValidFrom(time.Time{}))
+
+	var attrTypeID store.ID
+	item, err := txn.Get(key)
+	if err == nil {
+		err = item.Value(func(record []byte) error {
+			val, err := openRecord(record)
+			if err != nil {
+				return err
+			}
+			// Skip mode bit + tx id + valid to.
+			encoded, err := loadValue(txn, val[17:])
+			if err != nil {
+				return err
+			}
+			// See NOTE [VALUE-ENCODING].
+			if id, ok := decodeScalar(encoded, store.IDTypeRef); ok {
+				attrTypeID = id.(store.ID)
+				return nil
+			}
+			return gob.NewDecoder(bytes.NewReader(encoded)).Decode(&attrTypeID)
+		})
+	}
+	if err != nil {
+		return 0, fmt.Errorf("fetching type for attribute %q: %w", attribute, err)
+	}
+	return attrTypeID, nil
+}
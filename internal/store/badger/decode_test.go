@@ -0,0 +1,155 @@
+/*
+Copyright 2024 Andrew Meredith
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package badger
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"errors"
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/kendru/canter/internal/store"
+	"github.com/kendru/canter/pkg/dataflow"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDecodeScalar(t *testing.T) {
+	for _, tc := range []struct {
+		typ store.ID
+		val store.Value
+	}{
+		{store.IDTypeRef, store.ID(0)},
+		{store.IDTypeRef, store.ID(1 << 40)},
+		{store.IDTypeInt64, int64(math.MinInt64)},
+		{store.IDTypeInt64, int64(math.MaxInt64)},
+		{store.IDTypeInt32, int32(-7)},
+		{store.IDTypeInt16, int16(math.MaxInt16)},
+		{store.IDTypeInt8, int8(math.MinInt8)},
+		{store.IDTypeFloat64, 0.0},
+		{store.IDTypeFloat64, -1.5e300},
+		{store.IDTypeFloat32, float32(2.25)},
+		{store.IDTypeBoolean, true},
+		{store.IDTypeBoolean, false},
+		{store.IDTypeString, ""},
+		{store.IDTypeString, strings.Repeat("canter", 100)},
+		{store.IDTypeString, strings.Repeat("x", 0x7f)},
+		{store.IDTypeBinary, []byte{}},
+		{store.IDTypeBinary, []byte{0, 1, 2, 0xff}},
+	} {
+		// Scalars are encoded without gob, but exactly as gob would encode
+		// them.
+		var gobEncoded bytes.Buffer
+		assert.NoError(t, gob.NewEncoder(&gobEncoded).Encode(tc.val))
+		encoded, ok := appendScalar(nil, tc.val)
+		assert.True(t, ok)
+		assert.Equal(t, gobEncoded.Bytes(), encoded, "%T %v", tc.val, tc.val)
+
+		val, ok := decodeScalar(encoded, tc.typ)
+		assert.True(t, ok, "%T %v", tc.val, tc.val)
+		assert.Equal(t, tc.val, val)
+	}
+
+	// Values that are not scalars, or that do not fit the attribute's type,
+	// are left to gob.
+	encoded, err := encodeValue(nil, time.Now())
+	assert.NoError(t, err)
+	_, ok := decodeScalar(encoded, store.IDTypeTimestamp)
+	assert.False(t, ok)
+	encoded, err = encodeValue(nil, int64(1000))
+	assert.NoError(t, err)
+	_, ok = decodeScalar(encoded, store.IDTypeInt8)
+	assert.False(t, ok)
+	_, ok = decodeScalar(encoded, store.IDTypeString)
+	assert.False(t, ok)
+	_, ok = decodeScalar(encoded[:len(encoded)-1], store.IDTypeInt64)
+	assert.False(t, ok)
+}
+
+func TestVisitFacts(t *testing.T) {
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true).WithLogger(nil))
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer db.Close()
+	sto, err := New(db)
+	if !assert.NoError(t, err) {
+		return
+	}
+	conn := store.NewConnection(store.Config{
+		IdentManager: sto,
+		IDManager:    sto,
+		Indexer:      sto,
+		BlobStore:    sto,
+	})
+	if !assert.NoError(t, conn.InitializeDB()) {
+		return
+	}
+	_, err = conn.Assert(
+		store.EntityData{"db/ident": "doc/data", "db/type": "db.type/binary"},
+		store.EntityData{"db/ident": "doc/size", "db/type": "db.type/int64"},
+	)
+	if !assert.NoError(t, err) {
+		return
+	}
+	var docs []store.Assertable
+	for i := 0; i < 10; i++ {
+		docs = append(docs, store.EntityData{"doc/data": []byte{byte(i)}, "doc/size": int64(i)})
+	}
+	if _, err := conn.Assert(docs...); !assert.NoError(t, err) {
+		return
+	}
+	ids, err := sto.LookupIdentIDs([]string{"doc/data"})
+	if !assert.NoError(t, err) {
+		return
+	}
+	attr := ids[0]
+
+	// Visitors see every fact, and facts cloned from them match the facts
+	// that scans collect.
+	var visited []store.Fact
+	err = sto.VisitAEVT(attr, nil, func(fct *store.Fact) error {
+		visited = append(visited, fct.Clone())
+		return nil
+	})
+	assert.NoError(t, err)
+	scan, err := sto.ScanAEVT(attr, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	scanned, err := dataflow.CollectIntoSlice(dataflow.NewContext(context.Background()), scan)
+	assert.NoError(t, err)
+	if assert.Len(t, visited, 10) && assert.Len(t, scanned, 10) {
+		for i, fct := range scanned {
+			assert.Equal(t, *fct, visited[i])
+		}
+	}
+
+	// An error from the visitor stops the scan.
+	errStop := errors.New("stop")
+	n := 0
+	err = sto.VisitAEVT(attr, nil, func(*store.Fact) error {
+		n++
+		return errStop
+	})
+	assert.ErrorIs(t, err, errStop)
+	assert.Equal(t, 1, n)
+}
@@ -5,7 +5,7 @@ Licensed under the Apache License, Version 2.0 (the "License");
 you may not use this file except in compliance with the License.
 You may obtain a copy of the License at
 
-    http://www.apache.org/licenses/LICENSE-2.0
+	http://www.apache.org/licenses/LICENSE-2.0
 
 Unless required by applicable law or agreed to in writing, software
 distributed under the License is distributed on an "AS IS" BASIS,
@@ -17,15 +17,440 @@ limitations under the License.
 package badger
 
 import (
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"math"
+	"sync"
+	"time"
 
+	"github.com/dgraph-io/badger/v4"
+	"github.com/gofrs/uuid/v5"
 	"github.com/kendru/canter/internal/store"
 )
 
 func (sto *badgerStore) NextID() (store.ID, error) {
-	id, err := sto.idSeq.Next()
+	ids, err := sto.NextIDs(1)
 	if err != nil {
-		return store.ID(0), fmt.Errorf("allocating new ID: %w", err)
+		return store.ID(0), err
 	}
-	return store.ID(id), nil
+	return ids[0], nil
+}
+
+// NextIDs allocates n IDs from the store's ID lease. It only touches storage
+// when the lease is exhausted or due for renewal. See NOTE [ID-LEASES].
+func (sto *badgerStore) NextIDs(n int) ([]store.ID, error) {
+	if err := sto.guardWritable(); err != nil {
+		return nil, err
+	}
+	ids, err := sto.ids.take(n)
+	if err != nil {
+		return nil, fmt.Errorf("allocating new ID: %w", classifyErr(err))
+	}
+	return ids, nil
+}
+
+// ReserveIDs advances the ID sequence past through, so that IDs written by
+// replayed transactions are never allocated. Leases held by other owners are
+// not affected, so no other store instance may share the database while IDs
+// are reserved.
+func (sto *badgerStore) ReserveIDs(through store.ID) error {
+	if err := sto.guardWritable(); err != nil {
+		return err
+	}
+	if through <= 0 {
+		return nil
+	}
+	if err := sto.ids.reserve(uint64(through)); err != nil {
+		return fmt.Errorf("reserving IDs: %w", classifyErr(err))
+	}
+	return nil
+}
+
+// NOTE [ID-LEASES]:
+// IDs are allocated from leases: ranges of IDs that a store instance holds
+// exclusively. Each lease is recorded in the IDLeases table under the random
+// owner ID of the instance that holds it, along with the time at which it
+// expires. The next ID that has never been leased is kept under the seqID key,
+// in the format of the badger.Sequence that preceded leases.
+//
+// An owner renews its lease when it allocates IDs more than halfway through
+// the lease's term, and it verifies that it still holds an expired lease
+// before allocating from it. A lease that has expired may be reclaimed by
+// another owner. Since IDs that were handed out may already have been written,
+// only the IDs above the highest one found in the tables that are keyed by ID
+// are reclaimed. Releasing a lease when the store is closed returns its unused
+// IDs immediately, so IDs are only left unused until a lease expires if a
+// process exits without closing its store.
+//
+// Any number of store instances may share a Badger database, each allocating
+// from its own lease. Leases are acquired in conflict-checked transactions, so
+// two owners never acquire the same range.
+
+const (
+	// defaultIDLeaseTTL is the term of an ID lease when Options.IDLeaseTTL is
+	// zero.
+	defaultIDLeaseTTL = time.Minute
+	// idLeaseAttempts is the number of times that acquiring a lease is
+	// attempted when it conflicts with another owner.
+	idLeaseAttempts = 10
+)
+
+// idLease is the record of a lease in the IDLeases table. IDs in [start, end)
+// have not been handed out as of the time the record was written.
+type idLease struct {
+	start, end uint64
+	// expires is zero for a lease that was released.
+	expires time.Time
+}
+
+func (l idLease) encode() []byte {
+	// Value layout:
+	// |  start  |   end   | expires |
+	// | 8 bytes | 8 bytes | 8 bytes |
+	buf := make([]byte, 0, 24)
+	buf = binary.BigEndian.AppendUint64(buf, l.start)
+	buf = binary.BigEndian.AppendUint64(buf, l.end)
+	var expires uint64
+	if !l.expires.IsZero() {
+		expires = uint64(l.expires.UnixNano())
+	}
+	return binary.BigEndian.AppendUint64(buf, expires)
+}
+
+func decodeIDLease(val []byte) (idLease, error) {
+	if len(val) != 24 {
+		return idLease{}, fmt.Errorf("malformed ID lease: %x", val)
+	}
+	l := idLease{
+		start: binary.BigEndian.Uint64(val),
+		end:   binary.BigEndian.Uint64(val[8:]),
+	}
+	if expires := binary.BigEndian.Uint64(val[16:]); expires != 0 {
+		l.expires = time.Unix(0, int64(expires))
+	}
+	return l, nil
+}
+
+// expired reports whether the lease may be reclaimed at now.
+func (l idLease) expired(now time.Time) bool {
+	return l.expires.IsZero() || !now.Before(l.expires)
+}
+
+// idLeaser allocates IDs from a lease held by one owner.
+type idLeaser struct {
+	db    *badger.DB
+	owner uuid.UUID
+	// size is the number of IDs that are leased at a time.
+	size uint64
+	ttl  time.Duration
+	now  func() time.Time
+
+	mu sync.Mutex
+	// next and end bound the IDs of the lease that have not been handed out.
+	next, end uint64
+	expires   time.Time
+}
+
+func newIDLeaser(db *badger.DB, size uint64, ttl time.Duration) (*idLeaser, error) {
+	owner, err := uuid.NewV4()
+	if err != nil {
+		return nil, fmt.Errorf("generating ID lease owner: %w", err)
+	}
+	if ttl <= 0 {
+		ttl = defaultIDLeaseTTL
+	}
+	return &idLeaser{
+		db:    db,
+		owner: owner,
+		size:  size,
+		ttl:   ttl,
+		now:   time.Now,
+	}, nil
+}
+
+func (l *idLeaser) key() []byte {
+	// Key layout:
+	// | table prefix |  owner   |
+	// |   1 byte     | 16 bytes |
+	return append([]byte{tblPrefixIDLeases}, l.owner.Bytes()...)
+}
+
+// take hands out n IDs, renewing or acquiring leases as necessary.
+func (l *idLeaser) take(n int) ([]store.ID, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	ids := make([]store.ID, 0, n)
+	for len(ids) < n {
+		now := l.now()
+		if l.next < l.end && !now.Before(l.expires.Add(-l.ttl/2)) {
+			if err := l.renew(now); err != nil {
+				return nil, err
+			}
+		}
+		if l.next == l.end {
+			if err := l.acquire(uint64(n-len(ids)), now); err != nil {
+				return nil, err
+			}
+		}
+		for ; l.next < l.end && len(ids) < n; l.next++ {
+			// 0 is never a valid ID, since it is the zero value of store.ID.
+			if l.next == 0 {
+				continue
+			}
+			// IDs beyond the range of int64 would wrap into the system
+			// partition.
+			if l.next > math.MaxInt64 {
+				return nil, fmt.Errorf("ID sequence exhausted")
+			}
+			ids = append(ids, store.ID(l.next))
+		}
+	}
+	return ids, nil
+}
+
+// reserve ensures that no ID up to and including id is handed out, by skipping
+// it in the lease or by moving the frontier of the sequence past it.
+func (l *idLeaser) reserve(id uint64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if id < l.end {
+		// The rest of the sequence is already beyond the lease.
+		l.next = max(l.next, id+1)
+		return nil
+	}
+	l.next = l.end
+	return l.db.Update(func(txn *badger.Txn) error {
+		frontier, err := idFrontier(txn)
+		if err != nil || frontier > id {
+			return err
+		}
+		return setIDFrontier(txn, id+1)
+	})
+}
+
+// renew extends the term of the lease. If the lease was reclaimed by another
+// owner after it expired, its remaining IDs are dropped.
+func (l *idLeaser) renew(now time.Time) error {
+	lease := idLease{start: l.next, end: l.end, expires: now.Add(l.ttl)}
+	var lost bool
+	err := l.db.Update(func(txn *badger.Txn) error {
+		held, ok, err := l.held(txn)
+		if err != nil {
+			return err
+		}
+		if lost = !ok || held.end != l.end; lost {
+			return nil
+		}
+		return txn.Set(l.key(), lease.encode())
+	})
+	if errors.Is(err, badger.ErrConflict) {
+		// The lease is being reclaimed, so acquire a new one.
+		lost, err = true, nil
+	}
+	if err != nil {
+		return fmt.Errorf("renewing ID lease: %w", err)
+	}
+	if lost {
+		l.next = l.end
+		return nil
+	}
+	l.expires = lease.expires
+	return nil
+}
+
+// held returns the lease recorded for the owner, if any.
+func (l *idLeaser) held(txn *badger.Txn) (idLease, bool, error) {
+	item, err := txn.Get(l.key())
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		return idLease{}, false, nil
+	}
+	if err != nil {
+		return idLease{}, false, err
+	}
+	var lease idLease
+	err = item.Value(func(val []byte) error {
+		lease, err = decodeIDLease(val)
+		return err
+	})
+	return lease, err == nil, err
+}
+
+// acquire replaces the exhausted lease with a new lease of at least need IDs,
+// or with the unused IDs of an expired lease if there are any.
+func (l *idLeaser) acquire(need uint64, now time.Time) error {
+	size := max(l.size, need)
+	for attempt := 1; ; attempt++ {
+		var lease idLease
+		err := l.db.Update(func(txn *badger.Txn) error {
+			var ok bool
+			var err error
+			if lease, ok, err = reclaimIDLease(txn, l.owner, now); err != nil {
+				return err
+			}
+			if !ok {
+				start, err := idFrontier(txn)
+				if err != nil {
+					return err
+				}
+				if start > math.MaxUint64-size {
+					return fmt.Errorf("ID sequence exhausted")
+				}
+				lease = idLease{start: start, end: start + size}
+				if err := setIDFrontier(txn, lease.end); err != nil {
+					return err
+				}
+			}
+			lease.expires = now.Add(l.ttl)
+			return txn.Set(l.key(), lease.encode())
+		})
+		if errors.Is(err, badger.ErrConflict) && attempt < idLeaseAttempts {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("acquiring ID lease: %w", err)
+		}
+		l.next, l.end, l.expires = lease.start, lease.end, lease.expires
+		return nil
+	}
+}
+
+// release returns the unused IDs of the lease. If no lease was acquired after
+// it, the IDs are returned to the sequence. Otherwise, the lease is recorded
+// as released so that another owner may reclaim it at once.
+func (l *idLeaser) release() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.end == 0 {
+		return nil
+	}
+	err := l.db.Update(func(txn *badger.Txn) error {
+		held, ok, err := l.held(txn)
+		if err != nil || !ok || held.end != l.end {
+			return err
+		}
+		frontier, err := idFrontier(txn)
+		if err != nil {
+			return err
+		}
+		if l.next == l.end || l.end == frontier {
+			if l.end == frontier {
+				if err := setIDFrontier(txn, l.next); err != nil {
+					return err
+				}
+			}
+			return txn.Delete(l.key())
+		}
+		return txn.Set(l.key(), idLease{start: l.next, end: l.end}.encode())
+	})
+	if err != nil {
+		return fmt.Errorf("releasing ID lease: %w", err)
+	}
+	l.next = l.end
+	return nil
+}
+
+// reclaimIDLease takes over the unused IDs of a lease that has expired or
+// was released by another owner. Leases whose IDs were all used are deleted.
+func reclaimIDLease(txn *badger.Txn, owner uuid.UUID, now time.Time) (idLease, bool, error) {
+	type record struct {
+		key   []byte
+		lease idLease
+	}
+	var expired []record
+	prefix := []byte{tblPrefixIDLeases}
+	it := txn.NewIterator(badger.IteratorOptions{Prefix: prefix, PrefetchValues: true})
+	for it.Rewind(); it.Valid(); it.Next() {
+		item := it.Item()
+		if uuid.FromBytesOrNil(item.Key()[1:]) == owner {
+			continue
+		}
+		var lease idLease
+		if err := item.Value(func(val []byte) (err error) {
+			lease, err = decodeIDLease(val)
+			return err
+		}); err != nil {
+			it.Close()
+			return idLease{}, false, err
+		}
+		if lease.expired(now) {
+			expired = append(expired, record{key: item.KeyCopy(nil), lease: lease})
+		}
+	}
+	it.Close()
+
+	for _, rec := range expired {
+		if err := txn.Delete(rec.key); err != nil {
+			return idLease{}, false, err
+		}
+		start := rec.lease.start
+		used, ok, err := highestUsedID(txn, rec.lease.start, rec.lease.end)
+		if err != nil {
+			return idLease{}, false, err
+		}
+		if ok {
+			start = used + 1
+		}
+		if start < rec.lease.end {
+			return idLease{start: start, end: rec.lease.end}, true, nil
+		}
+	}
+	return idLease{}, false, nil
+}
+
+// idTables are the tables whose keys begin with an ID allocated by NextIDs.
+// Every allocated ID that is written is written to one of them: entities and
+// transactions to EAVT, idents to Idents, and interned values to ValueDict.
+var idTables = []byte{tblPrefixEAVT, tblPrefixIdents, tblPrefixValueDict}
+
+// highestUsedID returns the highest ID in [start, end) that has been written
+// to any of the idTables.
+func highestUsedID(txn *badger.Txn, start, end uint64) (uint64, bool, error) {
+	var highest uint64
+	var found bool
+	for _, table := range idTables {
+		it := txn.NewIterator(badger.IteratorOptions{Prefix: []byte{table}, Reverse: true})
+		// Reverse iteration seeks to the last key at or before the seek key.
+		for it.Seek(binary.BigEndian.AppendUint64([]byte{table}, end)); it.Valid(); it.Next() {
+			key := it.Item().Key()
+			if len(key) < 9 {
+				continue
+			}
+			id := binary.BigEndian.Uint64(key[1:])
+			if id >= end {
+				continue
+			}
+			if id >= start && (!found || id > highest) {
+				highest, found = id, true
+			}
+			break
+		}
+		it.Close()
+	}
+	return highest, found, nil
+}
+
+// idFrontier returns the lowest ID that has never been leased.
+func idFrontier(txn *badger.Txn) (uint64, error) {
+	item, err := txn.Get([]byte{seqID})
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	var frontier uint64
+	err = item.Value(func(val []byte) error {
+		if len(val) != 8 {
+			return fmt.Errorf("malformed ID sequence: %x", val)
+		}
+		frontier = binary.BigEndian.Uint64(val)
+		return nil
+	})
+	return frontier, err
+}
+
+func setIDFrontier(txn *badger.Txn, frontier uint64) error {
+	return txn.Set([]byte{seqID}, binary.BigEndian.AppendUint64(nil, frontier))
 }
@@ -0,0 +1,160 @@
+/*
+Copyright 2024 Andrew Meredith
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package badger
+
+import (
+	"encoding/binary"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/kendru/canter/internal/store"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIDLeases(t *testing.T) {
+	opts := DefaultOptions()
+	opts.IDPrefetch = 10
+	opts.IDLeaseTTL = time.Minute
+	now := time.Now()
+	// newDB opens a database for a scenario, and newStore opens a store in it
+	// whose clock reads *now.
+	var db *badger.DB
+	newDB := func() {
+		var err error
+		if db, err = badger.Open(badger.DefaultOptions("").WithInMemory(true).WithLogger(nil)); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { db.Close() })
+	}
+	newStore := func(now *time.Time) *badgerStore {
+		sto, err := NewWithOptions(db, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sto.ids.now = func() time.Time { return *now }
+		return sto
+	}
+
+	// Stores that share a database allocate from disjoint leases.
+	newDB()
+	a, b := newStore(&now), newStore(&now)
+	seen := make(map[store.ID]bool)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, sto := range []*badgerStore{a, b} {
+		wg.Add(1)
+		go func(sto *badgerStore) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				ids, err := sto.NextIDs(3)
+				assert.NoError(t, err)
+				mu.Lock()
+				for _, id := range ids {
+					assert.False(t, seen[id], "ID %d allocated twice", id)
+					seen[id] = true
+				}
+				mu.Unlock()
+			}
+		}(sto)
+	}
+	wg.Wait()
+	assert.Len(t, seen, 300)
+
+	// A store that exits without closing leaves its lease behind. Once the
+	// lease expires, IDs above the highest one that was written are
+	// reclaimed.
+	newDB()
+	crashed := newStore(&now)
+	ids, err := crashed.NextIDs(3)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, db.Update(func(txn *badger.Txn) error {
+		key := binary.BigEndian.AppendUint64([]byte{tblPrefixEAVT}, uint64(ids[1]))
+		return txn.Set(append(key, 0, 0), nil)
+	}))
+	later := now.Add(2 * time.Minute)
+	c := newStore(&later)
+	id, err := c.NextID()
+	assert.NoError(t, err)
+	assert.Equal(t, ids[1]+1, id)
+	reclaimed, err := c.NextIDs(6)
+	assert.NoError(t, err)
+	assert.Equal(t, ids[0]+8, reclaimed[len(reclaimed)-1], "the rest of the lease was reclaimed")
+
+	// A store whose lease was reclaimed after it expired does not allocate
+	// from it again.
+	crashed.ids.now = func() time.Time { return later }
+	id, err = crashed.NextID()
+	assert.NoError(t, err)
+	assert.Greater(t, id, ids[0]+8)
+
+	// Closing a store releases its lease for reclamation at once.
+	newDB()
+	d := newStore(&now)
+	id, err = d.NextID()
+	assert.NoError(t, err)
+	_, err = newStore(&now).NextID()
+	assert.NoError(t, err)
+	assert.NoError(t, d.Close())
+	next, err := newStore(&now).NextID()
+	assert.NoError(t, err)
+	assert.Equal(t, id+1, next)
+}
+
+func TestReserveIDs(t *testing.T) {
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true).WithLogger(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	opts := DefaultOptions()
+	opts.IDPrefetch = 10
+	sto, err := NewWithOptions(db, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// IDs beyond the lease move the sequence past them.
+	assert.NoError(t, sto.ReserveIDs(25))
+	id, err := sto.NextID()
+	assert.NoError(t, err)
+	assert.Equal(t, store.ID(26), id)
+
+	// IDs within the lease are skipped in it.
+	assert.NoError(t, sto.ReserveIDs(30))
+	id, err = sto.NextID()
+	assert.NoError(t, err)
+	assert.Equal(t, store.ID(31), id)
+
+	// Reserving IDs that were already handed out has no effect.
+	assert.NoError(t, sto.ReserveIDs(5))
+	id, err = sto.NextID()
+	assert.NoError(t, err)
+	assert.Equal(t, store.ID(32), id)
+
+	// Other stores continue after the reserved IDs.
+	other, err := NewWithOptions(db, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err = other.NextID()
+	assert.NoError(t, err)
+	assert.Greater(t, id, store.ID(35))
+}
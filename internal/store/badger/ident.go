@@ -20,12 +20,24 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
-	"strconv"
 
 	"github.com/dgraph-io/badger/v4"
 	"github.com/kendru/canter/internal/store"
 )
 
+// identFlagAlias is the value of an entry in the idents table whose name is an
+// alias rather than the canonical name of the ident.
+const identFlagAlias byte = 1
+
+func isAliasItem(item *badger.Item) (bool, error) {
+	var alias bool
+	err := item.Value(func(val []byte) error {
+		alias = len(val) > 0 && val[0] == identFlagAlias
+		return nil
+	})
+	return alias, err
+}
+
 func (s *badgerStore) LoadIdents() ([]store.Ident, error) {
 	var idents []store.Ident
 	opts := badger.IteratorOptions{
@@ -39,18 +51,22 @@ func (s *badgerStore) LoadIdents() ([]store.Ident, error) {
 			// | table prefix |    id   | name |
 			// |   1 byte     | 8 bytes | ...  |
 
-			// Note that the ident table acts as a sorted set, and the
-			// associated values are empty.
-			key := it.Item().Key()
-			id, err := strconv.ParseInt(string(key[1:9]), 10, 64)
+			// Note that the ident table acts as a sorted set. The
+			// associated values are empty, except for aliases, which are
+			// marked with identFlagAlias.
+			item := it.Item()
+			key := item.Key()
+			if len(key) < 9 {
+				return fmt.Errorf("malformed ident key: %x", key)
+			}
+			alias, err := isAliasItem(item)
 			if err != nil {
-				panic("malformed id. database corrupt.")
+				return err
 			}
-			name := make([]byte, 0, len(key)-9)
-			key = append(name, key[9:]...)
 			idents = append(idents, store.Ident{
-				ID:   store.ID(id),
-				Name: string(name),
+				ID:    store.ID(binary.BigEndian.Uint64(key[1:9])),
+				Name:  string(key[9:]),
+				Alias: alias,
 			})
 		}
 		return nil
@@ -110,7 +126,16 @@ func (s *badgerStore) LookupIdentNames(ids []store.ID) ([]string, error) {
 		defer it.Close()
 		for idx, id := range ids {
 			binary.BigEndian.PutUint64(keyPrefix[1:], uint64(id))
-			it.Seek(keyPrefix)
+			// Skip over any aliases to find the canonical name.
+			for it.Seek(keyPrefix); it.ValidForPrefix(keyPrefix); it.Next() {
+				alias, err := isAliasItem(it.Item())
+				if err != nil {
+					return err
+				}
+				if !alias {
+					break
+				}
+			}
 			if !it.ValidForPrefix(keyPrefix) {
 				return errors.Join(
 					fmt.Errorf("no ident for id %d", id),
@@ -130,6 +155,94 @@ func (s *badgerStore) LookupIdentNames(ids []store.ID) ([]string, error) {
 }
 
 func (s *badgerStore) StoreIdent(ident store.Ident) error {
+	if err := s.guardWritable(); err != nil {
+		return err
+	}
+	return classifyErr(s.db.Update(func(txn *badger.Txn) error {
+		return setIdent(txn, ident)
+	}))
+}
+
+func (s *badgerStore) AllocateIdents(names []string) ([]store.Ident, error) {
+	if err := s.guardWritable(); err != nil {
+		return nil, err
+	}
+	idents := make([]store.Ident, len(names))
+	err := s.db.View(func(txn *badger.Txn) error {
+		allocated := make(map[string]store.ID, len(names))
+		key := make([]byte, 0, 64)
+		for idx, name := range names {
+			if id, ok := allocated[name]; ok {
+				idents[idx] = store.Ident{ID: id, Name: name}
+				continue
+			}
+
+			key = append(key[:0], tblPrefixIdentIDByName)
+			key = append(key, name...)
+			id, err := getIdentID(txn, key)
+			switch err {
+			case nil:
+				// Ident already exists - reuse its ID.
+			case badger.ErrKeyNotFound:
+				ids, err := s.NextIDs(1)
+				if err != nil {
+					return fmt.Errorf("allocating ID for ident %q: %w", name, err)
+				}
+				id = ids[0]
+			default:
+				return err
+			}
+			idents[idx] = store.Ident{ID: id, Name: name}
+			allocated[name] = id
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return idents, nil
+}
+
+// writeIdent stores an ident within a write transaction unless it already
+// exists. The read of the existing ident adds the ident to the transaction's
+// read set, so concurrent transactions that create the same ident conflict.
+func writeIdent(txn *badger.Txn, ident store.Ident) error {
+	key := append([]byte{tblPrefixIdentIDByName}, ident.Name...)
+	id, err := getIdentID(txn, key)
+	switch err {
+	case nil:
+		if id != ident.ID {
+			return errors.Join(
+				fmt.Errorf("ident %q already exists with ID %d", ident.Name, id),
+				store.ErrIdentAlreadyExists,
+			)
+		}
+		return nil
+	case badger.ErrKeyNotFound:
+		return setIdent(txn, ident)
+	default:
+		return err
+	}
+}
+
+func getIdentID(txn *badger.Txn, key []byte) (store.ID, error) {
+	item, err := txn.Get(key)
+	if err != nil {
+		return 0, err
+	}
+	var id store.ID
+	err = item.Value(func(val []byte) error {
+		id = store.ID(binary.BigEndian.Uint64(val))
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("getting ID for name: %w", err)
+	}
+	return id, nil
+}
+
+func setIdent(txn *badger.Txn, ident store.Ident) error {
 	id := ident.ID
 	name := ident.Name
 
@@ -146,17 +259,15 @@ func (s *badgerStore) StoreIdent(ident store.Ident) error {
 
 	identIDByNameKey := append([]byte{tblPrefixIdentIDByName}, name...)
 
-	return s.db.Update(func(txn *badger.Txn) error {
-		// Set entry in Idents table.
-		if err := txn.Set(identsKey, nil); err != nil {
-			return err
-		}
-
-		// Set entry in IdentIDByName table.
-		if err := txn.Set(identIDByNameKey, idBytes[:]); err != nil {
-			return err
-		}
+	// Set entry in Idents table.
+	var identsVal []byte
+	if ident.Alias {
+		identsVal = []byte{identFlagAlias}
+	}
+	if err := txn.Set(identsKey, identsVal); err != nil {
+		return err
+	}
 
-		return nil
-	})
+	// Set entry in IdentIDByName table.
+	return txn.Set(identIDByNameKey, idBytes[:])
 }
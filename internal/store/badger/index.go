@@ -20,257 +20,714 @@ import (
 	"bytes"
 	"encoding/binary"
 	"encoding/gob"
+	"errors"
 	"fmt"
+	"math"
+	"math/bits"
+	"sort"
+	"sync"
+	"time"
 
 	"github.com/dgraph-io/badger/v4"
+	"github.com/gofrs/uuid/v5"
 	"github.com/kendru/canter/internal/store"
 	"github.com/kendru/canter/pkg/dataflow"
+	"github.com/oklog/ulid/v2"
 )
 
-func (sto *badgerStore) Write(assertions []store.ResolvedAssertion) error {
-	return sto.db.Update(func(txn *badger.Txn) error {
+func (sto *badgerStore) Write(assertions []store.ResolvedAssertion, idents []store.Ident) error {
+	if err := sto.guardWritable(); err != nil {
+		return err
+	}
+	return classifyErr(sto.db.Update(func(txn *badger.Txn) error {
 		// TODO: Write transaction entity data.
 
-		for _, assertion := range assertions {
-			// Write to EAVT
-			if err := writeEAVT(txn, assertion); err != nil {
+		for _, ident := range idents {
+			if err := writeIdent(txn, ident); err != nil {
+				return fmt.Errorf("writing ident %q: %w", ident.Name, err)
+			}
+		}
+		if err := sto.checkUniqueClaims(txn, assertions); err != nil {
+			return err
+		}
+
+		// Values and records are encoded into scratch buffers that are reused
+		// for every assertion. Only the keys and sealed records of the batch
+		// are retained by txn.
+		encodeBuf := getBuffer()
+		defer putBuffer(encodeBuf)
+		recordBuf := getBuffer()
+		defer putBuffer(recordBuf)
+		keyValBuf := getBuffer()
+		defer putBuffer(keyValBuf)
+
+		batch := newIndexBatch(len(assertions))
+		interned := make(map[store.ID]bool)
+		for idx, assertion := range assertions {
+			intern, ok := interned[assertion.Attribute]
+			if !ok {
+				var err error
+				if intern, err = isInterned(txn, assertion.Attribute); err != nil {
+					return err
+				}
+				interned[assertion.Attribute] = intern
+			}
+			encoded, err := encodeValue((*encodeBuf)[:0], assertion.Value)
+			if err != nil {
 				return err
 			}
-			if err := writeAVET(txn, assertion); err != nil {
+			*encodeBuf = encoded
+			val, err := sto.storedValue(txn, encoded, intern)
+			if err != nil {
+				return err
+			}
+			*keyValBuf = sto.appendKeyValue((*keyValBuf)[:0], encoded)
+
+			// The EAVT and AEVT indexes share a record.
+			*recordBuf = currentIndexValue((*recordBuf)[:0], assertion, val)
+			record, err := batch.seal(*recordBuf, sto.opts.Compression.Index, sto.opts.Compression.MinSize)
+			if err != nil {
 				return err
 			}
+			batch.setEAVT(assertion, record)
+			batch.setAEVT(assertion, record)
+			batch.setAVET(assertion, *keyValBuf)
+			*recordBuf = historyValue((*recordBuf)[:0], assertion, val)
+			record, err = batch.seal(*recordBuf, sto.opts.Compression.History, sto.opts.Compression.MinSize)
+			if err != nil {
+				return err
+			}
+			batch.setHistory(uint32(idx), assertion, record)
 			// TODO: Write to other indexes.
 		}
-		return nil
+		return batch.write(txn)
+	}))
+}
+
+func (r reader) ScanEAVT(entityID store.ID, attribute *store.ID) (dataflow.Producer[store.Fact], error) {
+	return collectFacts(0, func(visit store.FactVisitor) error {
+		return r.VisitEAVT(entityID, attribute, visit)
 	})
 }
 
-func (sto *badgerStore) ScanEAVT(entityID store.ID, attribute *store.ID) (dataflow.Producer[store.Fact], error) {
+func (r reader) VisitEAVT(entityID store.ID, attribute *store.ID, visit store.FactVisitor) error {
 	prefix := []byte{tblPrefixEAVT}
 	prefix = binary.BigEndian.AppendUint64(prefix, uint64(entityID))
 	if attribute != nil {
 		prefix = binary.BigEndian.AppendUint64(prefix, uint64(*attribute))
 	}
 
-	var facts []store.Fact
-	if err := sto.db.View(func(txn *badger.Txn) error {
-		it := txn.NewIterator(badger.DefaultIteratorOptions)
+	return r.visitCurrent(prefix, nil, func(key []byte, fct *store.Fact) {
+		fct.EntityID = entityID
+		fct.Attribute = store.ID(binary.BigEndian.Uint64(key[9:]))
+	}, visit)
+}
+
+func (r reader) ScanAEVT(attribute store.ID, entityID *store.ID) (dataflow.Producer[store.Fact], error) {
+	return collectFacts(0, func(visit store.FactVisitor) error {
+		return r.VisitAEVT(attribute, entityID, visit)
+	})
+}
+
+func (r reader) VisitAEVT(attribute store.ID, entityID *store.ID, visit store.FactVisitor) error {
+	prefix := []byte{tblPrefixAEVT}
+	prefix = binary.BigEndian.AppendUint64(prefix, uint64(attribute))
+	if entityID != nil {
+		prefix = binary.BigEndian.AppendUint64(prefix, uint64(*entityID))
+	}
+
+	return r.visitCurrent(prefix, nil, func(key []byte, fct *store.Fact) {
+		fct.Attribute = attribute
+		fct.EntityID = store.ID(binary.BigEndian.Uint64(key[9:]))
+	}, visit)
+}
+
+// ScanAEVTWhere evaluates pred as it iterates over the attribute's facts, so
+// facts that do not match are never collected.
+func (r reader) ScanAEVTWhere(attribute store.ID, pred store.ValuePredicate) (dataflow.Producer[store.Fact], error) {
+	return collectFacts(0, func(visit store.FactVisitor) error {
+		return r.VisitAEVTWhere(attribute, pred, visit)
+	})
+}
+
+func (r reader) VisitAEVTWhere(attribute store.ID, pred store.ValuePredicate, visit store.FactVisitor) error {
+	prefix := []byte{tblPrefixAEVT}
+	prefix = binary.BigEndian.AppendUint64(prefix, uint64(attribute))
+
+	return r.visitCurrent(prefix, pred, func(key []byte, fct *store.Fact) {
+		fct.Attribute = attribute
+		fct.EntityID = store.ID(binary.BigEndian.Uint64(key[9:]))
+	}, visit)
+}
+
+// collectFacts collects the facts visited by scan into a producer, cloning
+// each so that it no longer borrows from the scan. The hint is the number of
+// facts that the scan is expected to visit.
+func collectFacts(hint int, scan func(visit store.FactVisitor) error) (dataflow.Producer[store.Fact], error) {
+	facts := make([]store.Fact, 0, hint)
+	if err := scan(func(fct *store.Fact) error {
+		facts = append(facts, fct.Clone())
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	return dataflow.SliceScanner[store.Fact]{Slice: facts}, nil
+}
+
+// visitCurrent visits the facts of one of the current-state indexes (EAVT or
+// AEVT), which share a common layout aside from the order of the entity and
+// attribute in the key. The keyFn is responsible for populating the entity and
+// attribute of each fact from the key. If pred is not nil, only facts whose
+// values match it are visited. A single fact is reused for every visit.
+func (r reader) visitCurrent(prefix []byte, pred store.ValuePredicate, keyFn func(key []byte, fct *store.Fact), visit store.FactVisitor) error {
+	return r.view(func(txn *badger.Txn) error {
+		it := txn.NewIterator(r.iteratorOptions())
 		defer it.Close()
+		dec := newFactDecoder()
+		var fct store.Fact
 		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
-			fct := store.Fact{
-				EntityID: entityID,
-			}
-			if attribute == nil {
-				key := it.Item().Key()
-				fct.Attribute = store.ID(binary.BigEndian.Uint64(key[9:]))
-			} else {
-				fct.Attribute = *attribute
+			item := it.Item()
+			fct = store.Fact{}
+			keyFn(item.Key(), &fct)
+			// The fact is visited within the callback, since its value may
+			// borrow the record's memory.
+			if err := item.Value(func(record []byte) error {
+				isAddition, err := dec.decodeCurrent(txn, item.Key(), record, &fct)
+				if err != nil || !isAddition || (pred != nil && !pred.MatchValue(fct.Value)) {
+					return err
+				}
+				return visit(&fct)
+			}); err != nil {
+				return err
 			}
+		}
 
-			if err := it.Item().Value(func(val []byte) error {
-				// XXX: Determine what to do with removed/superseded facts.
-				assertMode := store.AssertMode(val[0])
-				if assertMode != store.AssertModeAddition {
-					return nil
-				}
+		return nil
+	})
+}
 
-				fct.Tx = store.ID(binary.BigEndian.Uint64(val[1:]))
-
-				dec := gob.NewDecoder(bytes.NewReader(val[9:]))
-				// We could either encode a type in the value, or we could look
-				// up the attribute's type in the schema. This would require us
-				// to look up the schema on a "smart path" that does not rely on
-				// ScanEAVT itself. We could also cache the schema in the store,
-				// assuming that the type of an attribute is immutable or we
-				// have a way to invalidate the cache.
-				// If we store a type tag in the value, we could support schema
-				// evolution by deferring rewriting the value until it is read.
-				attrType, err := sto.typeFor(fct.Attribute)
-				if err != nil {
-					return err
+// decodeCurrent populates a fact from a record of the EAVT or AEVT index whose
+// entity and attribute have already been read from the key. It reports false
+// if the record is not an addition.
+func (d *factDecoder) decodeCurrent(txn *badger.Txn, key, record []byte, fct *store.Fact) (bool, error) {
+	fct.ValidFrom = decodeValidFrom(binary.BigEndian.Uint64(key[17:]))
+
+	val, err := openRecord(record)
+	if err != nil {
+		return false, err
+	}
+	// XXX: Determine what to do with removed/superseded facts.
+	assertMode := store.AssertMode(val[0])
+	if assertMode != store.AssertModeAddition {
+		return false, nil
+	}
+
+	fct.Tx = store.ID(binary.BigEndian.Uint64(val[1:]))
+	fct.ValidTo = decodeValidTo(binary.BigEndian.Uint64(val[9:]))
+
+	fct.Value, err = d.decodeValue(txn, fct.Attribute, val[17:])
+	return true, err
+}
+
+func (r reader) ScanAVET(attribute store.ID, val store.Value) (dataflow.Producer[store.Fact], error) {
+	return r.ScanAVETValues(attribute, []store.Value{val})
+}
+
+// ScanAVETValues scans the AVET index for several values of an attribute
+// using a single iterator. Values are visited in key order so that the
+// iterator only moves forward through the index.
+func (r reader) ScanAVETValues(attribute store.ID, vals []store.Value) (dataflow.Producer[store.Fact], error) {
+	return collectFacts(len(vals), func(visit store.FactVisitor) error {
+		return r.VisitAVETValues(attribute, vals, visit)
+	})
+}
+
+func (r reader) VisitAVETValues(attribute store.ID, vals []store.Value, visit store.FactVisitor) error {
+	type avetPrefix struct {
+		prefix []byte
+		val    store.Value
+	}
+	prefixes := make([]avetPrefix, len(vals))
+	for i, val := range vals {
+		if val == nil {
+			return fmt.Errorf("nil value not supported")
+		}
+		prefix := []byte{tblPrefixAVET}
+		prefix = binary.BigEndian.AppendUint64(prefix, uint64(attribute))
+		// See NOTE [VALUE-ENCODING].
+		keyVal, err := r.keyValue(val)
+		if err != nil {
+			return err
+		}
+		prefixes[i] = avetPrefix{
+			prefix: append(prefix, keyVal...),
+			val:    val,
+		}
+	}
+	sort.Slice(prefixes, func(i, j int) bool {
+		return bytes.Compare(prefixes[i].prefix, prefixes[j].prefix) < 0
+	})
+
+	return r.view(func(txn *badger.Txn) error {
+		it := txn.NewIterator(r.iteratorOptions())
+		defer it.Close()
+		var fct store.Fact
+		for _, p := range prefixes {
+			for it.Seek(p.prefix); it.ValidForPrefix(p.prefix); it.Next() {
+				fct = store.Fact{
+					Attribute: attribute,
+					Value:     p.val,
 				}
-				switch attrType {
-				case store.IDTypeRef:
-					var ref store.ID
-					if err := dec.Decode(&ref); err != nil {
-						return fmt.Errorf("decoding ref value: %w", err)
-					}
-					fct.Value = store.Value(ref)
-				case store.IDTypeString:
-					var str string
-					if err := dec.Decode(&str); err != nil {
-						return fmt.Errorf("decoding string value: %w", err)
-					}
-					fct.Value = store.Value(str)
-				case store.IDTypeInt64:
-					var i int64
-					if err := dec.Decode(&i); err != nil {
-						return fmt.Errorf("decoding int64 value: %w", err)
+
+				var isAddition bool
+				if err := it.Item().Value(func(record []byte) error {
+					val, err := openRecord(record)
+					if err != nil {
+						return err
 					}
-					fct.Value = store.Value(i)
-				case store.IDTypeFloat64:
-					var f float64
-					if err := dec.Decode(&f); err != nil {
-						return fmt.Errorf("decoding float64 value: %w", err)
+					// XXX: Determine what to do with removed/superseded facts.
+					assertMode := store.AssertMode(val[0])
+					if assertMode != store.AssertModeAddition {
+						return nil
 					}
-					fct.Value = store.Value(f)
-				case store.IDTypeBoolean:
-					var b bool
-					if err := dec.Decode(&b); err != nil {
-						return fmt.Errorf("decoding bool value: %w", err)
+					isAddition = true
+
+					fct.Tx = store.ID(binary.BigEndian.Uint64(val[1:]))
+					fct.EntityID = store.ID(binary.BigEndian.Uint64(val[9:]))
+					fct.ValidFrom = decodeValidFrom(binary.BigEndian.Uint64(val[17:]))
+					fct.ValidTo = decodeValidTo(binary.BigEndian.Uint64(val[25:]))
+					return nil
+				}); err != nil {
+					return err
+				}
+				if isAddition {
+					if err := visit(&fct); err != nil {
+						return err
 					}
-					fct.Value = store.Value(b)
-				case store.IDTypeBinary:
-					fct.Value = store.Value(val[9:])
-				default:
-					return fmt.Errorf("unsupported value type for attribute %q: %q", fct.Attribute, attrType)
 				}
-
-				return nil
-			}); err != nil {
-				return err
 			}
-
-			facts = append(facts, fct)
 		}
-
 		return nil
-	}); err != nil {
-		return nil, err
-	}
-
-	return dataflow.SliceScanner[store.Fact]{Slice: facts}, nil
+	})
 }
 
-func (sto *badgerStore) ScanAEVT(attribute store.ID, entityID *store.ID) (dataflow.Producer[store.Fact], error) {
-	panic("badgerStore.ScanAEVT() not yet implemented.")
+func (r reader) ScanVAET(val store.Value, attribute *store.ID) (dataflow.Producer[store.Fact], error) {
+	panic("badgerStore.ScanVAET() not yet implemented.")
 }
 
-func (sto *badgerStore) ScanAVET(attribute store.ID, val store.Value) (dataflow.Producer[store.Fact], error) {
-	if val == nil {
-		return nil, fmt.Errorf("nil value not supported")
+func (r reader) ScanHistoryEAVT(entityID store.ID, attribute *store.ID) (dataflow.Producer[store.ResolvedAssertion], error) {
+	prefix := []byte{tblPrefixEAVTHistory}
+	prefix = binary.BigEndian.AppendUint64(prefix, uint64(entityID))
+	if attribute != nil {
+		prefix = binary.BigEndian.AppendUint64(prefix, uint64(*attribute))
 	}
 
-	prefix := []byte{tblPrefixAVET}
+	return r.scanHistory(prefix, func(key []byte, fct *store.Fact) {
+		fct.EntityID = entityID
+		fct.Attribute = store.ID(binary.BigEndian.Uint64(key[9:]))
+	})
+}
+
+func (r reader) ScanHistoryAEVT(attribute store.ID, entityID *store.ID) (dataflow.Producer[store.ResolvedAssertion], error) {
+	prefix := []byte{tblPrefixAEVTHistory}
 	prefix = binary.BigEndian.AppendUint64(prefix, uint64(attribute))
-	// See NOTE [VALUE-ENCODING].
-	prefixBuf := bytes.NewBuffer(nil)
-	if err := gob.NewEncoder(prefixBuf).Encode(val); err != nil {
-		return nil, fmt.Errorf("encoding value: %w", err)
+	if entityID != nil {
+		prefix = binary.BigEndian.AppendUint64(prefix, uint64(*entityID))
 	}
 
-	var facts []store.Fact
-	if err := sto.db.View(func(txn *badger.Txn) error {
-		it := txn.NewIterator(badger.DefaultIteratorOptions)
+	return r.scanHistory(prefix, func(key []byte, fct *store.Fact) {
+		fct.Attribute = attribute
+		fct.EntityID = store.ID(binary.BigEndian.Uint64(key[9:]))
+	})
+}
+
+// scanHistory scans one of the history indexes. Unlike the current-state
+// indexes, history indexes retain every assertion, including retractions.
+func (r reader) scanHistory(prefix []byte, keyFn func(key []byte, fct *store.Fact)) (dataflow.Producer[store.ResolvedAssertion], error) {
+	var assertions []store.ResolvedAssertion
+	if err := r.view(func(txn *badger.Txn) error {
+		it := txn.NewIterator(r.iteratorOptions())
 		defer it.Close()
+		dec := newFactDecoder()
 		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
-			fct := store.Fact{
-				Attribute: attribute,
-				Value:     val,
-			}
-
-			if err := it.Item().Value(func(val []byte) error {
-				// XXX: Determine what to do with removed/superseded facts.
-				assertMode := store.AssertMode(val[0])
-				if assertMode != store.AssertModeAddition {
-					return nil
+			var fct store.Fact
+			var mode store.AssertMode
+			key := it.Item().Key()
+			keyFn(key, &fct)
+			fct.Tx = store.ID(binary.BigEndian.Uint64(key[17:]))
+
+			if err := it.Item().Value(func(record []byte) error {
+				val, err := openRecord(record)
+				if err != nil {
+					return err
 				}
+				mode = store.AssertMode(val[0])
+				fct.ValidFrom = decodeValidFrom(binary.BigEndian.Uint64(val[1:]))
+				fct.ValidTo = decodeValidTo(binary.BigEndian.Uint64(val[9:]))
 
-				fct.Tx = store.ID(binary.BigEndian.Uint64(val[1:]))
-				fct.EntityID = store.ID(binary.BigEndian.Uint64(val[9:]))
-				return nil
+				fct.Value, err = dec.decodeValue(txn, fct.Attribute, val[17:])
+				fct = fct.Clone()
+				return err
 			}); err != nil {
 				return err
 			}
-			facts = append(facts, fct)
+
+			assertions = append(assertions, store.NewResolvedAssertion(fct, mode))
 		}
+
 		return nil
 	}); err != nil {
 		return nil, err
 	}
 
-	return dataflow.SliceScanner[store.Fact]{Slice: facts}, nil
+	return dataflow.SliceScanner[store.ResolvedAssertion]{Slice: assertions}, nil
 }
 
-func (sto *badgerStore) ScanVAET(val store.Value, attribute *store.ID) (dataflow.Producer[store.Fact], error) {
-	panic("badgerStore.ScanVAET() not yet implemented.")
+// DeleteHistory deletes the entries of both history indexes that record
+// assertions. An entry records an assertion if it was made in the same
+// transaction about the same entity and attribute, with the same mode, valid
+// time, and value.
+func (sto *badgerStore) DeleteHistory(assertions []store.ResolvedAssertion) error {
+	if err := sto.guardWritable(); err != nil {
+		return err
+	}
+
+	// The keys are found first and then deleted in a batch, since there may
+	// be more of them than a single transaction can hold.
+	var keys [][]byte
+	if err := sto.view(func(txn *badger.Txn) error {
+		dec := newFactDecoder()
+		deleted := make(map[string]bool)
+		for _, assertion := range assertions {
+			want, err := encodeValue(nil, assertion.Value)
+			if err != nil {
+				return err
+			}
+			prefix := []byte{tblPrefixEAVTHistory}
+			prefix = binary.BigEndian.AppendUint64(prefix, uint64(assertion.EntityID))
+			prefix = binary.BigEndian.AppendUint64(prefix, uint64(assertion.Attribute))
+			prefix = binary.BigEndian.AppendUint64(prefix, uint64(assertion.Tx))
+
+			it := txn.NewIterator(badger.IteratorOptions{Prefix: prefix})
+			for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+				key := it.Item().KeyCopy(nil)
+				if deleted[string(key)] {
+					continue
+				}
+				var match bool
+				if err := it.Item().Value(func(record []byte) error {
+					val, err := openRecord(record)
+					if err != nil {
+						return err
+					}
+					if store.AssertMode(val[0]) != assertion.Mode() ||
+						binary.BigEndian.Uint64(val[1:]) != encodeValidFrom(assertion.ValidFrom) {
+						return nil
+					}
+					// Values are compared in their encoded form, after
+					// resolving interned and blob values.
+					decoded, err := dec.decodeValue(txn, assertion.Attribute, val[17:])
+					if err != nil {
+						return err
+					}
+					got, err := encodeValue(nil, decoded)
+					match = err == nil && bytes.Equal(got, want)
+					return err
+				}); err != nil {
+					it.Close()
+					return err
+				}
+				if match {
+					deleted[string(key)] = true
+					keys = append(keys, key)
+					break
+				}
+			}
+			it.Close()
+		}
+		return nil
+	}); err != nil {
+		return classifyErr(err)
+	}
+
+	wb := sto.db.NewWriteBatch()
+	defer wb.Cancel()
+	for _, eavtKey := range keys {
+		// Key layout: see indexBatch.setHistory.
+		aevtKey := make([]byte, 0, len(eavtKey))
+		aevtKey = append(aevtKey, tblPrefixAEVTHistory)
+		aevtKey = append(aevtKey, eavtKey[9:17]...)
+		aevtKey = append(aevtKey, eavtKey[1:9]...)
+		aevtKey = append(aevtKey, eavtKey[17:]...)
+		if err := wb.Delete(eavtKey); err != nil {
+			return classifyErr(err)
+		}
+		if err := wb.Delete(aevtKey); err != nil {
+			return classifyErr(err)
+		}
+	}
+	return classifyErr(wb.Flush())
 }
 
-func writeEAVT(txn *badger.Txn, assertion store.ResolvedAssertion) error {
-	// DEBUG
-	// fmt.Printf("writing EAVT assertion: %v\n", assertion)
-	// fmt.Printf("\t[%d, %d, %v, %d, %s]\n", assertion.EntityID, assertion.Attribute, assertion.Value, assertion.Tx, assertion.Mode())
+// decodeUnique decodes a db/unique value. Before db/unique was enumerated it
+// was a boolean attribute, so its history may hold booleans as well as refs.
+func decodeUnique(encoded []byte) (store.Value, error) {
+	var id store.ID
+	if err := gob.NewDecoder(bytes.NewReader(encoded)).Decode(&id); err == nil {
+		return id, nil
+	}
+	return decodeAs[bool](gob.NewDecoder(bytes.NewReader(encoded)), "db/unique")
+}
 
-	key := make([]byte, 17)
-	key[0] = tblPrefixEAVT
-	binary.BigEndian.PutUint64(key[1:], uint64(assertion.EntityID))
-	binary.BigEndian.PutUint64(key[9:], uint64(assertion.Attribute))
+func decodeAs[T any](dec *gob.Decoder, typeName string) (store.Value, error) {
+	var v T
+	if err := dec.Decode(&v); err != nil {
+		return nil, fmt.Errorf("decoding %s value: %w", typeName, err)
+	}
+	return store.Value(v), nil
+}
 
-	val := make([]byte, 9)
-	val[0] = uint8(assertion.Mode())
+func init() {
+	// The elements of tuples are encoded as interfaces, so gob must know
+	// every concrete type that an element may have beyond its basic types.
+	gob.Register(store.ID(0))
+	gob.Register(time.Time{})
+	gob.Register(uuid.UUID{})
+	gob.Register(ulid.ULID{})
+}
 
-	binary.BigEndian.PutUint64(val[1:], uint64(assertion.Tx))
+// encodeValue appends the encoded form of a value to buf.
+func encodeValue(buf []byte, val store.Value) ([]byte, error) {
 	// NOTE [VALUE-ENCODING]:
 	// We are currently encoding the value as a gob. This is not ideal, as
 	// we cannot guarantee that the gob encoding will be stable across
 	// versions of the code or that values will be ordered correctly.
 	// We may not need to ensure ordering, but if we do, we should consider
 	// using an encoding scheme like FoundationDB's Tuple encoding.
-	valBuf := bytes.NewBuffer(val)
-	if err := gob.NewEncoder(valBuf).Encode(assertion.Value); err != nil {
-		return fmt.Errorf("encoding value: %w", err)
+	if out, ok := appendScalar(buf, val); ok {
+		return out, nil
+	}
+	valBuf := bytes.NewBuffer(buf)
+	if err := gob.NewEncoder(valBuf).Encode(val); err != nil {
+		return nil, fmt.Errorf("encoding value: %w", err)
 	}
-	// assertion.Value.EncodeAs(assertion.Attribute, valBuf)
+	return valBuf.Bytes(), nil
+}
 
-	return txn.Set(key, valBuf.Bytes())
+// appendScalar appends the gob encoding of a scalar value to buf without the
+// reflection and allocations of a gob.Encoder. It produces exactly the bytes
+// that gob would, in the layout described by decodeScalar, and reports false
+// if the value is not a scalar.
+func appendScalar(buf []byte, val store.Value) ([]byte, bool) {
+	var wireType, u uint64
+	var data []byte
+	switch v := val.(type) {
+	case store.ID:
+		wireType, u = gobWireInt, gobIntBits(int64(v))
+	case int64:
+		wireType, u = gobWireInt, gobIntBits(v)
+	case int32:
+		wireType, u = gobWireInt, gobIntBits(int64(v))
+	case int16:
+		wireType, u = gobWireInt, gobIntBits(int64(v))
+	case int8:
+		wireType, u = gobWireInt, gobIntBits(int64(v))
+	case float64:
+		wireType, u = gobWireFloat, bits.ReverseBytes64(math.Float64bits(v))
+	case float32:
+		wireType, u = gobWireFloat, bits.ReverseBytes64(math.Float64bits(float64(v)))
+	case bool:
+		wireType = gobWireBool
+		if v {
+			u = 1
+		}
+	case string:
+		wireType, u, data = gobWireString, uint64(len(v)), []byte(v)
+	case []byte:
+		wireType, u, data = gobWireBytes, uint64(len(v)), v
+	default:
+		return buf, false
+	}
+
+	// The message holds the type id, the singleton marker, and the value.
+	n := 2 + gobUintSize(u) + len(data)
+	buf = appendGobUint(buf, uint64(n))
+	buf = append(buf, byte(wireType), 0)
+	buf = appendGobUint(buf, u)
+	return append(buf, data...), true
 }
 
-func writeAVET(txn *badger.Txn, assertion store.ResolvedAssertion) error {
-	// Since the value contains the key, allocate a reasonable amount of
-	// space for the key.
-	key := make([]byte, 9, 64)
-	key[0] = tblPrefixAVET
-	binary.BigEndian.PutUint64(key[1:], uint64(assertion.Attribute))
-	// See NOTE [VALUE-ENCODING].
-	keyBuf := bytes.NewBuffer(key)
-	if err := gob.NewEncoder(keyBuf).Encode(assertion.Value); err != nil {
-		return fmt.Errorf("encoding value: %w", err)
+// appendGobUint appends an unsigned integer in gob's encoding (see gobUint).
+func appendGobUint(buf []byte, x uint64) []byte {
+	if x < 0x80 {
+		return append(buf, byte(x))
+	}
+	n := gobUintSize(x) - 1
+	buf = append(buf, byte(-n))
+	for i := n - 1; i >= 0; i-- {
+		buf = append(buf, byte(x>>(8*i)))
 	}
+	return buf
+}
+
+// gobUintSize returns the number of bytes in the gob encoding of x.
+func gobUintSize(x uint64) int {
+	if x < 0x80 {
+		return 1
+	}
+	return 1 + (bits.Len64(x)+7)/8
+}
 
-	val := make([]byte, 17)
-	val[0] = uint8(assertion.Mode())
-	binary.BigEndian.PutUint64(val[1:], uint64(assertion.Tx))
-	binary.BigEndian.PutUint64(val[9:], uint64(assertion.EntityID))
+// gobIntBits returns the unsigned integer that gob encodes for i, which
+// stores the sign in the low bit.
+func gobIntBits(i int64) uint64 {
+	if i < 0 {
+		return uint64(^i)<<1 | 1
+	}
+	return uint64(i) << 1
+}
 
-	return txn.Set(keyBuf.Bytes(), val)
+// currentIndexValue appends the value shared by the EAVT and AEVT indexes to
+// buf.
+func currentIndexValue(buf []byte, assertion store.ResolvedAssertion, storedVal []byte) []byte {
+	// Value layout:
+	// | mode   |   tx    | valid to | value |
+	// | 1 byte | 8 bytes | 8 bytes  |  ...  |
+	buf = append(buf, uint8(assertion.Mode()))
+	buf = binary.BigEndian.AppendUint64(buf, uint64(assertion.Tx))
+	buf = binary.BigEndian.AppendUint64(buf, encodeValidTo(assertion.ValidTo))
+
+	return append(buf, storedVal...)
 }
 
-// typeFor returns the type of the attribute.
-// TODO: Cache values.
-func (sto *badgerStore) typeFor(attribute store.ID) (attrTypeID store.ID, err error) {
-	typeID := int64(store.IDType)
-	key := make([]byte, 17)
+// historyValue appends the value of the history indexes to buf.
+func historyValue(buf []byte, assertion store.ResolvedAssertion, storedVal []byte) []byte {
+	// Value layout:
+	// | mode   | valid from | valid to | value |
+	// | 1 byte |  8 bytes   | 8 bytes  |  ...  |
+	buf = append(buf, uint8(assertion.Mode()))
+	buf = binary.BigEndian.AppendUint64(buf, encodeValidFrom(assertion.ValidFrom))
+	buf = binary.BigEndian.AppendUint64(buf, encodeValidTo(assertion.ValidTo))
+
+	return append(buf, storedVal...)
+}
+
+// bufferPool holds scratch buffers for encoding values and records.
+var bufferPool = sync.Pool{
+	New: func() any {
+		buf := make([]byte, 0, 256)
+		return &buf
+	},
+}
+
+// maxPooledBuffer is the capacity above which a buffer is not returned to the
+// pool, so that one large value does not pin a large buffer.
+const maxPooledBuffer = 64 << 10
+
+func getBuffer() *[]byte {
+	return bufferPool.Get().(*[]byte)
+}
+
+func putBuffer(buf *[]byte) {
+	if cap(*buf) > maxPooledBuffer {
+		return
+	}
+	*buf = (*buf)[:0]
+	bufferPool.Put(buf)
+}
+
+// isInterned reports whether the schema of the attribute, as visible to txn,
+// marks its values as interned.
+func isInterned(txn *badger.Txn, attribute store.ID) (bool, error) {
+	encoded, ok, err := schemaValue(txn, attribute, store.IDInterned)
+	if err != nil || !ok {
+		return false, err
+	}
+	var interned bool
+	// See NOTE [VALUE-ENCODING].
+	if err := gob.NewDecoder(bytes.NewReader(encoded)).Decode(&interned); err != nil {
+		return false, fmt.Errorf("fetching interning for attribute %q: %w", attribute, err)
+	}
+	return interned, nil
+}
+
+// schemaValue returns the encoded value of a property of an attribute's schema,
+// as visible to txn, and whether the attribute has the property.
+func schemaValue(txn *badger.Txn, attribute, property store.ID) ([]byte, bool, error) {
+	// Schema facts are never bounded in valid time.
+	key := make([]byte, 25)
 	key[0] = tblPrefixEAVT
 	binary.BigEndian.PutUint64(key[1:], uint64(attribute))
-	binary.BigEndian.PutUint64(key[9:], uint64(typeID))
+	binary.BigEndian.PutUint64(key[9:], uint64(property))
+	binary.BigEndian.PutUint64(key[17:], encodeValidFrom(time.Time{}))
 
-	err = sto.db.View(func(txn *badger.Txn) error {
-		item, err := txn.Get(key)
+	item, err := txn.Get(key)
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("fetching %s of attribute %q: %w", property, attribute, err)
+	}
+	var encoded []byte
+	err = item.Value(func(record []byte) error {
+		val, err := openRecord(record)
 		if err != nil {
 			return err
 		}
-		return item.Value(func(val []byte) error {
-			// Skip mode bit + tx id.
-			data := bytes.NewReader(val[9:])
-			// See NOTE [VALUE-ENCODING].
-			dec := gob.NewDecoder(data)
-			return dec.Decode(&attrTypeID)
-		})
+		if store.AssertMode(val[0]) != store.AssertModeAddition {
+			return nil
+		}
+		// Skip mode bit + tx id + valid to.
+		loaded, err := loadValue(txn, val[17:])
+		encoded = bytes.Clone(loaded)
+		return err
 	})
-
 	if err != nil {
-		err = fmt.Errorf("fetching type for attribute %q: %w", attribute, err)
+		return nil, false, fmt.Errorf("fetching %s of attribute %q: %w", property, attribute, err)
+	}
+	return encoded, encoded != nil, nil
+}
+
+// encodeValidFrom encodes the start of a valid-time period such that it sorts
+// correctly as an unsigned big-endian integer. An unbounded start sorts before
+// every bounded time.
+func encodeValidFrom(t time.Time) uint64 {
+	if t.IsZero() {
+		return 0
 	}
+	return encodeTime(t)
+}
+
+func decodeValidFrom(n uint64) time.Time {
+	if n == 0 {
+		return time.Time{}
+	}
+	return decodeTime(n)
+}
+
+// encodeValidTo encodes the end of a valid-time period. An unbounded end sorts
+// after every bounded time.
+func encodeValidTo(t time.Time) uint64 {
+	if t.IsZero() {
+		return math.MaxUint64
+	}
+	return encodeTime(t)
+}
+
+func decodeValidTo(n uint64) time.Time {
+	if n == math.MaxUint64 {
+		return time.Time{}
+	}
+	return decodeTime(n)
+}
+
+// encodeTime flips the sign bit of the time's nanosecond timestamp so that
+// negative timestamps sort before positive ones.
+func encodeTime(t time.Time) uint64 {
+	return uint64(t.UnixNano()) ^ (1 << 63)
+}
 
-	return
+func decodeTime(n uint64) time.Time {
+	return time.Unix(0, int64(n^(1<<63))).UTC()
 }
@@ -0,0 +1,166 @@
+/*
+Copyright 2024 Andrew Meredith
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package badger
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/kendru/canter/internal/store"
+	"github.com/kendru/canter/pkg/dataflow"
+	"github.com/stretchr/testify/assert"
+)
+
+func FuzzValidTime(f *testing.F) {
+	f.Add(int64(0), int64(1))
+	f.Add(int64(-1), int64(1))
+	f.Add(int64(math.MinInt64+1), int64(math.MaxInt64-1))
+	f.Add(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC).UnixNano(), int64(-5))
+	f.Fuzz(func(t *testing.T, a, b int64) {
+		// The extreme timestamps encode to the sentinels for unbounded
+		// periods and are not representable.
+		if a == math.MinInt64 || a == math.MaxInt64 || b == math.MinInt64 || b == math.MaxInt64 {
+			return
+		}
+		ta, tb := time.Unix(0, a).UTC(), time.Unix(0, b).UTC()
+
+		assert.True(t, ta.Equal(decodeValidFrom(encodeValidFrom(ta))))
+		assert.True(t, ta.Equal(decodeValidTo(encodeValidTo(ta))))
+
+		// Encoded times must sort in the same order as the times themselves.
+		ea, eb := encodeValidFrom(ta), encodeValidFrom(tb)
+		switch {
+		case a < b:
+			assert.Less(t, ea, eb)
+		case a > b:
+			assert.Greater(t, ea, eb)
+		default:
+			assert.Equal(t, ea, eb)
+		}
+		// Unbounded periods sort around every bounded time.
+		assert.Less(t, encodeValidFrom(time.Time{}), ea)
+		assert.Greater(t, encodeValidTo(time.Time{}), encodeValidTo(ta))
+	})
+}
+
+func FuzzEncodeValue(f *testing.F) {
+	f.Add("", int64(0), 0.0, false, []byte{})
+	f.Add("hello", int64(-42), math.Pi, true, []byte{0, 1, 2})
+	f.Add("\xff", int64(math.MaxInt64), math.Inf(-1), false, []byte(nil))
+	f.Fuzz(func(t *testing.T, s string, i int64, fl float64, b bool, bin []byte) {
+		roundTrip(t, s, decodeAs[string])
+		roundTrip(t, i, decodeAs[int64])
+		roundTrip(t, b, decodeAs[bool])
+		if !math.IsNaN(fl) {
+			roundTrip(t, fl, decodeAs[float64])
+		}
+		if len(bin) > 0 {
+			roundTrip(t, bin, decodeAs[[]byte])
+		}
+	})
+}
+
+func roundTrip[T any](t *testing.T, val T, decode func(*gob.Decoder, string) (store.Value, error)) {
+	t.Helper()
+	encoded, err := encodeValue(nil, val)
+	if !assert.NoError(t, err) {
+		return
+	}
+	decoded, err := decode(gob.NewDecoder(bytes.NewReader(encoded)), "test")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, val, decoded)
+}
+
+func TestDeleteHistory(t *testing.T) {
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true).WithLogger(nil))
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer db.Close()
+	sto, err := New(db)
+	if !assert.NoError(t, err) {
+		return
+	}
+	conn := store.NewConnection(store.Config{
+		IdentManager: sto,
+		IDManager:    sto,
+		Indexer:      sto,
+	})
+	if !assert.NoError(t, conn.InitializeDB()) {
+		return
+	}
+	_, err = conn.Assert(store.EntityData{"db/ident": "car/color", "db/type": "db.type/string", "db/interned": true})
+	if !assert.NoError(t, err) {
+		return
+	}
+	res, err := conn.Assert(store.EntityData{"db/id": store.NamedTempID("car"), "car/color": "red"})
+	if !assert.NoError(t, err) {
+		return
+	}
+	car, _ := res.TempIDs.LookupTempID(store.NamedTempID("car"))
+	if _, err := conn.Assert(store.Assert(car, "car/color", "green")); !assert.NoError(t, err) {
+		return
+	}
+	ids, err := sto.LookupIdentIDs([]string{"car/color"})
+	if !assert.NoError(t, err) {
+		return
+	}
+	attr := ids[0]
+	history := func() []store.ResolvedAssertion {
+		scan, err := sto.ScanHistoryAEVT(attr, nil)
+		assert.NoError(t, err)
+		assertions, err := dataflow.CollectIntoSlice(dataflow.NewContext(context.Background()), scan)
+		assert.NoError(t, err)
+		out := make([]store.ResolvedAssertion, len(assertions))
+		for i, ra := range assertions {
+			out[i] = *ra
+		}
+		return out
+	}
+	before := history()
+	if !assert.Len(t, before, 2) {
+		return
+	}
+
+	// Assertions that are not in the history are ignored.
+	other := store.NewResolvedAssertion(store.Fact{
+		EntityID:  car,
+		Attribute: attr,
+		Value:     "blue",
+		Tx:        before[0].Tx,
+	}, store.AssertModeAddition)
+	assert.NoError(t, sto.DeleteHistory([]store.ResolvedAssertion{other}))
+	assert.Equal(t, before, history())
+
+	// Matching entries are deleted from both history indexes.
+	assert.NoError(t, sto.DeleteHistory(before[:1]))
+	assert.Equal(t, before[1:], history())
+	scan, err := sto.ScanHistoryEAVT(car, &attr)
+	if assert.NoError(t, err) {
+		assertions, err := dataflow.CollectIntoSlice(dataflow.NewContext(context.Background()), scan)
+		if assert.NoError(t, err) && assert.Len(t, assertions, 1) {
+			assert.Equal(t, "green", assertions[0].Value)
+		}
+	}
+}
@@ -0,0 +1,259 @@
+/*
+Copyright 2024 Andrew Meredith
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package badger
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+// ErrStoreTooNew is returned when opening a store whose format version is
+// newer than this code supports.
+var ErrStoreTooNew = errors.New("store requires a newer version of canter")
+
+// Format versions:
+//
+//	0: Records are not wrapped in an envelope.
+//	1: Records are wrapped in a versioned envelope. See NOTE [RECORD-ENVELOPE].
+const currentFormatVersion uint32 = 1
+
+var (
+	metaKeyFormatVersion   = []byte{tblPrefixMeta, 'f'}
+	metaKeyMigrationCursor = []byte{tblPrefixMeta, 'c'}
+)
+
+// migration upgrades a store from the previous format version to version.
+// Migrations must be idempotent, since an interrupted migration is run again
+// from its last checkpoint.
+type migration struct {
+	version     uint32
+	description string
+	apply       func(ctx context.Context, sto *badgerStore, cursor []byte, checkpoint func(cursor []byte, n int) error) (int, error)
+}
+
+// migrations are applied in order to bring a store up to currentFormatVersion.
+var migrations = []migration{
+	{
+		version:     1,
+		description: "wrap index records in versioned envelopes",
+		apply: func(ctx context.Context, sto *badgerStore, cursor []byte, checkpoint func(cursor []byte, n int) error) (int, error) {
+			return sto.upgradeRecordsFrom(ctx, cursor, checkpoint)
+		},
+	},
+}
+
+// MigrationProgress reports the progress of a single migration.
+type MigrationProgress struct {
+	Version     uint32
+	Description string
+	// Records is the number of records that the migration has rewritten.
+	Records int
+	// Done is set once the migration has completed.
+	Done bool
+}
+
+// PendingMigration describes a migration that has not been applied to a
+// store.
+type PendingMigration struct {
+	Version     uint32
+	Description string
+}
+
+// initFormatVersion records the current format version in a new store and
+// rejects stores that were written by newer code.
+func initFormatVersion(db *badger.DB) error {
+	return db.Update(func(txn *badger.Txn) error {
+		version, found, err := readFormatVersion(txn)
+		if err != nil {
+			return err
+		}
+		if found {
+			return guardFormatVersion(version)
+		}
+
+		// A store without a format version is either new, in which case it
+		// is written in the current format, or it predates format versions.
+		it := txn.NewIterator(badger.IteratorOptions{})
+		defer it.Close()
+		it.Rewind()
+		if it.Valid() {
+			return writeFormatVersion(txn, 0)
+		}
+		return writeFormatVersion(txn, currentFormatVersion)
+	})
+}
+
+// checkFormatVersion verifies that a store opened read-only can be read by
+// this code without writing a format version.
+func checkFormatVersion(db *badger.DB) error {
+	return db.View(func(txn *badger.Txn) error {
+		version, found, err := readFormatVersion(txn)
+		if err != nil {
+			return err
+		}
+		if !found {
+			return nil
+		}
+		return guardFormatVersion(version)
+	})
+}
+
+func guardFormatVersion(version uint32) error {
+	if version > currentFormatVersion {
+		return errors.Join(
+			fmt.Errorf("store format version %d is newer than supported version %d", version, currentFormatVersion),
+			ErrStoreTooNew,
+		)
+	}
+	return nil
+}
+
+func readFormatVersion(txn *badger.Txn) (uint32, bool, error) {
+	item, err := txn.Get(metaKeyFormatVersion)
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, fmt.Errorf("reading format version: %w", err)
+	}
+	var version uint32
+	err = item.Value(func(val []byte) error {
+		version = binary.BigEndian.Uint32(val)
+		return nil
+	})
+	return version, true, err
+}
+
+func writeFormatVersion(txn *badger.Txn, version uint32) error {
+	return txn.Set(metaKeyFormatVersion, binary.BigEndian.AppendUint32(nil, version))
+}
+
+// FormatVersion returns the format version of the store.
+func (sto *badgerStore) FormatVersion() (uint32, error) {
+	var version uint32
+	err := sto.db.View(func(txn *badger.Txn) error {
+		var err error
+		version, _, err = readFormatVersion(txn)
+		return err
+	})
+	return version, err
+}
+
+// PendingMigrations lists the migrations that Migrate would apply.
+func (sto *badgerStore) PendingMigrations() ([]PendingMigration, error) {
+	version, err := sto.FormatVersion()
+	if err != nil {
+		return nil, err
+	}
+	var pending []PendingMigration
+	for _, m := range migrations {
+		if m.version > version {
+			pending = append(pending, PendingMigration{
+				Version:     m.version,
+				Description: m.description,
+			})
+		}
+	}
+	return pending, nil
+}
+
+// Migrate applies every pending migration in order. Progress is checkpointed
+// in the store, so a migration that is interrupted resumes where it left off
+// the next time Migrate is called. If progress is non-nil, it is called as
+// each migration makes progress.
+func (sto *badgerStore) Migrate(ctx context.Context, progress func(MigrationProgress)) error {
+	if err := sto.guardWritable(); err != nil {
+		return err
+	}
+	version, err := sto.FormatVersion()
+	if err != nil {
+		return err
+	}
+
+	for _, m := range migrations {
+		if m.version <= version {
+			continue
+		}
+
+		report := func(n int, done bool) {
+			if progress != nil {
+				progress(MigrationProgress{
+					Version:     m.version,
+					Description: m.description,
+					Records:     n,
+					Done:        done,
+				})
+			}
+		}
+
+		cursor, err := sto.migrationCursor(m.version)
+		if err != nil {
+			return err
+		}
+		n, err := m.apply(ctx, sto, cursor, func(cursor []byte, n int) error {
+			report(n, false)
+			return sto.db.Update(func(txn *badger.Txn) error {
+				val := binary.BigEndian.AppendUint32(nil, m.version)
+				return txn.Set(metaKeyMigrationCursor, append(val, cursor...))
+			})
+		})
+		if err != nil {
+			return fmt.Errorf("applying migration %d (%s): %w", m.version, m.description, err)
+		}
+
+		if err := sto.db.Update(func(txn *badger.Txn) error {
+			if err := txn.Delete(metaKeyMigrationCursor); err != nil {
+				return err
+			}
+			return writeFormatVersion(txn, m.version)
+		}); err != nil {
+			return fmt.Errorf("completing migration %d: %w", m.version, err)
+		}
+		report(n, true)
+	}
+
+	return nil
+}
+
+// migrationCursor returns the checkpoint of an interrupted run of the
+// migration to version, or nil if the migration has not been started.
+func (sto *badgerStore) migrationCursor(version uint32) ([]byte, error) {
+	var cursor []byte
+	err := sto.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(metaKeyMigrationCursor)
+		if errors.Is(err, badger.ErrKeyNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return item.Value(func(val []byte) error {
+			if binary.BigEndian.Uint32(val) == version {
+				cursor = append([]byte(nil), val[4:]...)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("reading migration cursor: %w", err)
+	}
+	return cursor, nil
+}
@@ -0,0 +1,81 @@
+/*
+Copyright 2024 Andrew Meredith
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package badger
+
+import (
+	"context"
+	"testing"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMigrate(t *testing.T) {
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true).WithLogger(nil))
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer db.Close()
+
+	// Simulate a store that predates format versions.
+	legacyKey := []byte{tblPrefixAVET, 1}
+	payload := []byte{1, 2, 3, 4}
+	err = db.Update(func(txn *badger.Txn) error {
+		return txn.Set(legacyKey, payload)
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	sto, err := New(db)
+	if !assert.NoError(t, err) {
+		return
+	}
+	version, err := sto.FormatVersion()
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(0), version)
+	pending, err := sto.PendingMigrations()
+	assert.NoError(t, err)
+	assert.Len(t, pending, 1)
+
+	var progress []MigrationProgress
+	err = sto.Migrate(context.Background(), func(p MigrationProgress) {
+		progress = append(progress, p)
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.True(t, progress[len(progress)-1].Done)
+	assert.Equal(t, 1, progress[len(progress)-1].Records)
+
+	version, err = sto.FormatVersion()
+	assert.NoError(t, err)
+	assert.Equal(t, currentFormatVersion, version)
+	pending, err = sto.PendingMigrations()
+	assert.NoError(t, err)
+	assert.Empty(t, pending)
+
+	// Stores written by newer code are refused.
+	err = db.Update(func(txn *badger.Txn) error {
+		return writeFormatVersion(txn, currentFormatVersion+1)
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = New(db)
+	assert.ErrorIs(t, err, ErrStoreTooNew)
+}
@@ -0,0 +1,211 @@
+/*
+Copyright 2024 Andrew Meredith
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package badger
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/kendru/canter/internal/store"
+	"github.com/kendru/canter/pkg/dataflow"
+)
+
+// ScanEAVTPartitions splits the EAVT index into n ranges of entities.
+//
+// Where Badger has flushed the index to SSTables, the ranges are split at
+// table boundaries, so that partitions read from different tables. Otherwise
+// the user partition is split into ranges of equal numbers of entity IDs,
+// which are allocated sequentially. The system partition, whose IDs are
+// negative and so sort after every user ID, is always in the last range.
+func (r reader) ScanEAVTPartitions(n int) ([]dataflow.Producer[store.Fact], error) {
+	if n < 1 {
+		return nil, fmt.Errorf("invalid number of partitions: %d", n)
+	}
+
+	var bounds []uint64
+	if err := r.view(func(txn *badger.Txn) error {
+		var err error
+		bounds, err = r.partitionBounds(txn, n)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+
+	// bounds holds the first entity of every partition but the first.
+	producers := make([]dataflow.Producer[store.Fact], n)
+	for i := range producers {
+		p := eavtPartition{r: r, start: eavtEntityKey(0)}
+		if i > 0 {
+			p.start = eavtEntityKey(bounds[i-1])
+		}
+		if i < n-1 {
+			p.end = eavtEntityKey(bounds[i])
+		}
+		producers[i] = p
+	}
+	return producers, nil
+}
+
+// partitionBounds returns the n-1 entities at which partitions begin, in
+// ascending order. Bounds may repeat if there are too few entities to fill
+// every partition, in which case some partitions are empty.
+func (r reader) partitionBounds(txn *badger.Txn, n int) ([]uint64, error) {
+	bounds := make([]uint64, 0, n-1)
+	if n == 1 {
+		return bounds, nil
+	}
+
+	if r.txn == nil {
+		splits := tableSplits(r.db)
+		if len(splits) >= n-1 {
+			// Choose evenly spaced table boundaries.
+			for i := 1; i < n; i++ {
+				bounds = append(bounds, splits[i*len(splits)/n])
+			}
+			return bounds, nil
+		}
+	}
+
+	first, ok, err := seekEntity(txn, eavtEntityKey(0), false)
+	if err != nil || !ok {
+		// An empty index yields one partition and n-1 empty ones.
+		for len(bounds) < n-1 {
+			bounds = append(bounds, math.MaxUint64)
+		}
+		return bounds, err
+	}
+	last, _, err := seekEntity(txn, eavtEntityKey(math.MaxInt64), true)
+	if err != nil {
+		return nil, err
+	}
+	if last < first || last > math.MaxInt64 {
+		// The index only holds the system partition.
+		last = first
+	}
+	span := last - first + 1
+	for i := 1; i < n; i++ {
+		bounds = append(bounds, first+span*uint64(i)/uint64(n))
+	}
+	return bounds, nil
+}
+
+// tableSplits returns the distinct entities at which SSTables of the EAVT
+// index end, in ascending order.
+func tableSplits(db *badger.DB) []uint64 {
+	seen := make(map[uint64]struct{})
+	var splits []uint64
+	for _, table := range db.Tables() {
+		right := table.Right
+		if len(right) < 9 || right[0] != tblPrefixEAVT {
+			continue
+		}
+		entity := binary.BigEndian.Uint64(right[1:9])
+		if _, ok := seen[entity]; ok {
+			continue
+		}
+		seen[entity] = struct{}{}
+		splits = append(splits, entity)
+	}
+	sort.Slice(splits, func(i, j int) bool { return splits[i] < splits[j] })
+	return splits
+}
+
+// seekEntity returns the entity of the first EAVT entry at or after key, or,
+// if reverse is set, at or before the last entry of the entity in key.
+func seekEntity(txn *badger.Txn, key []byte, reverse bool) (uint64, bool, error) {
+	opts := badger.DefaultIteratorOptions
+	opts.PrefetchValues = false
+	opts.Reverse = reverse
+	opts.Prefix = []byte{tblPrefixEAVT}
+	it := txn.NewIterator(opts)
+	defer it.Close()
+	if reverse {
+		// Seek past every entry of the entity.
+		key = append(bytes.Clone(key), 0xff)
+	}
+	it.Seek(key)
+	if !it.Valid() {
+		return 0, false, nil
+	}
+	k := it.Item().Key()
+	if len(k) < 9 {
+		return 0, false, errors.New("malformed EAVT key")
+	}
+	return binary.BigEndian.Uint64(k[1:9]), true, nil
+}
+
+func eavtEntityKey(entity uint64) []byte {
+	key := []byte{tblPrefixEAVT}
+	return binary.BigEndian.AppendUint64(key, entity)
+}
+
+// eavtPartition produces the facts of the entities in [start, end) of the EAVT
+// index. A nil end extends the partition to the end of the index. Facts are
+// read as they are produced rather than collected up front, so that a
+// partition of a large index does not need to fit in memory.
+type eavtPartition struct {
+	r          reader
+	start, end []byte
+}
+
+func (p eavtPartition) Produce(ctx dataflow.DataflowCtx, next dataflow.ConsumeFn[store.Fact]) error {
+	err := p.r.view(func(txn *badger.Txn) error {
+		it := txn.NewIterator(p.r.iteratorOptions())
+		defer it.Close()
+		prefix := []byte{tblPrefixEAVT}
+		dec := newFactDecoder()
+		for it.Seek(p.start); it.ValidForPrefix(prefix); it.Next() {
+			key := it.Item().Key()
+			if p.end != nil && bytes.Compare(key, p.end) >= 0 {
+				break
+			}
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			fct := store.Fact{
+				EntityID:  store.ID(binary.BigEndian.Uint64(key[1:])),
+				Attribute: store.ID(binary.BigEndian.Uint64(key[9:])),
+			}
+			var isAddition bool
+			if err := it.Item().Value(func(record []byte) error {
+				var err error
+				isAddition, err = dec.decodeCurrent(txn, key, record, &fct)
+				// The fact outlives the record, so it must not borrow it.
+				fct = fct.Clone()
+				return err
+			}); err != nil {
+				return err
+			}
+			if !isAddition {
+				continue
+			}
+			if err := next(ctx, &fct); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return next(ctx, nil)
+}
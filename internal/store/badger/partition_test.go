@@ -0,0 +1,117 @@
+/*
+Copyright 2024 Andrew Meredith
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package badger
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/kendru/canter/internal/store"
+	"github.com/kendru/canter/pkg/dataflow"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScanEAVTPartitions(t *testing.T) {
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true).WithLogger(nil))
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer db.Close()
+	sto, err := New(db)
+	if !assert.NoError(t, err) {
+		return
+	}
+	conn := store.NewConnection(store.Config{
+		IdentManager: sto,
+		IDManager:    sto,
+		Indexer:      sto,
+		BlobStore:    sto,
+	})
+	if !assert.NoError(t, conn.InitializeDB()) {
+		return
+	}
+	_, err = conn.Assert(store.EntityData{"db/ident": "doc/id", "db/type": "db.type/string", "db/unique": true})
+	if !assert.NoError(t, err) {
+		return
+	}
+	var docs []store.Assertable
+	for i := 0; i < 100; i++ {
+		docs = append(docs, store.EntityData{"doc/id": fmt.Sprintf("doc-%d", i)})
+	}
+	if _, err := conn.Assert(docs...); !assert.NoError(t, err) {
+		return
+	}
+
+	// scanAll consumes the partitions concurrently and returns the entities
+	// that each produced along with the total number of facts.
+	scanAll := func(n int) ([]map[store.ID]struct{}, int) {
+		partitions, err := sto.ScanEAVTPartitions(n)
+		if !assert.NoError(t, err) || !assert.Len(t, partitions, n) {
+			return nil, 0
+		}
+		entities := make([]map[store.ID]struct{}, n)
+		counts := make([]int, n)
+		var wg sync.WaitGroup
+		for i, p := range partitions {
+			wg.Add(1)
+			go func(i int, p dataflow.Producer[store.Fact]) {
+				defer wg.Done()
+				entities[i] = make(map[store.ID]struct{})
+				facts, err := dataflow.CollectIntoSlice(dataflow.NewContext(context.Background()), p)
+				assert.NoError(t, err)
+				for _, fct := range facts {
+					entities[i][fct.EntityID] = struct{}{}
+				}
+				counts[i] = len(facts)
+			}(i, p)
+		}
+		wg.Wait()
+		var total int
+		for _, c := range counts {
+			total += c
+		}
+		return entities, total
+	}
+
+	_, want := scanAll(1)
+	assert.Greater(t, want, 100)
+	for _, n := range []int{2, 4, 7, 500} {
+		entities, total := scanAll(n)
+		assert.Equal(t, want, total, "partitions: %d", n)
+		// Every entity is produced by exactly one partition.
+		seen := make(map[store.ID]int)
+		for i, ents := range entities {
+			for eid := range ents {
+				if prev, ok := seen[eid]; ok {
+					t.Errorf("entity %d produced by partitions %d and %d", eid, prev, i)
+				}
+				seen[eid] = i
+			}
+		}
+		if n <= 7 {
+			for i, ents := range entities {
+				assert.NotEmpty(t, ents, "partition %d of %d", i, n)
+			}
+		}
+	}
+
+	_, err = sto.ScanEAVTPartitions(0)
+	assert.Error(t, err)
+}
@@ -0,0 +1,267 @@
+/*
+Copyright 2024 Andrew Meredith
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package badger
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+// NOTE [RECORD-ENVELOPE]:
+// Every record in the index tables is wrapped in an envelope so that the
+// encoding of records can change without breaking existing databases:
+//
+// | version | flags  | codec  | payload |
+// | 1 byte  | 1 byte | 1 byte |   ...   |
+//
+// The low bits of the flags hold the Compression of the payload.
+//
+// Envelope versions always have the high bit set. Records written before
+// records were versioned have no envelope and begin with an AssertMode, which
+// never has the high bit set. Older records are upgraded in memory when they
+// are read, and UpgradeRecords rewrites them in the background.
+const (
+	recordVersionLegacy  uint8 = 0
+	recordVersion1       uint8 = 0x81
+	currentRecordVersion       = recordVersion1
+
+	recordVersionMask uint8 = 0x80
+	recordHeaderSize        = 3
+
+	// recordFlagCompressionMask selects the bits of the flags that hold the
+	// Compression of the payload.
+	recordFlagCompressionMask uint8 = 0x0f
+)
+
+// Codecs identify how values in a record payload are encoded.
+const (
+	codecGob uint8 = 1
+)
+
+// recordUpgrade converts the payload of a record from one version to the next.
+type recordUpgrade struct {
+	next    uint8
+	upgrade func(payload []byte) ([]byte, error)
+}
+
+// recordUpgrades holds the upgrade from each version to its successor.
+var recordUpgrades = map[uint8]recordUpgrade{
+	recordVersionLegacy: {
+		next: recordVersion1,
+		// The payload layout did not change when the envelope was added.
+		upgrade: func(payload []byte) ([]byte, error) { return payload, nil },
+	},
+}
+
+// indexTables are the tables whose records are wrapped in an envelope.
+var indexTables = []byte{
+	tblPrefixEAVT,
+	tblPrefixAEVT,
+	tblPrefixAVET,
+	tblPrefixEAVTHistory,
+	tblPrefixAEVTHistory,
+}
+
+// sealRecord wraps a payload in an envelope for the current record version.
+func sealRecord(payload []byte) []byte {
+	return appendRecord(make([]byte, 0, recordHeaderSize+len(payload)), payload, CompressionNone)
+}
+
+// appendRecord appends a record to dst that wraps a payload compressed with c.
+func appendRecord(dst, payload []byte, c Compression) []byte {
+	return append(appendRecordHeader(dst, c), payload...)
+}
+
+// appendRecordHeader appends the envelope of a record whose payload is
+// compressed with c to dst.
+func appendRecordHeader(dst []byte, c Compression) []byte {
+	return append(dst, currentRecordVersion, uint8(c), codecGob)
+}
+
+// sealCompressedRecord is like sealRecord, except that payloads of at least
+// minSize bytes are compressed with c. The compression is recorded in the
+// flags of the envelope.
+func sealCompressedRecord(payload []byte, c Compression, minSize int) ([]byte, error) {
+	compressed, applied, err := c.compress(payload, minSize)
+	if err != nil {
+		return nil, err
+	}
+	return appendRecord(make([]byte, 0, recordHeaderSize+len(compressed)), compressed, applied), nil
+}
+
+// openRecord returns the payload of a record in the layout of the current
+// record version, upgrading the record in memory if necessary.
+func openRecord(record []byte) ([]byte, error) {
+	payload, _, err := upgradeRecord(record)
+	return payload, err
+}
+
+// upgradeRecord returns the payload of a record in the layout of the current
+// record version, along with whether any upgrades were applied.
+func upgradeRecord(record []byte) ([]byte, bool, error) {
+	if len(record) == 0 {
+		return nil, false, errors.New("empty record")
+	}
+
+	version := recordVersionLegacy
+	payload := record
+	if record[0]&recordVersionMask != 0 {
+		if len(record) < recordHeaderSize {
+			return nil, false, errors.New("truncated record envelope")
+		}
+		version = record[0]
+		flags := record[1]
+		if flags&^recordFlagCompressionMask != 0 {
+			return nil, false, fmt.Errorf("unsupported record flags: %#x", flags)
+		}
+		if codec := record[2]; codec != codecGob {
+			return nil, false, fmt.Errorf("unsupported record codec: %d", codec)
+		}
+		var err error
+		payload, err = Compression(flags & recordFlagCompressionMask).decompress(record[recordHeaderSize:])
+		if err != nil {
+			return nil, false, err
+		}
+	}
+
+	upgraded := false
+	for version != currentRecordVersion {
+		up, ok := recordUpgrades[version]
+		if !ok {
+			return nil, false, fmt.Errorf("unsupported record version: %#x", version)
+		}
+		var err error
+		if payload, err = up.upgrade(payload); err != nil {
+			return nil, false, fmt.Errorf("upgrading record from version %#x: %w", version, err)
+		}
+		version = up.next
+		upgraded = true
+	}
+
+	return payload, upgraded, nil
+}
+
+// upgradeBatchSize is the number of records rewritten per transaction by
+// UpgradeRecords.
+const upgradeBatchSize = 1000
+
+// UpgradeRecords rewrites every index record that was written with an older
+// record version. Records are rewritten in small transactions, so this may run
+// alongside other writes; a batch that conflicts with a concurrent write is
+// retried. It returns the number of records that were rewritten.
+func (sto *badgerStore) UpgradeRecords(ctx context.Context) (int, error) {
+	if err := sto.guardWritable(); err != nil {
+		return 0, err
+	}
+	return sto.upgradeRecordsFrom(ctx, nil, nil)
+}
+
+// upgradeRecordsFrom upgrades records starting at the key cursor, or at the
+// beginning of the first index table if cursor is nil. After each batch,
+// checkpoint is called with the key at which the next batch starts and the
+// number of records rewritten so far.
+func (sto *badgerStore) upgradeRecordsFrom(ctx context.Context, cursor []byte, checkpoint func(cursor []byte, n int) error) (int, error) {
+	var total int
+	for _, table := range indexTables {
+		if cursor != nil && cursor[0] > table {
+			continue
+		}
+		start := []byte{table}
+		if cursor != nil && cursor[0] == table {
+			start = cursor
+		}
+		for start != nil {
+			if err := ctx.Err(); err != nil {
+				return total, err
+			}
+
+			var next []byte
+			var n int
+			err := sto.db.Update(func(txn *badger.Txn) error {
+				var err error
+				next, n, err = upgradeBatch(txn, table, start)
+				return err
+			})
+			if errors.Is(err, badger.ErrConflict) {
+				// Retry the same batch.
+				continue
+			}
+			if err != nil {
+				return total, fmt.Errorf("upgrading records: %w", err)
+			}
+			total += n
+			start = next
+
+			if checkpoint != nil {
+				resume := start
+				if resume == nil {
+					// Resume after the end of this table.
+					resume = []byte{table + 1}
+				}
+				if err := checkpoint(resume, total); err != nil {
+					return total, err
+				}
+			}
+		}
+	}
+	return total, nil
+}
+
+// upgradeBatch upgrades up to upgradeBatchSize records in table, starting at
+// the key start. It returns the key at which the next batch should start, or
+// nil if the table has been exhausted.
+func upgradeBatch(txn *badger.Txn, table byte, start []byte) ([]byte, int, error) {
+	it := txn.NewIterator(badger.IteratorOptions{
+		Prefix:         []byte{table},
+		PrefetchValues: true,
+		PrefetchSize:   100,
+	})
+	defer it.Close()
+
+	var n int
+	var seen int
+	for it.Seek(start); it.Valid(); it.Next() {
+		item := it.Item()
+		if seen == upgradeBatchSize {
+			return item.KeyCopy(nil), n, nil
+		}
+		seen++
+
+		var upgraded []byte
+		if err := item.Value(func(record []byte) error {
+			payload, ok, err := upgradeRecord(record)
+			if err != nil || !ok {
+				return err
+			}
+			upgraded = sealRecord(payload)
+			return nil
+		}); err != nil {
+			return nil, n, err
+		}
+		if upgraded == nil {
+			continue
+		}
+		if err := txn.Set(item.KeyCopy(nil), upgraded); err != nil {
+			return nil, n, err
+		}
+		n++
+	}
+	return nil, n, nil
+}
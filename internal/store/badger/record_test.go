@@ -0,0 +1,120 @@
+/*
+Copyright 2024 Andrew Meredith
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package badger
+
+import (
+	"context"
+	"testing"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecordEnvelope(t *testing.T) {
+	payload := []byte{1, 2, 3, 4}
+
+	sealed := sealRecord(payload)
+	opened, upgraded, err := upgradeRecord(sealed)
+	assert.NoError(t, err)
+	assert.False(t, upgraded)
+	assert.Equal(t, payload, opened)
+
+	// Unversioned records begin with an AssertMode and are upgraded.
+	opened, upgraded, err = upgradeRecord(payload)
+	assert.NoError(t, err)
+	assert.True(t, upgraded)
+	assert.Equal(t, payload, opened)
+
+	_, err = openRecord([]byte{0xFF, 0, codecGob})
+	assert.ErrorContains(t, err, "unsupported record version")
+	_, err = openRecord([]byte{currentRecordVersion, 0, 0xFF})
+	assert.ErrorContains(t, err, "unsupported record codec")
+}
+
+func TestUpgradeRecords(t *testing.T) {
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true).WithLogger(nil))
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer db.Close()
+	sto, err := New(db)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	legacyKey := []byte{tblPrefixEAVT, 1}
+	currentKey := []byte{tblPrefixEAVT, 2}
+	payload := []byte{1, 2, 3, 4}
+	err = db.Update(func(txn *badger.Txn) error {
+		if err := txn.Set(legacyKey, payload); err != nil {
+			return err
+		}
+		return txn.Set(currentKey, sealRecord(payload))
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	n, err := sto.UpgradeRecords(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+
+	err = db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(legacyKey)
+		if err != nil {
+			return err
+		}
+		record, err := item.ValueCopy(nil)
+		assert.Equal(t, sealRecord(payload), record)
+		return err
+	})
+	assert.NoError(t, err)
+}
+
+func FuzzOpenRecord(f *testing.F) {
+	f.Add([]byte{})
+	f.Add([]byte{1, 2, 3, 4})
+	f.Add(sealRecord([]byte{1, 2, 3, 4}))
+	f.Add([]byte{currentRecordVersion, uint8(CompressionSnappy), codecGob, 0xFF})
+	f.Add([]byte{currentRecordVersion, uint8(CompressionZstd), codecGob, 0xFF})
+	f.Fuzz(func(t *testing.T, record []byte) {
+		// Arbitrary input must be rejected with an error rather than a panic.
+		_, _ = openRecord(record)
+	})
+}
+
+func FuzzSealRecord(f *testing.F) {
+	f.Add([]byte{}, uint8(CompressionNone), 0)
+	f.Add([]byte("hello, hello, hello, hello"), uint8(CompressionSnappy), 0)
+	f.Add([]byte("hello, hello, hello, hello"), uint8(CompressionZstd), 8)
+	f.Fuzz(func(t *testing.T, payload []byte, c uint8, minSize int) {
+		compression := Compression(c % 3)
+		record, err := sealCompressedRecord(payload, compression, minSize)
+		if !assert.NoError(t, err) {
+			return
+		}
+		opened, err := openRecord(record)
+		if !assert.NoError(t, err) {
+			return
+		}
+		if len(payload) == 0 {
+			assert.Empty(t, opened)
+			return
+		}
+		assert.Equal(t, payload, opened)
+	})
+}
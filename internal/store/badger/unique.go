@@ -0,0 +1,195 @@
+/*
+Copyright 2024 Andrew Meredith
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package badger
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/kendru/canter/internal/store"
+)
+
+// NOTE [UNIQUE-CLAIMS]:
+// The connection checks that values of unique attributes are not held by
+// another entity before it writes a transaction, but that check only
+// serializes the transactions of a single connection. Several store instances
+// may share a Badger database (see NOTE [ID-LEASES]), so uniqueness is also
+// enforced within the Badger transaction that writes the values.
+//
+// The AVET index has a single entry for each value of an attribute, which
+// records the entity that last asserted the value. Before a value of a unique
+// attribute is asserted, its AVET entry is read, which adds the key to the
+// read set of the transaction. Two concurrent transactions that assert the same
+// value both write the key, so the one that commits second fails with
+// badger.ErrConflict. It is retried as a transient error, and the retry then
+// finds the value held by the other entity.
+//
+// The AVET entry of a value that was replaced is not removed, so the entry
+// only claims the value while the EAVT entry of its holder still holds it.
+// Reading that entry adds it to the read set as well, so a transaction that
+// claims a value conflicts with one that releases it concurrently.
+
+// uniqueValues are the encoded db/unique values of unique attributes.
+// Attributes that were unique before db/unique was enumerated hold true.
+var uniqueValues = func() [][]byte {
+	var values [][]byte
+	for _, v := range []store.Value{store.IDUniqueIdentity, store.IDUniqueValue, true} {
+		encoded, err := encodeValue(nil, v)
+		if err != nil {
+			panic(err)
+		}
+		values = append(values, encoded)
+	}
+	return values
+}()
+
+// isUnique reports whether the schema of the attribute, as visible to txn,
+// makes it unique.
+func isUnique(txn *badger.Txn, attribute store.ID) (bool, error) {
+	encoded, ok, err := schemaValue(txn, attribute, store.IDUnique)
+	if err != nil || !ok {
+		return false, err
+	}
+	for _, v := range uniqueValues {
+		if bytes.Equal(encoded, v) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// checkUniqueClaims fails with store.ErrConflict if a transaction asserts a
+// value of a unique attribute that another entity holds. See NOTE
+// [UNIQUE-CLAIMS].
+func (sto *badgerStore) checkUniqueClaims(txn *badger.Txn, assertions []store.ResolvedAssertion) error {
+	unique := make(map[store.ID]bool)
+	// replaced holds the EAVT keys that the transaction overwrites, whose
+	// values are released by it.
+	var replaced map[string]struct{}
+	for _, assertion := range assertions {
+		if assertion.Mode() != store.AssertModeAddition {
+			continue
+		}
+		isUniq, ok := unique[assertion.Attribute]
+		if !ok {
+			var err error
+			if isUniq, err = isUnique(txn, assertion.Attribute); err != nil {
+				return err
+			}
+			unique[assertion.Attribute] = isUniq
+		}
+		if !isUniq {
+			continue
+		}
+		if replaced == nil {
+			replaced = make(map[string]struct{}, len(assertions))
+			for _, a := range assertions {
+				replaced[string(eavtKey(a.EntityID, a.Attribute, encodeValidFrom(a.ValidFrom)))] = struct{}{}
+			}
+		}
+
+		encoded, err := encodeValue(nil, assertion.Value)
+		if err != nil {
+			return err
+		}
+		key := binary.BigEndian.AppendUint64([]byte{tblPrefixAVET}, uint64(assertion.Attribute))
+		key = sto.appendKeyValue(key, encoded)
+		holder, validFrom, ok, err := avetHolder(txn, key)
+		if err != nil {
+			return err
+		}
+		if !ok || holder == assertion.EntityID {
+			continue
+		}
+		holderKey := eavtKey(holder, assertion.Attribute, validFrom)
+		if _, ok := replaced[string(holderKey)]; ok {
+			continue
+		}
+		held, err := holdsValue(txn, holderKey, encoded)
+		if err != nil {
+			return err
+		}
+		if held {
+			return errors.Join(
+				fmt.Errorf("unique attribute %d value %v is already held by entity %d", assertion.Attribute, assertion.Value, holder),
+				store.ErrConflict,
+			)
+		}
+	}
+	return nil
+}
+
+// avetHolder returns the entity that last asserted the value of the AVET
+// entry at key, along with the encoded start of the valid-time period of its
+// assertion. It reports false if the value was last retracted or was never
+// asserted.
+func avetHolder(txn *badger.Txn, key []byte) (store.ID, uint64, bool, error) {
+	item, err := txn.Get(key)
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		return 0, 0, false, nil
+	}
+	if err != nil {
+		return 0, 0, false, err
+	}
+	var holder store.ID
+	var validFrom uint64
+	var ok bool
+	err = item.Value(func(record []byte) error {
+		val, err := openRecord(record)
+		if err != nil {
+			return err
+		}
+		if ok = store.AssertMode(val[0]) == store.AssertModeAddition; ok {
+			holder = store.ID(binary.BigEndian.Uint64(val[9:]))
+			validFrom = binary.BigEndian.Uint64(val[17:])
+		}
+		return nil
+	})
+	return holder, validFrom, ok, err
+}
+
+// holdsValue reports whether the EAVT entry at key holds the encoded value.
+func holdsValue(txn *badger.Txn, key, encoded []byte) (bool, error) {
+	item, err := txn.Get(key)
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	var held bool
+	err = item.Value(func(record []byte) error {
+		val, err := openRecord(record)
+		if err != nil || store.AssertMode(val[0]) != store.AssertModeAddition {
+			return err
+		}
+		// Skip mode bit + tx id + valid to.
+		stored, err := loadValue(txn, val[17:])
+		held = bytes.Equal(stored, encoded)
+		return err
+	})
+	return held, err
+}
+
+func eavtKey(entity, attribute store.ID, validFrom uint64) []byte {
+	key := binary.BigEndian.AppendUint64([]byte{tblPrefixEAVT}, uint64(entity))
+	key = binary.BigEndian.AppendUint64(key, uint64(attribute))
+	return binary.BigEndian.AppendUint64(key, validFrom)
+}
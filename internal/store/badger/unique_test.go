@@ -0,0 +1,95 @@
+/*
+Copyright 2024 Andrew Meredith
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package badger
+
+import (
+	"testing"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/kendru/canter/internal/store"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUniqueClaims(t *testing.T) {
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true).WithLogger(nil))
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer db.Close()
+	sto, err := New(db)
+	if !assert.NoError(t, err) {
+		return
+	}
+	conn := store.NewConnection(store.Config{
+		IdentManager: sto,
+		IDManager:    sto,
+		Indexer:      sto,
+	})
+	if !assert.NoError(t, conn.InitializeDB()) {
+		return
+	}
+	_, err = conn.Assert(
+		store.EntityData{"db/ident": "user/email", "db/type": "db.type/string", "db/unique": "db.unique/value"},
+		store.EntityData{"db/ident": "user/name", "db/type": "db.type/string"},
+	)
+	if !assert.NoError(t, err) {
+		return
+	}
+	ids, err := sto.LookupIdentIDs([]string{"user/email", "user/name"})
+	if !assert.NoError(t, err) {
+		return
+	}
+	email, name := ids[0], ids[1]
+	ids, err = sto.NextIDs(4)
+	if !assert.NoError(t, err) {
+		return
+	}
+	alice, bob, tx1, tx2 := ids[0], ids[1], ids[2], ids[3]
+	fact := func(e, a store.ID, v string, tx store.ID, mode store.AssertMode) store.ResolvedAssertion {
+		return store.NewResolvedAssertion(store.Fact{EntityID: e, Attribute: a, Value: v, Tx: tx}, mode)
+	}
+
+	// Writes that bypass the connection's checks are still rejected.
+	assert.NoError(t, sto.Write([]store.ResolvedAssertion{fact(alice, email, "a@example.com", tx1, store.AssertModeAddition)}, nil))
+	assert.ErrorIs(t, sto.Write([]store.ResolvedAssertion{fact(bob, email, "a@example.com", tx2, store.AssertModeAddition)}, nil), store.ErrConflict)
+	assert.NoError(t, sto.Write([]store.ResolvedAssertion{fact(bob, name, "a@example.com", tx2, store.AssertModeAddition)}, nil))
+
+	// A value that its holder retracts or replaces in the same transaction
+	// may be claimed, as may one that its holder has since replaced.
+	assert.NoError(t, sto.Write([]store.ResolvedAssertion{
+		fact(alice, email, "a@example.com", tx2, store.AssertModeRetraction),
+		fact(bob, email, "a@example.com", tx2, store.AssertModeAddition),
+	}, nil))
+	assert.NoError(t, sto.Write([]store.ResolvedAssertion{fact(bob, email, "b@example.com", tx2, store.AssertModeAddition)}, nil))
+	assert.NoError(t, sto.Write([]store.ResolvedAssertion{fact(alice, email, "a@example.com", tx2, store.AssertModeAddition)}, nil))
+
+	// A claim conflicts with a concurrent transaction that claims the same
+	// value.
+	claim := []store.ResolvedAssertion{fact(alice, email, "c@example.com", tx2, store.AssertModeAddition)}
+	txn := db.NewTransaction(true)
+	defer txn.Discard()
+	assert.NoError(t, sto.checkUniqueClaims(txn, claim))
+	assert.NoError(t, sto.Write([]store.ResolvedAssertion{fact(bob, email, "c@example.com", tx2, store.AssertModeAddition)}, nil))
+	batch := newIndexBatch(1)
+	keyVal, err := sto.keyValue(claim[0].Value)
+	if !assert.NoError(t, err) {
+		return
+	}
+	batch.setAVET(claim[0], keyVal)
+	assert.NoError(t, batch.write(txn))
+	assert.ErrorIs(t, txn.Commit(), badger.ErrConflict)
+}
@@ -0,0 +1,206 @@
+/*
+Copyright 2024 Andrew Meredith
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package badger
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/kendru/canter/internal/store"
+)
+
+// Values in index entries are preceded by a tag byte that describes how the
+// rest of the value is stored.
+const (
+	// valueInline is followed by the encoded value.
+	valueInline byte = iota
+	// valueDigest is followed by the SHA-256 digest of the encoded value. In
+	// index values, the encoded value is stored in the value blob table under
+	// the digest.
+	valueDigest
+	// valueInterned is followed by the 8-byte ID of the encoded value in the
+	// value dictionary. It is only used in index values.
+	valueInterned
+	// valueDigestCompressed is followed by a 1-byte Compression and the
+	// SHA-256 digest of the encoded value. The compressed value is stored in
+	// the value blob table under the digest and compression, so compressed
+	// and uncompressed copies of a value never share a key. It is only used
+	// in index values.
+	valueDigestCompressed
+)
+
+// storedValue prepares an encoded value for use in the value of an index
+// entry. The encoded value is not retained, so it may be reused. If
+// intern is set, the value is added to the value dictionary within txn and
+// only its dictionary ID is stored inline. Otherwise, values whose encoding is
+// larger than MaxInlineValueSize are written to the value blob table within
+// txn, compressed according to the store's options, and only their digest is
+// stored inline.
+func (sto *badgerStore) storedValue(txn *badger.Txn, encoded []byte, intern bool) ([]byte, error) {
+	if intern {
+		id, err := sto.internValue(txn, encoded)
+		if err != nil {
+			return nil, err
+		}
+		return binary.BigEndian.AppendUint64([]byte{valueInterned}, id), nil
+	}
+	if len(encoded) <= sto.opts.MaxInlineValueSize {
+		return append([]byte{valueInline}, encoded...), nil
+	}
+
+	digest := sha256.Sum256(encoded)
+	compressed, applied, err := sto.opts.Compression.ValueBlobs.compress(encoded, sto.opts.Compression.MinSize)
+	if err != nil {
+		return nil, fmt.Errorf("compressing value blob: %w", err)
+	}
+	if applied != CompressionNone {
+		key := append(blobKey(digest[:]), byte(applied))
+		if err := txn.Set(key, compressed); err != nil {
+			return nil, fmt.Errorf("writing value blob: %w", err)
+		}
+		return append([]byte{valueDigestCompressed, byte(applied)}, digest[:]...), nil
+	}
+	// Blobs are content-addressed, so rewriting an existing blob is harmless.
+	if err := txn.Set(blobKey(digest[:]), bytes.Clone(encoded)); err != nil {
+		return nil, fmt.Errorf("writing value blob: %w", err)
+	}
+	return append([]byte{valueDigest}, digest[:]...), nil
+}
+
+// internValue returns the dictionary ID of an encoded value, adding the value
+// to the dictionary if it is not already present. Reading the existing entry
+// adds it to the read set of txn, so concurrent transactions that intern the
+// same value conflict rather than allocating two IDs.
+func (sto *badgerStore) internValue(txn *badger.Txn, encoded []byte) (uint64, error) {
+	digest := sha256.Sum256(encoded)
+	// Key layout:
+	// | table prefix |  digest  |
+	// |   1 byte     | 32 bytes |
+	byDigestKey := append([]byte{tblPrefixValueDictByDigest}, digest[:]...)
+	item, err := txn.Get(byDigestKey)
+	switch {
+	case err == nil:
+		var id uint64
+		err := item.Value(func(val []byte) error {
+			id = binary.BigEndian.Uint64(val)
+			return nil
+		})
+		return id, err
+	case !errors.Is(err, badger.ErrKeyNotFound):
+		return 0, fmt.Errorf("reading value dictionary: %w", err)
+	}
+
+	// Dictionary IDs are drawn from the ID sequence, which guarantees that
+	// they are unique.
+	ids, err := sto.NextIDs(1)
+	if err != nil {
+		return 0, fmt.Errorf("allocating value dictionary ID: %w", err)
+	}
+	id := uint64(ids[0])
+	if err := txn.Set(valueDictKey(id), bytes.Clone(encoded)); err != nil {
+		return 0, fmt.Errorf("writing value dictionary: %w", err)
+	}
+	if err := txn.Set(byDigestKey, binary.BigEndian.AppendUint64(nil, id)); err != nil {
+		return 0, fmt.Errorf("writing value dictionary: %w", err)
+	}
+	return id, nil
+}
+
+func valueDictKey(id uint64) []byte {
+	// Key layout:
+	// | table prefix |   id    |
+	// |   1 byte     | 8 bytes |
+	return binary.BigEndian.AppendUint64([]byte{tblPrefixValueDict}, id)
+}
+
+// keyValue encodes a value for use in an AVET key. Values whose encoding is
+// larger than MaxKeyValueSize are replaced by their digest, which keeps keys
+// small while still supporting lookups by value.
+func (r reader) keyValue(val store.Value) ([]byte, error) {
+	encoded, err := encodeValue(nil, val)
+	if err != nil {
+		return nil, err
+	}
+	return r.appendKeyValue(nil, encoded), nil
+}
+
+// appendKeyValue is like keyValue for a value that has already been encoded,
+// except that it appends the key value to buf.
+func (r reader) appendKeyValue(buf, encoded []byte) []byte {
+	if len(encoded) <= r.opts.MaxKeyValueSize {
+		buf = append(buf, valueInline)
+		return append(buf, encoded...)
+	}
+
+	digest := sha256.Sum256(encoded)
+	buf = append(buf, valueDigest)
+	return append(buf, digest[:]...)
+}
+
+// loadValue returns the encoded value from an index entry that was written by
+// storedValue, reading it from the value blob table or the value dictionary
+// if necessary.
+func loadValue(txn *badger.Txn, data []byte) ([]byte, error) {
+	if len(data) == 0 {
+		return nil, fmt.Errorf("empty stored value")
+	}
+	switch data[0] {
+	case valueInline:
+		return data[1:], nil
+	case valueDigest:
+		item, err := txn.Get(blobKey(data[1:]))
+		if err != nil {
+			return nil, fmt.Errorf("reading value blob: %w", err)
+		}
+		return item.ValueCopy(nil)
+	case valueDigestCompressed:
+		if len(data) < 2 {
+			return nil, fmt.Errorf("malformed compressed value: %x", data)
+		}
+		item, err := txn.Get(append(blobKey(data[2:]), data[1]))
+		if err != nil {
+			return nil, fmt.Errorf("reading value blob: %w", err)
+		}
+		compressed, err := item.ValueCopy(nil)
+		if err != nil {
+			return nil, err
+		}
+		return Compression(data[1]).decompress(compressed)
+	case valueInterned:
+		if len(data) != 9 {
+			return nil, fmt.Errorf("malformed interned value: %x", data)
+		}
+		item, err := txn.Get(valueDictKey(binary.BigEndian.Uint64(data[1:])))
+		if err != nil {
+			return nil, fmt.Errorf("reading value dictionary: %w", err)
+		}
+		return item.ValueCopy(nil)
+	default:
+		return nil, fmt.Errorf("unknown stored value tag: %d", data[0])
+	}
+}
+
+func blobKey(digest []byte) []byte {
+	// Key layout:
+	// | table prefix |  digest  |
+	// |   1 byte     | 32 bytes |
+	return append([]byte{tblPrefixValueBlobs}, digest...)
+}
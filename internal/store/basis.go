@@ -0,0 +1,228 @@
+/*
+Copyright 2024 Andrew Meredith
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Read-your-writes:
+//
+// A transaction is visible through the connection that committed it as soon
+// as Assert returns, but other connections learn of it later. Peers observe
+// it once its report arrives from the transactor, and connections that share
+// storage with the committing connection never observe it at all, although
+// their reads of the indexes see it. A caller that must see its own write
+// through another connection, or through a Database that it obtained
+// earlier, passes the basis of the AssertResult to AtLeast, which waits until
+// the connection reflects the transaction.
+
+// Causal consistency:
+//
+// Services that share a store but read through different connections, such
+// as read replicas, pass basis tokens between them so that each one observes
+// the writes that the others made before calling it. A service returns the
+// Token of its AssertResult or Database with its response, and the service
+// that receives the token reads through Since, which waits until its
+// connection reflects the transaction. Tokens are opaque strings so that they
+// can travel in headers and URLs and so that their encoding can change.
+
+// basisTokenVersion is the first byte of every basis token.
+const basisTokenVersion = 1
+
+// atLeastPollInterval is how often a connection that is not a peer checks
+// storage for a transaction that it is waiting for.
+const atLeastPollInterval = 10 * time.Millisecond
+
+// basisNotifier wakes the callers waiting for the basis of a connection to
+// advance.
+type basisNotifier struct {
+	mu sync.Mutex
+	ch chan struct{}
+}
+
+// wait returns a channel that is closed the next time the basis advances.
+func (n *basisNotifier) wait() <-chan struct{} {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.ch == nil {
+		n.ch = make(chan struct{})
+	}
+	return n.ch
+}
+
+// notify wakes every caller waiting for the basis to advance.
+func (n *basisNotifier) notify() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.ch != nil {
+		close(n.ch)
+		n.ch = nil
+	}
+}
+
+// Basis returns the basis of the database after the transaction, which reads
+// through other connections may require with AtLeast. Unlike TxID, it is set
+// even if no transaction was committed, as by SyncEntity for an entity that
+// was already up to date.
+func (res *AssertResult) Basis() ID {
+	return res.DB.Basis.ID()
+}
+
+// AtLeast returns the latest database of the connection once it reflects
+// every transaction up to and including basis, waiting until ctx is done if
+// necessary. Reads of the database observe the writes of the transaction,
+// whichever connection committed it.
+func (conn *Connection) AtLeast(ctx context.Context, basis ID) (Database, error) {
+	for {
+		changed := conn.basisChanged.wait()
+		if ID(conn.basis.Load()) >= basis {
+			return conn.DB(), nil
+		}
+		// Peers must wait to observe the transaction, since that evicts the
+		// entities that it changed from their caches. Other connections only
+		// observe their own transactions, so they look for the transaction
+		// in storage. A transactor assigns transaction IDs in the order that
+		// it writes transactions, so once basis is in storage, so is every
+		// transaction before it, and the basis may advance to it.
+		var poll <-chan time.Time
+		if conn.transactor == nil {
+			committed, err := conn.committed(basis)
+			if err != nil {
+				return Database{}, err
+			}
+			if committed {
+				conn.advanceBasis(basis)
+				return conn.DB(), nil
+			}
+			poll = time.After(atLeastPollInterval)
+		}
+		select {
+		case <-ctx.Done():
+			return Database{}, fmt.Errorf("waiting for transaction %d: %w", basis, ctx.Err())
+		case <-changed:
+		case <-poll:
+		}
+	}
+}
+
+// committed reports whether the transaction has been written to storage.
+func (conn *Connection) committed(tx ID) (bool, error) {
+	attr := IDTxCommitTime
+	var found bool
+	err := conn.indexer.VisitEAVT(tx, &attr, func(*Fact) error {
+		found = true
+		return nil
+	})
+	return found, err
+}
+
+// AtLeast returns a database that reflects every transaction up to and
+// including basis. If the database already does, it is returned unchanged.
+// Otherwise, the latest database of its connection is returned once the
+// connection reflects basis, with the same valid-time filter. A view that is
+// as of an earlier transaction or is pinned by a ReadTxn cannot advance, so it
+// fails with ErrStaleBasis.
+func (db Database) AtLeast(ctx context.Context, basis ID) (Database, error) {
+	if db.Basis.ID() >= basis {
+		return db, nil
+	}
+	if db.asOf != nil || db.snapshot != nil {
+		return Database{}, errors.Join(
+			fmt.Errorf("database as of transaction %d cannot reflect transaction %d", db.Basis.ID(), basis),
+			ErrStaleBasis,
+		)
+	}
+	latest, err := db.conn.AtLeast(ctx, basis)
+	if err != nil {
+		return Database{}, err
+	}
+	latest.validAt = db.validAt
+	latest.warnings = db.warnings
+	latest.readFilter = db.readFilter
+	return latest, nil
+}
+
+// Token returns an opaque token for the basis of the database after the
+// transaction, which another service may pass to Since to observe the
+// transaction.
+func (res *AssertResult) Token() string {
+	return encodeBasisToken(res.Basis())
+}
+
+// Token returns an opaque token for the basis of the database, which another
+// service may pass to Since to observe every transaction that the database
+// reflects.
+func (db Database) Token() string {
+	return encodeBasisToken(db.Basis.ID())
+}
+
+// Since returns the latest database of the connection once it reflects the
+// basis of token, as AtLeast does. An empty token requires no basis, so the
+// latest database is returned immediately. A token that was not returned by
+// Token fails with ErrInvalidToken.
+func (conn *Connection) Since(ctx context.Context, token string) (Database, error) {
+	basis, err := decodeBasisToken(token)
+	if err != nil {
+		return Database{}, err
+	}
+	return conn.AtLeast(ctx, basis)
+}
+
+// Since returns a database that reflects the basis of token, as AtLeast does.
+// An empty token requires no basis, so the database is returned unchanged.
+func (db Database) Since(ctx context.Context, token string) (Database, error) {
+	basis, err := decodeBasisToken(token)
+	if err != nil {
+		return Database{}, err
+	}
+	return db.AtLeast(ctx, basis)
+}
+
+// TokenBasis returns the basis that a token carries, so that clients can tell
+// which of two tokens reflects more transactions. An empty token carries a
+// basis of zero, and a token that was not returned by Token fails with
+// ErrInvalidToken.
+func TokenBasis(token string) (ID, error) {
+	return decodeBasisToken(token)
+}
+
+func encodeBasisToken(basis ID) string {
+	buf := binary.AppendUvarint([]byte{basisTokenVersion}, uint64(basis))
+	return base64.RawURLEncoding.EncodeToString(buf)
+}
+
+func decodeBasisToken(token string) (ID, error) {
+	if token == "" {
+		return 0, nil
+	}
+	buf, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil || len(buf) < 2 || buf[0] != basisTokenVersion {
+		return 0, ErrInvalidToken
+	}
+	basis, n := binary.Uvarint(buf[1:])
+	if n != len(buf)-1 {
+		return 0, ErrInvalidToken
+	}
+	return ID(basis), nil
+}
@@ -0,0 +1,95 @@
+/*
+Copyright 2024 Andrew Meredith
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+)
+
+var (
+	ErrNoSuchBlob        = errors.New("blob does not exist")
+	ErrNoBlobStore       = errors.New("connection has no blob store")
+	errInvalidBlobDigest = errors.New("blob digest must be 32 bytes")
+)
+
+// BlobDigest is the SHA-256 digest of the contents of a blob. Facts about
+// db.type/blob attributes hold the digest of a blob rather than its contents.
+type BlobDigest [sha256.Size]byte
+
+func (d BlobDigest) String() string {
+	return hex.EncodeToString(d[:])
+}
+
+// ParseBlobDigest parses the hex-encoded form of a BlobDigest.
+func ParseBlobDigest(s string) (BlobDigest, error) {
+	var d BlobDigest
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return d, err
+	}
+	if len(b) != len(d) {
+		return d, errInvalidBlobDigest
+	}
+	copy(d[:], b)
+	return d, nil
+}
+
+// BlobStore stores the contents of blobs, addressed by their digest.
+type BlobStore interface {
+	// PutBlob stores the contents read from r and returns their digest.
+	// Storing contents that already exist is a no-op.
+	PutBlob(r io.Reader) (BlobDigest, error)
+	// OpenBlob returns a reader over the contents of a blob. This will
+	// return `ErrNoSuchBlob` if the blob does not exist.
+	OpenBlob(BlobDigest) (io.ReadCloser, error)
+	// BlobSize returns the size of a blob in bytes. This will return
+	// `ErrNoSuchBlob` if the blob does not exist.
+	BlobSize(BlobDigest) (int64, error)
+}
+
+// PutBlob streams the contents read from r into the connection's blob store.
+// The returned digest may be asserted as the value of a db.type/blob
+// attribute.
+func (conn *Connection) PutBlob(r io.Reader) (BlobDigest, error) {
+	if conn.blobStore == nil {
+		return BlobDigest{}, ErrNoBlobStore
+	}
+	if conn.readOnly {
+		return BlobDigest{}, ErrReadOnly
+	}
+	return conn.blobStore.PutBlob(r)
+}
+
+// OpenBlob returns a reader that streams the contents of a blob. The reader
+// must be closed when it is no longer needed.
+func (conn *Connection) OpenBlob(digest BlobDigest) (io.ReadCloser, error) {
+	if conn.blobStore == nil {
+		return nil, ErrNoBlobStore
+	}
+	return conn.blobStore.OpenBlob(digest)
+}
+
+// BlobSize returns the size of a blob in bytes.
+func (conn *Connection) BlobSize(digest BlobDigest) (int64, error) {
+	if conn.blobStore == nil {
+		return 0, ErrNoBlobStore
+	}
+	return conn.blobStore.BlobSize(digest)
+}
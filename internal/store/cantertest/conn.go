@@ -0,0 +1,95 @@
+/*
+Copyright 2024 Andrew Meredith
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cantertest
+
+import (
+	"testing"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/kendru/canter/internal/store"
+	badgerImpl "github.com/kendru/canter/internal/store/badger"
+)
+
+// Conn is a connection to an in-memory database that fails the test on any
+// error from its Must methods.
+type Conn struct {
+	*store.Connection
+	t testing.TB
+}
+
+// NewConn opens an initialized in-memory database and loads the fixture
+// files, in order, each as its own transaction. The database is closed when
+// the test finishes. cfg may configure the connection, but its storage is
+// always the in-memory database.
+func NewConn(t testing.TB, cfg store.Config, fixtures ...string) *Conn {
+	t.Helper()
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true).WithLogger(nil))
+	if err != nil {
+		t.Fatalf("opening database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	sto, err := badgerImpl.New(db)
+	if err != nil {
+		t.Fatalf("opening store: %v", err)
+	}
+	cfg.IdentManager = sto
+	cfg.IDManager = sto
+	cfg.Indexer = sto
+	cfg.BlobStore = sto
+
+	conn := &Conn{
+		Connection: store.NewConnection(cfg),
+		t:          t,
+	}
+	if err := conn.InitializeDB(); err != nil {
+		t.Fatalf("initializing database: %v", err)
+	}
+	for _, path := range fixtures {
+		conn.MustLoadFixture(path)
+	}
+	return conn
+}
+
+// MustAssert is like Assert, but fails the test on error.
+func (c *Conn) MustAssert(assertables ...store.Assertable) *store.AssertResult {
+	c.t.Helper()
+	res, err := c.Assert(assertables...)
+	if err != nil {
+		c.t.Fatalf("asserting: %v", err)
+	}
+	return res
+}
+
+// MustPull pulls from the current database, failing the test on error.
+func (c *Conn) MustPull(idResolver store.Resolver, pattern ...store.PullAttr) store.EntityData {
+	c.t.Helper()
+	data, err := c.DB().Pull(idResolver, pattern...)
+	if err != nil {
+		c.t.Fatalf("pulling: %v", err)
+	}
+	return data
+}
+
+// MustLoadFixture is like LoadFixture, but fails the test on error.
+func (c *Conn) MustLoadFixture(path string) *store.AssertResult {
+	c.t.Helper()
+	res, err := LoadFixture(c.Connection, path)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return res
+}
@@ -0,0 +1,99 @@
+/*
+Copyright 2024 Andrew Meredith
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cantertest_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/kendru/canter/internal/store"
+	"github.com/kendru/canter/internal/store/cantertest"
+	"github.com/oklog/ulid/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFixtures(t *testing.T) {
+	conn := cantertest.NewConn(t, store.Config{}, "testdata/schema.json", "testdata/orders.json")
+
+	assert.Equal(t, store.EntityData{
+		"order/quantity": int32(3),
+		"order/total":    29.97,
+		"order/placedAt": time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC),
+		"order/paid":     true,
+		"order/tags":     []store.Value{"gift"},
+	}, conn.MustPull(store.NewLookup("order/number", "A-1001"),
+		store.PullAttr{Attribute: "order/quantity"},
+		store.PullAttr{Attribute: "order/total"},
+		store.PullAttr{Attribute: "order/placedAt"},
+		store.PullAttr{Attribute: "order/paid"},
+		store.PullAttr{Attribute: "order/tags"},
+	))
+
+	// Integral numbers are accepted for float attributes.
+	assert.Equal(t, store.EntityData{"order/total": 5.0},
+		conn.MustPull(store.NewLookup("order/number", "A-1002"), store.PullAttr{Attribute: "order/total"}))
+}
+
+func TestReadFixtureErrors(t *testing.T) {
+	_, err := cantertest.ReadFixture("testdata/missing.json")
+	assert.Error(t, err)
+}
+
+func TestDeterministicTransactions(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	transact := func() *store.AssertResult {
+		conn := cantertest.NewConn(t, store.Config{
+			Clock:    cantertest.NewClock(start, time.Second),
+			IDSource: cantertest.NewIDSource(1),
+		}, "testdata/schema.json")
+		gen, err := cantertest.NewGenerator(conn.Connection, 1)
+		if !assert.NoError(t, err) {
+			return nil
+		}
+		entities, err := gen.Entities(10)
+		if !assert.NoError(t, err) {
+			return nil
+		}
+		// Isolated tempIDs are also drawn from the connection's IDSource.
+		assertables := []store.Assertable{store.WithIsolatedTempIDs()}
+		for _, ent := range entities {
+			assertables = append(assertables, ent)
+		}
+		return conn.MustAssert(assertables...)
+	}
+
+	first, second := transact(), transact()
+	if first == nil || second == nil {
+		return
+	}
+	assert.Equal(t, first.TempIDs, second.TempIDs)
+	assert.Equal(t, first.Data, second.Data)
+	assert.Equal(t, first.Tx().Time(), second.Tx().Time())
+	assert.True(t, first.Tx().Time().After(start))
+
+	// The same seed generates the same IDs.
+	a, b := cantertest.NewIDSource(7), cantertest.NewIDSource(7)
+	var prev ulid.ULID
+	for i := 0; i < 3; i++ {
+		next := a.NewULID()
+		assert.Equal(t, next, b.NewULID())
+		assert.Equal(t, a.NewUUID(), b.NewUUID())
+		// ULIDs increase in the order that they are generated.
+		assert.Equal(t, 1, next.Compare(prev))
+		prev = next
+	}
+}
@@ -0,0 +1,85 @@
+/*
+Copyright 2024 Andrew Meredith
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cantertest
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/gofrs/uuid/v5"
+	"github.com/kendru/canter/internal/store"
+	"github.com/oklog/ulid/v2"
+)
+
+var (
+	_ store.Clock    = (*Clock)(nil)
+	_ store.IDSource = (*IDSource)(nil)
+)
+
+// Clock is a store.Clock whose readings do not depend on the wall clock. The
+// first reading is start, and every reading after that is step later than the
+// one before, so connections configured with equal Clocks commit the same
+// sequence of transactions at the same times.
+type Clock struct {
+	mu   sync.Mutex
+	next time.Time
+	step time.Duration
+}
+
+// NewClock returns a clock that reads start first and advances by step on
+// every reading.
+func NewClock(start time.Time, step time.Duration) *Clock {
+	return &Clock{next: start, step: step}
+}
+
+func (c *Clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.next
+	c.next = c.next.Add(c.step)
+	return now
+}
+
+// IDSource is a store.IDSource that generates the same sequence of ULIDs and
+// UUIDs for the same seed. Its ULIDs all carry a zero timestamp and increase
+// in the order that they are generated.
+type IDSource struct {
+	mu      sync.Mutex
+	entropy *ulid.MonotonicEntropy
+	uuids   *uuid.Gen
+}
+
+// NewIDSource returns an IDSource seeded with seed.
+func NewIDSource(seed int64) *IDSource {
+	return &IDSource{
+		entropy: ulid.Monotonic(rand.New(rand.NewSource(seed)), 0),
+		uuids:   uuid.NewGenWithOptions(uuid.WithRandomReader(rand.New(rand.NewSource(seed)))),
+	}
+}
+
+func (s *IDSource) NewULID() ulid.ULID {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return ulid.MustNew(0, s.entropy)
+}
+
+func (s *IDSource) NewUUID() uuid.UUID {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return uuid.Must(s.uuids.NewV4())
+}
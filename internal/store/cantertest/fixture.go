@@ -0,0 +1,101 @@
+/*
+Copyright 2024 Andrew Meredith
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cantertest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/kendru/canter/internal/store"
+)
+
+// ReadFixture reads a fixture file. A fixture is a JSON array of entities,
+// each of which is an object mapping attribute idents to values, e.g.:
+//
+//	[
+//	  {"db/ident": "person/email", "db/type": "db.type/string", "db/unique": true, "db/cardinality": "db.cardinality/one"},
+//	  {"person/email": "ameredith@example.com"}
+//	]
+//
+// Arrays are values of cardinality-many attributes, strings in ref position
+// are resolved as idents, and numbers are read as int64 when they are integers
+// and as float64 otherwise.
+func ReadFixture(path string) ([]store.EntityData, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading fixture: %w", err)
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var raw []map[string]any
+	if err := dec.Decode(&raw); err != nil {
+		return nil, fmt.Errorf("decoding fixture %s: %w", path, err)
+	}
+
+	entities := make([]store.EntityData, len(raw))
+	for i, ent := range raw {
+		entities[i] = make(store.EntityData, len(ent))
+		for attr, val := range ent {
+			if entities[i][attr], err = fixtureValue(val); err != nil {
+				return nil, fmt.Errorf("decoding fixture %s: entity %d: %s: %w", path, i, attr, err)
+			}
+		}
+	}
+	return entities, nil
+}
+
+// LoadFixture asserts the entities in a fixture file as a single transaction.
+func LoadFixture(conn *store.Connection, path string) (*store.AssertResult, error) {
+	entities, err := ReadFixture(path)
+	if err != nil {
+		return nil, err
+	}
+	assertables := make([]store.Assertable, len(entities))
+	for i, ent := range entities {
+		assertables[i] = ent
+	}
+	res, err := conn.Assert(assertables...)
+	if err != nil {
+		return nil, fmt.Errorf("loading fixture %s: %w", path, err)
+	}
+	return res, nil
+}
+
+func fixtureValue(val any) (store.Value, error) {
+	switch v := val.(type) {
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return n, nil
+		}
+		return v.Float64()
+	case []any:
+		vals := make([]store.Value, len(v))
+		for i, elem := range v {
+			var err error
+			if vals[i], err = fixtureValue(elem); err != nil {
+				return nil, err
+			}
+		}
+		return vals, nil
+	case map[string]any:
+		return nil, fmt.Errorf("nested entities are not supported")
+	default:
+		return v, nil
+	}
+}
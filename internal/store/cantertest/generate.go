@@ -0,0 +1,310 @@
+/*
+Copyright 2024 Andrew Meredith
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package cantertest provides helpers for testing code that uses the store.
+package cantertest
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"time"
+
+	"github.com/gofrs/uuid/v5"
+	"github.com/kendru/canter/internal/store"
+	"github.com/oklog/ulid/v2"
+)
+
+// Attribute describes a user attribute in the schema.
+type Attribute struct {
+	ID     store.ID
+	Name   string
+	Type   store.ID
+	Many   bool
+	Unique bool
+}
+
+// Generator generates random entities that are valid against a database's
+// schema. Values respect the type and cardinality of each attribute, values
+// of unique attributes are never repeated, and refs point at other entities in
+// the same batch. A generator's output is fully determined by the schema and
+// its seed.
+//
+// Attributes of types that cannot be generated, such as blobs and tuples, are
+// left out.
+// Unique values are drawn from a counter, so unique int8 and int16 attributes
+// only support up to 127 and 32767 values respectively.
+type Generator struct {
+	conn  *store.Connection
+	rng   *rand.Rand
+	attrs []Attribute
+	// seq is incremented for every unique value generated, so that unique
+	// values never repeat.
+	seq int64
+}
+
+// NewGenerator reads the schema of the database that conn is connected to and
+// returns a generator seeded with seed. Unique values are only unique among
+// the values produced by this generator, so two generators with the same seed
+// must not write to the same database.
+func NewGenerator(conn *store.Connection, seed int64) (*Generator, error) {
+	attrs, err := ReadSchema(conn)
+	if err != nil {
+		return nil, err
+	}
+	var supported []Attribute
+	for _, attr := range attrs {
+		if generatable(attr) {
+			supported = append(supported, attr)
+		}
+	}
+	return &Generator{
+		conn:  conn,
+		rng:   rand.New(rand.NewSource(seed)),
+		attrs: supported,
+	}, nil
+}
+
+// ReadSchema returns every user attribute in the database, ordered by name.
+func ReadSchema(conn *store.Connection) ([]Attribute, error) {
+	db := conn.DB()
+	rows, err := db.Query(store.Query{
+		Find: []store.Var{"?a", "?type", "?cardinality"},
+		Where: []store.Clause{
+			store.Pattern{Entity: store.Var("?a"), Attribute: "db/type", Value: store.Var("?type")},
+			store.Pattern{Entity: store.Var("?a"), Attribute: "db/cardinality", Value: store.Var("?cardinality")},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("querying schema: %w", err)
+	}
+
+	var attrs []Attribute
+	for _, row := range rows {
+		id := row[0].(store.ID)
+		if id.IsSystem() {
+			continue
+		}
+		ident, err := store.ResolveIdent(conn, id)
+		if err != nil {
+			return nil, fmt.Errorf("resolving ident of attribute %d: %w", id, err)
+		}
+		schema, err := db.SchemaFor(id)
+		if err != nil {
+			return nil, fmt.Errorf("reading attribute %s: %w", ident.Name, err)
+		}
+		attrs = append(attrs, Attribute{
+			ID:     id,
+			Name:   ident.Name,
+			Type:   row[1].(store.ID),
+			Many:   row[2] == store.IDCardinalityMany,
+			Unique: schema.Unique != 0,
+		})
+	}
+	sort.Slice(attrs, func(i, j int) bool {
+		return attrs[i].Name < attrs[j].Name
+	})
+	return attrs, nil
+}
+
+func generatable(attr Attribute) bool {
+	switch attr.Type {
+	case store.IDTypeDecimal, store.IDTypeComposite, store.IDTypeBlob, store.IDTypeTuple:
+		return false
+	case store.IDTypeBoolean:
+		// There are too few booleans to keep generating unique ones.
+		return !attr.Unique
+	default:
+		return true
+	}
+}
+
+// Attributes returns the attributes that the generator produces values for.
+func (g *Generator) Attributes() []Attribute {
+	return g.attrs
+}
+
+// Entities generates n entities. Each entity is given a value for a random
+// subset of the attributes named by attrs, or of every attribute if attrs is
+// empty, and always for at least one of them. Every entity has a db/id tempID
+// so that the entities may be asserted together in a single transaction.
+func (g *Generator) Entities(n int, attrs ...string) ([]store.EntityData, error) {
+	candidates := g.attrs
+	if len(attrs) > 0 {
+		candidates = make([]Attribute, 0, len(attrs))
+		for _, name := range attrs {
+			attr, ok := g.attribute(name)
+			if !ok {
+				return nil, fmt.Errorf("no generatable attribute named %q", name)
+			}
+			candidates = append(candidates, attr)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, errors.New("no attributes to generate")
+	}
+
+	ids := make([]store.Value, n)
+	for i := range ids {
+		ids[i] = g.conn.TempID()
+	}
+	entities := make([]store.EntityData, n)
+	for i := range entities {
+		ent := store.EntityData{"db/id": ids[i]}
+		for len(ent) == 1 {
+			for _, attr := range candidates {
+				if g.rng.Intn(2) == 0 {
+					continue
+				}
+				ent[attr.Name] = g.value(attr, ids)
+			}
+		}
+		entities[i] = ent
+	}
+	return entities, nil
+}
+
+func (g *Generator) attribute(name string) (Attribute, bool) {
+	for _, attr := range g.attrs {
+		if attr.Name == name {
+			return attr, true
+		}
+	}
+	return Attribute{}, false
+}
+
+// value generates a value for attr. Refs are chosen from ids.
+func (g *Generator) value(attr Attribute, ids []store.Value) store.Value {
+	if !attr.Many {
+		return g.scalar(attr, ids)
+	}
+	n := 1 + g.rng.Intn(3)
+	vals := make([]store.Value, 0, n)
+	for len(vals) < n {
+		val := g.scalar(attr, ids)
+		// Values of cardinality-many attributes form a set.
+		if !containsValue(vals, val) {
+			vals = append(vals, val)
+		} else if attr.Type == store.IDTypeRef || attr.Type == store.IDTypeBoolean {
+			// The batch may not have enough distinct values.
+			break
+		}
+	}
+	return vals
+}
+
+func (g *Generator) scalar(attr Attribute, ids []store.Value) store.Value {
+	var seq int64
+	if attr.Unique {
+		g.seq++
+		seq = g.seq
+	}
+
+	switch attr.Type {
+	case store.IDTypeRef:
+		return ids[g.rng.Intn(len(ids))]
+	case store.IDTypeString:
+		if attr.Unique {
+			return fmt.Sprintf("%s-%d", g.word(), seq)
+		}
+		return g.word()
+	case store.IDTypeBoolean:
+		return g.rng.Intn(2) == 0
+	case store.IDTypeInt64:
+		if attr.Unique {
+			return seq
+		}
+		return g.rng.Int63() - g.rng.Int63()
+	case store.IDTypeInt32:
+		if attr.Unique {
+			return int32(seq)
+		}
+		return int32(g.rng.Int63n(math.MaxUint32+1) + math.MinInt32)
+	case store.IDTypeInt16:
+		if attr.Unique {
+			return int16(seq)
+		}
+		return int16(g.rng.Int63n(math.MaxUint16+1) + math.MinInt16)
+	case store.IDTypeInt8:
+		if attr.Unique {
+			return int8(seq)
+		}
+		return int8(g.rng.Int63n(math.MaxUint8+1) + math.MinInt8)
+	case store.IDTypeFloat64:
+		if attr.Unique {
+			return float64(seq) + g.rng.Float64()
+		}
+		return g.rng.NormFloat64() * 1e6
+	case store.IDTypeFloat32:
+		if attr.Unique {
+			return float32(seq)
+		}
+		return float32(g.rng.NormFloat64() * 1e3)
+	case store.IDTypeTimestamp:
+		if attr.Unique {
+			return time.Unix(seq, 0).UTC()
+		}
+		return g.time()
+	case store.IDTypeDate:
+		if attr.Unique {
+			return time.Unix(seq*24*60*60, 0).UTC()
+		}
+		return g.time().Truncate(24 * time.Hour)
+	case store.IDTypeBinary:
+		buf := make([]byte, 1+g.rng.Intn(32))
+		g.rng.Read(buf)
+		if attr.Unique {
+			buf = fmt.Appendf(buf, "-%d", seq)
+		}
+		return buf
+	case store.IDTypeUUID:
+		var id uuid.UUID
+		g.rng.Read(id[:])
+		return id
+	case store.IDTypeULID:
+		var id ulid.ULID
+		g.rng.Read(id[:])
+		return id
+	default:
+		panic(fmt.Sprintf("cannot generate values of type %s", attr.Type))
+	}
+}
+
+const letters = "abcdefghijklmnopqrstuvwxyz"
+
+func (g *Generator) word() string {
+	buf := make([]byte, 1+g.rng.Intn(12))
+	for i := range buf {
+		buf[i] = letters[g.rng.Intn(len(letters))]
+	}
+	return string(buf)
+}
+
+// time returns a random time between 1970 and 2100 with second precision.
+func (g *Generator) time() time.Time {
+	return time.Unix(g.rng.Int63n(4102444800), 0).UTC()
+}
+
+func containsValue(vals []store.Value, val store.Value) bool {
+	for _, v := range vals {
+		if fmt.Sprintf("%#v", v) == fmt.Sprintf("%#v", val) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,102 @@
+/*
+Copyright 2024 Andrew Meredith
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cantertest_test
+
+import (
+	"testing"
+
+	"github.com/kendru/canter/internal/store"
+	"github.com/kendru/canter/internal/store/cantertest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadSchema(t *testing.T) {
+	conn := cantertest.NewConn(t, store.Config{}, "testdata/schema.json")
+	attrs, err := cantertest.ReadSchema(conn.Connection)
+	if !assert.NoError(t, err) {
+		return
+	}
+	names := make([]string, len(attrs))
+	for i, attr := range attrs {
+		names[i] = attr.Name
+	}
+	assert.Equal(t, []string{
+		"order/number", "order/paid", "order/placedAt", "order/quantity",
+		"order/ref", "order/related", "order/tags", "order/total",
+	}, names)
+	assert.Equal(t, cantertest.Attribute{
+		ID:     attrs[0].ID,
+		Name:   "order/number",
+		Type:   store.IDTypeString,
+		Unique: true,
+	}, attrs[0])
+	assert.True(t, attrs[6].Many)
+}
+
+func TestGenerator(t *testing.T) {
+	conn := cantertest.NewConn(t, store.Config{}, "testdata/schema.json")
+	generate := func() []store.EntityData {
+		gen, err := cantertest.NewGenerator(conn.Connection, 1)
+		if !assert.NoError(t, err) {
+			return nil
+		}
+		entities, err := gen.Entities(50)
+		assert.NoError(t, err)
+		return entities
+	}
+
+	entities := generate()
+	if !assert.Len(t, entities, 50) {
+		return
+	}
+	res := conn.MustAssert(assertables(entities)...)
+
+	// Every generated entity is stored as a distinct entity.
+	ids := make(map[store.ID]struct{})
+	for symbol, id := range res.TempIDs {
+		if symbol != "txid" {
+			ids[id] = struct{}{}
+		}
+	}
+	assert.Len(t, ids, len(entities))
+
+	// Generators with the same seed produce the same values.
+	again := generate()
+	for i := range entities {
+		assert.Equal(t, withoutRefs(entities[i]), withoutRefs(again[i]))
+	}
+}
+
+func assertables(entities []store.EntityData) []store.Assertable {
+	out := make([]store.Assertable, len(entities))
+	for i, ent := range entities {
+		out[i] = ent
+	}
+	return out
+}
+
+// withoutRefs removes the values that hold tempIDs, which are different each
+// time they are generated.
+func withoutRefs(ent store.EntityData) store.EntityData {
+	out := make(store.EntityData, len(ent))
+	for attr, val := range ent {
+		if attr != "db/id" && attr != "order/related" {
+			out[attr] = val
+		}
+	}
+	return out
+}
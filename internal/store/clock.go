@@ -0,0 +1,112 @@
+/*
+Copyright 2024 Andrew Meredith
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Clock supplies the commit times of transactions.
+type Clock interface {
+	Now() time.Time
+}
+
+// SystemClock is a Clock that reads the wall clock.
+type SystemClock struct{}
+
+func (SystemClock) Now() time.Time {
+	return time.Now()
+}
+
+// HybridLogicalClock is a Clock that never goes backwards. It follows a
+// physical clock, but whenever the physical clock reads at or before the
+// latest time that the HLC has issued or observed, the HLC issues that time
+// plus one nanosecond instead. Every time that it issues is therefore strictly
+// later than the last, and later than any time that it has observed from
+// another clock.
+type HybridLogicalClock struct {
+	mu       sync.Mutex
+	physical Clock
+	last     time.Time
+}
+
+// NewHybridLogicalClock returns an HLC that follows physical. If physical is
+// nil, the wall clock is used.
+func NewHybridLogicalClock(physical Clock) *HybridLogicalClock {
+	if physical == nil {
+		physical = SystemClock{}
+	}
+	return &HybridLogicalClock{physical: physical}
+}
+
+func (c *HybridLogicalClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// Strip the monotonic reading so that issued times compare the same way
+	// before and after they are stored.
+	t := c.physical.Now().Round(0)
+	if !t.After(c.last) {
+		t = c.last.Add(time.Nanosecond)
+	}
+	c.last = t
+	return t
+}
+
+// Observe advances the clock to t, a time issued by another clock, so that
+// every time issued afterwards is later than t.
+func (c *HybridLogicalClock) Observe(t time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if t.After(c.last) {
+		c.last = t.Round(0)
+	}
+}
+
+// commitClock issues the commit times of a connection's transactions. Before
+// issuing the first time, it observes the commit time of the latest
+// transaction in storage, so commit times keep increasing when a new
+// transactor takes over a database.
+type commitClock struct {
+	hlc      *HybridLogicalClock
+	seedOnce sync.Once
+	seedErr  error
+}
+
+func newCommitClock(clock Clock) *commitClock {
+	hlc, ok := clock.(*HybridLogicalClock)
+	if !ok {
+		hlc = NewHybridLogicalClock(clock)
+	}
+	return &commitClock{hlc: hlc}
+}
+
+// nextCommitTime returns the commit time for a new transaction.
+func (conn *Connection) nextCommitTime() (time.Time, error) {
+	cc := conn.commitClock
+	cc.seedOnce.Do(func() {
+		cc.seedErr = conn.scanCommitTimes(nil, func(_ ID, committed time.Time) bool {
+			cc.hlc.Observe(committed)
+			return true
+		})
+	})
+	if cc.seedErr != nil {
+		return time.Time{}, fmt.Errorf("reading latest commit time: %w", cc.seedErr)
+	}
+	return cc.hlc.Now(), nil
+}
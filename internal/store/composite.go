@@ -0,0 +1,285 @@
+/*
+Copyright 2024 Andrew Meredith
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync/atomic"
+)
+
+// Composite attributes hold a Tuple of the values of several cardinality-one
+// attributes of the same entity, called its components. A composite attribute
+// is declared with db/type db.type/composite and the components, in order, as
+// a Tuple of attributes in db/compositeComponents:
+//
+//	store.EntityData{
+//		"db/ident":               "member/orgEmail",
+//		"db/type":                "db.type/composite",
+//		"db/compositeComponents": store.Tuple{store.Ident{Name: "member/org"}, store.Ident{Name: "member/email"}},
+//		"db/unique":              true,
+//	}
+//
+// Composite values may not be asserted directly. Instead, every transaction
+// that changes a component of an entity derives the entity's composite value:
+// the tuple of its component values if it has a value for every component, or
+// no value otherwise. A unique composite attribute therefore constrains the
+// combination of its components' values, and it may be used in a Lookup with
+// a Tuple of those values. Entities that existed before a composite attribute
+// was declared are given a value the next time one of their components
+// changes.
+
+// compositeAttr is a composite attribute along with its components.
+type compositeAttr struct {
+	ID         ID
+	Components []ID
+	Unique     bool
+}
+
+// compositeIndex holds the composite attributes of a database by component.
+type compositeIndex struct {
+	byComponent map[ID][]*compositeAttr
+}
+
+// compositeCache caches the compositeIndex of a connection. It is cleared by
+// transactions that may change the declaration of a composite attribute.
+type compositeCache struct {
+	index atomic.Pointer[compositeIndex]
+}
+
+// observe clears the cache if the assertions may declare or change composite
+// attributes.
+func (c *compositeCache) observe(assertions []ResolvedAssertion) {
+	for _, ra := range assertions {
+		if ra.Attribute == IDCompositeComponents || ra.Attribute == IDUnique {
+			c.index.Store(nil)
+			return
+		}
+	}
+}
+
+// composites returns the composite attributes of the database.
+func (db Database) composites() (*compositeIndex, error) {
+	cache := &db.conn.composites
+	if idx := cache.index.Load(); idx != nil {
+		return idx, nil
+	}
+	attr := IDCompositeComponents
+	facts, err := db.scan(nil, &attr)
+	if err != nil {
+		return nil, fmt.Errorf("scanning composite attributes: %w", err)
+	}
+	idx := &compositeIndex{byComponent: make(map[ID][]*compositeAttr)}
+	for _, fct := range facts {
+		components, ok := compositeComponents(fct.Value)
+		if !ok {
+			continue
+		}
+		unique, err := db.isUnique(fct.EntityID)
+		if err != nil {
+			return nil, err
+		}
+		ca := &compositeAttr{ID: fct.EntityID, Components: components, Unique: unique}
+		for _, comp := range components {
+			idx.byComponent[comp] = append(idx.byComponent[comp], ca)
+		}
+	}
+	cache.index.Store(idx)
+	return idx, nil
+}
+
+// compositeComponents returns the components of a db/compositeComponents
+// value.
+func compositeComponents(val Value) ([]ID, bool) {
+	tuple, ok := val.(Tuple)
+	if !ok {
+		return nil, false
+	}
+	components := make([]ID, len(tuple))
+	for i, elem := range tuple {
+		if components[i], ok = elem.(ID); !ok {
+			return nil, false
+		}
+	}
+	return components, true
+}
+
+// checkCompositeDeclaration returns an error unless a db/compositeComponents
+// value names at least two distinct cardinality-one attributes.
+func (db Database) checkCompositeDeclaration(val Value) error {
+	components, ok := compositeComponents(val)
+	if !ok {
+		return errors.New("db/compositeComponents must be a tuple of attributes")
+	}
+	if len(components) < 2 {
+		return errors.New("a composite attribute must have at least two components")
+	}
+	seen := make(map[ID]struct{}, len(components))
+	for _, comp := range components {
+		if _, ok := seen[comp]; ok {
+			return fmt.Errorf("component %d is repeated", comp)
+		}
+		seen[comp] = struct{}{}
+		cardinality, err := db.cardinalityOf(comp)
+		if err != nil {
+			return fmt.Errorf("component %d: %w", comp, err)
+		}
+		if cardinality != IDCardinalityOne {
+			return fmt.Errorf("component %d must have cardinality one", comp)
+		}
+	}
+	return nil
+}
+
+// deriveComposites appends to the resolved assertions of a transaction the
+// assertions and retractions of the composite values that change as a result
+// of them, and adds a precondition that the transaction's unique composite
+// values are not held by other entities.
+func (tx *TxBuilder) deriveComposites(resolved []ResolvedAssertion) ([]ResolvedAssertion, error) {
+	db := tx.conn.DB()
+	for _, ra := range resolved {
+		if ra.Attribute == IDCompositeComponents && ra.mode == AssertModeAddition {
+			if err := db.checkCompositeDeclaration(ra.Value); err != nil {
+				return nil, fmt.Errorf("declaring composite attribute %d: %w", ra.EntityID, err)
+			}
+		}
+	}
+	idx, err := db.composites()
+	if err != nil {
+		return nil, err
+	}
+	if len(idx.byComponent) == 0 {
+		return resolved, nil
+	}
+
+	type entityAttr struct {
+		entity ID
+		attr   ID
+	}
+	// changed holds the composites of each entity that the transaction
+	// changes a component of, and asserted holds the component values that
+	// the transaction leaves in place.
+	changed := make(map[ID]map[*compositeAttr]struct{})
+	asserted := make(map[entityAttr]Value)
+	var entities []ID
+	for _, ra := range resolved {
+		composites := idx.byComponent[ra.Attribute]
+		if len(composites) == 0 {
+			continue
+		}
+		if _, ok := changed[ra.EntityID]; !ok {
+			changed[ra.EntityID] = make(map[*compositeAttr]struct{})
+			entities = append(entities, ra.EntityID)
+		}
+		for _, ca := range composites {
+			changed[ra.EntityID][ca] = struct{}{}
+		}
+		key := entityAttr{ra.EntityID, ra.Attribute}
+		if ra.mode == AssertModeAddition {
+			asserted[key] = ra.Value
+		} else {
+			asserted[key] = nil
+		}
+	}
+	sort.Slice(entities, func(i, j int) bool { return entities[i] < entities[j] })
+
+	current := func(eid, attr ID) (Value, error) {
+		facts, err := db.scan(&eid, &attr)
+		if err != nil || len(facts) == 0 {
+			return nil, err
+		}
+		return facts[0].Value, nil
+	}
+	type uniqueValue struct {
+		attr   ID
+		entity ID
+		value  Tuple
+	}
+	var unique []uniqueValue
+	for _, eid := range entities {
+		composites := make([]*compositeAttr, 0, len(changed[eid]))
+		for ca := range changed[eid] {
+			composites = append(composites, ca)
+		}
+		sort.Slice(composites, func(i, j int) bool { return composites[i].ID < composites[j].ID })
+
+		for _, ca := range composites {
+			value := make(Tuple, len(ca.Components))
+			for i, comp := range ca.Components {
+				val, ok := asserted[entityAttr{eid, comp}]
+				if !ok {
+					if val, err = current(eid, comp); err != nil {
+						return nil, err
+					}
+				}
+				if val == nil {
+					value = nil
+					break
+				}
+				value[i] = val
+			}
+			old, err := current(eid, ca.ID)
+			if err != nil {
+				return nil, err
+			}
+			if old != nil && value != nil && ValueEqual(old, value) {
+				continue
+			}
+			if old != nil {
+				resolved = append(resolved, ResolvedAssertion{
+					Fact: Fact{EntityID: eid, Attribute: ca.ID, Value: old},
+					mode: AssertModeRetraction,
+				})
+			}
+			if value != nil {
+				resolved = append(resolved, ResolvedAssertion{
+					Fact: Fact{EntityID: eid, Attribute: ca.ID, Value: value},
+					mode: AssertModeAddition,
+				})
+				if ca.Unique {
+					unique = append(unique, uniqueValue{attr: ca.ID, entity: eid, value: value})
+				}
+			}
+		}
+	}
+
+	if len(unique) > 0 {
+		// Uniqueness is checked when the transaction is written, so that no
+		// other transaction can claim the same values in between.
+		tx.preconditions = append(tx.preconditions, func(db Database) error {
+			claimed := make(map[lookupKey]ID, len(unique))
+			for _, u := range unique {
+				key := newLookupKey(u.attr, u.value)
+				if other, ok := claimed[key]; ok {
+					return uniqueConflict(db, u.attr, u.value, other)
+				}
+				claimed[key] = u.entity
+				other, err := db.lookupEntity(u.attr, u.value)
+				switch {
+				case errors.Is(err, ErrNoSuchEntity):
+				case err != nil:
+					return err
+				case other != u.entity:
+					return uniqueConflict(db, u.attr, u.value, other)
+				}
+			}
+			return nil
+		})
+	}
+	return resolved, nil
+}
@@ -0,0 +1,134 @@
+/*
+Copyright 2024 Andrew Meredith
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// ComputedAttribute is an attribute whose value is computed from an entity's
+// stored attributes when the entity is read, such as a person/fullName
+// computed from a person's first and last names. Computed attributes appear
+// in the results of Entity.GetData and Entity.Pull, marked as ComputedValues,
+// but they are never stored: they cannot be asserted, and queries and lookups
+// do not see them.
+type ComputedAttribute struct {
+	// Fn computes the attribute's value from the stored data of an entity, as
+	// returned by GetData without computed attributes. It reports false if
+	// the entity has no value for the attribute, in which case the attribute
+	// is omitted.
+	Fn func(data EntityData) (Value, bool, error)
+}
+
+// ComputedValue is the value of a computed attribute in EntityData. It marks
+// the value as computed rather than stored, and it is skipped when the data is
+// asserted, so that data read with GetData may be modified and asserted
+// again. It marshals to JSON as its Value.
+type ComputedValue struct {
+	Value Value
+}
+
+func (v ComputedValue) MarshalJSON() ([]byte, error) {
+	return json.Marshal(v.Value)
+}
+
+// computedAttributes holds the computed attributes registered with a
+// connection.
+type computedAttributes struct {
+	mu    sync.RWMutex
+	attrs map[string]ComputedAttribute
+}
+
+func newComputedAttributes() *computedAttributes {
+	return &computedAttributes{attrs: make(map[string]ComputedAttribute)}
+}
+
+func (c *computedAttributes) lookup(name string) (ComputedAttribute, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	attr, ok := c.attrs[name]
+	return attr, ok
+}
+
+// names returns the names of the computed attributes in order.
+func (c *computedAttributes) names() []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	names := make([]string, 0, len(c.attrs))
+	for name := range c.attrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// compute computes the named attribute from an entity's stored data.
+func (c *computedAttributes) compute(name string, attr ComputedAttribute, stored EntityData) (Value, bool, error) {
+	val, ok, err := attr.Fn(stored)
+	if err != nil {
+		return nil, false, fmt.Errorf("computing attribute %s: %w", name, err)
+	}
+	return val, ok, nil
+}
+
+// RegisterComputedAttribute registers an attribute that is computed when an
+// entity is read. The name must have a namespace, like the ident of a stored
+// attribute, and it may not be the ident of an existing attribute. A stored
+// attribute may not be created with the name of a computed attribute
+// afterwards either.
+func (conn *Connection) RegisterComputedAttribute(name string, attr ComputedAttribute) error {
+	if attr.Fn == nil {
+		return fmt.Errorf("computed attribute %s has no implementation", name)
+	}
+	if namespace, _ := namespaceOf(name); namespace == "" {
+		return fmt.Errorf("computed attribute %s has no namespace", name)
+	}
+	if _, err := ResolveIdent(conn, name); err == nil {
+		return fmt.Errorf("computed attribute %s is already a stored attribute", name)
+	} else if !errors.Is(err, ErrNoSuchIdent) {
+		return err
+	}
+	conn.computed.mu.Lock()
+	defer conn.computed.mu.Unlock()
+	if _, ok := conn.computed.attrs[name]; ok {
+		return fmt.Errorf("computed attribute %s is already registered", name)
+	}
+	conn.computed.attrs[name] = attr
+	return nil
+}
+
+// checkNotComputed fails if an assertion asserts a computed attribute or
+// creates an ident with the name of one.
+func (conn *Connection) checkNotComputed(assertion Assertion) error {
+	name, ok := assertion.attribute.(string)
+	if !ok {
+		return nil
+	}
+	if name == "db/ident" {
+		if name, ok = assertion.value.(string); !ok {
+			return nil
+		}
+	}
+	if _, ok := conn.computed.lookup(name); ok {
+		return errors.Join(fmt.Errorf("attribute %s is computed and cannot be stored", name), ErrComputedAttribute)
+	}
+	return nil
+}
@@ -20,14 +20,11 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"math"
 	"strings"
-	"time"
+	"sync"
+	"sync/atomic"
 
-	"github.com/gofrs/uuid/v5"
-	"github.com/kendru/canter/internal/util"
-	"github.com/kendru/canter/pkg/dataflow"
-	"github.com/oklog/ulid/v2"
+	"github.com/kendru/canter/pkg/rtype"
 )
 
 const unresolvedEntityID = ID(0)
@@ -36,29 +33,193 @@ type Config struct {
 	IdentManager
 	IDManager
 	Indexer
+	// BlobStore stores the contents of db.type/blob values. If nil, blob
+	// attributes cannot be used.
+	BlobStore BlobStore
+
+	// MaxTxFacts limits the number of facts that a single transaction may
+	// assert. If zero, transactions are unlimited.
+	MaxTxFacts int
+
+	// RetryPolicy controls how storage operations that fail with transient
+	// errors are retried. If nil, DefaultRetryPolicy() is used.
+	RetryPolicy *RetryPolicy
+
+	// ReadOnly rejects every operation that would write to storage with
+	// ErrReadOnly. Read-only connections may share storage with a writer.
+	ReadOnly bool
+
+	// TypeRegistry is the registry used to resolve types for this connection.
+	// If nil, the default rtype registry is used.
+	TypeRegistry *rtype.Registry
+
+	// EntityCacheSize is the number of recently read entities that the
+	// connection caches. If zero, entities are not cached. Cached entities are
+	// only invalidated by transactions committed through the connection, so
+	// the cache must not be enabled on a connection whose storage is written
+	// by other connections, except for peers of the connection (see NewPeer).
+	EntityCacheSize int
+
+	// MemoryBudget is the number of bytes that the connection's entity cache
+	// and its scans and queries in progress may hold at once, as estimated
+	// from the values that they hold. When the budget is reached, cached
+	// entities are evicted to make room, and scans and queries that still
+	// need more memory fail with ErrMemoryBudget. If zero, memory use is
+	// tracked (see Connection.MemoryStats) but not limited.
+	MemoryBudget int64
+
+	// IdentCacheSize bounds the number of idents, other than the system
+	// idents, that the connection caches. When the cache is full, the least
+	// recently used ident is evicted. If zero, the cache is unbounded and
+	// every ident in storage is loaded when the connection is opened.
+	IdentCacheSize int
+
+	// Clock supplies the commit times of transactions. Commit times are kept
+	// strictly increasing even if the clock is not, and they continue from
+	// the latest commit time in storage. If nil, the wall clock is used. Use a
+	// HybridLogicalClock to also order commit times after times observed from
+	// other processes.
+	Clock Clock
+
+	// IDSource generates the ULIDs and UUIDs that the connection needs, such
+	// as the symbols of tempIDs created by Connection.TempID. If nil, they
+	// are random.
+	IDSource IDSource
+
+	// Outbox, if set, derives events from every transaction. The events are
+	// written to the transactional outbox atomically with the transaction
+	// and are delivered by an OutboxRelay.
+	Outbox OutboxFunc
+
+	// BeforeCommit, if set, is called with the resolved assertions of every
+	// transaction built by a TxBuilder of the connection or of its peers,
+	// including dry runs, before it is written, e.g. to enforce security
+	// policies. If it returns an error, the transaction fails with that
+	// error. It is passed the context given to the transaction by
+	// WithContext, and it must not modify the assertions. The transaction's
+	// ID and commit time are assigned once it is written, so they are not
+	// among the assertions.
+	// The system schema written by InitializeDB and the transactions written
+	// by Replay were validated elsewhere, so they are not passed to it.
+	BeforeCommit func(ctx context.Context, assertions []ResolvedAssertion) error
+
+	// AfterCommit, if set, is called with the report of every transaction
+	// committed through the connection once the transaction is visible, e.g.
+	// to invalidate an application cache. Unlike a TxReportQueue, it is
+	// called by the committing goroutine before the commit returns, so it
+	// delays the caller, and transactions committed concurrently may be
+	// reported out of commit order.
+	AfterCommit func(report TxReport)
+
+	// Functions are the functions that queries may call in Predicate and Call
+	// clauses. If nil, the connection has its own registry of the built-in
+	// functions, to which RegisterFunction adds.
+	Functions *FunctionRegistry
+
+	// SlowLog configures the log of slow transactions and queries. By
+	// default, nothing is logged.
+	SlowLog SlowLogConfig
+
+	// Admission, if set, limits the rate at which transactions are committed
+	// through the connection. Transactions are admitted under AdmissionKey
+	// unless they set their own key with WithAdmissionKey.
+	Admission    *AdmissionController
+	AdmissionKey string
+
+	// InferSchema enables soft schema mode for exploratory data. Asserting
+	// an attribute that does not exist creates it instead of failing, with a
+	// type inferred from the asserted value, cardinality one, and
+	// db/inferred set so that it can be found by InferredSchema and hardened
+	// later.
+	InferSchema bool
 }
 
 func NewConnection(cfg Config) *Connection {
 	// Initialize an ident cache that is hydrated with system idents.
-	identCache := newIdentCache(cfg.IdentManager)
+	identCache := newIdentCache(cfg.IdentCacheSize)
 
-	// TODO: Figure out when to call this and how to handle errors.
-	go func() {
-		idents, err := cfg.IdentManager.LoadIdents()
-		if err != nil {
-			println("Error loading idents from ident manager:", err)
-			return
-		}
-		identCache.store(idents)
-	}()
+	retryPolicy := DefaultRetryPolicy()
+	if cfg.RetryPolicy != nil {
+		retryPolicy = *cfg.RetryPolicy
+	}
+
+	typeRegistry := cfg.TypeRegistry
+	if typeRegistry == nil {
+		typeRegistry = rtype.DefaultRegistry()
+	}
+
+	functions := cfg.Functions
+	if functions == nil {
+		functions = NewFunctionRegistry()
+	}
 
-	return &Connection{
+	idSource := cfg.IDSource
+	if idSource == nil {
+		idSource = RandomIDSource{}
+	}
+
+	memory := newMemoryAccountant(cfg.MemoryBudget)
+	conn := &Connection{
 		identCache:        identCache,
 		identManager:      cfg.IdentManager,
 		schemaEntityCache: make(map[ID]Entity),
+		entityCache:       newEntityCache(cfg.EntityCacheSize, memory),
+		memory:            memory,
+		attrStats:         newAttrStatsRegistry(),
 		idManager:         cfg.IDManager,
 		indexer:           cfg.Indexer,
+		blobStore:         cfg.BlobStore,
+		maxTxFacts:        cfg.MaxTxFacts,
+		retryPolicy:       retryPolicy,
+		readOnly:          cfg.ReadOnly,
+		typeRegistry:      typeRegistry,
+		commitClock:       newCommitClock(cfg.Clock),
+		idSource:          idSource,
+		outbox:            cfg.Outbox,
+		beforeCommit:      cfg.BeforeCommit,
+		afterCommit:       cfg.AfterCommit,
+		functions:         functions,
+		computed:          newComputedAttributes(),
+		slowLog:           newSlowLog(cfg.SlowLog),
+		admission:         cfg.Admission,
+		admissionKey:      cfg.AdmissionKey,
+		inferSchema:       cfg.InferSchema,
+	}
+	// A connection to a store that already holds transactions starts at the
+	// latest of them. If they cannot be read now, the basis is found again
+	// when it is first needed to commit (see latestTx).
+	if conn.indexer != nil {
+		_ = conn.loadBasis()
 	}
+	conn.goBackground(func() { hydrateIdentCache(identCache, cfg.IdentManager) })
+	return conn
+}
+
+// goBackground runs fn in a goroutine that Close waits for.
+func (conn *Connection) goBackground(fn func()) {
+	conn.lifecycle.inflight.Add(1)
+	go func() {
+		defer conn.lifecycle.end()
+		fn()
+	}()
+}
+
+// hydrateIdentCache loads every ident from the ident manager into the cache.
+// A bounded cache is instead filled as idents are used, so it is considered
+// hydrated from the start.
+func hydrateIdentCache(identCache *identCache, identManager IdentManager) {
+	if identCache.bounded() {
+		identCache.hydrated.Store(true)
+		return
+	}
+	// TODO: Figure out when to call this and how to handle errors.
+	idents, err := identManager.LoadIdents()
+	if err != nil {
+		println("Error loading idents from ident manager:", err)
+		return
+	}
+	identCache.store(idents)
+	identCache.hydrated.Store(true)
 }
 
 // Connection is the structure used to maintain
@@ -68,177 +229,138 @@ type Connection struct {
 	identCache   *identCache
 
 	// schema
+	schemaMu          sync.RWMutex
 	schemaEntityCache map[ID]Entity
+	// schemaGen is incremented every time cached schema is invalidated.
+	schemaGen uint64
+
+	entityCache *entityCache
+	memory      *memoryAccountant
+	attrStats   *attrStatsRegistry
+	composites  compositeCache
 
 	idManager IDManager
 
-	indexer Indexer
+	indexer   Indexer
+	blobStore BlobStore
+
+	// writeMu serializes writes to storage.
+	writeMu sync.Mutex
+	// reportMu orders the delivery of tx reports. A writer takes it before
+	// releasing writeMu, so reports are queued in commit order.
+	reportMu    sync.Mutex
+	maxTxFacts  int
+	retryPolicy RetryPolicy
+	readOnly    bool
+	// basis is the ID of the most recently committed transaction.
+	basis        atomic.Int64
+	basisChanged basisNotifier
+
+	typeRegistry *rtype.Registry
+	commitClock  *commitClock
+	idSource     IDSource
+	outbox       OutboxFunc
+	beforeCommit func(ctx context.Context, assertions []ResolvedAssertion) error
+	afterCommit  func(report TxReport)
+	functions    *FunctionRegistry
+	computed     *computedAttributes
+	slowLog      *slowLog
+	admission    *AdmissionController
+	admissionKey string
+	inferSchema  bool
+
+	txReports txReportQueues
+	lifecycle lifecycle
+
+	// transactor is the connection to which a peer forwards its writes. It is
+	// nil for connections that write to storage themselves.
+	transactor *Connection
+}
+
+// ReadOnly reports whether the connection rejects writes.
+func (conn *Connection) ReadOnly() bool {
+	return conn.readOnly
+}
+
+// TypeRegistry returns the type registry associated with the connection.
+func (conn *Connection) TypeRegistry() *rtype.Registry {
+	return conn.typeRegistry
+}
+
+// ParseType parses a type expression using the connection's type registry.
+func (conn *Connection) ParseType(typeStr string) (rtype.ConcreteType, error) {
+	return rtype.ParseWithRegistry(conn.typeRegistry, typeStr)
 }
 
 // InitializeDB sets up all of the required resources in the underlying storage
-// engine for the database to which the peer is connected. It should only be
-// called once, before transacting any data.
+// engine for the database to which the peer is connected. It must be called
+// before transacting any data, and it is safe to call every time a connection
+// is opened: a database that is already initialized is left untouched, and one
+// that was initialized by an earlier release has its system schema upgraded.
+// Databases initialized by a newer release are refused with ErrSystemTooNew.
 func (conn *Connection) InitializeDB() error {
-	// TODO: Ensure system is not already initialized.
+	if conn.readOnly {
+		return ErrReadOnly
+	}
+
+	db := conn.DB()
+	version, err := db.systemVersion()
+	if err != nil {
+		return fmt.Errorf("reading system schema version: %w", err)
+	}
+	if version > systemSchemaVersion {
+		return errors.Join(
+			fmt.Errorf("system schema version %d is newer than supported version %d", version, systemSchemaVersion),
+			ErrSystemTooNew,
+		)
+	}
+	if version == systemSchemaVersion {
+		return nil
+	}
 
 	// Note that since we do not have any schema in the database already, we
 	// must call the internal `conn.assert()`, passing ResolvedAssertions, which
 	// use IDs directly rather than attempting to resolve idents, lookups, etc.
+	// Only facts that are missing or differ from the system schema are
+	// asserted, so upgrading does not duplicate existing schema facts.
 	assertions := make([]ResolvedAssertion, 0, 256)
-
-	// Allocate a transaction ID for the initial transaction, and assert the transaction timestamp fact.
-	var txID ID
-	var err error
-	for txID == 0 {
-		txID, err = conn.idManager.NextID()
+	for _, ent := range systemSchema {
+		if ent.Reserved {
+			continue
+		}
+		eid := ent.ID
+		current, err := db.systemFacts(eid)
 		if err != nil {
-			return fmt.Errorf("getting ID for initial transaction: %w", err)
+			return fmt.Errorf("reading system entity %s: %w", eid, err)
 		}
-	}
-
-	assertions = append(assertions, ResolvedAssertion{
-		Fact: Fact{
-			EntityID:  txID,
-			Attribute: IDTxCommitTime,
-			Value:     uint64(time.Now().Unix()),
-			Tx:        txID,
-		},
-		mode: AssertModeAddition,
-	})
-
-	// Add system schema.
-	schemaEntities := []map[ID]any{
-		{
-			IDIdent:       IDID,
-			IDType:        IDTypeInt64,
-			IDCardinality: IDCardinalityOne,
-			IDUnique:      true,
-			IDDoc:         "Entity ID",
-		},
-		{
-			IDIdent:       IDIdent,
-			IDType:        IDTypeRef,
-			IDCardinality: IDCardinalityOne,
-			IDUnique:      true,
-			IDDoc:         "Global ident. Should be applied to schema entities and global values like enum variants.",
-		},
-		{
-			IDIdent:       IDType,
-			IDType:        IDTypeRef,
-			IDCardinality: IDCardinalityOne,
-			IDDoc:         "Schema entity type",
-		},
-		// TODO: Add IDCompositeComponents schema entity.
-		{
-			IDIdent:       IDCardinality,
-			IDType:        IDTypeRef,
-			IDCardinality: IDCardinalityOne,
-			IDDoc:         "Cardinality of an attribute. Enumerated value: db.cardinality/one or db.cardinality/many",
-		},
-		{
-			IDIdent:       IDUnique,
-			IDType:        IDTypeBoolean,
-			IDCardinality: IDCardinalityOne,
-			IDDoc:         "Whether an attribute is unique. If true, only one entity may have a given value for the attribute.",
-		},
-		{
-			IDIdent:       IDIndexed,
-			IDType:        IDTypeBoolean,
-			IDCardinality: IDCardinalityOne,
-			IDDoc:         "Whether an attribute is indexed. If true, the attribute will be indexed in the AVET index.",
-		},
-		{
-			IDIdent:       IDDoc,
-			IDType:        IDTypeString,
-			IDCardinality: IDCardinalityOne,
-			IDDoc:         "Documentation for an attribute or entity.",
-		},
-		{
-			IDIdent:       IDTxCommitTime,
-			IDType:        IDTypeTimestamp,
-			IDCardinality: IDCardinalityOne,
-			IDDoc:         "Timestamp of the transaction commit.",
-		},
-		// Enum values.
-		{
-			IDIdent: IDCardinalityOne,
-		},
-		{
-			IDIdent: IDCardinalityMany,
-		},
-		{
-			IDIdent: IDTypeString,
-		},
-		{
-			IDIdent: IDTypeBoolean,
-		},
-		{
-			IDIdent: IDTypeInt64,
-		},
-		{
-			IDIdent: IDTypeInt32,
-		},
-		{
-			IDIdent: IDTypeInt16,
-		},
-		{
-			IDIdent: IDTypeInt8,
-		},
-		{
-			IDIdent: IDTypeFloat64,
-		},
-		{
-			IDIdent: IDTypeFloat32,
-		},
-		{
-			IDIdent: IDTypeDecimal,
-		},
-		{
-			IDIdent: IDTypeTimestamp,
-		},
-		{
-			IDIdent: IDTypeDate,
-		},
-		{
-			IDIdent: IDTypeRef,
-		},
-		{
-			IDIdent: IDTypeBinary,
-		},
-		{
-			IDIdent: IDTypeUUID,
-		},
-		{
-			IDIdent: IDTypeULID,
-		},
-		{
-			IDIdent: IDTypeComposite,
-		},
-	}
-
-	for _, entityData := range schemaEntities {
-		var eid ID
-		for key, val := range entityData {
-			if key == IDIdent {
-				eid = val.(ID)
-				break
+		for attr, value := range ent.facts() {
+			if val, ok := current[attr]; ok && ValueEqual(val, value) {
+				continue
 			}
-		}
-		for attr, value := range entityData {
 			assertions = append(assertions, ResolvedAssertion{
 				Fact: Fact{
 					EntityID:  eid,
 					Attribute: attr,
 					Value:     value,
-					Tx:        txID,
 				},
 				mode: AssertModeAddition,
 			})
 		}
 	}
 
-	if _, err := conn.assert(Database{}, assertions, nil); err != nil {
-		return fmt.Errorf("asserting initial data: %w", err)
+	// Version 9 replaced the boolean db/unique with an enumeration. Attributes
+	// that were unique become identity attributes, which behave as unique
+	// attributes did before.
+	if version > 0 && version < 9 {
+		migrated, err := db.migrateUniqueness()
+		if err != nil {
+			return fmt.Errorf("migrating db/unique: %w", err)
+		}
+		assertions = append(assertions, migrated...)
+	}
+
+	if _, err := conn.assert(assertions, nil, nil); err != nil {
+		return fmt.Errorf("asserting system schema: %w", err)
 	}
 
 	return nil
@@ -297,15 +419,23 @@ func (conn *Connection) ResolveIdents(idents []any) (ids []Ident, err error) {
 		if err != nil {
 			return nil, err
 		}
-		newIdents := make([]Ident, len(ids))
+		// A name may be an alias, so look up the canonical name for each ID.
+		canonicalNames, err := conn.identManager.LookupIdentNames(ids)
+		if err != nil {
+			return nil, err
+		}
+		newIdents := make([]Ident, 0, len(ids))
 		for idx, id := range ids {
 			name := unresolvedNames[idx]
 			outIdx := indexesNames[idx]
 			newIdent := Ident{
 				ID:   id,
-				Name: name,
+				Name: canonicalNames[idx],
+			}
+			newIdents = append(newIdents, newIdent)
+			if name != newIdent.Name {
+				newIdents = append(newIdents, Ident{ID: id, Name: name, Alias: true})
 			}
-			newIdents[idx] = newIdent
 			out[outIdx] = newIdent
 		}
 		// Cache the new idents
@@ -343,740 +473,403 @@ func ResolveIdent(conn *Connection, ident any) (Ident, error) {
 	return idents[0], nil
 }
 
-type TempIDs map[string]ID
-
-func (ids TempIDs) LookupTempID(tid tempID) (ID, bool) {
-	id, ok := ids[tid.symbol]
-	return id, ok
-}
-
-type AssertResult struct {
-	DB      Database
-	Data    []ResolvedAssertion
-	TempIDs TempIDs
-}
-
-func (conn *Connection) Assert(assertables ...Assertable) (*AssertResult, error) {
-	var assertions []Assertion
-
-	for _, a := range assertables {
-		newAssertions, err := a.Assertions(conn)
-		if err != nil {
-			return nil, fmt.Errorf("resolving facts for assertion: %w", err)
+// EnsureIdents returns the ID of the entity named by each ident, creating an
+// entity for every name that does not exist yet. The created entities have
+// only a db/ident, which suits enumerated values such as
+// appUser/type.customer that are referenced by name from ref attributes. They
+// are committed in a single transaction, so either all of them are created or
+// none are.
+func (conn *Connection) EnsureIdents(names ...string) ([]ID, error) {
+	var missing []Assertable
+	seen := make(map[string]struct{})
+	for _, name := range names {
+		if name == "" {
+			return nil, errors.New("ident name may not be empty")
+		}
+		_, err := ResolveIdent(conn, name)
+		switch {
+		case err == nil:
+			continue
+		case !errors.Is(err, ErrNoSuchIdent):
+			return nil, fmt.Errorf("resolving ident %q: %w", name, err)
+		}
+		if _, ok := seen[name]; ok {
+			continue
 		}
-		assertions = append(assertions, newAssertions...)
+		seen[name] = struct{}{}
+		missing = append(missing, EntityData{"db/ident": name})
 	}
-
-	// Return if any assertions have validation errors.
-	assertionErrors := util.Map(assertions, func(assertion Assertion) error {
-		return assertion.err
-	})
-	if err := errors.Join(assertionErrors...); err != nil {
-		return nil, fmt.Errorf("invalid assertions: %w", err)
+	if len(missing) > 0 {
+		if _, err := conn.Assert(missing...); err != nil {
+			return nil, fmt.Errorf("creating idents: %w", err)
+		}
 	}
 
-	// Create a map of tempID symbols to their resolved IDs.
-	tempIDs := make(TempIDs)
-
-	// Append assertions for transaction.
-	// Create a transaction entity, using a tempID with a well-known symbol.
-	tempIDs["txid"] = unresolvedEntityID // TODO: ensure that tx ids are monotonically increasing, regardless of which instance assigned them.
-	assertions = append(assertions, Assertion{
-		entityID:  tempID{symbol: "txid"},
-		attribute: "db.tx/commitTime",
-		value:     uint64(time.Now().Unix()), // TODO: Get time from database.
-	})
-	isIDConflict := func(sym string, newID ID) bool {
-		resolvedID, ok := tempIDs[sym]
-		return ok &&
-			resolvedID != unresolvedEntityID &&
-			resolvedID != newID
+	ids := make([]ID, len(names))
+	for i, name := range names {
+		ident, err := ResolveIdent(conn, name)
+		if err != nil {
+			return nil, fmt.Errorf("resolving ident %q: %w", name, err)
+		}
+		ids[i] = ident.ID
 	}
+	return ids, nil
+}
 
-	// First pass:
-	// 1. Collect tempIDs in the ID and Value positions.
-	// 2. Resolve lookups in the Value position.
-	// 3. Resolve idents in all positions.
-	for idx := range assertions {
-		assertion := &assertions[idx]
-
-		/////////////////
-		// Attribute Resolution
-
-		// Resolve Attribute to an ID.
+// allocateIdents allocates IDs for every ident that is the value of a db/ident
+// assertion but is neither known to the connection nor already staged. All such
+// idents are allocated in a single batch and added to staged, which is keyed by
+// name. Staged idents are stored along with the transaction that stages them.
+func (conn *Connection) allocateIdents(assertions []Assertion, staged map[string]Ident) error {
+	var names []string
+	seen := make(map[string]struct{})
+	for _, assertion := range assertions {
+		if assertion.mode != AssertModeAddition {
+			continue
+		}
 		attribute, err := ResolveIdent(conn, assertion.attribute)
-		if err != nil {
-			return nil, err
+		if err != nil || attribute.ID != IDIdent {
+			// Unresolvable attributes are reported by the first pass.
+			continue
 		}
-		assertion.attribute = attribute.ID
-
-		/////////////////
-		// Value Resolution
-
-		// Get schema ident. Value resolution is dependent on the type that the
-		// attributes refers to.
-		schemaEntity, err := conn.getSchemaEntity(attribute.ID)
-		if err != nil {
-			return nil, fmt.Errorf("fetching attribute schema: %w", err)
+		name := identName(assertion.value)
+		if name == "" {
+			continue
 		}
-		var valueTypeID ID
-		valueType, err := schemaEntity.Get(conn, IDType)
-		switch err {
-		case nil:
-			valueTypeID = valueType.(ID)
-		case ErrPropertyNotFound:
-			return nil, fmt.Errorf("attribute entity %d is not a schema entity", attribute.ID)
-		default:
-			return nil, err
+		if _, ok := seen[name]; ok {
+			continue
 		}
+		if _, ok := staged[name]; ok {
+			continue
+		}
+		if _, ok := conn.identCache.lookupByName(name); ok {
+			continue
+		}
+		if strings.HasPrefix(name, "db/") {
+			// Reserved names are rejected during resolution.
+			continue
+		}
+		seen[name] = struct{}{}
+		names = append(names, name)
+	}
+	if len(names) == 0 {
+		return nil
+	}
 
-		// Resolve value based on attribute type.
-		// TODO: Extract this to a function.
-		switch valueTypeID {
-		case IDTypeRef:
-			if asStr, ok := assertion.value.(string); ok {
-				assertion.value = Ident{Name: asStr}
-			}
-
-			switch v := assertion.value.(type) {
-			case ID:
-				// Nothing to do - value is already an ID.
-			case tempID:
-				// Add to tempIDs map if not already present.
-				if _, ok := tempIDs[v.symbol]; !ok {
-					tempIDs[v.symbol] = unresolvedEntityID
-				}
-			default:
-				// Resolve lookups and idents in the Value position.
-				asResolver, ok := assertion.value.(Resolver)
-				if !ok {
-					return nil, fmt.Errorf("value for ref attribute %q must resolve to an ID", attribute.Name)
-				}
-				resolvedID, err := asResolver.Resolve(conn)
-				if err != nil {
-					// Special case: if this is an id/ident we have not yet
-					// seen, we can allocate a new ID for the ident. The
-					// subsequent EntityID resolution pass will resolve the
-					// tempID for all attributes in this entity to the new ID.
-					if attribute.ID == IDIdent && errors.Is(err, ErrNoSuchIdent) {
-						// Safety: only a resolver for an Ident can return ErrNoSuchIdent.
-						id, err := conn.idManager.NextID()
-						if err != nil {
-							return nil, fmt.Errorf("allocating new ID for db/ident: %w", err)
-						}
-						resolvedID = id
-						asIdent := assertion.value.(Ident)
-						asIdent.ID = id
-						conn.identManager.StoreIdent(asIdent)
-					} else {
-						return nil, fmt.Errorf("resolving value of ref attribute %q: %w", attribute.Name, err)
-					}
-				}
-				assertion.value = resolvedID
-			}
-
-		case IDTypeString:
-			switch v := assertion.value.(type) {
-			case string:
-				// Nothing to do - value is already a string.
-			case []byte:
-				assertion.value = string(v)
-			default:
-				return nil, fmt.Errorf("value for string attribute %q is not assignable to a string", attribute.Name)
-			}
-
-		case IDTypeInt64:
-			switch v := assertion.value.(type) {
-			case int64:
-				// Nothing to do - value is already an int64.
-			case uint64:
-				assertion.value = int64(v)
-			case int:
-				assertion.value = int64(v)
-			case uint:
-				assertion.value = int64(v)
-			case int32:
-				assertion.value = int64(v)
-			case uint32:
-				assertion.value = int64(v)
-			case int16:
-				assertion.value = int64(v)
-			case uint16:
-				assertion.value = int64(v)
-			case int8:
-				assertion.value = int64(v)
-			case uint8:
-				assertion.value = int64(v)
-			default:
-				return nil, fmt.Errorf("value for int64 attribute %q is not assignable to an int64", attribute.Name)
-			}
-
-		case IDTypeInt32:
-			switch v := assertion.value.(type) {
-			case int64:
-				if v > math.MaxInt32 || v < math.MinInt32 {
-					return nil, fmt.Errorf("value for int32 attribute %q is out of range", attribute.Name)
-				}
-				assertion.value = int32(v)
-			case uint64:
-				if v > math.MaxInt32 {
-					return nil, fmt.Errorf("value for int32 attribute %q is out of range", attribute.Name)
-				}
-				assertion.value = int32(v)
-			case int:
-				if v > math.MaxInt32 || v < math.MinInt32 {
-					return nil, fmt.Errorf("value for int32 attribute %q is out of range", attribute.Name)
-				}
-				assertion.value = int32(v)
-			case uint:
-				if v > math.MaxInt32 {
-					return nil, fmt.Errorf("value for int32 attribute %q is out of range", attribute.Name)
-				}
-				assertion.value = int32(v)
-			case int32:
-				// Nothing to do - value is already an int32.
-			case uint32:
-				if v > math.MaxInt32 {
-					return nil, fmt.Errorf("value for int32 attribute %q is out of range", attribute.Name)
-				}
-				assertion.value = int32(v)
-			case int16:
-				assertion.value = int32(v)
-			case uint16:
-				assertion.value = int32(v)
-			case int8:
-				assertion.value = int32(v)
-			case uint8:
-				assertion.value = int32(v)
-			default:
-				return nil, fmt.Errorf("value for int32 attribute %q is not assignable to an int32", attribute.Name)
-			}
-
-		case IDTypeInt16:
-			switch v := assertion.value.(type) {
-			case int64:
-				if v > math.MaxInt16 || v < math.MinInt16 {
-					return nil, fmt.Errorf("value for int16 attribute %q is out of range", attribute.Name)
-				}
-				assertion.value = int16(v)
-			case uint64:
-				if v > math.MaxInt16 {
-					return nil, fmt.Errorf("value for int16 attribute %q is out of range", attribute.Name)
-				}
-				assertion.value = int16(v)
-			case int:
-				if v > math.MaxInt16 || v < math.MinInt16 {
-					return nil, fmt.Errorf("value for int16 attribute %q is out of range", attribute.Name)
-				}
-				assertion.value = int16(v)
-			case uint:
-				if v > math.MaxInt16 {
-					return nil, fmt.Errorf("value for int16 attribute %q is out of range", attribute.Name)
-				}
-				assertion.value = int16(v)
-			case int32:
-				if v > math.MaxInt16 || v < math.MinInt16 {
-					return nil, fmt.Errorf("value for int16 attribute %q is out of range", attribute.Name)
-				}
-				assertion.value = int16(v)
-			case uint32:
-				if v > math.MaxInt16 {
-					return nil, fmt.Errorf("value for int16 attribute %q is out of range", attribute.Name)
-				}
-				assertion.value = int16(v)
-			case int16:
-				// Nothing to do - value is already an int16.
-			case uint16:
-				if v > math.MaxInt16 {
-					return nil, fmt.Errorf("value for int16 attribute %q is out of range", attribute.Name)
-				}
-				assertion.value = int16(v)
-			case int8:
-				assertion.value = int16(v)
-			case uint8:
-				assertion.value = int16(v)
-			default:
-				return nil, fmt.Errorf("value for int16 attribute %q is not assignable to an int16", attribute.Name)
-			}
-
-		case IDTypeInt8:
-			switch v := assertion.value.(type) {
-			case int64:
-				if v > math.MaxInt8 || v < math.MinInt8 {
-					return nil, fmt.Errorf("value for int8 attribute %q is out of range", attribute.Name)
-				}
-				assertion.value = int8(v)
-			case uint64:
-				if v > math.MaxInt8 {
-					return nil, fmt.Errorf("value for int8 attribute %q is out of range", attribute.Name)
-				}
-				assertion.value = int8(v)
-			case int:
-				if v > math.MaxInt8 || v < math.MinInt8 {
-					return nil, fmt.Errorf("value for int8 attribute %q is out of range", attribute.Name)
-				}
-				assertion.value = int8(v)
-			case uint:
-				if v > math.MaxInt8 {
-					return nil, fmt.Errorf("value for int8 attribute %q is out of range", attribute.Name)
-				}
-				assertion.value = int8(v)
-			case int32:
-				if v > math.MaxInt8 || v < math.MinInt8 {
-					return nil, fmt.Errorf("value for int8 attribute %q is out of range", attribute.Name)
-				}
-				assertion.value = int8(v)
-			case uint32:
-				if v > math.MaxInt8 {
-					return nil, fmt.Errorf("value for int8 attribute %q is out of range", attribute.Name)
-				}
-				assertion.value = int8(v)
-			case int16:
-				if v > math.MaxInt8 || v < math.MinInt8 {
-					return nil, fmt.Errorf("value for int8 attribute %q is out of range", attribute.Name)
-				}
-				assertion.value = int8(v)
-			case uint16:
-				if v > math.MaxInt8 {
-					return nil, fmt.Errorf("value for int8 attribute %q is out of range", attribute.Name)
-				}
-				assertion.value = int8(v)
-			case int8:
-				// Nothing to do - value is already an int8.
-			case uint8:
-				if v > math.MaxInt8 {
-					return nil, fmt.Errorf("value for int8 attribute %q is out of range", attribute.Name)
-				}
-				assertion.value = int8(v)
-
-			default:
-				return nil, fmt.Errorf("value for int8 attribute %q is not assignable to an int8", attribute.Name)
-			}
-
-		case IDTypeBoolean:
-			switch assertion.value.(type) {
-			case bool:
-				// Nothing to do - value is already a bool.
-			default:
-				return nil, fmt.Errorf("value for boolean attribute %q is not assignable to a bool", attribute.Name)
-			}
-
-		case IDTypeFloat64:
-			switch v := assertion.value.(type) {
-			case float64:
-				// Nothing to do - value is already a float64.
-			case float32:
-				assertion.value = float64(v)
-			case int64:
-				assertion.value = float64(v)
-			case uint64:
-				assertion.value = float64(v)
-			case int:
-				assertion.value = float64(v)
-			case uint:
-				assertion.value = float64(v)
-			case int32:
-				assertion.value = float64(v)
-			case uint32:
-				assertion.value = float64(v)
-			case int16:
-				assertion.value = float64(v)
-			case uint16:
-				assertion.value = float64(v)
-			case int8:
-				assertion.value = float64(v)
-			case uint8:
-				assertion.value = float64(v)
-			default:
-				return nil, fmt.Errorf("value for float64 attribute %q is not assignable to a float64", attribute.Name)
-			}
-
-		case IDTypeFloat32:
-			switch v := assertion.value.(type) {
-			case float64:
-				if v > math.MaxFloat32 || v < -math.MaxFloat32 {
-					return nil, fmt.Errorf("value for float32 attribute %q is out of range", attribute.Name)
-				}
-				assertion.value = float32(v)
-			case float32:
-				// Nothing to do - value is already a float32.
-			case int64:
-				assertion.value = float32(v)
-			case uint64:
-				assertion.value = float32(v)
-			case int:
-				assertion.value = float32(v)
-			case uint:
-				assertion.value = float32(v)
-			case int32:
-				assertion.value = float32(v)
-			case uint32:
-				assertion.value = float32(v)
-			case int16:
-				assertion.value = float32(v)
-			case uint16:
-				assertion.value = float32(v)
-			case int8:
-				assertion.value = float32(v)
-			case uint8:
-				assertion.value = float32(v)
-			default:
-				return nil, fmt.Errorf("value for float32 attribute %q is not assignable to a float32", attribute.Name)
-			}
-
-		case IDTypeTimestamp:
-			switch v := assertion.value.(type) {
-			case time.Time:
-				// Nothing to do - value is already a time.Time.
-			case int64:
-				assertion.value = time.Unix(v, 0)
-			case uint64:
-				assertion.value = time.Unix(int64(v), 0)
-			case int:
-				assertion.value = time.Unix(int64(v), 0)
-			case uint:
-				assertion.value = time.Unix(int64(v), 0)
-			case int32:
-				assertion.value = time.Unix(int64(v), 0)
-			case uint32:
-				assertion.value = time.Unix(int64(v), 0)
-			case int16:
-				assertion.value = time.Unix(int64(v), 0)
-			case uint16:
-				assertion.value = time.Unix(int64(v), 0)
-			case int8:
-				assertion.value = time.Unix(int64(v), 0)
-			case uint8:
-				assertion.value = time.Unix(int64(v), 0)
-			case string:
-				t, err := time.Parse(time.RFC3339, v)
-				if err != nil {
-					return nil, fmt.Errorf("value for timestamp attribute %q is not a valid RFC3339 string", attribute.Name)
-				}
-				assertion.value = t
-			default:
-				return nil, fmt.Errorf("value for timestamp attribute %q is not assignable to a time.Time", attribute.Name)
-			}
+	var idents []Ident
+	err := conn.retryPolicy.Do("allocating idents", func() (err error) {
+		idents, err = conn.identManager.AllocateIdents(names)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("allocating idents: %w", err)
+	}
+	for _, ident := range idents {
+		if err := guardUserPartition(ident.ID); err != nil {
+			return fmt.Errorf("allocating ident %q: %w", ident.Name, err)
+		}
+		staged[ident.Name] = ident
+	}
+	return nil
+}
 
-		case IDTypeDate:
-			var t time.Time
-			switch v := assertion.value.(type) {
-			case time.Time:
-				// Nothing to do - value is already a time.Time.
-			case int64:
-				t = time.Unix(v, 0)
-			case uint64:
-				t = time.Unix(int64(v), 0)
-			case int:
-				t = time.Unix(int64(v), 0)
-			case uint:
-				t = time.Unix(int64(v), 0)
-			case int32:
-				t = time.Unix(int64(v), 0)
-			case uint32:
-				t = time.Unix(int64(v), 0)
-			case int16:
-				t = time.Unix(int64(v), 0)
-			case uint16:
-				t = time.Unix(int64(v), 0)
-			case int8:
-				t = time.Unix(int64(v), 0)
-			case uint8:
-				t = time.Unix(int64(v), 0)
-			case string:
-				parsedTime, err := time.Parse("2006-01-02", v)
-				if err != nil {
-					return nil, fmt.Errorf("value for date attribute %q is not a valid date string (YYYY-MM-DD)", attribute.Name)
-				}
-				t = parsedTime
-			default:
-				return nil, fmt.Errorf("value for date attribute %q is not assignable to a time.Time", attribute.Name)
-			}
-			assertion.value = t.UTC().Truncate(24 * time.Hour)
-
-		case IDTypeBinary:
-			switch v := assertion.value.(type) {
-			case []byte:
-				// Nothing to do - value is already a []byte.
-			case string:
-				assertion.value = []byte(v)
-			default:
-				return nil, fmt.Errorf("value for binary attribute %q is not assignable to a []byte", attribute.Name)
-			}
+// identName returns the name of an ident that has not been resolved to an ID,
+// or the empty string if ident is not an unresolved name.
+func identName(ident any) string {
+	switch v := ident.(type) {
+	case string:
+		return v
+	case Ident:
+		if v.ID == 0 {
+			return v.Name
+		}
+	}
+	return ""
+}
 
-		case IDTypeDecimal:
-			panic("TODO: decimal type not implemented")
+type TempIDs map[string]ID
 
-		case IDTypeComposite:
-			panic("TODO: composite type not implemented")
+func (ids TempIDs) LookupTempID(tid tempID) (ID, bool) {
+	id, ok := ids[tid.symbol]
+	return id, ok
+}
 
-		case IDTypeUUID:
-			switch v := assertion.value.(type) {
-			case uuid.UUID:
-				// Nothing to do - value is already a uuid.UUID.
-			case string:
-				parsedUUID, err := uuid.FromString(v)
-				if err != nil {
-					return nil, fmt.Errorf("value for uuid attribute %q is not a valid uuid string", attribute.Name)
-				}
-				assertion.value = parsedUUID
-			case []byte:
-				parsedUUID, err := uuid.FromBytes(v)
-				if err != nil {
-					return nil, fmt.Errorf("value for uuid attribute %q is not a valid uuid byte slice", attribute.Name)
-				}
-				assertion.value = parsedUUID
-			default:
-				return nil, fmt.Errorf("value for uuid attribute %q is not assignable to a uuid.UUID", attribute.Name)
-			}
+type AssertResult struct {
+	DB      Database
+	Data    []ResolvedAssertion
+	TempIDs TempIDs
+	// Names maps the name of every NamedTempID used in the transaction to
+	// its resolved ID.
+	Names map[string]ID
+
+	tx Tx
+	// newEntities holds the IDs allocated for tempIDs that did not resolve to
+	// an existing entity, in ascending order.
+	newEntities []ID
+}
 
-		case IDTypeULID:
-			switch v := assertion.value.(type) {
-			case ulid.ULID:
-				// Nothing to do - value is already a ulid.ULID.
-			case string:
-				parsedULID, err := ulid.Parse(v)
-				if err != nil {
-					return nil, fmt.Errorf("value for ulid attribute %q is not a valid ulid string", attribute.Name)
-				}
-				assertion.value = parsedULID
-			default:
-				return nil, fmt.Errorf("value for ulid attribute %q is not assignable to a ulid.ULID", attribute.Name)
-			}
+// ResolvedID returns the ID that tid resolved to in the transaction. It
+// reports false if tid was not used in the transaction.
+func (res *AssertResult) ResolvedID(tid tempID) (ID, bool) {
+	if tid.validate() != nil {
+		// Invalid names could not have been used, but "txid" would find
+		// the transaction entity.
+		return 0, false
+	}
+	return res.TempIDs.LookupTempID(tid)
+}
 
-		default:
-			panic(fmt.Sprintf("unhandled attribute type: %s", valueTypeID))
-		}
+// TxID returns the ID of the transaction entity.
+func (res *AssertResult) TxID() ID {
+	return res.TempIDs[txTempIDSymbol]
+}
 
-		/////////////////
-		// ID Resolution
+// Tx returns the transaction entity, including its commit time and any other
+// facts that the transaction asserted about itself.
+func (res *AssertResult) Tx() Tx {
+	return res.tx
+}
 
-		// Mark tempIDs for resolution, and resolve idents and lookups.
-		switch v := assertion.entityID.(type) {
-		case ID:
-			// Already resolved.
+// NewEntities returns the IDs of the entities created by the transaction, in
+// ascending order. Tempids that resolved to existing entities, e.g. through a
+// unique attribute, and the transaction entity itself are not included.
+func (res *AssertResult) NewEntities() []ID {
+	return res.newEntities
+}
 
-		case tempID:
-			// Special cases for ID resolution of tempIDs.
-			switch assertion.attribute {
-			case IDID:
-				// ID was specified as db/id.
-				id, ok := assertion.value.(ID)
-				if !ok {
-					return nil, fmt.Errorf("value for db/id must resolve to an ID")
-				}
-				scan, err := conn.indexer.ScanEAVT(attribute.ID, &id)
-				if err != nil {
-					return nil, fmt.Errorf("scanning for existing entity with db/id %d: %w", id, err)
-				}
-				facts, err := dataflow.CollectIntoSlice(dataflow.NewContext(context.Background()), scan)
-				if err != nil {
-					return nil, fmt.Errorf("scanning for existing entity with db/id %d: %w", id, err)
-				}
-				if len(facts) == 0 {
-					return nil, fmt.Errorf("no entity found with db/id %d", id)
-				}
-				if isIDConflict(v.symbol, id) {
-					return nil, errors.Join(
-						fmt.Errorf("db/id %d conflicts with an already-resolved ID for tempid %q", id, v.symbol),
-						ErrConflict,
-					)
-				}
-				tempIDs[v.symbol] = id
-
-			case IDIdent:
-				// ID was allocated on the first pass through the assertions.
-				id := assertion.value.(ID)
-				if isIDConflict(v.symbol, id) {
-					return nil, errors.Join(
-						fmt.Errorf("db/ident %q conflicts with an already-resolved ID for tempid %s", assertion.value, v.symbol),
-						ErrConflict,
-					)
-				}
-				tempIDs[v.symbol] = id
+// Assert resolves and commits the assertions produced by the assertables as a
+// single transaction. The transaction is atomic: any idents that it introduces
+// via db/ident are committed together with its facts, and if the transaction
+// fails, none of its facts or new idents are stored. Transactions submitted
+// through Assert may not modify entities in the system partition.
+func (conn *Connection) Assert(assertables ...Assertable) (*AssertResult, error) {
+	return conn.transact(false, assertables...)
+}
 
-			default:
-				// If unique attribute, resolve to an ID.
-				isUnique, err := schemaEntity.Get(conn, IDUnique)
-				if err != nil && !errors.Is(err, ErrPropertyNotFound) {
-					return nil, fmt.Errorf("fetching attribute schema: %w", err)
-				}
-				if isUnique != nil && isUnique.(bool) {
-					id, err := NewLookup(attribute.Name, assertion.value).Resolve(conn)
-					switch err {
-					case nil:
-						if isIDConflict(v.symbol, id) {
-							return nil, errors.Join(
-								fmt.Errorf("unique attribute %q conflicts with an already-resolved ID for tempid %q", attribute.Name, v.symbol),
-								ErrConflict,
-							)
-						}
-						tempIDs[v.symbol] = id
-					case ErrNoSuchEntity:
-						// This is fine - we will create a new entity.
-					default:
-						return nil, fmt.Errorf("resolving lookup: %w", err)
-					}
-				}
+// AlterSystemSchema is like Assert, except that the transaction may modify the
+// built-in schema entities in the system partition. It is intended for
+// migrations of the system schema and should not be used for application data.
+func (conn *Connection) AlterSystemSchema(assertables ...Assertable) (*AssertResult, error) {
+	return conn.transact(true, assertables...)
+}
 
-				// HAPPY PATH:
-				// Add to tempIDs map if not already present.
-				if _, ok := tempIDs[v.symbol]; !ok {
-					tempIDs[v.symbol] = unresolvedEntityID
-				}
-			}
+// AssertDryRun resolves and validates the assertions produced by the
+// assertables exactly as Assert would, including uniqueness, composite, and
+// namespace checks, but does not commit them. The result holds the facts that
+// the transaction would write and the IDs that its tempIDs would resolve to,
+// and its DB is the unchanged database that the transaction was checked
+// against. IDs allocated for new entities are not reserved, so a transaction
+// that is later committed may allocate different ones.
+func (conn *Connection) AssertDryRun(assertables ...Assertable) (*AssertResult, error) {
+	tx := conn.newTx(false)
+	tx.dryRun = true
+	if err := tx.Add(assertables...); err != nil {
+		return nil, err
+	}
+	return tx.Commit()
+}
 
-		case string:
-			// Assume the string is an ident name, and resolve it.
-			ident, err := ResolveIdent(conn, v)
-			if err != nil {
-				return nil, err
-			}
-			assertion.entityID = ident.ID
-		}
+func (conn *Connection) transact(allowSystem bool, assertables ...Assertable) (*AssertResult, error) {
+	tx := conn.newTx(allowSystem)
+	if err := tx.Add(assertables...); err != nil {
+		return nil, err
 	}
+	return tx.Commit()
+}
 
-	// Allocate ids for tempIDs.
-	for symbol, id := range tempIDs {
-		if id != unresolvedEntityID {
-			// Was already set via db/id, db/ident, or unique attribute.
-			continue
-		}
+// assert writes resolved assertions to storage. Each precondition is checked
+// against the latest database before the assertions are written, and the
+// transaction fails if any precondition returns an error.
+func (conn *Connection) assert(assertions []ResolvedAssertion, newIdents []Ident, resolvedIDs TempIDs, preconditions ...precondition) (*AssertResult, error) {
+	if err := conn.lifecycle.begin(); err != nil {
+		return nil, err
+	}
+	defer conn.lifecycle.end()
+	if conn.transactor != nil {
+		return conn.forward(assertions, newIdents, resolvedIDs, preconditions)
+	}
 
-		newID, err := conn.idManager.NextID()
-		if err != nil {
-			return nil, fmt.Errorf("allocating ID for tempID %q: %w", symbol, err)
+	// Writes are serialized so that no transaction can commit between the
+	// check of a precondition and the write that depends on it, and so that
+	// transaction IDs and commit times follow the order of writes.
+	conn.writeMu.Lock()
+	for _, check := range preconditions {
+		if err := check(conn.DB()); err != nil {
+			conn.writeMu.Unlock()
+			return nil, err
 		}
-		tempIDs[symbol] = newID
 	}
+	assertions, err := conn.stampTx(assertions, resolvedIDs)
+	if err != nil {
+		conn.writeMu.Unlock()
+		return nil, err
+	}
+	err = conn.retryPolicy.Do("writing assertions", func() error {
+		return conn.indexer.Write(assertions, newIdents)
+	})
+	if err != nil {
+		conn.writeMu.Unlock()
+		return nil, fmt.Errorf("writing assertions: %w", err)
+	}
+	txID := conn.observeTx(assertions, newIdents)
+	db := conn.DB()
+	conn.reportMu.Lock()
+	conn.writeMu.Unlock()
+
+	conn.reportTx(TxReport{
+		Tx:      txID,
+		DBAfter: db.AsOf(txID),
+		TxData:  assertions,
+		TempIDs: resolvedIDs,
+	})
 
-	// Second pass: Replace tempIDs with resolved IDs, and populate ResolvedAssertions.
-	resolved := make([]ResolvedAssertion, len(assertions))
-	for idx, assertion := range assertions {
-		ra := ResolvedAssertion{
-			Fact: Fact{
-				Attribute: assertion.attribute.(ID),
-				Tx:        tempIDs["txid"],
-			},
-			mode: assertion.mode,
-		}
+	return &AssertResult{
+		DB:      db,
+		Data:    assertions,
+		TempIDs: resolvedIDs,
+	}, nil
+}
 
-		switch v := assertion.entityID.(type) {
-		case ID:
-			ra.Fact.EntityID = v
-		case tempID:
-			ra.Fact.EntityID = tempIDs[v.symbol]
-		default:
-			panic(fmt.Sprintf("unhandled entityID type: %T", assertion.entityID))
-		}
+// checkAssert checks the preconditions of resolved assertions against the
+// latest database without writing them, for a dry run of a transaction.
+func (conn *Connection) checkAssert(assertions []ResolvedAssertion, resolvedIDs TempIDs, preconditions ...precondition) (*AssertResult, error) {
+	if err := conn.lifecycle.begin(); err != nil {
+		return nil, err
+	}
+	defer conn.lifecycle.end()
 
-		if asTmpID, ok := assertion.value.(tempID); ok {
-			ra.Value = tempIDs[asTmpID.symbol]
-		} else {
-			ra.Value = assertion.value
+	db := conn.DB()
+	for _, check := range preconditions {
+		if err := check(db); err != nil {
+			return nil, err
 		}
-
-		resolved[idx] = ra
 	}
-
-	// XXX: Get an actual database value. This should be used to determine the
-	// basis of the
-	db := Database{}
-	return conn.assert(db, resolved, tempIDs)
-}
-
-func (conn *Connection) assert(db Database, assertions []ResolvedAssertion, resolvedIDs TempIDs) (*AssertResult, error) {
-	err := conn.indexer.Write(assertions)
+	assertions, err := conn.stampTx(assertions, resolvedIDs)
 	if err != nil {
-		return nil, fmt.Errorf("writing assertions: %w", err)
+		return nil, err
 	}
-
 	return &AssertResult{
-		// XXX: Get db tx basis.
 		DB:      db,
 		Data:    assertions,
 		TempIDs: resolvedIDs,
 	}, nil
 }
 
-func (conn *Connection) GetEntity(idResolver Resolver) (Entity, error) {
-	eid, err := idResolver.Resolve(conn)
-	if err != nil {
-		return Entity{}, fmt.Errorf("resolving entity ID: %w", err)
+// stampTx allocates the ID and commit time of a transaction that is about to
+// be written. It sets the transaction of every resolved assertion, adds the
+// commit time and the Merkle root of the transaction's facts, and records the
+// ID under the transaction's tempID. Writers call it with writeMu held, so
+// transaction IDs and commit times both increase in the order that
+// transactions are written.
+func (conn *Connection) stampTx(assertions []ResolvedAssertion, resolvedIDs TempIDs) ([]ResolvedAssertion, error) {
+	var txID ID
+	err := conn.retryPolicy.Do("allocating ID", func() (err error) {
+		txID, err = conn.idManager.NextID()
+		return err
+	})
+	if err == nil {
+		// See NOTE [ENTITY-PARTITIONS].
+		err = guardPartition(txID, 0)
 	}
-	// TODO: cache entities
-	ent := Entity{
-		eid:   eid,
-		state: make(map[ID]Value),
+	if err != nil {
+		return nil, fmt.Errorf("allocating transaction ID: %w", err)
 	}
-	scan, err := conn.indexer.ScanEAVT(eid, nil)
+	commitTime, err := conn.nextCommitTime()
 	if err != nil {
-		return ent, fmt.Errorf("scanning EAVT index: %v", err)
+		return nil, err
 	}
-	if err := scan.Produce(dataflow.NewContext(context.Background()), func(dc dataflow.DataflowCtx, fct *Fact) error {
-		if fct == nil {
-			return nil
-		}
-		attrEntity, err := conn.getSchemaEntity(fct.Attribute)
-		if err != nil {
-			return fmt.Errorf("fetching attribute schema: %w", err)
-		}
-		attrCardinality, err := attrEntity.Get(conn, IDCardinality)
-		if err != nil {
-			panic("error fetching attribute cardinality: " + err.Error())
-		}
-
-		val := fct.Value
-		if attrCardinality == IDCardinalityMany {
-			vals, ok := ent.state[fct.Attribute]
-			if !ok {
-				vals = make([]Value, 0, 1)
-			}
-			ent.state[fct.Attribute] = append(vals.([]Value), val)
-		} else {
-			ent.state[fct.Attribute] = val
-		}
-		if fct.Tx > ent.basisID {
-			ent.basisID = fct.Tx
-		}
 
-		return nil
-	}); err != nil {
-		return ent, err
+	stamped := make([]ResolvedAssertion, len(assertions), len(assertions)+2)
+	for i, ra := range assertions {
+		ra.Tx = txID
+		stamped[i] = ra
 	}
-
-	return ent, nil
+	stamped = append(stamped, ResolvedAssertion{
+		Fact: Fact{
+			EntityID:  txID,
+			Attribute: IDTxCommitTime,
+			Value:     commitTime,
+			Tx:        txID,
+		},
+		mode: AssertModeAddition,
+	})
+	if resolvedIDs != nil {
+		resolvedIDs[txTempIDSymbol] = txID
+	}
+	return withTxRoot(stamped)
 }
 
-// getSchemaEntity resolves a schema identity. This is a special case of
-// GetEntity that assumes the argument passed in is an already-resolved ID
-// pointing to a schema entity (attribute or ident). It also omits the attribute
-// type lookup, since schema entities do not have db.cardinality/many (for now)
-// attributes, looking up a schema entity for each attribute type would cause a
-// recursive loop.
-func (conn *Connection) getSchemaEntity(attrID ID) (Entity, error) {
-	if ent, ok := conn.schemaEntityCache[attrID]; ok {
-		return ent, nil
+// observeTx updates the connection's caches and basis to reflect a committed
+// transaction and returns the transaction's ID.
+func (conn *Connection) observeTx(assertions []ResolvedAssertion, newIdents []Ident) ID {
+	// Staged idents only become visible once they have been committed.
+	conn.identCache.store(newIdents)
+	conn.invalidateSchema(assertions)
+	conn.entityCache.invalidate(assertions)
+	conn.attrStats.observe(assertions)
+	conn.composites.observe(assertions)
+
+	var txID ID
+	if len(assertions) > 0 {
+		txID = assertions[0].Tx
+		conn.advanceBasis(txID)
 	}
+	return txID
+}
 
-	ent := Entity{
-		eid:   attrID,
-		state: make(map[ID]Value),
+// invalidateSchema evicts every cached schema entity that was modified by the
+// assertions.
+func (conn *Connection) invalidateSchema(assertions []ResolvedAssertion) {
+	conn.schemaMu.Lock()
+	defer conn.schemaMu.Unlock()
+	for _, assertion := range assertions {
+		delete(conn.schemaEntityCache, assertion.EntityID)
 	}
-	scan, err := conn.indexer.ScanEAVT(attrID, nil)
-	if err != nil {
-		return ent, fmt.Errorf("scanning EAVT index: %v", err)
+	conn.schemaGen++
+}
+
+// DB returns a view of the database that includes all facts.
+func (conn *Connection) DB() Database {
+	return Database{
+		Basis: Tx{eid: ID(conn.basis.Load())},
+		conn:  conn,
 	}
-	if err := scan.Produce(dataflow.NewContext(context.Background()), func(dc dataflow.DataflowCtx, fct *Fact) error {
-		if fct != nil {
-			ent.state[fct.Attribute] = fct.Value
+}
+
+// advanceBasis records txID as the latest committed transaction unless a later
+// one has already been recorded.
+func (conn *Connection) advanceBasis(txID ID) {
+	for {
+		cur := conn.basis.Load()
+		if int64(txID) <= cur {
+			return
+		}
+		if conn.basis.CompareAndSwap(cur, int64(txID)) {
+			conn.basisChanged.notify()
+			return
 		}
-		return nil
-	}); err != nil {
-		return ent, err
 	}
+}
+
+func (conn *Connection) GetEntity(idResolver Resolver, opts ...ReadOpts) (Entity, error) {
+	return conn.DB().GetEntity(idResolver, opts...)
+}
 
-	conn.schemaEntityCache[attrID] = ent
+// GetEntities fetches several entities in bulk. See Database.GetEntities.
+func (conn *Connection) GetEntities(ids []ID) ([]Entity, error) {
+	return conn.DB().GetEntities(ids)
+}
+
+// cardinalityOf returns the cardinality of an attribute, defaulting to
+// db.cardinality/one when the schema does not specify one.
+func (conn *Connection) cardinalityOf(attrID ID) (ID, error) {
+	return conn.DB().cardinalityOf(attrID)
+}
 
-	return ent, nil
+func (db Database) cardinalityOf(attrID ID) (ID, error) {
+	schema, err := db.schemaFor(attrID)
+	if err != nil {
+		return 0, err
+	}
+	return schema.Cardinality, nil
 }
@@ -17,11 +17,30 @@ limitations under the License.
 package store_test
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/dgraph-io/badger/v4"
+	"github.com/gofrs/uuid/v5"
 	"github.com/kendru/canter/internal/store"
 	badgerImpl "github.com/kendru/canter/internal/store/badger"
+	"github.com/kendru/canter/pkg/dataflow"
+	"github.com/kendru/canter/pkg/rtype"
+	"github.com/oklog/ulid/v2"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -157,11 +176,72 @@ func TestAssert(t *testing.T) {
 	assert.Equal(t, store.EntityData{
 		"db/ident":       store.Ident{Name: "person/email"}.MustResolve(conn),
 		"db/type":        store.Ident{Name: "db.type/string"}.MustResolve(conn),
-		"db/unique":      true,
+		"db/unique":      store.IDUniqueIdentity,
 		"db/cardinality": store.Ident{Name: "db.cardinality/one"}.MustResolve(conn),
 	}, data)
 }
 
+func TestAssertReadRoundTrip(t *testing.T) {
+	// Property: reading back an entity yields exactly the data submitted.
+	conn := newMemoryConnection()
+	_, err := conn.Assert(
+		store.EntityData{"db/ident": "item/key", "db/type": "db.type/string", "db/unique": true, "db/cardinality": "db.cardinality/one"},
+		store.EntityData{"db/ident": "item/label", "db/type": "db.type/string", "db/cardinality": "db.cardinality/one"},
+		store.EntityData{"db/ident": "item/count", "db/type": "db.type/int64", "db/cardinality": "db.cardinality/one"},
+		store.EntityData{"db/ident": "item/weight", "db/type": "db.type/float64", "db/cardinality": "db.cardinality/one"},
+		store.EntityData{"db/ident": "item/active", "db/type": "db.type/boolean", "db/cardinality": "db.cardinality/one"},
+		store.EntityData{"db/ident": "item/payload", "db/type": "db.type/binary", "db/cardinality": "db.cardinality/one"},
+	)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	rng := rand.New(rand.NewSource(1))
+	randomString := func() string {
+		buf := make([]byte, rng.Intn(64))
+		for i := range buf {
+			buf[i] = byte(' ' + rng.Intn(95))
+		}
+		return string(buf)
+	}
+	for i := 0; i < 100; i++ {
+		submitted := store.EntityData{
+			"item/key": fmt.Sprintf("item-%d", i),
+		}
+		// Each optional attribute is present about half of the time.
+		if rng.Intn(2) == 0 {
+			submitted["item/label"] = randomString()
+		}
+		if rng.Intn(2) == 0 {
+			submitted["item/count"] = rng.Int63() - rng.Int63()
+		}
+		if rng.Intn(2) == 0 {
+			submitted["item/weight"] = rng.NormFloat64() * 1e6
+		}
+		if rng.Intn(2) == 0 {
+			submitted["item/active"] = rng.Intn(2) == 0
+		}
+		if rng.Intn(2) == 0 {
+			payload := make([]byte, 1+rng.Intn(256))
+			rng.Read(payload)
+			submitted["item/payload"] = payload
+		}
+
+		if _, err := conn.Assert(submitted); !assert.NoError(t, err) {
+			return
+		}
+		ent, err := conn.GetEntity(store.NewLookup("item/key", submitted["item/key"]))
+		if !assert.NoError(t, err) {
+			return
+		}
+		data, err := ent.GetData(conn)
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.Equal(t, submitted, data, "entity %d", i)
+	}
+}
+
 func TestAssertExistingEntity(t *testing.T) {
 	conn := newTestConn()
 	{
@@ -205,6 +285,459 @@ func TestAssertExistingEntity(t *testing.T) {
 	}
 }
 
+func TestAttributeAliases(t *testing.T) {
+	conn := newTestConn()
+
+	_, err := conn.Assert(store.Assert("person/email", "db/alias", "user/email"))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// The alias resolves to the canonical attribute.
+	ident, err := store.ResolveIdent(conn, "user/email")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, store.Ident{Name: "person/email"}.MustResolve(conn), ident.ID)
+	assert.Equal(t, "person/email", ident.Name)
+
+	// Writes through the alias are stored against the canonical attribute.
+	_, err = conn.Assert(store.EntityData{
+		"user/email":       "ameredith@example.com",
+		"person/firstName": "Andrew",
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	entity, err := conn.GetEntity(store.NewLookup("user/email", "ameredith@example.com"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	data, err := entity.GetData(conn)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, store.EntityData{
+		"person/email":     "ameredith@example.com",
+		"person/firstName": "Andrew",
+	}, data)
+
+	// An alias may not take a name that belongs to another entity.
+	_, err = conn.Assert(store.Assert("person/ssn", "db/alias", "person/firstName"))
+	assert.ErrorIs(t, err, store.ErrIdentAlreadyExists)
+}
+
+func TestPull(t *testing.T) {
+	conn := newTestConn()
+	_, err := conn.Assert(store.EntityData{
+		"person/email":     "ameredith@example.com",
+		"person/firstName": "Andrew",
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	data, err := conn.DB().Pull(
+		store.NewLookup("person/email", "ameredith@example.com"),
+		store.PullAttr{Attribute: "person/email"},
+		store.PullAttr{Attribute: "person/firstName", As: "name"},
+		store.PullAttr{Attribute: "person/lastName", As: "surname", Default: "Unknown"},
+		store.PullAttr{Attribute: "person/ssn"},
+	)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, store.EntityData{
+		"person/email": "ameredith@example.com",
+		"name":         "Andrew",
+		"surname":      "Unknown",
+	}, data)
+
+	_, err = conn.DB().Pull(
+		store.NewLookup("person/email", "ameredith@example.com"),
+		store.PullAttr{Attribute: "person/firstName", As: "name"},
+		store.PullAttr{Attribute: "person/lastName", As: "name"},
+	)
+	assert.Error(t, err)
+}
+
+func TestPullMany(t *testing.T) {
+	conn := newTestConn()
+	_, err := conn.Assert(store.EntityData{"db/ident": "person/bestFriend", "db/type": "db.type/ref"})
+	if !assert.NoError(t, err) {
+		return
+	}
+	res, err := conn.Assert(
+		store.EntityData{"db/id": store.NamedTempID("rex"), "pet/name": "Rex"},
+		store.EntityData{"db/id": store.NamedTempID("tom"), "pet/name": "Tom"},
+		store.EntityData{
+			"db/id":        store.NamedTempID("ann"),
+			"person/email": "ann@example.com",
+			"person/pets":  []any{store.NamedTempID("tom")},
+		},
+		store.EntityData{
+			"db/id":             store.NamedTempID("bob"),
+			"person/email":      "bob@example.com",
+			"person/pets":       []any{store.NamedTempID("rex")},
+			"person/bestFriend": store.NamedTempID("ann"),
+		},
+	)
+	if !assert.NoError(t, err) {
+		return
+	}
+	id := func(name string) store.ID {
+		id, ok := res.TempIDs.LookupTempID(store.NamedTempID(name))
+		assert.True(t, ok)
+		return id
+	}
+
+	// Entities and the entities that they refer to are each read in one
+	// batch per level.
+	loader := conn.DB().NewEntityLoader()
+	data, err := loader.PullMany([]store.ID{id("bob"), id("ann")},
+		store.PullAttr{Attribute: "person/email"},
+		store.PullAttr{Attribute: "person/pets", Pull: []store.PullAttr{{Attribute: "pet/name"}}},
+		store.PullAttr{Attribute: "person/bestFriend", As: "friend", Pull: []store.PullAttr{{Attribute: "person/email"}}},
+	)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, []store.EntityData{
+		{
+			"person/email": "bob@example.com",
+			"person/pets":  []store.Value{store.EntityData{"pet/name": "Rex"}},
+			"friend":       store.EntityData{"person/email": "ann@example.com"},
+		},
+		{
+			"person/email": "ann@example.com",
+			"person/pets":  []store.Value{store.EntityData{"pet/name": "Tom"}},
+		},
+	}, data)
+	assert.Equal(t, 2, loader.Batches())
+
+	// Entities that the loader has read are cached.
+	_, err = loader.PullMany([]store.ID{id("ann")}, store.PullAttr{Attribute: "person/email"})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, loader.Batches())
+
+	// Loads are coalesced until the first result is needed.
+	loader = conn.DB().NewEntityLoader()
+	ann, bob := loader.Load(id("ann")), loader.Load(id("bob"))
+	assert.Equal(t, 0, loader.Batches())
+	ent, err := bob()
+	if assert.NoError(t, err) {
+		assert.Equal(t, id("bob"), ent.ID())
+	}
+	ent, err = ann()
+	if assert.NoError(t, err) {
+		assert.Equal(t, id("ann"), ent.ID())
+	}
+	assert.Equal(t, 1, loader.Batches())
+
+	// Entity.Pull follows nested patterns too.
+	ent, err = conn.GetEntity(id("bob"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	pulled, err := ent.Pull(conn, store.PullAttr{Attribute: "person/bestFriend", Pull: []store.PullAttr{{Attribute: "person/pets"}}})
+	if assert.NoError(t, err) {
+		assert.Equal(t, store.EntityData{
+			"person/bestFriend": store.EntityData{"person/pets": []store.Value{id("tom")}},
+		}, pulled)
+	}
+}
+
+func TestSyncEntity(t *testing.T) {
+	conn := newTestConn()
+	_, err := conn.Assert(store.EntityData{
+		"person/email":     "ameredith@example.com",
+		"person/firstName": "Andrew",
+		"person/lastName":  "Meredith",
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	person := store.NewLookup("person/email", "ameredith@example.com")
+
+	// Syncing to the current state does not transact anything.
+	basis := conn.DB().Basis.ID()
+	res, err := conn.SyncEntity(person, store.EntityData{
+		"person/email":     "ameredith@example.com",
+		"person/firstName": "Andrew",
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Empty(t, res.Data)
+	assert.Equal(t, basis, conn.DB().Basis.ID())
+
+	// Only changed values are asserted, and nil values are retracted.
+	res, err = conn.SyncEntity(person, store.EntityData{
+		"person/email":     "ameredith@example.com",
+		"person/firstName": "Andy",
+		"person/lastName":  nil,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	// One addition, one retraction, and the transaction's commit time and
+	// root.
+	assert.Len(t, res.Data, 4)
+
+	entity, err := conn.GetEntity(person)
+	if !assert.NoError(t, err) {
+		return
+	}
+	data, err := entity.GetData(conn)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, store.EntityData{
+		"person/email":     "ameredith@example.com",
+		"person/firstName": "Andy",
+	}, data)
+
+	// Values of cardinality-many attributes that are kept are not asserted
+	// again, and only the values that were dropped are retracted.
+	_, err = conn.Assert(
+		store.EntityData{"pet/id": "a", "pet/name": "Ace"},
+		store.EntityData{"pet/id": "b", "pet/name": "Bo"},
+		store.EntityData{"pet/id": "c", "pet/name": "Cy"},
+	)
+	if !assert.NoError(t, err) {
+		return
+	}
+	pets := make(map[string]store.ID)
+	for _, id := range []string{"a", "b", "c"} {
+		pets[id], err = store.NewLookup("pet/id", id).Resolve(conn)
+		assert.NoError(t, err)
+	}
+	_, err = conn.SyncEntity(person, store.EntityData{"person/pets": []store.Value{pets["a"], pets["b"], pets["c"]}})
+	if !assert.NoError(t, err) {
+		return
+	}
+	res, err = conn.SyncEntity(person, store.EntityData{"person/pets": []store.Value{pets["a"], pets["b"]}})
+	if !assert.NoError(t, err) {
+		return
+	}
+	// One retraction, and the transaction's commit time and root.
+	if !assert.Len(t, res.Data, 3) {
+		return
+	}
+	retraction := res.Data[0]
+	assert.Equal(t, store.AssertModeRetraction, retraction.Mode())
+	assert.Equal(t, pets["c"], retraction.Value)
+
+	// The current indexes hold one value per entity, attribute, and valid
+	// time, so the values of the attribute are read from history.
+	entity, err = conn.DB().AsOf(res.TxID()).GetEntity(person)
+	if !assert.NoError(t, err) {
+		return
+	}
+	data, err = entity.GetData(conn)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.ElementsMatch(t, []store.Value{pets["a"], pets["b"]}, data["person/pets"])
+}
+
+func TestGetEntities(t *testing.T) {
+	conn := newTestConn()
+	res, err := conn.Assert(
+		store.EntityData{
+			"person/email":     "ameredith@example.com",
+			"person/firstName": "Andrew",
+		},
+		store.EntityData{
+			"person/email":     "jdoe@example.com",
+			"person/firstName": "Jane",
+		},
+	)
+	if !assert.NoError(t, err) {
+		return
+	}
+	andrew, err := store.NewLookup("person/email", "ameredith@example.com").Resolve(conn)
+	if !assert.NoError(t, err) {
+		return
+	}
+	jane, err := store.NewLookup("person/email", "jdoe@example.com").Resolve(conn)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// Entities are returned in the order requested.
+	ids := []store.ID{jane, andrew}
+	if jane < andrew {
+		ids = []store.ID{andrew, jane}
+	}
+	entities, err := conn.GetEntities(ids)
+	if !assert.NoError(t, err) || !assert.Len(t, entities, 2) {
+		return
+	}
+	for i, entity := range entities {
+		assert.Equal(t, ids[i], entity.ID())
+		single, err := res.DB.GetEntity(ids[i])
+		if !assert.NoError(t, err) {
+			continue
+		}
+		data, err := entity.GetData(conn)
+		assert.NoError(t, err)
+		expected, err := single.GetData(conn)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, data)
+	}
+}
+
+func TestPeer(t *testing.T) {
+	conn := newTestConn()
+	peer, stop := conn.NewPeer(store.PeerConfig{})
+	defer stop()
+
+	// Writes through the peer are forwarded to the transactor and are
+	// immediately visible to the peer.
+	_, err := peer.Assert(store.EntityData{
+		"person/email":     "ameredith@example.com",
+		"person/firstName": "Andrew",
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	andrew := store.NewLookup("person/email", "ameredith@example.com")
+	data, err := peer.DB().Pull(andrew, store.PullAttr{Attribute: "person/firstName"})
+	assert.NoError(t, err)
+	assert.Equal(t, store.EntityData{"person/firstName": "Andrew"}, data)
+	data, err = conn.DB().Pull(andrew, store.PullAttr{Attribute: "person/firstName"})
+	assert.NoError(t, err)
+	assert.Equal(t, store.EntityData{"person/firstName": "Andrew"}, data)
+
+	// Writes through the transactor evict the peer's cached copy of the
+	// entity once the peer has observed them.
+	reports, remove := peer.TxReportQueue(1)
+	defer remove()
+	res, err := conn.Assert(store.EntityData{
+		"person/email":     "ameredith@example.com",
+		"person/firstName": "Drew",
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	select {
+	case report := <-reports:
+		assert.Equal(t, res.DB.Basis.ID(), report.Tx)
+		assert.Equal(t, res.DB.Basis.ID(), report.DBAfter.Basis.ID())
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for the peer to observe the transaction")
+	}
+	data, err = peer.DB().Pull(andrew, store.PullAttr{Attribute: "person/firstName"})
+	assert.NoError(t, err)
+	assert.Equal(t, store.EntityData{"person/firstName": "Drew"}, data)
+}
+
+func TestBatchUpsert(t *testing.T) {
+	conn := newTestConn()
+	_, err := conn.Assert(
+		store.EntityData{"person/email": "a@example.com", "person/firstName": "A"},
+		store.EntityData{"person/email": "b@example.com", "person/firstName": "B"},
+		store.EntityData{"pet/id": "rex", "pet/name": "Rex"},
+	)
+	if !assert.NoError(t, err) {
+		return
+	}
+	a, err := store.NewLookup("person/email", "a@example.com").Resolve(conn)
+	if !assert.NoError(t, err) {
+		return
+	}
+	rex, err := store.NewLookup("pet/id", "rex").Resolve(conn)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// Existing entities are matched by their unique attributes, and lookups in
+	// the value position resolve, whether or not they were found.
+	_, err = conn.Assert(
+		store.EntityData{"person/email": "a@example.com", "person/lastName": "Aye", "person/pets": store.NewLookup("pet/id", "rex")},
+		store.EntityData{"person/email": "b@example.com", "person/lastName": "Bee"},
+		store.EntityData{"person/email": "c@example.com", "person/lastName": "See"},
+	)
+	if !assert.NoError(t, err) {
+		return
+	}
+	for email, lastName := range map[string]string{
+		"a@example.com": "Aye",
+		"b@example.com": "Bee",
+		"c@example.com": "See",
+	} {
+		entity, err := conn.GetEntity(store.NewLookup("person/email", email))
+		if !assert.NoError(t, err) {
+			continue
+		}
+		val, err := entity.Get(conn, "person/lastName")
+		assert.NoError(t, err)
+		assert.Equal(t, lastName, val)
+	}
+	entity, err := conn.GetEntity(a)
+	if !assert.NoError(t, err) {
+		return
+	}
+	pets, err := entity.Get(conn, "person/pets")
+	assert.NoError(t, err)
+	assert.Equal(t, []store.Value{rex}, pets)
+
+	// A lookup that matches nothing fails the transaction.
+	_, err = conn.Assert(store.EntityData{
+		"person/email": "a@example.com",
+		"person/pets":  store.NewLookup("pet/id", "fido"),
+	})
+	assert.ErrorIs(t, err, store.ErrNoSuchEntity)
+}
+
+func TestInternedValues(t *testing.T) {
+	conn := newTestConn()
+	_, err := conn.Assert(store.EntityData{
+		"db/ident":       "person/status",
+		"db/type":        "db.type/string",
+		"db/cardinality": "db.cardinality/one",
+		"db/interned":    true,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	res, err := conn.Assert(
+		store.EntityData{"person/email": "a@example.com", "person/status": "active"},
+		store.EntityData{"person/email": "b@example.com", "person/status": "active"},
+	)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = conn.Assert(store.EntityData{"person/email": "a@example.com", "person/status": "suspended"})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	for email, status := range map[string]string{
+		"a@example.com": "suspended",
+		"b@example.com": "active",
+	} {
+		entity, err := conn.GetEntity(store.NewLookup("person/email", email))
+		if !assert.NoError(t, err) {
+			continue
+		}
+		val, err := entity.Get(conn, "person/status")
+		assert.NoError(t, err)
+		assert.Equal(t, status, val)
+	}
+
+	// Interned values are also read from history.
+	entity, err := conn.DB().AsOf(res.DB.Basis.ID()).GetEntity(store.NewLookup("person/email", "a@example.com"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	val, err := entity.Get(conn, "person/status")
+	assert.NoError(t, err)
+	assert.Equal(t, "active", val)
+}
+
 func TestMultipleUniqueIdentifiers(t *testing.T) {
 	conn := newTestConn()
 
@@ -309,82 +842,4438 @@ func TestMultipleUniqueIdentifiers(t *testing.T) {
 	// }
 }
 
-// newTestConn returns a new connection to an in-memory test store
-// that has been initialized with the schema required for testing.
-func newTestConn() *store.Connection {
-	conn := newMemoryConnection()
-	// db := conn.DB()
-	// Create the schema.
-	_, err := conn.Assert(
-		// Person
+func TestNamedTempIDs(t *testing.T) {
+	conn := newTestConn()
+
+	// Separately constructed entities with the same name are the same entity.
+	res, err := conn.Assert(
 		store.EntityData{
-			"db/ident":       "person/email",
-			"db/type":        "db.type/string",
-			"db/unique":      true,
-			"db/cardinality": "db.cardinality/one",
-			"db/doc":         "An individual email address. Used to uniquely identify a person.",
+			"db/id":        store.NamedTempID("owner"),
+			"person/email": "alice@example.com",
+			"person/pets":  []any{store.NamedTempID("pet")},
 		},
 		store.EntityData{
-			"db/ident":       "person/ssn",
-			"db/type":        "db.type/string",
-			"db/unique":      true,
-			"db/cardinality": "db.cardinality/one",
-			"db/doc":         "A Social Security Number. Used to uniquely identify a person.",
+			"db/id":    store.NamedTempID("pet"),
+			"pet/name": "Rex",
 		},
 		store.EntityData{
-			"db/ident":       "person/firstName",
-			"db/type":        "db.type/string",
-			"db/cardinality": "db.cardinality/one",
+			"db/id":     store.NamedTempID("pet"),
+			"pet/breed": "Beagle",
 		},
+	)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Len(t, res.Names, 2)
+	petID, ok := res.TempIDs.LookupTempID(store.NamedTempID("pet"))
+	assert.True(t, ok)
+	assert.Equal(t, petID, res.Names["pet"])
+	data, err := conn.DB().Pull(petID, store.PullAttr{Attribute: "pet/name"}, store.PullAttr{Attribute: "pet/breed"})
+	if assert.NoError(t, err) {
+		assert.Equal(t, store.EntityData{"pet/name": "Rex", "pet/breed": "Beagle"}, data)
+	}
+	owner, err := store.NewLookup("person/email", "alice@example.com").Resolve(conn)
+	if assert.NoError(t, err) {
+		assert.Equal(t, owner, res.Names["owner"])
+	}
+
+	// Names are scoped to a transaction.
+	again, err := conn.Assert(store.EntityData{
+		"db/id":    store.NamedTempID("pet"),
+		"pet/name": "Fido",
+	})
+	if assert.NoError(t, err) {
+		assert.NotEqual(t, petID, again.Names["pet"])
+	}
+
+	// Names that collide with reserved symbols are rejected.
+	for _, name := range []string{"", "txid", "01ARZ3NDEKTSV4RRFFQ69G5FAV"} {
+		_, err := conn.Assert(store.EntityData{
+			"db/id":    store.NamedTempID(name),
+			"pet/name": "Spot",
+		})
+		assert.ErrorIs(t, err, store.ErrInvalidTempID, "name %q", name)
+	}
+}
+
+func TestAssertResult(t *testing.T) {
+	conn := newTestConn()
+	existing, err := conn.Assert(store.EntityData{
+		"db/id":        store.NamedTempID("bob"),
+		"person/email": "bob@example.com",
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	bob := existing.Names["bob"]
+
+	alice, pet := store.TempID(), store.TempID()
+	res, err := conn.Assert(
 		store.EntityData{
-			"db/ident":       "person/lastName",
-			"db/type":        "db.type/string",
-			"db/cardinality": "db.cardinality/one",
+			"db/id":        alice,
+			"person/email": "alice@example.com",
+			"person/pets":  []any{pet},
 		},
 		store.EntityData{
-			"db/ident":       "person/pets",
-			"db/type":        "db.type/ref",
-			"db/cardinality": "db.cardinality/many",
+			"db/id":    pet,
+			"pet/name": "Rex",
 		},
-		// Pet
+		// Resolves to an existing entity, so it is not new.
 		store.EntityData{
-			"db/ident":       "pet/id",
+			"person/email":    "bob@example.com",
+			"person/lastName": "Smith",
+		},
+	)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	aliceID, ok := res.ResolvedID(alice)
+	assert.True(t, ok)
+	petID, ok := res.ResolvedID(pet)
+	assert.True(t, ok)
+	_, ok = res.ResolvedID(store.TempID())
+	assert.False(t, ok, "tempID that was not used in the transaction")
+	_, ok = res.ResolvedID(store.NamedTempID("txid"))
+	assert.False(t, ok, "the transaction entity is not a caller's tempID")
+
+	assert.ElementsMatch(t, []store.ID{aliceID, petID}, res.NewEntities())
+	assert.NotContains(t, res.NewEntities(), bob)
+	for _, ra := range res.Data {
+		assert.Equal(t, res.TxID(), ra.Tx)
+	}
+	assert.NotContains(t, res.NewEntities(), res.TxID())
+}
+
+func TestAssertResultTx(t *testing.T) {
+	conn := newTestConn()
+	res, err := conn.Assert(store.EntityData{"person/email": "alice@example.com"})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	tx := res.Tx()
+	assert.Equal(t, res.TxID(), tx.ID())
+	assert.Equal(t, res.DB.Basis.ID(), tx.ID())
+	assert.False(t, tx.Time().IsZero())
+
+	// The transaction's facts match what was committed.
+	stored, err := conn.DB().Pull(tx.ID(), store.PullAttr{Attribute: "db.tx/commitTime"})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.True(t, tx.Time().Equal(stored["db.tx/commitTime"].(time.Time)))
+	data, err := tx.GetData(conn)
+	if assert.NoError(t, err) {
+		root, err := store.TxRoot(res.Data)
+		assert.NoError(t, err)
+		assert.Equal(t, store.EntityData{"db.tx/commitTime": tx.Time(), "db.tx/hash": root}, data)
+	}
+	commitTime, err := tx.Get(conn, "db.tx/commitTime")
+	if assert.NoError(t, err) {
+		assert.Equal(t, tx.Time(), commitTime)
+	}
+}
+
+func TestTupleValues(t *testing.T) {
+	conn := newTestConn()
+	_, err := conn.Assert(
+		store.EntityData{
+			"db/ident":       "track/title",
 			"db/type":        "db.type/string",
 			"db/unique":      true,
 			"db/cardinality": "db.cardinality/one",
 		},
 		store.EntityData{
-			"db/ident":       "pet/name",
-			"db/type":        "db.type/string",
+			"db/ident":       "playlist/tracks",
+			"db/type":        "db.type/tuple",
 			"db/cardinality": "db.cardinality/one",
 		},
 		store.EntityData{
-			"db/ident":       "pet/breed",
-			"db/type":        "db.type/string",
+			"db/ident":       "playlist/meta",
+			"db/type":        "db.type/tuple",
 			"db/cardinality": "db.cardinality/one",
 		},
 	)
-	if err != nil {
-		panic(err)
+	if !assert.NoError(t, err) {
+		return
 	}
-	return conn
+
+	// Elements keep their order and may refer to entities in the same
+	// transaction.
+	res, err := conn.Assert(
+		store.EntityData{"db/id": store.NamedTempID("a"), "track/title": "A"},
+		store.EntityData{"db/id": store.NamedTempID("b"), "track/title": "B"},
+		store.EntityData{"db/id": store.NamedTempID("c"), "track/title": "C"},
+		store.EntityData{
+			"db/id":           store.NamedTempID("playlist"),
+			"playlist/tracks": store.Tuple{store.NamedTempID("c"), store.NamedTempID("a"), store.NamedTempID("b")},
+			"playlist/meta":   store.Tuple{"mix", 3, true, time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC), store.Ident{Name: "person/email"}},
+		},
+	)
+	if !assert.NoError(t, err) {
+		return
+	}
+	a, b, c, playlist := res.Names["a"], res.Names["b"], res.Names["c"], res.Names["playlist"]
+	pull := func() store.EntityData {
+		data, err := conn.DB().Pull(playlist,
+			store.PullAttr{Attribute: "playlist/tracks"},
+			store.PullAttr{Attribute: "playlist/meta"},
+		)
+		assert.NoError(t, err)
+		return data
+	}
+	data := pull()
+	assert.Equal(t, store.Tuple{c, a, b}, data["playlist/tracks"])
+	email := store.Ident{Name: "person/email"}.MustResolve(conn)
+	assert.Equal(t, store.Tuple{"mix", int64(3), true, time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC), email}, data["playlist/meta"])
+
+	// Reordering replaces the whole tuple.
+	_, err = conn.Assert(store.EntityData{
+		"db/id":           playlist,
+		"playlist/tracks": store.Tuple{store.NewLookup("track/title", "A"), b, c},
+	})
+	if assert.NoError(t, err) {
+		assert.Equal(t, store.Tuple{a, b, c}, pull()["playlist/tracks"])
+	}
+
+	// Syncing to the same tuple commits nothing.
+	synced, err := conn.SyncEntity(playlist, store.EntityData{"playlist/tracks": store.Tuple{a, b, c}})
+	if assert.NoError(t, err) {
+		assert.Empty(t, synced.Data)
+	}
+
+	_, err = conn.Assert(store.EntityData{"db/id": playlist, "playlist/tracks": []any{a, b}})
+	assert.Error(t, err, "a plain slice is not a tuple")
+	_, err = conn.Assert(store.EntityData{"db/id": playlist, "playlist/tracks": store.Tuple{struct{}{}}})
+	assert.Error(t, err, "unsupported element type")
 }
 
-func newMemoryConnection() *store.Connection {
-	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true))
-	if err != nil {
-		panic(err)
+func TestAttrStats(t *testing.T) {
+	conn := newTestConn()
+	_, err := conn.Assert(store.EntityData{
+		"db/ident":       "person/age",
+		"db/type":        "db.type/int64",
+		"db/cardinality": "db.cardinality/one",
+	})
+	if !assert.NoError(t, err) {
+		return
 	}
-	sto, err := badgerImpl.New(db)
-	if err != nil {
-		panic(err)
+	var people []store.Assertable
+	for i := 0; i < 1000; i++ {
+		people = append(people, store.EntityData{
+			"person/email": fmt.Sprintf("person%d@example.com", i),
+			"person/age":   int64(20 + i%50),
+		})
 	}
-	p := store.NewConnection(store.Config{
-		IdentManager: sto,
-		IDManager:    sto,
-		Indexer:      sto,
+	if _, err := conn.Assert(people...); !assert.NoError(t, err) {
+		return
+	}
+
+	stats, err := conn.AttrStats("person/email")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, int64(1000), stats.Count)
+	assert.InEpsilon(t, 1000, stats.Distinct, 0.05)
+	assert.Equal(t, "person0@example.com", stats.Min)
+	assert.Equal(t, "person9@example.com", stats.Max)
+
+	stats, err = conn.AttrStats("person/age")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, int64(1000), stats.Count)
+	assert.InEpsilon(t, 50, stats.Distinct, 0.05)
+	assert.Equal(t, int64(20), stats.Min)
+	assert.Equal(t, int64(69), stats.Max)
+
+	// Statistics are updated by later transactions.
+	_, err = conn.Assert(store.EntityData{
+		"person/email": "elder@example.com",
+		"person/age":   int64(101),
 	})
-	p.InitializeDB()
+	if !assert.NoError(t, err) {
+		return
+	}
+	stats, err = conn.AttrStats("person/age")
+	if assert.NoError(t, err) {
+		assert.Equal(t, int64(1001), stats.Count)
+		assert.Equal(t, int64(101), stats.Max)
+	}
 
-	return p
+	// Attributes without values have empty statistics.
+	stats, err = conn.AttrStats("pet/breed")
+	if assert.NoError(t, err) {
+		assert.Equal(t, store.AttrStats{}, stats)
+	}
+
+	// The planner starts from the more selective pattern, which does not
+	// change the results.
+	rows, err := conn.DB().Query(store.Query{
+		Find: []store.Var{"?email"},
+		Where: []store.Clause{
+			store.Pattern{Entity: store.Var("?e"), Attribute: "person/email", Value: store.Var("?email")},
+			store.Pattern{Entity: store.Var("?e"), Attribute: "person/age", Value: int64(101)},
+		},
+	})
+	if assert.NoError(t, err) {
+		assert.Equal(t, [][]store.Value{{"elder@example.com"}}, rows)
+	}
+}
+
+func TestQueryFilters(t *testing.T) {
+	conn := newTestConn()
+	_, err := conn.Assert(store.EntityData{
+		"db/ident":       "person/age",
+		"db/type":        "db.type/int64",
+		"db/cardinality": "db.cardinality/one",
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	var people []store.Assertable
+	for i := 0; i < 20; i++ {
+		people = append(people, store.EntityData{
+			"person/email": fmt.Sprintf("p%02d@example.com", i),
+			"person/age":   int64(20 + i),
+		})
+	}
+	if _, err := conn.Assert(people...); !assert.NoError(t, err) {
+		return
+	}
+
+	emails := func(where ...store.Clause) []string {
+		rows, err := conn.DB().Query(store.Query{
+			Find:  []store.Var{"?email"},
+			Where: where,
+		})
+		assert.NoError(t, err)
+		var out []string
+		for _, row := range rows {
+			out = append(out, row[0].(string))
+		}
+		sort.Strings(out)
+		return out
+	}
+	email := store.Pattern{Entity: store.Var("?e"), Attribute: "person/email", Value: store.Var("?email")}
+
+	assert.Equal(t, []string{"p10@example.com", "p11@example.com", "p12@example.com"}, emails(
+		store.Pattern{Entity: store.Var("?e"), Attribute: "person/age", Value: store.Var("?age"),
+			Filter: store.ValueRange{Min: int64(30), Max: int64(33), MaxExclusive: true}},
+		email,
+	))
+	assert.Equal(t, []string{"p18@example.com", "p19@example.com"}, emails(
+		store.Pattern{Entity: store.Var("?e"), Attribute: "person/age", Value: store.Var("?age"),
+			Filter: store.ValueRange{Min: int64(38)}},
+		email,
+	))
+	assert.Equal(t, []string{"p01@example.com", "p05@example.com"}, emails(
+		store.Pattern{Entity: store.Var("?e"), Attribute: "person/age", Value: store.Var("?age"),
+			Filter: store.ValueIn{int64(21), int64(25), int64(99)}},
+		email,
+	))
+	assert.Equal(t, []string{"p10@example.com", "p11@example.com"}, emails(
+		store.Pattern{Entity: store.Var("?e"), Attribute: "person/email", Value: store.Var("?email"),
+			Filter: store.ValuePrefix("p1")},
+		store.Pattern{Entity: store.Var("?e"), Attribute: "person/age", Value: store.Var("?age"),
+			Filter: store.ValueRange{Max: int64(31)}},
+	))
+
+	// Constants are converted to the type of the attribute, as they are when
+	// asserted.
+	assert.Equal(t, []string{"p10@example.com"}, emails(
+		store.Pattern{Entity: store.Var("?e"), Attribute: "person/age", Value: 30},
+		email,
+	))
+	assert.Equal(t, []string{"p18@example.com", "p19@example.com"}, emails(
+		store.Pattern{Entity: store.Var("?e"), Attribute: "person/age", Value: store.Var("?age"),
+			Filter: store.ValueRange{Min: 38}},
+		email,
+	))
+	assert.Equal(t, []string{"p01@example.com"}, emails(
+		store.Pattern{Entity: store.Var("?e"), Attribute: "person/age", Value: store.Var("?age"),
+			Filter: store.ValueIn{21, uint8(99)}},
+		email,
+	))
+	_, err = conn.DB().Query(store.Query{
+		Find:  []store.Var{"?e"},
+		Where: []store.Clause{store.Pattern{Entity: store.Var("?e"), Attribute: "person/age", Value: "thirty"}},
+	})
+	assert.ErrorContains(t, err, "not assignable to an int64")
+
+	// Filters on patterns whose entity is bound are evaluated in memory.
+	bound := store.NewLookup("person/email", "p03@example.com")
+	rows, err := conn.DB().Query(store.Query{
+		Find: []store.Var{"?age"},
+		Where: []store.Clause{
+			store.Pattern{Entity: bound, Attribute: "person/age", Value: store.Var("?age"), Filter: store.ValueRange{Min: int64(30)}},
+		},
+	})
+	if assert.NoError(t, err) {
+		assert.Empty(t, rows)
+	}
+}
+
+func TestFilterFacts(t *testing.T) {
+	scan := dataflow.SliceScanner[store.Fact]{Slice: []store.Fact{
+		{EntityID: 1, Value: "apple"},
+		{EntityID: 2, Value: "banana"},
+		{EntityID: 3, Value: []byte("apricot")},
+		{EntityID: 4, Value: int64(7)},
+	}}
+	facts, err := dataflow.CollectIntoSlice(dataflow.NewContext(context.Background()), store.FilterFacts(scan, store.ValuePrefix("ap")))
+	if !assert.NoError(t, err) {
+		return
+	}
+	var ids []store.ID
+	for _, fct := range facts {
+		ids = append(ids, fct.EntityID)
+	}
+	assert.Equal(t, []store.ID{1, 3}, ids)
+}
+
+func TestValidTime(t *testing.T) {
+	conn := newTestConn()
+	y2020 := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	y2022 := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	lookup := store.NewLookup("person/email", "valid@example.com")
+	_, err := conn.Assert(
+		store.EntityData{
+			"person/email":     "valid@example.com",
+			"person/firstName": "Val",
+		},
+	)
+	if !assert.NoError(t, err) {
+		return
+	}
+	eid, err := lookup.Resolve(conn)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = conn.Assert(
+		store.ValidDuring(y2020, y2022, store.EntityData{
+			"db/id":           eid,
+			"person/lastName": "Before",
+		}),
+		store.Assert(eid, "person/lastName", "After").ValidDuring(y2022, time.Time{}),
+	)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	getData := func(db store.Database) store.EntityData {
+		entity, err := db.GetEntity(lookup)
+		if !assert.NoError(t, err) {
+			return nil
+		}
+		data, err := entity.GetData(conn)
+		assert.NoError(t, err)
+		return data
+	}
+
+	assert.Equal(t, store.EntityData{
+		"person/email":     "valid@example.com",
+		"person/firstName": "Val",
+	}, getData(conn.DB().ValidAt(y2020.Add(-time.Hour))))
+	assert.Equal(t, "Before", getData(conn.DB().ValidAt(y2020))["person/lastName"])
+	assert.Equal(t, "After", getData(conn.DB().ValidAt(y2022))["person/lastName"])
+
+	_, err = conn.Assert(store.Assert("person/firstName", "person/doc", "x").ValidDuring(y2022, y2020))
+	assert.Error(t, err, "period must end after it begins")
+}
+
+func TestAsOfQuery(t *testing.T) {
+	conn := newTestConn()
+
+	res, err := conn.Assert(
+		store.EntityData{
+			"person/email":     "alice@example.com",
+			"person/firstName": "Alice",
+		},
+		store.EntityData{
+			"person/email":     "bob@example.com",
+			"person/firstName": "Bob",
+		},
+	)
+	if !assert.NoError(t, err) {
+		return
+	}
+	before := res.TempIDs["txid"]
+
+	aliceID, err := store.NewLookup("person/email", "alice@example.com").Resolve(conn)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = conn.Assert(store.Assert(aliceID, "person/email", "alice@example.org"))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// The as-of view should see the email that was current as of the first
+	// transaction.
+	entity, err := conn.DB().AsOf(before).GetEntity(aliceID)
+	if !assert.NoError(t, err) {
+		return
+	}
+	email, err := entity.Get(conn, "person/email")
+	assert.NoError(t, err)
+	assert.Equal(t, "alice@example.com", email)
+
+	// Join the current database against the as-of view to find every email
+	// that changed since the first transaction.
+	rows, err := store.RunQuery(store.Query{
+		Find: []store.Var{"?name", "?old", "?new"},
+		In:   []string{"$", "$before"},
+		Where: []store.Clause{
+			store.Pattern{Source: "$before", Entity: store.Var("?e"), Attribute: "person/email", Value: store.Var("?old")},
+			store.Pattern{Entity: store.Var("?e"), Attribute: "person/email", Value: store.Var("?new")},
+			store.Pattern{Entity: store.Var("?e"), Attribute: "person/firstName", Value: store.Var("?name")},
+		},
+	}, conn.DB(), conn.DB().AsOf(before))
+	if !assert.NoError(t, err) {
+		return
+	}
+	var changed [][]store.Value
+	for _, row := range rows {
+		if row[1] != row[2] {
+			changed = append(changed, row)
+		}
+	}
+	assert.Equal(t, [][]store.Value{{"Alice", "alice@example.com", "alice@example.org"}}, changed)
+	assert.Len(t, rows, 2)
+}
+
+func TestTxAt(t *testing.T) {
+	conn := newTestConn()
+	start := time.Now().Add(-time.Second)
+	var txIDs []store.ID
+	for _, email := range []string{"a@example.com", "b@example.com", "c@example.com"} {
+		res, err := conn.Assert(store.EntityData{"person/email": email})
+		if !assert.NoError(t, err) {
+			return
+		}
+		txIDs = append(txIDs, res.DB.Basis.ID())
+	}
+	end := time.Now().Add(time.Second)
+
+	txID, err := conn.TxAt(end)
+	assert.NoError(t, err)
+	assert.Equal(t, txIDs[len(txIDs)-1], txID)
+
+	_, err = conn.TxAt(start.Add(-time.Hour))
+	assert.ErrorIs(t, err, store.ErrNoSuchEntity)
+
+	inRange, err := conn.TxRange(start, end)
+	assert.NoError(t, err)
+	assert.Subset(t, inRange, txIDs)
+	assert.IsIncreasing(t, inRange)
+
+	inRange, err = conn.TxRange(end, end.Add(time.Hour))
+	assert.NoError(t, err)
+	assert.Empty(t, inRange)
+}
+
+type fixedClock time.Time
+
+func (c fixedClock) Now() time.Time {
+	return time.Time(c)
+}
+
+func TestCommitTimesIncrease(t *testing.T) {
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true).WithLogger(nil))
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer db.Close()
+	sto, err := badgerImpl.New(db)
+	if !assert.NoError(t, err) {
+		return
+	}
+	newConn := func(clock store.Clock) *store.Connection {
+		return store.NewConnection(store.Config{
+			IdentManager: sto,
+			IDManager:    sto,
+			Indexer:      sto,
+			Clock:        clock,
+		})
+	}
+	commitTime := func(conn *store.Connection, res *store.AssertResult) time.Time {
+		data, err := res.DB.Pull(res.DB.Basis.ID(), store.PullAttr{Attribute: "db.tx/commitTime"})
+		assert.NoError(t, err)
+		return data["db.tx/commitTime"].(time.Time)
+	}
+
+	// A stopped clock still yields increasing commit times.
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	conn := newConn(fixedClock(now))
+	if !assert.NoError(t, conn.InitializeDB()) {
+		return
+	}
+	var last time.Time
+	for _, name := range []string{"color/red", "color/green"} {
+		res, err := conn.Assert(store.EntityData{"db/ident": name})
+		if !assert.NoError(t, err) {
+			return
+		}
+		committed := commitTime(conn, res)
+		assert.True(t, committed.After(last), "%s committed at %s, after %s", name, committed, last)
+		last = committed
+	}
+
+	// A new transactor whose clock is behind continues from the latest
+	// commit time in storage.
+	conn = newConn(fixedClock(now.Add(-time.Hour)))
+	res, err := conn.Assert(store.EntityData{"db/ident": "color/blue"})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.True(t, commitTime(conn, res).After(last))
+}
+
+func TestCommitTimesFollowTxIDs(t *testing.T) {
+	conn := newTestConn()
+	const writers = 64
+	results := make(chan *store.AssertResult, writers)
+	errs := make(chan error, writers)
+	for i := 0; i < writers; i++ {
+		go func(i int) {
+			res, err := conn.Assert(store.EntityData{"person/email": fmt.Sprintf("user%d@example.com", i)})
+			results <- res
+			errs <- err
+		}(i)
+	}
+	var txs []store.Tx
+	for i := 0; i < writers; i++ {
+		res := <-results
+		if !assert.NoError(t, <-errs) {
+			return
+		}
+		txs = append(txs, res.Tx())
+	}
+
+	// Transactions committed concurrently are committed at increasing times
+	// in the order of their IDs.
+	sort.Slice(txs, func(i, j int) bool { return txs[i].ID() < txs[j].ID() })
+	for i := 1; i < len(txs); i++ {
+		assert.True(t, txs[i].Time().After(txs[i-1].Time()),
+			"transaction %d committed at %s, not after transaction %d at %s",
+			txs[i].ID(), txs[i].Time(), txs[i-1].ID(), txs[i-1].Time())
+	}
+}
+
+func TestHybridLogicalClock(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	hlc := store.NewHybridLogicalClock(fixedClock(now))
+	assert.Equal(t, now, hlc.Now())
+	assert.Equal(t, now.Add(time.Nanosecond), hlc.Now())
+
+	// Times observed from other clocks push the clock forward.
+	hlc.Observe(now.Add(time.Minute))
+	assert.Equal(t, now.Add(time.Minute+time.Nanosecond), hlc.Now())
+	hlc.Observe(now)
+	assert.Equal(t, now.Add(time.Minute+2*time.Nanosecond), hlc.Now())
+}
+
+func TestTxAtOutOfIDOrder(t *testing.T) {
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true).WithLogger(nil))
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer db.Close()
+	sto, err := badgerImpl.New(db)
+	if !assert.NoError(t, err) {
+		return
+	}
+	conn := store.NewConnection(store.Config{IdentManager: sto, IDManager: sto, Indexer: sto})
+	if !assert.NoError(t, conn.InitializeDB()) {
+		return
+	}
+
+	// Transactions written by different transactors of a store need not be
+	// committed in the order of their IDs.
+	start := time.Now().Add(time.Hour)
+	for _, tx := range []struct {
+		id        store.ID
+		committed time.Time
+	}{
+		{100000, start.Add(2 * time.Hour)},
+		{100001, start.Add(time.Hour)},
+	} {
+		err := sto.Write([]store.ResolvedAssertion{
+			store.NewResolvedAssertion(store.Fact{EntityID: tx.id, Attribute: store.IDTxCommitTime, Value: tx.committed, Tx: tx.id}, store.AssertModeAddition),
+		}, nil)
+		if !assert.NoError(t, err) {
+			return
+		}
+	}
+
+	txID, err := conn.TxAt(start.Add(90 * time.Minute))
+	assert.NoError(t, err)
+	assert.Equal(t, store.ID(100001), txID)
+	txID, err = conn.TxAt(start.Add(3 * time.Hour))
+	assert.NoError(t, err)
+	assert.Equal(t, store.ID(100000), txID)
+
+	inRange, err := conn.TxRange(start, start.Add(3*time.Hour))
+	assert.NoError(t, err)
+	assert.Equal(t, []store.ID{100001, 100000}, inRange)
+}
+
+func TestSubscription(t *testing.T) {
+	conn := newTestConn()
+
+	sub, err := conn.Subscribe(store.Query{
+		Find: []store.Var{"?name"},
+		Where: []store.Clause{
+			store.Pattern{Entity: store.Var("?e"), Attribute: "person/firstName", Value: store.Var("?name")},
+		},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer sub.Close()
+	assert.Empty(t, sub.Initial())
+
+	nextDelta := func() store.QueryDelta {
+		select {
+		case delta := <-sub.Deltas():
+			return delta
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for query delta")
+			return store.QueryDelta{}
+		}
+	}
+
+	// Transactions that do not touch a dependent attribute produce no delta.
+	_, err = conn.Assert(store.EntityData{"pet/name": "Rex"})
+	assert.NoError(t, err)
+
+	res, err := conn.Assert(store.EntityData{
+		"person/email":     "carol@example.com",
+		"person/firstName": "Carol",
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	delta := nextDelta()
+	assert.Equal(t, res.TempIDs["txid"], delta.Tx)
+	assert.Equal(t, [][]store.Value{{"Carol"}}, delta.Added)
+	assert.Empty(t, delta.Removed)
+
+	_, err = conn.Assert(store.EntityData{
+		"person/email":     "carol@example.com",
+		"person/firstName": "Caroline",
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	delta = nextDelta()
+	assert.Equal(t, [][]store.Value{{"Caroline"}}, delta.Added)
+	assert.Equal(t, [][]store.Value{{"Carol"}}, delta.Removed)
+}
+
+func TestSubscriptionGroupedQuery(t *testing.T) {
+	conn := newTestConn()
+
+	sub, err := conn.Subscribe(store.Query{
+		Find: []store.Var{"?name"},
+		Where: []store.Clause{
+			store.Group{Clauses: []store.Clause{
+				store.Pattern{Entity: store.Var("?e"), Attribute: "person/firstName", Value: store.Var("?name")},
+			}},
+		},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer sub.Close()
+
+	res, err := conn.Assert(store.EntityData{
+		"person/email":     "erin@example.com",
+		"person/firstName": "Erin",
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	select {
+	case delta := <-sub.Deltas():
+		assert.Equal(t, res.TempIDs["txid"], delta.Tx)
+		assert.Equal(t, [][]store.Value{{"Erin"}}, delta.Added)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for query delta")
+	}
+}
+
+func TestSubscriptionIncremental(t *testing.T) {
+	conn := newTestConn()
+	res, err := conn.Assert(
+		store.EntityData{"db/id": store.NamedTempID("ann"), "person/email": "ann@example.com", "person/firstName": "Ann"},
+		store.EntityData{"db/id": store.NamedTempID("anne"), "person/email": "anne@example.com", "person/firstName": "Ann"},
+	)
+	if !assert.NoError(t, err) {
+		return
+	}
+	ann, anne := res.Names["ann"], res.Names["anne"]
+
+	sub, err := conn.Subscribe(store.Query{
+		Find: []store.Var{"?name"},
+		Where: []store.Clause{
+			store.Pattern{Entity: store.Var("?e"), Attribute: "person/firstName", Value: store.Var("?name")},
+			store.Pattern{Entity: store.Var("?e"), Attribute: "person/email", Value: store.Var("?email")},
+		},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer sub.Close()
+	assert.Equal(t, [][]store.Value{{"Ann"}}, sub.Initial())
+
+	// A row that is still derived from another entity is not removed.
+	_, err = conn.Assert(store.Retract(ann, "person/firstName", "Ann"))
+	assert.NoError(t, err)
+	res, err = conn.Assert(store.Retract(anne, "person/email", "anne@example.com"))
+	assert.NoError(t, err)
+	select {
+	case delta := <-sub.Deltas():
+		assert.Equal(t, res.TxID(), delta.Tx)
+		assert.Empty(t, delta.Added)
+		assert.Equal(t, [][]store.Value{{"Ann"}}, delta.Removed)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for query delta")
+	}
+}
+
+func TestSubscriptionSlowConsumer(t *testing.T) {
+	conn := newTestConn()
+	sub, err := conn.Subscribe(store.Query{
+		Find:  []store.Var{"?name"},
+		Where: []store.Clause{store.Pattern{Entity: store.Var("?e"), Attribute: "person/firstName", Value: store.Var("?name")}},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer sub.Close()
+	res, err := conn.Assert(store.EntityData{"person/email": "pat@example.com"})
+	if !assert.NoError(t, err) {
+		return
+	}
+	pat := res.NewEntities()[0]
+	changes, stop := conn.WatchEntity(pat)
+	defer stop()
+
+	// Writers are not delayed by subscribers that do not keep up.
+	committed := make(chan error)
+	go func() {
+		for i := 0; i < 100; i++ {
+			if _, err := conn.Assert(store.EntityData{"db/id": pat, "person/firstName": fmt.Sprintf("Pat %d", i)}); err != nil {
+				committed <- err
+				return
+			}
+		}
+		committed <- nil
+	}()
+	select {
+	case err := <-committed:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("writers were blocked by a slow subscriber")
+	}
+
+	// The subscription and the watch are stopped instead.
+	timeout := time.After(5 * time.Second)
+	for open := true; open; {
+		select {
+		case _, open = <-sub.Deltas():
+		case <-timeout:
+			t.Fatal("timed out waiting for the subscription to stop")
+		}
+	}
+	assert.ErrorIs(t, sub.Err(), store.ErrSlowConsumer)
+	var last store.EntityChange
+	for open := true; open; {
+		select {
+		case change, ok := <-changes:
+			if open = ok; ok {
+				last = change
+			}
+		case <-timeout:
+			t.Fatal("timed out waiting for the watch to stop")
+		}
+	}
+	assert.ErrorIs(t, last.Err, store.ErrSlowConsumer)
+}
+
+func TestWatchEntity(t *testing.T) {
+	conn := newTestConn()
+	_, err := conn.Assert(store.EntityData{
+		"person/email":     "dave@example.com",
+		"person/firstName": "Dave",
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	eid, err := store.NewLookup("person/email", "dave@example.com").Resolve(conn)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = conn.Assert(store.EntityData{"db/ident": "person/nickname", "db/type": "db.type/string", "db/cardinality": "db.cardinality/many"})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	changes, stop := conn.WatchEntity(eid)
+	defer stop()
+
+	res, err := conn.Assert(
+		store.EntityData{
+			"db/id":            eid,
+			"person/lastName":  "Jones",
+			"person/firstName": "David",
+		},
+		store.Assert(eid, "person/nickname", "Jonesy"),
+		store.Assert(eid, "person/nickname", "DJ"),
+		store.Assert(eid, "person/nickname", "Davo"),
+	)
+	if !assert.NoError(t, err) {
+		return
+	}
+	firstName := store.Ident{Name: "person/firstName"}.MustResolve(conn)
+	lastName := store.Ident{Name: "person/lastName"}.MustResolve(conn)
+	nickname := store.Ident{Name: "person/nickname"}.MustResolve(conn)
+
+	// Changes are ordered by attribute, and their values by value.
+	want := []store.AttributeChange{
+		{Attribute: firstName, Added: []store.Value{"David"}, Removed: []store.Value{"Dave"}},
+		{Attribute: lastName, Added: []store.Value{"Jones"}},
+		{Attribute: nickname, Added: []store.Value{"DJ", "Davo", "Jonesy"}},
+	}
+	sort.Slice(want, func(i, j int) bool { return want[i].Attribute < want[j].Attribute })
+	select {
+	case change := <-changes:
+		assert.NoError(t, change.Err)
+		assert.Equal(t, res.TempIDs["txid"], change.Tx)
+		assert.Equal(t, eid, change.EntityID)
+		assert.Equal(t, want, change.Changes)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for entity change")
+	}
+}
+
+// newTestConn returns a new connection to an in-memory test store
+// that has been initialized with the schema required for testing.
+func TestAllocateIdentsInOneTransaction(t *testing.T) {
+	conn := newTestConn()
+	_, err := conn.Assert(
+		store.EntityData{"db/ident": "status/active"},
+		store.EntityData{"db/ident": "status/inactive"},
+	)
+	if !assert.NoError(t, err) {
+		return
+	}
+	idents, err := conn.ResolveIdents([]any{"status/active", "status/inactive"})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NotZero(t, idents[0].ID)
+	assert.NotZero(t, idents[1].ID)
+	assert.NotEqual(t, idents[0].ID, idents[1].ID)
+
+	// Asserting an existing ident again resolves to the same entity.
+	res, err := conn.Assert(store.EntityData{
+		"db/ident": "status/active",
+		"db/doc":   "The entity is active.",
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	for _, fact := range res.Data {
+		if fact.Attribute == store.IDDoc {
+			assert.Equal(t, idents[0].ID, fact.EntityID)
+		}
+	}
+}
+
+func TestEnsureIdents(t *testing.T) {
+	conn := newTestConn()
+	_, err := conn.Assert(store.EntityData{
+		"db/ident":       "appUser/type",
+		"db/type":        "db.type/ref",
+		"db/cardinality": "db.cardinality/one",
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	ids, err := conn.EnsureIdents("appUser/type.customer", "appUser/type.admin", "appUser/type.customer")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Len(t, ids, 3)
+	assert.Equal(t, ids[0], ids[2])
+	assert.NotEqual(t, ids[0], ids[1])
+	assert.Equal(t, ids[0], store.Ident{Name: "appUser/type.customer"}.MustResolve(conn))
+
+	// Existing idents are returned without creating new entities.
+	basis := conn.DB().Basis.ID()
+	again, err := conn.EnsureIdents("appUser/type.admin", "person/email")
+	if assert.NoError(t, err) {
+		assert.Equal(t, ids[1], again[0])
+		assert.Equal(t, store.Ident{Name: "person/email"}.MustResolve(conn), again[1])
+	}
+	assert.Equal(t, basis, conn.DB().Basis.ID())
+
+	// Enum values may be referenced by name.
+	res, err := conn.Assert(store.EntityData{
+		"person/email": "alice@example.com",
+		"appUser/type": "appUser/type.admin",
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	data, err := res.DB.Pull(store.NewLookup("person/email", "alice@example.com"), store.PullAttr{Attribute: "appUser/type"})
+	if assert.NoError(t, err) {
+		assert.Equal(t, ids[1], data["appUser/type"])
+	}
+
+	// Names in the reserved namespace are rejected, and nothing is created.
+	_, err = conn.EnsureIdents("appUser/type.guest", "db/bogus")
+	assert.Error(t, err)
+	_, err = store.ResolveIdent(conn, "appUser/type.guest")
+	assert.ErrorIs(t, err, store.ErrNoSuchIdent)
+}
+
+func TestFailedTransactionDoesNotLeakIdents(t *testing.T) {
+	conn := newTestConn()
+	_, err := conn.Assert(store.EntityData{
+		"db/ident":       "widget/size",
+		"db/type":        "db.type/nonexistent",
+		"db/cardinality": "db.cardinality/one",
+	})
+	assert.Error(t, err)
+
+	_, err = conn.ResolveIdents([]any{"widget/size"})
+	assert.ErrorIs(t, err, store.ErrNoSuchIdent)
+
+	// The ident can still be created by a later transaction.
+	_, err = conn.Assert(store.EntityData{
+		"db/ident":       "widget/size",
+		"db/type":        "db.type/int64",
+		"db/cardinality": "db.cardinality/one",
+	})
+	assert.NoError(t, err)
+	_, err = conn.ResolveIdents([]any{"widget/size"})
+	assert.NoError(t, err)
+}
+
+func TestSystemEntitiesAreReadOnly(t *testing.T) {
+	conn := newTestConn()
+
+	_, err := conn.Assert(store.Assert(store.IDDoc, "db/doc", "Documentation."))
+	assert.ErrorIs(t, err, store.ErrSystemEntity)
+
+	// An ident that resolves to a system entity is rejected as well.
+	_, err = conn.Assert(store.Assert("db/doc", "db/doc", "Documentation."))
+	assert.ErrorIs(t, err, store.ErrSystemEntity)
+
+	_, err = conn.AlterSystemSchema(store.Assert(store.IDDoc, "db/doc", "Documentation."))
+	assert.NoError(t, err)
+}
+
+func TestSchemaChangesAreVisibleImmediately(t *testing.T) {
+	conn := newTestConn()
+	_, err := conn.Assert(store.EntityData{
+		"db/ident":       "account/handle",
+		"db/type":        "db.type/string",
+		"db/cardinality": "db.cardinality/one",
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	handle := store.Ident{Name: "account/handle"}.MustResolve(conn)
+
+	entityFor := func(res *store.AssertResult) store.ID {
+		for _, fact := range res.Data {
+			if fact.Attribute == handle {
+				return fact.EntityID
+			}
+		}
+		return 0
+	}
+
+	res, err := conn.Assert(store.EntityData{"account/handle": "ada"})
+	if !assert.NoError(t, err) {
+		return
+	}
+	original := entityFor(res)
+
+	// Make the attribute unique. Subsequent transactions must observe the
+	// change rather than a cached copy of the old schema.
+	_, err = conn.Assert(store.EntityData{
+		"db/ident":  "account/handle",
+		"db/unique": true,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	res, err = conn.Assert(store.EntityData{"account/handle": "ada"})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, original, entityFor(res))
+}
+
+func TestLargeValues(t *testing.T) {
+	conn := newTestConn()
+	// Larger than both the inline value and AVET key limits.
+	email := strings.Repeat("x", 4096) + "@example.com"
+	_, err := conn.Assert(store.EntityData{
+		"person/email":     email,
+		"person/firstName": "Large",
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	entity, err := conn.GetEntity(store.NewLookup("person/email", email))
+	if !assert.NoError(t, err) {
+		return
+	}
+	val, err := entity.Get(conn, "person/email")
+	assert.NoError(t, err)
+	assert.Equal(t, email, val)
+
+	_, err = conn.GetEntity(store.NewLookup("person/email", strings.Repeat("y", 4096)+"@example.com"))
+	assert.ErrorIs(t, err, store.ErrNoSuchEntity)
+}
+
+func TestBlobs(t *testing.T) {
+	conn := newTestConn()
+	_, err := conn.Assert(store.EntityData{
+		"db/ident":       "person/avatar",
+		"db/type":        "db.type/blob",
+		"db/cardinality": "db.cardinality/one",
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// Span several chunks.
+	contents := bytes.Repeat([]byte("canter"), 50_000)
+	digest, err := conn.PutBlob(bytes.NewReader(contents))
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, store.BlobDigest(sha256.Sum256(contents)), digest)
+
+	// Storing the same contents again yields the same blob.
+	again, err := conn.PutBlob(bytes.NewReader(contents))
+	assert.NoError(t, err)
+	assert.Equal(t, digest, again)
+
+	_, err = conn.Assert(store.EntityData{
+		"person/email":  "fay@example.com",
+		"person/avatar": digest,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	entity, err := conn.GetEntity(store.NewLookup("person/email", "fay@example.com"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	val, err := entity.Get(conn, "person/avatar")
+	if !assert.NoError(t, err) {
+		return
+	}
+	r, err := conn.OpenBlob(val.(store.BlobDigest))
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer r.Close()
+	read, err := io.ReadAll(r)
+	assert.NoError(t, err)
+	assert.Equal(t, contents, read)
+
+	// Facts may not refer to blobs that have not been stored.
+	_, err = conn.Assert(store.EntityData{
+		"person/email":  "fay@example.com",
+		"person/avatar": store.BlobDigest{},
+	})
+	assert.ErrorIs(t, err, store.ErrNoSuchBlob)
+}
+
+func TestTxBuilder(t *testing.T) {
+	conn := newTestConn()
+	tx := conn.NewTx()
+	// Enough assertions to be resolved in several chunks.
+	for i := 0; i < 1500; i++ {
+		err := tx.Add(store.EntityData{
+			"person/email":     fmt.Sprintf("user%d@example.com", i),
+			"person/firstName": "User",
+		})
+		if !assert.NoError(t, err) {
+			return
+		}
+	}
+	res, err := tx.Commit()
+	if !assert.NoError(t, err) {
+		return
+	}
+	// Every fact plus the transaction's commit time and root.
+	assert.Len(t, res.Data, 3002)
+
+	_, err = conn.GetEntity(store.NewLookup("person/email", "user1499@example.com"))
+	assert.NoError(t, err)
+
+	_, err = tx.Commit()
+	assert.ErrorIs(t, err, store.ErrTxDone)
+}
+
+func TestTxSizeLimit(t *testing.T) {
+	conn := newMemoryConnectionWithConfig(store.Config{MaxTxFacts: 2})
+	_, err := conn.Assert(
+		store.EntityData{"db/ident": "color/red"},
+		store.EntityData{"db/ident": "color/green"},
+	)
+	assert.NoError(t, err)
+
+	_, err = conn.Assert(
+		store.EntityData{"db/ident": "color/blue"},
+		store.EntityData{"db/ident": "color/cyan"},
+		store.EntityData{"db/ident": "color/magenta"},
+	)
+	assert.ErrorIs(t, err, store.ErrTxTooLarge)
+	_, err = conn.ResolveIdents([]any{"color/blue"})
+	assert.ErrorIs(t, err, store.ErrNoSuchIdent)
+}
+
+// flakyIndexer fails writes with a transient error until failUntil writes have
+// been attempted.
+type flakyIndexer struct {
+	store.Indexer
+	writes    int
+	failUntil int
+}
+
+func (f *flakyIndexer) Write(assertions []store.ResolvedAssertion, idents []store.Ident) error {
+	f.writes++
+	if f.writes <= f.failUntil {
+		return errors.Join(errors.New("write conflict"), store.ErrTransient)
+	}
+	return f.Indexer.Write(assertions, idents)
+}
+
+func TestRetryPolicy(t *testing.T) {
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true).WithLogger(nil))
+	if !assert.NoError(t, err) {
+		return
+	}
+	sto, err := badgerImpl.New(db)
+	if !assert.NoError(t, err) {
+		return
+	}
+	flaky := &flakyIndexer{Indexer: sto}
+	conn := store.NewConnection(store.Config{
+		IdentManager: sto,
+		IDManager:    sto,
+		Indexer:      flaky,
+		RetryPolicy: &store.RetryPolicy{
+			MaxAttempts:    3,
+			InitialBackoff: time.Millisecond,
+			Multiplier:     2,
+		},
+	})
+	if !assert.NoError(t, conn.InitializeDB()) {
+		return
+	}
+
+	// Succeeds on the last attempt.
+	flaky.failUntil = flaky.writes + 2
+	_, err = conn.Assert(store.EntityData{"db/ident": "color/red"})
+	assert.NoError(t, err)
+
+	flaky.failUntil = flaky.writes + 3
+	_, err = conn.Assert(store.EntityData{"db/ident": "color/green"})
+	var exhausted *store.RetriesExhaustedError
+	if assert.ErrorAs(t, err, &exhausted) {
+		assert.Equal(t, 3, exhausted.Attempts)
+	}
+	assert.ErrorIs(t, err, store.ErrTransient)
+}
+
+func newTestConn() *store.Connection {
+	conn := newMemoryConnection()
+	// db := conn.DB()
+	// Create the schema.
+	_, err := conn.Assert(
+		// Person
+		store.EntityData{
+			"db/ident":       "person/email",
+			"db/type":        "db.type/string",
+			"db/unique":      true,
+			"db/cardinality": "db.cardinality/one",
+			"db/doc":         "An individual email address. Used to uniquely identify a person.",
+		},
+		store.EntityData{
+			"db/ident":       "person/ssn",
+			"db/type":        "db.type/string",
+			"db/unique":      true,
+			"db/cardinality": "db.cardinality/one",
+			"db/doc":         "A Social Security Number. Used to uniquely identify a person.",
+		},
+		store.EntityData{
+			"db/ident":       "person/firstName",
+			"db/type":        "db.type/string",
+			"db/cardinality": "db.cardinality/one",
+		},
+		store.EntityData{
+			"db/ident":       "person/lastName",
+			"db/type":        "db.type/string",
+			"db/cardinality": "db.cardinality/one",
+		},
+		store.EntityData{
+			"db/ident":       "person/pets",
+			"db/type":        "db.type/ref",
+			"db/cardinality": "db.cardinality/many",
+		},
+		// Pet
+		store.EntityData{
+			"db/ident":       "pet/id",
+			"db/type":        "db.type/string",
+			"db/unique":      true,
+			"db/cardinality": "db.cardinality/one",
+		},
+		store.EntityData{
+			"db/ident":       "pet/name",
+			"db/type":        "db.type/string",
+			"db/cardinality": "db.cardinality/one",
+		},
+		store.EntityData{
+			"db/ident":       "pet/breed",
+			"db/type":        "db.type/string",
+			"db/cardinality": "db.cardinality/one",
+		},
+	)
+	if err != nil {
+		panic(err)
+	}
+	return conn
+}
+
+func newMemoryConnection() *store.Connection {
+	return newMemoryConnectionWithConfig(store.Config{})
+}
+
+// newMemoryConnectionWithConfig creates a connection to an in-memory store.
+// The storage fields of cfg are populated by the store.
+func newMemoryConnectionWithConfig(cfg store.Config) *store.Connection {
+	p := newEmptyConnection(cfg)
+	p.InitializeDB()
+
+	return p
+}
+
+// newEmptyConnection creates a connection to an in-memory store whose system
+// schema has not been initialized.
+func newEmptyConnection(cfg store.Config) *store.Connection {
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true))
+	if err != nil {
+		panic(err)
+	}
+	sto, err := badgerImpl.New(db)
+	if err != nil {
+		panic(err)
+	}
+	cfg.IdentManager = sto
+	cfg.IDManager = sto
+	cfg.Indexer = sto
+	cfg.BlobStore = sto
+	return store.NewConnection(cfg)
+}
+
+func TestReadTxn(t *testing.T) {
+	conn := newTestConn()
+	res, err := conn.Assert(store.EntityData{
+		"person/email":     "erin@example.com",
+		"person/firstName": "Erin",
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	lookup := store.NewLookup("person/email", "erin@example.com")
+	eid, err := lookup.Resolve(conn)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	rtxn, err := conn.ReadTxn()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer rtxn.Close()
+	assert.Equal(t, res.TempIDs["txid"], rtxn.DB().Basis.ID())
+
+	_, err = conn.Assert(store.EntityData{
+		"db/id":            eid,
+		"person/firstName": "Erica",
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	firstName := func(db store.Database) store.Value {
+		entity, err := db.GetEntity(lookup)
+		if !assert.NoError(t, err) {
+			return nil
+		}
+		val, err := entity.Get(conn, "person/firstName")
+		assert.NoError(t, err)
+		return val
+	}
+	assert.Equal(t, "Erin", firstName(rtxn.DB()))
+	assert.Equal(t, "Erica", firstName(conn.DB()))
+	assert.NotEqual(t, rtxn.DB().Basis.ID(), conn.DB().Basis.ID())
+}
+
+func TestReadOnlyConnection(t *testing.T) {
+	dir := t.TempDir()
+
+	// Populate the store with a writer.
+	writer, err := badgerImpl.Open(dir, false, badgerImpl.DefaultOptions())
+	if !assert.NoError(t, err) {
+		return
+	}
+	conn := store.NewConnection(store.Config{
+		IdentManager: writer,
+		IDManager:    writer,
+		Indexer:      writer,
+	})
+	if !assert.NoError(t, conn.InitializeDB()) {
+		return
+	}
+	_, err = conn.Assert(store.EntityData{
+		"db/ident":       "person/email",
+		"db/type":        "db.type/string",
+		"db/unique":      true,
+		"db/cardinality": "db.cardinality/one",
+	})
+	assert.NoError(t, err)
+	_, err = conn.Assert(store.EntityData{"person/email": "erin@example.com"})
+	assert.NoError(t, err)
+	if !assert.NoError(t, writer.Close()) {
+		return
+	}
+
+	reader, err := badgerImpl.Open(dir, true, badgerImpl.DefaultOptions())
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer reader.Close()
+	conn = store.NewConnection(store.Config{
+		IdentManager: reader,
+		IDManager:    reader,
+		Indexer:      reader,
+		BlobStore:    reader,
+		ReadOnly:     true,
+	})
+	assert.True(t, conn.ReadOnly())
+
+	eid, err := store.NewLookup("person/email", "erin@example.com").Resolve(conn)
+	assert.NoError(t, err)
+	assert.NotZero(t, eid)
+
+	_, err = conn.Assert(store.EntityData{"person/email": "frank@example.com"})
+	assert.ErrorIs(t, err, store.ErrReadOnly)
+	_, err = conn.NewTx().Commit()
+	assert.ErrorIs(t, err, store.ErrReadOnly)
+	assert.ErrorIs(t, conn.InitializeDB(), store.ErrReadOnly)
+	_, err = conn.PutBlob(strings.NewReader("data"))
+	assert.ErrorIs(t, err, store.ErrReadOnly)
+
+	// The store rejects writes even without a read-only connection.
+	_, err = reader.NextID()
+	assert.ErrorIs(t, err, store.ErrReadOnly)
+}
+
+func TestInitializeDBIsIdempotent(t *testing.T) {
+	conn := newTestConn()
+	basis := conn.DB().Basis.ID()
+
+	// An initialized database is left untouched.
+	assert.NoError(t, conn.InitializeDB())
+	assert.Equal(t, basis, conn.DB().Basis.ID())
+
+	system, err := conn.GetEntity(store.IDSystem)
+	if !assert.NoError(t, err) {
+		return
+	}
+	version, err := system.Get(conn, "db.system/version")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(14), version)
+
+	// A database without a version stamp is upgraded in a single transaction.
+	_, err = conn.AlterSystemSchema(store.Retract(store.IDSystem, "db.system/version", int64(14)))
+	if !assert.NoError(t, err) {
+		return
+	}
+	basis = conn.DB().Basis.ID()
+	assert.NoError(t, conn.InitializeDB())
+	assert.NotEqual(t, basis, conn.DB().Basis.ID())
+	system, err = conn.GetEntity(store.IDSystem)
+	assert.NoError(t, err)
+	version, err = system.Get(conn, "db.system/version")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(14), version)
+
+	// A database initialized by a newer release is refused.
+	_, err = conn.AlterSystemSchema(store.Assert(store.IDSystem, "db.system/version", int64(99)))
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.ErrorIs(t, conn.InitializeDB(), store.ErrSystemTooNew)
+}
+
+func TestSystemSchemaEnumsAreDocumented(t *testing.T) {
+	conn := newTestConn()
+
+	for _, id := range []store.ID{store.IDCardinalityOne, store.IDTypeString, store.IDTypeBlob, store.IDTypeTuple} {
+		ent, err := conn.GetEntity(id)
+		if !assert.NoError(t, err) {
+			continue
+		}
+		doc, err := ent.Get(conn, "db/doc")
+		assert.NoError(t, err)
+		assert.NotEmpty(t, doc, "missing doc for %s", id)
+	}
+}
+
+// recordingPublisher records the events that it publishes.
+type recordingPublisher struct {
+	events    chan store.OutboxEvent
+	published []store.OutboxEvent
+	err       error
+}
+
+func (p *recordingPublisher) Publish(_ context.Context, events []store.OutboxEvent) error {
+	if p.err != nil {
+		return p.err
+	}
+	p.published = append(p.published, events...)
+	if p.events != nil {
+		for _, evt := range events {
+			p.events <- evt
+		}
+	}
+	return nil
+}
+
+func TestOutbox(t *testing.T) {
+	emailAttr := store.ID(0)
+	conn := newMemoryConnectionWithConfig(store.Config{
+		Outbox: func(data []store.ResolvedAssertion) ([]store.OutboxEvent, error) {
+			var events []store.OutboxEvent
+			for _, ra := range data {
+				if ra.Attribute != emailAttr || ra.Mode() != store.AssertModeAddition {
+					continue
+				}
+				if ra.Value == "invalid" {
+					return nil, errors.New("invalid email")
+				}
+				events = append(events, store.OutboxEvent{
+					Topic:   "signups",
+					Key:     []byte(fmt.Sprint(ra.EntityID)),
+					Payload: []byte(ra.Value.(string)),
+				})
+			}
+			return events, nil
+		},
+	})
+	ids, err := conn.EnsureIdents("person/email")
+	if !assert.NoError(t, err) {
+		return
+	}
+	emailAttr = ids[0]
+	_, err = conn.Assert(store.EntityData{"db/id": emailAttr, "db/type": "db.type/string", "db/unique": true})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	res, err := conn.Assert(
+		store.EntityData{"db/id": store.NamedTempID("a"), "person/email": "a@example.com"},
+		store.EntityData{"db/id": store.NamedTempID("b"), "person/email": "b@example.com"},
+	)
+	if !assert.NoError(t, err) {
+		return
+	}
+	a, _ := res.ResolvedID(store.NamedTempID("a"))
+
+	// A failure to derive events fails the transaction.
+	_, err = conn.Assert(store.EntityData{"person/email": "invalid"})
+	assert.Error(t, err)
+	_, err = conn.GetEntity(store.NewLookup("person/email", "invalid"))
+	assert.Error(t, err)
+
+	// Events stay in the outbox until they have been published.
+	pub := &recordingPublisher{err: errors.New("broker unavailable")}
+	relay := conn.NewOutboxRelay(pub)
+	_, err = relay.RelayPending(context.Background())
+	assert.Error(t, err)
+
+	pub.err = nil
+	n, err := relay.RelayPending(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+	if assert.Len(t, pub.published, 2) {
+		first := pub.published[0]
+		assert.Equal(t, "signups", first.Topic)
+		assert.Equal(t, []byte(fmt.Sprint(a)), first.Key)
+		assert.Equal(t, []byte("a@example.com"), first.Payload)
+		assert.Equal(t, res.TxID(), first.Tx)
+		assert.Less(t, first.ID, pub.published[1].ID)
+		assert.Equal(t, []byte("b@example.com"), pub.published[1].Payload)
+	}
+	n, err = relay.RelayPending(context.Background())
+	assert.NoError(t, err)
+	assert.Zero(t, n)
+
+	// A running relay publishes the events of new transactions.
+	pub.events = make(chan store.OutboxEvent, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- relay.Run(ctx) }()
+	_, err = conn.Assert(store.EntityData{"person/email": "c@example.com"})
+	assert.NoError(t, err)
+	select {
+	case evt := <-pub.events:
+		assert.Equal(t, []byte("c@example.com"), evt.Payload)
+	case <-time.After(time.Second):
+		t.Error("timed out waiting for the relay to publish")
+	}
+	cancel()
+	assert.ErrorIs(t, <-done, context.Canceled)
+	assert.Len(t, pub.published, 3)
+
+	// A broker that does not respond holds back the relay but not writers.
+	blocked := &blockingPublisher{unblock: make(chan struct{})}
+	relay = conn.NewOutboxRelay(blocked)
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	go func() { done <- relay.Run(ctx) }()
+	committed := make(chan error)
+	go func() {
+		for i := 0; i < 40; i++ {
+			if _, err := conn.Assert(store.EntityData{"person/email": fmt.Sprintf("slow%d@example.com", i)}); err != nil {
+				committed <- err
+				return
+			}
+		}
+		committed <- nil
+	}()
+	select {
+	case err := <-committed:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for writers while the broker was blocked")
+	}
+	close(blocked.unblock)
+	assert.Eventually(t, func() bool { return blocked.count() == 40 }, 5*time.Second, time.Millisecond)
+	cancel()
+	assert.ErrorIs(t, <-done, context.Canceled)
+}
+
+// blockingPublisher accepts events only once unblock is closed.
+type blockingPublisher struct {
+	unblock chan struct{}
+	mu      sync.Mutex
+	n       int
+}
+
+func (p *blockingPublisher) Publish(ctx context.Context, events []store.OutboxEvent) error {
+	select {
+	case <-p.unblock:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.n += len(events)
+	return nil
+}
+
+func (p *blockingPublisher) count() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.n
+}
+
+func TestConnectionStatus(t *testing.T) {
+	conn := newTestConn()
+	assert.NoError(t, conn.Ping())
+	status, err := conn.Status()
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.True(t, status.Transactor)
+	assert.Equal(t, conn.DB().Basis.ID(), status.Basis)
+	assert.Equal(t, status.Basis, status.TransactorBasis)
+	assert.Zero(t, status.Lag)
+	assert.Eventually(t, func() bool {
+		status, err := conn.Status()
+		return err == nil && status.IdentsLoaded
+	}, time.Second, 10*time.Millisecond)
+
+	peer, stop := conn.NewPeer(store.PeerConfig{})
+	defer stop()
+	_, err = conn.Assert(store.EntityData{"person/email": "status@example.com"})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Eventually(t, func() bool {
+		status, err := peer.Status()
+		return err == nil && !status.Transactor && status.Basis == conn.DB().Basis.ID() && status.Lag == 0
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestConnectionClose(t *testing.T) {
+	dir := t.TempDir()
+	sto, err := badgerImpl.Open(dir, false, badgerImpl.DefaultOptions())
+	if !assert.NoError(t, err) {
+		return
+	}
+	conn := store.NewConnection(store.Config{IdentManager: sto, IDManager: sto, Indexer: sto, BlobStore: sto})
+	if !assert.NoError(t, conn.InitializeDB()) {
+		return
+	}
+	res, err := conn.Assert(store.EntityData{"db/ident": "color/red"})
+	if !assert.NoError(t, err) {
+		return
+	}
+	changes, stopWatch := conn.WatchEntity(res.DB.Basis.ID())
+	defer stopWatch()
+	peer, stopPeer := conn.NewPeer(store.PeerConfig{})
+	defer stopPeer()
+
+	// Closing a peer leaves the transactor's storage open.
+	assert.NoError(t, peer.Close(context.Background()))
+	_, err = peer.Assert(store.EntityData{"db/ident": "color/green"})
+	assert.ErrorIs(t, err, store.ErrClosed)
+	res, err = conn.Assert(store.EntityData{"db/ident": "color/green"})
+	assert.NoError(t, err)
+
+	// Close waits for open read transactions until its context is done.
+	rt, err := conn.ReadTxn()
+	if !assert.NoError(t, err) {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, conn.Close(ctx), context.DeadlineExceeded)
+	rt.Close()
+	assert.NoError(t, conn.Close(context.Background()), "closing again is a no-op")
+
+	_, err = conn.Assert(store.EntityData{"db/ident": "color/blue"})
+	assert.ErrorIs(t, err, store.ErrClosed)
+	_, err = conn.ReadTxn()
+	assert.ErrorIs(t, err, store.ErrClosed)
+	_, ok := <-changes
+	assert.False(t, ok, "watches stop when the connection is closed")
+
+	// The storage was closed, returning the IDs that it had leased.
+	sto, err = badgerImpl.Open(dir, false, badgerImpl.DefaultOptions())
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer sto.Close()
+	next, err := sto.NextID()
+	assert.NoError(t, err)
+	assert.Equal(t, res.DB.Basis.ID()+1, next)
+}
+
+func TestQueryValidate(t *testing.T) {
+	valid := store.Query{
+		Find: []store.Var{"?email"},
+		Where: []store.Clause{
+			store.Pattern{Entity: store.Var("?e"), Attribute: "person/email", Value: store.Var("?email"), Filter: store.ValuePrefix("a")},
+		},
+	}
+	assert.NoError(t, valid.Validate())
+
+	err := store.Query{
+		Find: []store.Var{"?email", "?name"},
+		In:   []string{"$", "$"},
+		Where: []store.Clause{
+			store.Pattern{Source: "$other", Entity: store.Var("?e"), Attribute: "person/email", Value: store.Var("?email")},
+		},
+	}.Validate()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), `duplicate query source: "$"`)
+		assert.Contains(t, err.Error(), `unknown query source: "$other"`)
+		assert.Contains(t, err.Error(), "find variable ?name is not bound")
+	}
+}
+
+func TestQueryFunctions(t *testing.T) {
+	conn := newTestConn()
+	_, err := conn.Assert(store.EntityData{
+		"db/ident":       "person/age",
+		"db/type":        "db.type/int64",
+		"db/cardinality": "db.cardinality/one",
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = conn.Assert(
+		store.EntityData{"person/email": "ada@example.com", "person/age": int64(36)},
+		store.EntityData{"person/email": "bo@example.org", "person/age": int64(17)},
+	)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	run := func(find []store.Var, where ...store.Clause) ([][]store.Value, error) {
+		return conn.DB().Query(store.Query{
+			Find: find,
+			Where: append([]store.Clause{
+				store.Pattern{Entity: store.Var("?e"), Attribute: "person/email", Value: store.Var("?email")},
+				store.Pattern{Entity: store.Var("?e"), Attribute: "person/age", Value: store.Var("?age")},
+			}, where...),
+		})
+	}
+	emails := []store.Var{"?email"}
+
+	// Function clauses are planned after the clauses that bind their
+	// arguments, regardless of the order in which they are written.
+	rows, err := run(emails, store.Predicate{Fn: ">", Args: []any{store.Var("?age"), 21.5}})
+	assert.NoError(t, err)
+	assert.Equal(t, [][]store.Value{{"ada@example.com"}}, rows)
+
+	rows, err = run(emails, store.Predicate{Fn: "str/ends-with?", Args: []any{store.Var("?email"), ".org"}})
+	assert.NoError(t, err)
+	assert.Equal(t, [][]store.Value{{"bo@example.org"}}, rows)
+
+	rows, err = run([]store.Var{"?email", "?months"},
+		store.Call{Fn: "*", Args: []any{store.Var("?age"), int64(12)}, Bind: "?months"},
+		store.Predicate{Fn: "<", Args: []any{store.Var("?months"), int64(300)}},
+	)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]store.Value{{"bo@example.org", int64(204)}}, rows)
+
+	// A call whose result is already bound filters on equality.
+	rows, err = run(emails, store.Call{Fn: "mod", Args: []any{store.Var("?age"), int64(2)}, Bind: "?age"})
+	assert.NoError(t, err)
+	assert.Empty(t, rows)
+
+	assert.NoError(t, conn.RegisterFunction("adult?", store.Function{
+		Params: []rtype.ConcreteType{rtype.RTypeInt64},
+		Result: rtype.RTypeBool,
+		Fn: func(args []store.Value) (store.Value, error) {
+			return args[0].(int64) >= 18, nil
+		},
+	}))
+	rows, err = run(emails, store.Predicate{Fn: "adult?", Args: []any{store.Var("?age")}})
+	assert.NoError(t, err)
+	assert.Equal(t, [][]store.Value{{"ada@example.com"}}, rows)
+	assert.ErrorContains(t, conn.RegisterFunction("adult?", store.Function{Fn: func([]store.Value) (store.Value, error) { return true, nil }}),
+		"already registered")
+	assert.ErrorContains(t, conn.RegisterFunction("noop", store.Function{}), "has no implementation")
+
+	for _, tt := range []struct {
+		clause   store.Clause
+		contains string
+	}{
+		{store.Predicate{Fn: "nope?", Args: []any{store.Var("?age")}}, "unknown function: nope?"},
+		{store.Predicate{Fn: ">", Args: []any{store.Var("?age")}}, "calling >: expects 2 arguments but got 1"},
+		{store.Predicate{Fn: "adult?", Args: []any{"36"}}, `argument 1: "36" is not of type int64`},
+		{store.Predicate{Fn: "str/upper", Args: []any{store.Var("?email")}}, "cannot be used as a predicate"},
+		{store.Predicate{Fn: "adult?", Args: []any{store.Var("?email")}}, "is not of type int64"},
+		{store.Predicate{Fn: "<", Args: []any{store.Var("?email"), int64(1)}}, "cannot compare"},
+		{store.Call{Fn: "/", Args: []any{store.Var("?age"), int64(0)}, Bind: "?x"}, "calling /: division by zero"},
+	} {
+		_, err := run(emails, tt.clause)
+		assert.ErrorContains(t, err, tt.contains, "%#v", tt.clause)
+	}
+}
+
+func TestQueryAcrossDatabases(t *testing.T) {
+	tenantA, tenantB := newTestConn(), newTestConn()
+	_, err := tenantA.Assert(
+		store.EntityData{"person/email": "alice@example.com", "person/firstName": "Alice"},
+		store.EntityData{"person/email": "bob@example.com", "person/firstName": "Bob"},
+	)
+	if !assert.NoError(t, err) {
+		return
+	}
+	// Give the tenants' entities different IDs.
+	_, err = tenantB.Assert(store.EntityData{"person/email": "zed@example.com", "person/firstName": "Zed"})
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = tenantB.Assert(
+		store.EntityData{"person/email": "alice@example.com", "person/firstName": "Alicia"},
+		store.EntityData{"person/email": "bob@example.com", "person/firstName": "Bob"},
+	)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	q := store.Query{
+		Find: []store.Var{"?email", "?a", "?b"},
+		In:   []string{"$a", "$b"},
+		Where: []store.Clause{
+			store.Group{Source: "$a", Clauses: []store.Clause{
+				store.Pattern{Entity: store.Var("?ea"), Attribute: "person/email", Value: store.Var("?email")},
+				store.Pattern{Entity: store.Var("?ea"), Attribute: "person/firstName", Value: store.Var("?a")},
+			}},
+			store.Group{Source: "$b", Clauses: []store.Clause{
+				store.Pattern{Entity: store.Var("?eb"), Attribute: "person/email", Value: store.Var("?email")},
+				store.Pattern{Entity: store.Var("?eb"), Attribute: "person/firstName", Value: store.Var("?b")},
+			}},
+			store.Predicate{Fn: "!=", Args: []any{store.Var("?a"), store.Var("?b")}},
+		},
+	}
+	assert.NoError(t, q.Validate())
+	rows, err := store.RunQuery(q, tenantA.DB(), tenantB.DB())
+	assert.NoError(t, err)
+	assert.Equal(t, [][]store.Value{{"alice@example.com", "Alice", "Alicia"}}, rows)
+
+	// Joining on entities across connections matches nothing, since the
+	// tenants assigned different IDs.
+	rows, err = store.RunQuery(store.Query{
+		Find: []store.Var{"?email"},
+		In:   []string{"$a", "$b"},
+		Where: []store.Clause{
+			store.Group{Source: "$a", Clauses: []store.Clause{
+				store.Pattern{Entity: store.Var("?e"), Attribute: "person/email", Value: store.Var("?email")},
+			}},
+			store.Group{Source: "$b", Clauses: []store.Clause{
+				store.Pattern{Entity: store.Var("?e"), Attribute: "person/email", Value: store.Var("?email")},
+			}},
+		},
+	}, tenantA.DB(), tenantB.DB())
+	assert.NoError(t, err)
+	assert.Empty(t, rows)
+
+	err = store.Query{
+		Find:  []store.Var{"?email"},
+		In:    []string{"$a"},
+		Where: []store.Clause{store.Group{Source: "$b", Clauses: []store.Clause{store.Pattern{Entity: store.Var("?e"), Attribute: "person/email", Value: store.Var("?email")}}}},
+	}.Validate()
+	assert.ErrorContains(t, err, `unknown query source: "$b"`)
+}
+
+func TestTriggers(t *testing.T) {
+	conn := newTestConn()
+	_, err := conn.Assert(
+		store.EntityData{"db/ident": "person/age", "db/type": "db.type/int64", "db/cardinality": "db.cardinality/one"},
+		store.EntityData{"db/ident": "person/adult", "db/type": "db.type/boolean", "db/cardinality": "db.cardinality/one"},
+	)
+	if !assert.NoError(t, err) {
+		return
+	}
+	alice, err := conn.Assert(store.EntityData{"person/email": "alice@example.com", "person/age": int64(17)})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	var handled [][]store.Value
+	failNext := false
+	runner, err := conn.NewTriggerRunner(
+		store.Trigger{
+			Name:      "log-emails",
+			Attribute: "person/email",
+			Handler: func(ctx context.Context, evt store.TriggerEvent) error {
+				if failNext {
+					failNext = false
+					return errors.New("broker unavailable")
+				}
+				for _, fct := range evt.Facts {
+					handled = append(handled, []store.Value{fct.Value, fct.Mode()})
+				}
+				return nil
+			},
+			Retractions: true,
+		},
+		store.Trigger{
+			// Denormalize whether people are adults.
+			Name:      "adults",
+			Attribute: "person/age",
+			Filter:    store.ValueRange{Min: int64(18)},
+			Then: func(evt store.TriggerEvent) ([]store.Assertable, error) {
+				var out []store.Assertable
+				for _, fct := range evt.Facts {
+					out = append(out, store.Assert(fct.EntityID, "person/adult", true))
+				}
+				return out, nil
+			},
+		},
+	)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	n, err := runner.RunPending(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+	assert.Equal(t, [][]store.Value{{"alice@example.com", store.AssertModeAddition}}, handled)
+
+	aliceID := alice.NewEntities()[0]
+
+	// Progress is recorded, so nothing is delivered twice.
+	n, err = runner.RunPending(context.Background())
+	assert.NoError(t, err)
+	assert.Zero(t, n)
+
+	// A failed delivery is retried.
+	_, err = conn.Assert(store.Retract(aliceID, "person/email", "alice@example.com"), store.Assert(aliceID, "person/age", int64(18)))
+	if !assert.NoError(t, err) {
+		return
+	}
+	failNext = true
+	_, err = runner.RunPending(context.Background())
+	assert.ErrorContains(t, err, "broker unavailable")
+	n, err = runner.RunPending(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+	assert.ElementsMatch(t, [][]store.Value{
+		{"alice@example.com", store.AssertModeAddition},
+		{"alice@example.com", store.AssertModeRetraction},
+	}, handled)
+
+	entity, err := conn.GetEntity(aliceID)
+	if assert.NoError(t, err) {
+		adult, err := entity.Get(conn, "person/adult")
+		assert.NoError(t, err)
+		assert.Equal(t, true, adult)
+	}
+
+	// A new runner resumes from the recorded progress, and Run delivers
+	// transactions as they are committed.
+	runner, err = conn.NewTriggerRunner(store.Trigger{
+		Name:      "log-emails",
+		Attribute: "person/email",
+		Handler: func(ctx context.Context, evt store.TriggerEvent) error {
+			for _, fct := range evt.Facts {
+				handled = append(handled, []store.Value{fct.Value, fct.Mode()})
+			}
+			return nil
+		},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	handled = nil
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- runner.Run(ctx) }()
+	bob, err := conn.Assert(store.EntityData{"person/email": "bob@example.com"})
+	if !assert.NoError(t, err) {
+		cancel()
+		return
+	}
+	assert.Eventually(t, func() bool {
+		progress, err := store.NewLookup("db.trigger/name", "log-emails").Resolve(conn)
+		if err != nil {
+			return false
+		}
+		entity, err := conn.GetEntity(progress)
+		if err != nil {
+			return false
+		}
+		tx, _ := entity.Get(conn, "db.trigger/tx")
+		return tx == bob.TxID()
+	}, time.Second, time.Millisecond)
+	cancel()
+	assert.ErrorIs(t, <-done, context.Canceled)
+	assert.Equal(t, [][]store.Value{{"bob@example.com", store.AssertModeAddition}}, handled)
+
+	// Run keeps up with many pending transactions without holding back
+	// writers, and records its progress once per run.
+	for i := 0; i < 40; i++ {
+		_, err := conn.Assert(store.EntityData{"person/email": fmt.Sprintf("pending%d@example.com", i)})
+		if !assert.NoError(t, err) {
+			return
+		}
+	}
+	var mu sync.Mutex
+	var emails int
+	runner, err = conn.NewTriggerRunner(store.Trigger{
+		Name:      "count-emails",
+		Attribute: "person/email",
+		Handler: func(ctx context.Context, evt store.TriggerEvent) error {
+			mu.Lock()
+			defer mu.Unlock()
+			for _, fct := range evt.Facts {
+				if email := fct.Value.(string); strings.HasPrefix(email, "pending") || strings.HasPrefix(email, "running") {
+					emails++
+				}
+			}
+			return nil
+		},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	before := conn.DB().Basis.ID()
+	ctx, cancel = context.WithCancel(context.Background())
+	go func() { done <- runner.Run(ctx) }()
+	for i := 0; i < 20; i++ {
+		_, err := conn.Assert(store.EntityData{"person/email": fmt.Sprintf("running%d@example.com", i)})
+		assert.NoError(t, err)
+	}
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return emails == 60
+	}, 5*time.Second, time.Millisecond)
+	cancel()
+	assert.ErrorIs(t, <-done, context.Canceled)
+	log, err := conn.DB().TxLog(before+1, 0)
+	if assert.NoError(t, err) {
+		// Besides the 20 transactions committed while it ran, the runner
+		// committed at most one transaction for its first run and one for
+		// each later transaction.
+		assert.LessOrEqual(t, len(log), 20+21)
+	}
+
+	_, err = conn.NewTriggerRunner(store.Trigger{Name: "a", Attribute: "person/email"})
+	assert.ErrorContains(t, err, "neither a handler nor a follow-up transaction")
+	_, err = conn.NewTriggerRunner(
+		store.Trigger{Name: "a", Attribute: "person/email", Then: func(store.TriggerEvent) ([]store.Assertable, error) { return nil, nil }},
+		store.Trigger{Name: "a", Attribute: "person/age", Then: func(store.TriggerEvent) ([]store.Assertable, error) { return nil, nil }},
+	)
+	assert.ErrorContains(t, err, "duplicate trigger: a")
+}
+
+func TestAssertIfUnchanged(t *testing.T) {
+	conn := newTestConn()
+	res, err := conn.Assert(store.EntityData{"person/email": "alice@example.com", "person/firstName": "Alice"})
+	if !assert.NoError(t, err) {
+		return
+	}
+	alice := res.NewEntities()[0]
+	version, err := conn.DB().EntityVersion(alice)
+	assert.NoError(t, err)
+	assert.Equal(t, res.TxID(), version)
+	_, err = conn.DB().EntityVersion(store.ID(1 << 40))
+	assert.ErrorIs(t, err, store.ErrNoSuchEntity)
+
+	// Unrelated transactions do not change the entity's version.
+	_, err = conn.Assert(store.EntityData{"person/email": "bob@example.com"})
+	assert.NoError(t, err)
+	basis := conn.DB().Basis.ID()
+
+	res, err = conn.AssertIfUnchanged(alice, version, store.Assert(alice, "person/firstName", "Alicia"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = conn.AssertIfUnchanged(store.NewLookup("person/email", "alice@example.com"), basis,
+		store.Assert(alice, "person/firstName", "Ally"))
+	assert.ErrorIs(t, err, store.ErrConflict)
+	var changed *store.EntityChangedError
+	if assert.ErrorAs(t, err, &changed) {
+		assert.Equal(t, alice, changed.Entity)
+		assert.Equal(t, basis, changed.Expected)
+		assert.Equal(t, res.TxID(), changed.Version)
+	}
+	entity, err := conn.GetEntity(alice)
+	if assert.NoError(t, err) {
+		name, err := entity.Get(conn, "person/firstName")
+		assert.NoError(t, err)
+		assert.Equal(t, "Alicia", name)
+	}
+
+	// Retractions change the entity too.
+	version = res.TxID()
+	_, err = conn.Assert(store.Retract(alice, "person/firstName", "Alicia"))
+	assert.NoError(t, err)
+	_, err = conn.AssertIfUnchanged(alice, version, store.Assert(alice, "person/firstName", "Al"))
+	assert.ErrorIs(t, err, store.ErrConflict)
+
+	// Of several writers that read the same version, exactly one succeeds.
+	version, err = conn.DB().EntityVersion(alice)
+	if !assert.NoError(t, err) {
+		return
+	}
+	errs := make(chan error)
+	for i := 0; i < 8; i++ {
+		go func(i int) {
+			_, err := conn.AssertIfUnchanged(alice, version, store.Assert(alice, "person/firstName", fmt.Sprintf("Alice %d", i)))
+			errs <- err
+		}(i)
+	}
+	var succeeded int
+	for i := 0; i < 8; i++ {
+		if err := <-errs; err == nil {
+			succeeded++
+		} else {
+			assert.ErrorIs(t, err, store.ErrConflict)
+		}
+	}
+	assert.Equal(t, 1, succeeded)
+}
+
+func TestAssertIfUnchangedInterleaved(t *testing.T) {
+	type pauseKey struct{}
+	resolved, resume := make(chan struct{}), make(chan struct{})
+	conn := newMemoryConnectionWithConfig(store.Config{
+		BeforeCommit: func(ctx context.Context, _ []store.ResolvedAssertion) error {
+			if ctx.Value(pauseKey{}) != nil {
+				close(resolved)
+				<-resume
+			}
+			return nil
+		},
+	})
+	_, err := conn.Assert(store.EntityData{"db/ident": "person/firstName", "db/type": "db.type/string", "db/cardinality": "db.cardinality/one"})
+	if !assert.NoError(t, err) {
+		return
+	}
+	res, err := conn.Assert(store.EntityData{"person/firstName": "Alice"})
+	if !assert.NoError(t, err) {
+		return
+	}
+	alice := res.NewEntities()[0]
+
+	// The first writer is resolved before the second, but it is written
+	// after the second writer commits and a client reads the entity.
+	first := make(chan error)
+	go func() {
+		pause := store.WithContext(context.WithValue(context.Background(), pauseKey{}, true))
+		_, err := conn.Assert(pause, store.Assert(alice, "person/firstName", "Alicia"))
+		first <- err
+	}()
+	<-resolved
+	_, err = conn.Assert(store.EntityData{"person/firstName": "Bob"})
+	if !assert.NoError(t, err) {
+		return
+	}
+	basis := conn.DB().Basis.ID()
+	close(resume)
+	if !assert.NoError(t, <-first) {
+		return
+	}
+
+	// The change made by the first writer is after the basis that the
+	// client read, so the client's update is rejected.
+	_, err = conn.AssertIfUnchanged(alice, basis, store.Assert(alice, "person/firstName", "Al"))
+	assert.ErrorIs(t, err, store.ErrConflict)
+}
+
+func TestEntitiesBy(t *testing.T) {
+	conn := newTestConn()
+	_, err := conn.Assert(store.EntityData{
+		"db/ident":       "person/joined",
+		"db/type":        "db.type/timestamp",
+		"db/cardinality": "db.cardinality/one",
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	var people []store.Assertable
+	for i, name := range []string{"Dee", "Bea", "Cy", "Al", "Bea"} {
+		people = append(people, store.EntityData{
+			"person/email":     fmt.Sprintf("p%d@example.com", i),
+			"person/firstName": name,
+			"person/joined":    start.Add(time.Duration(i) * time.Hour),
+		})
+	}
+	if _, err := conn.Assert(people...); !assert.NoError(t, err) {
+		return
+	}
+
+	list := func(attr string, order store.SortOrder, limit int) (values []store.Value, pages int) {
+		var cursor string
+		for {
+			page, err := conn.EntitiesBy(attr, order, cursor, limit)
+			if !assert.NoError(t, err) {
+				return nil, pages
+			}
+			pages++
+			for _, fct := range page.Facts {
+				values = append(values, fct.Value)
+			}
+			if cursor = page.Cursor; cursor == "" {
+				return values, pages
+			}
+		}
+	}
+
+	names, pages := list("person/firstName", store.Ascending, 2)
+	assert.Equal(t, []store.Value{"Al", "Bea", "Bea", "Cy", "Dee"}, names)
+	assert.Equal(t, 3, pages)
+	names, pages = list("person/firstName", store.Descending, 0)
+	assert.Equal(t, []store.Value{"Dee", "Cy", "Bea", "Bea", "Al"}, names)
+	assert.Equal(t, 1, pages)
+	joined, _ := list("person/joined", store.Descending, 3)
+	if assert.Len(t, joined, 5) {
+		assert.Equal(t, start.Add(4*time.Hour), joined[0])
+		assert.Equal(t, start, joined[4])
+	}
+
+	// Repeated values are ordered by entity, and entities added between
+	// pages do not shift the pages that follow.
+	first, err := conn.EntitiesBy("person/firstName", store.Ascending, "", 2)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Less(t, first.Facts[0].Value, first.Facts[1].Value)
+	_, err = conn.Assert(store.EntityData{"person/email": "new@example.com", "person/firstName": "Aa"})
+	assert.NoError(t, err)
+	second, err := conn.EntitiesBy("person/firstName", store.Ascending, first.Cursor, 2)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "Bea", second.Facts[0].Value)
+		assert.Greater(t, second.Facts[0].EntityID, first.Facts[1].EntityID)
+		assert.Equal(t, "Cy", second.Facts[1].Value)
+	}
+
+	_, err = conn.EntitiesBy("person/firstName", store.Ascending, "not a cursor", 2)
+	assert.ErrorIs(t, err, store.ErrInvalidCursor)
+	byJoined, err := conn.EntitiesBy("person/joined", store.Ascending, "", 2)
+	if assert.NoError(t, err) {
+		_, err = conn.EntitiesBy("person/firstName", store.Ascending, byJoined.Cursor, 2)
+		assert.ErrorIs(t, err, store.ErrInvalidCursor)
+	}
+	_, err = conn.EntitiesBy("person/email", store.Ascending, "", 2)
+	assert.NoError(t, err)
+}
+
+func TestCompositeUniqueness(t *testing.T) {
+	conn := newTestConn()
+	_, err := conn.Assert(
+		store.EntityData{"db/ident": "member/org", "db/type": "db.type/ref", "db/cardinality": "db.cardinality/one"},
+		store.EntityData{"db/ident": "member/email", "db/type": "db.type/string", "db/cardinality": "db.cardinality/one"},
+		store.EntityData{"db/ident": "member/role", "db/type": "db.type/string", "db/cardinality": "db.cardinality/many"},
+		store.EntityData{"db/ident": "org/name", "db/type": "db.type/string", "db/cardinality": "db.cardinality/one", "db/unique": true},
+	)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = conn.Assert(store.EntityData{
+		"db/ident":               "member/orgEmail",
+		"db/type":                "db.type/composite",
+		"db/compositeComponents": store.Tuple{store.Ident{Name: "member/org"}, store.Ident{Name: "member/email"}},
+		"db/unique":              true,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// Components must be distinct cardinality-one attributes.
+	_, err = conn.Assert(store.EntityData{
+		"db/ident":               "member/orgRole",
+		"db/type":                "db.type/composite",
+		"db/compositeComponents": store.Tuple{store.Ident{Name: "member/org"}, store.Ident{Name: "member/role"}},
+	})
+	assert.ErrorContains(t, err, "cardinality one")
+	_, err = conn.Assert(store.EntityData{
+		"db/ident":               "member/orgOnly",
+		"db/type":                "db.type/composite",
+		"db/compositeComponents": store.Tuple{store.Ident{Name: "member/org"}},
+	})
+	assert.ErrorContains(t, err, "at least two components")
+
+	res, err := conn.Assert(
+		store.EntityData{"db/id": store.NamedTempID("acme"), "org/name": "Acme"},
+		store.EntityData{"db/id": store.NamedTempID("globex"), "org/name": "Globex"},
+		store.EntityData{"db/id": store.NamedTempID("alice"), "member/org": store.NamedTempID("acme"), "member/email": "alice@example.com"},
+	)
+	if !assert.NoError(t, err) {
+		return
+	}
+	acme, globex, alice := res.Names["acme"], res.Names["globex"], res.Names["alice"]
+
+	// The composite value is derived from the components.
+	data, err := conn.DB().Pull(alice, store.PullAttr{Attribute: "member/orgEmail"})
+	if assert.NoError(t, err) {
+		assert.Equal(t, store.Tuple{acme, "alice@example.com"}, data["member/orgEmail"])
+	}
+
+	// The same email may be used in another org, but not twice in one org.
+	_, err = conn.Assert(store.EntityData{"member/org": globex, "member/email": "alice@example.com"})
+	assert.NoError(t, err)
+	_, err = conn.Assert(store.EntityData{"member/org": acme, "member/email": "alice@example.com"})
+	assert.ErrorIs(t, err, store.ErrConflict)
+	_, err = conn.Assert(
+		store.EntityData{"member/org": acme, "member/email": "carol@example.com"},
+		store.EntityData{"member/org": acme, "member/email": "carol@example.com"},
+	)
+	assert.ErrorIs(t, err, store.ErrConflict)
+
+	// Lookups take a tuple of the component values.
+	id, err := store.NewLookup("member/orgEmail", store.Tuple{store.NewLookup("org/name", "Acme"), "alice@example.com"}).Resolve(conn)
+	assert.NoError(t, err)
+	assert.Equal(t, alice, id)
+
+	// Changing a component changes the composite value and releases the old
+	// value.
+	_, err = conn.Assert(store.Assert(alice, "member/email", "alice@acme.example.com"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = store.NewLookup("member/orgEmail", store.Tuple{acme, "alice@example.com"}).Resolve(conn)
+	assert.ErrorIs(t, err, store.ErrNoSuchEntity)
+	_, err = conn.Assert(store.EntityData{"member/org": acme, "member/email": "alice@example.com"})
+	assert.NoError(t, err)
+
+	// Retracting a component retracts the composite value.
+	_, err = conn.Assert(store.Retract(alice, "member/email", "alice@acme.example.com"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	data, err = conn.DB().Pull(alice, store.PullAttr{Attribute: "member/orgEmail"})
+	if assert.NoError(t, err) {
+		assert.NotContains(t, data, "member/orgEmail")
+	}
+
+	// Composite values cannot be asserted directly.
+	_, err = conn.Assert(store.Assert(alice, "member/orgEmail", store.Tuple{acme, "x@example.com"}))
+	assert.ErrorContains(t, err, "derived from its components")
+}
+
+func TestUniqueValue(t *testing.T) {
+	conn := newTestConn()
+	_, err := conn.Assert(store.EntityData{
+		"db/ident":       "account/handle",
+		"db/type":        "db.type/string",
+		"db/cardinality": "db.cardinality/one",
+		"db/unique":      "db.unique/value",
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = conn.Assert(store.EntityData{
+		"db/ident":       "account/nickname",
+		"db/type":        "db.type/string",
+		"db/cardinality": "db.cardinality/one",
+		"db/unique":      "db.cardinality/one",
+	})
+	assert.ErrorContains(t, err, "db.unique/identity or db.unique/value")
+
+	res, err := conn.Assert(store.EntityData{"account/handle": "ann"})
+	if !assert.NoError(t, err) {
+		return
+	}
+	ann := res.NewEntities()[0]
+
+	// Asserting a held value conflicts instead of upserting.
+	_, err = conn.Assert(store.EntityData{"account/handle": "ann"})
+	assert.ErrorIs(t, err, store.ErrConflict)
+	_, err = conn.Assert(
+		store.EntityData{"account/handle": "bob"},
+		store.EntityData{"account/handle": "bob"},
+	)
+	assert.ErrorIs(t, err, store.ErrConflict)
+
+	// The holder may assert its own value again, and lookups resolve it.
+	_, err = conn.Assert(store.Assert(ann, "account/handle", "ann"))
+	assert.NoError(t, err)
+	id, err := store.NewLookup("account/handle", "ann").Resolve(conn)
+	assert.NoError(t, err)
+	assert.Equal(t, ann, id)
+
+	// A value may move to another entity once it is retracted.
+	res, err = conn.Assert(
+		store.Retract(ann, "account/handle", "ann"),
+		store.EntityData{"db/id": store.NamedTempID("ann2"), "account/handle": "ann"},
+	)
+	if assert.NoError(t, err) {
+		id, err := store.NewLookup("account/handle", "ann").Resolve(conn)
+		assert.NoError(t, err)
+		assert.Equal(t, res.Names["ann2"], id)
+	}
+}
+
+func TestMigrateBooleanUniqueness(t *testing.T) {
+	conn := newTestConn()
+
+	// Recreate a database from before db/unique was enumerated.
+	_, err := conn.AlterSystemSchema(store.Assert(store.IDUnique, "db/type", "db.type/boolean"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = conn.Assert(
+		store.EntityData{"db/ident": "legacy/code", "db/type": "db.type/string", "db/cardinality": "db.cardinality/one", "db/unique": true},
+		store.EntityData{"db/ident": "legacy/label", "db/type": "db.type/string", "db/cardinality": "db.cardinality/one", "db/unique": false},
+	)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = conn.AlterSystemSchema(store.Assert(store.IDSystem, "db.system/version", int64(8)))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	if !assert.NoError(t, conn.InitializeDB()) {
+		return
+	}
+	code, err := conn.GetEntity(store.Ident{Name: "legacy/code"})
+	if assert.NoError(t, err) {
+		unique, err := code.Get(conn, "db/unique")
+		assert.NoError(t, err)
+		assert.Equal(t, store.IDUniqueIdentity, unique)
+	}
+	label, err := conn.GetEntity(store.Ident{Name: "legacy/label"})
+	if assert.NoError(t, err) {
+		_, err := label.Get(conn, "db/unique")
+		assert.ErrorIs(t, err, store.ErrPropertyNotFound)
+	}
+
+	// Formerly unique attributes still upsert, and their history is readable.
+	first, err := conn.Assert(store.EntityData{"legacy/code": "x"})
+	if !assert.NoError(t, err) {
+		return
+	}
+	second, err := conn.Assert(store.EntityData{"legacy/code": "x", "legacy/label": "X"})
+	if assert.NoError(t, err) {
+		assert.Empty(t, second.NewEntities())
+	}
+	id, err := store.NewLookup("legacy/code", "x").Resolve(conn)
+	assert.NoError(t, err)
+	assert.Equal(t, first.NewEntities()[0], id)
+	_, err = conn.DB().EntityVersion(code.ID())
+	assert.NoError(t, err)
+}
+
+func TestTxOptions(t *testing.T) {
+	conn := newTestConn()
+	res, err := conn.Assert(store.EntityData{"person/email": "alice@example.com"})
+	if !assert.NoError(t, err) {
+		return
+	}
+	alice := res.NewEntities()[0]
+
+	// By default, a tempID upserts through an identity attribute.
+	res, err = conn.Assert(store.EntityData{"person/email": "alice@example.com", "person/firstName": "Alice"})
+	if assert.NoError(t, err) {
+		assert.Empty(t, res.NewEntities())
+	}
+
+	// Without resolving unique attributes, it conflicts instead.
+	_, err = conn.Assert(store.WithNoResolveUnique(), store.EntityData{"person/email": "alice@example.com"})
+	assert.ErrorIs(t, err, store.ErrConflict)
+	res, err = conn.Assert(store.WithNoResolveUnique(), store.EntityData{"person/email": "bob@example.com"})
+	if assert.NoError(t, err) {
+		assert.Len(t, res.NewEntities(), 1)
+	}
+	tx := conn.NewTx(store.WithNoResolveUnique())
+	assert.NoError(t, tx.Add(store.EntityData{"person/email": "alice@example.com"}))
+	_, err = tx.Commit()
+	assert.ErrorIs(t, err, store.ErrConflict)
+	id, err := store.NewLookup("person/email", "alice@example.com").Resolve(conn)
+	assert.NoError(t, err)
+	assert.Equal(t, alice, id)
+
+	// Isolated names refer to a different entity in each Assertable.
+	record := func(email string) store.Assertable {
+		return store.EntityData{"db/id": store.NamedTempID("row"), "person/email": email}
+	}
+	res, err = conn.Assert(store.WithIsolatedTempIDs(), record("carol@example.com"), record("dave@example.com"))
+	if assert.NoError(t, err) {
+		assert.Len(t, res.NewEntities(), 2)
+		assert.Empty(t, res.Names)
+	}
+	res, err = conn.Assert(
+		store.WithIsolatedTempIDs(),
+		store.EntityData{"db/id": store.NamedTempID("row"), "person/email": "erin@example.com", "person/pets": store.NamedTempID("pet")},
+		store.EntityData{"db/id": store.NamedTempID("pet"), "pet/id": "rex"},
+	)
+	if assert.NoError(t, err) {
+		// The pet that the person refers to is not the pet of the second
+		// Assertable.
+		assert.Len(t, res.NewEntities(), 3)
+	}
+
+	// Options must come first.
+	_, err = conn.Assert(store.EntityData{"person/email": "gina@example.com"}, store.WithIsolatedTempIDs())
+	assert.ErrorContains(t, err, "before any assertions")
+}
+
+func TestBoundedIdentCache(t *testing.T) {
+	conn := newMemoryConnectionWithConfig(store.Config{IdentCacheSize: 2})
+	status, err := conn.Status()
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.True(t, status.IdentsLoaded)
+	systemIdents := status.IdentCache.Size
+
+	_, err = conn.Assert(
+		store.EntityData{"db/ident": "color/red", "db/alias": "color/rouge"},
+		store.EntityData{"db/ident": "color/green"},
+		store.EntityData{"db/ident": "color/blue"},
+	)
+	if !assert.NoError(t, err) {
+		return
+	}
+	status, err = conn.Status()
+	if assert.NoError(t, err) {
+		assert.Equal(t, systemIdents+2, status.IdentCache.Size)
+		assert.Equal(t, uint64(1), status.IdentCache.Evictions)
+	}
+
+	// Evicted idents, including aliases, are resolved from storage again.
+	for _, name := range []string{"color/red", "color/rouge", "color/green", "color/blue", "db/ident"} {
+		ident, err := store.ResolveIdent(conn, name)
+		if assert.NoError(t, err, name) {
+			assert.NotZero(t, ident.ID, name)
+		}
+	}
+	red, err := store.ResolveIdent(conn, "color/rouge")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "color/red", red.Name)
+	}
+
+	status, err = conn.Status()
+	if assert.NoError(t, err) {
+		assert.Equal(t, systemIdents+2, status.IdentCache.Size)
+		assert.Greater(t, status.IdentCache.Hits, uint64(0))
+		assert.Greater(t, status.IdentCache.Misses, uint64(0))
+		assert.Greater(t, status.IdentCache.Evictions, uint64(1))
+	}
+}
+
+func TestNamespaces(t *testing.T) {
+	conn := newTestConn()
+	_, err := conn.Assert(
+		store.EntityData{
+			"db/ident":            "db.namespace/person",
+			"db/doc":              "People and their pets.",
+			"db/owner":            "people-team",
+			"db/attributePattern": "^[a-z][a-zA-Z]*$",
+		},
+		store.EntityData{"db/ident": "db.namespace/legacy", "db/deprecated": true},
+	)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	ns, err := conn.DB().Namespace("person")
+	if assert.NoError(t, err) {
+		assert.NotZero(t, ns.ID)
+		assert.Equal(t, "People and their pets.", ns.Doc)
+		assert.Equal(t, []string{"people-team"}, ns.Owners)
+		assert.Equal(t, "^[a-z][a-zA-Z]*$", ns.AttributePattern)
+		var names []string
+		for _, attr := range ns.Attributes {
+			names = append(names, attr.Name)
+		}
+		assert.Equal(t, []string{"person/email", "person/firstName", "person/lastName", "person/pets", "person/ssn"}, names)
+	}
+	_, err = conn.DB().Namespace("vehicle")
+	assert.ErrorIs(t, err, store.ErrNoSuchEntity)
+
+	namespaces, err := conn.DB().Namespaces()
+	if assert.NoError(t, err) {
+		var names []string
+		for _, ns := range namespaces {
+			names = append(names, ns.Name)
+		}
+		assert.Equal(t, []string{"legacy", "person", "pet"}, names)
+		assert.True(t, namespaces[0].Deprecated)
+		assert.Empty(t, namespaces[0].Attributes)
+		assert.Zero(t, namespaces[2].ID)
+	}
+
+	// New attributes must follow the rules of their namespace.
+	_, err = conn.Assert(store.EntityData{"db/ident": "person/Nickname", "db/type": "db.type/string"})
+	assert.ErrorIs(t, err, store.ErrSchemaViolation)
+	_, err = conn.Assert(store.EntityData{"db/ident": "legacy/code", "db/type": "db.type/string"})
+	assert.ErrorIs(t, err, store.ErrSchemaViolation)
+	_, err = conn.Assert(store.EntityData{"db/ident": "person/nickname", "db/type": "db.type/string"})
+	assert.NoError(t, err)
+	_, err = conn.Assert(store.EntityData{"db/ident": "db.namespace/pet", "db/attributePattern": "("})
+	assert.ErrorIs(t, err, store.ErrSchemaViolation)
+
+	// Existing attributes are not affected.
+	_, err = conn.Assert(store.Assert("person/nickname", "db/doc", "Informal name."))
+	assert.NoError(t, err)
+}
+
+func TestAttributeDeprecation(t *testing.T) {
+	conn := newTestConn()
+	_, err := conn.Assert(
+		store.EntityData{"db/ident": "person/fullName", "db/type": "db.type/string"},
+		store.EntityData{"db/ident": "person/firstName", "db/deprecated": true, "db/replacedBy": "person/fullName"},
+		store.EntityData{"db/ident": "person/ssn", "db/deprecated": true},
+	)
+	if !assert.NoError(t, err) {
+		return
+	}
+	// Deprecated attributes may still be written.
+	_, err = conn.Assert(store.EntityData{
+		"person/email":     "ameredith@example.com",
+		"person/firstName": "Andrew",
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	fullName, err := store.ResolveIdent(conn, "person/fullName")
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// Reads without a collector raise no warnings.
+	_, err = conn.DB().GetEntity(store.NewLookup("person/email", "ameredith@example.com"))
+	assert.NoError(t, err)
+
+	// Each deprecated attribute that a read touches is reported once.
+	var warnings store.Warnings
+	db := conn.DB().WithWarnings(&warnings)
+	_, err = db.GetEntity(store.NewLookup("person/email", "ameredith@example.com"))
+	assert.NoError(t, err)
+	_, err = db.Pull(store.NewLookup("person/email", "ameredith@example.com"), store.PullAttr{Attribute: "person/firstName"})
+	assert.NoError(t, err)
+	if deprecations := warnings.Deprecations(); assert.Len(t, deprecations, 1) {
+		assert.Equal(t, "person/firstName", deprecations[0].Attribute.Name)
+		assert.Equal(t, fullName, deprecations[0].ReplacedBy)
+		assert.Equal(t, "attribute person/firstName is deprecated: use person/fullName instead", deprecations[0].String())
+	}
+
+	// Queries are checked too, and collectors are independent.
+	var queryWarnings store.Warnings
+	_, err = conn.DB().WithWarnings(&queryWarnings).Query(store.Query{
+		Find: []store.Var{"?e"},
+		Where: []store.Clause{
+			store.Pattern{Entity: store.Var("?e"), Attribute: "person/ssn", Value: store.Var("?ssn")},
+		},
+	})
+	assert.NoError(t, err)
+	if deprecations := queryWarnings.Deprecations(); assert.Len(t, deprecations, 1) {
+		assert.Equal(t, "person/ssn", deprecations[0].Attribute.Name)
+		assert.Zero(t, deprecations[0].ReplacedBy)
+	}
+	assert.Equal(t, 1, warnings.Len())
+
+	// Schema introspection surfaces deprecations and their replacements.
+	d, ok, err := conn.DB().Deprecation("person/firstName")
+	if assert.NoError(t, err) && assert.True(t, ok) {
+		assert.Equal(t, fullName, d.ReplacedBy)
+	}
+	_, ok, err = conn.DB().Deprecation("person/email")
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	ns, err := conn.DB().Namespace("person")
+	if assert.NoError(t, err) {
+		var names []string
+		for _, d := range ns.Deprecations {
+			names = append(names, d.Attribute.Name)
+		}
+		assert.Equal(t, []string{"person/firstName", "person/ssn"}, names)
+	}
+	deprecations, err := conn.DB().Deprecations()
+	if assert.NoError(t, err) {
+		assert.Len(t, deprecations, 2)
+	}
+}
+
+// manualClock is a Clock that only moves when it is advanced.
+type manualClock struct {
+	now time.Time
+}
+
+func (c *manualClock) Now() time.Time {
+	return c.now
+}
+
+func TestHistoryRetention(t *testing.T) {
+	day := 24 * time.Hour
+	clock := &manualClock{now: time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)}
+	conn := newMemoryConnectionWithConfig(store.Config{Clock: clock})
+	_, err := conn.Assert(
+		store.EntityData{"db/ident": "db.namespace/session", "db/historyRetention": "90d"},
+		store.EntityData{"db/ident": "session/token", "db/type": "db.type/string"},
+		store.EntityData{"db/ident": "session/tags", "db/type": "db.type/string", "db/cardinality": "db.cardinality/many"},
+		store.EntityData{"db/ident": "session/audit", "db/type": "db.type/string", "db/historyRetention": "3650d"},
+	)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = conn.Assert(store.EntityData{"db/ident": "session/note", "db/historyRetention": "soon"})
+	assert.ErrorIs(t, err, store.ErrSchemaViolation)
+
+	policies, err := conn.DB().RetentionPolicies()
+	if assert.NoError(t, err) {
+		assert.Equal(t, []store.RetentionPolicy{
+			{Attribute: "session/*", Keep: 90 * day},
+			{Attribute: "session/audit", Keep: 3650 * day},
+		}, policies)
+	}
+
+	res, err := conn.Assert(store.EntityData{
+		"db/id":         store.NamedTempID("session"),
+		"session/token": "a",
+		"session/tags":  []store.Value{"x", "y"},
+		"session/audit": "a1",
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	session, ok := res.TempIDs.LookupTempID(store.NamedTempID("session"))
+	if !assert.True(t, ok) {
+		return
+	}
+	clock.now = clock.now.Add(10 * day)
+	res, err = conn.Assert(
+		store.Assert(session, "session/token", "b"),
+		store.Retract(session, "session/tags", "x"),
+		store.Assert(session, "session/audit", "a2"),
+	)
+	if !assert.NoError(t, err) {
+		return
+	}
+	replaced := res.DB.Basis.ID()
+	clock.now = clock.now.Add(100 * day)
+	_, err = conn.Assert(store.Assert(session, "session/token", "c"))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// History that was superseded more than 90 days ago expires, except for
+	// session/audit, which is kept for longer.
+	type entry struct {
+		Attribute string
+		Value     store.Value
+		Mode      store.AssertMode
+	}
+	entries := func(assertions []store.ResolvedAssertion) []entry {
+		var out []entry
+		for _, ra := range assertions {
+			ident, err := store.ResolveIdent(conn, ra.Attribute)
+			assert.NoError(t, err)
+			out = append(out, entry{ident.Name, ra.Value, ra.Mode()})
+		}
+		return out
+	}
+	expired, err := conn.DB().PreviewRetention()
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.ElementsMatch(t, []entry{
+		{"session/token", "a", store.AssertModeAddition},
+		{"session/tags", "x", store.AssertModeAddition},
+		{"session/tags", "x", store.AssertModeRetraction},
+	}, entries(expired))
+
+	// Policies that are not in the schema may be previewed too.
+	expired, err = conn.DB().PreviewRetention(store.RetentionPolicy{Attribute: "session/audit", Keep: 30 * day})
+	if assert.NoError(t, err) {
+		assert.Equal(t, []entry{{"session/audit", "a1", store.AssertModeAddition}}, entries(expired))
+	}
+
+	collected, err := conn.NewHistoryCollector(time.Hour).Collect()
+	if assert.NoError(t, err) {
+		assert.Equal(t, 3, collected)
+	}
+	expired, err = conn.DB().PreviewRetention()
+	if assert.NoError(t, err) {
+		assert.Empty(t, expired)
+	}
+
+	// Views within the retention are unaffected.
+	data, err := conn.DB().AsOf(replaced).Pull(session, store.PullAttr{Attribute: "session/token"}, store.PullAttr{Attribute: "session/tags"})
+	if assert.NoError(t, err) {
+		assert.Equal(t, store.EntityData{"session/token": "b", "session/tags": []store.Value{"y"}}, data)
+	}
+	data, err = conn.DB().Pull(session, store.PullAttr{Attribute: "session/token"}, store.PullAttr{Attribute: "session/audit"})
+	if assert.NoError(t, err) {
+		assert.Equal(t, store.EntityData{"session/token": "c", "session/audit": "a2"}, data)
+	}
+}
+
+func TestSchemaFile(t *testing.T) {
+	conn := newTestConn()
+	_, err := conn.Assert(
+		store.EntityData{"db/ident": "db.namespace/person", "db/doc": "People and their pets."},
+		store.EntityData{"db/ident": "color/red"},
+		store.EntityData{"db/ident": "pet/color", "db/type": "db.type/ref", "db/cardinality": "db.cardinality/one"},
+		store.EntityData{
+			"db/ident":               "person/fullName",
+			"db/type":                "db.type/composite",
+			"db/compositeComponents": store.Tuple{store.Ident{Name: "person/firstName"}, store.Ident{Name: "person/lastName"}},
+			"db/unique":              "db.unique/value",
+		},
+	)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	var exported strings.Builder
+	if !assert.NoError(t, conn.DB().ExportSchema(&exported)) {
+		return
+	}
+	assert.Contains(t, exported.String(), `:db/compositeComponents [:person/firstName :person/lastName]`)
+	assert.Less(t, strings.Index(exported.String(), ":db/ident :person/firstName"), strings.Index(exported.String(), ":db/ident :person/fullName"))
+
+	// Applying the schema to an empty database reproduces it.
+	other := newMemoryConnection()
+	if _, err := other.ApplySchema(strings.NewReader(exported.String())); !assert.NoError(t, err) {
+		return
+	}
+	var reexported strings.Builder
+	if assert.NoError(t, other.DB().ExportSchema(&reexported)) {
+		assert.Equal(t, exported.String(), reexported.String())
+	}
+
+	// Applying it again leaves the schema unchanged.
+	_, err = other.ApplySchema(strings.NewReader(exported.String()))
+	assert.NoError(t, err)
+	reexported.Reset()
+	if assert.NoError(t, other.DB().ExportSchema(&reexported)) {
+		assert.Equal(t, exported.String(), reexported.String())
+	}
+
+	_, err = other.ApplySchema(strings.NewReader("[{:db/ident :thing/name\n :db/type}]"))
+	var syntaxErr *store.EDNSyntaxError
+	if assert.ErrorAs(t, err, &syntaxErr) {
+		assert.Equal(t, 1, syntaxErr.Line)
+	}
+	_, err = other.ApplySchema(strings.NewReader(`[{:db/doc "No ident."}]`))
+	assert.Error(t, err)
+}
+
+func TestAssertDryRun(t *testing.T) {
+	conn := newTestConn()
+	before := conn.DB().Basis
+
+	res, err := conn.AssertDryRun(
+		store.EntityData{"db/ident": "person/nickname", "db/type": "db.type/string"},
+		store.EntityData{"db/id": store.NamedTempID("alice"), "person/email": "alice@example.com"},
+	)
+	if !assert.NoError(t, err) {
+		return
+	}
+	aliceID := res.Names["alice"]
+	assert.NotZero(t, aliceID)
+	assert.Equal(t, []store.ID{aliceID}, res.NewEntities())
+	var emails []store.Value
+	for _, ra := range res.Data {
+		if ra.EntityID == aliceID {
+			emails = append(emails, ra.Value)
+		}
+	}
+	assert.Equal(t, []store.Value{"alice@example.com"}, emails)
+	assert.Equal(t, before, res.DB.Basis)
+
+	// Nothing was written.
+	assert.Equal(t, before, conn.DB().Basis)
+	_, err = store.NewLookup("person/email", "alice@example.com").Resolve(conn)
+	assert.Error(t, err)
+	_, err = store.ResolveIdent(conn, "person/nickname")
+	assert.Error(t, err)
+
+	// Transactions that would fail fail in the same way.
+	_, err = conn.Assert(store.EntityData{"person/email": "bob@example.com"})
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = conn.AssertDryRun(store.WithNoResolveUnique(), store.EntityData{"person/email": "bob@example.com"})
+	assert.ErrorIs(t, err, store.ErrConflict)
+	_, err = conn.AssertDryRun(store.Assert("no/such-attr", "db/doc", "Nothing."))
+	assert.Error(t, err)
+}
+
+func TestTxLog(t *testing.T) {
+	conn := newTestConn()
+	first, err := conn.Assert(store.EntityData{"person/email": "alice@example.com", "person/firstName": "Alice"})
+	if !assert.NoError(t, err) {
+		return
+	}
+	alice := first.NewEntities()[0]
+	second, err := conn.Assert(store.Retract(alice, "person/firstName", "Alice"))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	entries, err := conn.DB().TxLog(first.TxID(), 0)
+	if !assert.NoError(t, err) || !assert.Len(t, entries, 2) {
+		return
+	}
+	assert.Equal(t, first.TxID(), entries[0].Tx)
+	assert.Equal(t, first.Tx().Time(), entries[0].CommitTime)
+	assert.ElementsMatch(t, first.Data, entries[0].Data)
+	assert.Equal(t, second.TxID(), entries[1].Tx)
+	if assert.Len(t, entries[1].Data, 3) {
+		assert.Equal(t, alice, entries[1].Data[0].EntityID)
+		assert.Equal(t, store.AssertModeRetraction, entries[1].Data[0].Mode())
+	}
+
+	entries, err = conn.DB().TxLog(first.TxID(), 1)
+	if assert.NoError(t, err) && assert.Len(t, entries, 1) {
+		assert.Equal(t, first.TxID(), entries[0].Tx)
+	}
+	entries, err = conn.DB().AsOf(first.TxID()).TxLog(0, 0)
+	if assert.NoError(t, err) && assert.NotEmpty(t, entries) {
+		assert.Equal(t, first.TxID(), entries[len(entries)-1].Tx)
+	}
+}
+
+func TestEntityHistory(t *testing.T) {
+	conn := newTestConn()
+	first, err := conn.Assert(store.EntityData{"person/email": "alice@example.com", "person/firstName": "Alice"})
+	if !assert.NoError(t, err) {
+		return
+	}
+	alice := store.NewLookup("person/email", "alice@example.com")
+	second, err := conn.Assert(store.Retract(first.NewEntities()[0], "person/firstName", "Alice"))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	history, err := conn.DB().EntityHistory(alice)
+	if !assert.NoError(t, err) || !assert.Len(t, history, 3) {
+		return
+	}
+	for _, ra := range history[:2] {
+		assert.Equal(t, first.TxID(), ra.Tx)
+		assert.Equal(t, store.AssertModeAddition, ra.Mode())
+	}
+	assert.Equal(t, second.TxID(), history[2].Tx)
+	assert.Equal(t, store.AssertModeRetraction, history[2].Mode())
+	assert.Equal(t, "Alice", history[2].Value)
+
+	history, err = conn.DB().AsOf(first.TxID()).EntityHistory(alice)
+	if assert.NoError(t, err) {
+		assert.Len(t, history, 2)
+	}
+}
+
+func TestSlowLog(t *testing.T) {
+	var logged bytes.Buffer
+	conn := newMemoryConnectionWithConfig(store.Config{
+		SlowLog: store.SlowLogConfig{
+			TxThreshold:    time.Nanosecond,
+			QueryThreshold: time.Nanosecond,
+			Size:           3,
+			Logger:         slog.New(slog.NewTextHandler(&logged, nil)),
+		},
+	})
+	res, err := conn.Assert(store.EntityData{"db/ident": "person/name", "db/type": "db.type/string"})
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = conn.DB().Query(store.Query{
+		Find:  []store.Var{"?e"},
+		Where: []store.Clause{store.Pattern{Entity: store.Var("?e"), Attribute: "person/name", Value: "Ada"}},
+	})
+	assert.NoError(t, err)
+	_, err = conn.DB().Query(store.Query{Find: []store.Var{"?unbound"}})
+	assert.Error(t, err)
+
+	// The log keeps only the most recent entries.
+	entries := conn.SlowLog()
+	if !assert.Len(t, entries, 3) {
+		return
+	}
+	stages := func(entry store.SlowLogEntry) []string {
+		var names []string
+		var total time.Duration
+		for _, stage := range entry.Stages {
+			names = append(names, stage.Stage)
+			total += stage.Duration
+		}
+		assert.Equal(t, entry.Duration, total)
+		return names
+	}
+
+	tx := entries[0]
+	assert.Equal(t, store.SlowLogTx, tx.Kind)
+	assert.Equal(t, res.TxID(), tx.Tx)
+	assert.Equal(t, len(res.Data), tx.Assertions)
+	assert.Equal(t, []string{"add", "resolve", "validate", "write"}, stages(tx))
+	assert.NoError(t, tx.Err)
+
+	q := entries[1]
+	assert.Equal(t, store.SlowLogQuery, q.Kind)
+	assert.Len(t, q.Clauses, 1)
+	assert.Zero(t, q.Rows)
+	assert.Equal(t, []string{"plan", "evaluate", "project"}, stages(q))
+
+	failed := entries[2]
+	assert.Error(t, failed.Err)
+	assert.Equal(t, []string{"plan", "evaluate", "project"}, stages(failed))
+
+	assert.Contains(t, logged.String(), "slow tx")
+	assert.Contains(t, logged.String(), "slow query")
+
+	// Operations under the thresholds are not logged.
+	fast := newMemoryConnection()
+	_, err = fast.Assert(store.EntityData{"db/ident": "person/name", "db/type": "db.type/string"})
+	assert.NoError(t, err)
+	assert.Empty(t, fast.SlowLog())
+}
+
+func TestAdmission(t *testing.T) {
+	ac := store.NewAdmissionController(store.AdmissionConfig{Rate: 0.001, Burst: 2})
+	conn := newMemoryConnectionWithConfig(store.Config{Admission: ac, AdmissionKey: "interactive"})
+	color := func(name string) store.Assertable {
+		return store.EntityData{"db/ident": "color/" + name}
+	}
+
+	// The bucket of each key allows a burst, then throttles.
+	for _, name := range []string{"red", "green"} {
+		_, err := conn.Assert(color(name))
+		assert.NoError(t, err)
+	}
+	_, err := conn.Assert(color("blue"))
+	var throttled *store.ThrottledError
+	if assert.ErrorAs(t, err, &throttled) {
+		assert.ErrorIs(t, err, store.ErrThrottled)
+		assert.Equal(t, "interactive", throttled.Key)
+		assert.False(t, throttled.InFlight)
+		assert.Greater(t, throttled.RetryAfter, time.Duration(0))
+	}
+	// Other keys have buckets of their own, and dry runs are not throttled.
+	_, err = conn.Assert(store.WithAdmissionKey("bulk"), color("blue"))
+	assert.NoError(t, err)
+	_, err = conn.AssertDryRun(color("cyan"))
+	assert.NoError(t, err)
+	status, err := conn.Status()
+	if assert.NoError(t, err) {
+		assert.Equal(t, store.AdmissionStats{Admitted: 3, Throttled: 1}, status.Admission)
+	}
+
+	// A throttled transaction may be committed again once it is admitted,
+	// and transactions may wait to be admitted.
+	ac = store.NewAdmissionController(store.AdmissionConfig{Rate: 50, Burst: 1})
+	conn = newMemoryConnectionWithConfig(store.Config{Admission: ac})
+	_, err = conn.Assert(color("red"))
+	assert.NoError(t, err)
+	tx := conn.NewTx()
+	assert.NoError(t, tx.Add(color("green")))
+	_, err = tx.Commit()
+	assert.ErrorIs(t, err, store.ErrThrottled)
+	time.Sleep(100 * time.Millisecond)
+	_, err = tx.Commit()
+	assert.NoError(t, err)
+	ac = store.NewAdmissionController(store.AdmissionConfig{Rate: 50, Burst: 1, MaxWait: time.Second})
+	conn = newMemoryConnectionWithConfig(store.Config{Admission: ac})
+	for _, name := range []string{"red", "green", "blue"} {
+		_, err := conn.Assert(color(name))
+		assert.NoError(t, err)
+	}
+
+	// Transactions beyond the cap on transactions in flight are throttled.
+	blocked, unblock := make(chan struct{}), make(chan struct{})
+	ac = store.NewAdmissionController(store.AdmissionConfig{MaxInFlight: 1})
+	conn = newMemoryConnectionWithConfig(store.Config{
+		Admission: ac,
+		Outbox: func(data []store.ResolvedAssertion) ([]store.OutboxEvent, error) {
+			if blocked != nil {
+				close(blocked)
+				blocked = nil
+				<-unblock
+			}
+			return nil, nil
+		},
+	})
+	wait := blocked
+	done := make(chan error)
+	go func() {
+		_, err := conn.Assert(color("red"))
+		done <- err
+	}()
+	<-wait
+	_, err = conn.Assert(store.WithAdmissionKey("bulk"), color("green"))
+	if assert.ErrorAs(t, err, &throttled) {
+		assert.True(t, throttled.InFlight)
+	}
+	assert.Equal(t, int64(1), ac.Stats().InFlight)
+	close(unblock)
+	assert.NoError(t, <-done)
+	_, err = conn.Assert(color("green"))
+	assert.NoError(t, err)
+	assert.Equal(t, store.AdmissionStats{Admitted: 2, Throttled: 1}, ac.Stats())
+}
+
+func TestMemoryBudget(t *testing.T) {
+	const budget = 64 << 10
+	conn := newMemoryConnectionWithConfig(store.Config{MemoryBudget: budget, EntityCacheSize: 1000})
+	_, err := conn.Assert(
+		store.EntityData{"db/ident": "doc/body", "db/type": "db.type/string"},
+		store.EntityData{"db/ident": "doc/title", "db/type": "db.type/string"},
+	)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// Reading an entity larger than the budget fails rather than holding it.
+	res, err := conn.Assert(store.EntityData{"doc/title": "Huge", "doc/body": strings.Repeat("x", budget)})
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = conn.GetEntity(res.NewEntities()[0])
+	var budgetErr *store.MemoryBudgetError
+	if assert.ErrorAs(t, err, &budgetErr) {
+		assert.ErrorIs(t, err, store.ErrMemoryBudget)
+		assert.Equal(t, "scan", budgetErr.Operation)
+		assert.Equal(t, int64(budget), budgetErr.Budget)
+	}
+
+	// The entity cache evicts entities to stay within the budget.
+	var docs []store.Assertable
+	for i := 0; i < 200; i++ {
+		docs = append(docs, store.EntityData{"doc/title": fmt.Sprintf("Doc %d", i), "doc/body": strings.Repeat("y", 1024)})
+	}
+	res, err = conn.Assert(docs...)
+	if !assert.NoError(t, err) {
+		return
+	}
+	for _, eid := range res.NewEntities() {
+		_, err := conn.GetEntity(eid)
+		assert.NoError(t, err)
+	}
+	stats := conn.MemoryStats()
+	assert.Greater(t, stats.Used, int64(0))
+	assert.LessOrEqual(t, stats.Peak, int64(budget))
+
+	// Queries whose bindings would exceed the budget fail, after evicting
+	// cached entities to make room.
+	_, err = conn.DB().Query(store.Query{
+		Find: []store.Var{"?a", "?b"},
+		Where: []store.Clause{
+			store.Pattern{Entity: store.Var("?a"), Attribute: "doc/title", Value: store.Var("?ta")},
+			store.Pattern{Entity: store.Var("?b"), Attribute: "doc/title", Value: store.Var("?tb")},
+		},
+	})
+	if assert.ErrorAs(t, err, &budgetErr) {
+		assert.Equal(t, "query", budgetErr.Operation)
+	}
+	reclaimed := conn.MemoryStats()
+	assert.Less(t, reclaimed.Used, stats.Used)
+
+	// Memory reserved by scans and queries is released when they end.
+	rows, err := conn.DB().Query(store.Query{
+		Find:  []store.Var{"?a"},
+		Where: []store.Clause{store.Pattern{Entity: store.Var("?a"), Attribute: "doc/title", Value: "Doc 7"}},
+	})
+	if assert.NoError(t, err) {
+		assert.Len(t, rows, 1)
+	}
+	after := conn.MemoryStats()
+	assert.Equal(t, reclaimed.Used, after.Used)
+	assert.Equal(t, uint64(2), after.Rejected)
+
+	// Bindings are projected as they are produced, so a query only needs room
+	// for its distinct rows rather than for every binding that produces them.
+	conn = newMemoryConnectionWithConfig(store.Config{MemoryBudget: budget})
+	docs = docs[:0]
+	for i := 0; i < 50; i++ {
+		docs = append(docs, store.EntityData{"db/ident": fmt.Sprintf("doc/%d", i)})
+	}
+	if _, err := conn.Assert(docs...); !assert.NoError(t, err) {
+		return
+	}
+	rows, err = conn.DB().Query(store.Query{
+		Find: []store.Var{"?a"},
+		Where: []store.Clause{
+			store.Pattern{Entity: store.Var("?a"), Attribute: "db/ident", Value: store.Var("?ia")},
+			store.Pattern{Entity: store.Var("?b"), Attribute: "db/ident", Value: store.Var("?ib")},
+		},
+	})
+	assert.NoError(t, err)
+	assert.Greater(t, len(rows), 50)
+}
+
+func BenchmarkAssert(b *testing.B) {
+	conn := newMemoryConnection()
+	_, err := conn.Assert(
+		store.EntityData{"db/ident": "doc/title", "db/type": "db.type/string"},
+		store.EntityData{"db/ident": "doc/size", "db/type": "db.type/int64"},
+		store.EntityData{"db/ident": "doc/public", "db/type": "db.type/boolean"},
+	)
+	if err != nil {
+		b.Fatal(err)
+	}
+	docs := make([]store.Assertable, 100)
+	for i := range docs {
+		docs[i] = store.EntityData{"doc/title": fmt.Sprintf("Doc %d", i), "doc/size": int64(i), "doc/public": i%2 == 0}
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := conn.Assert(docs...); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestComputedAttributes(t *testing.T) {
+	conn := newTestConn()
+	fullName := store.ComputedAttribute{
+		Fn: func(data store.EntityData) (store.Value, bool, error) {
+			first, ok := data["person/firstName"].(string)
+			if !ok {
+				return nil, false, nil
+			}
+			last, _ := data["person/lastName"].(string)
+			return strings.TrimSpace(first + " " + last), true, nil
+		},
+	}
+	assert.ErrorContains(t, conn.RegisterComputedAttribute("fullName", fullName), "no namespace")
+	assert.ErrorContains(t, conn.RegisterComputedAttribute("person/email", fullName), "already a stored attribute")
+	if !assert.NoError(t, conn.RegisterComputedAttribute("person/fullName", fullName)) {
+		return
+	}
+	assert.ErrorContains(t, conn.RegisterComputedAttribute("person/fullName", fullName), "already registered")
+
+	res, err := conn.Assert(
+		store.EntityData{"person/email": "andrew@example.com", "person/firstName": "Andrew", "person/lastName": "Meredith"},
+		store.EntityData{"person/email": "anon@example.com"},
+	)
+	if !assert.NoError(t, err) {
+		return
+	}
+	andrew, anon := res.NewEntities()[0], res.NewEntities()[1]
+
+	// Computed attributes appear in GetData, marked as computed.
+	ent, err := conn.GetEntity(andrew)
+	if !assert.NoError(t, err) {
+		return
+	}
+	data, err := ent.GetData(conn)
+	assert.NoError(t, err)
+	assert.Equal(t, store.ComputedValue{Value: "Andrew Meredith"}, data["person/fullName"])
+	encoded, err := json.Marshal(data["person/fullName"])
+	assert.NoError(t, err)
+	assert.Equal(t, `"Andrew Meredith"`, string(encoded))
+
+	// Data read with GetData may be asserted again, since computed values
+	// are skipped.
+	data["person/firstName"] = "Andy"
+	_, err = conn.Assert(data)
+	assert.NoError(t, err)
+
+	// Pull selects computed attributes by name, and their defaults apply to
+	// entities for which they have no value.
+	pattern := []store.PullAttr{
+		{Attribute: "person/email", As: "email"},
+		{Attribute: "person/fullName", As: "name", Default: "unknown"},
+	}
+	pulled, err := conn.DB().Pull(andrew, pattern...)
+	assert.NoError(t, err)
+	assert.Equal(t, store.EntityData{"email": "andrew@example.com", "name": store.ComputedValue{Value: "Andy Meredith"}}, pulled)
+	pulled, err = conn.DB().Pull(anon, pattern...)
+	assert.NoError(t, err)
+	assert.Equal(t, store.EntityData{"email": "anon@example.com", "name": "unknown"}, pulled)
+
+	// Computed attributes are never stored.
+	_, err = conn.Assert(store.Assert(andrew, "person/fullName", "Someone Else"))
+	assert.ErrorIs(t, err, store.ErrComputedAttribute)
+	_, err = conn.Assert(store.EntityData{"db/ident": "person/fullName", "db/type": "db.type/string"})
+	assert.ErrorIs(t, err, store.ErrComputedAttribute)
+}
+
+func TestReplay(t *testing.T) {
+	y2020 := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	conn := newTestConn()
+	res, err := conn.Assert(
+		store.EntityData{"db/id": store.NamedTempID("pet"), "pet/id": "p1", "pet/name": "Rex"},
+		store.EntityData{"db/id": store.NamedTempID("alice"), "person/email": "alice@example.com", "person/pets": store.NamedTempID("pet")},
+	)
+	if !assert.NoError(t, err) {
+		return
+	}
+	alice, _ := res.TempIDs.LookupTempID(store.NamedTempID("alice"))
+	_, err = conn.Assert(
+		store.Retract(alice, "person/email", "alice@example.com"),
+		store.Assert(alice, "person/email", "alice@example.org").ValidDuring(y2020, time.Time{}),
+	)
+	assert.NoError(t, err)
+	last, err := conn.Assert(store.EntityData{"db/ident": "person/nickname", "db/type": "db.type/string", "db/cardinality": "db.cardinality/one"})
+	assert.NoError(t, err)
+	nickname, err := store.ResolveIdent(conn, "person/nickname")
+	assert.NoError(t, err)
+
+	entries, err := conn.DB().TxLog(0, 0)
+	if !assert.NoError(t, err) {
+		return
+	}
+	var buf bytes.Buffer
+	w := store.NewTxLogWriter(&buf)
+	for _, entry := range entries {
+		assert.NoError(t, w.Write(entry))
+	}
+
+	replayed := newEmptyConnection(store.Config{})
+	r := store.NewTxLogReader(&buf)
+	for {
+		entry, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.NoError(t, replayed.Replay(entry))
+	}
+	assert.Equal(t, conn.DB().Basis, replayed.DB().Basis)
+
+	// The replayed store has the same log, and so the same indexes.
+	replayedEntries, err := replayed.DB().TxLog(0, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, entries, replayedEntries)
+	ent, err := replayed.DB().AsOf(res.TxID()).GetEntity(alice)
+	if assert.NoError(t, err) {
+		email, err := ent.Get(replayed, "person/email")
+		assert.NoError(t, err)
+		assert.Equal(t, "alice@example.com", email)
+	}
+	ident, err := store.ResolveIdent(replayed, "person/nickname")
+	assert.NoError(t, err)
+	assert.Equal(t, nickname, ident)
+
+	// Transactions may only be replayed in commit order, and new
+	// transactions do not reuse replayed IDs.
+	assert.ErrorIs(t, replayed.Replay(entries[len(entries)-1]), store.ErrReplayed)
+	res, err = replayed.Assert(store.EntityData{"person/email": "bob@example.com"})
+	if assert.NoError(t, err) {
+		assert.Greater(t, res.TxID(), last.TxID())
+		assert.Greater(t, res.NewEntities()[0], ident.ID)
+	}
+}
+
+func TestCommitHooks(t *testing.T) {
+	type userKey struct{}
+	errForbidden := errors.New("forbidden")
+	var reports []store.TxReport
+	conn := newMemoryConnectionWithConfig(store.Config{
+		BeforeCommit: func(ctx context.Context, assertions []store.ResolvedAssertion) error {
+			if ctx.Value(userKey{}) != "admin" {
+				return errForbidden
+			}
+			return nil
+		},
+		AfterCommit: func(report store.TxReport) {
+			reports = append(reports, report)
+		},
+	})
+	// The system schema is reported, but it is not checked.
+	assert.Len(t, reports, 1)
+
+	schema := store.EntityData{"db/ident": "note/text", "db/type": "db.type/string", "db/cardinality": "db.cardinality/one"}
+	_, err := conn.Assert(schema)
+	assert.ErrorIs(t, err, errForbidden)
+	_, err = conn.AssertDryRun(schema)
+	assert.ErrorIs(t, err, errForbidden)
+	assert.Len(t, reports, 1)
+
+	admin := store.WithContext(context.WithValue(context.Background(), userKey{}, "admin"))
+	res, err := conn.Assert(admin, schema)
+	if !assert.NoError(t, err) {
+		return
+	}
+	tx := conn.NewTx(admin)
+	assert.NoError(t, tx.Add(store.EntityData{"note/text": "hello"}))
+	res2, err := tx.Commit()
+	if !assert.NoError(t, err) {
+		return
+	}
+	if assert.Len(t, reports, 3) {
+		assert.Equal(t, res.TxID(), reports[1].Tx)
+		assert.Equal(t, res2.TxID(), reports[2].Tx)
+		assert.Equal(t, res2.Data, reports[2].TxData)
+	}
+
+	// Transactions of peers are checked by the hook of their transactor,
+	// which also reports them.
+	peer, stop := conn.NewPeer(store.PeerConfig{})
+	defer stop()
+	_, err = peer.Assert(store.EntityData{"note/text": "from a peer"})
+	assert.ErrorIs(t, err, errForbidden)
+	_, err = peer.Assert(admin, store.EntityData{"note/text": "from a peer"})
+	assert.NoError(t, err)
+	assert.Len(t, reports, 4)
+}
+
+func TestReadYourWrites(t *testing.T) {
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true).WithLogger(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	sto, err := badgerImpl.New(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newConn := func() *store.Connection {
+		return store.NewConnection(store.Config{IdentManager: sto, IDManager: sto, Indexer: sto})
+	}
+	conn := newConn()
+	if !assert.NoError(t, conn.InitializeDB()) {
+		return
+	}
+	_, err = conn.Assert(store.EntityData{"db/ident": "note/text", "db/type": "db.type/string", "db/cardinality": "db.cardinality/one"})
+	if !assert.NoError(t, err) {
+		return
+	}
+	res, err := conn.Assert(store.EntityData{"db/id": store.NamedTempID("note"), "note/text": "draft"})
+	if !assert.NoError(t, err) {
+		return
+	}
+	note, _ := res.TempIDs.LookupTempID(store.NamedTempID("note"))
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	// A peer that has cached the entity reflects the write once it reaches
+	// the basis.
+	peer, stop := conn.NewPeer(store.PeerConfig{})
+	defer stop()
+	_, err = peer.GetEntity(note)
+	assert.NoError(t, err)
+	res, err = conn.Assert(store.Assert(note, "note/text", "final"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	peerDB, err := peer.AtLeast(ctx, res.Basis())
+	if assert.NoError(t, err) {
+		assert.GreaterOrEqual(t, peerDB.Basis.ID(), res.Basis())
+		ent, err := peerDB.GetEntity(note)
+		assert.NoError(t, err)
+		text, _ := ent.Get(peer, "note/text")
+		assert.Equal(t, "final", text)
+	}
+
+	// A connection that shares storage finds the transaction there.
+	other := newConn()
+	otherDB, err := other.DB().AtLeast(ctx, res.Basis())
+	if assert.NoError(t, err) {
+		assert.Equal(t, res.Basis(), otherDB.Basis.ID())
+	}
+
+	// Views that cannot advance fail, and waiting ends with ctx.
+	_, err = conn.DB().AsOf(res.Basis()-1).AtLeast(ctx, res.Basis())
+	assert.ErrorIs(t, err, store.ErrStaleBasis)
+	short, cancelShort := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancelShort()
+	_, err = peer.AtLeast(short, res.Basis()+1000)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	_, err = other.AtLeast(short, res.Basis()+1000)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	// Once the latest of several concurrent writes is reflected, so are the
+	// others.
+	results := make(chan *store.AssertResult)
+	for i := 0; i < 16; i++ {
+		go func(i int) {
+			res, err := conn.Assert(store.EntityData{"note/text": fmt.Sprintf("note %d", i)})
+			assert.NoError(t, err)
+			results <- res
+		}(i)
+	}
+	var latest *store.AssertResult
+	var writes []*store.AssertResult
+	for i := 0; i < 16; i++ {
+		res := <-results
+		if res == nil {
+			return
+		}
+		writes = append(writes, res)
+		if latest == nil || res.Basis() > latest.Basis() {
+			latest = res
+		}
+	}
+	otherDB, err = other.AtLeast(ctx, latest.Basis())
+	if !assert.NoError(t, err) {
+		return
+	}
+	for _, res := range writes {
+		ent, err := otherDB.GetEntity(res.NewEntities()[0])
+		if assert.NoError(t, err) {
+			text, _ := ent.Get(other, "note/text")
+			assert.NotEmpty(t, text)
+		}
+	}
+}
+
+func TestBasisTokens(t *testing.T) {
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true).WithLogger(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	sto, err := badgerImpl.New(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newConn := func() *store.Connection {
+		return store.NewConnection(store.Config{IdentManager: sto, IDManager: sto, Indexer: sto})
+	}
+	conn := newConn()
+	if !assert.NoError(t, conn.InitializeDB()) {
+		return
+	}
+	res, err := conn.Assert(store.EntityData{"db/ident": "note/text", "db/type": "db.type/string", "db/cardinality": "db.cardinality/one"})
+	if !assert.NoError(t, err) {
+		return
+	}
+	token := res.Token()
+	assert.Equal(t, token, res.DB.Token())
+	assert.Equal(t, token, conn.DB().Token())
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	// Another connection reads the write once it has been handed the token.
+	other := newConn()
+	otherDB, err := other.Since(ctx, token)
+	if assert.NoError(t, err) {
+		assert.Equal(t, res.Basis(), otherDB.Basis.ID())
+		assert.Equal(t, token, otherDB.Token())
+	}
+
+	// An empty token requires nothing, and tokens that were not returned by
+	// Token are rejected.
+	latest := conn.DB()
+	sameDB, err := latest.Since(ctx, "")
+	assert.NoError(t, err)
+	assert.Equal(t, latest.Basis.ID(), sameDB.Basis.ID())
+	for _, bad := range []string{"not a token", "AA", token + "AA"} {
+		_, err = conn.Since(ctx, bad)
+		assert.ErrorIs(t, err, store.ErrInvalidToken, bad)
+	}
+}
+
+func TestValueComparison(t *testing.T) {
+	now := time.Now()
+	id := uuid.Must(uuid.NewV4())
+	for _, tc := range []struct {
+		a, b store.Value
+		want int
+	}{
+		{int64(1), int64(2), -1},
+		{"b", "a", 1},
+		{now, now.In(time.FixedZone("EST", -5*3600)), 0},
+		{now.Add(-time.Second), now, -1},
+		{[]byte("ab"), []byte("ab"), 0},
+		{[]byte("ab"), []byte("b"), -1},
+		{id, id, 0},
+		{uuid.UUID{}, id, -1},
+		{store.BlobDigest{1}, store.BlobDigest{1}, 0},
+		{store.BlobDigest{1}, store.BlobDigest{2}, -1},
+		{store.ID(3), store.ID(2), 1},
+		{math.NaN(), math.NaN(), 0},
+		{math.NaN(), -math.MaxFloat64, -1},
+		{false, true, -1},
+		{store.Tuple{"a", int64(1)}, store.Tuple{"a", int64(1)}, 0},
+		{store.Tuple{"a"}, store.Tuple{"a", int64(1)}, -1},
+		{store.Tuple{now}, store.Tuple{now.UTC()}, 0},
+		// Values of different types are never equal, but they are ordered.
+		{int64(1), int32(1), 1},
+		{nil, false, -1},
+		{"1", int64(1), 1},
+	} {
+		assert.Equal(t, tc.want, store.CompareValues(tc.a, tc.b), "%#v <=> %#v", tc.a, tc.b)
+		assert.Equal(t, -tc.want, store.CompareValues(tc.b, tc.a), "%#v <=> %#v", tc.b, tc.a)
+		assert.Equal(t, tc.want == 0, store.ValueEqual(tc.a, tc.b), "%#v == %#v", tc.a, tc.b)
+	}
+}
+
+func TestTxRoots(t *testing.T) {
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true).WithLogger(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	sto, err := badgerImpl.New(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := store.NewConnection(store.Config{IdentManager: sto, IDManager: sto, Indexer: sto})
+	if !assert.NoError(t, conn.InitializeDB()) {
+		return
+	}
+	_, err = conn.Assert(
+		store.EntityData{"db/ident": "note/text", "db/type": "db.type/string", "db/cardinality": "db.cardinality/one"},
+		store.EntityData{"db/ident": "note/at", "db/type": "db.type/timestamp", "db/cardinality": "db.cardinality/one"},
+	)
+	if !assert.NoError(t, err) {
+		return
+	}
+	res, err := conn.Assert(store.EntityData{"db/id": store.NamedTempID("note"), "note/text": "draft", "note/at": time.Now()})
+	if !assert.NoError(t, err) {
+		return
+	}
+	note, _ := res.TempIDs.LookupTempID(store.NamedTempID("note"))
+
+	// The root does not depend on the order of the facts.
+	root, err := store.TxRoot(res.Data)
+	assert.NoError(t, err)
+	reversed := make([]store.ResolvedAssertion, len(res.Data))
+	for i, ra := range res.Data {
+		reversed[len(res.Data)-1-i] = ra
+	}
+	again, err := store.TxRoot(reversed)
+	assert.NoError(t, err)
+	assert.Equal(t, root, again)
+
+	ok, err := conn.DB().VerifyTx(res.TxID())
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	verification, err := conn.DB().VerifyTxLog()
+	if assert.NoError(t, err) {
+		assert.Equal(t, 3, verification.Verified)
+		assert.Zero(t, verification.Unrooted)
+		assert.Empty(t, verification.Failed)
+	}
+
+	// A replica with the same transactions has the same root.
+	entries, err := conn.DB().TxLog(0, 0)
+	if !assert.NoError(t, err) {
+		return
+	}
+	replica := newEmptyConnection(store.Config{})
+	for _, entry := range entries {
+		assert.NoError(t, replica.Replay(entry))
+	}
+	replicated, err := replica.DB().VerifyTxLog()
+	if assert.NoError(t, err) {
+		assert.Equal(t, verification, replicated)
+	}
+
+	// A fact that is slipped into a committed transaction is detected.
+	text, err := store.ResolveIdent(conn, "note/text")
+	if !assert.NoError(t, err) {
+		return
+	}
+	tampered := store.NewResolvedAssertion(store.Fact{
+		EntityID:  note,
+		Attribute: text.ID,
+		Value:     "forged",
+		Tx:        res.TxID(),
+	}, store.AssertModeAddition)
+	if !assert.NoError(t, sto.Write([]store.ResolvedAssertion{tampered}, nil)) {
+		return
+	}
+	_, err = conn.DB().VerifyTx(res.TxID())
+	assert.ErrorIs(t, err, store.ErrIntegrity)
+	verification, err = conn.DB().VerifyTxLog()
+	if assert.NoError(t, err) {
+		assert.Equal(t, 2, verification.Verified)
+		assert.Len(t, verification.Failed, 1)
+		assert.NotEqual(t, replicated.Root, verification.Root)
+	}
+
+	// A tampered log is not replayed.
+	entries, err = conn.DB().TxLog(0, 0)
+	if !assert.NoError(t, err) {
+		return
+	}
+	replica = newEmptyConnection(store.Config{})
+	for _, entry := range entries {
+		if err = replica.Replay(entry); err != nil {
+			break
+		}
+	}
+	assert.ErrorIs(t, err, store.ErrIntegrity)
+}
+
+func TestVerifyLog(t *testing.T) {
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true).WithLogger(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	sto, err := badgerImpl.New(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := store.NewConnection(store.Config{IdentManager: sto, IDManager: sto, Indexer: sto})
+	if !assert.NoError(t, conn.InitializeDB()) {
+		return
+	}
+	_, err = conn.Assert(
+		store.EntityData{"db/ident": "note/text", "db/type": "db.type/string", "db/cardinality": "db.cardinality/one"},
+		store.EntityData{"db/ident": "note/tags", "db/type": "db.type/string", "db/cardinality": "db.cardinality/many"},
+	)
+	if !assert.NoError(t, err) {
+		return
+	}
+	res, err := conn.Assert(store.EntityData{"db/id": store.NamedTempID("note"), "note/text": "draft", "note/tags": []string{"a", "b"}})
+	if !assert.NoError(t, err) {
+		return
+	}
+	note, _ := res.TempIDs.LookupTempID(store.NamedTempID("note"))
+	_, err = conn.Assert(
+		store.Assert(note, "note/text", "final"),
+		store.Retract(note, "note/tags", "a"),
+		store.Assert(note, "note/tags", "c").ValidDuring(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC), time.Time{}),
+	)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	exportLog := func() *bytes.Buffer {
+		entries, err := conn.DB().TxLog(0, 0)
+		assert.NoError(t, err)
+		var buf bytes.Buffer
+		w := store.NewTxLogWriter(&buf)
+		for _, entry := range entries {
+			assert.NoError(t, w.Write(entry))
+		}
+		return &buf
+	}
+	backup := exportLog().Bytes()
+	res2, err := conn.DB().VerifyLog(store.NewTxLogReader(bytes.NewReader(backup)))
+	if assert.NoError(t, err) {
+		assert.Equal(t, 4, res2.Verified)
+		assert.Empty(t, res2.Failed)
+		assert.True(t, res2.IndexesChecked)
+		verification, err := conn.DB().VerifyTxLog()
+		assert.NoError(t, err)
+		assert.Equal(t, verification.Root, res2.Root)
+	}
+
+	// Later transactions are allowed, but the indexes can no longer be
+	// compared with the log.
+	_, err = conn.Assert(store.Assert(note, "note/text", "edited"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	res2, err = conn.DB().VerifyLog(store.NewTxLogReader(bytes.NewReader(backup)))
+	if assert.NoError(t, err) {
+		assert.Equal(t, 4, res2.Verified)
+		assert.Equal(t, 1, res2.Later)
+		assert.Empty(t, res2.Failed)
+		assert.False(t, res2.IndexesChecked)
+	}
+
+	// A fact written to the indexes outside of any transaction changes
+	// their state.
+	text, err := store.ResolveIdent(conn, "note/text")
+	if !assert.NoError(t, err) {
+		return
+	}
+	forged := store.NewResolvedAssertion(store.Fact{EntityID: note + 100, Attribute: text.ID, Value: "forged", Tx: note + 100}, store.AssertModeAddition)
+	if !assert.NoError(t, sto.Write([]store.ResolvedAssertion{forged}, nil)) {
+		return
+	}
+	res2, err = conn.DB().VerifyLog(store.NewTxLogReader(exportLog()))
+	if assert.NoError(t, err) {
+		assert.True(t, res2.IndexesChecked)
+		assert.Len(t, res2.Failed, 2)
+		for _, err := range res2.Failed {
+			assert.ErrorIs(t, err, store.ErrIntegrity)
+		}
+	}
+}
+
+func TestInferredSchema(t *testing.T) {
+	// Without soft schema mode, unknown attributes are rejected.
+	strict := newMemoryConnection()
+	_, err := strict.Assert(store.EntityData{"sensor/reading": 21.5})
+	assert.ErrorIs(t, err, store.ErrNoSuchIdent)
+
+	conn := newMemoryConnectionWithConfig(store.Config{InferSchema: true})
+	_, err = conn.Assert(store.EntityData{"db/ident": "sensor/name", "db/type": "db.type/string", "db/unique": "db.unique/identity"})
+	if !assert.NoError(t, err) {
+		return
+	}
+	at := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	res, err := conn.Assert(
+		store.EntityData{
+			"db/id":          store.NamedTempID("sensor"),
+			"sensor/name":    "kitchen",
+			"sensor/reading": 21.5,
+			"sensor/at":      at,
+			"sensor/samples": 3,
+		},
+		store.EntityData{"sensor/calibrated": true, "sensor/of": store.NamedTempID("sensor")},
+	)
+	if !assert.NoError(t, err) {
+		return
+	}
+	sensor := res.TempIDs["sensor"]
+	entity, err := conn.GetEntity(sensor)
+	if assert.NoError(t, err) {
+		reading, err := entity.Get(conn, "sensor/reading")
+		assert.NoError(t, err)
+		assert.Equal(t, 21.5, reading)
+		samples, err := entity.Get(conn, "sensor/samples")
+		assert.NoError(t, err)
+		assert.Equal(t, int64(3), samples)
+	}
+
+	// Attributes that already exist are not inferred.
+	inferred, err := conn.DB().InferredSchema()
+	if !assert.NoError(t, err) {
+		return
+	}
+	types := make(map[string]string)
+	for _, attr := range inferred {
+		types[attr.Attribute.Name] = attr.Type.Name
+		assert.Less(t, attr.Tx, res.TxID())
+	}
+	assert.Equal(t, map[string]string{
+		"sensor/at":         "db.type/timestamp",
+		"sensor/calibrated": "db.type/boolean",
+		"sensor/of":         "db.type/ref",
+		"sensor/reading":    "db.type/float64",
+		"sensor/samples":    "db.type/int64",
+	}, types)
+
+	// Inferred attributes are ordinary attributes once created, so values of
+	// another type are rejected.
+	_, err = conn.Assert(store.Assert(sensor, "sensor/reading", "warm"))
+	assert.Error(t, err)
+
+	// Hardening an attribute removes it from the report.
+	_, err = conn.Assert(store.Retract("sensor/reading", "db/inferred", true))
+	if !assert.NoError(t, err) {
+		return
+	}
+	inferred, err = conn.DB().InferredSchema()
+	if assert.NoError(t, err) {
+		assert.Len(t, inferred, 4)
+		for _, attr := range inferred {
+			assert.NotEqual(t, "sensor/reading", attr.Attribute.Name)
+		}
+	}
+
+	// Dry runs infer attributes as Assert would, but do not create them.
+	dry, err := conn.AssertDryRun(store.EntityData{"sensor/location": "kitchen", "sensor/floor": 2})
+	if assert.NoError(t, err) {
+		var values []store.Value
+		for _, ra := range dry.Data {
+			values = append(values, ra.Value)
+		}
+		assert.Contains(t, values, "kitchen")
+		assert.Contains(t, values, int64(2))
+	}
+	_, err = conn.AssertDryRun(store.EntityData{"sensor/location": "kitchen", "sensor/name": 3})
+	assert.Error(t, err)
+	_, err = store.ResolveIdent(conn, "sensor/location")
+	assert.ErrorIs(t, err, store.ErrNoSuchIdent)
+	inferred, err = conn.DB().InferredSchema()
+	if assert.NoError(t, err) {
+		assert.Len(t, inferred, 4)
+	}
+	_, err = conn.Assert(store.EntityData{"sensor/location": "kitchen", "sensor/floor": 2})
+	assert.NoError(t, err)
+}
+
+func TestSchemaFor(t *testing.T) {
+	conn := newMemoryConnection()
+	_, err := conn.Assert(
+		store.EntityData{"db/ident": "person/email", "db/type": "db.type/string", "db/unique": "db.unique/identity", "db/indexed": true, "db/doc": "Primary email."},
+		store.EntityData{"db/ident": "person/tags", "db/type": "db.type/string", "db/cardinality": "db.cardinality/many"},
+		store.EntityData{"db/ident": "person/mail", "db/type": "db.type/string", "db/deprecated": true, "db/replacedBy": "person/email"},
+		store.EntityData{"db/ident": "color/red"},
+	)
+	if !assert.NoError(t, err) {
+		return
+	}
+	email, err := store.ResolveIdent(conn, "person/email")
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	schema, err := conn.SchemaFor("person/email")
+	if assert.NoError(t, err) {
+		assert.Equal(t, store.SchemaAttribute{
+			ID:          email.ID,
+			Type:        store.IDTypeString,
+			Cardinality: store.IDCardinalityOne,
+			Unique:      store.IDUniqueIdentity,
+			Indexed:     true,
+			Doc:         "Primary email.",
+		}, schema)
+		assert.True(t, schema.IsAttribute())
+		assert.False(t, schema.Many())
+	}
+
+	// Missing flags take their defaults.
+	schema, err = conn.DB().SchemaFor("person/tags")
+	if assert.NoError(t, err) {
+		assert.True(t, schema.Many())
+		assert.Zero(t, schema.Unique)
+		assert.False(t, schema.Indexed)
+		assert.False(t, schema.Deprecated)
+	}
+	schema, err = conn.SchemaFor("person/mail")
+	if assert.NoError(t, err) {
+		assert.Equal(t, store.IDCardinalityOne, schema.Cardinality)
+		assert.True(t, schema.Deprecated)
+		assert.Equal(t, email.ID, schema.ReplacedBy)
+	}
+
+	// System attributes are described too, and IDs are accepted.
+	schema, err = conn.SchemaFor(store.IDAlias)
+	if assert.NoError(t, err) {
+		assert.Equal(t, store.IDTypeString, schema.Type)
+		assert.True(t, schema.Many())
+		assert.Equal(t, store.IDUniqueIdentity, schema.Unique)
+	}
+
+	// Idents that are not attributes have no type.
+	schema, err = conn.SchemaFor("color/red")
+	if assert.NoError(t, err) {
+		assert.False(t, schema.IsAttribute())
+	}
+	_, err = conn.SchemaFor("person/none")
+	assert.ErrorIs(t, err, store.ErrNoSuchIdent)
+}
+
+func TestReadFilter(t *testing.T) {
+	conn := newMemoryConnection()
+	_, err := conn.Assert(
+		store.EntityData{"db/ident": "person/email", "db/type": "db.type/string", "db/unique": "db.unique/identity"},
+		store.EntityData{"db/ident": "person/ssn", "db/type": "db.type/string", "db/unique": "db.unique/value"},
+		store.EntityData{"db/ident": "person/friend", "db/type": "db.type/ref"},
+	)
+	if !assert.NoError(t, err) {
+		return
+	}
+	res, err := conn.Assert(
+		store.EntityData{"db/id": store.NamedTempID("ada"), "person/email": "ada@example.com", "person/ssn": "123-45-6789"},
+		store.EntityData{"person/email": "bo@example.com", "person/ssn": "987-65-4321", "person/friend": store.NamedTempID("ada")},
+	)
+	if !assert.NoError(t, err) {
+		return
+	}
+	ada := res.Names["ada"]
+	// Warm the entity cache with the unfiltered entity.
+	_, err = conn.DB().GetEntity(ada)
+	assert.NoError(t, err)
+
+	hideSSN := func(attr store.Ident, eid store.ID) bool { return attr.Name != "person/ssn" }
+	db := conn.WithReadFilter(hideSSN)
+
+	ent, err := db.GetEntity(ada)
+	if assert.NoError(t, err) {
+		data, err := ent.GetData(conn)
+		assert.NoError(t, err)
+		assert.Equal(t, store.EntityData{"person/email": "ada@example.com"}, data)
+	}
+	// The cached entity is unaffected.
+	ent, err = conn.DB().GetEntity(ada)
+	if assert.NoError(t, err) {
+		ssn, err := ent.Get(conn, "person/ssn")
+		assert.NoError(t, err)
+		assert.Equal(t, "123-45-6789", ssn)
+	}
+
+	// Nested pulls are filtered too.
+	data, err := db.Pull(store.NewLookup("person/email", "bo@example.com"),
+		store.PullAttr{Attribute: "person/ssn"},
+		store.PullAttr{Attribute: "person/friend", Pull: []store.PullAttr{{Attribute: "person/email"}, {Attribute: "person/ssn"}}},
+	)
+	if assert.NoError(t, err) {
+		assert.Equal(t, store.EntityData{"person/friend": store.EntityData{"person/email": "ada@example.com"}}, data)
+	}
+
+	// Queries can neither project nor match hidden attributes.
+	rows, err := db.Query(store.Query{
+		Find:  []store.Var{"?ssn"},
+		Where: []store.Clause{store.Pattern{Entity: store.Var("?e"), Attribute: "person/ssn", Value: store.Var("?ssn")}},
+	})
+	assert.NoError(t, err)
+	assert.Empty(t, rows)
+	rows, err = db.Query(store.Query{
+		Find:  []store.Var{"?e"},
+		Where: []store.Clause{store.Pattern{Entity: store.Var("?e"), Attribute: "person/ssn", Value: "123-45-6789"}},
+	})
+	assert.NoError(t, err)
+	assert.Empty(t, rows)
+	rows, err = db.Query(store.Query{
+		Find:  []store.Var{"?email"},
+		Where: []store.Clause{store.Pattern{Entity: store.Var("?e"), Attribute: "person/email", Value: store.Var("?email")}},
+	})
+	assert.NoError(t, err)
+	assert.Len(t, rows, 2)
+
+	// Lookups cannot probe hidden values either.
+	_, err = db.GetEntity(store.NewLookup("person/ssn", "123-45-6789"))
+	assert.ErrorIs(t, err, store.ErrNoSuchEntity)
+	bySSN := func(ssn string) ([][]store.Value, error) {
+		return db.Query(store.Query{
+			Find:  []store.Var{"?email"},
+			Where: []store.Clause{store.Pattern{Entity: store.NewLookup("person/ssn", ssn), Attribute: "person/email", Value: store.Var("?email")}},
+		})
+	}
+	rows, err = bySSN("123-45-6789")
+	missingRows, missingErr := bySSN("000-00-0000")
+	assert.Empty(t, rows)
+	assert.Equal(t, missingRows, rows)
+	assert.Equal(t, missingErr, err)
+	_, err = conn.DB().GetEntity(store.NewLookup("person/ssn", "123-45-6789"))
+	assert.NoError(t, err)
+
+	history, err := db.EntityHistory(ada)
+	if assert.NoError(t, err) {
+		for _, ra := range history {
+			assert.NotEqual(t, "123-45-6789", ra.Value)
+		}
+	}
+
+	// Filters may be decided per entity, and stacked filters only narrow.
+	onlyAda := db.WithReadFilter(func(attr store.Ident, eid store.ID) bool { return eid == ada })
+	rows, err = onlyAda.Query(store.Query{
+		Find:  []store.Var{"?e", "?v"},
+		Where: []store.Clause{store.Pattern{Entity: store.Var("?e"), Attribute: store.Var("?a"), Value: store.Var("?v")}, store.Pattern{Entity: store.Var("?e"), Attribute: "person/email", Value: store.Var("?email")}},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, [][]store.Value{{ada, "ada@example.com"}}, rows)
+}
+
+func TestPartitionIDs(t *testing.T) {
+	p := store.Partition(3)
+	assert.Equal(t, p, p.FirstID().Partition())
+	assert.Equal(t, p, p.LastID().Partition())
+	assert.Equal(t, p+1, (p.LastID() + 1).Partition())
+	assert.Equal(t, store.Partition(0), store.IDType.Partition())
+	assert.Equal(t, store.MaxPartition, store.MaxPartition.LastID().Partition())
+	assert.Positive(t, int64(store.MaxPartition.LastID()))
+
+	// Entities are allocated in partition 0 unless the ID manager supports
+	// partitions.
+	conn := newMemoryConnection()
+	res, err := conn.Assert(store.EntityData{"db/id": store.NamedTempID("doc"), "db/doc": "home"})
+	if assert.NoError(t, err) {
+		assert.Equal(t, store.Partition(0), res.Names["doc"].Partition())
+	}
+	_, err = conn.Assert(store.WithPartition(p), store.EntityData{"db/doc": "elsewhere"})
+	assert.ErrorContains(t, err, "cannot allocate IDs in partition 3")
+}
+
+func TestWarmup(t *testing.T) {
+	conn := newMemoryConnectionWithConfig(store.Config{EntityCacheSize: 2})
+	_, err := conn.Assert(store.EntityData{"db/ident": "sensor/zone", "db/type": "db.type/string"})
+	assert.NoError(t, err)
+	_, err = conn.Assert(
+		store.EntityData{"sensor/zone": "north"},
+		store.EntityData{"sensor/zone": "south"},
+		store.EntityData{"sensor/zone": "east"},
+	)
+	assert.NoError(t, err)
+
+	ctx := context.Background()
+	stats, err := conn.Warmup(ctx, store.WarmupSpec{
+		Attributes: []store.WarmupAttribute{{Attribute: "sensor/zone"}},
+		Entities:   true,
+	})
+	if assert.NoError(t, err) {
+		assert.Positive(t, stats.Idents)
+		assert.Positive(t, stats.SchemaEntities)
+		// Each fact is read from both the AEVT and the AVET index.
+		assert.Equal(t, 6, stats.Entries)
+		// The entity cache only holds two entities.
+		assert.Equal(t, 2, stats.Entities)
+	}
+
+	stats, err = conn.Warmup(ctx, store.WarmupSpec{
+		Attributes: []store.WarmupAttribute{{Attribute: "sensor/zone", Values: []store.Value{"south"}}},
+	})
+	if assert.NoError(t, err) {
+		assert.Equal(t, 1, stats.Entries)
+		assert.Zero(t, stats.Entities)
+	}
+
+	_, err = conn.Warmup(ctx, store.WarmupSpec{
+		Attributes: []store.WarmupAttribute{{Attribute: "sensor/missing"}},
+	})
+	assert.ErrorIs(t, err, store.ErrNoSuchIdent)
+
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err = conn.Warmup(canceled, store.WarmupSpec{})
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+func TestReadConsistency(t *testing.T) {
+	conn := newTestConn()
+	andrew := store.NewLookup("person/email", "ameredith@example.com")
+	_, err := conn.Assert(store.EntityData{"person/email": "ameredith@example.com", "person/firstName": "Andrew"})
+	assert.NoError(t, err)
+	old := conn.DB().AsOf(conn.DB().Basis.ID())
+	_, err = conn.Assert(store.EntityData{"person/email": "ameredith@example.com", "person/firstName": "Drew"})
+	assert.NoError(t, err)
+
+	firstName := func(db store.Database, opts ...store.ReadOpts) (store.Value, error) {
+		ent, err := db.GetEntity(andrew, opts...)
+		if err != nil {
+			return nil, err
+		}
+		return ent.Get(conn, "person/firstName")
+	}
+
+	// An eventually consistent read, or one that tolerates the lag, reads
+	// the view as it is.
+	name, err := firstName(old)
+	assert.NoError(t, err)
+	assert.Equal(t, "Andrew", name)
+	name, err = firstName(old, store.ReadOpts{Consistency: store.ConsistencyBounded, MaxLag: time.Hour})
+	assert.NoError(t, err)
+	assert.Equal(t, "Andrew", name)
+
+	// A view that cannot advance fails reads that require fresher data.
+	_, err = firstName(old, store.ReadOpts{Consistency: store.ConsistencyStrong})
+	assert.ErrorIs(t, err, store.ErrStaleBasis)
+	_, err = firstName(old, store.ReadOpts{Consistency: store.ConsistencyBounded})
+	assert.ErrorIs(t, err, store.ErrStaleBasis)
+	name, err = firstName(conn.DB(), store.ReadOpts{Consistency: store.ConsistencyStrong})
+	assert.NoError(t, err)
+	assert.Equal(t, "Drew", name)
+
+	_, err = firstName(conn.DB(), store.ReadOpts{}, store.ReadOpts{})
+	assert.Error(t, err)
+
+	// A strongly consistent read through a peer waits for the peer to
+	// observe the transactor's latest transaction.
+	peer, stop := conn.NewPeer(store.PeerConfig{})
+	defer stop()
+	_, err = conn.Assert(store.EntityData{"person/email": "bo@example.com", "person/firstName": "Bo"})
+	assert.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	rows, err := peer.DB().Query(store.Query{
+		Find: []store.Var{"?name"},
+		Where: []store.Clause{
+			store.Pattern{Entity: store.Var("?e"), Attribute: "person/firstName", Value: store.Var("?name")},
+		},
+	}, store.ReadOpts{Consistency: store.ConsistencyStrong, Context: ctx})
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, [][]store.Value{{"Drew"}, {"Bo"}}, rows)
+}
+
+// sequentialIDSource generates the ULIDs 1, 2, 3, and so on.
+type sequentialIDSource struct {
+	n uint64
+}
+
+func (s *sequentialIDSource) NewULID() ulid.ULID {
+	s.n++
+	var id ulid.ULID
+	binary.BigEndian.PutUint64(id[8:], s.n)
+	return id
+}
+
+func (s *sequentialIDSource) NewUUID() uuid.UUID {
+	return uuid.Must(uuid.NewV4())
+}
+
+func TestIDSource(t *testing.T) {
+	ids := &sequentialIDSource{}
+	conn := newMemoryConnectionWithConfig(store.Config{IDSource: ids})
+	assert.Equal(t, ids, conn.IDSource())
+	_, err := conn.Assert(store.EntityData{
+		"db/ident":       "person/firstName",
+		"db/type":        "db.type/string",
+		"db/cardinality": "db.cardinality/one",
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	symbol := func(n uint64) string {
+		var id ulid.ULID
+		binary.BigEndian.PutUint64(id[8:], n)
+		return id.String()
+	}
+	// The schema entity was also given a tempID by the IDSource.
+	start := ids.n
+	assert.Equal(t, uint64(1), start)
+
+	// TempIDs created by the connection take their symbols from its
+	// IDSource.
+	ada := conn.TempID()
+	res, err := conn.Assert(
+		store.EntityData{"db/id": ada, "person/firstName": "Ada"},
+		store.EntityData{"person/firstName": "Bo"},
+	)
+	if !assert.NoError(t, err) {
+		return
+	}
+	adaID, ok := res.ResolvedID(ada)
+	assert.True(t, ok)
+	assert.Equal(t, adaID, res.TempIDs[symbol(start+1)])
+	assert.Contains(t, res.TempIDs, symbol(start+2))
+
+	// So do the tempIDs that isolate named tempIDs.
+	res, err = conn.Assert(
+		store.WithIsolatedTempIDs(),
+		store.EntityData{"db/id": store.NamedTempID("p"), "person/firstName": "Cy"},
+	)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Contains(t, res.TempIDs, symbol(start+3))
+
+	// Without an IDSource, symbols are random.
+	assert.Equal(t, store.RandomIDSource{}, newMemoryConnection().IDSource())
+}
+
+func TestReopenedConnectionBasis(t *testing.T) {
+	dir := t.TempDir()
+	open := func() (*store.Connection, func()) {
+		sto, err := badgerImpl.Open(dir, false, badgerImpl.DefaultOptions())
+		if err != nil {
+			t.Fatalf("opening store: %v", err)
+		}
+		conn := store.NewConnection(store.Config{IdentManager: sto, IDManager: sto, Indexer: sto, BlobStore: sto})
+		return conn, func() { sto.Close() }
+	}
+
+	conn, closeStore := open()
+	if !assert.NoError(t, conn.InitializeDB()) {
+		return
+	}
+	_, err := conn.Assert(store.EntityData{"db/ident": "color/red"})
+	assert.NoError(t, err)
+	res, err := conn.Assert(store.EntityData{"db/ident": "color/green"})
+	assert.NoError(t, err)
+	latest := res.TxID()
+	token := res.DB.Token()
+	closeStore()
+
+	// A reopened connection starts at the latest transaction in storage.
+	conn, closeStore = open()
+	defer closeStore()
+	assert.Equal(t, latest, conn.DB().Basis.ID())
+	status, err := conn.Status()
+	assert.NoError(t, err)
+	assert.Equal(t, latest, status.Basis)
+	assert.Equal(t, token, conn.DB().Token())
+	_, err = conn.Since(context.Background(), token)
+	assert.NoError(t, err)
+
+	res, err = conn.Assert(store.EntityData{"db/ident": "color/blue"})
+	assert.NoError(t, err)
+	assert.Greater(t, res.TxID(), latest)
+	assert.Equal(t, res.TxID(), conn.DB().Basis.ID())
+}
+
+func TestTriggersAfterReopen(t *testing.T) {
+	dir := t.TempDir()
+	open := func() (*store.Connection, func()) {
+		sto, err := badgerImpl.Open(dir, false, badgerImpl.DefaultOptions())
+		if err != nil {
+			t.Fatalf("opening store: %v", err)
+		}
+		conn := store.NewConnection(store.Config{IdentManager: sto, IDManager: sto, Indexer: sto, BlobStore: sto})
+		return conn, func() { sto.Close() }
+	}
+
+	conn, closeStore := open()
+	if !assert.NoError(t, conn.InitializeDB()) {
+		return
+	}
+	_, err := conn.Assert(store.EntityData{"db/ident": "color/name", "db/type": "db.type/string", "db/cardinality": "db.cardinality/one"})
+	if !assert.NoError(t, err) {
+		return
+	}
+	for _, name := range []string{"red", "green"} {
+		_, err = conn.Assert(store.EntityData{"color/name": name})
+		assert.NoError(t, err)
+	}
+	closeStore()
+
+	// Transactions committed before the store was closed are delivered by a
+	// runner on the reopened connection.
+	conn, closeStore = open()
+	defer closeStore()
+	var handled []store.Value
+	runner, err := conn.NewTriggerRunner(store.Trigger{
+		Name:      "log-colors",
+		Attribute: "color/name",
+		Handler: func(ctx context.Context, evt store.TriggerEvent) error {
+			for _, fct := range evt.Facts {
+				handled = append(handled, fct.Value)
+			}
+			return nil
+		},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	n, err := runner.RunPending(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+	assert.Equal(t, []store.Value{"red", "green"}, handled)
+
+	n, err = runner.RunPending(context.Background())
+	assert.NoError(t, err)
+	assert.Zero(t, n)
+}
+
+// orderIndexer records the order in which transactions are written.
+type orderIndexer struct {
+	store.Indexer
+	mu  sync.Mutex
+	txs []store.ID
+}
+
+func (o *orderIndexer) Write(assertions []store.ResolvedAssertion, idents []store.Ident) error {
+	if err := o.Indexer.Write(assertions, idents); err != nil {
+		return err
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.txs = append(o.txs, assertions[0].Tx)
+	return nil
+}
+
+func TestTxReportQueueOrder(t *testing.T) {
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true).WithLogger(nil))
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer db.Close()
+	sto, err := badgerImpl.New(db)
+	if !assert.NoError(t, err) {
+		return
+	}
+	written := &orderIndexer{Indexer: sto}
+	conn := store.NewConnection(store.Config{IdentManager: sto, IDManager: sto, Indexer: written})
+	if !assert.NoError(t, conn.InitializeDB()) {
+		return
+	}
+	_, err = conn.Assert(
+		store.EntityData{"db/ident": "person/email", "db/type": "db.type/string", "db/unique": true, "db/cardinality": "db.cardinality/one"},
+		store.EntityData{"db/ident": "person/firstName", "db/type": "db.type/string", "db/cardinality": "db.cardinality/one"},
+	)
+	if !assert.NoError(t, err) {
+		return
+	}
+	reports, stop := conn.TxReportQueue(64)
+	defer stop()
+	written.txs = nil
+
+	// Reports of concurrent commits arrive in the order that the
+	// transactions were written.
+	const writers = 8
+	errs := make(chan error, writers)
+	for i := 0; i < writers; i++ {
+		go func(i int) {
+			_, err := conn.Assert(store.EntityData{"person/email": fmt.Sprintf("p%d@example.com", i)})
+			errs <- err
+		}(i)
+	}
+	for i := 0; i < writers; i++ {
+		assert.NoError(t, <-errs)
+	}
+	var reported []store.ID
+	for i := 0; i < writers; i++ {
+		reported = append(reported, (<-reports).Tx)
+	}
+	assert.Equal(t, written.txs, reported)
+
+	// The view in a report stays at its transaction.
+	andrew := store.NewLookup("person/email", "andrew@example.com")
+	_, err = conn.Assert(store.EntityData{"person/email": "andrew@example.com", "person/firstName": "Andrew"})
+	assert.NoError(t, err)
+	first := <-reports
+	_, err = conn.Assert(store.EntityData{"person/email": "andrew@example.com", "person/firstName": "Drew"})
+	assert.NoError(t, err)
+	<-reports
+	assert.Equal(t, first.Tx, first.DBAfter.Basis.ID())
+	ent, err := first.DBAfter.GetEntity(andrew)
+	if assert.NoError(t, err) {
+		name, err := ent.Get(conn, "person/firstName")
+		assert.NoError(t, err)
+		assert.Equal(t, "Andrew", name)
+	}
 }
@@ -0,0 +1,127 @@
+/*
+Copyright 2024 Andrew Meredith
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Consistency is the freshness that a read requires of the database that
+// serves it. Stronger consistency may make a read wait for a peer to catch
+// up with its transactor, so it trades latency for freshness.
+type Consistency uint8
+
+const (
+	// ConsistencyEventual reads the database as it is, however far its
+	// connection trails the transactor.
+	ConsistencyEventual Consistency = iota
+	// ConsistencyBounded reads a database that trails the transactor by no
+	// more than ReadOpts.MaxLag, measured between the commit times of the
+	// database's basis and the transactor's latest transaction. A database
+	// that trails by more waits to reflect the transactor's latest
+	// transaction.
+	ConsistencyBounded
+	// ConsistencyStrong reads a database that reflects every transaction
+	// that the transactor had committed when the read began.
+	ConsistencyStrong
+)
+
+// ReadOpts configures the consistency of a read, such as Database.GetEntity or
+// Database.Query. The zero ReadOpts reads with ConsistencyEventual, as reads
+// without options do.
+//
+// Consistency is only meaningful for the reads of a peer, which observes the
+// transactions of its transactor some time after they are committed, or of
+// a view obtained earlier than the read. The latest database of a transactor
+// always satisfies every level.
+type ReadOpts struct {
+	Consistency Consistency
+	// MaxLag is the staleness that ConsistencyBounded allows.
+	MaxLag time.Duration
+	// Context bounds how long a read waits for its database to catch up. If
+	// nil, the read waits as long as it takes.
+	Context context.Context
+}
+
+// withConsistency returns a view of db that satisfies opts, of which at most
+// one may be given. See AtLeast for the views that cannot advance.
+func (db Database) withConsistency(opts []ReadOpts) (Database, error) {
+	switch len(opts) {
+	case 0:
+		return db, nil
+	case 1:
+	default:
+		return Database{}, errors.New("at most one ReadOpts may be given")
+	}
+	o := opts[0]
+	ctx := o.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	switch o.Consistency {
+	case ConsistencyEventual:
+		return db, nil
+	case ConsistencyStrong:
+		return db.AtLeast(ctx, db.conn.transactorBasis())
+	case ConsistencyBounded:
+		if o.MaxLag < 0 {
+			return Database{}, fmt.Errorf("negative maximum lag %s", o.MaxLag)
+		}
+		latest := db.conn.transactorBasis()
+		if db.Basis.ID() >= latest {
+			return db, nil
+		}
+		lag, err := db.conn.lag(db.Basis.ID(), latest)
+		if err != nil {
+			return Database{}, err
+		}
+		if lag <= o.MaxLag {
+			return db, nil
+		}
+		return db.AtLeast(ctx, latest)
+	default:
+		return Database{}, fmt.Errorf("unknown consistency %d", o.Consistency)
+	}
+}
+
+// transactorBasis returns the latest transaction that the connection's
+// transactor has committed. For a transactor, it is the connection's own
+// basis.
+func (conn *Connection) transactorBasis() ID {
+	root := conn
+	for root.transactor != nil {
+		root = root.transactor
+	}
+	return ID(root.basis.Load())
+}
+
+// lag returns the time between the commits of basis and latest.
+func (conn *Connection) lag(basis, latest ID) (time.Duration, error) {
+	behind, err := conn.commitTimeOf(basis)
+	if err != nil {
+		return 0, err
+	}
+	ahead, err := conn.commitTimeOf(latest)
+	if err != nil {
+		return 0, err
+	}
+	return ahead.Sub(behind), nil
+}
@@ -16,13 +16,22 @@ limitations under the License.
 
 package store
 
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/kendru/canter/pkg/dataflow"
+)
+
 // Tx is is a transaction entity. Transaction entities are normal entities, but
 // they are associated with a database value as of a particular point in time,
 // and they themselves are not associated with any other transaction.
 type Tx struct {
 	eid   ID
-	time  uint64
-	state map[ID][]Value
+	time  time.Time
+	state map[ID]Value
 }
 
 // ID returns the entity ID associated with the transaction.
@@ -30,11 +39,459 @@ func (t Tx) ID() ID {
 	return t.eid
 }
 
-func (t Tx) Time() uint64 {
+// Time returns the commit time of the transaction, or the zero time if the
+// transaction's facts are not known, as for the basis of a database.
+func (t Tx) Time() time.Time {
 	return t.time
 }
 
-// Database
+// Get returns the value of an attribute of the transaction entity, such as
+// db.tx/commitTime. attribute may either be an ident name or an ID.
+func (t Tx) Get(conn *Connection, attribute any) (Value, error) {
+	return t.entity().Get(conn, attribute)
+}
+
+// GetData returns every attribute of the transaction entity.
+func (t Tx) GetData(conn *Connection) (EntityData, error) {
+	return t.entity().GetData(conn)
+}
+
+func (t Tx) entity() Entity {
+	return Entity{eid: t.eid, basisID: t.eid, state: t.state}
+}
+
+// txFromAssertions returns the transaction entity described by the facts that a
+// transaction committed.
+func txFromAssertions(txID ID, assertions []ResolvedAssertion) Tx {
+	tx := Tx{eid: txID, state: make(map[ID]Value)}
+	for _, ra := range assertions {
+		if ra.EntityID != txID || ra.mode != AssertModeAddition {
+			continue
+		}
+		tx.state[ra.Attribute] = ra.Value
+		if t, ok := ra.Value.(time.Time); ok && ra.Attribute == IDTxCommitTime {
+			tx.time = t
+		}
+	}
+	return tx
+}
+
+// Database is a view of the data available through a connection. By default,
+// a database includes every fact regardless of its valid time. Use ValidAt()
+// to obtain a view that only includes facts that were valid at a particular
+// point in time.
 type Database struct {
 	Basis Tx
+
+	conn    *Connection
+	validAt *time.Time
+	asOf    *ID
+	// snapshot pins reads to a consistent view of the indexes. If nil, each
+	// read observes the latest state of the indexes.
+	snapshot IndexReader
+	// warnings collects warnings about the data read through the view, if
+	// set.
+	warnings *Warnings
+	// readFilter hides the facts that it rejects from the view, if set.
+	readFilter ReadFilter
+}
+
+func (db Database) reader() IndexReader {
+	if db.snapshot != nil {
+		return db.snapshot
+	}
+	return db.conn.indexer
+}
+
+// AsOf returns a view of the database as it existed immediately after the
+// transaction identified by txID was committed. Reads against an as-of view
+// are served from the history indexes, so they are more expensive than reads
+// against the current database.
+func (db Database) AsOf(txID ID) Database {
+	db.asOf = &txID
+	db.Basis = Tx{eid: txID}
+	return db
+}
+
+// IsTimeSliced reports whether the view must be reconstructed from history
+// rather than read from the current indexes.
+func (db Database) IsTimeSliced() bool {
+	return db.asOf != nil
+}
+
+// ValidAt returns a view of the database that only includes facts whose
+// valid-time period contains t.
+func (db Database) ValidAt(t time.Time) Database {
+	db.validAt = &t
+	return db
+}
+
+// includes reports whether a fact is visible in this view of the database.
+func (db Database) includes(fct *Fact) bool {
+	if db.validAt != nil && !fct.ValidAt(*db.validAt) {
+		return false
+	}
+	return true
+}
+
+// GetEntity fetches the state of an entity as visible in this view of the
+// database, or in a later view that satisfies opts, of which at most one may
+// be given.
+func (db Database) GetEntity(idResolver Resolver, opts ...ReadOpts) (Entity, error) {
+	db, err := db.withConsistency(opts)
+	if err != nil {
+		return Entity{}, err
+	}
+	eid, err := db.resolve(idResolver)
+	if err != nil {
+		return Entity{}, fmt.Errorf("resolving entity ID: %w", err)
+	}
+	// Only views of the latest state of the indexes may use the entity
+	// cache.
+	cacheable := db.snapshot == nil && db.asOf == nil && db.validAt == nil
+	var gen uint64
+	if cacheable {
+		var ent Entity
+		var ok bool
+		if ent, gen, ok = db.conn.entityCache.get(eid); ok {
+			ent = db.filterEntity(ent)
+			for attrID := range ent.state {
+				if err := db.warnAttribute(attrID); err != nil {
+					return ent, err
+				}
+			}
+			return ent, nil
+		}
+	}
+	facts, err := db.scan(&eid, nil)
+	if err != nil {
+		return Entity{eid: eid, state: make(map[ID]Value)}, err
+	}
+	ent, err := db.buildEntity(eid, facts, make(map[ID]ID))
+	// An entity read through a filter is missing the facts that the filter
+	// hides, so it must not be shared with other views.
+	if err == nil && cacheable && db.readFilter == nil {
+		db.conn.entityCache.put(ent, gen)
+	}
+	return ent, err
+}
+
+// GetEntities fetches the state of several entities at once. The entities are
+// returned in the same order as ids. Unless the view is already pinned to a
+// snapshot, every entity is read from a single snapshot of the indexes, and
+// the schema of each attribute is only resolved once.
+func (db Database) GetEntities(ids []ID) ([]Entity, error) {
+	if db.snapshot == nil && db.asOf == nil {
+		snap, err := db.conn.indexer.Snapshot()
+		if err != nil {
+			return nil, fmt.Errorf("opening index snapshot: %w", err)
+		}
+		defer snap.Release()
+		db.snapshot = snap
+	}
+
+	// Scan in ID order so that reads move through the EAVT index in one
+	// direction.
+	order := make([]int, len(ids))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(i, j int) bool {
+		return ids[order[i]] < ids[order[j]]
+	})
+
+	cardinalities := make(map[ID]ID)
+	entities := make([]Entity, len(ids))
+	for _, i := range order {
+		eid := ids[i]
+		facts, err := db.scan(&eid, nil)
+		if err != nil {
+			return nil, fmt.Errorf("scanning entity %d: %w", eid, err)
+		}
+		ent, err := db.buildEntity(eid, facts, cardinalities)
+		if err != nil {
+			return nil, err
+		}
+		entities[i] = ent
+	}
+	return entities, nil
+}
+
+// buildEntity folds the facts of an entity into its state. The cardinality of
+// each attribute is looked up in cardinalities, which is populated on a miss.
+func (db Database) buildEntity(eid ID, facts []Fact, cardinalities map[ID]ID) (Entity, error) {
+	ent := Entity{
+		eid:   eid,
+		state: make(map[ID]Value),
+	}
+	for _, fct := range facts {
+		attrCardinality, ok := cardinalities[fct.Attribute]
+		if !ok {
+			var err error
+			attrCardinality, err = db.cardinalityOf(fct.Attribute)
+			if err != nil {
+				panic("error fetching attribute cardinality: " + err.Error())
+			}
+			cardinalities[fct.Attribute] = attrCardinality
+		}
+
+		val := fct.Value
+		if attrCardinality == IDCardinalityMany {
+			vals, ok := ent.state[fct.Attribute]
+			if !ok {
+				vals = make([]Value, 0, 1)
+			}
+			ent.state[fct.Attribute] = append(vals.([]Value), val)
+		} else {
+			ent.state[fct.Attribute] = val
+		}
+		if fct.Tx > ent.basisID {
+			ent.basisID = fct.Tx
+		}
+	}
+
+	return ent, nil
+}
+
+// systemVersion returns the version of the system schema that the database was
+// initialized with, or 0 if it has not been initialized with a versioned
+// system schema.
+func (db Database) systemVersion() (int64, error) {
+	facts, err := db.systemFacts(IDSystem)
+	if err != nil {
+		return 0, err
+	}
+	version, _ := facts[IDSystemVersion].(int64)
+	return version, nil
+}
+
+// systemFacts returns the current value of each attribute of a system entity.
+// Unlike GetEntity, it does not depend on any schema being present.
+func (db Database) systemFacts(eid ID) (map[ID]Value, error) {
+	facts, err := db.scan(&eid, nil)
+	if err != nil {
+		return nil, err
+	}
+	out := make(map[ID]Value, len(facts))
+	for _, fct := range facts {
+		out[fct.Attribute] = fct.Value
+	}
+	return out, nil
+}
+
+// AttributeFacts returns every fact of an attribute that is visible in this
+// view of the database. attribute may either be an ident name or an ID.
+func (db Database) AttributeFacts(attribute any) ([]Fact, error) {
+	ident, err := ResolveIdent(db.conn, attribute)
+	if err != nil {
+		return nil, fmt.Errorf("resolving attribute ident: %w", err)
+	}
+	return db.scan(nil, &ident.ID)
+}
+
+// scan returns the facts visible in this view of the database for an entity,
+// an attribute, or both. At least one of eid or attr must be non-nil.
+func (db Database) scan(eid *ID, attr *ID) ([]Fact, error) {
+	return db.scanWhere(eid, attr, nil)
+}
+
+// scanWhere is like scan, but it only returns facts whose values match pred,
+// or every fact if pred is nil. When only the attribute is constrained, pred
+// is evaluated by the index as it is scanned.
+func (db Database) scanWhere(eid *ID, attr *ID, pred ValuePredicate) ([]Fact, error) {
+	var facts []Fact
+	var err error
+	if db.asOf != nil {
+		facts, err = db.scanHistory(eid, attr)
+	} else {
+		facts, err = db.scanCurrent(eid, attr, pred)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	visible := facts[:0]
+	for i := range facts {
+		if db.includes(&facts[i]) && (pred == nil || pred.MatchValue(facts[i].Value)) {
+			visible = append(visible, facts[i])
+		}
+	}
+	visible = db.filterFacts(visible)
+	if err := db.warnAttributes(visible); err != nil {
+		return nil, err
+	}
+	return visible, nil
+}
+
+func (db Database) scanCurrent(eid *ID, attr *ID, pred ValuePredicate) ([]Fact, error) {
+	// Facts are reserved from the memory budget as they are visited, and only
+	// those that fit are copied out of the index.
+	scope := db.conn.memory.scope("scan")
+	defer scope.close()
+	var facts []Fact
+	visit := func(fct *Fact) error {
+		if err := scope.reserve(factSize(fct)); err != nil {
+			return err
+		}
+		facts = append(facts, fct.Clone())
+		return nil
+	}
+
+	switch {
+	case eid != nil:
+		if err := db.reader().VisitEAVT(*eid, attr, visit); err != nil {
+			return nil, fmt.Errorf("scanning EAVT index: %w", err)
+		}
+	case attr != nil && pred != nil:
+		if err := db.reader().VisitAEVTWhere(*attr, pred, visit); err != nil {
+			return nil, fmt.Errorf("scanning AEVT index: %w", err)
+		}
+	case attr != nil:
+		if err := db.reader().VisitAEVT(*attr, nil, visit); err != nil {
+			return nil, fmt.Errorf("scanning AEVT index: %w", err)
+		}
+	default:
+		return nil, errors.New("scan must be constrained by entity or attribute")
+	}
+	return facts, nil
+}
+
+// scanHistory reconstructs the facts that were current as of the view's basis
+// transaction by replaying the history of the entity and/or attribute.
+func (db Database) scanHistory(eid *ID, attr *ID) ([]Fact, error) {
+	var scan dataflow.Producer[ResolvedAssertion]
+	var err error
+	switch {
+	case eid != nil:
+		if scan, err = db.reader().ScanHistoryEAVT(*eid, attr); err != nil {
+			return nil, fmt.Errorf("scanning EAVT history: %w", err)
+		}
+	case attr != nil:
+		if scan, err = db.reader().ScanHistoryAEVT(*attr, nil); err != nil {
+			return nil, fmt.Errorf("scanning AEVT history: %w", err)
+		}
+	default:
+		return nil, errors.New("scan must be constrained by entity or attribute")
+	}
+
+	scope := db.conn.memory.scope("scan")
+	defer scope.close()
+	assertions, err := collect(scope, scan, assertionSize)
+	if err != nil {
+		return nil, err
+	}
+
+	return db.foldHistory(assertions, *db.asOf)
+}
+
+// foldHistory replays assertions up to and including the basis transaction,
+// yielding the facts that remained asserted. For cardinality-one attributes,
+// the latest assertion for an (entity, attribute, valid from) triple wins. For
+// cardinality-many attributes, each distinct value is tracked separately.
+func (db Database) foldHistory(assertions []*ResolvedAssertion, basis ID) ([]Fact, error) {
+	type factKey struct {
+		eid       ID
+		attr      ID
+		validFrom int64
+		value     string
+	}
+	var order []factKey
+	latest := make(map[factKey]*ResolvedAssertion)
+	for _, ra := range assertions {
+		if ra.Tx > basis {
+			continue
+		}
+		cardinality, err := db.cardinalityOf(ra.Attribute)
+		if err != nil {
+			return nil, err
+		}
+		key := factKey{
+			eid:       ra.EntityID,
+			attr:      ra.Attribute,
+			validFrom: ra.ValidFrom.UnixNano(),
+		}
+		if cardinality == IDCardinalityMany {
+			key.value = fmt.Sprintf("%#v", ra.Value)
+		}
+		if _, ok := latest[key]; !ok {
+			order = append(order, key)
+		}
+		latest[key] = ra
+	}
+
+	facts := make([]Fact, 0, len(order))
+	for _, key := range order {
+		ra := latest[key]
+		if ra.Mode() == AssertModeAddition {
+			facts = append(facts, ra.Fact)
+		}
+	}
+	return facts, nil
+}
+
+// resolve resolves an entity identifier against this view of the database.
+// Lookups are resolved using the view's indexes, while other resolvers do not
+// depend on the state of the database.
+func (db Database) resolve(r Resolver) (ID, error) {
+	if l, ok := r.(Lookup); ok {
+		return l.resolveIn(db)
+	}
+	return r.Resolve(db.conn)
+}
+
+// getSchemaEntity reads a schema entity from this view of the database. This
+// is a special case of GetEntity that assumes the argument passed in is an
+// already-resolved ID pointing to a schema entity (attribute or ident). It
+// also omits the attribute type lookup, since schema entities do not have
+// db.cardinality/many (for now) attributes, looking up a schema entity for
+// each attribute type would cause a recursive loop. Most callers want the
+// parsed schema of SchemaFor instead.
+//
+// Schema entities read from the latest state of the indexes are cached on the
+// connection until a transaction modifies them. Reads from a snapshot bypass
+// the cache, since the cache may hold schema that is newer than the snapshot.
+func (db Database) getSchemaEntity(attrID ID) (Entity, error) {
+	if db.snapshot != nil {
+		return db.readSchemaEntity(attrID)
+	}
+
+	conn := db.conn
+	conn.schemaMu.RLock()
+	ent, ok := conn.schemaEntityCache[attrID]
+	gen := conn.schemaGen
+	conn.schemaMu.RUnlock()
+	if ok {
+		return ent, nil
+	}
+
+	ent, err := db.readSchemaEntity(attrID)
+	if err != nil {
+		return ent, err
+	}
+
+	// Only cache the entity if no schema was invalidated while it was being
+	// read. Otherwise, the read may have observed the state from before the
+	// invalidating transaction.
+	conn.schemaMu.Lock()
+	if conn.schemaGen == gen {
+		conn.schemaEntityCache[attrID] = ent
+	}
+	conn.schemaMu.Unlock()
+
+	return ent, nil
+}
+
+func (db Database) readSchemaEntity(attrID ID) (Entity, error) {
+	ent := Entity{
+		eid:   attrID,
+		state: make(map[ID]Value),
+	}
+	if err := db.reader().VisitEAVT(attrID, nil, func(fct *Fact) error {
+		ent.state[fct.Attribute] = fct.Clone().Value
+		return nil
+	}); err != nil {
+		return ent, fmt.Errorf("scanning EAVT index: %v", err)
+	}
+
+	return ent, nil
 }
@@ -0,0 +1,195 @@
+/*
+Copyright 2024 Andrew Meredith
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// An attribute is deprecated by asserting db/deprecated on it, optionally
+// along with a db/replacedBy that names the attribute to use instead:
+//
+//	store.EntityData{
+//		"db/ident":      "person/name",
+//		"db/deprecated": true,
+//		"db/replacedBy": "person/fullName",
+//	}
+//
+// Deprecated attributes may still be read and written, so that data can be
+// migrated at its own pace. Reads through a view of the database that has a
+// Warnings collector attached record a Deprecation for each deprecated
+// attribute that they touch, which lets callers find the code that still
+// depends on old schema.
+
+// Deprecation describes a deprecated attribute.
+type Deprecation struct {
+	Attribute Ident
+	// ReplacedBy is the attribute that replaces the deprecated attribute, or
+	// the zero Ident if it has no replacement.
+	ReplacedBy Ident
+}
+
+func (d Deprecation) String() string {
+	if d.ReplacedBy.Name == "" {
+		return fmt.Sprintf("attribute %s is deprecated", d.Attribute.Name)
+	}
+	return fmt.Sprintf("attribute %s is deprecated: use %s instead", d.Attribute.Name, d.ReplacedBy.Name)
+}
+
+// Warnings collects the warnings raised by reads through a view of the
+// database. Attach a collector to a view with Database.WithWarnings, typically
+// one per request. A Warnings is safe for concurrent use.
+type Warnings struct {
+	mu           sync.Mutex
+	seen         map[ID]struct{}
+	deprecations []Deprecation
+}
+
+// Deprecations returns the deprecated attributes that have been read, in the
+// order that they were first read. Each attribute is reported once.
+func (w *Warnings) Deprecations() []Deprecation {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	out := make([]Deprecation, len(w.deprecations))
+	copy(out, w.deprecations)
+	return out
+}
+
+// Len returns the number of warnings collected.
+func (w *Warnings) Len() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return len(w.deprecations)
+}
+
+// checked reports whether attrID has already been checked for deprecation,
+// marking it as checked if not.
+func (w *Warnings) checked(attrID ID) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, ok := w.seen[attrID]; ok {
+		return true
+	}
+	if w.seen == nil {
+		w.seen = make(map[ID]struct{})
+	}
+	w.seen[attrID] = struct{}{}
+	return false
+}
+
+func (w *Warnings) addDeprecation(d Deprecation) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.deprecations = append(w.deprecations, d)
+}
+
+// WithWarnings returns a view of the database that records warnings about the
+// data it reads in w.
+func (db Database) WithWarnings(w *Warnings) Database {
+	db.warnings = w
+	return db
+}
+
+// warnAttributes records a warning for each deprecated attribute among the
+// attributes of facts. It does nothing unless a Warnings collector is
+// attached to the view.
+func (db Database) warnAttributes(facts []Fact) error {
+	if db.warnings == nil {
+		return nil
+	}
+	for i := range facts {
+		if err := db.warnAttribute(facts[i].Attribute); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// warnAttribute records a warning if attrID is deprecated.
+func (db Database) warnAttribute(attrID ID) error {
+	if db.warnings == nil || attrID.IsSystem() || db.warnings.checked(attrID) {
+		return nil
+	}
+	d, ok, err := db.deprecation(attrID)
+	if err != nil {
+		return err
+	}
+	if ok {
+		db.warnings.addDeprecation(d)
+	}
+	return nil
+}
+
+// Deprecation reports whether an attribute is deprecated and, if so, what
+// replaces it. attribute may either be an ident name or an ID.
+func (db Database) Deprecation(attribute any) (Deprecation, bool, error) {
+	ident, err := ResolveIdent(db.conn, attribute)
+	if err != nil {
+		return Deprecation{}, false, fmt.Errorf("resolving attribute ident: %w", err)
+	}
+	return db.deprecation(ident.ID)
+}
+
+// Deprecations returns every deprecated attribute, ordered by name.
+func (db Database) Deprecations() ([]Deprecation, error) {
+	deprecatedAttr := IDDeprecated
+	facts, err := db.scan(nil, &deprecatedAttr)
+	if err != nil {
+		return nil, fmt.Errorf("scanning deprecations: %w", err)
+	}
+	var out []Deprecation
+	for _, fct := range facts {
+		if deprecated, _ := fct.Value.(bool); !deprecated {
+			continue
+		}
+		d, ok, err := db.deprecation(fct.EntityID)
+		if err != nil {
+			return nil, err
+		}
+		// Namespace entities may be deprecated too, but they are not
+		// attributes.
+		if ok {
+			out = append(out, d)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Attribute.Name < out[j].Attribute.Name })
+	return out, nil
+}
+
+// deprecation reads the deprecation of an attribute from its schema entity.
+func (db Database) deprecation(attrID ID) (Deprecation, bool, error) {
+	schema, err := db.schemaFor(attrID)
+	if err != nil {
+		return Deprecation{}, false, err
+	}
+	if !schema.IsAttribute() || !schema.Deprecated {
+		return Deprecation{}, false, nil
+	}
+	d := Deprecation{}
+	if d.Attribute, err = ResolveIdent(db.conn, attrID); err != nil {
+		// Attributes without idents are reported by ID.
+		d.Attribute = Ident{ID: attrID, Name: fmt.Sprint(int64(attrID))}
+	}
+	if replacement := schema.ReplacedBy; replacement != 0 {
+		if d.ReplacedBy, err = ResolveIdent(db.conn, replacement); err != nil {
+			d.ReplacedBy = Ident{ID: replacement, Name: fmt.Sprint(int64(replacement))}
+		}
+	}
+	return d, true, nil
+}
@@ -0,0 +1,297 @@
+/*
+Copyright 2024 Andrew Meredith
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// This file reads and writes the subset of EDN that schema files use:
+// vectors, maps, keywords, strings, integers, floats, booleans, nil, and
+// #inst timestamps. Vectors are read as []any, maps as ednMap, and keywords
+// as ednKeyword.
+
+// ednKeyword is an EDN keyword, without its leading colon.
+type ednKeyword string
+
+// ednMap is an EDN map. Its entries are kept in the order in which they were
+// read.
+type ednMap struct {
+	keys   []any
+	values []any
+}
+
+// EDNSyntaxError describes malformed EDN.
+type EDNSyntaxError struct {
+	Line, Col int
+	Msg       string
+}
+
+func (e *EDNSyntaxError) Error() string {
+	return fmt.Sprintf("%d:%d: %s", e.Line, e.Col, e.Msg)
+}
+
+// ednReader reads EDN forms from a string.
+type ednReader struct {
+	src       string
+	off       int
+	line, col int
+}
+
+func newEDNReader(src string) *ednReader {
+	return &ednReader{src: src, line: 1, col: 1}
+}
+
+func (r *ednReader) errorf(line, col int, format string, args ...any) error {
+	return &EDNSyntaxError{Line: line, Col: col, Msg: fmt.Sprintf(format, args...)}
+}
+
+func (r *ednReader) peek() byte {
+	return r.src[r.off]
+}
+
+func (r *ednReader) advance() byte {
+	b := r.src[r.off]
+	r.off++
+	if b == '\n' {
+		r.line++
+		r.col = 1
+	} else {
+		r.col++
+	}
+	return b
+}
+
+// skipSpace skips whitespace, commas, and comments.
+func (r *ednReader) skipSpace() {
+	for r.off < len(r.src) {
+		switch b := r.peek(); {
+		case b == ';':
+			for r.off < len(r.src) && r.peek() != '\n' {
+				r.advance()
+			}
+		case b == ',' || unicode.IsSpace(rune(b)):
+			r.advance()
+		default:
+			return
+		}
+	}
+}
+
+// atEnd reports whether only whitespace and comments remain.
+func (r *ednReader) atEnd() bool {
+	r.skipSpace()
+	return r.off >= len(r.src)
+}
+
+func (r *ednReader) read() (any, error) {
+	r.skipSpace()
+	line, col := r.line, r.col
+	if r.off >= len(r.src) {
+		return nil, r.errorf(line, col, "unexpected end of input")
+	}
+	switch b := r.peek(); b {
+	case '[':
+		r.advance()
+		return r.readSeq(']')
+	case '{':
+		r.advance()
+		items, err := r.readSeq('}')
+		if err != nil {
+			return nil, err
+		}
+		if len(items)%2 != 0 {
+			return nil, r.errorf(line, col, "map has a key without a value")
+		}
+		m := ednMap{}
+		for i := 0; i < len(items); i += 2 {
+			m.keys = append(m.keys, items[i])
+			m.values = append(m.values, items[i+1])
+		}
+		return m, nil
+	case ']', '}', '(', ')':
+		return nil, r.errorf(line, col, "unexpected %q", b)
+	case '"':
+		return r.readString()
+	case '#':
+		return r.readTagged()
+	default:
+		return r.readAtom()
+	}
+}
+
+func (r *ednReader) readSeq(end byte) ([]any, error) {
+	items := []any{}
+	for {
+		r.skipSpace()
+		if r.off >= len(r.src) {
+			return nil, r.errorf(r.line, r.col, "unexpected end of input, expected %q", end)
+		}
+		if r.peek() == end {
+			r.advance()
+			return items, nil
+		}
+		item, err := r.read()
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+}
+
+func (r *ednReader) readString() (string, error) {
+	line, col := r.line, r.col
+	start := r.off
+	r.advance()
+	for r.off < len(r.src) {
+		switch r.advance() {
+		case '\\':
+			if r.off < len(r.src) {
+				r.advance()
+			}
+		case '"':
+			s, err := strconv.Unquote(r.src[start:r.off])
+			if err != nil {
+				return "", r.errorf(line, col, "invalid string: %v", err)
+			}
+			return s, nil
+		}
+	}
+	return "", r.errorf(line, col, "unterminated string")
+}
+
+func (r *ednReader) readToken() string {
+	start := r.off
+	for r.off < len(r.src) {
+		b := r.peek()
+		if b == ',' || b == ';' || b == '"' || strings.IndexByte("[](){}", b) >= 0 || unicode.IsSpace(rune(b)) {
+			break
+		}
+		r.advance()
+	}
+	return r.src[start:r.off]
+}
+
+func (r *ednReader) readTagged() (any, error) {
+	line, col := r.line, r.col
+	r.advance()
+	tag := r.readToken()
+	if tag != "inst" {
+		return nil, r.errorf(line, col, "unknown tag #%s", tag)
+	}
+	r.skipSpace()
+	if r.off >= len(r.src) || r.peek() != '"' {
+		return nil, r.errorf(r.line, r.col, "#inst must be followed by a string")
+	}
+	s, err := r.readString()
+	if err != nil {
+		return nil, err
+	}
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		return nil, r.errorf(line, col, "invalid #inst: %v", err)
+	}
+	return t, nil
+}
+
+func (r *ednReader) readAtom() (any, error) {
+	line, col := r.line, r.col
+	tok := r.readToken()
+	switch {
+	case tok == "":
+		return nil, r.errorf(line, col, "unexpected %q", r.peek())
+	case tok == "nil":
+		return nil, nil
+	case tok == "true" || tok == "false":
+		return tok == "true", nil
+	case tok[0] == ':':
+		if len(tok) == 1 {
+			return nil, r.errorf(line, col, "empty keyword")
+		}
+		return ednKeyword(tok[1:]), nil
+	}
+	sign := strings.TrimLeft(tok, "+-")
+	if sign != "" && sign[0] >= '0' && sign[0] <= '9' {
+		if n, err := strconv.ParseInt(tok, 10, 64); err == nil {
+			return n, nil
+		}
+		if f, err := strconv.ParseFloat(tok, 64); err == nil {
+			return f, nil
+		}
+		return nil, r.errorf(line, col, "invalid number %q", tok)
+	}
+	return nil, r.errorf(line, col, "unsupported symbol %q", tok)
+}
+
+// writeEDN appends the EDN form of a value to b.
+func writeEDN(b *strings.Builder, val any) error {
+	switch v := val.(type) {
+	case nil:
+		b.WriteString("nil")
+	case ednKeyword:
+		b.WriteByte(':')
+		b.WriteString(string(v))
+	case string:
+		b.WriteString(strconv.Quote(v))
+	case bool:
+		b.WriteString(strconv.FormatBool(v))
+	case int64:
+		b.WriteString(strconv.FormatInt(v, 10))
+	case int32:
+		b.WriteString(strconv.FormatInt(int64(v), 10))
+	case int16:
+		b.WriteString(strconv.FormatInt(int64(v), 10))
+	case int8:
+		b.WriteString(strconv.FormatInt(int64(v), 10))
+	case float64:
+		writeEDNFloat(b, v, 64)
+	case float32:
+		writeEDNFloat(b, float64(v), 32)
+	case time.Time:
+		b.WriteString(`#inst "`)
+		b.WriteString(v.UTC().Format(time.RFC3339Nano))
+		b.WriteByte('"')
+	case []any:
+		b.WriteByte('[')
+		for i, elem := range v {
+			if i > 0 {
+				b.WriteByte(' ')
+			}
+			if err := writeEDN(b, elem); err != nil {
+				return err
+			}
+		}
+		b.WriteByte(']')
+	default:
+		return fmt.Errorf("value of type %T cannot be written as EDN", val)
+	}
+	return nil
+}
+
+// writeEDNFloat writes a float so that it is read back as a float rather
+// than an integer.
+func writeEDNFloat(b *strings.Builder, f float64, bits int) {
+	s := strconv.FormatFloat(f, 'g', -1, bits)
+	if !strings.ContainsAny(s, ".eEn") {
+		s += ".0"
+	}
+	b.WriteString(s)
+}
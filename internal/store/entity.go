@@ -20,6 +20,7 @@ import (
 	"errors"
 	"fmt"
 	"reflect"
+	"slices"
 )
 
 var ErrPropertyNotFound = errors.New("property not found")
@@ -51,7 +52,36 @@ func (e Entity) Get(conn *Connection, attribute any) (Value, error) {
 	return val, nil
 }
 
+// GetData returns every attribute of the entity, keyed by ident name. The
+// values of the connection's computed attributes are included as
+// ComputedValues.
 func (e Entity) GetData(conn *Connection) (EntityData, error) {
+	data, err := e.storedData(conn)
+	if err != nil {
+		return nil, err
+	}
+	computed := make(EntityData)
+	for _, name := range conn.computed.names() {
+		attr, ok := conn.computed.lookup(name)
+		if !ok {
+			continue
+		}
+		val, ok, err := conn.computed.compute(name, attr, data)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			computed[name] = ComputedValue{Value: val}
+		}
+	}
+	for name, val := range computed {
+		data[name] = val
+	}
+	return data, nil
+}
+
+// storedData returns the stored attributes of the entity, keyed by ident name.
+func (e Entity) storedData(conn *Connection) (EntityData, error) {
 	attrIDs := make([]any, 0, len(e.state))
 	data := make(EntityData, len(e.state))
 	for attrID := range e.state {
@@ -67,7 +97,6 @@ func (e Entity) GetData(conn *Connection) (EntityData, error) {
 	}
 
 	return data, nil
-
 }
 
 type EntityData map[string]Value
@@ -81,18 +110,33 @@ func (ed EntityData) Assertions(conn *Connection) ([]Assertion, error) {
 		return nil, fmt.Errorf("resolving EntityID for EntityData: %w", err)
 	}
 
-	assertions := make([]Assertion, 0, len(ed))
+	// Attributes are visited in order so that the same EntityData always
+	// produces the same assertions.
+	attrIdentNames := make([]string, 0, len(ed))
+	for attrIdentName := range ed {
+		attrIdentNames = append(attrIdentNames, attrIdentName)
+	}
+	slices.Sort(attrIdentNames)
 
-	for attrIdentName, val := range ed {
+	assertions := make([]Assertion, 0, len(ed))
+	for _, attrIdentName := range attrIdentNames {
+		val := ed[attrIdentName]
 		if attrIdentName == "db/id" {
 			// ID only used to match existing entity.
 			continue
 		}
+		if _, ok := val.(ComputedValue); ok {
+			// Computed attributes are not stored.
+			continue
+		}
 
 		rv := reflect.ValueOf(val)
-		switch rv.Kind() {
-		case reflect.Slice, reflect.Array:
-			// Split multi-valued attributes into multiple assertions.
+		_, isTuple := val.(Tuple)
+		switch {
+		case rv.Kind() == reflect.Slice && rv.Type().Elem().Kind() != reflect.Uint8 && !isTuple:
+			// Split multi-valued attributes into multiple assertions. Byte
+			// slices and arrays, such as UUIDs and blob digests, and tuples
+			// are single values.
 			for i := 0; i < rv.Len(); i++ {
 				assertions = append(assertions, Assert(
 					id,
@@ -125,7 +169,7 @@ func (ed EntityData) getIdentifier(conn *Connection) (identifier, error) {
 			valIdent, err := ResolveIdent(conn, val)
 			if err != nil {
 				if errors.Is(err, ErrNoSuchIdent) {
-					return TempID(), nil
+					return conn.TempID(), nil
 				}
 				return nil, fmt.Errorf("resolving db/ident value as ident: %w", err)
 			}
@@ -137,5 +181,5 @@ func (ed EntityData) getIdentifier(conn *Connection) (identifier, error) {
 		// that resolve to different IDs, throw an error.
 	}
 
-	return TempID(), nil
+	return conn.TempID(), nil
 }
@@ -0,0 +1,179 @@
+/*
+Copyright 2024 Andrew Meredith
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"container/list"
+	"sync"
+)
+
+// entityCache is a bounded cache of entities read from the latest state of the
+// indexes. When the cache is full, or its entities would exceed the memory
+// budget of the connection, the least recently used entities are evicted. A
+// nil cache caches nothing.
+type entityCache struct {
+	mu      sync.Mutex
+	size    int
+	memory  *memoryAccountant
+	order   *list.List
+	entries map[ID]*list.Element
+	// gen is incremented every time cached entities are invalidated.
+	gen uint64
+}
+
+// cachedEntity is an entity in the cache along with the memory reserved for
+// it.
+type cachedEntity struct {
+	ent  Entity
+	size int64
+}
+
+func newEntityCache(size int, memory *memoryAccountant) *entityCache {
+	if size <= 0 {
+		return nil
+	}
+	c := &entityCache{
+		size:    size,
+		memory:  memory,
+		order:   list.New(),
+		entries: make(map[ID]*list.Element),
+	}
+	memory.addReclaimer(c.reclaim)
+	return c
+}
+
+// reclaim evicts the least recently used entities until n bytes have been
+// freed or the cache is empty, and returns the number of bytes freed.
+func (c *entityCache) reclaim(n int64) int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var freed int64
+	for freed < n && c.order.Len() > 0 {
+		freed += c.remove(c.order.Back())
+	}
+	return freed
+}
+
+// get returns the cached entity, if any, along with the generation of the
+// cache. The generation must be passed to put when caching an entity that was
+// read after a miss.
+func (c *entityCache) get(eid ID) (Entity, uint64, bool) {
+	if c == nil {
+		return Entity{}, 0, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[eid]
+	if !ok {
+		return Entity{}, c.gen, false
+	}
+	c.order.MoveToFront(elem)
+	return elem.Value.(*cachedEntity).ent, c.gen, true
+}
+
+// put caches an entity unless the cache was invalidated since gen was
+// obtained, in which case the entity may predate the invalidating transaction.
+func (c *entityCache) put(ent Entity, gen uint64) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.gen != gen {
+		return
+	}
+	if elem, ok := c.entries[ent.eid]; ok {
+		c.remove(elem)
+	}
+	if c.order.Len() >= c.size {
+		c.remove(c.order.Back())
+	}
+
+	// Make room within the memory budget, or leave the entity uncached if
+	// there is none to be made.
+	size := entitySize(ent)
+	for !c.memory.tryReserve(size) {
+		if c.order.Len() == 0 {
+			return
+		}
+		c.remove(c.order.Back())
+	}
+	c.entries[ent.eid] = c.order.PushFront(&cachedEntity{ent: ent, size: size})
+}
+
+// remove evicts a cached entity, releases its memory, and returns the number
+// of bytes released.
+func (c *entityCache) remove(elem *list.Element) int64 {
+	cached := c.order.Remove(elem).(*cachedEntity)
+	delete(c.entries, cached.ent.eid)
+	c.memory.release(cached.size)
+	return cached.size
+}
+
+// full reports whether the cache holds as many entities as it may. A nil
+// cache is always full.
+func (c *entityCache) full() bool {
+	if c == nil {
+		return true
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len() >= c.size
+}
+
+// removeAll evicts every entity and releases their memory.
+func (c *entityCache) removeAll() {
+	for elem := c.order.Front(); elem != nil; elem = elem.Next() {
+		c.memory.release(elem.Value.(*cachedEntity).size)
+	}
+	c.order.Init()
+	c.entries = make(map[ID]*list.Element)
+}
+
+// invalidate evicts every entity modified by the assertions. A change to the
+// cardinality of an attribute changes the shape of every entity that holds
+// it, so it evicts everything.
+func (c *entityCache) invalidate(assertions []ResolvedAssertion) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gen++
+	for _, assertion := range assertions {
+		if assertion.Attribute == IDCardinality {
+			c.removeAll()
+			return
+		}
+	}
+	for _, assertion := range assertions {
+		if elem, ok := c.entries[assertion.EntityID]; ok {
+			c.remove(elem)
+		}
+	}
+}
+
+// clear evicts every entity.
+func (c *entityCache) clear() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gen++
+	c.removeAll()
+}
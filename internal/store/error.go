@@ -19,6 +19,66 @@ package store
 import "fmt"
 
 var (
-	ErrNoSuchEntity = fmt.Errorf("no such entity")
-	ErrConflict     = fmt.Errorf("conflict")
+	ErrNoSuchEntity  = fmt.Errorf("no such entity")
+	ErrConflict      = fmt.Errorf("conflict")
+	ErrSystemEntity  = fmt.Errorf("system entities may not be modified")
+	ErrTxTooLarge    = fmt.Errorf("transaction too large")
+	ErrTxDone        = fmt.Errorf("transaction has already been committed")
+	ErrReadOnly      = fmt.Errorf("connection is read-only")
+	ErrSystemTooNew  = fmt.Errorf("system schema is newer than supported")
+	ErrInvalidTempID = fmt.Errorf("invalid tempID")
+	ErrClosed        = fmt.Errorf("connection is closed")
+	ErrInvalidCursor = fmt.Errorf("invalid cursor")
+	// ErrSchemaViolation is returned when a transaction adds an attribute
+	// that breaks the rules of its namespace.
+	ErrSchemaViolation = fmt.Errorf("schema violation")
+	// ErrThrottled is returned when a transaction is not admitted by the
+	// connection's AdmissionController. See ThrottledError.
+	ErrThrottled = fmt.Errorf("transaction throttled")
+	// ErrMemoryBudget is returned when a scan or query would exceed the
+	// memory budget of its connection. See MemoryBudgetError.
+	ErrMemoryBudget = fmt.Errorf("memory budget exceeded")
+	// ErrComputedAttribute is returned when a transaction asserts a computed
+	// attribute. See Connection.RegisterComputedAttribute.
+	ErrComputedAttribute = fmt.Errorf("computed attribute")
+	// ErrReplayed is returned when a transaction is replayed into a store
+	// that already has the transaction or a later one. See
+	// Connection.Replay.
+	ErrReplayed = fmt.Errorf("transaction already replayed")
+	// ErrStaleBasis is returned by Database.AtLeast for a view that cannot
+	// advance to the required basis.
+	ErrStaleBasis = fmt.Errorf("stale basis")
+	// ErrInvalidToken is returned by Since for a token that was not returned
+	// by Token.
+	ErrInvalidToken = fmt.Errorf("invalid basis token")
+	// ErrIntegrity is returned when the facts of a transaction do not match
+	// the Merkle root that was recorded when it was committed.
+	ErrIntegrity = fmt.Errorf("integrity check failed")
+	// ErrCrossPartition is returned by an Indexer that routes partitions to
+	// separate indexes when a transaction writes to more than one of them.
+	// See NOTE [ENTITY-PARTITIONS].
+	ErrCrossPartition = fmt.Errorf("transaction spans partitions")
+	// ErrSlowConsumer is returned by a live query or entity watch that fell
+	// so far behind the transactions committed through its connection that
+	// it was stopped rather than delay the writers.
+	ErrSlowConsumer = fmt.Errorf("slow consumer")
 )
+
+// EntityChangedError is returned when a transaction that requires an entity to
+// be unchanged since a basis transaction finds that it has changed. It matches
+// ErrConflict.
+type EntityChangedError struct {
+	Entity ID
+	// Expected is the basis that the caller last read the entity at.
+	Expected ID
+	// Version is the last transaction that changed the entity.
+	Version ID
+}
+
+func (e *EntityChangedError) Error() string {
+	return fmt.Sprintf("entity %d was changed by transaction %d after %d", e.Entity, e.Version, e.Expected)
+}
+
+func (e *EntityChangedError) Unwrap() error {
+	return ErrConflict
+}
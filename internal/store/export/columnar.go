@@ -0,0 +1,198 @@
+/*
+Copyright 2024 Andrew Meredith
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package export pivots the facts of a database into columnar record batches
+// for analytical tools such as DuckDB and Spark.
+package export
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/kendru/canter/internal/store"
+)
+
+const (
+	// ColumnID holds the ID of the entity that a row describes.
+	ColumnID = "db/id"
+	// ColumnTx holds the latest transaction that asserted any of the row's
+	// values.
+	ColumnTx = "db/tx"
+	// ColumnTxTime holds the commit time of the ColumnTx transaction.
+	ColumnTxTime = "db.tx/commitTime"
+)
+
+// DefaultBatchSize is the number of rows per batch when Options.BatchSize is
+// not set.
+const DefaultBatchSize = 64 * 1024
+
+// Options selects the data to export.
+type Options struct {
+	// Attributes are the idents of the attributes to export, each of which
+	// becomes a column. Every entity that has a value for at least one of them
+	// becomes a row.
+	Attributes []string
+	// BatchSize is the maximum number of rows per batch.
+	BatchSize int
+}
+
+// Field describes a column of a record batch.
+type Field struct {
+	Name string
+	// Type is the value type of the column, such as store.IDTypeString.
+	Type store.ID
+	// Nullable is set for columns that may hold nil values.
+	Nullable bool
+}
+
+// RecordBatch is a set of rows stored as a column per field. Columns[i] holds
+// the values of Fields[i], with nil for entities that have no value.
+type RecordBatch struct {
+	Fields  []Field
+	Columns [][]store.Value
+	NumRows int
+}
+
+// Batches pivots the facts of the selected attributes into record batches of
+// one row per entity, ordered by entity ID, and calls fn with each batch. The
+// batch passed to fn must not be retained after fn returns.
+//
+// The first column holds the entity ID and is followed by a column per
+// attribute, then by the ColumnTx and ColumnTxTime columns that describe the
+// transaction that last changed the row. Cardinality-many attributes cannot be
+// exported, since a row holds a single value per column. If no entity has a
+// value for any of the attributes, fn is called once with an empty batch so
+// that the schema of the export is still known.
+func Batches(conn *store.Connection, db store.Database, opts Options, fn func(*RecordBatch) error) error {
+	if len(opts.Attributes) == 0 {
+		return errors.New("no attributes to export")
+	}
+	batchSize := opts.BatchSize
+	if batchSize <= 0 {
+		batchSize = DefaultBatchSize
+	}
+
+	fields := []Field{{Name: ColumnID, Type: store.IDTypeRef}}
+	values := make([]map[store.ID]store.Fact, len(opts.Attributes))
+	entitySet := make(map[store.ID]struct{})
+	for i, name := range opts.Attributes {
+		typ, err := attributeType(db, name)
+		if err != nil {
+			return err
+		}
+		fields = append(fields, Field{Name: name, Type: typ, Nullable: true})
+
+		facts, err := db.AttributeFacts(name)
+		if err != nil {
+			return fmt.Errorf("scanning attribute %s: %w", name, err)
+		}
+		values[i] = make(map[store.ID]store.Fact, len(facts))
+		for _, fct := range facts {
+			// A value may have been asserted for several valid-time
+			// periods. The one that was valid from the latest time is
+			// the entity's current value.
+			if prev, ok := values[i][fct.EntityID]; ok && prev.ValidFrom.After(fct.ValidFrom) {
+				continue
+			}
+			values[i][fct.EntityID] = fct
+			entitySet[fct.EntityID] = struct{}{}
+		}
+	}
+	fields = append(fields,
+		Field{Name: ColumnTx, Type: store.IDTypeRef},
+		Field{Name: ColumnTxTime, Type: store.IDTypeTimestamp, Nullable: true},
+	)
+
+	txTimes, err := commitTimes(db)
+	if err != nil {
+		return err
+	}
+
+	entities := make([]store.ID, 0, len(entitySet))
+	for eid := range entitySet {
+		entities = append(entities, eid)
+	}
+	sort.Slice(entities, func(i, j int) bool { return entities[i] < entities[j] })
+	if len(entities) == 0 {
+		return fn(&RecordBatch{Fields: fields, Columns: make([][]store.Value, len(fields))})
+	}
+
+	for start := 0; start < len(entities); start += batchSize {
+		end := min(start+batchSize, len(entities))
+		batch := &RecordBatch{
+			Fields:  fields,
+			Columns: make([][]store.Value, len(fields)),
+			NumRows: end - start,
+		}
+		for i := range batch.Columns {
+			batch.Columns[i] = make([]store.Value, batch.NumRows)
+		}
+		txCol, txTimeCol := len(fields)-2, len(fields)-1
+		for row, eid := range entities[start:end] {
+			batch.Columns[0][row] = eid
+			var tx store.ID
+			for i, attrValues := range values {
+				fct, ok := attrValues[eid]
+				if !ok {
+					continue
+				}
+				batch.Columns[i+1][row] = fct.Value
+				tx = max(tx, fct.Tx)
+			}
+			batch.Columns[txCol][row] = tx
+			if t, ok := txTimes[tx]; ok {
+				batch.Columns[txTimeCol][row] = t
+			}
+		}
+		if err := fn(batch); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// attributeType returns the value type of an attribute, failing if the
+// attribute cannot be represented as a column.
+func attributeType(db store.Database, name string) (store.ID, error) {
+	schema, err := db.SchemaFor(name)
+	if err != nil {
+		return 0, fmt.Errorf("reading attribute %s: %w", name, err)
+	}
+	if !schema.IsAttribute() {
+		return 0, fmt.Errorf("%s is not an attribute", name)
+	}
+	if schema.Many() {
+		return 0, fmt.Errorf("attribute %s: cardinality-many attributes cannot be exported", name)
+	}
+	return schema.Type, nil
+}
+
+// commitTimes returns the commit time of every transaction.
+func commitTimes(db store.Database) (map[store.ID]time.Time, error) {
+	facts, err := db.AttributeFacts(store.IDTxCommitTime)
+	if err != nil {
+		return nil, fmt.Errorf("scanning transaction commit times: %w", err)
+	}
+	times := make(map[store.ID]time.Time, len(facts))
+	for _, fct := range facts {
+		if t, ok := fct.Value.(time.Time); ok {
+			times[fct.EntityID] = t
+		}
+	}
+	return times, nil
+}
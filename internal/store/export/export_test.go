@@ -0,0 +1,418 @@
+/*
+Copyright 2024 Andrew Meredith
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package export_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/kendru/canter/internal/store"
+	"github.com/kendru/canter/internal/store/cantertest"
+	"github.com/kendru/canter/internal/store/export"
+	"github.com/stretchr/testify/assert"
+)
+
+func newExportConn(t *testing.T) *cantertest.Conn {
+	conn := cantertest.NewConn(t, store.Config{})
+	conn.MustAssert(
+		store.EntityData{"db/ident": "person/name", "db/type": "db.type/string"},
+		store.EntityData{"db/ident": "person/age", "db/type": "db.type/int64"},
+		store.EntityData{"db/ident": "person/active", "db/type": "db.type/boolean"},
+		store.EntityData{"db/ident": "person/tags", "db/type": "db.type/string", "db/cardinality": "db.cardinality/many"},
+	)
+	return conn
+}
+
+func TestBatches(t *testing.T) {
+	conn := newExportConn(t)
+	first := conn.MustAssert(
+		store.EntityData{"db/id": store.NamedTempID("alice"), "person/name": "Alice", "person/age": 30},
+		store.EntityData{"db/id": store.NamedTempID("bob"), "person/name": "Bob"},
+		store.EntityData{"db/id": store.NamedTempID("carol"), "person/age": 41},
+	)
+	alice, _ := first.ResolvedID(store.NamedTempID("alice"))
+	bob, _ := first.ResolvedID(store.NamedTempID("bob"))
+	carol, _ := first.ResolvedID(store.NamedTempID("carol"))
+	second := conn.MustAssert(store.EntityData{"db/id": bob, "person/age": 25})
+
+	var batches []export.RecordBatch
+	err := export.Batches(conn.Connection, conn.DB(), export.Options{
+		Attributes: []string{"person/name", "person/age"},
+		BatchSize:  2,
+	}, func(batch *export.RecordBatch) error {
+		batches = append(batches, *batch)
+		return nil
+	})
+	if !assert.NoError(t, err) || !assert.Len(t, batches, 2) {
+		return
+	}
+
+	assert.Equal(t, []export.Field{
+		{Name: export.ColumnID, Type: store.IDTypeRef},
+		{Name: "person/name", Type: store.IDTypeString, Nullable: true},
+		{Name: "person/age", Type: store.IDTypeInt64, Nullable: true},
+		{Name: export.ColumnTx, Type: store.IDTypeRef},
+		{Name: export.ColumnTxTime, Type: store.IDTypeTimestamp, Nullable: true},
+	}, batches[0].Fields)
+	assert.Equal(t, 2, batches[0].NumRows)
+	assert.Equal(t, 1, batches[1].NumRows)
+
+	rows := make(map[store.ID][]store.Value)
+	for _, batch := range batches {
+		for row := 0; row < batch.NumRows; row++ {
+			var values []store.Value
+			for _, col := range batch.Columns {
+				values = append(values, col[row])
+			}
+			rows[values[0].(store.ID)] = values[1:]
+		}
+	}
+	assert.Equal(t, []store.Value{"Alice", int64(30), first.TxID(), first.Tx().Time()}, rows[alice])
+	// The transaction columns describe the latest change to the row.
+	assert.Equal(t, []store.Value{"Bob", int64(25), second.TxID(), second.Tx().Time()}, rows[bob])
+	assert.Equal(t, []store.Value{nil, int64(41), first.TxID(), first.Tx().Time()}, rows[carol])
+
+	// Cardinality-many attributes have no single value per row.
+	err = export.Batches(conn.Connection, conn.DB(), export.Options{Attributes: []string{"person/tags"}},
+		func(*export.RecordBatch) error { return nil })
+	assert.Error(t, err)
+	err = export.Batches(conn.Connection, conn.DB(), export.Options{},
+		func(*export.RecordBatch) error { return nil })
+	assert.Error(t, err)
+}
+
+func TestBatchesEmpty(t *testing.T) {
+	conn := newExportConn(t)
+	var batches []export.RecordBatch
+	err := export.Batches(conn.Connection, conn.DB(), export.Options{Attributes: []string{"person/name"}},
+		func(batch *export.RecordBatch) error {
+			batches = append(batches, *batch)
+			return nil
+		})
+	if assert.NoError(t, err) && assert.Len(t, batches, 1) {
+		assert.Zero(t, batches[0].NumRows)
+		assert.Len(t, batches[0].Fields, 4)
+	}
+}
+
+func TestWriteParquet(t *testing.T) {
+	conn := newExportConn(t)
+	var people []store.Assertable
+	for i := 0; i < 20; i++ {
+		person := store.EntityData{"person/name": fmt.Sprintf("person-%d", i), "person/active": i%2 == 0}
+		if i%3 == 0 {
+			person["person/age"] = i
+		}
+		people = append(people, person)
+	}
+	res := conn.MustAssert(people...)
+
+	var buf bytes.Buffer
+	err := export.WriteParquet(&buf, conn.Connection, conn.DB(), export.Options{
+		Attributes: []string{"person/name", "person/age", "person/active"},
+		BatchSize:  8,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	file := buf.Bytes()
+	if !assert.Greater(t, len(file), 12) {
+		return
+	}
+	assert.Equal(t, "PAR1", string(file[:4]))
+	assert.Equal(t, "PAR1", string(file[len(file)-4:]))
+	metaLen := int(binary.LittleEndian.Uint32(file[len(file)-8:]))
+	if !assert.Less(t, metaLen, len(file)-12) {
+		return
+	}
+	meta, err := readThrift(file[len(file)-8-metaLen : len(file)-8])
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// The schema has a root element followed by a leaf for each column.
+	type column struct {
+		name                            string
+		physical, repetition, converted int64
+	}
+	const (
+		required, optional = 0, 1
+		boolean, int64Type = 0, 2
+		byteArray          = 6
+		noType, utf8       = -1, 0
+		timestampMicros    = 10
+	)
+	schema := meta[2].([]any)
+	if !assert.Len(t, schema, 7) {
+		return
+	}
+	assert.Equal(t, int64(6), schema[0].(thriftStruct)[5])
+	var columns []column
+	for _, elem := range schema[1:] {
+		elem := elem.(thriftStruct)
+		col := column{name: elem[4].(string), physical: elem[1].(int64), repetition: elem[3].(int64), converted: noType}
+		if converted, ok := elem[6]; ok {
+			col.converted = converted.(int64)
+		}
+		columns = append(columns, col)
+	}
+	assert.Equal(t, []column{
+		{"db/id", int64Type, required, noType},
+		{"person/name", byteArray, optional, utf8},
+		{"person/age", int64Type, optional, noType},
+		{"person/active", boolean, optional, noType},
+		{"db/tx", int64Type, required, noType},
+		{"db.tx/commitTime", int64Type, optional, timestampMicros},
+	}, columns)
+
+	// Each batch is a row group with a data page per column.
+	assert.Equal(t, int64(20), meta[3])
+	groups := meta[4].([]any)
+	if !assert.Len(t, groups, 3) {
+		return
+	}
+	rows := make([][]any, len(columns))
+	for i, group := range groups {
+		group := group.(thriftStruct)
+		numRows := group[3].(int64)
+		assert.Equal(t, []int64{8, 8, 4}[i], numRows)
+		chunks := group[1].([]any)
+		if !assert.Len(t, chunks, len(columns)) {
+			return
+		}
+		for c, chunk := range chunks {
+			chunkMeta := chunk.(thriftStruct)[3].(thriftStruct)
+			assert.Equal(t, columns[c].physical, chunkMeta[1])
+			assert.Equal(t, numRows, chunkMeta[5])
+			values, err := readDataPage(file, chunkMeta[9].(int64), columns[c].physical, columns[c].repetition == optional)
+			if !assert.NoError(t, err, "column %s", columns[c].name) {
+				return
+			}
+			assert.Len(t, values, int(numRows))
+			rows[c] = append(rows[c], values...)
+		}
+	}
+
+	commitTime := res.Tx().Time().UnixMicro()
+	seen := make(map[string]bool)
+	for row := range rows[0] {
+		assert.NotZero(t, rows[0][row])
+		name := rows[1][row].(string)
+		seen[name] = true
+		var i int
+		_, err := fmt.Sscanf(name, "person-%d", &i)
+		assert.NoError(t, err)
+		if i%3 == 0 {
+			assert.Equal(t, int64(i), rows[2][row], name)
+		} else {
+			assert.Nil(t, rows[2][row], name)
+		}
+		assert.Equal(t, i%2 == 0, rows[3][row], name)
+		assert.Equal(t, int64(res.TxID()), rows[4][row], name)
+		assert.Equal(t, commitTime, rows[5][row], name)
+	}
+	assert.Len(t, seen, 20)
+
+	// Types without a Parquet representation are refused.
+	conn.MustAssert(store.EntityData{"db/ident": "person/nicknames", "db/type": "db.type/tuple"})
+	conn.MustAssert(store.EntityData{"person/nicknames": store.Tuple{"al"}, "person/name": "Al", "person/age": 3, "person/active": true})
+	err = export.WriteParquet(&bytes.Buffer{}, conn.Connection, conn.DB(), export.Options{
+		Attributes: []string{"person/nicknames"},
+	})
+	assert.Error(t, err)
+}
+
+// thriftStruct is a struct decoded from the Thrift compact protocol, by field
+// ID. Integers are decoded as int64s, binary fields as strings, and lists as
+// []any.
+type thriftStruct map[int16]any
+
+// thriftReader decodes the Thrift compact protocol, which Parquet uses for its
+// page headers and file metadata.
+type thriftReader struct {
+	buf []byte
+	pos int
+}
+
+// readThrift decodes a struct from the start of buf.
+func readThrift(buf []byte) (thriftStruct, error) {
+	r := &thriftReader{buf: buf}
+	return r.readStruct()
+}
+
+func (r *thriftReader) readStruct() (thriftStruct, error) {
+	out := make(thriftStruct)
+	var last int16
+	for {
+		if r.pos >= len(r.buf) {
+			return nil, errors.New("truncated struct")
+		}
+		header := r.buf[r.pos]
+		r.pos++
+		if header == 0 {
+			return out, nil
+		}
+		id := last + int16(header>>4)
+		if header>>4 == 0 {
+			v, err := r.varint()
+			if err != nil {
+				return nil, err
+			}
+			id = int16(v)
+		}
+		last = id
+		val, err := r.readValue(header & 0x0f)
+		if err != nil {
+			return nil, fmt.Errorf("field %d: %w", id, err)
+		}
+		out[id] = val
+	}
+}
+
+func (r *thriftReader) readValue(typ byte) (any, error) {
+	switch typ {
+	case 1:
+		return true, nil
+	case 2:
+		return false, nil
+	case 5, 6:
+		return r.varint()
+	case 8:
+		n, err := r.uvarint()
+		if err != nil {
+			return nil, err
+		}
+		if r.pos+int(n) > len(r.buf) {
+			return nil, errors.New("truncated binary")
+		}
+		s := string(r.buf[r.pos : r.pos+int(n)])
+		r.pos += int(n)
+		return s, nil
+	case 9:
+		if r.pos >= len(r.buf) {
+			return nil, errors.New("truncated list")
+		}
+		header := r.buf[r.pos]
+		r.pos++
+		n := uint64(header >> 4)
+		if n == 15 {
+			var err error
+			if n, err = r.uvarint(); err != nil {
+				return nil, err
+			}
+		}
+		list := make([]any, n)
+		for i := range list {
+			elem, err := r.readValue(header & 0x0f)
+			if err != nil {
+				return nil, err
+			}
+			list[i] = elem
+		}
+		return list, nil
+	case 12:
+		return r.readStruct()
+	}
+	return nil, fmt.Errorf("unexpected type %d", typ)
+}
+
+func (r *thriftReader) varint() (int64, error) {
+	v, n := binary.Varint(r.buf[r.pos:])
+	if n <= 0 {
+		return 0, errors.New("malformed varint")
+	}
+	r.pos += n
+	return v, nil
+}
+
+func (r *thriftReader) uvarint() (uint64, error) {
+	v, n := binary.Uvarint(r.buf[r.pos:])
+	if n <= 0 {
+		return 0, errors.New("malformed varint")
+	}
+	r.pos += n
+	return v, nil
+}
+
+// readDataPage decodes the values of the uncompressed, PLAIN-encoded data page
+// at offset, with nil for the values that an optional column does not define.
+func readDataPage(file []byte, offset int64, physical int64, optional bool) ([]any, error) {
+	r := &thriftReader{buf: file, pos: int(offset)}
+	header, err := r.readStruct()
+	if err != nil {
+		return nil, fmt.Errorf("reading page header: %w", err)
+	}
+	size := int(header[3].(int64))
+	if int(header[2].(int64)) != size {
+		return nil, errors.New("page is compressed")
+	}
+	dataHeader := header[5].(thriftStruct)
+	if dataHeader[2] != int64(0) {
+		return nil, fmt.Errorf("page encoding is %v, not PLAIN", dataHeader[2])
+	}
+	numValues := int(dataHeader[1].(int64))
+	if r.pos+size > len(file) {
+		return nil, errors.New("truncated page")
+	}
+	page := file[r.pos : r.pos+size]
+
+	defined := make([]bool, numValues)
+	for i := range defined {
+		defined[i] = true
+	}
+	if optional {
+		// Definition levels are a single bit-packed run of the RLE/bit-packing
+		// hybrid encoding, prefixed by their length.
+		n := int(binary.LittleEndian.Uint32(page))
+		levels := page[4 : 4+n]
+		page = page[4+n:]
+		run, k := binary.Uvarint(levels)
+		if k <= 0 || run&1 == 0 || int(run>>1)*8 < numValues {
+			return nil, fmt.Errorf("unexpected definition levels %x", levels)
+		}
+		for i := range defined {
+			defined[i] = levels[k+i/8]&(1<<(i%8)) != 0
+		}
+	}
+
+	values := make([]any, numValues)
+	var bit int
+	for i := range values {
+		if !defined[i] {
+			continue
+		}
+		switch physical {
+		case 0:
+			values[i] = page[bit/8]&(1<<(bit%8)) != 0
+			bit++
+		case 2:
+			values[i] = int64(binary.LittleEndian.Uint64(page))
+			page = page[8:]
+		case 6:
+			n := binary.LittleEndian.Uint32(page)
+			values[i] = string(page[4 : 4+n])
+			page = page[4+n:]
+		default:
+			return nil, fmt.Errorf("unexpected physical type %d", physical)
+		}
+	}
+	return values, nil
+}
@@ -0,0 +1,429 @@
+/*
+Copyright 2024 Andrew Meredith
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package export
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"time"
+
+	"github.com/gofrs/uuid/v5"
+	"github.com/kendru/canter/internal/store"
+	"github.com/oklog/ulid/v2"
+)
+
+// Physical types, converted types, encodings, and other enumerations from the
+// Parquet format specification.
+const (
+	parquetBoolean   = 0
+	parquetInt32     = 1
+	parquetInt64     = 2
+	parquetFloat     = 4
+	parquetDouble    = 5
+	parquetByteArray = 6
+
+	convertedNone            = -1
+	convertedUTF8            = 0
+	convertedDate            = 6
+	convertedTimestampMicros = 10
+	convertedInt8            = 15
+	convertedInt16           = 16
+
+	repetitionRequired = 0
+	repetitionOptional = 1
+
+	encodingPlain = 0
+	encodingRLE   = 3
+
+	pageTypeData = 0
+)
+
+var parquetMagic = []byte("PAR1")
+
+// WriteParquet writes the record batches produced by Batches to w as a Parquet
+// file with a row group per batch. Pages are not compressed. Strings, UUIDs,
+// ULIDs, and blob digests are written as UTF-8 strings, refs as 64-bit
+// integers, timestamps with microsecond precision, and dates as days since the
+// Unix epoch. Decimal, composite, and tuple attributes are not supported.
+func WriteParquet(w io.Writer, conn *store.Connection, db store.Database, opts Options) error {
+	pw := &parquetWriter{w: w}
+	if err := pw.write(parquetMagic); err != nil {
+		return err
+	}
+	err := Batches(conn, db, opts, func(batch *RecordBatch) error {
+		if pw.columns == nil {
+			columns, err := parquetColumns(batch.Fields)
+			if err != nil {
+				return err
+			}
+			pw.columns = columns
+		}
+		return pw.writeRowGroup(batch)
+	})
+	if err != nil {
+		return err
+	}
+	return pw.writeFooter()
+}
+
+type parquetColumn struct {
+	name       string
+	physical   int32
+	converted  int32
+	repetition int32
+	// encode appends the PLAIN encoding of a value of any physical type but
+	// boolean, which is bit-packed across values.
+	encode func(buf *bytes.Buffer, val store.Value) error
+}
+
+func parquetColumns(fields []Field) ([]parquetColumn, error) {
+	columns := make([]parquetColumn, len(fields))
+	for i, field := range fields {
+		col := parquetColumn{name: field.Name, converted: convertedNone, repetition: repetitionRequired}
+		if field.Nullable {
+			col.repetition = repetitionOptional
+		}
+		switch field.Type {
+		case store.IDTypeString:
+			col.physical, col.converted, col.encode = parquetByteArray, convertedUTF8, encodeByteArray
+		case store.IDTypeBoolean:
+			col.physical = parquetBoolean
+		case store.IDTypeInt64:
+			col.physical, col.encode = parquetInt64, encodeInt64
+		case store.IDTypeInt32:
+			col.physical, col.encode = parquetInt32, encodeInt32
+		case store.IDTypeInt16:
+			col.physical, col.converted, col.encode = parquetInt32, convertedInt16, encodeInt32
+		case store.IDTypeInt8:
+			col.physical, col.converted, col.encode = parquetInt32, convertedInt8, encodeInt32
+		case store.IDTypeFloat64:
+			col.physical, col.encode = parquetDouble, encodeFloat64
+		case store.IDTypeFloat32:
+			col.physical, col.encode = parquetFloat, encodeFloat32
+		case store.IDTypeTimestamp:
+			col.physical, col.converted, col.encode = parquetInt64, convertedTimestampMicros, encodeTimestamp
+		case store.IDTypeDate:
+			col.physical, col.converted, col.encode = parquetInt32, convertedDate, encodeDate
+		case store.IDTypeRef:
+			col.physical, col.encode = parquetInt64, encodeInt64
+		case store.IDTypeBinary:
+			col.physical, col.encode = parquetByteArray, encodeByteArray
+		case store.IDTypeUUID, store.IDTypeULID, store.IDTypeBlob:
+			col.physical, col.converted, col.encode = parquetByteArray, convertedUTF8, encodeByteArray
+		default:
+			return nil, fmt.Errorf("column %s: type %v cannot be written to Parquet", field.Name, field.Type)
+		}
+		columns[i] = col
+	}
+	return columns, nil
+}
+
+func encodeByteArray(buf *bytes.Buffer, val store.Value) error {
+	var b []byte
+	switch v := val.(type) {
+	case string:
+		b = []byte(v)
+	case []byte:
+		b = v
+	case uuid.UUID:
+		b = []byte(v.String())
+	case ulid.ULID:
+		b = []byte(v.String())
+	case store.BlobDigest:
+		b = []byte(v.String())
+	default:
+		return fmt.Errorf("unexpected value for byte array column: %T", val)
+	}
+	buf.Write(binary.LittleEndian.AppendUint32(nil, uint32(len(b))))
+	buf.Write(b)
+	return nil
+}
+
+func encodeInt64(buf *bytes.Buffer, val store.Value) error {
+	var n int64
+	switch v := val.(type) {
+	case int64:
+		n = v
+	case store.ID:
+		n = int64(v)
+	default:
+		return fmt.Errorf("unexpected value for INT64 column: %T", val)
+	}
+	buf.Write(binary.LittleEndian.AppendUint64(nil, uint64(n)))
+	return nil
+}
+
+func encodeInt32(buf *bytes.Buffer, val store.Value) error {
+	var n int32
+	switch v := val.(type) {
+	case int32:
+		n = v
+	case int16:
+		n = int32(v)
+	case int8:
+		n = int32(v)
+	default:
+		return fmt.Errorf("unexpected value for INT32 column: %T", val)
+	}
+	buf.Write(binary.LittleEndian.AppendUint32(nil, uint32(n)))
+	return nil
+}
+
+func encodeFloat64(buf *bytes.Buffer, val store.Value) error {
+	f, ok := val.(float64)
+	if !ok {
+		return fmt.Errorf("unexpected value for DOUBLE column: %T", val)
+	}
+	buf.Write(binary.LittleEndian.AppendUint64(nil, math.Float64bits(f)))
+	return nil
+}
+
+func encodeFloat32(buf *bytes.Buffer, val store.Value) error {
+	f, ok := val.(float32)
+	if !ok {
+		return fmt.Errorf("unexpected value for FLOAT column: %T", val)
+	}
+	buf.Write(binary.LittleEndian.AppendUint32(nil, math.Float32bits(f)))
+	return nil
+}
+
+func encodeTimestamp(buf *bytes.Buffer, val store.Value) error {
+	t, ok := val.(time.Time)
+	if !ok {
+		return fmt.Errorf("unexpected value for timestamp column: %T", val)
+	}
+	buf.Write(binary.LittleEndian.AppendUint64(nil, uint64(t.UnixMicro())))
+	return nil
+}
+
+func encodeDate(buf *bytes.Buffer, val store.Value) error {
+	t, ok := val.(time.Time)
+	if !ok {
+		return fmt.Errorf("unexpected value for date column: %T", val)
+	}
+	secs := t.Unix()
+	days := secs / 86400
+	if secs < 0 && secs%86400 != 0 {
+		days--
+	}
+	buf.Write(binary.LittleEndian.AppendUint32(nil, uint32(int32(days))))
+	return nil
+}
+
+// columnChunk records where a column of a row group was written.
+type columnChunk struct {
+	numValues  int64
+	size       int64
+	pageOffset int64
+}
+
+type rowGroup struct {
+	chunks  []columnChunk
+	numRows int64
+	size    int64
+}
+
+type parquetWriter struct {
+	w         io.Writer
+	offset    int64
+	columns   []parquetColumn
+	rowGroups []rowGroup
+}
+
+func (pw *parquetWriter) write(b []byte) error {
+	n, err := pw.w.Write(b)
+	pw.offset += int64(n)
+	return err
+}
+
+// writeRowGroup writes a batch as a row group of one data page per column.
+func (pw *parquetWriter) writeRowGroup(batch *RecordBatch) error {
+	if batch.NumRows == 0 {
+		return nil
+	}
+	rg := rowGroup{numRows: int64(batch.NumRows)}
+	for i, col := range pw.columns {
+		page, err := col.dataPage(batch.Columns[i])
+		if err != nil {
+			return err
+		}
+		header := pageHeader(len(batch.Columns[i]), len(page))
+		chunk := columnChunk{
+			numValues:  int64(len(batch.Columns[i])),
+			size:       int64(len(header) + len(page)),
+			pageOffset: pw.offset,
+		}
+		if err := pw.write(header); err != nil {
+			return err
+		}
+		if err := pw.write(page); err != nil {
+			return err
+		}
+		rg.chunks = append(rg.chunks, chunk)
+		rg.size += chunk.size
+	}
+	pw.rowGroups = append(pw.rowGroups, rg)
+	return nil
+}
+
+// dataPage encodes the values of a column as the body of a data page: the
+// definition levels of an optional column followed by its non-nil values.
+func (col parquetColumn) dataPage(values []store.Value) ([]byte, error) {
+	var page bytes.Buffer
+	if col.repetition == repetitionOptional {
+		defined := make([]bool, len(values))
+		for i, val := range values {
+			defined[i] = val != nil
+		}
+		levels := encodeLevels(defined)
+		page.Write(binary.LittleEndian.AppendUint32(nil, uint32(len(levels))))
+		page.Write(levels)
+	}
+
+	if col.physical == parquetBoolean {
+		var bools []bool
+		for _, val := range values {
+			if val == nil {
+				continue
+			}
+			b, ok := val.(bool)
+			if !ok {
+				return nil, fmt.Errorf("column %s: unexpected value for BOOLEAN column: %T", col.name, val)
+			}
+			bools = append(bools, b)
+		}
+		page.Write(packBits(bools))
+		return page.Bytes(), nil
+	}
+
+	for _, val := range values {
+		if val == nil {
+			if col.repetition == repetitionRequired {
+				return nil, fmt.Errorf("column %s: missing value for required column", col.name)
+			}
+			continue
+		}
+		if err := col.encode(&page, val); err != nil {
+			return nil, fmt.Errorf("column %s: %w", col.name, err)
+		}
+	}
+	return page.Bytes(), nil
+}
+
+// encodeLevels encodes definition levels of bit width 1 as a single
+// bit-packed run of the RLE/bit-packing hybrid encoding.
+func encodeLevels(defined []bool) []byte {
+	groups := (len(defined) + 7) / 8
+	out := binary.AppendUvarint(nil, uint64(groups)<<1|1)
+	return append(out, packBits(defined)...)
+}
+
+// packBits packs booleans into bytes, least significant bit first.
+func packBits(bits []bool) []byte {
+	out := make([]byte, (len(bits)+7)/8)
+	for i, b := range bits {
+		if b {
+			out[i/8] |= 1 << (i % 8)
+		}
+	}
+	return out
+}
+
+func pageHeader(numValues, size int) []byte {
+	var w thriftWriter
+	w.structBegin()
+	w.i32Field(1, pageTypeData)
+	w.i32Field(2, int32(size))
+	w.i32Field(3, int32(size))
+	w.structField(5)
+	w.i32Field(1, int32(numValues))
+	w.i32Field(2, encodingPlain)
+	w.i32Field(3, encodingRLE)
+	w.i32Field(4, encodingRLE)
+	w.structEnd()
+	w.structEnd()
+	return w.Bytes()
+}
+
+// writeFooter writes the file metadata and the trailing magic number.
+func (pw *parquetWriter) writeFooter() error {
+	var w thriftWriter
+	var numRows int64
+	for _, rg := range pw.rowGroups {
+		numRows += rg.numRows
+	}
+
+	w.structBegin()
+	w.i32Field(1, 1)
+	w.listField(2, thriftStruct, len(pw.columns)+1)
+	w.structBegin()
+	w.stringField(4, "schema")
+	w.i32Field(5, int32(len(pw.columns)))
+	w.structEnd()
+	for _, col := range pw.columns {
+		w.structBegin()
+		w.i32Field(1, col.physical)
+		w.i32Field(3, col.repetition)
+		w.stringField(4, col.name)
+		if col.converted != convertedNone {
+			w.i32Field(6, col.converted)
+		}
+		w.structEnd()
+	}
+	w.i64Field(3, numRows)
+	w.listField(4, thriftStruct, len(pw.rowGroups))
+	for _, rg := range pw.rowGroups {
+		w.structBegin()
+		w.listField(1, thriftStruct, len(rg.chunks))
+		for i, chunk := range rg.chunks {
+			col := pw.columns[i]
+			w.structBegin()
+			w.i64Field(2, chunk.pageOffset)
+			w.structField(3)
+			w.i32Field(1, col.physical)
+			w.listField(2, thriftI32, 2)
+			w.i32Elem(encodingPlain)
+			w.i32Elem(encodingRLE)
+			w.listField(3, thriftBinary, 1)
+			w.stringElem(col.name)
+			w.i32Field(4, 0) // Uncompressed
+			w.i64Field(5, chunk.numValues)
+			w.i64Field(6, chunk.size)
+			w.i64Field(7, chunk.size)
+			w.i64Field(9, chunk.pageOffset)
+			w.structEnd()
+			w.structEnd()
+		}
+		w.i64Field(2, rg.size)
+		w.i64Field(3, rg.numRows)
+		w.structEnd()
+	}
+	w.stringField(6, "canter")
+	w.structEnd()
+
+	meta := w.Bytes()
+	if err := pw.write(meta); err != nil {
+		return err
+	}
+	if err := pw.write(binary.LittleEndian.AppendUint32(nil, uint32(len(meta)))); err != nil {
+		return err
+	}
+	return pw.write(parquetMagic)
+}
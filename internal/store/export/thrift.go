@@ -0,0 +1,119 @@
+/*
+Copyright 2024 Andrew Meredith
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package export
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// Type codes of the Thrift compact protocol.
+const (
+	thriftI32    = 5
+	thriftI64    = 6
+	thriftBinary = 8
+	thriftList   = 9
+	thriftStruct = 12
+)
+
+// thriftWriter encodes structs with the Thrift compact protocol, which Parquet
+// uses for its page headers and file metadata. Only the types that those
+// structures need are supported. Every struct, including the outermost, is
+// written between structBegin and structEnd.
+type thriftWriter struct {
+	buf bytes.Buffer
+	// lastField holds the ID of the last field written in each open struct,
+	// since field IDs are encoded as deltas from it.
+	lastField []int16
+}
+
+func (w *thriftWriter) Bytes() []byte {
+	return w.buf.Bytes()
+}
+
+func (w *thriftWriter) fieldHeader(id int16, typ byte) {
+	last := &w.lastField[len(w.lastField)-1]
+	if delta := id - *last; delta > 0 && delta <= 15 {
+		w.buf.WriteByte(byte(delta)<<4 | typ)
+	} else {
+		w.buf.WriteByte(typ)
+		w.varint(int64(id))
+	}
+	*last = id
+}
+
+// varint writes a zigzag-encoded integer.
+func (w *thriftWriter) varint(v int64) {
+	w.buf.Write(binary.AppendVarint(nil, v))
+}
+
+func (w *thriftWriter) uvarint(v uint64) {
+	w.buf.Write(binary.AppendUvarint(nil, v))
+}
+
+func (w *thriftWriter) i32Field(id int16, v int32) {
+	w.fieldHeader(id, thriftI32)
+	w.varint(int64(v))
+}
+
+func (w *thriftWriter) i64Field(id int16, v int64) {
+	w.fieldHeader(id, thriftI64)
+	w.varint(v)
+}
+
+func (w *thriftWriter) stringField(id int16, v string) {
+	w.fieldHeader(id, thriftBinary)
+	w.uvarint(uint64(len(v)))
+	w.buf.WriteString(v)
+}
+
+// structField begins a struct-valued field. It must be closed by structEnd.
+func (w *thriftWriter) structField(id int16) {
+	w.fieldHeader(id, thriftStruct)
+	w.structBegin()
+}
+
+// listField begins a list-valued field of n elements of the given type. Struct
+// elements are written with structBegin and structEnd, and other elements with
+// the element writers.
+func (w *thriftWriter) listField(id int16, elemType byte, n int) {
+	w.fieldHeader(id, thriftList)
+	if n < 15 {
+		w.buf.WriteByte(byte(n)<<4 | elemType)
+	} else {
+		w.buf.WriteByte(0xf0 | elemType)
+		w.uvarint(uint64(n))
+	}
+}
+
+func (w *thriftWriter) i32Elem(v int32) {
+	w.varint(int64(v))
+}
+
+func (w *thriftWriter) stringElem(v string) {
+	w.uvarint(uint64(len(v)))
+	w.buf.WriteString(v)
+}
+
+func (w *thriftWriter) structBegin() {
+	w.lastField = append(w.lastField, 0)
+}
+
+func (w *thriftWriter) structEnd() {
+	w.buf.WriteByte(0)
+	w.lastField = w.lastField[:len(w.lastField)-1]
+}
@@ -16,9 +16,41 @@ limitations under the License.
 
 package store
 
+import (
+	"bytes"
+	"time"
+)
+
 type Fact struct {
 	EntityID  ID
 	Attribute ID
 	Value     Value
 	Tx        ID
+
+	// ValidFrom and ValidTo bound the period during which the fact holds in
+	// the domain being modeled (valid time), as opposed to when the fact was
+	// recorded (transaction time). A zero time indicates that the period is
+	// unbounded on that side. ValidFrom is inclusive, and ValidTo is exclusive.
+	ValidFrom time.Time
+	ValidTo   time.Time
+}
+
+// Clone returns a copy of the fact that does not share memory with it, such as
+// a fact borrowed by a FactVisitor.
+func (f Fact) Clone() Fact {
+	if b, ok := f.Value.([]byte); ok {
+		f.Value = bytes.Clone(b)
+	}
+	return f
+}
+
+// ValidAt reports whether the fact's valid-time period contains t.
+func (f Fact) ValidAt(t time.Time) bool {
+	if !f.ValidFrom.IsZero() && t.Before(f.ValidFrom) {
+		return false
+	}
+	if !f.ValidTo.IsZero() && !t.Before(f.ValidTo) {
+		return false
+	}
+	return true
 }
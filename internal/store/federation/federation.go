@@ -0,0 +1,327 @@
+/*
+Copyright 2024 Andrew Meredith
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package federation runs queries and pulls across several stores, such as
+// the per-tenant shards of a multi-tenant service, as if they were one.
+//
+// Connections are registered with a Federation under a shard name. A
+// federated query runs against the latest database of every shard
+// concurrently, and the rows of all shards are merged into a single result
+// without duplicates. A federated pull looks an entity up by a unique
+// attribute in every shard and merges the data found. A shard that fails does
+// not fail the whole operation: its error is reported alongside the results
+// of the other shards, and the operation only fails if every shard does.
+//
+// Entity IDs are allocated by each store independently, so an ID is only
+// meaningful within the shard that it came from. Federated queries should
+// find values, such as the values of unique attributes, rather than IDs.
+package federation
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/kendru/canter/internal/store"
+)
+
+// ShardError is the error of a single shard of a federated operation.
+type ShardError struct {
+	Shard string
+	Err   error
+}
+
+func (e *ShardError) Error() string {
+	return fmt.Sprintf("shard %s: %v", e.Shard, e.Err)
+}
+
+func (e *ShardError) Unwrap() error {
+	return e.Err
+}
+
+// Federation is a set of connections, called shards, that are queried
+// together. A Federation is safe for concurrent use, and shards may be
+// registered while operations are in progress; an operation uses the shards
+// that were registered when it started.
+type Federation struct {
+	mu     sync.RWMutex
+	names  []string
+	shards map[string]*store.Connection
+}
+
+// New returns a federation without shards.
+func New() *Federation {
+	return &Federation{shards: make(map[string]*store.Connection)}
+}
+
+// Register adds conn to the federation under name. The results of shards
+// are merged in the order that the shards were registered.
+func (f *Federation) Register(name string, conn *store.Connection) error {
+	if name == "" {
+		return errors.New("shard name may not be empty")
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.shards[name]; ok {
+		return fmt.Errorf("shard %s is already registered", name)
+	}
+	f.names = append(f.names, name)
+	f.shards[name] = conn
+	return nil
+}
+
+// Unregister removes the shard with the given name, if it is registered. The
+// shard's connection is not closed.
+func (f *Federation) Unregister(name string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.shards[name]; !ok {
+		return
+	}
+	delete(f.shards, name)
+	for i, n := range f.names {
+		if n == name {
+			f.names = append(f.names[:i:i], f.names[i+1:]...)
+			break
+		}
+	}
+}
+
+// Shards returns the names of the registered shards in registration order.
+func (f *Federation) Shards() []string {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return append([]string(nil), f.names...)
+}
+
+// shard is a registered connection along with its position in registration
+// order.
+type shard struct {
+	name string
+	conn *store.Connection
+}
+
+func (f *Federation) snapshot() []shard {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	shards := make([]shard, len(f.names))
+	for i, name := range f.names {
+		shards[i] = shard{name: name, conn: f.shards[name]}
+	}
+	return shards
+}
+
+// fanOut calls fn with the latest database of every shard concurrently and
+// returns the result of each shard in registration order. It returns early
+// with ctx.Err() if ctx is done before every shard has finished.
+func fanOut[T any](ctx context.Context, shards []shard, fn func(db store.Database) (T, error)) ([]T, []error, error) {
+	type outcome struct {
+		i   int
+		val T
+		err error
+	}
+	// The channel is buffered so that shards that finish after ctx is done
+	// do not block.
+	outcomes := make(chan outcome, len(shards))
+	for i, s := range shards {
+		go func(i int, s shard) {
+			val, err := fn(s.conn.DB())
+			outcomes <- outcome{i: i, val: val, err: err}
+		}(i, s)
+	}
+
+	vals := make([]T, len(shards))
+	errs := make([]error, len(shards))
+	for range shards {
+		select {
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		case o := <-outcomes:
+			vals[o.i], errs[o.i] = o.val, o.err
+		}
+	}
+	return vals, errs, nil
+}
+
+// shardErrors collects the errors of the shards that failed. If every shard
+// failed, it also returns an error that joins them.
+func shardErrors(shards []shard, errs []error) ([]*ShardError, error) {
+	var failed []*ShardError
+	joined := make([]error, 0, len(errs))
+	for i, err := range errs {
+		if err == nil {
+			continue
+		}
+		se := &ShardError{Shard: shards[i].name, Err: err}
+		failed = append(failed, se)
+		joined = append(joined, se)
+	}
+	if len(shards) > 0 && len(failed) == len(shards) {
+		return failed, errors.Join(joined...)
+	}
+	return failed, nil
+}
+
+// QueryResult is the result of a federated query.
+type QueryResult struct {
+	Vars []store.Var
+	// Rows holds every distinct row found by any shard, in the order of
+	// store.CompareValues applied to each column in turn.
+	Rows [][]store.Value
+	// Errors holds the errors of the shards that failed, whose rows are
+	// missing from Rows.
+	Errors []*ShardError
+}
+
+// Query runs q against the latest database of every shard and merges the
+// rows. It fails if there are no shards, if ctx is done before every shard
+// has answered, or if every shard fails.
+func (f *Federation) Query(ctx context.Context, q store.Query) (*QueryResult, error) {
+	shards := f.snapshot()
+	if len(shards) == 0 {
+		return nil, errors.New("federation has no shards")
+	}
+	results, errs, err := fanOut(ctx, shards, func(db store.Database) ([][]store.Value, error) {
+		return db.Query(q)
+	})
+	if err != nil {
+		return nil, err
+	}
+	failed, err := shardErrors(shards, errs)
+	if err != nil {
+		return nil, err
+	}
+
+	var rows [][]store.Value
+	for _, shardRows := range results {
+		rows = append(rows, shardRows...)
+	}
+	return &QueryResult{Vars: q.Find, Rows: dedupeRows(rows), Errors: failed}, nil
+}
+
+// dedupeRows sorts rows and removes duplicates.
+func dedupeRows(rows [][]store.Value) [][]store.Value {
+	sort.SliceStable(rows, func(i, j int) bool { return compareRows(rows[i], rows[j]) < 0 })
+	out := rows[:0]
+	for i, row := range rows {
+		if i > 0 && compareRows(row, out[len(out)-1]) == 0 {
+			continue
+		}
+		out = append(out, row)
+	}
+	return out
+}
+
+func compareRows(a, b []store.Value) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if c := store.CompareValues(a[i], b[i]); c != 0 {
+			return c
+		}
+	}
+	return len(a) - len(b)
+}
+
+// PullResult is the result of a federated pull.
+type PullResult struct {
+	// Data is the merged data of the entity. For each key, the value of the
+	// first shard in registration order that has one is used, except that
+	// the values of cardinality-many attributes are combined without
+	// duplicates.
+	Data store.EntityData
+	// Shards names the shards in which the entity was found, in
+	// registration order.
+	Shards []string
+	// Errors holds the errors of the shards that failed.
+	Errors []*ShardError
+}
+
+// Pull looks up the entity identified by lookup in every shard, pulls pattern
+// from each shard that has it, and merges the data. A shard that does not
+// have the entity is not an error, but Pull fails with store.ErrNoSuchEntity
+// if no shard has it and none failed.
+func (f *Federation) Pull(ctx context.Context, lookup store.Lookup, pattern ...store.PullAttr) (*PullResult, error) {
+	shards := f.snapshot()
+	if len(shards) == 0 {
+		return nil, errors.New("federation has no shards")
+	}
+	results, errs, err := fanOut(ctx, shards, func(db store.Database) (store.EntityData, error) {
+		data, err := db.Pull(lookup, pattern...)
+		if errors.Is(err, store.ErrNoSuchEntity) || errors.Is(err, store.ErrNoSuchIdent) {
+			// The shard does not have the entity, or lacks the lookup
+			// attribute altogether.
+			return nil, nil
+		}
+		return data, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	failed, err := shardErrors(shards, errs)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &PullResult{Errors: failed}
+	for i, data := range results {
+		if data == nil {
+			continue
+		}
+		res.Shards = append(res.Shards, shards[i].name)
+		if res.Data == nil {
+			res.Data = make(store.EntityData, len(data))
+		}
+		mergeEntityData(res.Data, data)
+	}
+	if res.Data == nil && len(failed) == 0 {
+		return nil, fmt.Errorf("pulling %s %v: %w", lookup.AttributeName, lookup.Value, store.ErrNoSuchEntity)
+	}
+	return res, nil
+}
+
+// mergeEntityData merges src into dst. Keys already in dst keep their values,
+// except that []Value values are combined without duplicates.
+func mergeEntityData(dst, src store.EntityData) {
+	for key, val := range src {
+		cur, ok := dst[key]
+		if !ok {
+			dst[key] = val
+			continue
+		}
+		curVals, curMany := cur.([]store.Value)
+		vals, many := val.([]store.Value)
+		if !curMany || !many {
+			continue
+		}
+		merged := append([]store.Value(nil), curVals...)
+		for _, v := range vals {
+			if !containsValue(merged, v) {
+				merged = append(merged, v)
+			}
+		}
+		dst[key] = merged
+	}
+}
+
+func containsValue(vals []store.Value, v store.Value) bool {
+	for _, cur := range vals {
+		if store.ValueEqual(cur, v) {
+			return true
+		}
+	}
+	return false
+}
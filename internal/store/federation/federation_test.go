@@ -0,0 +1,154 @@
+/*
+Copyright 2024 Andrew Meredith
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package federation_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/kendru/canter/internal/store"
+	"github.com/kendru/canter/internal/store/cantertest"
+	"github.com/kendru/canter/internal/store/federation"
+	"github.com/kendru/canter/pkg/rtype"
+	"github.com/stretchr/testify/assert"
+)
+
+func newShard(t *testing.T, people ...store.EntityData) *cantertest.Conn {
+	conn := cantertest.NewConn(t, store.Config{})
+	conn.MustAssert(
+		store.EntityData{"db/ident": "person/email", "db/type": "db.type/string", "db/unique": "db.unique/identity"},
+		store.EntityData{"db/ident": "person/name", "db/type": "db.type/string"},
+		store.EntityData{"db/ident": "person/tags", "db/type": "db.type/string", "db/cardinality": "db.cardinality/many"},
+	)
+	if len(people) > 0 {
+		conn.MustAssert(toAssertables(people)...)
+	}
+	return conn
+}
+
+func toAssertables(data []store.EntityData) []store.Assertable {
+	out := make([]store.Assertable, len(data))
+	for i, d := range data {
+		out[i] = d
+	}
+	return out
+}
+
+var namesQuery = store.Query{
+	Find: []store.Var{"?name"},
+	Where: []store.Clause{
+		store.Pattern{Entity: store.Var("?e"), Attribute: "person/name", Value: store.Var("?name")},
+		store.Predicate{Fn: "shard/ok?", Args: []any{store.Var("?name")}},
+	},
+}
+
+// registerCheck registers the shard/ok? predicate of namesQuery, which fails
+// with err if it is not nil.
+func registerCheck(t *testing.T, conn *cantertest.Conn, err error) {
+	assert.NoError(t, conn.RegisterFunction("shard/ok?", store.Function{
+		Params: []rtype.ConcreteType{nil},
+		Result: rtype.RTypeBool,
+		Fn: func([]store.Value) (store.Value, error) {
+			return err == nil, err
+		},
+	}))
+}
+
+func TestFederatedQuery(t *testing.T) {
+	ctx := context.Background()
+	east := newShard(t,
+		store.EntityData{"person/email": "ada@example.com", "person/name": "Ada"},
+		store.EntityData{"person/email": "bo@example.com", "person/name": "Bo"},
+	)
+	west := newShard(t,
+		store.EntityData{"person/email": "cy@example.com", "person/name": "Cy"},
+		store.EntityData{"person/email": "ada@west.example.com", "person/name": "Ada"},
+	)
+
+	registerCheck(t, east, nil)
+	registerCheck(t, west, nil)
+
+	fed := federation.New()
+	_, err := fed.Query(ctx, namesQuery)
+	assert.Error(t, err)
+
+	assert.NoError(t, fed.Register("east", east.Connection))
+	assert.NoError(t, fed.Register("west", west.Connection))
+	assert.Error(t, fed.Register("east", west.Connection))
+	assert.Equal(t, []string{"east", "west"}, fed.Shards())
+
+	res, err := fed.Query(ctx, namesQuery)
+	if assert.NoError(t, err) {
+		assert.Equal(t, []store.Var{"?name"}, res.Vars)
+		assert.Equal(t, [][]store.Value{{"Ada"}, {"Bo"}, {"Cy"}}, res.Rows)
+		assert.Empty(t, res.Errors)
+	}
+
+	// A failed shard is reported without failing the query.
+	broken := newShard(t, store.EntityData{"person/email": "dee@example.com", "person/name": "Dee"})
+	registerCheck(t, broken, errors.New("shard unavailable"))
+	assert.NoError(t, fed.Register("broken", broken.Connection))
+	res, err = fed.Query(ctx, namesQuery)
+	if assert.NoError(t, err) {
+		assert.Len(t, res.Rows, 3)
+		if assert.Len(t, res.Errors, 1) {
+			assert.Equal(t, "broken", res.Errors[0].Shard)
+		}
+	}
+
+	// The query only fails if every shard fails.
+	fed.Unregister("east")
+	fed.Unregister("west")
+	assert.Equal(t, []string{"broken"}, fed.Shards())
+	_, err = fed.Query(ctx, namesQuery)
+	var shardErr *federation.ShardError
+	if assert.True(t, errors.As(err, &shardErr)) {
+		assert.Equal(t, "broken", shardErr.Shard)
+	}
+
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err = fed.Query(canceled, namesQuery)
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+func TestFederatedPull(t *testing.T) {
+	ctx := context.Background()
+	east := newShard(t, store.EntityData{"person/email": "ada@example.com", "person/name": "Ada", "person/tags": []store.Value{"admin"}})
+	west := newShard(t, store.EntityData{"person/email": "ada@example.com", "person/name": "Ada L.", "person/tags": []store.Value{"dev"}})
+	empty := newShard(t)
+
+	fed := federation.New()
+	for name, conn := range map[string]*cantertest.Conn{"east": east, "west": west, "empty": empty} {
+		assert.NoError(t, fed.Register(name, conn.Connection))
+	}
+
+	res, err := fed.Pull(ctx, store.NewLookup("person/email", "ada@example.com"),
+		store.PullAttr{Attribute: "person/name"},
+		store.PullAttr{Attribute: "person/tags"},
+	)
+	if assert.NoError(t, err) {
+		assert.ElementsMatch(t, []string{"east", "west"}, res.Shards)
+		assert.Contains(t, []store.Value{"Ada", "Ada L."}, res.Data["person/name"])
+		assert.ElementsMatch(t, []store.Value{"admin", "dev"}, res.Data["person/tags"])
+		assert.Empty(t, res.Errors)
+	}
+
+	_, err = fed.Pull(ctx, store.NewLookup("person/email", "nobody@example.com"), store.PullAttr{Attribute: "person/name"})
+	assert.ErrorIs(t, err, store.ErrNoSuchEntity)
+}
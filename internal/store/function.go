@@ -0,0 +1,349 @@
+/*
+Copyright 2024 Andrew Meredith
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/kendru/canter/pkg/rtype"
+)
+
+// Function is a Go function that may be called from Predicate and Call
+// clauses of a query. Its signature is checked against the arguments and
+// result of every call, and against constant arguments before the query
+// runs.
+type Function struct {
+	// Params are the types of the arguments. A nil type accepts any value,
+	// and a union type accepts a value of any of its variants.
+	Params []rtype.ConcreteType
+	// Variadic makes the last parameter accept any number of arguments,
+	// including none.
+	Variadic bool
+	// Result is the type of the value that Fn returns. A function used as a
+	// Predicate must return rtype.RTypeBool.
+	Result rtype.ConcreteType
+	Fn     func(args []Value) (Value, error)
+}
+
+// numeric is the type of the arguments of the built-in math functions.
+var numeric = rtype.NewUnionType(rtype.RTypeInt64, rtype.RTypeFloat64)
+
+// checkArity returns an error unless the function may be called with n
+// arguments.
+func (f Function) checkArity(n int) error {
+	if f.Variadic {
+		if min := len(f.Params) - 1; n < min {
+			return fmt.Errorf("expects at least %d arguments but got %d", min, n)
+		}
+		return nil
+	}
+	if n != len(f.Params) {
+		return fmt.Errorf("expects %d arguments but got %d", len(f.Params), n)
+	}
+	return nil
+}
+
+// param returns the type of the i-th argument.
+func (f Function) param(i int) rtype.ConcreteType {
+	if f.Variadic && i >= len(f.Params)-1 {
+		return f.Params[len(f.Params)-1]
+	}
+	return f.Params[i]
+}
+
+// call calls the function, checking the types of its arguments and result.
+func (f Function) call(name string, args []Value) (Value, error) {
+	if err := f.checkArity(len(args)); err != nil {
+		return nil, fmt.Errorf("calling %s: %w", name, err)
+	}
+	for i, arg := range args {
+		if t := f.param(i); !valueHasType(arg, t) {
+			return nil, fmt.Errorf("calling %s: argument %d: %#v is not of type %s", name, i+1, arg, t.TypeTag())
+		}
+	}
+	result, err := f.Fn(args)
+	if err != nil {
+		return nil, fmt.Errorf("calling %s: %w", name, err)
+	}
+	if !valueHasType(result, f.Result) {
+		return nil, fmt.Errorf("calling %s: result %#v is not of type %s", name, result, f.Result.TypeTag())
+	}
+	return result, nil
+}
+
+// valueHasType reports whether a value read from the database or a query is
+// of type t. Types that values in queries cannot have are not checked.
+func valueHasType(val Value, t rtype.ConcreteType) bool {
+	switch t := t.(type) {
+	case nil:
+		return true
+	case *rtype.UnionType:
+		return valueHasType(val, *t)
+	case rtype.UnionType:
+		for _, variant := range t.Variants {
+			if valueHasType(val, variant) {
+				return true
+			}
+		}
+		return false
+	}
+	var ok bool
+	switch rtype.RootType(t) {
+	case rtype.RTypeString:
+		_, ok = val.(string)
+	case rtype.RTypeInt64:
+		_, ok = val.(int64)
+	case rtype.RTypeFloat64:
+		_, ok = val.(float64)
+	case rtype.RTypeBool:
+		_, ok = val.(bool)
+	case rtype.RTypeTimestamp:
+		_, ok = val.(time.Time)
+	default:
+		ok = true
+	}
+	return ok
+}
+
+// FunctionRegistry holds the functions that queries may call by name. A
+// FunctionRegistry is safe for concurrent use.
+type FunctionRegistry struct {
+	mu    sync.RWMutex
+	funcs map[string]Function
+}
+
+// NewFunctionRegistry returns a registry of the built-in functions:
+//
+//   - Comparisons: =, !=, <, <=, >, >=. Integers and floats may be compared
+//     with each other.
+//   - Math: +, -, *, and / over integers and floats, and mod over integers.
+//     The result is an integer if every argument is.
+//   - Strings: str/starts-with?, str/ends-with?, str/includes?, str/upper,
+//     str/lower, str/trim, str/length, and str, which concatenates the
+//     printed form of its arguments.
+func NewFunctionRegistry() *FunctionRegistry {
+	r := &FunctionRegistry{funcs: make(map[string]Function)}
+	for name, fn := range builtinFunctions() {
+		r.funcs[name] = fn
+	}
+	return r
+}
+
+// Lookup returns the function registered under name.
+func (r *FunctionRegistry) Lookup(name string) (Function, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	fn, ok := r.funcs[name]
+	return fn, ok
+}
+
+// Register registers a function under name. Names may not be registered
+// twice, so built-in functions cannot be replaced.
+func (r *FunctionRegistry) Register(name string, fn Function) error {
+	if fn.Fn == nil {
+		return fmt.Errorf("function %s has no implementation", name)
+	}
+	if fn.Variadic && len(fn.Params) == 0 {
+		return fmt.Errorf("variadic function %s has no parameters", name)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.funcs[name]; ok {
+		return fmt.Errorf("function %s is already registered", name)
+	}
+	r.funcs[name] = fn
+	return nil
+}
+
+// RegisterFunction registers a function that the connection's queries may
+// call. See FunctionRegistry.Register.
+func (conn *Connection) RegisterFunction(name string, fn Function) error {
+	return conn.functions.Register(name, fn)
+}
+
+func builtinFunctions() map[string]Function {
+	funcs := map[string]Function{
+		"=": predicate2(nil, func(a, b Value) (bool, error) {
+			return ValueEqual(a, b) || numericCompare(a, b) == 0, nil
+		}),
+		"!=": predicate2(nil, func(a, b Value) (bool, error) {
+			return !ValueEqual(a, b) && numericCompare(a, b) != 0, nil
+		}),
+		"str/starts-with?": predicate2(rtype.RTypeString, func(a, b Value) (bool, error) {
+			return strings.HasPrefix(a.(string), b.(string)), nil
+		}),
+		"str/ends-with?": predicate2(rtype.RTypeString, func(a, b Value) (bool, error) {
+			return strings.HasSuffix(a.(string), b.(string)), nil
+		}),
+		"str/includes?": predicate2(rtype.RTypeString, func(a, b Value) (bool, error) {
+			return strings.Contains(a.(string), b.(string)), nil
+		}),
+		"str/upper": stringFunc(strings.ToUpper),
+		"str/lower": stringFunc(strings.ToLower),
+		"str/trim":  stringFunc(strings.TrimSpace),
+		"str/length": {
+			Params: []rtype.ConcreteType{rtype.RTypeString},
+			Result: rtype.RTypeInt64,
+			Fn: func(args []Value) (Value, error) {
+				return int64(utf8.RuneCountInString(args[0].(string))), nil
+			},
+		},
+		"str": {
+			Params:   []rtype.ConcreteType{nil},
+			Variadic: true,
+			Result:   rtype.RTypeString,
+			Fn: func(args []Value) (Value, error) {
+				var sb strings.Builder
+				for _, arg := range args {
+					fmt.Fprint(&sb, arg)
+				}
+				return sb.String(), nil
+			},
+		},
+		"+": arithmetic(0, false, func(a, b int64) (int64, error) { return a + b, nil }, func(a, b float64) float64 { return a + b }),
+		"-": arithmetic(0, true, func(a, b int64) (int64, error) { return a - b, nil }, func(a, b float64) float64 { return a - b }),
+		"*": arithmetic(1, false, func(a, b int64) (int64, error) { return a * b, nil }, func(a, b float64) float64 { return a * b }),
+		"/": arithmetic(1, true, func(a, b int64) (int64, error) {
+			if b == 0 {
+				return 0, errors.New("division by zero")
+			}
+			return a / b, nil
+		}, func(a, b float64) float64 { return a / b }),
+		"mod": {
+			Params: []rtype.ConcreteType{rtype.RTypeInt64, rtype.RTypeInt64},
+			Result: rtype.RTypeInt64,
+			Fn: func(args []Value) (Value, error) {
+				if args[1].(int64) == 0 {
+					return nil, errors.New("division by zero")
+				}
+				return args[0].(int64) % args[1].(int64), nil
+			},
+		},
+	}
+	for name, holds := range map[string]func(cmp int) bool{
+		"<":  func(cmp int) bool { return cmp < 0 },
+		"<=": func(cmp int) bool { return cmp <= 0 },
+		">":  func(cmp int) bool { return cmp > 0 },
+		">=": func(cmp int) bool { return cmp >= 0 },
+	} {
+		holds := holds
+		funcs[name] = predicate2(nil, func(a, b Value) (bool, error) {
+			cmp, ok := compareValues(a, b)
+			if !ok {
+				if cmp = numericCompare(a, b); cmp == incomparable {
+					return false, fmt.Errorf("cannot compare %#v with %#v", a, b)
+				}
+			}
+			return holds(cmp), nil
+		})
+	}
+	return funcs
+}
+
+// incomparable is returned by numericCompare for values that are not both
+// numbers.
+const incomparable = 2
+
+// numericCompare compares integers and floats with each other.
+func numericCompare(a, b Value) int {
+	af, aok := toFloat(a)
+	bf, bok := toFloat(b)
+	switch {
+	case !aok || !bok:
+		return incomparable
+	case af < bf:
+		return -1
+	case af > bf:
+		return 1
+	default:
+		return 0
+	}
+}
+
+func toFloat(v Value) (float64, bool) {
+	switch v := v.(type) {
+	case int64:
+		return float64(v), true
+	case float64:
+		return v, true
+	default:
+		return 0, false
+	}
+}
+
+func predicate2(param rtype.ConcreteType, fn func(a, b Value) (bool, error)) Function {
+	return Function{
+		Params: []rtype.ConcreteType{param, param},
+		Result: rtype.RTypeBool,
+		Fn: func(args []Value) (Value, error) {
+			return fn(args[0], args[1])
+		},
+	}
+}
+
+func stringFunc(fn func(string) string) Function {
+	return Function{
+		Params: []rtype.ConcreteType{rtype.RTypeString},
+		Result: rtype.RTypeString,
+		Fn: func(args []Value) (Value, error) {
+			return fn(args[0].(string)), nil
+		},
+	}
+}
+
+// arithmetic returns a variadic math function that folds its arguments from
+// left to right, starting from identity. The inverse operations - and /
+// take at least one argument, and fold a single argument into identity, so
+// that (- ?x) negates ?x.
+func arithmetic(identity int64, inverse bool, intOp func(a, b int64) (int64, error), floatOp func(a, b float64) float64) Function {
+	params := []rtype.ConcreteType{numeric}
+	if inverse {
+		params = append(params, numeric)
+	}
+	return Function{
+		Params:   params,
+		Variadic: true,
+		Result:   numeric,
+		Fn: func(args []Value) (Value, error) {
+			if len(args) == 0 || (inverse && len(args) == 1) {
+				args = append([]Value{identity}, args...)
+			}
+			acc := args[0]
+			for _, arg := range args[1:] {
+				ai, aInt := acc.(int64)
+				bi, bInt := arg.(int64)
+				if aInt && bInt {
+					n, err := intOp(ai, bi)
+					if err != nil {
+						return nil, err
+					}
+					acc = n
+					continue
+				}
+				af, _ := toFloat(acc)
+				bf, _ := toFloat(arg)
+				acc = floatOp(af, bf)
+			}
+			return acc, nil
+		},
+	}
+}
@@ -16,10 +16,18 @@ limitations under the License.
 
 package store
 
-import "github.com/oklog/ulid/v2"
+import (
+	"errors"
+	"fmt"
+
+	"github.com/oklog/ulid/v2"
+)
 
 type IDManager interface {
 	NextID() (ID, error)
+	// NextIDs allocates n IDs at once. Implementations should allocate the
+	// entire batch with as few round trips to storage as possible.
+	NextIDs(n int) ([]ID, error)
 }
 
 // Marker interface for IDs and things that can be resolved to IDs at
@@ -30,29 +38,104 @@ type identifier interface {
 
 // ID is an identifier that uniquely identifies an entity or ident.
 //
+// IDs are split into two partitions. The system partition holds the negative
+// IDs of the built-in idents and enumerated values, and the user partition
+// holds the positive IDs allocated by an IDManager. 0 is never a valid ID. The
+// user partition is further divided into numbered partitions; see Partition.
+//
 //go:generate stringer -type ID -trimprefix ID
 type ID int64
 
 func (id ID) identify() {}
 
+// IsSystem reports whether the ID belongs to the system partition.
+func (id ID) IsSystem() bool {
+	return id < 0
+}
+
 func (id ID) Resolve(conn *Connection) (ID, error) {
 	return id, nil
 }
 
+// txTempIDSymbol is the symbol of the tempID that stands for the transaction
+// entity in every transaction.
+const txTempIDSymbol = "txid"
+
 // tempID is a placeholder that may be repeated within a transaction and will be
 // replaced by the same ID everywhere it occurs.
 type tempID struct {
 	symbol string
+	// named is set for tempIDs created by NamedTempID, whose symbol is chosen
+	// by the caller rather than generated.
+	named bool
 }
 
 func (id tempID) identify() {}
 
+// TempID returns a tempID with a random symbol. Use Connection.TempID for
+// tempIDs whose symbols come from the connection's IDSource.
 func TempID() tempID {
 	return tempID{
-		symbol: ulid.Make().String(),
+		symbol: RandomIDSource{}.NewULID().String(),
 	}
 }
 
+// TempID returns a tempID whose symbol is generated by the connection's
+// IDSource, so that the tempIDs reported by transactions that use it are
+// reproducible when the IDSource is deterministic.
+func (conn *Connection) TempID() tempID {
+	return tempID{
+		symbol: conn.idSource.NewULID().String(),
+	}
+}
+
+// IDSource returns the IDSource that the connection generates ULIDs and UUIDs
+// from.
+func (conn *Connection) IDSource() IDSource {
+	return conn.idSource
+}
+
+// NamedTempID returns a tempID identified by name. Every NamedTempID with the
+// same name refers to the same entity within a transaction, so entities that
+// are constructed separately can refer to one another without passing a
+// tempID around. Names are scoped to a single transaction: the same name in
+// another transaction refers to a different entity.
+//
+// The name may not be empty, "txid", or a ULID, which would collide with the
+// transaction entity and with tempIDs created by TempID. Such names are
+// rejected with ErrInvalidTempID when the tempID is added to a transaction.
+func NamedTempID(name string) tempID {
+	return tempID{
+		symbol: name,
+		named:  true,
+	}
+}
+
+// validate reports whether a named tempID collides with a reserved symbol.
+func (id tempID) validate() error {
+	if !id.named {
+		return nil
+	}
+	var reason string
+	switch {
+	case id.symbol == "":
+		reason = "name is empty"
+	case id.symbol == txTempIDSymbol:
+		reason = "name is reserved for the transaction entity"
+	default:
+		if _, err := ulid.ParseStrict(id.symbol); err == nil {
+			reason = "name is a ULID"
+		}
+	}
+	if reason == "" {
+		return nil
+	}
+	return errors.Join(
+		fmt.Errorf("named tempID %q: %s", id.symbol, reason),
+		ErrInvalidTempID,
+	)
+}
+
 const (
 	// System-managed idents.
 	IDID ID = -1*iota - 1
@@ -85,4 +168,50 @@ const (
 	IDTypeUUID
 	IDTypeULID
 	IDTypeComposite
+	IDTypeBlob
+	IDTypeTuple
+)
+
+const (
+	// The system entity, which records the version of the system schema that
+	// the database was initialized with.
+	IDSystem        ID = -100
+	IDSystemVersion ID = -101
+
+	// Alternate names for an entity. Each alias resolves to the entity's ID.
+	IDAlias ID = -102
+	// Whether the values of an attribute are stored in a dictionary.
+	IDInterned ID = -103
+
+	// Events in the transactional outbox.
+	IDOutboxTopic   ID = -104
+	IDOutboxKey     ID = -105
+	IDOutboxPayload ID = -106
+
+	// Checkpoints of triggers: the last transaction that each trigger has
+	// processed.
+	IDTriggerName ID = -107
+	IDTriggerTx   ID = -108
+
+	// Uniqueness semantics of an attribute: identity attributes upsert
+	// entities by value, while value attributes reject duplicate values.
+	IDUniqueIdentity ID = -109
+	IDUniqueValue    ID = -110
+
+	// Descriptions of schema entities and namespaces.
+	IDOwner            ID = -111
+	IDDeprecated       ID = -112
+	IDAttributePattern ID = -113
+	IDReplacedBy       ID = -114
+
+	// How long the history of an attribute, or of the attributes in a
+	// namespace, is kept.
+	IDHistoryRetention ID = -115
+
+	// Merkle root of the facts of a transaction. See TxRoot.
+	IDTxHash ID = -116
+
+	// Whether an attribute was created by schema inference. See
+	// Config.InferSchema.
+	IDInferred ID = -117
 )
@@ -36,26 +36,51 @@ func _() {
 	_ = x[IDTypeUUID - -524]
 	_ = x[IDTypeULID - -525]
 	_ = x[IDTypeComposite - -526]
+	_ = x[IDTypeBlob - -527]
+	_ = x[IDTypeTuple - -528]
+	_ = x[IDSystem - -100]
+	_ = x[IDSystemVersion - -101]
+	_ = x[IDAlias - -102]
+	_ = x[IDInterned - -103]
+	_ = x[IDOutboxTopic - -104]
+	_ = x[IDOutboxKey - -105]
+	_ = x[IDOutboxPayload - -106]
+	_ = x[IDTriggerName - -107]
+	_ = x[IDTriggerTx - -108]
+	_ = x[IDUniqueIdentity - -109]
+	_ = x[IDUniqueValue - -110]
+	_ = x[IDOwner - -111]
+	_ = x[IDDeprecated - -112]
+	_ = x[IDAttributePattern - -113]
+	_ = x[IDReplacedBy - -114]
+	_ = x[IDHistoryRetention - -115]
+	_ = x[IDTxHash - -116]
+	_ = x[IDInferred - -117]
 }
 
 const (
-	_ID_name_0 = "TypeCompositeTypeULIDTypeUUIDTypeBinaryTypeRefTypeDateTypeTimestampTypeDecimalTypeFloat32TypeFloat64TypeInt8TypeInt16TypeInt32TypeInt64TypeBooleanTypeString"
-	_ID_name_1 = "CardinalityManyCardinalityOneTxCommitTimeDocIndexedUniqueCardinalityCompositeComponentsTypeIdentIDunresolvedEntityID"
+	_ID_name_0 = "TypeTupleTypeBlobTypeCompositeTypeULIDTypeUUIDTypeBinaryTypeRefTypeDateTypeTimestampTypeDecimalTypeFloat32TypeFloat64TypeInt8TypeInt16TypeInt32TypeInt64TypeBooleanTypeString"
+	_ID_name_1 = "InferredTxHashHistoryRetentionReplacedByAttributePatternDeprecatedOwnerUniqueValueUniqueIdentityTriggerTxTriggerNameOutboxPayloadOutboxKeyOutboxTopicInternedAliasSystemVersionSystem"
+	_ID_name_2 = "CardinalityManyCardinalityOneTxCommitTimeDocIndexedUniqueCardinalityCompositeComponentsTypeIdentIDunresolvedEntityID"
 )
 
 var (
-	_ID_index_0 = [...]uint8{0, 13, 21, 29, 39, 46, 54, 67, 78, 89, 100, 108, 117, 126, 135, 146, 156}
-	_ID_index_1 = [...]uint8{0, 15, 29, 41, 44, 51, 57, 68, 87, 91, 96, 98, 116}
+	_ID_index_0 = [...]uint8{0, 9, 17, 30, 38, 46, 56, 63, 71, 84, 95, 106, 117, 125, 134, 143, 152, 163, 173}
+	_ID_index_1 = [...]uint8{0, 8, 14, 30, 40, 56, 66, 71, 82, 96, 105, 116, 129, 138, 149, 157, 162, 175, 181}
+	_ID_index_2 = [...]uint8{0, 15, 29, 41, 44, 51, 57, 68, 87, 91, 96, 98, 116}
 )
 
 func (i ID) String() string {
 	switch {
-	case -526 <= i && i <= -511:
-		i -= -526
+	case -528 <= i && i <= -511:
+		i -= -528
 		return _ID_name_0[_ID_index_0[i]:_ID_index_0[i+1]]
+	case -117 <= i && i <= -100:
+		i -= -117
+		return _ID_name_1[_ID_index_1[i]:_ID_index_1[i+1]]
 	case -11 <= i && i <= 0:
 		i -= -11
-		return _ID_name_1[_ID_index_1[i]:_ID_index_1[i+1]]
+		return _ID_name_2[_ID_index_2[i]:_ID_index_2[i+1]]
 	default:
 		return "ID(" + strconv.FormatInt(int64(i), 10) + ")"
 	}
@@ -17,8 +17,10 @@ limitations under the License.
 package store
 
 import (
+	"container/list"
 	"errors"
 	"sync"
+	"sync/atomic"
 )
 
 var (
@@ -33,6 +35,10 @@ var NullIdent = Ident{}
 type Ident struct {
 	ID   ID
 	Name string
+	// Alias is set when Name is an alternate name for the entity rather than
+	// its canonical name. Aliases resolve to the same ID as the canonical
+	// name, but an ID always resolves to its canonical name.
+	Alias bool
 }
 
 func (ident Ident) String() string {
@@ -79,162 +85,190 @@ type IdentManager interface {
 	// StoreIdent will store the ident in the backing store. This will return
 	// `ErrIdentAlreadyExists` if the ident already exists.
 	StoreIdent(Ident) error
+	// AllocateIdents returns an ident for each of the names supplied. Names
+	// that do not already have an ident are allocated a new ID. Allocated
+	// idents are not stored; they are stored by Indexer.Write() along with the
+	// transaction that introduces them.
+	AllocateIdents([]string) ([]Ident, error)
 }
 
+// identCache caches the mapping between idents and IDs. An unbounded cache
+// holds every ident that it is given. A bounded cache holds at most size
+// idents other than the system idents, which are never evicted, and evicts
+// the least recently used ident to make room for another. Aliases are cached
+// along with their canonical ident and do not count towards the bound.
 type identCache struct {
-	mu           sync.Mutex
-	idents       []Ident
-	identIdxID   map[ID]int
-	identIdxName map[string]int
+	mu     sync.RWMutex
+	size   int
+	order  *list.List
+	byID   map[ID]*identEntry
+	byName map[string]*identEntry
+	// hydrated is set once every ident in storage has been loaded.
+	hydrated atomic.Bool
+
+	hits      atomic.Uint64
+	misses    atomic.Uint64
+	evictions atomic.Uint64
+}
+
+// identEntry is a cached canonical ident along with its cached aliases.
+type identEntry struct {
+	ident   Ident
+	aliases []string
+	// elem is the entry's position in the LRU order. It is nil for pinned
+	// entries and for every entry of an unbounded cache.
+	elem *list.Element
+}
+
+// IdentCacheStats describes the use of a connection's ident cache.
+type IdentCacheStats struct {
+	// Size is the number of idents in the cache, including the system idents
+	// but not aliases.
+	Size int
+	// Hits and Misses count the lookups that the cache could and could not
+	// answer.
+	Hits   uint64
+	Misses uint64
+	// Evictions counts the idents that a bounded cache has evicted.
+	Evictions uint64
 }
 
-func newIdentCache(mgr IdentManager) *identCache {
+// newIdentCache returns a cache of the system idents. If size is positive, the
+// cache holds at most size other idents.
+func newIdentCache(size int) *identCache {
 	c := &identCache{
-		idents:       make([]Ident, 0, 256),
-		identIdxID:   make(map[ID]int, 256),
-		identIdxName: make(map[string]int, 256),
+		size:   size,
+		order:  list.New(),
+		byID:   make(map[ID]*identEntry, 256),
+		byName: make(map[string]*identEntry, 256),
 	}
 
-	c.store([]Ident{
-		{
-			ID:   IDID,
-			Name: "db/id",
-		},
-		{
-			ID:   IDIdent,
-			Name: "db/ident",
-		},
-		{
-			ID:   IDType,
-			Name: "db/type",
-		},
-		{
-			ID:   IDCompositeComponents,
-			Name: "db/compositeComponents",
-		},
-		{
-			ID:   IDCardinality,
-			Name: "db/cardinality",
-		},
-		{
-			ID:   IDUnique,
-			Name: "db/unique",
-		},
-		{
-			ID:   IDIndexed,
-			Name: "db/indexed",
-		},
-		{
-			ID:   IDDoc,
-			Name: "db/doc",
-		},
-		{
-			ID:   IDTxCommitTime,
-			Name: "db.tx/commitTime",
-		},
-		{
-			ID:   IDCardinalityOne,
-			Name: "db.cardinality/one",
-		},
-		{
-			ID:   IDCardinalityMany,
-			Name: "db.cardinality/many",
-		},
-		{
-			ID:   IDTypeString,
-			Name: "db.type/string",
-		},
-		{
-			ID:   IDTypeBoolean,
-			Name: "db.type/boolean",
-		},
-		{
-			ID:   IDTypeInt64,
-			Name: "db.type/int64",
-		},
-		{
-			ID:   IDTypeInt32,
-			Name: "db.type/int32",
-		},
-		{
-			ID:   IDTypeInt16,
-			Name: "db.type/int16",
-		},
-		{
-			ID:   IDTypeInt8,
-			Name: "db.type/int8",
-		},
-		{
-			ID:   IDTypeFloat64,
-			Name: "db.type/float64",
-		},
-		{
-			ID:   IDTypeFloat32,
-			Name: "db.type/float32",
-		},
-		{
-			ID:   IDTypeDecimal,
-			Name: "db.type/decimal",
-		},
-		{
-			ID:   IDTypeTimestamp,
-			Name: "db.type/timestamp",
-		},
-		{
-			ID:   IDTypeDate,
-			Name: "db.type/date",
-		},
-		{
-			ID:   IDTypeRef,
-			Name: "db.type/ref",
-		},
-		{
-			ID:   IDTypeBinary,
-			Name: "db.type/binary",
-		},
-		{
-			ID:   IDTypeUUID,
-			Name: "db.type/uuid",
-		},
-		{
-			ID:   IDTypeULID,
-			Name: "db.type/ulid",
-		},
-		{
-			ID:   IDTypeComposite,
-			Name: "db.type/composite",
-		},
-	})
+	c.store(systemIdents())
 
 	return c
 }
 
+// bounded reports whether the cache evicts idents.
+func (c *identCache) bounded() bool {
+	return c.size > 0
+}
+
+// store caches the idents, replacing the name of any ident whose ID is
+// already cached. Canonical idents are stored before aliases, and each alias
+// is indexed to its canonical ident. Aliases of entities whose canonical
+// ident is not cached are skipped, so they are resolved through the
+// IdentManager instead.
 func (c *identCache) store(idents []Ident) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	idx := len(c.idents)
 	for _, ident := range idents {
-		if _, found := c.identIdxID[ident.ID]; found {
-			return
+		if ident.Alias {
+			continue
+		}
+		entry, found := c.byID[ident.ID]
+		if !found {
+			entry = &identEntry{ident: ident}
+			c.byID[ident.ID] = entry
+			if c.bounded() && !ident.ID.IsSystem() {
+				entry.elem = c.order.PushFront(entry)
+			}
+		} else if entry.ident.Name != ident.Name {
+			c.unindexName(entry.ident.Name, entry)
+			entry.ident = ident
+		}
+		c.byName[ident.Name] = entry
+		c.touch(entry)
+	}
+	for _, ident := range idents {
+		if !ident.Alias {
+			continue
+		}
+		if entry, found := c.byID[ident.ID]; found && c.byName[ident.Name] != entry {
+			c.unindexName(ident.Name, c.byName[ident.Name])
+			c.byName[ident.Name] = entry
+			entry.aliases = append(entry.aliases, ident.Name)
 		}
-		c.idents = append(c.idents, ident)
-		c.identIdxID[ident.ID] = idx
-		c.identIdxName[ident.Name] = idx
-		idx += 1
 	}
+	c.evict()
 }
 
-func (c *identCache) lookupByID(id ID) (Ident, bool) {
-	if idx, ok := c.identIdxID[id]; ok {
-		return c.idents[idx], true
+// unindexName removes a name from the index if it refers to entry.
+func (c *identCache) unindexName(name string, entry *identEntry) {
+	if entry != nil && c.byName[name] == entry {
+		delete(c.byName, name)
+	}
+}
+
+// touch marks an entry as the most recently used. c.mu must be held for
+// writing.
+func (c *identCache) touch(entry *identEntry) {
+	if entry.elem != nil {
+		c.order.MoveToFront(entry.elem)
 	}
-	return NullIdent, false
+}
+
+// evict evicts the least recently used idents until the cache is within its
+// bound. c.mu must be held for writing.
+func (c *identCache) evict() {
+	if !c.bounded() {
+		return
+	}
+	for c.order.Len() > c.size {
+		entry := c.order.Remove(c.order.Back()).(*identEntry)
+		delete(c.byID, entry.ident.ID)
+		c.unindexName(entry.ident.Name, entry)
+		for _, alias := range entry.aliases {
+			c.unindexName(alias, entry)
+		}
+		c.evictions.Add(1)
+	}
+}
+
+func (c *identCache) lookupByID(id ID) (Ident, bool) {
+	return c.lookup(func() *identEntry { return c.byID[id] })
 }
 
 func (c *identCache) lookupByName(name string) (Ident, bool) {
-	if idx, ok := c.identIdxName[name]; ok {
-		return c.idents[idx], true
+	return c.lookup(func() *identEntry { return c.byName[name] })
+}
+
+// lookup returns the ident of the entry found by find. A bounded cache must
+// record the use of the entry, which requires an exclusive lock.
+func (c *identCache) lookup(find func() *identEntry) (Ident, bool) {
+	var ident Ident
+	var found bool
+	if c.bounded() {
+		c.mu.Lock()
+		if entry := find(); entry != nil {
+			c.touch(entry)
+			ident, found = entry.ident, true
+		}
+		c.mu.Unlock()
+	} else {
+		c.mu.RLock()
+		if entry := find(); entry != nil {
+			ident, found = entry.ident, true
+		}
+		c.mu.RUnlock()
+	}
+	if !found {
+		c.misses.Add(1)
+		return NullIdent, false
+	}
+	c.hits.Add(1)
+	return ident, true
+}
+
+// stats returns the cache's statistics.
+func (c *identCache) stats() IdentCacheStats {
+	c.mu.RLock()
+	size := len(c.byID)
+	c.mu.RUnlock()
+	return IdentCacheStats{
+		Size:      size,
+		Hits:      c.hits.Load(),
+		Misses:    c.misses.Load(),
+		Evictions: c.evictions.Load(),
 	}
-	return NullIdent, false
 }
@@ -0,0 +1,44 @@
+/*
+Copyright 2024 Andrew Meredith
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"github.com/gofrs/uuid/v5"
+	"github.com/oklog/ulid/v2"
+)
+
+// IDSource generates the ULIDs and UUIDs that a connection needs, such as the
+// symbols of the tempIDs created by Connection.TempID. Injecting a
+// deterministic IDSource, together with a deterministic Clock, makes the
+// output of transactions reproducible.
+type IDSource interface {
+	NewULID() ulid.ULID
+	NewUUID() uuid.UUID
+}
+
+// RandomIDSource is an IDSource that generates random ULIDs and version 4
+// UUIDs. ULIDs generated within the same millisecond are monotonically
+// increasing.
+type RandomIDSource struct{}
+
+func (RandomIDSource) NewULID() ulid.ULID {
+	return ulid.Make()
+}
+
+func (RandomIDSource) NewUUID() uuid.UUID {
+	return uuid.Must(uuid.NewV4())
+}
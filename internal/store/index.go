@@ -16,12 +16,89 @@ limitations under the License.
 
 package store
 
-import "github.com/kendru/canter/pkg/dataflow"
+import (
+	"io"
+
+	"github.com/kendru/canter/pkg/dataflow"
+)
 
 type Indexer interface {
-	Write([]ResolvedAssertion) error
+	IndexReader
+	// Write atomically writes the assertions of a transaction along with any
+	// idents that the transaction introduces. If the write fails, none of the
+	// assertions or idents are stored. Writing an ident that already exists
+	// with the same ID is a no-op, but an ident that exists with a different
+	// ID fails the write with ErrIdentAlreadyExists.
+	Write(assertions []ResolvedAssertion, idents []Ident) error
+
+	// Snapshot returns a reader that observes a single consistent view of the
+	// indexes, unaffected by subsequent writes. The snapshot must be released
+	// when it is no longer needed.
+	Snapshot() (IndexSnapshot, error)
+
+	// DeleteHistory removes entries from the history indexes. Each assertion
+	// identifies the entries that record it in a transaction, as produced by
+	// ScanHistoryEAVT and ScanHistoryAEVT. Assertions that are not in the
+	// history are ignored.
+	DeleteHistory(assertions []ResolvedAssertion) error
+}
+
+// IndexSnapshot is an IndexReader pinned to a single point in time. Snapshots
+// are not safe for concurrent use.
+type IndexSnapshot interface {
+	IndexReader
+	Release()
+}
+
+// BackupSnapshot is implemented by index snapshots that can write a backup of
+// the whole store as of the snapshot, while writes to the store continue.
+type BackupSnapshot interface {
+	IndexSnapshot
+	Backup(w io.Writer) error
+}
+
+// FactVisitor is called with each fact read by a scan. The fact is borrowed
+// from the scan: it, and the memory of a binary value that it holds, are only
+// valid until the visitor returns, so a visitor that retains a fact must retain
+// a Clone of it. If the visitor returns an error, the scan stops and returns
+// that error.
+type FactVisitor func(fct *Fact) error
+
+// IndexReader provides read access to the indexes.
+type IndexReader interface {
 	ScanEAVT(entityID ID, attribute *ID) (dataflow.Producer[Fact], error)
 	ScanAEVT(attribute ID, entityID *ID) (dataflow.Producer[Fact], error)
+	// ScanAEVTWhere is like ScanAEVT for every entity, but it only produces
+	// facts whose values match pred. Implementations should evaluate pred as
+	// they iterate over the index rather than producing every fact of the
+	// attribute; those that cannot may return FilterFacts of ScanAEVT.
+	ScanAEVTWhere(attribute ID, pred ValuePredicate) (dataflow.Producer[Fact], error)
 	ScanAVET(attribute ID, val Value) (dataflow.Producer[Fact], error)
+	// ScanAVETValues is like ScanAVET, but it scans for several values of the
+	// attribute in a single pass over the index.
+	ScanAVETValues(attribute ID, vals []Value) (dataflow.Producer[Fact], error)
 	ScanVAET(val Value, attribute *ID) (dataflow.Producer[Fact], error)
+	// ScanEAVTPartitions splits the EAVT index into n partitions that together
+	// produce every current fact. Each partition produces the facts of a
+	// disjoint range of entities in EAVT order, so all facts of an entity are
+	// produced by the same partition, and partitions may be empty. Partitions
+	// of the latest state of the indexes may be consumed concurrently, which
+	// lets full-index jobs such as exports and analytics read in parallel.
+	ScanEAVTPartitions(n int) ([]dataflow.Producer[Fact], error)
+
+	// VisitEAVT, VisitAEVT, VisitAEVTWhere, and VisitAVETValues are like the
+	// corresponding scans, except that they pass each fact to visit as it is
+	// read rather than collecting the facts, so large scans need not hold
+	// every fact in memory at once.
+	VisitEAVT(entityID ID, attribute *ID, visit FactVisitor) error
+	VisitAEVT(attribute ID, entityID *ID, visit FactVisitor) error
+	VisitAEVTWhere(attribute ID, pred ValuePredicate, visit FactVisitor) error
+	VisitAVETValues(attribute ID, vals []Value, visit FactVisitor) error
+
+	// ScanHistoryEAVT and ScanHistoryAEVT scan every assertion, including
+	// retractions, that has ever been made about the entity or attribute.
+	// Assertions are produced in transaction order for each (entity,
+	// attribute) pair.
+	ScanHistoryEAVT(entityID ID, attribute *ID) (dataflow.Producer[ResolvedAssertion], error)
+	ScanHistoryAEVT(attribute ID, entityID *ID) (dataflow.Producer[ResolvedAssertion], error)
 }
@@ -0,0 +1,245 @@
+/*
+Copyright 2024 Andrew Meredith
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gofrs/uuid/v5"
+	"github.com/oklog/ulid/v2"
+)
+
+// In soft schema mode, enabled by Config.InferSchema, an assertion of an
+// attribute that does not exist creates the attribute instead of failing.
+// Its type is inferred from the first value asserted for it, and it is
+// created with cardinality one and db/inferred set to true:
+//
+//	conn.Assert(store.EntityData{"sensor/reading": 21.5})
+//	// creates sensor/reading as a db.type/float64 attribute
+//
+// Inferred attributes are created in a transaction of their own that
+// precedes the transaction that uses them, so they remain even if that
+// transaction fails. AssertDryRun infers attributes in the same way but does
+// not create them. InferredSchema reports the attributes that are still
+// marked as inferred. Once an attribute has been reviewed, and its schema
+// altered if needed, it is hardened by retracting db/inferred:
+//
+//	conn.Assert(store.Retract("sensor/reading", "db/inferred", true))
+
+// InferredAttribute describes an attribute that was created by schema
+// inference and has not been hardened.
+type InferredAttribute struct {
+	Attribute Ident
+	Type      Ident
+	// Tx is the transaction that created the attribute.
+	Tx ID
+}
+
+// InferredSchema returns the attributes that are marked as inferred, ordered
+// by name.
+func (db Database) InferredSchema() ([]InferredAttribute, error) {
+	inferredAttr := IDInferred
+	facts, err := db.scan(nil, &inferredAttr)
+	if err != nil {
+		return nil, fmt.Errorf("scanning inferred schema: %w", err)
+	}
+	var out []InferredAttribute
+	for _, fct := range facts {
+		if inferred, _ := fct.Value.(bool); !inferred {
+			continue
+		}
+		attr := InferredAttribute{Tx: fct.Tx}
+		if attr.Attribute, err = ResolveIdent(db.conn, fct.EntityID); err != nil {
+			return nil, fmt.Errorf("resolving ident of entity %d: %w", fct.EntityID, err)
+		}
+		schema, err := db.schemaFor(fct.EntityID)
+		if err != nil {
+			return nil, fmt.Errorf("schema of %s: %w", attr.Attribute.Name, err)
+		}
+		if schema.IsAttribute() {
+			if attr.Type, err = ResolveIdent(db.conn, schema.Type); err != nil {
+				return nil, fmt.Errorf("resolving type of %s: %w", attr.Attribute.Name, err)
+			}
+		}
+		out = append(out, attr)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Attribute.Name < out[j].Attribute.Name })
+	return out, nil
+}
+
+// inferAttributes creates every attribute that is named by the pending
+// assertions of the transaction but does not exist, is not staged, and is not
+// declared by another of the assertions. Attributes whose type cannot be
+// inferred from their value are left for the first pass to report as unknown.
+//
+// A dry run checks the attributes as they would be created, but stages them in
+// the transaction instead of creating them, so that it resolves as the
+// transaction would once they exist.
+func (tx *TxBuilder) inferAttributes() error {
+	missing, err := tx.conn.missingAttributes(tx.pending, tx.stagedIdents)
+	if err != nil || len(missing) == 0 {
+		return err
+	}
+	assertables := make([]Assertable, len(missing))
+	for i, attr := range missing {
+		assertables[i] = attr
+	}
+	if !tx.dryRun {
+		if _, err := tx.conn.Assert(assertables...); err != nil {
+			return fmt.Errorf("creating inferred attributes: %w", err)
+		}
+		return nil
+	}
+
+	inferred := tx.conn.newTx(false)
+	inferred.dryRun = true
+	if err := inferred.Add(assertables...); err != nil {
+		return fmt.Errorf("checking inferred attributes: %w", err)
+	}
+	if _, err := inferred.Commit(); err != nil {
+		return fmt.Errorf("checking inferred attributes: %w", err)
+	}
+	if tx.stagedSchema == nil {
+		tx.stagedSchema = make(map[ID]SchemaAttribute, len(missing))
+	}
+	for _, attr := range missing {
+		ident, ok := inferred.stagedIdents[attr["db/ident"].(string)]
+		if !ok {
+			return fmt.Errorf("inferred attribute %q was not staged", attr["db/ident"])
+		}
+		tx.stagedIdents[ident.Name] = ident
+		tx.stagedSchema[ident.ID] = SchemaAttribute{
+			ID:          ident.ID,
+			Type:        attr["db/type"].(ID),
+			Cardinality: IDCardinalityOne,
+			Inferred:    true,
+		}
+	}
+	return nil
+}
+
+// missingAttributes returns the definition of every attribute that is named
+// by an assertion but does not exist, is not staged, and is not declared by
+// another of the assertions, and whose type can be inferred from its value.
+func (conn *Connection) missingAttributes(assertions []Assertion, staged map[string]Ident) ([]EntityData, error) {
+	var declared map[string]struct{}
+	var missing []EntityData
+	seen := make(map[string]struct{})
+	for _, assertion := range assertions {
+		if assertion.mode != AssertModeAddition {
+			continue
+		}
+		name := identName(assertion.attribute)
+		if name == "" {
+			continue
+		}
+		if _, ok := seen[name]; ok {
+			continue
+		}
+		if _, ok := staged[name]; ok {
+			continue
+		}
+		if strings.HasPrefix(name, "db/") || strings.HasPrefix(name, "db.") {
+			// Reserved names are rejected during resolution.
+			continue
+		}
+		_, err := ResolveIdent(conn, name)
+		switch {
+		case err == nil:
+			continue
+		case !errors.Is(err, ErrNoSuchIdent):
+			return nil, fmt.Errorf("resolving ident %q: %w", name, err)
+		}
+		valueType, ok := inferType(assertion.value)
+		if !ok {
+			continue
+		}
+		if declared == nil {
+			declared = declaredIdents(conn, assertions)
+		}
+		if _, ok := declared[name]; ok {
+			// The transaction defines the attribute itself.
+			continue
+		}
+		seen[name] = struct{}{}
+		missing = append(missing, EntityData{
+			"db/ident":       name,
+			"db/type":        valueType,
+			"db/cardinality": IDCardinalityOne,
+			"db/inferred":    true,
+		})
+	}
+	return missing, nil
+}
+
+// declaredIdents returns the names of the idents asserted via db/ident by
+// assertions.
+func declaredIdents(conn *Connection, assertions []Assertion) map[string]struct{} {
+	declared := make(map[string]struct{})
+	for _, assertion := range assertions {
+		if assertion.mode != AssertModeAddition {
+			continue
+		}
+		attribute, err := ResolveIdent(conn, assertion.attribute)
+		if err != nil || attribute.ID != IDIdent {
+			continue
+		}
+		if name := identName(assertion.value); name != "" {
+			declared[name] = struct{}{}
+		}
+	}
+	return declared
+}
+
+// inferType returns the attribute type that suits a value.
+func inferType(value any) (ID, bool) {
+	switch value.(type) {
+	case string:
+		return IDTypeString, true
+	case bool:
+		return IDTypeBoolean, true
+	case int, int64, uint, uint64, uint32, uint16, uint8:
+		return IDTypeInt64, true
+	case int32:
+		return IDTypeInt32, true
+	case int16:
+		return IDTypeInt16, true
+	case int8:
+		return IDTypeInt8, true
+	case float64:
+		return IDTypeFloat64, true
+	case float32:
+		return IDTypeFloat32, true
+	case time.Time:
+		return IDTypeTimestamp, true
+	case []byte:
+		return IDTypeBinary, true
+	case uuid.UUID:
+		return IDTypeUUID, true
+	case ulid.ULID:
+		return IDTypeULID, true
+	case BlobDigest:
+		return IDTypeBlob, true
+	case ID, tempID, Lookup, Ident:
+		return IDTypeRef, true
+	}
+	return 0, false
+}
@@ -0,0 +1,261 @@
+/*
+Copyright 2024 Andrew Meredith
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package ingest continuously transacts events from partitioned logs such as
+// Kafka topics, so that a database serves as a materialized view of the event
+// streams.
+//
+// Events are read through a Source, decoded by a Decoder, and mapped to
+// entities by a Mapping. The offset of the next event to read from each
+// partition is stored as facts in the same transaction as the entities that
+// the events mapped to, so every event is transacted exactly once, even if the
+// ingester stops between reading events and the source committing its own
+// offsets. No Kafka client is bundled: a consumer is adapted to Source by
+// forwarding Seek to its seek operation and returning polled messages from
+// Fetch.
+package ingest
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/kendru/canter/internal/store"
+)
+
+// Record is an event read from a partition of a topic.
+type Record struct {
+	Topic     string
+	Partition int32
+	Offset    int64
+	Key       []byte
+	Value     []byte
+}
+
+// Source reads records from a partitioned log.
+type Source interface {
+	// Seek positions a partition so that the next record fetched from it is
+	// the one at offset.
+	Seek(topic string, partition int32, offset int64) error
+	// Fetch waits for and returns the next records. Records of each
+	// partition must be returned in offset order. Fetch returns ctx.Err()
+	// if ctx is done before records are available.
+	Fetch(ctx context.Context) ([]Record, error)
+}
+
+// Decoder decodes the value of a record into an event.
+type Decoder func(value []byte) (map[string]any, error)
+
+// DecodeJSON decodes a record value that holds a JSON object. Numbers are
+// decoded as json.Number, so that integers are mapped without loss.
+func DecodeJSON(value []byte) (map[string]any, error) {
+	dec := json.NewDecoder(bytes.NewReader(value))
+	dec.UseNumber()
+	var event map[string]any
+	if err := dec.Decode(&event); err != nil {
+		return nil, err
+	}
+	if event == nil {
+		return nil, errors.New("event is not an object")
+	}
+	return event, nil
+}
+
+// Attributes of the entities that record the ingestion offsets.
+const (
+	attrOffsetKey       = "ingest.offset/key"
+	attrOffsetConsumer  = "ingest.offset/consumer"
+	attrOffsetTopic     = "ingest.offset/topic"
+	attrOffsetPartition = "ingest.offset/partition"
+	attrOffsetNext      = "ingest.offset/next"
+)
+
+var offsetSchema = []store.Assertable{
+	store.EntityData{"db/ident": attrOffsetKey, "db/type": "db.type/string", "db/unique": true,
+		"db/doc": "Identifies the consumer, topic, and partition of an ingestion offset."},
+	store.EntityData{"db/ident": attrOffsetConsumer, "db/type": "db.type/string",
+		"db/doc": "The name of the ingester that consumed the partition."},
+	store.EntityData{"db/ident": attrOffsetTopic, "db/type": "db.type/string",
+		"db/doc": "The topic of the consumed partition."},
+	store.EntityData{"db/ident": attrOffsetPartition, "db/type": "db.type/int64",
+		"db/doc": "The number of the consumed partition."},
+	store.EntityData{"db/ident": attrOffsetNext, "db/type": "db.type/int64",
+		"db/doc": "The offset of the next record to ingest from the partition."},
+}
+
+// Config configures an Ingester.
+type Config struct {
+	// Consumer names the ingester. Offsets are stored per consumer, so
+	// ingesters with different names consume the same topics independently.
+	Consumer string
+	Source   Source
+	Mapping  Mapping
+	// Decode decodes record values. If nil, DecodeJSON is used.
+	Decode Decoder
+	// OnError is called with each record that cannot be decoded or mapped.
+	// If it returns nil, the record is skipped. Otherwise, ingestion stops
+	// with the returned error. If OnError is nil, ingestion stops at the
+	// first such record.
+	OnError func(rec Record, err error) error
+}
+
+type partition struct {
+	topic string
+	num   int32
+}
+
+// Ingester transacts the records of a Source.
+type Ingester struct {
+	conn *store.Connection
+	cfg  Config
+	// next holds the offset of the next record to ingest from each
+	// partition that has been ingested from.
+	next map[partition]int64
+}
+
+// New returns an ingester that transacts records through conn.
+func New(conn *store.Connection, cfg Config) (*Ingester, error) {
+	if cfg.Consumer == "" {
+		return nil, errors.New("no consumer name specified")
+	}
+	if cfg.Source == nil {
+		return nil, errors.New("no source specified")
+	}
+	if err := cfg.Mapping.validate(); err != nil {
+		return nil, err
+	}
+	if cfg.Decode == nil {
+		cfg.Decode = DecodeJSON
+	}
+	return &Ingester{conn: conn, cfg: cfg}, nil
+}
+
+// Run resumes ingestion from the stored offsets and transacts records until
+// ctx is done or a record cannot be ingested. Each batch of records returned
+// by the source is transacted together.
+func (ing *Ingester) Run(ctx context.Context) error {
+	if err := ing.start(); err != nil {
+		return err
+	}
+	for {
+		records, err := ing.cfg.Source.Fetch(ctx)
+		if err != nil {
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return ctxErr
+			}
+			return fmt.Errorf("fetching records: %w", err)
+		}
+		if err := ing.ingest(records); err != nil {
+			return err
+		}
+	}
+}
+
+// start creates the offset schema, loads the stored offsets of the consumer,
+// and seeks the source to them.
+func (ing *Ingester) start() error {
+	if _, err := ing.conn.Assert(offsetSchema...); err != nil {
+		return fmt.Errorf("creating offset schema: %w", err)
+	}
+	rows, err := ing.conn.DB().Query(store.Query{
+		Find: []store.Var{"?topic", "?partition", "?next"},
+		Where: []store.Clause{
+			store.Pattern{Entity: store.Var("?e"), Attribute: attrOffsetConsumer, Value: ing.cfg.Consumer},
+			store.Pattern{Entity: store.Var("?e"), Attribute: attrOffsetTopic, Value: store.Var("?topic")},
+			store.Pattern{Entity: store.Var("?e"), Attribute: attrOffsetPartition, Value: store.Var("?partition")},
+			store.Pattern{Entity: store.Var("?e"), Attribute: attrOffsetNext, Value: store.Var("?next")},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("loading offsets: %w", err)
+	}
+	ing.next = make(map[partition]int64, len(rows))
+	for _, row := range rows {
+		p := partition{topic: row[0].(string), num: int32(row[1].(int64))}
+		next := row[2].(int64)
+		ing.next[p] = next
+		if err := ing.cfg.Source.Seek(p.topic, p.num, next); err != nil {
+			return fmt.Errorf("seeking %s/%d to offset %d: %w", p.topic, p.num, next, err)
+		}
+	}
+	return nil
+}
+
+// ingest transacts a batch of records along with the offsets that they
+// advance their partitions to. Records before the stored offset of their
+// partition have already been ingested and are skipped.
+func (ing *Ingester) ingest(records []Record) error {
+	var assertables []store.Assertable
+	advanced := make(map[partition]int64)
+	for _, rec := range records {
+		p := partition{topic: rec.Topic, num: rec.Partition}
+		next, ok := advanced[p]
+		if !ok {
+			next, ok = ing.next[p]
+		}
+		if ok && rec.Offset < next {
+			continue
+		}
+		advanced[p] = rec.Offset + 1
+
+		ent, err := ing.mapRecord(rec)
+		if err != nil {
+			err = fmt.Errorf("record %s/%d@%d: %w", rec.Topic, rec.Partition, rec.Offset, err)
+			if ing.cfg.OnError == nil {
+				return err
+			}
+			if err := ing.cfg.OnError(rec, err); err != nil {
+				return err
+			}
+			continue
+		}
+		assertables = append(assertables, ent)
+	}
+	if len(advanced) == 0 {
+		return nil
+	}
+
+	for p, next := range advanced {
+		assertables = append(assertables, store.EntityData{
+			attrOffsetKey:       fmt.Sprintf("%s:%s:%d", ing.cfg.Consumer, p.topic, p.num),
+			attrOffsetConsumer:  ing.cfg.Consumer,
+			attrOffsetTopic:     p.topic,
+			attrOffsetPartition: int64(p.num),
+			attrOffsetNext:      next,
+		})
+	}
+	if _, err := ing.conn.Assert(assertables...); err != nil {
+		return fmt.Errorf("transacting records: %w", err)
+	}
+	for p, next := range advanced {
+		ing.next[p] = next
+	}
+	return nil
+}
+
+func (ing *Ingester) mapRecord(rec Record) (store.EntityData, error) {
+	tm, ok := ing.cfg.Mapping.Topics[rec.Topic]
+	if !ok {
+		return nil, errors.New("topic has no mapping")
+	}
+	event, err := ing.cfg.Decode(rec.Value)
+	if err != nil {
+		return nil, fmt.Errorf("decoding event: %w", err)
+	}
+	return tm.Entity(event)
+}
@@ -0,0 +1,227 @@
+/*
+Copyright 2024 Andrew Meredith
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ingest_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/kendru/canter/internal/store"
+	"github.com/kendru/canter/internal/store/cantertest"
+	"github.com/kendru/canter/internal/store/ingest"
+	"github.com/stretchr/testify/assert"
+)
+
+// batchSource returns its batches of records in order, then stops ingestion
+// by cancelling the context. Seeks are recorded but do not skip any records,
+// as when a log redelivers records that were already consumed.
+type batchSource struct {
+	batches [][]ingest.Record
+	cancel  context.CancelFunc
+	seeks   map[string]int64
+}
+
+func (s *batchSource) Seek(topic string, partition int32, offset int64) error {
+	if s.seeks == nil {
+		s.seeks = make(map[string]int64)
+	}
+	s.seeks[fmt.Sprintf("%s/%d", topic, partition)] = offset
+	return nil
+}
+
+func (s *batchSource) Fetch(ctx context.Context) ([]ingest.Record, error) {
+	if len(s.batches) == 0 {
+		s.cancel()
+		return nil, ctx.Err()
+	}
+	batch := s.batches[0]
+	s.batches = s.batches[1:]
+	return batch, nil
+}
+
+func run(t *testing.T, conn *cantertest.Conn, cfg ingest.Config, batches ...[]ingest.Record) (*batchSource, error) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	src := &batchSource{batches: batches, cancel: cancel}
+	cfg.Source = src
+	ing, err := ingest.New(conn.Connection, cfg)
+	if !assert.NoError(t, err) {
+		return nil, err
+	}
+	err = ing.Run(ctx)
+	if errors.Is(err, context.Canceled) {
+		err = nil
+	}
+	return src, err
+}
+
+const testMapping = `{
+	"topics": {
+		"customers": {"attributes": {"customer/id": "id", "customer/name": "profile.name"}},
+		"orders": {
+			"attributes": {
+				"order/number": "number",
+				"order/total": {"field": "total"},
+				"order/customer": {"field": "customer", "lookup": "customer/id"}
+			}
+		},
+		"clicks": {"attributes": {"click/page": "page"}}
+	}
+}`
+
+func newIngestConn(t *testing.T) *cantertest.Conn {
+	conn := cantertest.NewConn(t, store.Config{})
+	conn.MustAssert(
+		store.EntityData{"db/ident": "customer/id", "db/type": "db.type/string", "db/unique": true},
+		store.EntityData{"db/ident": "customer/name", "db/type": "db.type/string"},
+		store.EntityData{"db/ident": "order/number", "db/type": "db.type/string", "db/unique": true},
+		store.EntityData{"db/ident": "order/total", "db/type": "db.type/float64"},
+		store.EntityData{"db/ident": "order/customer", "db/type": "db.type/ref"},
+		store.EntityData{"db/ident": "click/page", "db/type": "db.type/string"},
+	)
+	return conn
+}
+
+func record(topic string, partition int32, offset int64, value string) ingest.Record {
+	return ingest.Record{Topic: topic, Partition: partition, Offset: offset, Value: []byte(value)}
+}
+
+func countClicks(t *testing.T, conn *cantertest.Conn) int {
+	rows, err := conn.DB().Query(store.Query{
+		Find:  []store.Var{"?e"},
+		Where: []store.Clause{store.Pattern{Entity: store.Var("?e"), Attribute: "click/page", Value: store.Var("?page")}},
+	})
+	assert.NoError(t, err)
+	return len(rows)
+}
+
+func TestIngest(t *testing.T) {
+	conn := newIngestConn(t)
+	mapping, err := ingest.ParseMapping([]byte(testMapping))
+	if !assert.NoError(t, err) {
+		return
+	}
+	cfg := ingest.Config{Consumer: "materializer", Mapping: mapping}
+
+	batches := [][]ingest.Record{
+		{
+			record("customers", 0, 0, `{"id": "c1", "profile": {"name": "Ada"}}`),
+			record("clicks", 0, 0, `{"page": "/home"}`),
+			record("clicks", 1, 0, `{"page": "/about"}`),
+		},
+		{
+			record("orders", 0, 0, `{"number": "o1", "total": 12, "customer": "c1"}`),
+			record("customers", 0, 1, `{"id": "c1", "profile": {"name": "Ada L."}}`),
+			record("clicks", 0, 1, `{"page": "/cart"}`),
+		},
+	}
+	_, err = run(t, conn, cfg, batches...)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	c1 := conn.MustPull(store.NewLookup("customer/id", "c1"), store.PullAttr{Attribute: "customer/name"})
+	assert.Equal(t, store.EntityData{"customer/name": "Ada L."}, c1)
+	customer, err := store.NewLookup("customer/id", "c1").Resolve(conn.Connection)
+	assert.NoError(t, err)
+	assert.Equal(t, store.EntityData{"order/total": 12.0, "order/customer": customer},
+		conn.MustPull(store.NewLookup("order/number", "o1"),
+			store.PullAttr{Attribute: "order/total"},
+			store.PullAttr{Attribute: "order/customer"}))
+	assert.Equal(t, 3, countClicks(t, conn))
+
+	// A restarted ingester seeks to the stored offsets and skips records that
+	// the source redelivers, so that events without unique attributes are not
+	// transacted twice.
+	batches = append(batches, []ingest.Record{record("clicks", 1, 1, `{"page": "/contact"}`)})
+	src, err := run(t, conn, cfg, batches...)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, map[string]int64{"customers/0": 2, "clicks/0": 2, "clicks/1": 1, "orders/0": 1}, src.seeks)
+	assert.Equal(t, 4, countClicks(t, conn))
+
+	// Offsets are stored per consumer.
+	cfg.Consumer = "replayer"
+	_, err = run(t, conn, cfg, batches[0])
+	assert.NoError(t, err)
+	assert.Equal(t, 6, countClicks(t, conn))
+}
+
+func TestIngestErrors(t *testing.T) {
+	conn := newIngestConn(t)
+	mapping, err := ingest.ParseMapping([]byte(testMapping))
+	if !assert.NoError(t, err) {
+		return
+	}
+	batch := []ingest.Record{
+		record("clicks", 0, 0, `{"page": "/home"}`),
+		record("clicks", 0, 1, `not json`),
+		record("unmapped", 0, 0, `{"page": "/home"}`),
+		record("clicks", 0, 2, `{"referrer": "/home"}`),
+		record("clicks", 0, 3, `{"page": "/cart"}`),
+	}
+
+	// By default, ingestion stops at the first bad record without
+	// transacting the batch.
+	_, err = run(t, conn, ingest.Config{Consumer: "strict", Mapping: mapping}, batch)
+	assert.Error(t, err)
+	assert.Equal(t, 0, countClicks(t, conn))
+
+	var skipped []int64
+	_, err = run(t, conn, ingest.Config{
+		Consumer: "lenient",
+		Mapping:  mapping,
+		OnError: func(rec ingest.Record, err error) error {
+			skipped = append(skipped, rec.Offset)
+			return nil
+		},
+	}, batch)
+	assert.NoError(t, err)
+	assert.Equal(t, []int64{1, 0, 2}, skipped)
+	assert.Equal(t, 2, countClicks(t, conn))
+}
+
+func TestParseMapping(t *testing.T) {
+	for name, doc := range map[string]string{
+		"no topics":     `{"topics": {}}`,
+		"no attributes": `{"topics": {"t": {"attributes": {}}}}`,
+		"no field":      `{"topics": {"t": {"attributes": {"a/b": {"lookup": "c/d"}}}}}`,
+		"unknown field": `{"topics": {"t": {"attrs": {"a/b": "x"}}}}`,
+	} {
+		_, err := ingest.ParseMapping([]byte(doc))
+		assert.Error(t, err, name)
+	}
+
+	mapping, err := ingest.ParseMapping([]byte(`{"topics": {"t": {"attributes": {"a/b": "x.y", "a/c": {"field": "z", "lookup": "c/id"}}}}}`))
+	if !assert.NoError(t, err) {
+		return
+	}
+	event, err := ingest.DecodeJSON([]byte(`{"x": {"y": 1.5}, "z": ["c1", null, "c2"]}`))
+	if !assert.NoError(t, err) {
+		return
+	}
+	ent, err := mapping.Topics["t"].Entity(event)
+	assert.NoError(t, err)
+	assert.Equal(t, store.EntityData{
+		"a/b": 1.5,
+		"a/c": []store.Value{store.NewLookup("c/id", "c1"), store.NewLookup("c/id", "c2")},
+	}, ent)
+}
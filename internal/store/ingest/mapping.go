@@ -0,0 +1,180 @@
+/*
+Copyright 2024 Andrew Meredith
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ingest
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/kendru/canter/internal/store"
+)
+
+// Mapping describes how the events of each topic become entities. Mappings are
+// usually read from JSON with ParseMapping, e.g.:
+//
+//	{
+//	  "topics": {
+//	    "orders": {
+//	      "attributes": {
+//	        "order/number": "id",
+//	        "order/total": "amount.value",
+//	        "order/customer": {"field": "customer", "lookup": "customer/id"}
+//	      }
+//	    }
+//	  }
+//	}
+type Mapping struct {
+	Topics map[string]TopicMapping `json:"topics"`
+}
+
+// TopicMapping maps the events of a topic to entities. Each event is asserted
+// as one entity, so an event whose mapped attributes include a unique
+// attribute updates the entity with the same value of that attribute, and any
+// other event creates a new entity.
+type TopicMapping struct {
+	// Attributes maps attribute idents to the event fields that hold their
+	// values. Fields that are missing from an event or null are skipped.
+	Attributes map[string]FieldMapping `json:"attributes"`
+}
+
+// FieldMapping selects the value of an attribute from an event. In JSON, a
+// mapping that only has a Field may be given as a string.
+type FieldMapping struct {
+	// Field is the path of the field in the event, with the names of nested
+	// objects separated by dots.
+	Field string `json:"field"`
+	// Lookup, if set, names a unique attribute. The field's value is then
+	// resolved to the entity that has that value of Lookup, so the mapped
+	// attribute must be a ref.
+	Lookup string `json:"lookup,omitempty"`
+}
+
+func (f *FieldMapping) UnmarshalJSON(data []byte) error {
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte(`"`)) {
+		return json.Unmarshal(data, &f.Field)
+	}
+	type fieldMapping FieldMapping
+	return json.Unmarshal(data, (*fieldMapping)(f))
+}
+
+// ParseMapping reads a mapping from JSON.
+func ParseMapping(data []byte) (Mapping, error) {
+	var m Mapping
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&m); err != nil {
+		return Mapping{}, fmt.Errorf("decoding mapping: %w", err)
+	}
+	if err := m.validate(); err != nil {
+		return Mapping{}, err
+	}
+	return m, nil
+}
+
+func (m Mapping) validate() error {
+	if len(m.Topics) == 0 {
+		return errors.New("mapping has no topics")
+	}
+	for topic, tm := range m.Topics {
+		if len(tm.Attributes) == 0 {
+			return fmt.Errorf("topic %s: mapping has no attributes", topic)
+		}
+		for attr, fm := range tm.Attributes {
+			if fm.Field == "" {
+				return fmt.Errorf("topic %s: attribute %s: no field specified", topic, attr)
+			}
+		}
+	}
+	return nil
+}
+
+// Entity maps a decoded event to an entity. Integral JSON numbers become int64
+// values, other numbers float64 values, and arrays the values of
+// cardinality-many attributes. It fails if the event has none of the mapped
+// fields.
+func (tm TopicMapping) Entity(event map[string]any) (store.EntityData, error) {
+	ent := make(store.EntityData, len(tm.Attributes))
+	for attr, fm := range tm.Attributes {
+		raw, ok := lookupField(event, fm.Field)
+		if !ok || raw == nil {
+			continue
+		}
+		val, err := eventValue(raw)
+		if err != nil {
+			return nil, fmt.Errorf("field %s: %w", fm.Field, err)
+		}
+		if fm.Lookup != "" {
+			if vals, ok := val.([]store.Value); ok {
+				for i := range vals {
+					vals[i] = store.NewLookup(fm.Lookup, vals[i])
+				}
+			} else {
+				val = store.NewLookup(fm.Lookup, val)
+			}
+		}
+		ent[attr] = val
+	}
+	if len(ent) == 0 {
+		return nil, errors.New("event has none of the mapped fields")
+	}
+	return ent, nil
+}
+
+// lookupField returns the value at a dotted path in an event.
+func lookupField(event map[string]any, path string) (any, bool) {
+	var cur any = event
+	for _, name := range strings.Split(path, ".") {
+		obj, ok := cur.(map[string]any)
+		if !ok {
+			return nil, false
+		}
+		if cur, ok = obj[name]; !ok {
+			return nil, false
+		}
+	}
+	return cur, true
+}
+
+func eventValue(val any) (store.Value, error) {
+	switch v := val.(type) {
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return n, nil
+		}
+		return v.Float64()
+	case []any:
+		vals := make([]store.Value, 0, len(v))
+		for _, elem := range v {
+			if elem == nil {
+				continue
+			}
+			val, err := eventValue(elem)
+			if err != nil {
+				return nil, err
+			}
+			vals = append(vals, val)
+		}
+		return vals, nil
+	case map[string]any:
+		return nil, errors.New("objects cannot be mapped to a value")
+	default:
+		return v, nil
+	}
+}
@@ -0,0 +1,196 @@
+/*
+Copyright 2024 Andrew Meredith
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+)
+
+// lifecycle tracks the operations in flight on a connection so that Close can
+// wait for them to finish.
+type lifecycle struct {
+	mu     sync.Mutex
+	closed bool
+	// inflight counts writes, open read transactions, and background work.
+	inflight sync.WaitGroup
+	readTxns map[*ReadTxn]struct{}
+	// onClose holds functions that stop background work that is not
+	// stopped by closing the connection's tx report queues.
+	onClose []func()
+}
+
+// begin registers an operation, which must be ended by calling end. It fails
+// with ErrClosed once the connection is closing.
+func (l *lifecycle) begin() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return ErrClosed
+	}
+	l.inflight.Add(1)
+	return nil
+}
+
+func (l *lifecycle) end() {
+	l.inflight.Done()
+}
+
+func (l *lifecycle) isClosed() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.closed
+}
+
+func (l *lifecycle) beginReadTxn(rt *ReadTxn) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return ErrClosed
+	}
+	if l.readTxns == nil {
+		l.readTxns = make(map[*ReadTxn]struct{})
+	}
+	l.readTxns[rt] = struct{}{}
+	l.inflight.Add(1)
+	return nil
+}
+
+func (l *lifecycle) endReadTxn(rt *ReadTxn) {
+	l.mu.Lock()
+	delete(l.readTxns, rt)
+	l.mu.Unlock()
+	l.inflight.Done()
+}
+
+// onCloseFunc registers fn to be called when the connection is closed.
+func (l *lifecycle) onCloseFunc(fn func()) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.onClose = append(l.onClose, fn)
+}
+
+// close marks the connection as closing and reports whether it was open.
+func (l *lifecycle) close() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return false
+	}
+	l.closed = true
+	return true
+}
+
+// wait waits for the operations in flight to finish. If ctx is done first,
+// the read transactions that are still open are closed, and ctx's error is
+// returned.
+func (l *lifecycle) wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		l.inflight.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+	}
+
+	l.mu.Lock()
+	open := make([]*ReadTxn, 0, len(l.readTxns))
+	for rt := range l.readTxns {
+		open = append(open, rt)
+	}
+	l.mu.Unlock()
+	for _, rt := range open {
+		rt.Close()
+	}
+	return ctx.Err()
+}
+
+// Close shuts the connection down. Transactions and read transactions that
+// are started after Close is called fail with ErrClosed, and Close waits for
+// those already in flight to finish. It then closes the connection's tx
+// report queues, which stops the peers, watches, subscriptions, and outbox
+// relays that follow the connection, and clears its caches. Unless the
+// connection is a peer, it finally closes every part of its storage that
+// implements io.Closer, which returns unused IDs leased from the ID sequence.
+//
+// If ctx is done before the operations in flight finish, read transactions
+// that are still open are closed, the connection is shut down without waiting
+// for writes, and ctx's error is returned. Closing a closed connection is a
+// no-op.
+func (conn *Connection) Close(ctx context.Context) error {
+	if !conn.lifecycle.close() {
+		return nil
+	}
+	waitErr := conn.lifecycle.wait(ctx)
+
+	conn.txReports.close()
+	conn.lifecycle.mu.Lock()
+	onClose := conn.lifecycle.onClose
+	conn.lifecycle.mu.Unlock()
+	for _, fn := range onClose {
+		fn()
+	}
+	conn.clearCaches()
+
+	var closeErr error
+	if conn.transactor == nil {
+		closeErr = conn.closeStorage()
+	}
+	return errors.Join(waitErr, closeErr)
+}
+
+// clearCaches releases the memory held by the connection's schema and entity
+// caches.
+func (conn *Connection) clearCaches() {
+	conn.schemaMu.Lock()
+	conn.schemaEntityCache = make(map[ID]Entity)
+	conn.schemaGen++
+	conn.schemaMu.Unlock()
+	conn.entityCache.clear()
+}
+
+// closeStorage closes each distinct part of the connection's storage that
+// implements io.Closer.
+func (conn *Connection) closeStorage() error {
+	var closers []io.Closer
+	var errs []error
+	for _, part := range []any{conn.indexer, conn.idManager, conn.identManager, conn.blobStore} {
+		closer, ok := part.(io.Closer)
+		if !ok || containsCloser(closers, closer) {
+			continue
+		}
+		closers = append(closers, closer)
+		if err := closer.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func containsCloser(closers []io.Closer, closer io.Closer) bool {
+	for _, c := range closers {
+		if c == closer {
+			return true
+		}
+	}
+	return false
+}
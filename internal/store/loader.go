@@ -0,0 +1,114 @@
+/*
+Copyright 2024 Andrew Meredith
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import "sync"
+
+// EntityLoader batches and caches reads of entities from a view of the
+// database, in the manner of a DataLoader. Load only schedules an entity to be
+// read; the entities scheduled by every Load call are read together, in a
+// single GetEntities batch, when the result of any of them is first needed.
+// This lets code that resolves references one at a time, such as the
+// resolvers of a GraphQL server, read a whole level of a graph in one batch
+// rather than one entity at a time.
+//
+// A loader caches every entity that it reads for as long as it is in use, so
+// it should be scoped to a single request. It is safe for concurrent use.
+type EntityLoader struct {
+	db Database
+
+	mu      sync.Mutex
+	pending []ID
+	results map[ID]*loadResult
+	batches int
+}
+
+type loadResult struct {
+	ent Entity
+	err error
+}
+
+// NewEntityLoader returns a loader that reads entities from this view of the
+// database.
+func (db Database) NewEntityLoader() *EntityLoader {
+	return &EntityLoader{db: db, results: make(map[ID]*loadResult)}
+}
+
+// Load schedules an entity to be read and returns a function that returns it.
+// Calling the function reads every entity that has been scheduled but not yet
+// read.
+func (l *EntityLoader) Load(id ID) func() (Entity, error) {
+	l.mu.Lock()
+	r, ok := l.results[id]
+	if !ok {
+		r = &loadResult{}
+		l.results[id] = r
+		l.pending = append(l.pending, id)
+	}
+	l.mu.Unlock()
+	return func() (Entity, error) {
+		l.dispatch()
+		return r.ent, r.err
+	}
+}
+
+// LoadMany returns several entities, in the same order as ids, along with
+// every other entity that has been scheduled.
+func (l *EntityLoader) LoadMany(ids []ID) ([]Entity, error) {
+	thunks := make([]func() (Entity, error), len(ids))
+	for i, id := range ids {
+		thunks[i] = l.Load(id)
+	}
+	ents := make([]Entity, len(ids))
+	for i, thunk := range thunks {
+		var err error
+		if ents[i], err = thunk(); err != nil {
+			return nil, err
+		}
+	}
+	return ents, nil
+}
+
+// Batches returns the number of batches in which the loader has read
+// entities.
+func (l *EntityLoader) Batches() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.batches
+}
+
+// dispatch reads the entities that are scheduled. The lock is held while they
+// are read, so that callers waiting on a scheduled entity see its result.
+func (l *EntityLoader) dispatch() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.pending) == 0 {
+		return
+	}
+	ids := l.pending
+	l.pending = nil
+	l.batches++
+	ents, err := l.db.GetEntities(ids)
+	for i, id := range ids {
+		r := l.results[id]
+		if err != nil {
+			r.err = err
+			continue
+		}
+		r.ent = ents[i]
+	}
+}
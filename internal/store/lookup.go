@@ -19,6 +19,7 @@ package store
 import (
 	"context"
 	"fmt"
+	"time"
 
 	"github.com/kendru/canter/pkg/dataflow"
 )
@@ -36,27 +37,30 @@ func NewLookup(attributeName string, value Value) Lookup {
 }
 
 func (l Lookup) Resolve(conn *Connection) (ID, error) {
+	return l.resolveIn(conn.DB())
+}
+
+func (l Lookup) resolveIn(db Database) (ID, error) {
+	conn := db.conn
 	attr, err := ResolveIdent(conn, l.AttributeName)
 	if err != nil {
 		return 0, fmt.Errorf("resolving attribute: %w", err)
 	}
-	schemaEntity, err := conn.GetEntity(attr.ID)
-	if err != nil {
-		return 0, fmt.Errorf("fetching attribute schema: %w", err)
+	if err := db.checkUnique(attr); err != nil {
+		return 0, err
 	}
-	isUnique, err := schemaEntity.Get(conn, IDUnique)
-	switch err {
-	case nil:
-		if !isUnique.(bool) {
-			return 0, fmt.Errorf("attribute %q is not unique", l.AttributeName)
-		}
-	case ErrPropertyNotFound:
-		return 0, fmt.Errorf("attribute %q is not unique", l.AttributeName)
-	default:
-		return 0, fmt.Errorf("fetching attribute %q uniqueness: %w", l.AttributeName, err)
+	value, err := db.lookupValue(l.Value)
+	if err != nil {
+		return 0, fmt.Errorf("resolving Lookup value: %w", err)
 	}
+	return db.lookupEntity(attr.ID, value)
+}
 
-	scan, err := conn.indexer.ScanAVET(attr.ID, l.Value)
+// lookupEntity returns the entity that holds a value of a unique attribute.
+// If the view's read filter hides the attribute of that entity, the lookup
+// fails with ErrNoSuchEntity, so that hidden values cannot be probed.
+func (db Database) lookupEntity(attrID ID, value Value) (ID, error) {
+	scan, err := db.reader().ScanAVET(attrID, value)
 	if err != nil {
 		return 0, fmt.Errorf("scanning AVET index to resolve Lookup: %w", err)
 	}
@@ -66,9 +70,158 @@ func (l Lookup) Resolve(conn *Connection) (ID, error) {
 		return 0, fmt.Errorf("scanning AVET index to resolve Lookup: %w", err)
 	}
 
-	if len(facts) == 0 {
+	if len(facts) == 0 || !db.readable(attrID, facts[0].EntityID, make(readFilterCache)) {
 		return 0, ErrNoSuchEntity
 	}
 
 	return facts[0].EntityID, nil
 }
+
+// lookupValue converts the elements of a tuple lookup value, such as the
+// value of a composite attribute, to the form in which they are stored.
+// Other values are returned unchanged.
+func (db Database) lookupValue(val Value) (Value, error) {
+	tuple, ok := val.(Tuple)
+	if !ok {
+		return val, nil
+	}
+	out := make(Tuple, len(tuple))
+	for i, elem := range tuple {
+		switch v := elem.(type) {
+		case int:
+			out[i] = int64(v)
+		case Ident:
+			id, err := v.Resolve(db.conn)
+			if err != nil {
+				return nil, fmt.Errorf("resolving element %d: %w", i, err)
+			}
+			out[i] = id
+		case Lookup:
+			id, err := v.resolveIn(db)
+			if err != nil {
+				return nil, fmt.Errorf("resolving element %d: %w", i, err)
+			}
+			out[i] = id
+		default:
+			out[i] = elem
+		}
+	}
+	return out, nil
+}
+
+// checkUnique returns an error unless attr is a unique attribute.
+func (db Database) checkUnique(attr Ident) error {
+	isUnique, err := db.isUnique(attr.ID)
+	if err != nil {
+		return fmt.Errorf("fetching attribute %q uniqueness: %w", attr.Name, err)
+	}
+	if !isUnique {
+		return fmt.Errorf("attribute %q is not unique", attr.Name)
+	}
+	return nil
+}
+
+// isUnique reports whether the schema marks an attribute as unique, with
+// either identity or value semantics.
+func (db Database) isUnique(attrID ID) (bool, error) {
+	uniqueness, err := db.uniqueness(attrID)
+	return uniqueness != 0, err
+}
+
+// lookupKey identifies a lookup by its resolved attribute and value. Values
+// that are equal by ValueEqual have the same key.
+type lookupKey struct {
+	attr  ID
+	value string
+}
+
+func newLookupKey(attr ID, val Value) lookupKey {
+	return lookupKey{
+		attr:  attr,
+		value: fmt.Sprintf("%#v", canonicalValue(val)),
+	}
+}
+
+// canonicalValue returns the same value for values that are equal by
+// ValueEqual but would otherwise be formatted differently: times in different
+// locations.
+func canonicalValue(val Value) Value {
+	switch v := val.(type) {
+	case time.Time:
+		return v.UTC()
+	case Tuple:
+		out := make(Tuple, len(v))
+		for i, elem := range v {
+			out[i] = canonicalValue(elem)
+		}
+		return out
+	default:
+		return val
+	}
+}
+
+// resolveLookups resolves a batch of lookups, scanning the AVET index once
+// per attribute. Lookups that do not match any entity map to
+// unresolvedEntityID. Lookups whose attribute cannot be resolved or is not
+// unique are omitted from the result, so that resolving them individually
+// reports the error.
+func (db Database) resolveLookups(lookups []Lookup) (map[lookupKey]ID, error) {
+	out := make(map[lookupKey]ID, len(lookups))
+
+	// Group the values by attribute.
+	var order []ID
+	attrs := make(map[string]Ident)
+	values := make(map[ID][]Value)
+	for _, l := range lookups {
+		if l.Value == nil {
+			continue
+		}
+		// The elements of tuple values may need to be resolved themselves, so
+		// they are left to be resolved individually.
+		if _, ok := l.Value.(Tuple); ok {
+			continue
+		}
+		attr, ok := attrs[l.AttributeName]
+		if !ok {
+			ident, err := ResolveIdent(db.conn, l.AttributeName)
+			if err == nil && db.checkUnique(ident) == nil {
+				attr = ident
+			}
+			attrs[l.AttributeName] = attr
+		}
+		if attr.ID == 0 {
+			continue
+		}
+		key := newLookupKey(attr.ID, l.Value)
+		if _, ok := out[key]; ok {
+			continue
+		}
+		out[key] = unresolvedEntityID
+		if _, ok := values[attr.ID]; !ok {
+			order = append(order, attr.ID)
+		}
+		values[attr.ID] = append(values[attr.ID], l.Value)
+	}
+
+	idents := make(readFilterCache)
+	for _, attrID := range order {
+		scan, err := db.reader().ScanAVETValues(attrID, values[attrID])
+		if err != nil {
+			return nil, fmt.Errorf("scanning AVET index to resolve lookups: %w", err)
+		}
+		facts, err := dataflow.CollectIntoSlice(dataflow.NewContext(context.Background()), scan)
+		if err != nil {
+			return nil, fmt.Errorf("scanning AVET index to resolve lookups: %w", err)
+		}
+		for _, fct := range facts {
+			if !db.readable(attrID, fct.EntityID, idents) {
+				continue
+			}
+			key := newLookupKey(attrID, fct.Value)
+			if out[key] == unresolvedEntityID {
+				out[key] = fct.EntityID
+			}
+		}
+	}
+	return out, nil
+}
@@ -0,0 +1,260 @@
+/*
+Copyright 2024 Andrew Meredith
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/kendru/canter/pkg/dataflow"
+)
+
+// MemoryStats describes the memory accounted for by a connection.
+type MemoryStats struct {
+	// Budget is the connection's memory budget in bytes, or zero if it is
+	// unlimited.
+	Budget int64
+	// Used is the estimated number of bytes held by the entity cache and by
+	// scans and queries in progress, and Peak is the most that has been used
+	// at once.
+	Used, Peak int64
+	// Rejected is the number of scans and queries that failed with
+	// ErrMemoryBudget.
+	Rejected uint64
+}
+
+// MemoryStats returns the memory accounted for by the connection. See
+// Config.MemoryBudget.
+func (conn *Connection) MemoryStats() MemoryStats {
+	return conn.memory.stats()
+}
+
+// MemoryBudgetError is returned when a scan or query would exceed the memory
+// budget of its connection. It matches ErrMemoryBudget.
+type MemoryBudgetError struct {
+	// Operation is the operation that needed the memory: "scan" or "query".
+	Operation string
+	// Requested is the number of bytes that the operation needed, in
+	// addition to Used, the number in use by the connection at the time.
+	Requested, Used, Budget int64
+}
+
+func (e *MemoryBudgetError) Error() string {
+	return fmt.Sprintf("%s needs %d bytes, but %d of the budget of %d are in use", e.Operation, e.Requested, e.Used, e.Budget)
+}
+
+func (e *MemoryBudgetError) Unwrap() error {
+	return ErrMemoryBudget
+}
+
+// memoryAccountant tracks the estimated memory held by a connection's entity
+// cache and by its scans and queries in progress, and keeps it within a
+// budget. The estimates count the values that are held rather than every
+// allocation, so the budget bounds memory use only approximately.
+//
+// Caches yield to scans and queries: when a scan or query needs memory that
+// is not available, cached entries are evicted to make room before the scan
+// or query fails.
+type memoryAccountant struct {
+	// budget is the number of bytes that may be used, or zero if memory is
+	// only tracked.
+	budget   int64
+	used     atomic.Int64
+	peak     atomic.Int64
+	rejected atomic.Uint64
+
+	mu sync.Mutex
+	// reclaimers free at least the requested number of bytes from a cache,
+	// if they can, and return the number that they freed.
+	reclaimers []func(n int64) int64
+}
+
+func newMemoryAccountant(budget int64) *memoryAccountant {
+	return &memoryAccountant{budget: max(budget, 0)}
+}
+
+// tryReserve reserves n bytes if they fit within the budget and reports
+// whether they did.
+func (m *memoryAccountant) tryReserve(n int64) bool {
+	for {
+		used := m.used.Load()
+		if m.budget > 0 && used+n > m.budget {
+			return false
+		}
+		if m.used.CompareAndSwap(used, used+n) {
+			m.observePeak(used + n)
+			return true
+		}
+	}
+}
+
+// reclaim asks the caches to free n bytes and reports whether they did.
+func (m *memoryAccountant) reclaim(n int64) bool {
+	m.mu.Lock()
+	reclaimers := m.reclaimers
+	m.mu.Unlock()
+	for _, r := range reclaimers {
+		if n -= r(n); n <= 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// addReclaimer registers a cache from which memory may be reclaimed.
+func (m *memoryAccountant) addReclaimer(r func(n int64) int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.reclaimers = append(m.reclaimers, r)
+}
+
+func (m *memoryAccountant) observePeak(used int64) {
+	for {
+		peak := m.peak.Load()
+		if used <= peak || m.peak.CompareAndSwap(peak, used) {
+			return
+		}
+	}
+}
+
+func (m *memoryAccountant) release(n int64) {
+	m.used.Add(-n)
+}
+
+func (m *memoryAccountant) stats() MemoryStats {
+	return MemoryStats{
+		Budget:   m.budget,
+		Used:     m.used.Load(),
+		Peak:     m.peak.Load(),
+		Rejected: m.rejected.Load(),
+	}
+}
+
+// memScope holds the memory reserved by a single operation, which is released
+// all at once when the operation ends. A scope is not safe for concurrent use.
+type memScope struct {
+	acct      *memoryAccountant
+	operation string
+	reserved  int64
+}
+
+func (m *memoryAccountant) scope(operation string) *memScope {
+	return &memScope{acct: m, operation: operation}
+}
+
+// reserve reserves n more bytes for the operation, evicting cached entries to
+// make room if necessary, or fails with a *MemoryBudgetError if they would
+// exceed the budget.
+func (s *memScope) reserve(n int64) error {
+	if !s.acct.tryReserve(n) && !(s.acct.reclaim(n) && s.acct.tryReserve(n)) {
+		s.acct.rejected.Add(1)
+		return &MemoryBudgetError{
+			Operation: s.operation,
+			Requested: n,
+			Used:      s.acct.used.Load(),
+			Budget:    s.acct.budget,
+		}
+	}
+	s.reserved += n
+	return nil
+}
+
+// release releases n of the bytes reserved by the operation.
+func (s *memScope) release(n int64) {
+	n = min(n, s.reserved)
+	s.reserved -= n
+	s.acct.release(n)
+}
+
+// close releases everything reserved by the operation.
+func (s *memScope) close() {
+	s.release(s.reserved)
+}
+
+// collect collects the items produced by scan, reserving the size of each
+// item from the scope as it is produced.
+func collect[T any](scope *memScope, scan dataflow.Producer[T], size func(*T) int64) ([]*T, error) {
+	var items []*T
+	err := scan.Produce(dataflow.NewContext(context.Background()), func(_ dataflow.DataflowCtx, item *T) error {
+		if item == nil {
+			return nil
+		}
+		if err := scope.reserve(size(item)); err != nil {
+			return err
+		}
+		items = append(items, item)
+		return nil
+	})
+	return items, err
+}
+
+// The sizes of facts and values are estimates of the memory that they hold,
+// including the overhead of the structures that hold them.
+const (
+	factOverhead    = 96
+	valueOverhead   = 16
+	bindingOverhead = 48
+)
+
+func factSize(fct *Fact) int64 {
+	return factOverhead + valueSize(fct.Value)
+}
+
+func assertionSize(ra *ResolvedAssertion) int64 {
+	return factSize(&ra.Fact)
+}
+
+func valueSize(val Value) int64 {
+	switch v := val.(type) {
+	case string:
+		return valueOverhead + int64(len(v))
+	case []byte:
+		return valueOverhead + int64(len(v))
+	case Tuple:
+		size := int64(valueOverhead)
+		for _, elem := range v {
+			size += valueSize(elem)
+		}
+		return size
+	case []Value:
+		size := int64(valueOverhead)
+		for _, elem := range v {
+			size += valueSize(elem)
+		}
+		return size
+	default:
+		return valueOverhead
+	}
+}
+
+func entitySize(ent Entity) int64 {
+	size := int64(bindingOverhead)
+	for _, val := range ent.state {
+		size += bindingOverhead + valueSize(val)
+	}
+	return size
+}
+
+func bindingSize(b binding) int64 {
+	size := int64(bindingOverhead)
+	for _, val := range b {
+		size += bindingOverhead + valueSize(val)
+	}
+	return size
+}
@@ -0,0 +1,319 @@
+/*
+Copyright 2024 Andrew Meredith
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/gofrs/uuid/v5"
+	"github.com/oklog/ulid/v2"
+)
+
+// NOTE [TX-ROOTS]:
+//
+// Every transaction records the Merkle root of its facts as its db.tx/hash,
+// so that anyone holding the facts of the transaction can check that they
+// are the facts that were committed: a replica can compare its roots with
+// those of the transactor, and a log that was altered after the fact no longer
+// matches its roots.
+//
+// The leaves of the tree are the hashes of the facts (see HashFact), sorted
+// so that the root does not depend on the order in which the indexes return
+// them. Each interior node hashes its two children, and a node without a
+// sibling is carried up to the next level unchanged. Leaves and interior
+// nodes are hashed with different prefixes so that one cannot pose as the
+// other. The db.tx/hash fact itself is not a leaf.
+//
+// The encoding of a fact must never change, or the roots of existing
+// transactions would no longer verify. A new type of value must be given a
+// new tag.
+
+// Prefixes of the hashes of the nodes of a transaction's Merkle tree.
+const (
+	merkleLeaf     byte = 0
+	merkleInterior byte = 1
+)
+
+// Tags of the types of values in the canonical encoding of a fact.
+const (
+	hashTagNil byte = iota
+	hashTagBool
+	hashTagInt8
+	hashTagInt16
+	hashTagInt32
+	hashTagInt64
+	hashTagFloat32
+	hashTagFloat64
+	hashTagString
+	hashTagBytes
+	hashTagTime
+	hashTagID
+	hashTagUUID
+	hashTagULID
+	hashTagTuple
+	hashTagBlob
+)
+
+// HashFact returns the SHA-256 hash of the canonical encoding of a resolved
+// fact: its entity, attribute, transaction, mode, valid-time period, and
+// value. Equal facts hash equally, whatever the location of their times.
+func HashFact(ra ResolvedAssertion) ([sha256.Size]byte, error) {
+	buf := make([]byte, 0, 64)
+	buf = append(buf, merkleLeaf)
+	buf = binary.BigEndian.AppendUint64(buf, uint64(ra.EntityID))
+	buf = binary.BigEndian.AppendUint64(buf, uint64(ra.Attribute))
+	buf = binary.BigEndian.AppendUint64(buf, uint64(ra.Tx))
+	buf = append(buf, byte(ra.mode))
+	buf = appendHashTime(buf, ra.ValidFrom)
+	buf = appendHashTime(buf, ra.ValidTo)
+	buf, err := appendHashValue(buf, ra.Value)
+	if err != nil {
+		return [sha256.Size]byte{}, fmt.Errorf("hashing fact of entity %d attribute %d: %w", ra.EntityID, ra.Attribute, err)
+	}
+	return sha256.Sum256(buf), nil
+}
+
+// TxRoot returns the Merkle root of the facts of a transaction. See NOTE
+// [TX-ROOTS].
+func TxRoot(assertions []ResolvedAssertion) ([]byte, error) {
+	level := make([][]byte, 0, len(assertions))
+	for _, ra := range assertions {
+		if ra.Attribute == IDTxHash {
+			continue
+		}
+		leaf, err := HashFact(ra)
+		if err != nil {
+			return nil, err
+		}
+		level = append(level, leaf[:])
+	}
+	return merkleRoot(level), nil
+}
+
+// merkleRoot returns the root of the Merkle tree whose leaves are the given
+// hashes, in sorted order. It sorts leaves in place.
+func merkleRoot(level [][]byte) []byte {
+	if len(level) == 0 {
+		root := sha256.Sum256(nil)
+		return root[:]
+	}
+	sort.Slice(level, func(i, j int) bool {
+		return bytes.Compare(level[i], level[j]) < 0
+	})
+	for len(level) > 1 {
+		next := level[:0:0]
+		for i := 0; i < len(level); i += 2 {
+			if i+1 == len(level) {
+				next = append(next, level[i])
+				continue
+			}
+			h := sha256.New()
+			h.Write([]byte{merkleInterior})
+			h.Write(level[i])
+			h.Write(level[i+1])
+			next = append(next, h.Sum(nil))
+		}
+		level = next
+	}
+	return level[0]
+}
+
+func appendHashTime(buf []byte, t time.Time) []byte {
+	if t.IsZero() {
+		return append(buf, 0)
+	}
+	buf = append(buf, 1)
+	buf = binary.BigEndian.AppendUint64(buf, uint64(t.Unix()))
+	return binary.BigEndian.AppendUint32(buf, uint32(t.Nanosecond()))
+}
+
+func appendHashBytes(buf, b []byte) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(b)))
+	return append(buf, b...)
+}
+
+func appendHashValue(buf []byte, val Value) ([]byte, error) {
+	switch v := val.(type) {
+	case nil:
+		return append(buf, hashTagNil), nil
+	case bool:
+		if v {
+			return append(buf, hashTagBool, 1), nil
+		}
+		return append(buf, hashTagBool, 0), nil
+	case int8:
+		return append(buf, hashTagInt8, byte(v)), nil
+	case int16:
+		return binary.BigEndian.AppendUint16(append(buf, hashTagInt16), uint16(v)), nil
+	case int32:
+		return binary.BigEndian.AppendUint32(append(buf, hashTagInt32), uint32(v)), nil
+	case int64:
+		return binary.BigEndian.AppendUint64(append(buf, hashTagInt64), uint64(v)), nil
+	case float32:
+		return binary.BigEndian.AppendUint32(append(buf, hashTagFloat32), math.Float32bits(v)), nil
+	case float64:
+		return binary.BigEndian.AppendUint64(append(buf, hashTagFloat64), math.Float64bits(v)), nil
+	case string:
+		return appendHashBytes(append(buf, hashTagString), []byte(v)), nil
+	case []byte:
+		return appendHashBytes(append(buf, hashTagBytes), v), nil
+	case time.Time:
+		return appendHashTime(append(buf, hashTagTime), v), nil
+	case ID:
+		return binary.BigEndian.AppendUint64(append(buf, hashTagID), uint64(v)), nil
+	case uuid.UUID:
+		return append(append(buf, hashTagUUID), v[:]...), nil
+	case ulid.ULID:
+		return append(append(buf, hashTagULID), v[:]...), nil
+	case BlobDigest:
+		return append(append(buf, hashTagBlob), v[:]...), nil
+	case Tuple:
+		buf = binary.AppendUvarint(append(buf, hashTagTuple), uint64(len(v)))
+		var err error
+		for _, elem := range v {
+			if buf, err = appendHashValue(buf, elem); err != nil {
+				return nil, err
+			}
+		}
+		return buf, nil
+	default:
+		return nil, fmt.Errorf("cannot hash value of type %T", val)
+	}
+}
+
+// withTxRoot appends the db.tx/hash fact of the transaction that commits the
+// assertions, replacing any that they already hold. Assertions without a
+// transaction entity, which have no commit time, are returned unchanged.
+func withTxRoot(assertions []ResolvedAssertion) ([]ResolvedAssertion, error) {
+	var tx ID
+	out := make([]ResolvedAssertion, 0, len(assertions)+1)
+	for _, ra := range assertions {
+		if ra.Attribute == IDTxHash {
+			continue
+		}
+		if ra.Attribute == IDTxCommitTime && ra.EntityID == ra.Tx {
+			tx = ra.Tx
+		}
+		out = append(out, ra)
+	}
+	if tx == 0 {
+		return assertions, nil
+	}
+	root, err := TxRoot(out)
+	if err != nil {
+		return nil, err
+	}
+	return append(out, ResolvedAssertion{
+		Fact: Fact{EntityID: tx, Attribute: IDTxHash, Value: root, Tx: tx},
+		mode: AssertModeAddition,
+	}), nil
+}
+
+// VerifyTx recomputes the Merkle root of the facts of a transaction as of the
+// database and compares it with the root that was recorded when the
+// transaction was committed. It reports false if the transaction has no root,
+// as for transactions committed before roots were recorded, and fails with
+// ErrIntegrity if the roots differ. Facts that the history retention policy
+// of their attribute has discarded no longer verify.
+func (db Database) VerifyTx(tx ID) (bool, error) {
+	entries, err := db.TxLog(tx, 1)
+	if err != nil {
+		return false, err
+	}
+	if len(entries) == 0 || entries[0].Tx != tx {
+		return false, fmt.Errorf("transaction %d: %w", tx, ErrNoSuchEntity)
+	}
+	return verifyTxLogEntry(entries[0])
+}
+
+func verifyTxLogEntry(entry TxLogEntry) (bool, error) {
+	var recorded []byte
+	for _, ra := range entry.Data {
+		if ra.Attribute == IDTxHash && ra.EntityID == entry.Tx && ra.mode == AssertModeAddition {
+			recorded, _ = ra.Value.([]byte)
+		}
+	}
+	if recorded == nil {
+		return false, nil
+	}
+	root, err := TxRoot(entry.Data)
+	if err != nil {
+		return false, err
+	}
+	if !bytes.Equal(root, recorded) {
+		return false, fmt.Errorf("transaction %d has root %x, but its facts hash to %x: %w", entry.Tx, recorded, root, ErrIntegrity)
+	}
+	return true, nil
+}
+
+// TxLogVerification summarizes the verification of a transaction log.
+type TxLogVerification struct {
+	// Verified is the number of transactions whose roots matched their
+	// facts, and Unrooted the number that had no root.
+	Verified, Unrooted int
+	// Failed holds an error for each transaction whose root did not match.
+	Failed []error
+	// Root chains the roots of the transactions in commit order. Two stores
+	// with the same transactions have the same Root, so replicas may be
+	// compared by it alone.
+	Root []byte
+}
+
+// VerifyTxLog verifies every transaction of the database with VerifyTx.
+func (db Database) VerifyTxLog() (TxLogVerification, error) {
+	var res TxLogVerification
+	entries, err := db.TxLog(0, 0)
+	if err != nil {
+		return res, err
+	}
+	chain := sha256.New()
+	for _, entry := range entries {
+		ok, err := verifyTxLogEntry(entry)
+		switch {
+		case errors.Is(err, ErrIntegrity):
+			res.Failed = append(res.Failed, err)
+		case err != nil:
+			return res, err
+		case ok:
+			res.Verified++
+		default:
+			res.Unrooted++
+		}
+		root, err := TxRoot(entry.Data)
+		if err != nil {
+			return res, err
+		}
+		chainTxRoot(chain, entry.Tx, root)
+	}
+	res.Root = chain.Sum(nil)
+	return res, nil
+}
+
+// chainTxRoot adds the root of a transaction to the chain of the roots of a
+// log.
+func chainTxRoot(chain hash.Hash, tx ID, root []byte) {
+	chain.Write(binary.BigEndian.AppendUint64(nil, uint64(tx)))
+	chain.Write(root)
+}
@@ -0,0 +1,331 @@
+/*
+Copyright 2024 Andrew Meredith
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// The namespace of an attribute is the part of its ident before the slash,
+// such as "person" for "person/email". A namespace may be described by a
+// namespace entity, whose ident is the namespace's name in the db.namespace
+// namespace:
+//
+//	store.EntityData{
+//		"db/ident":            "db.namespace/person",
+//		"db/doc":              "People and their contact details.",
+//		"db/owner":            "identity-team",
+//		"db/attributePattern": "^[a-z][a-zA-Z]*$",
+//	}
+//
+// The namespace entity's rules are enforced when an attribute is added to the
+// namespace: the attribute's name, without the namespace, must match the
+// namespace's db/attributePattern, and no attribute may be added to a
+// namespace that is db/deprecated. Attributes that already exist are not
+// affected by changes to the rules.
+
+// namespacePrefix is the prefix of the idents of namespace entities.
+const namespacePrefix = "db.namespace/"
+
+// Namespace describes a namespace of attributes.
+type Namespace struct {
+	// ID is the ID of the namespace entity, or zero if the namespace has
+	// attributes but no entity.
+	ID         ID
+	Name       string
+	Doc        string
+	Owners     []string
+	Deprecated bool
+	// AttributePattern is the regular expression that the names of new
+	// attributes in the namespace must match, if any.
+	AttributePattern string
+	// Attributes are the attributes in the namespace, ordered by name.
+	Attributes []Ident
+	// Deprecations describe the deprecated attributes in the namespace and
+	// their replacements, ordered by name.
+	Deprecations []Deprecation
+}
+
+// namespaceOf splits an ident name into its namespace and local name. The
+// namespace is empty if the name does not have one.
+func namespaceOf(name string) (namespace, local string) {
+	namespace, local, ok := strings.Cut(name, "/")
+	if !ok {
+		return "", name
+	}
+	return namespace, local
+}
+
+// Namespaces returns every namespace that has a namespace entity or any
+// attributes, ordered by name. The system namespaces are omitted.
+func (db Database) Namespaces() ([]Namespace, error) {
+	byName := make(map[string]*Namespace)
+	get := func(name string) *Namespace {
+		ns, ok := byName[name]
+		if !ok {
+			ns = &Namespace{Name: name}
+			byName[name] = ns
+		}
+		return ns
+	}
+
+	attrs, err := db.attributes()
+	if err != nil {
+		return nil, err
+	}
+	for _, attr := range attrs {
+		if name, _ := namespaceOf(attr.Name); name != "" {
+			ns := get(name)
+			ns.Attributes = append(ns.Attributes, attr)
+		}
+	}
+	deprecations, err := db.Deprecations()
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range deprecations {
+		if name, _ := namespaceOf(d.Attribute.Name); name != "" {
+			ns := get(name)
+			ns.Deprecations = append(ns.Deprecations, d)
+		}
+	}
+
+	identAttr := IDIdent
+	facts, err := db.scan(nil, &identAttr)
+	if err != nil {
+		return nil, fmt.Errorf("scanning idents: %w", err)
+	}
+	var ids []any
+	for _, fct := range facts {
+		if !fct.EntityID.IsSystem() {
+			ids = append(ids, fct.EntityID)
+		}
+	}
+	idents, err := db.conn.ResolveIdents(ids)
+	if err != nil {
+		return nil, fmt.Errorf("resolving idents: %w", err)
+	}
+	for _, ident := range idents {
+		if name, ok := strings.CutPrefix(ident.Name, namespacePrefix); ok {
+			if err := db.loadNamespace(get(name), ident.ID); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	out := make([]Namespace, 0, len(byName))
+	for _, ns := range byName {
+		out = append(out, *ns)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out, nil
+}
+
+// Namespace returns the namespace with the given name. It fails with
+// ErrNoSuchEntity if the namespace has neither a namespace entity nor any
+// attributes.
+func (db Database) Namespace(name string) (Namespace, error) {
+	ns := Namespace{Name: name}
+	attrs, err := db.NamespaceAttributes(name)
+	if err != nil {
+		return ns, err
+	}
+	ns.Attributes = attrs
+	for _, attr := range attrs {
+		d, ok, err := db.deprecation(attr.ID)
+		if err != nil {
+			return ns, err
+		}
+		if ok {
+			ns.Deprecations = append(ns.Deprecations, d)
+		}
+	}
+	ident, err := ResolveIdent(db.conn, namespacePrefix+name)
+	switch {
+	case err == nil:
+		if err := db.loadNamespace(&ns, ident.ID); err != nil {
+			return ns, err
+		}
+	case errors.Is(err, ErrNoSuchIdent):
+	default:
+		return ns, err
+	}
+	if ns.ID == 0 && len(ns.Attributes) == 0 {
+		return ns, ErrNoSuchEntity
+	}
+	return ns, nil
+}
+
+// NamespaceAttributes returns the attributes in a namespace, ordered by name.
+func (db Database) NamespaceAttributes(namespace string) ([]Ident, error) {
+	attrs, err := db.attributes()
+	if err != nil {
+		return nil, err
+	}
+	var out []Ident
+	for _, attr := range attrs {
+		if name, _ := namespaceOf(attr.Name); name == namespace {
+			out = append(out, attr)
+		}
+	}
+	return out, nil
+}
+
+// attributes returns every attribute outside of the system partition,
+// ordered by name.
+func (db Database) attributes() ([]Ident, error) {
+	typeAttr := IDType
+	facts, err := db.scan(nil, &typeAttr)
+	if err != nil {
+		return nil, fmt.Errorf("scanning attributes: %w", err)
+	}
+	var ids []any
+	for _, fct := range facts {
+		if !fct.EntityID.IsSystem() {
+			ids = append(ids, fct.EntityID)
+		}
+	}
+	idents, err := db.conn.ResolveIdents(ids)
+	if err != nil {
+		return nil, fmt.Errorf("resolving attribute idents: %w", err)
+	}
+	sort.Slice(idents, func(i, j int) bool { return idents[i].Name < idents[j].Name })
+	return idents, nil
+}
+
+// loadNamespace populates ns from the facts of its namespace entity. A
+// namespace entity without any facts is treated as absent.
+func (db Database) loadNamespace(ns *Namespace, eid ID) error {
+	facts, err := db.scan(&eid, nil)
+	if err != nil {
+		return fmt.Errorf("reading namespace %q: %w", ns.Name, err)
+	}
+	for _, fct := range facts {
+		ns.ID = eid
+		switch fct.Attribute {
+		case IDDoc:
+			ns.Doc, _ = fct.Value.(string)
+		case IDOwner:
+			if owner, ok := fct.Value.(string); ok {
+				ns.Owners = append(ns.Owners, owner)
+			}
+		case IDDeprecated:
+			ns.Deprecated, _ = fct.Value.(bool)
+		case IDAttributePattern:
+			ns.AttributePattern, _ = fct.Value.(string)
+		}
+	}
+	sort.Strings(ns.Owners)
+	return nil
+}
+
+// checkNamespaces returns an error, which matches ErrSchemaViolation, if the
+// transaction adds an attribute that breaks the rules of its namespace or
+// declares an invalid db/attributePattern or db/historyRetention.
+func (tx *TxBuilder) checkNamespaces(resolved []ResolvedAssertion) error {
+	db := tx.conn.DB()
+	var stagedNames map[ID]string
+	for _, ra := range resolved {
+		if ra.mode != AssertModeAddition {
+			continue
+		}
+		switch ra.Attribute {
+		case IDAttributePattern:
+			if _, err := regexp.Compile(ra.Value.(string)); err != nil {
+				return errors.Join(fmt.Errorf("invalid db/attributePattern: %w", err), ErrSchemaViolation)
+			}
+
+		case IDHistoryRetention:
+			if _, err := parseRetention(ra.Value.(string)); err != nil {
+				return errors.Join(fmt.Errorf("invalid db/historyRetention: %w", err), ErrSchemaViolation)
+			}
+
+		case IDType:
+			// Only attributes that are new are checked.
+			eid, typeAttr := ra.EntityID, IDType
+			existing, err := db.scan(&eid, &typeAttr)
+			if err != nil {
+				return err
+			}
+			if len(existing) > 0 {
+				continue
+			}
+			if stagedNames == nil {
+				stagedNames = make(map[ID]string, len(tx.stagedIdents))
+				for name, ident := range tx.stagedIdents {
+					stagedNames[ident.ID] = name
+				}
+			}
+			name, ok := stagedNames[eid]
+			if !ok {
+				ident, err := ResolveIdent(tx.conn, eid)
+				if err != nil {
+					// Attributes without idents are not in a namespace.
+					continue
+				}
+				name = ident.Name
+			}
+			if err := db.checkNamespaceRules(name); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// checkNamespaceRules returns an error if a new attribute with the given name
+// breaks the rules of its namespace.
+func (db Database) checkNamespaceRules(attrName string) error {
+	name, local := namespaceOf(attrName)
+	if name == "" {
+		return nil
+	}
+	ident, err := ResolveIdent(db.conn, namespacePrefix+name)
+	switch {
+	case errors.Is(err, ErrNoSuchIdent):
+		return nil
+	case err != nil:
+		return err
+	}
+	ns := Namespace{Name: name}
+	if err := db.loadNamespace(&ns, ident.ID); err != nil {
+		return err
+	}
+	if ns.Deprecated {
+		return errors.Join(
+			fmt.Errorf("attribute %q may not be added to deprecated namespace %q", attrName, name),
+			ErrSchemaViolation,
+		)
+	}
+	if ns.AttributePattern != "" {
+		pattern, err := regexp.Compile(ns.AttributePattern)
+		if err != nil {
+			return fmt.Errorf("compiling db/attributePattern of namespace %q: %w", name, err)
+		}
+		if !pattern.MatchString(local) {
+			return errors.Join(
+				fmt.Errorf("attribute %q does not match pattern %q of namespace %q", attrName, ns.AttributePattern, name),
+				ErrSchemaViolation,
+			)
+		}
+	}
+	return nil
+}
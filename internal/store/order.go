@@ -0,0 +1,285 @@
+/*
+Copyright 2024 Andrew Meredith
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"container/heap"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// SortOrder is the order in which EntitiesBy lists entities.
+type SortOrder int
+
+const (
+	Ascending SortOrder = iota
+	Descending
+)
+
+// EntityPage is a page of entities listed by EntitiesBy.
+type EntityPage struct {
+	// Facts holds the fact of the ordering attribute for each entity on the
+	// page, in order.
+	Facts []Fact
+	// Cursor continues the listing after the last entity on the page. It is
+	// empty if there are no more entities.
+	Cursor string
+}
+
+// EntitiesBy lists the entities that have a value for a cardinality-one
+// attribute, ordered by that value and then by entity ID, so the order is
+// stable even when values repeat. At most limit entities are returned, or
+// every entity if limit is zero. To list the next page, pass the Cursor of
+// the previous page; the first page is listed with an empty cursor. Since
+// cursors hold the position of the last entity listed rather than an offset,
+// entities that are added or removed between pages do not cause others to be
+// skipped or repeated.
+//
+// Values must be strings, numbers, timestamps, or refs. A cursor that was not
+// returned by EntitiesBy for the same attribute fails with ErrInvalidCursor.
+func (db Database) EntitiesBy(attribute any, order SortOrder, cursor string, limit int) (EntityPage, error) {
+	ident, err := ResolveIdent(db.conn, attribute)
+	if err != nil {
+		return EntityPage{}, fmt.Errorf("resolving attribute: %w", err)
+	}
+	cardinality, err := db.cardinalityOf(ident.ID)
+	if err != nil {
+		return EntityPage{}, err
+	}
+	if cardinality != IDCardinalityOne {
+		return EntityPage{}, fmt.Errorf("cannot list entities by %s: only cardinality-one attributes may be ordered", ident.Name)
+	}
+	var after *Fact
+	if cursor != "" {
+		if after, err = decodeEntityCursor(cursor); err != nil {
+			return EntityPage{}, err
+		}
+	}
+
+	// The AVET index is not kept in value order (see NOTE [VALUE-ENCODING] in
+	// the badger package), so every fact of the attribute is read, but only
+	// the facts of the page are kept in order.
+	facts, err := db.scan(nil, &ident.ID)
+	if err != nil {
+		return EntityPage{}, err
+	}
+	if err := checkOrderable(facts, after, ident.Name); err != nil {
+		return EntityPage{}, err
+	}
+	less := func(a, b *Fact) bool {
+		cmp, _ := compareValues(a.Value, b.Value)
+		if cmp == 0 {
+			cmp, _ = compareValues(a.EntityID, b.EntityID)
+		}
+		if order == Descending {
+			return cmp > 0
+		}
+		return cmp < 0
+	}
+
+	var page EntityPage
+	sel := factSelection{less: less, limit: limit}
+	for i := range facts {
+		if after == nil || less(after, &facts[i]) {
+			sel.add(facts[i])
+		}
+	}
+	page.Facts = sel.sorted()
+	if sel.more {
+		if page.Cursor, err = encodeEntityCursor(page.Facts[len(page.Facts)-1]); err != nil {
+			return EntityPage{}, err
+		}
+	}
+	return page, nil
+}
+
+// checkOrderable checks that the values of facts and the cursor can all be
+// compared with one another before they are ordered.
+func checkOrderable(facts []Fact, after *Fact, attrName string) error {
+	for i := range facts {
+		if _, ok := compareValues(facts[i].Value, facts[0].Value); !ok {
+			return fmt.Errorf("cannot order values %#v and %#v of %s", facts[0].Value, facts[i].Value, attrName)
+		}
+	}
+	if after != nil && len(facts) > 0 {
+		if _, ok := compareValues(after.Value, facts[0].Value); !ok {
+			return ErrInvalidCursor
+		}
+	}
+	return nil
+}
+
+// factSelection keeps the first limit facts added to it in the order of
+// less, or every fact if limit is zero. The facts are held in a heap with
+// the last of them on top, so each fact that is added only displaces the
+// last.
+type factSelection struct {
+	facts []Fact
+	less  func(a, b *Fact) bool
+	limit int
+	// more is set once a fact has been displaced.
+	more bool
+}
+
+func (s *factSelection) Len() int           { return len(s.facts) }
+func (s *factSelection) Less(i, j int) bool { return s.less(&s.facts[j], &s.facts[i]) }
+func (s *factSelection) Swap(i, j int)      { s.facts[i], s.facts[j] = s.facts[j], s.facts[i] }
+func (s *factSelection) Push(x any)         { s.facts = append(s.facts, x.(Fact)) }
+
+func (s *factSelection) Pop() any {
+	last := s.facts[len(s.facts)-1]
+	s.facts = s.facts[:len(s.facts)-1]
+	return last
+}
+
+func (s *factSelection) add(fct Fact) {
+	if s.limit <= 0 {
+		s.facts = append(s.facts, fct)
+		return
+	}
+	if len(s.facts) < s.limit {
+		heap.Push(s, fct)
+		return
+	}
+	s.more = true
+	if s.less(&fct, &s.facts[0]) {
+		s.facts[0] = fct
+		heap.Fix(s, 0)
+	}
+}
+
+// sorted returns the selected facts in the order of less.
+func (s *factSelection) sorted() []Fact {
+	sort.Slice(s.facts, func(i, j int) bool {
+		return s.less(&s.facts[i], &s.facts[j])
+	})
+	return s.facts
+}
+
+// EntitiesBy lists entities ordered by an attribute in the latest database.
+// See Database.EntitiesBy.
+func (conn *Connection) EntitiesBy(attribute any, order SortOrder, cursor string, limit int) (EntityPage, error) {
+	return conn.DB().EntitiesBy(attribute, order, cursor, limit)
+}
+
+// entityCursor is the position of the last entity on a page.
+type entityCursor struct {
+	Entity ID              `json:"e"`
+	Type   string          `json:"t"`
+	Value  json.RawMessage `json:"v"`
+}
+
+func encodeEntityCursor(fct Fact) (string, error) {
+	c := entityCursor{Entity: fct.EntityID}
+	val := fct.Value
+	switch v := val.(type) {
+	case string:
+		c.Type = "string"
+	case int64:
+		c.Type = "int64"
+	case int32:
+		c.Type = "int32"
+	case int16:
+		c.Type = "int16"
+	case int8:
+		c.Type = "int8"
+	case float64:
+		c.Type = "float64"
+	case float32:
+		c.Type = "float32"
+	case ID:
+		c.Type = "ref"
+	case time.Time:
+		c.Type = "timestamp"
+		val = v.Format(time.RFC3339Nano)
+	default:
+		return "", fmt.Errorf("cannot order values of type %T", fct.Value)
+	}
+	var err error
+	if c.Value, err = json.Marshal(val); err != nil {
+		return "", err
+	}
+	buf, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+func decodeEntityCursor(cursor string) (*Fact, error) {
+	buf, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	var c entityCursor
+	if err := json.Unmarshal(buf, &c); err != nil {
+		return nil, ErrInvalidCursor
+	}
+
+	decode := func(v any) error {
+		return json.Unmarshal(c.Value, v)
+	}
+	var val Value
+	switch c.Type {
+	case "string":
+		var v string
+		err = decode(&v)
+		val = v
+	case "int64":
+		var v int64
+		err = decode(&v)
+		val = v
+	case "int32":
+		var v int32
+		err = decode(&v)
+		val = v
+	case "int16":
+		var v int16
+		err = decode(&v)
+		val = v
+	case "int8":
+		var v int8
+		err = decode(&v)
+		val = v
+	case "float64":
+		var v float64
+		err = decode(&v)
+		val = v
+	case "float32":
+		var v float32
+		err = decode(&v)
+		val = v
+	case "ref":
+		var v ID
+		err = decode(&v)
+		val = v
+	case "timestamp":
+		var s string
+		if err = decode(&s); err == nil {
+			val, err = time.Parse(time.RFC3339Nano, s)
+		}
+	default:
+		return nil, ErrInvalidCursor
+	}
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	return &Fact{EntityID: c.Entity, Value: val}, nil
+}
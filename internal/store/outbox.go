@@ -0,0 +1,237 @@
+/*
+Copyright 2024 Andrew Meredith
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// OutboxEvent is a message that a transaction emits for delivery to a message
+// broker.
+type OutboxEvent struct {
+	// ID identifies the event. It is the ID of the entity that holds the
+	// event in the outbox, which is assigned when the transaction commits, so
+	// it is ignored when the event is returned by an OutboxFunc. IDs increase
+	// in the order in which events were emitted.
+	ID ID
+	// Tx is the transaction that emitted the event. Like ID, it is assigned
+	// when the transaction commits.
+	Tx      ID
+	Topic   string
+	Key     []byte
+	Payload []byte
+}
+
+// OutboxFunc derives the events that a transaction emits from the facts that
+// it is about to commit. IDs in the facts are resolved, so events may refer to
+// new entities, but the transaction's own ID is only assigned when it is
+// written. If the function returns an error, the transaction fails.
+type OutboxFunc func(data []ResolvedAssertion) ([]OutboxEvent, error)
+
+// appendOutboxEvents appends the facts of the events that a transaction emits
+// to its resolved assertions, so that the events are written atomically with
+// the transaction.
+func (conn *Connection) appendOutboxEvents(resolved []ResolvedAssertion) ([]ResolvedAssertion, error) {
+	events, err := conn.outbox(resolved)
+	if err != nil {
+		return nil, fmt.Errorf("deriving outbox events: %w", err)
+	}
+	if len(events) == 0 {
+		return resolved, nil
+	}
+	for _, evt := range events {
+		if evt.Topic == "" {
+			return nil, errors.New("outbox event has no topic")
+		}
+	}
+
+	var ids []ID
+	err = conn.retryPolicy.Do("allocating IDs", func() (err error) {
+		ids, err = conn.idManager.NextIDs(len(events))
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("allocating IDs for outbox events: %w", err)
+	}
+	for i, evt := range events {
+		if err := guardUserPartition(ids[i]); err != nil {
+			return nil, fmt.Errorf("allocating ID for outbox event: %w", err)
+		}
+		// Empty keys and payloads are omitted rather than stored.
+		facts := map[ID]Value{IDOutboxTopic: evt.Topic}
+		if len(evt.Key) > 0 {
+			facts[IDOutboxKey] = evt.Key
+		}
+		if len(evt.Payload) > 0 {
+			facts[IDOutboxPayload] = evt.Payload
+		}
+		for _, attr := range []ID{IDOutboxTopic, IDOutboxKey, IDOutboxPayload} {
+			val, ok := facts[attr]
+			if !ok {
+				continue
+			}
+			resolved = append(resolved, ResolvedAssertion{
+				Fact: Fact{EntityID: ids[i], Attribute: attr, Value: val},
+				mode: AssertModeAddition,
+			})
+		}
+	}
+	return resolved, nil
+}
+
+// Publisher delivers outbox events to a message broker.
+type Publisher interface {
+	// Publish delivers events in order. It returns only once every event has
+	// been accepted by the broker.
+	Publish(ctx context.Context, events []OutboxEvent) error
+}
+
+// OutboxRelay publishes the events in the outbox and removes them once they
+// have been published.
+//
+// Since an event is only removed after the broker has accepted it, an event
+// may be published again if the relay stops in between. Consumers that
+// discard events whose ID they have already seen therefore observe every
+// event exactly once.
+type OutboxRelay struct {
+	conn      *Connection
+	publisher Publisher
+}
+
+// NewOutboxRelay returns a relay that publishes the events in the outbox of
+// the connection's database. Only one relay should run against a database at
+// a time.
+func (conn *Connection) NewOutboxRelay(publisher Publisher) *OutboxRelay {
+	return &OutboxRelay{conn: conn, publisher: publisher}
+}
+
+// Run publishes pending events, then publishes the events of every subsequent
+// transaction committed through the connection, until ctx is done, an event
+// cannot be published, or the connection is closed, in which case it returns
+// ErrClosed. Writers never wait for the relay, so a slow broker delays the
+// delivery of events but not the transactions that emit them.
+func (r *OutboxRelay) Run(ctx context.Context) error {
+	return r.conn.runAfterCommits(ctx, func([]TxReport, bool) error {
+		_, err := r.RelayPending(ctx)
+		return err
+	})
+}
+
+// maxPendingReports is the number of reports that runAfterCommits collects
+// while fn runs before it discards them.
+const maxPendingReports = 1024
+
+// runAfterCommits calls fn, then calls it again after subsequent transactions
+// are committed through the connection, until ctx is done, fn fails, or the
+// connection is closed, in which case it returns ErrClosed. Transactions that
+// are committed while fn runs are handled by a single further call, which is
+// passed their reports. If complete is false, some reports were discarded
+// because too many transactions were committed meanwhile, and fn must catch up
+// from storage instead; the first call is never complete.
+//
+// Commits only ever add to the reports collected for the next call, so
+// writers never wait for fn.
+func (conn *Connection) runAfterCommits(ctx context.Context, fn func(reports []TxReport, complete bool) error) error {
+	q := conn.txReports.addFeed(maxPendingReports)
+	defer q.remove()
+	var reports []TxReport
+	var complete bool
+	for {
+		if err := fn(reports, complete); err != nil {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-q.done:
+			return ErrClosed
+		case <-q.feed.wake:
+		}
+		reports, complete = q.feed.take()
+	}
+}
+
+// RelayPending publishes every event that is in the outbox, in the order in
+// which they were emitted, and returns the number of events published.
+func (r *OutboxRelay) RelayPending(ctx context.Context) (int, error) {
+	events, err := r.pending()
+	if err != nil || len(events) == 0 {
+		return 0, err
+	}
+	if err := r.publisher.Publish(ctx, events); err != nil {
+		return 0, fmt.Errorf("publishing outbox events: %w", err)
+	}
+
+	tx := r.conn.newTx(false)
+	tx.skipOutbox = true
+	for _, evt := range events {
+		retractions := []Assertable{Retract(evt.ID, IDOutboxTopic, evt.Topic)}
+		if len(evt.Key) > 0 {
+			retractions = append(retractions, Retract(evt.ID, IDOutboxKey, evt.Key))
+		}
+		if len(evt.Payload) > 0 {
+			retractions = append(retractions, Retract(evt.ID, IDOutboxPayload, evt.Payload))
+		}
+		if err := tx.Add(retractions...); err != nil {
+			return 0, fmt.Errorf("removing published events: %w", err)
+		}
+	}
+	if _, err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("removing published events: %w", err)
+	}
+	return len(events), nil
+}
+
+// pending returns the events in the outbox, ordered by ID.
+func (r *OutboxRelay) pending() ([]OutboxEvent, error) {
+	db := r.conn.DB()
+	attr := IDOutboxTopic
+	topics, err := db.scan(nil, &attr)
+	if err != nil {
+		return nil, fmt.Errorf("scanning outbox: %w", err)
+	}
+	if len(topics) == 0 {
+		return nil, nil
+	}
+	ids := make([]ID, len(topics))
+	for i, fct := range topics {
+		ids[i] = fct.EntityID
+	}
+	entities, err := db.GetEntities(ids)
+	if err != nil {
+		return nil, fmt.Errorf("reading outbox events: %w", err)
+	}
+
+	events := make([]OutboxEvent, len(topics))
+	for i, fct := range topics {
+		state := entities[i].state
+		events[i] = OutboxEvent{
+			ID:    fct.EntityID,
+			Tx:    fct.Tx,
+			Topic: fct.Value.(string),
+		}
+		events[i].Key, _ = state[IDOutboxKey].([]byte)
+		events[i].Payload, _ = state[IDOutboxPayload].([]byte)
+	}
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].ID < events[j].ID
+	})
+	return events, nil
+}
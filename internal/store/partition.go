@@ -0,0 +1,90 @@
+/*
+Copyright 2024 Andrew Meredith
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import "fmt"
+
+// A Partition is a numbered range of the user partition of IDs. The high bits
+// of a positive ID hold its partition and the low bits a sequence within the
+// partition, so every entity ID names the partition that it was allocated in
+// and storage can place the entities of different partitions in different
+// indexes. See NOTE [ENTITY-PARTITIONS].
+//
+// Partition 0 holds the transaction entities, the idents, and every entity of
+// a store that does not use partitions. System IDs also belong to partition
+// 0.
+type Partition uint16
+
+// partitionShift is the number of low bits of an ID that hold its sequence
+// within its partition.
+const partitionShift = 47
+
+// MaxPartition is the highest partition.
+const MaxPartition Partition = 1<<(63-partitionShift) - 1
+
+// Partition returns the partition that the ID was allocated in.
+func (id ID) Partition() Partition {
+	if id <= 0 {
+		return 0
+	}
+	return Partition(id >> partitionShift)
+}
+
+// FirstID returns the lowest ID of the partition. For partition 0, which
+// begins at the invalid ID 0, the lowest allocated ID is FirstID() + 1.
+func (p Partition) FirstID() ID {
+	return ID(p) << partitionShift
+}
+
+// LastID returns the highest ID of the partition.
+func (p Partition) LastID() ID {
+	return ID(p)<<partitionShift | (1<<partitionShift - 1)
+}
+
+// NOTE [ENTITY-PARTITIONS]:
+// A transaction that is committed WithPartition allocates its new entities in
+// that partition through a PartitionedIDManager. The transaction entity is
+// always allocated in partition 0, since transaction IDs order commits across
+// the whole store.
+//
+// An Indexer may route the facts of each partition to its own index, so that
+// a dataset may outgrow a single store and the indexes of different
+// partitions may be compacted in parallel. Such an Indexer writes a
+// transaction atomically only if its facts, other than those about the
+// transaction entity, belong to a single index, and it rejects other
+// transactions with ErrCrossPartition. A transaction that creates outbox
+// events or idents must therefore stay in partition 0.
+
+// PartitionedIDManager is implemented by IDManagers that allocate IDs in
+// partitions other than 0.
+type PartitionedIDManager interface {
+	IDManager
+	// NextIDsIn allocates n IDs in partition p.
+	NextIDsIn(p Partition, n int) ([]ID, error)
+}
+
+// guardPartition ensures that an ID allocated by an IDManager belongs to
+// partition p of the user partition.
+func guardPartition(id ID, p Partition) error {
+	if err := guardUserPartition(id); err != nil {
+		return err
+	}
+	if id.Partition() != p {
+		return fmt.Errorf("allocated ID %d is outside of partition %d", id, p)
+	}
+	return nil
+}
@@ -0,0 +1,421 @@
+/*
+Copyright 2024 Andrew Meredith
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package partitioned stores the entities of each partition in a store of its
+// own, so that a dataset may outgrow a single store and the stores of
+// different partitions may be compacted in parallel.
+//
+// An Indexer is both the store.Indexer and the store.IDManager of a
+// connection. It is built from a home store, which holds partition 0, the
+// system entities, and every transaction entity, and from a store for each
+// other partition that it serves. Entities are allocated in a partition by
+// committing transactions store.WithPartition. The home store must also be
+// the connection's IdentManager and BlobStore:
+//
+//	ix, err := partitioned.New(home, map[store.Partition]partitioned.Store{1: one, 2: two})
+//	conn := store.NewConnection(store.Config{
+//		IdentManager: home,
+//		IDManager:    ix,
+//		Indexer:      ix,
+//		BlobStore:    home,
+//	})
+//
+// A read of a single entity is served by the store of the entity's partition.
+// Other reads visit every store in turn, home first, so facts that span
+// partitions are produced in the order of each store rather than in a single
+// order across stores.
+//
+// Each store decodes and checks the facts that it holds by the schema that it
+// holds itself, so the facts that declare the types, uniqueness, and
+// interning of attributes are copied from the home store to every partition
+// store, both as they are written and, in case a copy failed, by New.
+// Attributes must be declared in partition 0.
+//
+// Each transaction is written to a single store, along with the facts of its
+// transaction entity, and transactions that write to the entities of more
+// than one store fail with store.ErrCrossPartition. The facts of the
+// transaction entity of a transaction that is written to a partition's store
+// are then copied to the home store, where they are read from. If the copy
+// fails, the transaction is completed by the next call to New. Uniqueness is
+// enforced by the stores within each partition only; the unique values of
+// other partitions are checked by transactions as they are resolved.
+package partitioned
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+
+	"github.com/kendru/canter/internal/store"
+	"github.com/kendru/canter/pkg/dataflow"
+)
+
+// Store is a store that holds the entities of one or more partitions.
+type Store interface {
+	store.Indexer
+	store.IDManager
+	store.IDReserver
+}
+
+// Indexer routes reads, writes, and ID allocation to the store of each
+// partition. It is safe for concurrent use.
+type Indexer struct {
+	reader
+	home  Store
+	parts map[store.Partition]Store
+
+	// mu is held exclusively by writes and shared by snapshots, so that a
+	// snapshot never observes a transaction in one store but not another.
+	mu sync.RWMutex
+}
+
+var (
+	_ store.Indexer              = (*Indexer)(nil)
+	_ store.PartitionedIDManager = (*Indexer)(nil)
+	_ store.IDReserver           = (*Indexer)(nil)
+)
+
+// New returns an Indexer that keeps partition 0 in home and every other
+// partition in the store that partitions maps it to. The ID sequence of each
+// partition store is advanced into the IDs of its partition, and any
+// transaction whose copy to the home store did not complete is completed.
+// Stores must not be shared between partitions or with other Indexers.
+func New(home Store, partitions map[store.Partition]Store) (*Indexer, error) {
+	ix := &Indexer{
+		home:  home,
+		parts: make(map[store.Partition]Store, len(partitions)),
+	}
+	ix.reader.home = home
+	for p, sto := range partitions {
+		if p == 0 {
+			return nil, errors.New("partition 0 is kept in the home store")
+		}
+		ix.parts[p] = sto
+		ix.reader.parts = append(ix.reader.parts, partReader{p: p, r: sto})
+	}
+	sort.Slice(ix.reader.parts, func(i, j int) bool {
+		return ix.reader.parts[i].p < ix.reader.parts[j].p
+	})
+
+	schema, err := storageSchema(home)
+	if err != nil {
+		return nil, fmt.Errorf("reading schema: %w", err)
+	}
+	for _, part := range ix.reader.parts {
+		err := ix.parts[part.p].ReserveIDs(part.p.FirstID())
+		if err == nil {
+			err = copySchema(schema, ix.parts[part.p])
+		}
+		if err != nil && !errors.Is(err, store.ErrReadOnly) {
+			return nil, fmt.Errorf("initializing partition %d: %w", part.p, err)
+		}
+		if err := ix.recover(part.p); err != nil {
+			return nil, fmt.Errorf("recovering partition %d: %w", part.p, err)
+		}
+	}
+	return ix, nil
+}
+
+// storageAttributes are the attributes of the schema that stores read as they
+// write and decode facts.
+var storageAttributes = []store.ID{store.IDType, store.IDUnique, store.IDInterned}
+
+func isStorageSchema(ra store.ResolvedAssertion) bool {
+	for _, attr := range storageAttributes {
+		if ra.Attribute == attr {
+			return true
+		}
+	}
+	return false
+}
+
+// storageSchema returns the history of the storage attributes in sto, which
+// brings another store's schema up to date when it is written in order.
+func storageSchema(sto Store) ([]store.ResolvedAssertion, error) {
+	ctx := dataflow.NewContext(context.Background())
+	var schema []store.ResolvedAssertion
+	for _, attr := range storageAttributes {
+		scan, err := sto.ScanHistoryAEVT(attr, nil)
+		if err != nil {
+			return nil, err
+		}
+		history, err := dataflow.CollectIntoSlice(ctx, scan)
+		if err != nil {
+			return nil, err
+		}
+		for _, ra := range history {
+			schema = append(schema, *ra)
+		}
+	}
+	return schema, nil
+}
+
+// schemaKey identifies an entry of the history of a storage attribute, whose
+// values are all comparable.
+type schemaKey struct {
+	tx, entity, attribute store.ID
+	value                 store.Value
+	mode                  store.AssertMode
+}
+
+func keyOf(ra store.ResolvedAssertion) schemaKey {
+	return schemaKey{ra.Tx, ra.EntityID, ra.Attribute, ra.Value, ra.Mode()}
+}
+
+// copySchema writes the entries of the schema history of the home store that
+// a partition store does not hold, such as those of a transaction whose copy
+// failed. Entries that it holds already are not written again, since a store
+// adds another entry to the history each time that a fact is written.
+func copySchema(schema []store.ResolvedAssertion, sto Store) error {
+	if len(schema) == 0 {
+		return nil
+	}
+	copied, err := storageSchema(sto)
+	if err != nil {
+		return err
+	}
+	have := make(map[schemaKey]struct{}, len(copied))
+	for _, ra := range copied {
+		have[keyOf(ra)] = struct{}{}
+	}
+	var missing []store.ResolvedAssertion
+	for _, ra := range schema {
+		if _, ok := have[keyOf(ra)]; !ok {
+			missing = append(missing, ra)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	return sto.Write(missing, nil)
+}
+
+// recover copies the facts of the latest transaction entity of partition p
+// to the home store if the home store does not have them. Writes are
+// serialized, so no earlier transaction may be incomplete.
+func (ix *Indexer) recover(p store.Partition) error {
+	var latest store.ID
+	err := ix.parts[p].VisitAEVT(store.IDTxCommitTime, nil, func(fct *store.Fact) error {
+		latest = max(latest, fct.EntityID)
+		return nil
+	})
+	if err != nil || latest == 0 {
+		return err
+	}
+
+	ctx := dataflow.NewContext(context.Background())
+	attr := store.IDTxCommitTime
+	scan, err := ix.home.ScanEAVT(latest, &attr)
+	if err != nil {
+		return err
+	}
+	facts, err := dataflow.CollectIntoSlice(ctx, scan)
+	if err != nil || len(facts) > 0 {
+		return err
+	}
+
+	history, err := ix.parts[p].ScanHistoryEAVT(latest, nil)
+	if err != nil {
+		return err
+	}
+	txFacts, err := dataflow.CollectIntoSlice(ctx, history)
+	if err != nil {
+		return err
+	}
+	assertions := make([]store.ResolvedAssertion, len(txFacts))
+	for i, ra := range txFacts {
+		assertions[i] = *ra
+	}
+	err = ix.home.Write(assertions, nil)
+	if errors.Is(err, store.ErrReadOnly) {
+		return nil
+	}
+	return err
+}
+
+// Write implements store.Indexer.
+func (ix *Indexer) Write(assertions []store.ResolvedAssertion, idents []store.Ident) error {
+	var target store.Partition
+	var data, txFacts, schema []store.ResolvedAssertion
+	for _, ra := range assertions {
+		if isStorageSchema(ra) {
+			if p := ra.EntityID.Partition(); p != 0 {
+				return fmt.Errorf("declaring attribute %d in partition %d: attributes must be declared in partition 0", ra.EntityID, p)
+			}
+			schema = append(schema, ra)
+		}
+		if ra.EntityID == ra.Tx {
+			txFacts = append(txFacts, ra)
+			continue
+		}
+		p := ra.EntityID.Partition()
+		if _, ok := ix.parts[p]; !ok && p != 0 {
+			return fmt.Errorf("writing entity %d: no store for partition %d", ra.EntityID, p)
+		}
+		if len(data) > 0 && p != target {
+			return fmt.Errorf("writing partitions %d and %d: %w", target, p, store.ErrCrossPartition)
+		}
+		target = p
+		data = append(data, ra)
+	}
+
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	if target == 0 {
+		if err := ix.home.Write(assertions, idents); err != nil {
+			return err
+		}
+		if len(schema) == 0 {
+			return nil
+		}
+		for _, part := range ix.reader.parts {
+			if err := ix.parts[part.p].Write(schema, nil); err != nil {
+				return fmt.Errorf("copying schema to partition %d: %w", part.p, err)
+			}
+		}
+		return nil
+	}
+	if len(idents) > 0 {
+		return fmt.Errorf("writing idents in partition %d: %w", target, store.ErrCrossPartition)
+	}
+	if err := ix.parts[target].Write(append(data, txFacts...), nil); err != nil {
+		return err
+	}
+	if len(txFacts) == 0 {
+		return nil
+	}
+	if err := ix.home.Write(txFacts, nil); err != nil {
+		return fmt.Errorf("copying transaction entity to home store: %w", err)
+	}
+	return nil
+}
+
+// Snapshot implements store.Indexer.
+func (ix *Indexer) Snapshot() (store.IndexSnapshot, error) {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+
+	var snap snapshot
+	home, err := ix.home.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+	snap.home = home
+	snap.snaps = append(snap.snaps, home)
+	for _, part := range ix.reader.parts {
+		partSnap, err := ix.parts[part.p].Snapshot()
+		if err != nil {
+			snap.Release()
+			return nil, fmt.Errorf("snapshotting partition %d: %w", part.p, err)
+		}
+		snap.parts = append(snap.parts, partReader{p: part.p, r: partSnap})
+		snap.snaps = append(snap.snaps, partSnap)
+	}
+	return snap, nil
+}
+
+// DeleteHistory implements store.Indexer.
+func (ix *Indexer) DeleteHistory(assertions []store.ResolvedAssertion) error {
+	byStore := make(map[store.Partition][]store.ResolvedAssertion)
+	for _, ra := range assertions {
+		p := ra.EntityID.Partition()
+		if _, ok := ix.parts[p]; !ok {
+			p = 0
+		}
+		byStore[p] = append(byStore[p], ra)
+	}
+	for p, group := range byStore {
+		sto := ix.home
+		if p != 0 {
+			sto = ix.parts[p]
+		}
+		if err := sto.DeleteHistory(group); err != nil {
+			return fmt.Errorf("deleting history of partition %d: %w", p, err)
+		}
+	}
+	return nil
+}
+
+// NextID implements store.IDManager. IDs are allocated in partition 0.
+func (ix *Indexer) NextID() (store.ID, error) {
+	return ix.home.NextID()
+}
+
+// NextIDs implements store.IDManager. IDs are allocated in partition 0.
+func (ix *Indexer) NextIDs(n int) ([]store.ID, error) {
+	return ix.home.NextIDs(n)
+}
+
+// NextIDsIn implements store.PartitionedIDManager.
+func (ix *Indexer) NextIDsIn(p store.Partition, n int) ([]store.ID, error) {
+	if p == 0 {
+		return ix.home.NextIDs(n)
+	}
+	sto, ok := ix.parts[p]
+	if !ok {
+		return nil, fmt.Errorf("no store for partition %d", p)
+	}
+	return sto.NextIDs(n)
+}
+
+// ReserveIDs implements store.IDReserver. Only the IDs of through's partition
+// are reserved.
+func (ix *Indexer) ReserveIDs(through store.ID) error {
+	p := through.Partition()
+	if p == 0 {
+		return ix.home.ReserveIDs(through)
+	}
+	sto, ok := ix.parts[p]
+	if !ok {
+		return fmt.Errorf("no store for partition %d", p)
+	}
+	return sto.ReserveIDs(through)
+}
+
+// Close closes every store that implements io.Closer.
+func (ix *Indexer) Close() error {
+	var errs []error
+	for _, sto := range ix.stores() {
+		if closer, ok := sto.(io.Closer); ok {
+			errs = append(errs, closer.Close())
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// stores returns the home store followed by the store of each partition in
+// order.
+func (ix *Indexer) stores() []Store {
+	stores := []Store{ix.home}
+	for _, part := range ix.reader.parts {
+		stores = append(stores, ix.parts[part.p])
+	}
+	return stores
+}
+
+type snapshot struct {
+	reader
+	snaps []store.IndexSnapshot
+}
+
+func (s snapshot) Release() {
+	for _, snap := range s.snaps {
+		snap.Release()
+	}
+}
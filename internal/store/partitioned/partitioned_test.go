@@ -0,0 +1,243 @@
+/*
+Copyright 2024 Andrew Meredith
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package partitioned_test
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"testing"
+
+	"github.com/kendru/canter/internal/store"
+	badgerImpl "github.com/kendru/canter/internal/store/badger"
+	"github.com/kendru/canter/internal/store/partitioned"
+	"github.com/kendru/canter/pkg/dataflow"
+	"github.com/stretchr/testify/assert"
+)
+
+func openStore(t *testing.T) partitioned.Store {
+	t.Helper()
+	sto, err := badgerImpl.OpenInMemory(badgerImpl.DefaultOptions())
+	if err != nil {
+		t.Fatalf("opening store: %v", err)
+	}
+	t.Cleanup(func() { sto.Close() })
+	return sto
+}
+
+type homeStore interface {
+	partitioned.Store
+	store.IdentManager
+	store.BlobStore
+}
+
+func newConn(t *testing.T, home homeStore, parts map[store.Partition]partitioned.Store) *store.Connection {
+	t.Helper()
+	ix, err := partitioned.New(home, parts)
+	if err != nil {
+		t.Fatalf("creating indexer: %v", err)
+	}
+	conn := store.NewConnection(store.Config{
+		IdentManager: home,
+		IDManager:    ix,
+		Indexer:      ix,
+		BlobStore:    home,
+	})
+	if err := conn.InitializeDB(); err != nil {
+		t.Fatalf("initializing database: %v", err)
+	}
+	return conn
+}
+
+func names(t *testing.T, db store.Database) []string {
+	t.Helper()
+	rows, err := db.Query(store.Query{
+		Find: []store.Var{"?name"},
+		Where: []store.Clause{
+			store.Pattern{Entity: store.Var("?e"), Attribute: "person/name", Value: store.Var("?name")},
+		},
+	})
+	assert.NoError(t, err)
+	var out []string
+	for _, row := range rows {
+		out = append(out, row[0].(string))
+	}
+	sort.Strings(out)
+	return out
+}
+
+func TestPartitionedIndexer(t *testing.T) {
+	home := openStore(t).(homeStore)
+	one, two := openStore(t), openStore(t)
+	conn := newConn(t, home, map[store.Partition]partitioned.Store{1: one, 2: two})
+
+	_, err := conn.Assert(
+		store.EntityData{"db/ident": "person/name", "db/type": "db.type/string"},
+		store.EntityData{"db/ident": "person/email", "db/type": "db.type/string", "db/unique": "db.unique/identity"},
+	)
+	assert.NoError(t, err)
+
+	ada := store.NamedTempID("ada")
+	res, err := conn.Assert(store.EntityData{"db/id": ada, "person/name": "Ada", "person/email": "ada@example.com"})
+	assert.NoError(t, err)
+	adaID := res.Names["ada"]
+	assert.Equal(t, store.Partition(0), adaID.Partition())
+
+	bo := store.NamedTempID("bo")
+	res, err = conn.Assert(store.WithPartition(1), store.EntityData{"db/id": bo, "person/name": "Bo", "person/email": "bo@example.com"})
+	assert.NoError(t, err)
+	boID := res.Names["bo"]
+	assert.Equal(t, store.Partition(1), boID.Partition())
+	assert.Equal(t, store.Partition(0), res.TxID().Partition())
+
+	cy := store.NamedTempID("cy")
+	res, err = conn.Assert(store.WithPartition(2), store.EntityData{"db/id": cy, "person/name": "Cy"})
+	assert.NoError(t, err)
+	cyID := res.Names["cy"]
+	assert.Equal(t, store.Partition(2), cyID.Partition())
+
+	// Reads of single entities are routed to their partitions, and other
+	// reads visit every partition.
+	db := conn.DB()
+	ent, err := db.GetEntity(boID)
+	assert.NoError(t, err)
+	name, err := ent.Get(conn, "person/name")
+	assert.NoError(t, err)
+	assert.Equal(t, "Bo", name)
+	assert.Equal(t, []string{"Ada", "Bo", "Cy"}, names(t, db))
+	found, err := db.GetEntity(store.NewLookup("person/email", "bo@example.com"))
+	assert.NoError(t, err)
+	assert.Equal(t, boID, found.ID())
+
+	// Transaction entities are only read from the home store, and the facts
+	// of every transaction are found where they were written.
+	txs, err := db.AttributeFacts("db.tx/commitTime")
+	assert.NoError(t, err)
+	seen := make(map[store.ID]bool)
+	for _, fct := range txs {
+		assert.False(t, seen[fct.EntityID], "transaction %d read twice", fct.EntityID)
+		seen[fct.EntityID] = true
+	}
+	verification, err := db.VerifyTxLog()
+	assert.NoError(t, err)
+	assert.Empty(t, verification.Failed)
+	assert.Equal(t, len(txs), verification.Verified)
+
+	// A unique value in one partition is visible to transactions in another.
+	_, err = conn.Assert(store.WithPartition(2), store.EntityData{"person/email": "bo@example.com", "person/name": "Robert"})
+	assert.NoError(t, err)
+	ent, err = conn.DB().GetEntity(boID)
+	assert.NoError(t, err)
+	name, err = ent.Get(conn, "person/name")
+	assert.NoError(t, err)
+	assert.Equal(t, "Robert", name)
+
+	// Transactions may not write to several partitions.
+	_, err = conn.Assert(
+		store.EntityData{"db/id": adaID, "person/name": "Ada L."},
+		store.EntityData{"db/id": cyID, "person/name": "Cy D."},
+	)
+	assert.ErrorIs(t, err, store.ErrCrossPartition)
+	assert.Equal(t, []string{"Ada", "Cy", "Robert"}, names(t, conn.DB()))
+
+	// A full scan produces the facts of every partition. Building the
+	// indexer again copies no schema that the partitions already hold.
+	ix, err := partitioned.New(home, map[store.Partition]partitioned.Store{1: one, 2: two})
+	assert.NoError(t, err)
+	typeHistory := func(sto partitioned.Store) int {
+		scan, err := sto.ScanHistoryAEVT(store.IDType, nil)
+		assert.NoError(t, err)
+		history, err := dataflow.CollectIntoSlice(dataflow.NewContext(context.Background()), scan)
+		assert.NoError(t, err)
+		return len(history)
+	}
+	assert.Equal(t, typeHistory(home), typeHistory(one))
+	assert.Equal(t, typeHistory(home), typeHistory(two))
+	three := openStore(t)
+	_, err = partitioned.New(home, map[store.Partition]partitioned.Store{3: three})
+	assert.NoError(t, err)
+	assert.Equal(t, typeHistory(home), typeHistory(three))
+	scans, err := ix.ScanEAVTPartitions(3)
+	assert.NoError(t, err)
+	entities := make(map[store.ID]bool)
+	commits := 0
+	for _, scan := range scans {
+		facts, err := dataflow.CollectIntoSlice(dataflow.NewContext(context.Background()), scan)
+		assert.NoError(t, err)
+		for _, fct := range facts {
+			entities[fct.EntityID] = true
+			if fct.Attribute == store.IDTxCommitTime {
+				commits++
+			}
+		}
+	}
+	assert.True(t, entities[adaID] && entities[boID] && entities[cyID])
+	assert.Equal(t, len(txs)+1, commits)
+}
+
+func TestPartitionedIndexerUnknownPartition(t *testing.T) {
+	home := openStore(t).(homeStore)
+	conn := newConn(t, home, map[store.Partition]partitioned.Store{1: openStore(t)})
+	_, err := conn.Assert(store.WithPartition(3), store.EntityData{"db/doc": "orphan"})
+	assert.Error(t, err)
+}
+
+// failingHome fails writes to the home store while fail is set.
+type failingHome struct {
+	homeStore
+	fail bool
+}
+
+func (h *failingHome) Write(assertions []store.ResolvedAssertion, idents []store.Ident) error {
+	if h.fail {
+		return errors.New("home store unavailable")
+	}
+	return h.homeStore.Write(assertions, idents)
+}
+
+func TestPartitionedIndexerRecovery(t *testing.T) {
+	home := &failingHome{homeStore: openStore(t).(homeStore)}
+	one := openStore(t)
+	conn := newConn(t, home, map[store.Partition]partitioned.Store{1: one})
+
+	home.fail = true
+	_, err := conn.Assert(store.WithPartition(1), store.EntityData{"db/doc": "torn"})
+	assert.Error(t, err)
+	home.fail = false
+
+	var tx store.ID
+	err = one.VisitAEVT(store.IDTxCommitTime, nil, func(fct *store.Fact) error {
+		tx = fct.EntityID
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.NotZero(t, tx)
+	commitTime := store.IDTxCommitTime
+	countHome := func() int {
+		n := 0
+		assert.NoError(t, home.VisitEAVT(tx, &commitTime, func(*store.Fact) error {
+			n++
+			return nil
+		}))
+		return n
+	}
+	assert.Equal(t, 0, countHome())
+
+	_, err = partitioned.New(home, map[store.Partition]partitioned.Store{1: one})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, countHome())
+}
@@ -0,0 +1,228 @@
+/*
+Copyright 2024 Andrew Meredith
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package partitioned
+
+import (
+	"github.com/kendru/canter/internal/store"
+	"github.com/kendru/canter/pkg/dataflow"
+)
+
+// reader reads from the home store and the store of each partition, either
+// at their latest state or as of a snapshot.
+type reader struct {
+	home store.IndexReader
+	// parts is ordered by partition.
+	parts []partReader
+}
+
+// partReader reads from the store of partition p. The store also holds copies
+// of the facts of the transaction entities of its transactions, which are
+// read from the home store instead, so only the facts of the entities of p
+// are read from it.
+type partReader struct {
+	p store.Partition
+	r store.IndexReader
+}
+
+func (pr partReader) owns(eid store.ID) bool {
+	return eid.Partition() == pr.p
+}
+
+// entity returns the reader of the store that holds eid.
+func (r reader) entity(eid store.ID) store.IndexReader {
+	p := eid.Partition()
+	for _, part := range r.parts {
+		if part.p == p {
+			return part.r
+		}
+	}
+	return r.home
+}
+
+// scanAll scans every store with scan and produces the facts of each in turn.
+func scanAll[T any](r reader, entity func(*T) store.ID, scan func(store.IndexReader) (dataflow.Producer[T], error)) (dataflow.Producer[T], error) {
+	home, err := scan(r.home)
+	if err != nil {
+		return nil, err
+	}
+	producers := concat[T]{home}
+	for _, part := range r.parts {
+		p, err := scan(part.r)
+		if err != nil {
+			return nil, err
+		}
+		producers = append(producers, owned[T]{scan: p, part: part, entity: entity})
+	}
+	return producers, nil
+}
+
+func factEntity(fct *store.Fact) store.ID { return fct.EntityID }
+
+func assertionEntity(ra *store.ResolvedAssertion) store.ID { return ra.EntityID }
+
+// visitAll visits every store with visit, skipping the facts that a partition
+// store does not own.
+func (r reader) visitAll(visit store.FactVisitor, scan func(store.IndexReader, store.FactVisitor) error) error {
+	if err := scan(r.home, visit); err != nil {
+		return err
+	}
+	for _, part := range r.parts {
+		err := scan(part.r, func(fct *store.Fact) error {
+			if !part.owns(fct.EntityID) {
+				return nil
+			}
+			return visit(fct)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r reader) ScanEAVT(entityID store.ID, attribute *store.ID) (dataflow.Producer[store.Fact], error) {
+	return r.entity(entityID).ScanEAVT(entityID, attribute)
+}
+
+func (r reader) ScanAEVT(attribute store.ID, entityID *store.ID) (dataflow.Producer[store.Fact], error) {
+	if entityID != nil {
+		return r.entity(*entityID).ScanAEVT(attribute, entityID)
+	}
+	return scanAll(r, factEntity, func(ir store.IndexReader) (dataflow.Producer[store.Fact], error) {
+		return ir.ScanAEVT(attribute, nil)
+	})
+}
+
+func (r reader) ScanAEVTWhere(attribute store.ID, pred store.ValuePredicate) (dataflow.Producer[store.Fact], error) {
+	return scanAll(r, factEntity, func(ir store.IndexReader) (dataflow.Producer[store.Fact], error) {
+		return ir.ScanAEVTWhere(attribute, pred)
+	})
+}
+
+func (r reader) ScanAVET(attribute store.ID, val store.Value) (dataflow.Producer[store.Fact], error) {
+	return scanAll(r, factEntity, func(ir store.IndexReader) (dataflow.Producer[store.Fact], error) {
+		return ir.ScanAVET(attribute, val)
+	})
+}
+
+func (r reader) ScanAVETValues(attribute store.ID, vals []store.Value) (dataflow.Producer[store.Fact], error) {
+	return scanAll(r, factEntity, func(ir store.IndexReader) (dataflow.Producer[store.Fact], error) {
+		return ir.ScanAVETValues(attribute, vals)
+	})
+}
+
+func (r reader) ScanVAET(val store.Value, attribute *store.ID) (dataflow.Producer[store.Fact], error) {
+	return scanAll(r, factEntity, func(ir store.IndexReader) (dataflow.Producer[store.Fact], error) {
+		return ir.ScanVAET(val, attribute)
+	})
+}
+
+// ScanEAVTPartitions splits each store into n partitions and joins them into n
+// partitions of consecutive ranges.
+func (r reader) ScanEAVTPartitions(n int) ([]dataflow.Producer[store.Fact], error) {
+	home, err := r.home.ScanEAVTPartitions(n)
+	if err != nil {
+		return nil, err
+	}
+	all := home
+	for _, part := range r.parts {
+		scans, err := part.r.ScanEAVTPartitions(n)
+		if err != nil {
+			return nil, err
+		}
+		for _, scan := range scans {
+			all = append(all, owned[store.Fact]{scan: scan, part: part, entity: factEntity})
+		}
+	}
+	stores := 1 + len(r.parts)
+	producers := make([]dataflow.Producer[store.Fact], n)
+	for i := range producers {
+		producers[i] = concat[store.Fact](all[i*stores : (i+1)*stores])
+	}
+	return producers, nil
+}
+
+func (r reader) VisitEAVT(entityID store.ID, attribute *store.ID, visit store.FactVisitor) error {
+	return r.entity(entityID).VisitEAVT(entityID, attribute, visit)
+}
+
+func (r reader) VisitAEVT(attribute store.ID, entityID *store.ID, visit store.FactVisitor) error {
+	if entityID != nil {
+		return r.entity(*entityID).VisitAEVT(attribute, entityID, visit)
+	}
+	return r.visitAll(visit, func(ir store.IndexReader, visit store.FactVisitor) error {
+		return ir.VisitAEVT(attribute, nil, visit)
+	})
+}
+
+func (r reader) VisitAEVTWhere(attribute store.ID, pred store.ValuePredicate, visit store.FactVisitor) error {
+	return r.visitAll(visit, func(ir store.IndexReader, visit store.FactVisitor) error {
+		return ir.VisitAEVTWhere(attribute, pred, visit)
+	})
+}
+
+func (r reader) VisitAVETValues(attribute store.ID, vals []store.Value, visit store.FactVisitor) error {
+	return r.visitAll(visit, func(ir store.IndexReader, visit store.FactVisitor) error {
+		return ir.VisitAVETValues(attribute, vals, visit)
+	})
+}
+
+func (r reader) ScanHistoryEAVT(entityID store.ID, attribute *store.ID) (dataflow.Producer[store.ResolvedAssertion], error) {
+	return r.entity(entityID).ScanHistoryEAVT(entityID, attribute)
+}
+
+func (r reader) ScanHistoryAEVT(attribute store.ID, entityID *store.ID) (dataflow.Producer[store.ResolvedAssertion], error) {
+	if entityID != nil {
+		return r.entity(*entityID).ScanHistoryAEVT(attribute, entityID)
+	}
+	return scanAll(r, assertionEntity, func(ir store.IndexReader) (dataflow.Producer[store.ResolvedAssertion], error) {
+		return ir.ScanHistoryAEVT(attribute, nil)
+	})
+}
+
+// concat produces the items of each of its producers in turn.
+type concat[T any] []dataflow.Producer[T]
+
+func (c concat[T]) Produce(ctx dataflow.DataflowCtx, next dataflow.ConsumeFn[T]) error {
+	forward := func(ctx dataflow.DataflowCtx, item *T) error {
+		if item == nil {
+			return nil
+		}
+		return next(ctx, item)
+	}
+	for _, p := range c {
+		if err := p.Produce(ctx, forward); err != nil {
+			return err
+		}
+	}
+	return next(ctx, nil)
+}
+
+// owned produces the items of a partition store's scan that are about the
+// entities of the partition.
+type owned[T any] struct {
+	scan   dataflow.Producer[T]
+	part   partReader
+	entity func(*T) store.ID
+}
+
+func (o owned[T]) Produce(ctx dataflow.DataflowCtx, next dataflow.ConsumeFn[T]) error {
+	filter := dataflow.NewFilter(func(item *T) bool {
+		return o.part.owns(o.entity(item))
+	}, next)
+	return o.scan.Produce(ctx, filter.Consume)
+}
@@ -0,0 +1,131 @@
+/*
+Copyright 2024 Andrew Meredith
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+// DefaultPeerEntityCacheSize is the number of entities that a peer caches when
+// PeerConfig.EntityCacheSize is zero.
+const DefaultPeerEntityCacheSize = 1024
+
+// PeerConfig configures a peer connection.
+type PeerConfig struct {
+	// EntityCacheSize is the number of recently read entities that the peer
+	// caches. If zero, DefaultPeerEntityCacheSize is used. If negative,
+	// entities are not cached.
+	EntityCacheSize int
+	// IdentCacheSize bounds the peer's ident cache like
+	// Config.IdentCacheSize. If zero, the bound of the transactor's ident
+	// cache is used.
+	IdentCacheSize int
+	// TxReportQueueSize is the size of the queue through which the peer
+	// follows the transactor. If zero, it defaults to 64.
+	TxReportQueueSize int
+}
+
+// NewPeer returns a peer of conn. A peer reads from the same storage as conn
+// but keeps its own ident, schema, and entity caches, so that reads are served
+// locally where possible. Transactions committed through the peer are resolved
+// by the peer and forwarded to conn, which acts as the transactor.
+//
+// The peer follows every transaction committed through the transactor,
+// including those of other peers, evicting stale cache entries and advancing
+// its basis as they arrive. Transactions committed through the peer itself
+// are visible to it as soon as they are committed. Tx reports and
+// subscriptions on the peer observe every transaction that the transactor
+// commits.
+//
+// The returned function stops the peer from following the transactor. The
+// peer must not be used after it is stopped. Closing the peer also stops it,
+// but leaves the storage that it shares with the transactor open.
+func (conn *Connection) NewPeer(cfg PeerConfig) (*Connection, func()) {
+	cacheSize := cfg.EntityCacheSize
+	if cacheSize == 0 {
+		cacheSize = DefaultPeerEntityCacheSize
+	}
+	identCacheSize := cfg.IdentCacheSize
+	if identCacheSize == 0 {
+		identCacheSize = conn.identCache.size
+	}
+	queueSize := cfg.TxReportQueueSize
+	if queueSize == 0 {
+		queueSize = 64
+	}
+
+	peer := &Connection{
+		identCache:        newIdentCache(identCacheSize),
+		identManager:      conn.identManager,
+		schemaEntityCache: make(map[ID]Entity),
+		entityCache:       newEntityCache(cacheSize, conn.memory),
+		memory:            conn.memory,
+		attrStats:         newAttrStatsRegistry(),
+		idManager:         conn.idManager,
+		indexer:           conn.indexer,
+		blobStore:         conn.blobStore,
+		maxTxFacts:        conn.maxTxFacts,
+		retryPolicy:       conn.retryPolicy,
+		readOnly:          conn.readOnly,
+		typeRegistry:      conn.typeRegistry,
+		commitClock:       conn.commitClock,
+		idSource:          conn.idSource,
+		outbox:            conn.outbox,
+		beforeCommit:      conn.beforeCommit,
+		functions:         conn.functions,
+		computed:          conn.computed,
+		slowLog:           newSlowLog(conn.slowLog.cfg),
+		admission:         conn.admission,
+		admissionKey:      conn.admissionKey,
+		inferSchema:       conn.inferSchema,
+		transactor:        conn,
+	}
+	peer.advanceBasis(ID(conn.basis.Load()))
+	peer.goBackground(func() { hydrateIdentCache(peer.identCache, peer.identManager) })
+
+	reports, stop := conn.TxReportQueue(queueSize)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for report := range reports {
+			peer.observeTx(report.TxData, nil)
+			report.DBAfter = peer.DB().AsOf(report.Tx)
+			peer.txReports.publish(report)
+		}
+	}()
+
+	stopFollowing := func() {
+		stop()
+		<-done
+	}
+	peer.lifecycle.onCloseFunc(stopFollowing)
+	return peer, stopFollowing
+}
+
+// forward commits a transaction that was resolved by a peer through the peer's
+// transactor.
+func (conn *Connection) forward(assertions []ResolvedAssertion, newIdents []Ident, resolvedIDs TempIDs, preconditions []precondition) (*AssertResult, error) {
+	res, err := conn.transactor.assert(assertions, newIdents, resolvedIDs, preconditions...)
+	if err != nil {
+		return nil, err
+	}
+	// The transaction will also arrive through the tx report queue, but it is
+	// observed here so that it is visible to the peer when Assert returns.
+	conn.observeTx(res.Data, newIdents)
+
+	return &AssertResult{
+		DB:      conn.DB(),
+		Data:    res.Data,
+		TempIDs: resolvedIDs,
+	}, nil
+}
@@ -0,0 +1,55 @@
+/*
+Copyright 2024 Andrew Meredith
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import "sync"
+
+// slicePool reuses the backing arrays of slices that are allocated and
+// discarded by every transaction, such as the buffers of a TxBuilder. Slices
+// that escape a transaction, like the ResolvedAssertions of an AssertResult,
+// must never be pooled.
+type slicePool[T any] struct {
+	pool sync.Pool
+	// maxCap is the capacity above which a slice is not returned to the
+	// pool, so that one large transaction does not pin a large array.
+	maxCap int
+}
+
+// get returns an empty slice with at least the given capacity.
+func (p *slicePool[T]) get(capacity int) []T {
+	if s, ok := p.pool.Get().(*[]T); ok && cap(*s) >= capacity {
+		return (*s)[:0]
+	}
+	return make([]T, 0, capacity)
+}
+
+// put returns a slice to the pool. Its elements are cleared so that the pool
+// does not keep the values that they reference alive.
+func (p *slicePool[T]) put(s []T) {
+	if s == nil || cap(s) > p.maxCap {
+		return
+	}
+	s = s[:cap(s)]
+	clear(s)
+	s = s[:0]
+	p.pool.Put(&s)
+}
+
+var (
+	assertionPool = &slicePool[Assertion]{maxCap: 4 * txChunkSize}
+	identPool     = &slicePool[Ident]{maxCap: 4 * txChunkSize}
+)
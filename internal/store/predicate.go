@@ -0,0 +1,102 @@
+/*
+Copyright 2024 Andrew Meredith
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"bytes"
+	"strings"
+
+	"github.com/kendru/canter/pkg/dataflow"
+)
+
+// ValuePredicate is a condition on the value of a fact. Predicates may be
+// passed to IndexReader.ScanAEVTWhere so that an index implementation can
+// skip non-matching facts as it iterates instead of producing every fact of
+// an attribute.
+type ValuePredicate interface {
+	// MatchValue reports whether val satisfies the predicate.
+	MatchValue(val Value) bool
+}
+
+// ValueRange matches ordered values (see AttrStats) between Min and Max. A nil
+// bound leaves that end of the range open. Bounds are inclusive unless
+// MinExclusive or MaxExclusive is set. Values of a different type than the
+// bounds never match.
+type ValueRange struct {
+	Min, Max                   Value
+	MinExclusive, MaxExclusive bool
+}
+
+func (r ValueRange) MatchValue(val Value) bool {
+	if r.Min != nil {
+		cmp, ok := compareValues(val, r.Min)
+		if !ok || cmp < 0 || (cmp == 0 && r.MinExclusive) {
+			return false
+		}
+	}
+	if r.Max != nil {
+		cmp, ok := compareValues(val, r.Max)
+		if !ok || cmp > 0 || (cmp == 0 && r.MaxExclusive) {
+			return false
+		}
+	}
+	if r.Min == nil && r.Max == nil {
+		_, ok := compareValues(val, val)
+		return ok
+	}
+	return true
+}
+
+// ValuePrefix matches string and binary values that begin with the prefix.
+type ValuePrefix string
+
+func (p ValuePrefix) MatchValue(val Value) bool {
+	switch v := val.(type) {
+	case string:
+		return strings.HasPrefix(v, string(p))
+	case []byte:
+		return bytes.HasPrefix(v, []byte(p))
+	default:
+		return false
+	}
+}
+
+// ValueIn matches values that are equal to any of its elements.
+type ValueIn []Value
+
+func (in ValueIn) MatchValue(val Value) bool {
+	return containsValue(in, val)
+}
+
+// FilterFacts returns a producer of the facts produced by scan whose values
+// match pred. IndexReaders that cannot evaluate predicates while iterating
+// over their indexes can implement ScanAEVTWhere by filtering ScanAEVT.
+func FilterFacts(scan dataflow.Producer[Fact], pred ValuePredicate) dataflow.Producer[Fact] {
+	return filteredScan{scan: scan, pred: pred}
+}
+
+type filteredScan struct {
+	scan dataflow.Producer[Fact]
+	pred ValuePredicate
+}
+
+func (f filteredScan) Produce(ctx dataflow.DataflowCtx, next dataflow.ConsumeFn[Fact]) error {
+	filter := dataflow.NewFilter(func(fct *Fact) bool {
+		return f.pred.MatchValue(fct.Value)
+	}, next)
+	return f.scan.Produce(ctx, filter.Consume)
+}
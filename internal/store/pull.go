@@ -0,0 +1,251 @@
+/*
+Copyright 2024 Andrew Meredith
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import "fmt"
+
+// PullAttr selects an attribute to include in the result of a pull.
+type PullAttr struct {
+	// Attribute is the attribute to pull. It may be an ident name or an ID.
+	Attribute any
+	// As is the key under which the value is returned. If empty, the
+	// attribute's canonical ident name is used.
+	As string
+	// Default is returned when the entity has no value for the attribute. If
+	// nil, the key is omitted from the result instead.
+	Default Value
+	// Pull, if set, pulls the entities that a ref attribute refers to with
+	// the given pattern, so that the attribute's value is the EntityData of
+	// the referenced entity, or a []Value of EntityData for a
+	// cardinality-many attribute, rather than IDs.
+	Pull []PullAttr
+}
+
+// pullPattern is a pull pattern whose attributes have been resolved.
+type pullPattern struct {
+	attrs  []PullAttr
+	idents []Ident
+	// computed holds the computed attributes of the pattern by position.
+	computed map[int]ComputedAttribute
+}
+
+func resolvePullPattern(conn *Connection, pattern []PullAttr) (pullPattern, error) {
+	p := pullPattern{attrs: pattern, idents: make([]Ident, len(pattern))}
+	// Computed attributes are not idents, so they are resolved separately.
+	var attrs []any
+	for i, attr := range pattern {
+		if name, ok := attr.Attribute.(string); ok {
+			if c, ok := conn.computed.lookup(name); ok {
+				if p.computed == nil {
+					p.computed = make(map[int]ComputedAttribute)
+				}
+				p.computed[i] = c
+				p.idents[i] = Ident{Name: name}
+				continue
+			}
+		}
+		attrs = append(attrs, attr.Attribute)
+	}
+	resolved, err := conn.ResolveIdents(attrs)
+	if err != nil {
+		return p, fmt.Errorf("resolving attribute idents: %w", err)
+	}
+	for i := range pattern {
+		if _, ok := p.computed[i]; !ok {
+			p.idents[i], resolved = resolved[0], resolved[1:]
+		}
+	}
+	return p, nil
+}
+
+// Pull returns the data for the attributes selected by the pattern. Unlike
+// GetData, only the selected attributes are returned, keyed by their As name.
+// The pattern may select computed attributes by name, whose values are
+// returned as ComputedValues. Entities selected by nested patterns are read
+// from the latest state of the database.
+func (e Entity) Pull(conn *Connection, pattern ...PullAttr) (EntityData, error) {
+	db := conn.DB()
+	out, err := db.pullEntities(db.NewEntityLoader(), []Entity{e}, pattern)
+	if err != nil {
+		return nil, err
+	}
+	return out[0], nil
+}
+
+// Pull fetches the entity identified by idResolver and pulls the attributes
+// selected by the pattern.
+func (db Database) Pull(idResolver Resolver, pattern ...PullAttr) (EntityData, error) {
+	ent, err := db.GetEntity(idResolver)
+	if err != nil {
+		return nil, err
+	}
+	out, err := db.pullEntities(db.NewEntityLoader(), []Entity{ent}, pattern)
+	if err != nil {
+		return nil, err
+	}
+	return out[0], nil
+}
+
+// PullMany pulls the attributes selected by the pattern from several
+// entities, such as the entities found by a query, and returns their data in
+// the same order as ids. The entities are read in a single batch, as are the
+// entities referred to at each level of nested patterns, so pulling a graph
+// of entities takes one batch of reads per level rather than one read per
+// entity.
+func (db Database) PullMany(ids []ID, pattern ...PullAttr) ([]EntityData, error) {
+	return db.NewEntityLoader().PullMany(ids, pattern...)
+}
+
+// PullMany is like Database.PullMany, but it reads entities through the
+// loader, so entities that the loader has already read are not read again.
+func (l *EntityLoader) PullMany(ids []ID, pattern ...PullAttr) ([]EntityData, error) {
+	ents, err := l.LoadMany(ids)
+	if err != nil {
+		return nil, err
+	}
+	return l.db.pullEntities(l, ents, pattern)
+}
+
+// pullEntities pulls the pattern from each entity. The entities referred to by
+// each nested pattern are loaded through loader together, before any of them
+// are pulled.
+func (db Database) pullEntities(loader *EntityLoader, ents []Entity, pattern []PullAttr) ([]EntityData, error) {
+	conn := db.conn
+	p, err := resolvePullPattern(conn, pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]EntityData, len(ents))
+	for i, e := range ents {
+		if out[i], err = e.pull(conn, p); err != nil {
+			return nil, err
+		}
+	}
+
+	// Schedule every referenced entity of every nested pattern, so that they
+	// are read in one batch, then pull them.
+	refs := make(map[int][]ID)
+	for i, attr := range pattern {
+		if _, ok := p.computed[i]; attr.Pull == nil || ok {
+			continue
+		}
+		seen := make(map[ID]bool)
+		for _, e := range ents {
+			for _, id := range refIDs(e.state[p.idents[i].ID]) {
+				if !seen[id] {
+					seen[id] = true
+					refs[i] = append(refs[i], id)
+					loader.Load(id)
+				}
+			}
+		}
+	}
+	for i, ids := range refs {
+		nested, err := loader.LoadMany(ids)
+		if err != nil {
+			return nil, err
+		}
+		data, err := db.pullEntities(loader, nested, pattern[i].Pull)
+		if err != nil {
+			return nil, err
+		}
+		byID := make(map[ID]EntityData, len(ids))
+		for j, id := range ids {
+			byID[id] = data[j]
+		}
+		key := pattern[i].As
+		if key == "" {
+			key = p.idents[i].Name
+		}
+		for j, e := range ents {
+			switch val := e.state[p.idents[i].ID].(type) {
+			case ID:
+				out[j][key] = byID[val]
+			case []Value:
+				vals := make([]Value, len(val))
+				for k, v := range val {
+					vals[k] = byID[v.(ID)]
+				}
+				out[j][key] = vals
+			}
+		}
+	}
+	return out, nil
+}
+
+// refIDs returns the IDs that the value of a ref attribute refers to.
+func refIDs(val Value) []ID {
+	switch v := val.(type) {
+	case ID:
+		return []ID{v}
+	case []Value:
+		ids := make([]ID, 0, len(v))
+		for _, elem := range v {
+			if id, ok := elem.(ID); ok {
+				ids = append(ids, id)
+			}
+		}
+		return ids
+	}
+	return nil
+}
+
+// pull returns the data of the entity for a resolved pattern. The values of
+// ref attributes with nested patterns are left as IDs.
+func (e Entity) pull(conn *Connection, p pullPattern) (EntityData, error) {
+	var stored EntityData
+	if len(p.computed) > 0 {
+		var err error
+		if stored, err = e.storedData(conn); err != nil {
+			return nil, err
+		}
+	}
+
+	data := make(EntityData, len(p.attrs))
+	for i, attr := range p.attrs {
+		key := attr.As
+		if key == "" {
+			key = p.idents[i].Name
+		}
+		if _, ok := data[key]; ok {
+			return nil, fmt.Errorf("pull pattern selects more than one value for key %q", key)
+		}
+
+		var val Value
+		var ok bool
+		if c, isComputed := p.computed[i]; isComputed {
+			var err error
+			if val, ok, err = conn.computed.compute(p.idents[i].Name, c, stored); err != nil {
+				return nil, err
+			}
+			if ok {
+				val = ComputedValue{Value: val}
+			}
+		} else {
+			val, ok = e.state[p.idents[i].ID]
+		}
+		switch {
+		case ok:
+			data[key] = val
+		case attr.Default != nil:
+			data[key] = attr.Default
+		}
+	}
+
+	return data, nil
+}
@@ -0,0 +1,833 @@
+/*
+Copyright 2024 Andrew Meredith
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/kendru/canter/pkg/rtype"
+)
+
+// DefaultSource is the name of the database that a Pattern is matched against
+// when it does not specify a Source.
+const DefaultSource = "$"
+
+// Var is a logic variable in a query. By convention, variable names begin with
+// a question mark, e.g. "?e".
+type Var string
+
+func (v Var) String() string {
+	return string(v)
+}
+
+// Clause is a single constraint in the Where section of a query.
+type Clause interface {
+	// vars returns the variables that the clause refers to.
+	vars() []Var
+}
+
+// Pattern is a clause that matches facts in a database. Each of Entity,
+// Attribute, and Value may either be a Var or a constant. A constant entity
+// may be anything that can be resolved to an ID, and a constant attribute may
+// be an ident name, Ident, or ID.
+type Pattern struct {
+	// Source names the database that the pattern is matched against. It must
+	// be one of the names listed in the query's In section. If empty, the
+	// DefaultSource is used.
+	Source    string
+	Entity    any
+	Attribute any
+	Value     any
+	// Filter, if set, restricts the pattern to facts whose values match it.
+	// The bounds of a ValueRange and the elements of a ValueIn are resolved
+	// like a constant Value, so refs may be given by ident. When the pattern
+	// is evaluated with only its attribute bound, the filter is evaluated by
+	// the index.
+	Filter ValuePredicate
+}
+
+func (p Pattern) vars() []Var {
+	var out []Var
+	for _, term := range []any{p.Entity, p.Attribute, p.Value} {
+		if v, ok := term.(Var); ok {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+func (p Pattern) source() string {
+	if p.Source == "" {
+		return DefaultSource
+	}
+	return p.Source
+}
+
+// Group is a clause that evaluates its clauses against a single source:
+// patterns in the group that do not name a source are matched against the
+// group's Source rather than the DefaultSource. Groups make it convenient to
+// join clauses against several databases, e.g. two time slices of one
+// database or the databases of two connections. Since entity and attribute
+// IDs are only meaningful within the database that assigned them, clauses
+// against the databases of different connections should be joined on values
+// rather than on entities.
+type Group struct {
+	Source  string
+	Clauses []Clause
+}
+
+func (g Group) vars() []Var {
+	var out []Var
+	for _, c := range g.Clauses {
+		out = append(out, c.vars()...)
+	}
+	return out
+}
+
+// flattenClauses replaces groups with their clauses, giving the group's
+// source to patterns that do not name one.
+func flattenClauses(clauses []Clause, source string) []Clause {
+	out := make([]Clause, 0, len(clauses))
+	for _, c := range clauses {
+		switch c := c.(type) {
+		case Group:
+			inner := c.Source
+			if inner == "" {
+				inner = source
+			}
+			out = append(out, flattenClauses(c.Clauses, inner)...)
+		case Pattern:
+			if c.Source == "" {
+				c.Source = source
+			}
+			out = append(out, c)
+		default:
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+// Predicate is a clause that calls a function registered with the
+// connection (see FunctionRegistry) and keeps only the bindings for which it
+// returns true. Each of Args may either be a Var or a constant, and every Var
+// must be bound by another clause.
+type Predicate struct {
+	Fn   string
+	Args []any
+}
+
+func (p Predicate) vars() []Var {
+	return argVars(p.Args)
+}
+
+// Call is a clause that calls a function registered with the connection and
+// binds its result to Bind. If Bind is already bound, the clause keeps only
+// the bindings for which the result is equal to it.
+type Call struct {
+	Fn   string
+	Args []any
+	Bind Var
+}
+
+func (c Call) vars() []Var {
+	return append(argVars(c.Args), c.Bind)
+}
+
+func argVars(args []any) []Var {
+	var out []Var
+	for _, arg := range args {
+		if v, ok := arg.(Var); ok {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// functionClause returns the function name and arguments of a Predicate or
+// Call clause.
+func functionClause(c Clause) (fn string, args []any, ok bool) {
+	switch c := c.(type) {
+	case Predicate:
+		return c.Fn, c.Args, true
+	case Call:
+		return c.Fn, c.Args, true
+	default:
+		return "", nil, false
+	}
+}
+
+// Query is a declarative query against one or more databases. Clauses in
+// Where are joined on their shared variables, and the values bound to the
+// variables in Find are returned as rows. Each distinct row is returned once.
+type Query struct {
+	Find []Var
+	// In names the databases that the query is evaluated against. The
+	// databases are supplied positionally when running the query. If empty,
+	// the query takes a single database named by DefaultSource.
+	In    []string
+	Where []Clause
+}
+
+// Validate checks the shape of the query without running it: every Find
+// variable must be bound by a clause, sources must be distinct and every
+// pattern's source must be listed in In, patterns must give all three terms,
+// a pattern with a Filter must bind its value to a variable, and function
+// clauses must name a function and have their arguments bound by other
+// clauses. Whether the functions exist is checked when the query is run.
+func (q Query) Validate() error {
+	var errs []error
+	if len(q.Find) == 0 {
+		errs = append(errs, errors.New("query has no find variables"))
+	}
+
+	in := q.In
+	if len(in) == 0 {
+		in = []string{DefaultSource}
+	}
+	sources := make(map[string]struct{}, len(in))
+	for _, name := range in {
+		if _, ok := sources[name]; ok {
+			errs = append(errs, fmt.Errorf("duplicate query source: %q", name))
+		}
+		sources[name] = struct{}{}
+	}
+
+	bound := make(map[Var]struct{})
+	var inputs []Var
+	for i, c := range flattenClauses(q.Where, "") {
+		if fn, args, ok := functionClause(c); ok {
+			if fn == "" {
+				errs = append(errs, fmt.Errorf("clause %d: function clause must name a function", i))
+			}
+			inputs = append(inputs, argVars(args)...)
+			if call, ok := c.(Call); ok {
+				if call.Bind == "" {
+					errs = append(errs, fmt.Errorf("clause %d: call must bind its result to a variable", i))
+				}
+				bound[call.Bind] = struct{}{}
+			}
+			continue
+		}
+		if p, ok := c.(Pattern); ok {
+			if _, ok := sources[p.source()]; !ok {
+				errs = append(errs, fmt.Errorf("clause %d: unknown query source: %q", i, p.source()))
+			}
+			if p.Entity == nil || p.Attribute == nil || p.Value == nil {
+				errs = append(errs, fmt.Errorf("clause %d: pattern must give an entity, attribute, and value", i))
+			}
+			if _, ok := p.Value.(Var); p.Filter != nil && !ok {
+				errs = append(errs, fmt.Errorf("clause %d: a filtered pattern must bind its value to a variable", i))
+			}
+		}
+		for _, v := range c.vars() {
+			bound[v] = struct{}{}
+		}
+	}
+	for _, v := range q.Find {
+		if _, ok := bound[v]; !ok {
+			errs = append(errs, fmt.Errorf("find variable %s is not bound by any clause", v))
+		}
+	}
+	for _, v := range inputs {
+		if _, ok := bound[v]; !ok {
+			errs = append(errs, fmt.Errorf("function argument %s is not bound by any clause", v))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Query runs a query that takes a single database. The query reads a view of
+// the database that satisfies opts, of which at most one may be given.
+func (db Database) Query(q Query, opts ...ReadOpts) ([][]Value, error) {
+	db, err := db.withConsistency(opts)
+	if err != nil {
+		return nil, err
+	}
+	return RunQuery(q, db)
+}
+
+// QueryEach is like Query, but rather than collecting the rows of the result,
+// it passes each row to fn as soon as the query produces it, so that the rows
+// can be written out without holding the whole result. The query is evaluated
+// only as fast as fn returns. If fn returns an error, the query stops and
+// QueryEach returns the error.
+func (db Database) QueryEach(q Query, fn func(row []Value) error, opts ...ReadOpts) error {
+	db, err := db.withConsistency(opts)
+	if err != nil {
+		return err
+	}
+	return runQueryLogged(q, []Database{db}, fn)
+}
+
+// RunQuery runs a query against the supplied databases, which are matched
+// positionally against the names in the query's In section. Since each
+// database may be a different view, e.g. an as-of view and the current
+// database, a single query may join historical and current data. The
+// databases may also belong to different connections, so that a query may
+// compare separate logical databases, such as those of two tenants. Function
+// clauses call the functions registered with the first database's connection.
+func RunQuery(q Query, dbs ...Database) ([][]Value, error) {
+	var rows [][]Value
+	err := runQueryLogged(q, dbs, func(row []Value) error {
+		rows = append(rows, row)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return rows, nil
+}
+
+// runQueryLogged runs a query, passing each row of the result to emit, and
+// records it in the slow log of the first database's connection.
+func runQueryLogged(q Query, dbs []Database, emit func(row []Value) error) error {
+	timer := &stageTimer{}
+	var n int
+	clauses, err := runQuery(q, dbs, nil, timer, func(row []Value) error {
+		n++
+		return emit(row)
+	})
+	timer.end()
+	for _, db := range dbs {
+		if db.conn != nil {
+			db.conn.slowLog.record(SlowLogEntry{
+				Kind:     SlowLogQuery,
+				Duration: timer.total(),
+				Stages:   timer.stages,
+				Err:      err,
+				Clauses:  clauses,
+				Rows:     n,
+			})
+			break
+		}
+	}
+	return err
+}
+
+// runQuery runs a query, timing each stage with timer, and passes each row of
+// the result to emit. Evaluation starts from seed, so that only the rows in
+// which its variables have the given values are produced. It returns the
+// clauses of the query in the order that they were evaluated.
+func runQuery(q Query, dbs []Database, seed binding, timer *stageTimer, emit func(row []Value) error) ([]Clause, error) {
+	timer.begin("plan")
+	in := q.In
+	if len(in) == 0 {
+		in = []string{DefaultSource}
+	}
+	if len(in) != len(dbs) {
+		return nil, fmt.Errorf("query expects %d databases but got %d", len(in), len(dbs))
+	}
+	sources := make(map[string]Database, len(in))
+	for i, name := range in {
+		if _, ok := sources[name]; ok {
+			return nil, fmt.Errorf("duplicate query source: %q", name)
+		}
+		sources[name] = dbs[i]
+	}
+	// The bindings of the query are reserved from the memory budget of the
+	// first source's connection as they are produced.
+	var mem *memScope
+	for _, db := range dbs {
+		if db.conn != nil {
+			mem = db.conn.memory.scope("query")
+			defer mem.close()
+			break
+		}
+	}
+	where := flattenClauses(q.Where, "")
+	functions, err := checkFunctions(where, dbs)
+	if err != nil {
+		return where, err
+	}
+	planned := planClauses(where, sources, seed)
+
+	// Clauses are evaluated depth first, so that each binding is projected as
+	// soon as every clause has extended it, and only the bindings that extend
+	// the current one are held at a time. The time spent projecting rows is
+	// told apart from the time spent evaluating clauses.
+	timer.end()
+	start := time.Now()
+	var projecting time.Duration
+	defer func() {
+		timer.add("evaluate", time.Since(start)-projecting)
+		timer.add("project", projecting)
+	}()
+	// Distinct rows are remembered so that each is only emitted once. They
+	// are reserved from the memory budget along with the bindings.
+	seen := make(map[string]struct{})
+	project := func(b binding) error {
+		began := time.Now()
+		defer func() { projecting += time.Since(began) }()
+		row := make([]Value, len(q.Find))
+		for i, v := range q.Find {
+			val, ok := b[v]
+			if !ok {
+				return fmt.Errorf("find variable %s is not bound by any clause", v)
+			}
+			row[i] = val
+		}
+		key := fmt.Sprintf("%#v", row)
+		if _, ok := seen[key]; ok {
+			return nil
+		}
+		if mem != nil {
+			if err := mem.reserve(int64(len(key)) + 16); err != nil {
+				return err
+			}
+		}
+		seen[key] = struct{}{}
+		return emit(row)
+	}
+	var eval func(i int, b binding) error
+	eval = func(i int, b binding) error {
+		if i == len(planned) {
+			return project(b)
+		}
+		extended, err := evalClause(planned[i], sources, functions, b)
+		if err != nil {
+			return err
+		}
+		if mem != nil {
+			var size int64
+			for _, e := range extended {
+				size += bindingSize(e)
+			}
+			if err := mem.reserve(size); err != nil {
+				return err
+			}
+			defer mem.release(size)
+		}
+		for _, e := range extended {
+			if err := eval(i+1, e); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if seed == nil {
+		seed = binding{}
+	}
+	if err := eval(0, seed); err != nil {
+		return planned, err
+	}
+
+	return planned, nil
+}
+
+// checkFunctions returns the function registry of the connection that the
+// databases belong to, after checking that every function clause calls a
+// registered function with the right number of arguments, that constant
+// arguments are of the right types, and that predicates return booleans.
+func checkFunctions(clauses []Clause, dbs []Database) (*FunctionRegistry, error) {
+	var functions *FunctionRegistry
+	for _, db := range dbs {
+		if db.conn != nil {
+			functions = db.conn.functions
+			break
+		}
+	}
+	if functions == nil {
+		functions = NewFunctionRegistry()
+	}
+
+	var errs []error
+	for _, c := range clauses {
+		name, args, ok := functionClause(c)
+		if !ok {
+			continue
+		}
+		fn, ok := functions.Lookup(name)
+		if !ok {
+			errs = append(errs, fmt.Errorf("unknown function: %s", name))
+			continue
+		}
+		if err := fn.checkArity(len(args)); err != nil {
+			errs = append(errs, fmt.Errorf("calling %s: %w", name, err))
+			continue
+		}
+		for i, arg := range args {
+			if _, ok := arg.(Var); ok {
+				continue
+			}
+			if t := fn.param(i); !valueHasType(arg, t) {
+				errs = append(errs, fmt.Errorf("calling %s: argument %d: %#v is not of type %s", name, i+1, arg, t.TypeTag()))
+			}
+		}
+		if _, ok := c.(Predicate); ok && fn.Result != nil && rtype.RootType(fn.Result) != rtype.RTypeBool {
+			errs = append(errs, fmt.Errorf("function %s returns %s and cannot be used as a predicate", name, fn.Result.TypeTag()))
+		}
+	}
+	return functions, errors.Join(errs...)
+}
+
+// binding maps variables to the values bound to them.
+type binding map[Var]Value
+
+func (b binding) with(v Var, val Value) binding {
+	out := make(binding, len(b)+1)
+	for k, existing := range b {
+		out[k] = existing
+	}
+	out[v] = val
+	return out
+}
+
+// planClauses orders clauses such that each clause is evaluated with as many
+// of its variables bound as possible. Patterns against time-sliced sources
+// (e.g. as-of views) must be reconstructed from history, which is much more
+// expensive than reading the current indexes, so they are deferred until
+// their entity is bound whenever possible. Ties are broken by the order in
+// which clauses were written. Patterns whose attribute is given directly are
+// costed by the number of facts that the attribute's statistics (see
+// AttrStats) suggest they will match. The variables of seed are bound before
+// any clause is evaluated.
+func planClauses(clauses []Clause, sources map[string]Database, seed binding) []Clause {
+	remaining := make([]Clause, len(clauses))
+	copy(remaining, clauses)
+	bound := make(map[Var]struct{}, len(seed))
+	for v := range seed {
+		bound[v] = struct{}{}
+	}
+	planned := make([]Clause, 0, len(clauses))
+
+	for len(remaining) > 0 {
+		best := 0
+		bestCost := clauseCost(remaining[0], sources, bound)
+		for i := 1; i < len(remaining); i++ {
+			if cost := clauseCost(remaining[i], sources, bound); cost < bestCost {
+				best, bestCost = i, cost
+			}
+		}
+		c := remaining[best]
+		planned = append(planned, c)
+		remaining = append(remaining[:best], remaining[best+1:]...)
+		for _, v := range c.vars() {
+			bound[v] = struct{}{}
+		}
+	}
+
+	return planned
+}
+
+// clauseCost is a rough estimate of the cost of evaluating a clause given the
+// set of variables that have already been bound.
+func clauseCost(c Clause, sources map[string]Database, bound map[Var]struct{}) int {
+	isBound := func(term any) bool {
+		v, ok := term.(Var)
+		if !ok {
+			return term != nil
+		}
+		_, ok = bound[v]
+		return ok
+	}
+	if _, args, ok := functionClause(c); ok {
+		// Functions are cheap, but can only be called once their arguments
+		// are bound.
+		for _, arg := range args {
+			if !isBound(arg) {
+				return math.MaxInt
+			}
+		}
+		return 0
+	}
+	p, ok := c.(Pattern)
+	if !ok {
+		return 0
+	}
+
+	var cost int
+	switch {
+	case isBound(p.Entity):
+		cost = 1
+	case isBound(p.Attribute) && isBound(p.Value):
+		cost = 10
+		if stats, ok := patternStats(p, sources); ok {
+			// Expect one fact for each occurrence of the value.
+			cost = 2 + int(stats.Count/max(stats.Distinct, 1))
+		}
+	case isBound(p.Attribute):
+		cost = 100
+		if stats, ok := patternStats(p, sources); ok {
+			cost = 2 + int(stats.Count)
+		}
+	default:
+		cost = 10000
+	}
+
+	if db, ok := sources[p.source()]; ok && db.IsTimeSliced() {
+		if isBound(p.Entity) {
+			cost *= 2
+		} else {
+			cost *= 50
+		}
+	}
+
+	return cost
+}
+
+// patternStats returns the statistics of a pattern's attribute if the
+// attribute is given directly rather than by a variable.
+func patternStats(p Pattern, sources map[string]Database) (AttrStats, bool) {
+	db, ok := sources[p.source()]
+	if !ok || db.conn == nil {
+		return AttrStats{}, false
+	}
+	switch p.Attribute.(type) {
+	case string, ID, Ident:
+	default:
+		return AttrStats{}, false
+	}
+	stats, err := db.conn.AttrStats(p.Attribute)
+	if err != nil {
+		return AttrStats{}, false
+	}
+	return stats, true
+}
+
+func evalClause(c Clause, sources map[string]Database, functions *FunctionRegistry, b binding) ([]binding, error) {
+	switch c := c.(type) {
+	case Pattern:
+		db, ok := sources[c.source()]
+		if !ok {
+			return nil, fmt.Errorf("unknown query source: %q", c.source())
+		}
+		return db.matchPattern(c, b)
+	case Predicate:
+		result, err := callFunction(functions, c.Fn, c.Args, b)
+		if err != nil {
+			return nil, err
+		}
+		if result != true {
+			return nil, nil
+		}
+		return []binding{b}, nil
+	case Call:
+		result, err := callFunction(functions, c.Fn, c.Args, b)
+		if err != nil {
+			return nil, err
+		}
+		if existing, ok := b[c.Bind]; ok {
+			if !ValueEqual(existing, result) {
+				return nil, nil
+			}
+			return []binding{b}, nil
+		}
+		return []binding{b.with(c.Bind, result)}, nil
+	default:
+		return nil, fmt.Errorf("unsupported clause type: %T", c)
+	}
+}
+
+// callFunction calls a registered function with the values of its arguments
+// under a binding.
+func callFunction(functions *FunctionRegistry, name string, args []any, b binding) (Value, error) {
+	fn, ok := functions.Lookup(name)
+	if !ok {
+		return nil, fmt.Errorf("unknown function: %s", name)
+	}
+	vals := make([]Value, len(args))
+	for i, arg := range args {
+		if v, ok := arg.(Var); ok {
+			val, ok := b[v]
+			if !ok {
+				return nil, fmt.Errorf("calling %s: argument %s is not bound", name, v)
+			}
+			arg = val
+		}
+		vals[i] = arg
+	}
+	return fn.call(name, vals)
+}
+
+// matchPattern extends a binding with every fact in the database that matches
+// the pattern.
+func (db Database) matchPattern(p Pattern, b binding) ([]binding, error) {
+	conn := db.conn
+
+	// Substitute bound variables.
+	entity, attribute, value := p.Entity, p.Attribute, p.Value
+	if v, ok := entity.(Var); ok {
+		if val, ok := b[v]; ok {
+			entity = val
+		}
+	}
+	if v, ok := attribute.(Var); ok {
+		if val, ok := b[v]; ok {
+			attribute = val
+		}
+	}
+	if v, ok := value.(Var); ok {
+		if val, ok := b[v]; ok {
+			value = val
+		}
+	}
+
+	var eid, attr *ID
+	if _, ok := entity.(Var); !ok {
+		id, err := db.resolveEntityTerm(entity)
+		if err != nil {
+			if errors.Is(err, ErrNoSuchEntity) || errors.Is(err, ErrNoSuchIdent) {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("resolving pattern entity: %w", err)
+		}
+		eid = &id
+	}
+	if _, ok := attribute.(Var); !ok {
+		ident, err := ResolveIdent(conn, attribute)
+		if err != nil {
+			if errors.Is(err, ErrNoSuchIdent) {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("resolving pattern attribute: %w", err)
+		}
+		attr = &ident.ID
+		// Patterns that name a deprecated attribute are reported even if
+		// they match nothing.
+		if err := db.warnAttribute(ident.ID); err != nil {
+			return nil, err
+		}
+
+		if _, ok := value.(Var); !ok {
+			if value, err = db.resolveValueTerm(ident.ID, value); err != nil {
+				return nil, fmt.Errorf("resolving pattern value: %w", err)
+			}
+		}
+	}
+	if eid == nil && attr == nil {
+		return nil, errors.New("pattern must bind its entity or attribute before it can be evaluated")
+	}
+
+	filter := p.Filter
+	if filter != nil && attr != nil {
+		var err error
+		if filter, err = db.resolvePredicate(*attr, filter); err != nil {
+			return nil, fmt.Errorf("resolving pattern filter: %w", err)
+		}
+	}
+	facts, err := db.scanWhere(eid, attr, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	var out []binding
+	for _, fct := range facts {
+		next := b
+		if v, ok := entity.(Var); ok {
+			next = next.with(v, fct.EntityID)
+		}
+		if v, ok := attribute.(Var); ok {
+			next = next.with(v, fct.Attribute)
+		}
+		if v, ok := value.(Var); ok {
+			next = next.with(v, fct.Value)
+		} else if !ValueEqual(value, fct.Value) {
+			continue
+		}
+		out = append(out, next)
+	}
+
+	return out, nil
+}
+
+// resolveEntityTerm resolves a constant in the entity position of a pattern.
+func (db Database) resolveEntityTerm(term any) (ID, error) {
+	switch term := term.(type) {
+	case string:
+		ident, err := ResolveIdent(db.conn, term)
+		if err != nil {
+			return 0, err
+		}
+		return ident.ID, nil
+	case Resolver:
+		return db.resolve(term)
+	default:
+		return 0, fmt.Errorf("cannot resolve %T to an entity", term)
+	}
+}
+
+// resolveValueTerm resolves a constant in the value position of a pattern such
+// that it may be compared with stored values of the attribute. Constants are
+// converted to the type of the attribute as they are when asserted, so that a
+// pattern matches the values that an assertion of the same constant stores.
+func (db Database) resolveValueTerm(attrID ID, term any) (Value, error) {
+	conn := db.conn
+	schema, err := db.schemaFor(attrID)
+	if err != nil {
+		return nil, err
+	}
+	if schema.Type != IDTypeRef {
+		ident, err := ResolveIdent(conn, attrID)
+		if err != nil {
+			return nil, err
+		}
+		return convertValue(schema.Type, ident.Name, term)
+	}
+
+	switch term := term.(type) {
+	case ID:
+		return term, nil
+	case string:
+		// Refs may be specified by ident.
+		ident, err := ResolveIdent(conn, term)
+		if err != nil {
+			return nil, err
+		}
+		return ident.ID, nil
+	case Resolver:
+		return db.resolve(term)
+	default:
+		return term, nil
+	}
+}
+
+// resolvePredicate converts the constants of a predicate to the type of an
+// attribute.
+func (db Database) resolvePredicate(attrID ID, pred ValuePredicate) (ValuePredicate, error) {
+	resolve := func(term Value) (Value, error) {
+		if term == nil {
+			return nil, nil
+		}
+		return db.resolveValueTerm(attrID, term)
+	}
+	switch p := pred.(type) {
+	case ValueRange:
+		var err error
+		if p.Min, err = resolve(p.Min); err != nil {
+			return nil, err
+		}
+		if p.Max, err = resolve(p.Max); err != nil {
+			return nil, err
+		}
+		return p, nil
+	case ValueIn:
+		out := make(ValueIn, len(p))
+		for i, val := range p {
+			var err error
+			if out[i], err = resolve(val); err != nil {
+				return nil, err
+			}
+		}
+		return out, nil
+	default:
+		return pred, nil
+	}
+}
@@ -0,0 +1,248 @@
+/*
+Copyright 2024 Andrew Meredith
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package query constructs queries, either from text with Parse or
+// programmatically with a Builder. Both produce a store.Query, so queries may
+// be run, subscribed to, or combined with hand-written clauses like any other:
+//
+//	rows, err := query.Find("?name").
+//		Where("?e", "person/email", "?email").
+//		Where("?e", "person/age", "?age").Filter(store.ValueRange{Min: int64(21)}).
+//		Where("?e", "person/firstName", "?name").
+//		Run(conn.DB())
+//
+// Exec returns a Result, whose rows may be scanned into structs or read as
+// typed columns and tuples:
+//
+//	var people []struct {
+//		Name string `canter:"?name"`
+//		Age  int
+//	}
+//	res, err := query.Find("?name", "?age").
+//		Where("?e", "person/name", "?name").
+//		Where("?e", "person/age", "?age").
+//		Exec(conn.DB())
+//	err = res.Scan(&people)
+//
+// In the terms of a clause, a string that begins with "?" is a variable, and
+// anything else is a constant. Use Literal for a constant string that begins
+// with "?".
+package query
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/kendru/canter/internal/store"
+)
+
+// Builder builds a query clause by clause. Each method returns a new Builder
+// and leaves its receiver unchanged, so a partial query may be shared and
+// extended in several ways. Errors in the shape of the query are collected
+// and reported by Build.
+type Builder struct {
+	q    store.Query
+	errs []error
+}
+
+// literal is a constant term that is never interpreted as a variable.
+type literal struct {
+	val store.Value
+}
+
+// Literal returns a constant term for val, which is otherwise interpreted as
+// a variable if it is a string that begins with "?".
+func Literal(val store.Value) any {
+	return literal{val: val}
+}
+
+// Find starts a query that returns the values bound to vars.
+func Find(vars ...string) Builder {
+	var b Builder
+	for _, name := range vars {
+		if !isVar(name) {
+			b.errs = append(b.errs, fmt.Errorf("find variable %q must begin with \"?\"", name))
+			continue
+		}
+		b.q.Find = append(b.q.Find, store.Var(name))
+	}
+	return b
+}
+
+// In names the databases that the query is evaluated against, in the order
+// in which they are passed to Run. Clauses are matched against
+// store.DefaultSource unless they are added with WhereIn.
+func (b Builder) In(sources ...string) Builder {
+	b = b.clone()
+	b.q.In = append(b.q.In, sources...)
+	return b
+}
+
+// Where adds a pattern that matches facts of the default source.
+func (b Builder) Where(entity, attribute, value any) Builder {
+	return b.WhereIn("", entity, attribute, value)
+}
+
+// WhereIn adds a pattern that matches facts of the named source, which must
+// be listed by In.
+func (b Builder) WhereIn(source string, entity, attribute, value any) Builder {
+	b = b.clone()
+	if isVar(source) {
+		b.errs = append(b.errs, fmt.Errorf("source %q must not be a variable", source))
+	}
+	if _, ok := attribute.(literal); ok {
+		b.errs = append(b.errs, errors.New("attribute must be a variable or ident, not a literal"))
+	}
+	b.q.Where = append(b.q.Where, store.Pattern{
+		Source:    source,
+		Entity:    term(entity),
+		Attribute: term(attribute),
+		Value:     term(value),
+	})
+	return b
+}
+
+// Filter restricts the pattern that was added last to facts whose values
+// match pred.
+func (b Builder) Filter(pred store.ValuePredicate) Builder {
+	b = b.clone()
+	last := len(b.q.Where) - 1
+	var p store.Pattern
+	var ok bool
+	if last >= 0 {
+		p, ok = b.q.Where[last].(store.Pattern)
+	}
+	switch {
+	case !ok:
+		b.errs = append(b.errs, errors.New("filter must follow a pattern"))
+	case p.Filter != nil:
+		b.errs = append(b.errs, fmt.Errorf("clause %d already has a filter", last))
+	default:
+		p.Filter = pred
+		b.q.Where[last] = p
+	}
+	return b
+}
+
+// Group adds a group of clauses that are evaluated against the named source,
+// which must be listed by In. The clauses are those added to the empty
+// Builder passed to clauses, so that
+//
+//	b.Group("$before", func(g query.Builder) query.Builder {
+//		return g.Where("?e", "person/name", "?name").Pred("str/starts-with?", "?name", "A")
+//	})
+//
+// matches the pattern against $before rather than the default source.
+func (b Builder) Group(source string, clauses func(Builder) Builder) Builder {
+	b = b.clone()
+	g := clauses(Builder{})
+	b.errs = append(b.errs, g.errs...)
+	b.q.Where = append(b.q.Where, store.Group{Source: source, Clauses: g.q.Where})
+	return b
+}
+
+// Pred adds a clause that keeps only the bindings for which the function fn
+// returns true. Each of args is a variable or a constant, as for Where.
+func (b Builder) Pred(fn string, args ...any) Builder {
+	b = b.clone()
+	b.q.Where = append(b.q.Where, store.Predicate{Fn: fn, Args: terms(args)})
+	return b
+}
+
+// Call adds a clause that binds the result of the function fn to the
+// variable bind.
+func (b Builder) Call(bind string, fn string, args ...any) Builder {
+	b = b.clone()
+	if !isVar(bind) {
+		b.errs = append(b.errs, fmt.Errorf("call result %q must be bound to a variable", bind))
+	}
+	b.q.Where = append(b.q.Where, store.Call{Fn: fn, Args: terms(args), Bind: store.Var(bind)})
+	return b
+}
+
+// Clause adds clauses that were constructed directly.
+func (b Builder) Clause(clauses ...store.Clause) Builder {
+	b = b.clone()
+	b.q.Where = append(b.q.Where, clauses...)
+	return b
+}
+
+// Build returns the query, or the errors in its shape. See store.Query.Validate
+// for the checks that are made in addition to those of the Builder.
+func (b Builder) Build() (store.Query, error) {
+	if err := errors.Join(append(b.errs, b.q.Validate())...); err != nil {
+		return store.Query{}, fmt.Errorf("invalid query: %w", err)
+	}
+	return b.clone().q, nil
+}
+
+// MustBuild is like Build, but it panics if the query is invalid. It is meant
+// for queries that are fixed at compile time.
+func (b Builder) MustBuild() store.Query {
+	q, err := b.Build()
+	if err != nil {
+		panic(err)
+	}
+	return q
+}
+
+// Run builds the query and runs it against dbs. See store.RunQuery.
+func (b Builder) Run(dbs ...store.Database) ([][]store.Value, error) {
+	q, err := b.Build()
+	if err != nil {
+		return nil, err
+	}
+	return store.RunQuery(q, dbs...)
+}
+
+// clone copies the builder so that appending to it does not modify the
+// receiver's slices.
+func (b Builder) clone() Builder {
+	return Builder{
+		q: store.Query{
+			Find:  append([]store.Var(nil), b.q.Find...),
+			In:    append([]string(nil), b.q.In...),
+			Where: append([]store.Clause(nil), b.q.Where...),
+		},
+		errs: append([]error(nil), b.errs...),
+	}
+}
+
+func isVar(s string) bool {
+	return strings.HasPrefix(s, "?")
+}
+
+// term converts an argument of a clause to a pattern term.
+func term(arg any) any {
+	switch arg := arg.(type) {
+	case literal:
+		return arg.val
+	case string:
+		if isVar(arg) {
+			return store.Var(arg)
+		}
+	}
+	return arg
+}
+
+func terms(args []any) []any {
+	out := make([]any, len(args))
+	for i, arg := range args {
+		out[i] = term(arg)
+	}
+	return out
+}
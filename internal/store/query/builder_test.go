@@ -0,0 +1,193 @@
+/*
+Copyright 2024 Andrew Meredith
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package query_test
+
+import (
+	"sort"
+	"testing"
+
+	"github.com/kendru/canter/internal/store"
+	"github.com/kendru/canter/internal/store/cantertest"
+	"github.com/kendru/canter/internal/store/query"
+	"github.com/kendru/canter/pkg/rtype"
+	"github.com/stretchr/testify/assert"
+)
+
+func newConn(t *testing.T) *cantertest.Conn {
+	conn := cantertest.NewConn(t, store.Config{})
+	conn.MustAssert(
+		store.EntityData{"db/ident": "person/email", "db/type": "db.type/string", "db/unique": true},
+		store.EntityData{"db/ident": "person/name", "db/type": "db.type/string"},
+		store.EntityData{"db/ident": "person/age", "db/type": "db.type/int64"},
+	)
+	conn.MustAssert(
+		store.EntityData{"person/email": "ada@example.com", "person/name": "Ada", "person/age": int64(36)},
+		store.EntityData{"person/email": "bo@example.com", "person/name": "Bo", "person/age": int64(17)},
+		store.EntityData{"person/email": "?who@example.com", "person/name": "Who", "person/age": int64(50)},
+	)
+	return conn
+}
+
+func names(rows [][]store.Value) []string {
+	var out []string
+	for _, row := range rows {
+		out = append(out, row[0].(string))
+	}
+	sort.Strings(out)
+	return out
+}
+
+func TestBuilder(t *testing.T) {
+	conn := newConn(t)
+
+	people := query.Find("?name").
+		Where("?e", "person/name", "?name")
+	adults := people.
+		Where("?e", "person/age", "?age").Filter(store.ValueRange{Min: int64(18)})
+
+	rows, err := people.Run(conn.DB())
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"Ada", "Bo", "Who"}, names(rows))
+
+	rows, err = adults.Run(conn.DB())
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"Ada", "Who"}, names(rows), "extending a builder leaves it unchanged")
+
+	rows, err = people.Where("?e", "person/email", query.Literal("?who@example.com")).Run(conn.DB())
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"Who"}, names(rows))
+
+	q := query.Find("?name").
+		In("$", "$before").
+		WhereIn("$before", "?e", "person/name", "?name").
+		Clause(store.Pattern{Entity: store.Var("?e"), Attribute: "person/age", Value: int64(17)}).
+		MustBuild()
+	assert.Equal(t, store.Query{
+		Find: []store.Var{"?name"},
+		In:   []string{"$", "$before"},
+		Where: []store.Clause{
+			store.Pattern{Source: "$before", Entity: store.Var("?e"), Attribute: "person/name", Value: store.Var("?name")},
+			store.Pattern{Entity: store.Var("?e"), Attribute: "person/age", Value: int64(17)},
+		},
+	}, q)
+	rows, err = store.RunQuery(q, conn.DB(), conn.DB())
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"Bo"}, names(rows))
+}
+
+func TestBuilderFunctions(t *testing.T) {
+	conn := newConn(t)
+	assert.NoError(t, conn.RegisterFunction("initial", store.Function{
+		Params: []rtype.ConcreteType{rtype.RTypeString},
+		Result: rtype.RTypeString,
+		Fn: func(args []store.Value) (store.Value, error) {
+			return args[0].(string)[:1], nil
+		},
+	}))
+
+	rows, err := query.Find("?name", "?next").
+		Where("?e", "person/name", "?name").
+		Where("?e", "person/age", "?age").
+		Pred("<", "?age", int64(40)).
+		Call("?next", "+", "?age", int64(1)).
+		Run(conn.DB())
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, [][]store.Value{{"Ada", int64(37)}, {"Bo", int64(18)}}, rows)
+
+	rows, err = query.Find("?name").
+		Where("?e", "person/name", "?name").
+		Call("?i", "initial", "?name").
+		Pred("=", "?i", query.Literal("?")).
+		Run(conn.DB())
+	assert.NoError(t, err)
+	assert.Empty(t, rows)
+
+	_, err = query.Find("?e").Where("?e", "person/name", "?name").Call("out", "str/upper", "?name").Build()
+	assert.ErrorContains(t, err, `call result "out" must be bound to a variable`)
+}
+
+func TestBuilderGroup(t *testing.T) {
+	conn, other := newConn(t), newConn(t)
+	q := query.Find("?name").
+		In("$", "$other").
+		Where("?e", "person/name", "?name").
+		Group("$other", func(g query.Builder) query.Builder {
+			return g.Where("?e2", "person/name", "?name").
+				Where("?e2", "person/age", "?age").
+				Pred(">", "?age", int64(40))
+		}).
+		MustBuild()
+	rows, err := store.RunQuery(q, conn.DB(), other.DB())
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"Who"}, names(rows))
+
+	_, err = query.Find("?e").In("$", "$other").Group("$other", func(g query.Builder) query.Builder {
+		return g.Filter(store.ValuePrefix("a"))
+	}).Build()
+	assert.ErrorContains(t, err, "filter must follow a pattern")
+}
+
+func TestBuilderErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		builder  query.Builder
+		contains []string
+	}{
+		{
+			name:     "find without question mark",
+			builder:  query.Find("name").Where("?e", "person/name", "?name"),
+			contains: []string{`find variable "name" must begin with "?"`, "query has no find variables"},
+		},
+		{
+			name:     "unbound find variable",
+			builder:  query.Find("?name", "?age").Where("?e", "person/name", "?name"),
+			contains: []string{"find variable ?age is not bound"},
+		},
+		{
+			name:     "filter without pattern",
+			builder:  query.Find("?e").Filter(store.ValuePrefix("a")),
+			contains: []string{"filter must follow a pattern"},
+		},
+		{
+			name:     "filter on constant",
+			builder:  query.Find("?e").Where("?e", "person/name", "Ada").Filter(store.ValuePrefix("A")),
+			contains: []string{"filtered pattern must bind its value"},
+		},
+		{
+			name:     "unknown source",
+			builder:  query.Find("?e").WhereIn("$before", "?e", "person/name", "?name"),
+			contains: []string{`unknown query source: "$before"`},
+		},
+		{
+			name:     "missing term",
+			builder:  query.Find("?e").Where("?e", nil, "?v"),
+			contains: []string{"pattern must give an entity, attribute, and value"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := tt.builder.Build()
+			if !assert.Error(t, err) {
+				return
+			}
+			for _, s := range tt.contains {
+				assert.Contains(t, err.Error(), s)
+			}
+			assert.Panics(t, func() { tt.builder.MustBuild() })
+		})
+	}
+}
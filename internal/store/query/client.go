@@ -0,0 +1,440 @@
+/*
+Copyright 2024 Andrew Meredith
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package query
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kendru/canter/internal/store"
+)
+
+// ClientConfig configures a Client.
+type ClientConfig struct {
+	// Servers are the base URLs of the servers that the client sends queries
+	// to, e.g. "http://replica-1:8080". Queries are POSTed to /query (see
+	// Handler), and health is checked at /readyz (see health.Handler).
+	Servers []string
+	// SessionsPerServer bounds the number of connections to each server, and
+	// so the number of queries that may run on it at once. If zero, 4
+	// sessions are used.
+	SessionsPerServer int
+	// HealthInterval is how often the health of each server is checked. If
+	// zero, servers are checked every 5 seconds.
+	HealthInterval time.Duration
+	// Retry controls how a query that fails to reach a server is retried,
+	// and how long a server whose sessions failed is avoided before it is
+	// reconnected. If nil, store.DefaultRetryPolicy() is used.
+	Retry *store.RetryPolicy
+}
+
+// Client runs queries against the query Handlers of a set of servers, such as
+// the replicas of a store, through a pool of sessions with each.
+//
+// Servers are checked in the background, and a server that fails a health
+// check, or whose session fails with a transport error, has its sessions
+// closed and is avoided until it is reconnected after a backoff that grows
+// as set by the retry policy. Queries go to the healthy servers in turn, and
+// a query that fails to reach one is retried on the next.
+//
+// The client tracks the latest basis that it has observed, both from the
+// results of its queries and from tokens passed to Observe, and sends it in
+// SinceHeader with every query, so that its reads never go back in time even
+// when they are served by a replica that has not caught up.
+type Client struct {
+	servers  []*server
+	retry    store.RetryPolicy
+	interval time.Duration
+	stop     chan struct{}
+	done     chan struct{}
+
+	mu    sync.Mutex
+	next  int
+	basis store.ID
+	token string
+}
+
+// server is a server of a Client and its pool of sessions.
+type server struct {
+	url      string
+	client   *http.Client
+	sessions chan struct{}
+
+	mu      sync.Mutex
+	healthy bool
+	// retryAt is when a server that is not healthy is next reconnected, and
+	// backoff is the delay before the reconnection after that.
+	retryAt time.Time
+	backoff time.Duration
+}
+
+// NewClient returns a client of the configured servers. It must be closed
+// to stop checking their health.
+func NewClient(cfg ClientConfig) (*Client, error) {
+	if len(cfg.Servers) == 0 {
+		return nil, errors.New("client has no servers")
+	}
+	c := &Client{
+		retry:    store.DefaultRetryPolicy(),
+		interval: cfg.HealthInterval,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	if cfg.Retry != nil {
+		c.retry = *cfg.Retry
+	}
+	if c.interval == 0 {
+		c.interval = 5 * time.Second
+	}
+	sessions := cfg.SessionsPerServer
+	if sessions == 0 {
+		sessions = 4
+	}
+	for _, u := range cfg.Servers {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.MaxConnsPerHost = sessions
+		transport.MaxIdleConnsPerHost = sessions
+		c.servers = append(c.servers, &server{
+			url:      strings.TrimSuffix(u, "/"),
+			client:   &http.Client{Transport: transport},
+			sessions: make(chan struct{}, sessions),
+			healthy:  true,
+			backoff:  c.retry.InitialBackoff,
+		})
+	}
+	go c.checkHealth()
+	return c, nil
+}
+
+// Close stops checking the health of the servers and closes their idle
+// sessions. Rows that are still open remain readable.
+func (c *Client) Close() {
+	close(c.stop)
+	<-c.done
+	for _, srv := range c.servers {
+		srv.client.CloseIdleConnections()
+	}
+}
+
+// Observe records the basis of a token, such as that of a transaction that
+// the caller committed (see store.AssertResult.Token), so that later queries
+// reflect it. Tokens older than the latest basis that the client has observed
+// are ignored.
+func (c *Client) Observe(token string) error {
+	basis, err := store.TokenBasis(token)
+	if err != nil {
+		return err
+	}
+	c.observe(basis, token)
+	return nil
+}
+
+func (c *Client) observe(basis store.ID, token string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if basis > c.basis {
+		c.basis, c.token = basis, token
+	}
+}
+
+// Token returns a token for the latest basis that the client has observed,
+// or "" if it has observed none.
+func (c *Client) Token() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.token
+}
+
+// Query runs the text of a query (see Parse) on one of the servers and returns
+// its rows as they arrive. The query reflects at least the latest basis that
+// the client has observed. The Rows hold a session with the server until they
+// are closed.
+func (c *Client) Query(ctx context.Context, src string) (*Rows, error) {
+	var rows *Rows
+	err := c.retry.Do("querying", func() error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		var err error
+		rows, err = c.query(ctx, c.pick(), src)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	c.observe(rows.Basis, rows.Token)
+	return rows, nil
+}
+
+// pick returns the next healthy server, or the server whose reconnection is
+// due soonest if none are healthy.
+func (c *Client) pick() *server {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var soonest *server
+	var soonestAt time.Time
+	for range c.servers {
+		srv := c.servers[c.next]
+		c.next = (c.next + 1) % len(c.servers)
+		healthy, retryAt := srv.status()
+		if healthy {
+			return srv
+		}
+		if soonest == nil || retryAt.Before(soonestAt) {
+			soonest, soonestAt = srv, retryAt
+		}
+	}
+	return soonest
+}
+
+// query runs a query on a server. Failures to reach the server wrap
+// store.ErrTransient, so that the query is retried.
+func (c *Client) query(ctx context.Context, srv *server, src string) (*Rows, error) {
+	select {
+	case srv.sessions <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	release := func() { <-srv.sessions }
+
+	reqCtx, cancel := context.WithCancel(ctx)
+	req, err := http.NewRequestWithContext(reqCtx, http.MethodPost, srv.url+"/query", strings.NewReader(src))
+	if err != nil {
+		cancel()
+		release()
+		return nil, err
+	}
+	if token := c.Token(); token != "" {
+		req.Header.Set(SinceHeader, token)
+	}
+	resp, err := srv.client.Do(req)
+	if err != nil {
+		cancel()
+		release()
+		if ctx.Err() == nil {
+			srv.fail(c.retry)
+			return nil, fmt.Errorf("%w: querying %s: %w", store.ErrTransient, srv.url, err)
+		}
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer cancel()
+		defer release()
+		defer resp.Body.Close()
+		var body errorResponse
+		if err := json.NewDecoder(resp.Body).Decode(&body); err != nil || body.Error == "" {
+			body.Error = resp.Status
+		}
+		err := fmt.Errorf("query failed: %s", body.Error)
+		if resp.StatusCode == http.StatusServiceUnavailable {
+			// The server could not serve the basis in time, so another
+			// server may.
+			err = fmt.Errorf("%w: %w", store.ErrTransient, err)
+		}
+		return nil, err
+	}
+
+	rows := &Rows{body: resp.Body, dec: json.NewDecoder(resp.Body), cancel: cancel, release: release}
+	if err := rows.readHead(); err != nil {
+		rows.Close()
+		return nil, err
+	}
+	return rows, nil
+}
+
+// checkHealth checks the health of every server at the configured interval
+// until the client is closed.
+func (c *Client) checkHealth() {
+	defer close(c.done)
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-ticker.C:
+		}
+		for _, srv := range c.servers {
+			if healthy, retryAt := srv.status(); !healthy && time.Now().Before(retryAt) {
+				continue
+			}
+			srv.check(c.retry)
+		}
+	}
+}
+
+func (s *server) status() (bool, time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.healthy, s.retryAt
+}
+
+// check checks the readiness of the server, which reconnects it if it was
+// not healthy.
+func (s *server) check(policy store.RetryPolicy) {
+	resp, err := s.client.Get(s.url + "/readyz")
+	if err == nil {
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			err = fmt.Errorf("server is not ready: %s", resp.Status)
+		}
+	}
+	if err != nil {
+		s.fail(policy)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.healthy = true
+	s.backoff = policy.InitialBackoff
+}
+
+// fail closes the idle sessions of the server and avoids it until its
+// backoff has passed, then grows the backoff for the next failure.
+func (s *server) fail(policy store.RetryPolicy) {
+	s.client.CloseIdleConnections()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.healthy = false
+	s.retryAt = time.Now().Add(s.backoff)
+	s.backoff = time.Duration(float64(s.backoff) * policy.Multiplier)
+	if policy.MaxBackoff > 0 && s.backoff > policy.MaxBackoff {
+		s.backoff = policy.MaxBackoff
+	}
+}
+
+// Rows iterates over the rows of a query run by a Client. Rows are decoded
+// from the response one at a time, and a server streams its rows as they are
+// projected, so neither side holds the whole result. Since the server writes
+// rows only as fast as they are read, a client that reads slowly also slows
+// the evaluation of the query, and closing the Rows early stops it.
+//
+// Values are decoded as by encoding/json, so numbers are float64s.
+type Rows struct {
+	// Basis is the transaction as of which the query was run, and Token is
+	// the basis as a token that may be sent as since to a later query.
+	Basis store.ID
+	Token string
+
+	body    io.ReadCloser
+	dec     *json.Decoder
+	cancel  context.CancelFunc
+	release func()
+	closed  bool
+	row     []store.Value
+	done    bool
+	err     error
+}
+
+// readHead reads the response up to its first row.
+func (r *Rows) readHead() error {
+	if err := r.expect(json.Delim('{')); err != nil {
+		return err
+	}
+	for {
+		tok, err := r.dec.Token()
+		if err != nil {
+			return err
+		}
+		switch tok {
+		case "basis":
+			err = r.dec.Decode(&r.Basis)
+		case "token":
+			err = r.dec.Decode(&r.Token)
+		case "rows":
+			return r.expect(json.Delim('['))
+		default:
+			var skip json.RawMessage
+			err = r.dec.Decode(&skip)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (r *Rows) expect(want json.Delim) error {
+	tok, err := r.dec.Token()
+	if err != nil {
+		return err
+	}
+	if tok != want {
+		return fmt.Errorf("malformed query response: expected %q but got %v", want, tok)
+	}
+	return nil
+}
+
+// Next advances to the next row, which is then returned by Row. It returns
+// false at the end of the rows or if reading them failed, which is reported
+// by Err.
+func (r *Rows) Next() bool {
+	if r.done {
+		return false
+	}
+	if !r.dec.More() {
+		r.done = true
+		// A response that was cut off is missing its closing brackets.
+		if err := r.expect(json.Delim(']')); err != nil {
+			r.err = err
+		} else if err := r.expect(json.Delim('}')); err != nil {
+			r.err = err
+		}
+		return false
+	}
+	r.row = nil
+	if err := r.dec.Decode(&r.row); err != nil {
+		r.done = true
+		r.err = err
+		return false
+	}
+	return true
+}
+
+// Row returns the current row.
+func (r *Rows) Row() []store.Value {
+	return r.row
+}
+
+// Err returns the error, if any, that ended the iteration. A server that fails
+// partway through a query drops the response, so its rows end with an error.
+func (r *Rows) Err() error {
+	if errors.Is(r.err, io.EOF) {
+		return io.ErrUnexpectedEOF
+	}
+	return r.err
+}
+
+// Close stops reading the rows, cancels the request, and returns its session
+// to the client.
+func (r *Rows) Close() error {
+	if r.closed {
+		return nil
+	}
+	r.closed, r.done = true, true
+	r.cancel()
+	err := r.body.Close()
+	r.release()
+	return err
+}
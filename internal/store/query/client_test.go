@@ -0,0 +1,124 @@
+/*
+Copyright 2024 Andrew Meredith
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package query_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/kendru/canter/internal/health"
+	"github.com/kendru/canter/internal/store"
+	"github.com/kendru/canter/internal/store/query"
+	"github.com/stretchr/testify/assert"
+)
+
+// newServer serves the query and health endpoints of conn.
+func newServer(t *testing.T, conn *store.Connection) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.Handle("/", health.Handler(conn, health.Options{}))
+	mux.Handle("/query", query.Handler(conn))
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestClient(t *testing.T) {
+	conn := newConn(t)
+	var people []store.Assertable
+	for i := 0; i < 300; i++ {
+		people = append(people, store.EntityData{"person/email": fmt.Sprintf("p%d@example.com", i)})
+	}
+	conn.MustAssert(people...)
+	replica, stop := conn.NewPeer(store.PeerConfig{})
+	defer stop()
+	primary, secondary := newServer(t, conn.Connection), newServer(t, replica)
+
+	client, err := query.NewClient(query.ClientConfig{
+		Servers:        []string{primary.URL, secondary.URL},
+		HealthInterval: 5 * time.Millisecond,
+		Retry:          &store.RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond, MaxBackoff: 10 * time.Millisecond, Multiplier: 2},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer client.Close()
+	ctx := context.Background()
+	const emails = `[:find ?email :where [?e :person/email ?email]]`
+
+	// Rows are read one at a time, and the basis of the result is tracked.
+	rows, err := client.Query(ctx, emails)
+	if assert.NoError(t, err) {
+		var n int
+		for rows.Next() {
+			n++
+		}
+		assert.NoError(t, rows.Err())
+		assert.Equal(t, 303, n)
+		assert.NoError(t, rows.Close())
+		assert.False(t, rows.Next())
+		assert.Equal(t, rows.Token, client.Token())
+	}
+	_, err = client.Query(ctx, `[:find ?email`)
+	assert.ErrorContains(t, err, "unexpected end of query")
+
+	// Reads reflect the writes that the client has observed, whichever
+	// server they are sent to.
+	res := conn.MustAssert(store.EntityData{"person/email": "new@example.com"})
+	assert.NoError(t, client.Observe(res.Token()))
+	assert.ErrorIs(t, client.Observe("not a token"), store.ErrInvalidToken)
+	for i := 0; i < 4; i++ {
+		rows, err := client.Query(ctx, `[:find ?e :where [?e :person/email "new@example.com"]]`)
+		if assert.NoError(t, err) {
+			assert.GreaterOrEqual(t, rows.Basis, res.Basis())
+			assert.True(t, rows.Next())
+			assert.NoError(t, rows.Close())
+		}
+	}
+
+	// Queries fail over to the servers that are still reachable.
+	secondary.Close()
+	for i := 0; i < 4; i++ {
+		rows, err := client.Query(ctx, emails)
+		if assert.NoError(t, err) {
+			assert.NoError(t, rows.Close())
+		}
+	}
+
+	// Open rows hold a session until they are closed.
+	single, err := query.NewClient(query.ClientConfig{Servers: []string{primary.URL}, SessionsPerServer: 1})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer single.Close()
+	held, err := single.Query(ctx, emails)
+	if !assert.NoError(t, err) {
+		return
+	}
+	timeout, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	_, err = single.Query(timeout, emails)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.NoError(t, held.Close())
+	rows, err = single.Query(ctx, emails)
+	if assert.NoError(t, err) {
+		assert.NoError(t, rows.Close())
+	}
+}
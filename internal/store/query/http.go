@@ -0,0 +1,174 @@
+/*
+Copyright 2024 Andrew Meredith
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package query
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/kendru/canter/internal/store"
+)
+
+// maxQuerySize limits the size of a query accepted by Handler.
+const maxQuerySize = 1 << 20
+
+// SinceHeader is the request header that carries a basis token (see
+// store.Database.Token) which the database of a query must reflect.
+const SinceHeader = "Canter-Since"
+
+// Response is the body of a successful response from Handler.
+type Response struct {
+	// Basis is the transaction as of which the query was run.
+	Basis store.ID `json:"basis"`
+	// Token is the basis as an opaque token, which a later request, possibly
+	// to another server, may send in SinceHeader to observe the same data.
+	Token string          `json:"token"`
+	Rows  [][]store.Value `json:"rows"`
+}
+
+// errorResponse is the body of a failed response from Handler.
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+// Handler runs the queries POSTed to it against the current database of conn.
+// The request body is the text of a query (see Parse) that takes a single
+// database, and the response is a JSON Response. Queries that do not parse
+// fail with 400, and queries that fail to run with 422. The rows of the
+// response are written and flushed as the query projects them rather than
+// collected first, and the query is evaluated only as fast as they are
+// written, so a client that reads slowly holds back the query rather than
+// having its rows buffered. If writing the response fails partway, the
+// connection is dropped. See Client for reading the rows as they arrive.
+//
+// A request that sends a basis token in SinceHeader is run once conn reflects
+// the token. An invalid token fails with 400, and a request that is canceled
+// while waiting fails with 503.
+func Handler(conn *store.Connection) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			writeJSON(w, http.StatusMethodNotAllowed, errorResponse{Error: "queries must be POSTed"})
+			return
+		}
+		src, err := io.ReadAll(io.LimitReader(r.Body, maxQuerySize+1))
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, errorResponse{Error: err.Error()})
+			return
+		}
+		if len(src) > maxQuerySize {
+			writeJSON(w, http.StatusRequestEntityTooLarge, errorResponse{Error: "query is too large"})
+			return
+		}
+		q, err := Parse(string(src))
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, errorResponse{Error: err.Error()})
+			return
+		}
+		db, err := conn.Since(r.Context(), r.Header.Get(SinceHeader))
+		if err != nil {
+			status := http.StatusServiceUnavailable
+			if errors.Is(err, store.ErrInvalidToken) {
+				status = http.StatusBadRequest
+			}
+			writeJSON(w, status, errorResponse{Error: err.Error()})
+			return
+		}
+		rw := &rowWriter{w: w, db: db}
+		if err := db.QueryEach(q, rw.write); err != nil {
+			if !rw.started {
+				writeJSON(w, http.StatusUnprocessableEntity, errorResponse{Error: err.Error()})
+				return
+			}
+			// Part of the result has been sent, so the connection is dropped
+			// to keep the client from taking it for the whole result.
+			panic(http.ErrAbortHandler)
+		}
+		if err := rw.finish(); err != nil {
+			panic(http.ErrAbortHandler)
+		}
+	})
+}
+
+// flushRows is the number of rows that Handler writes between flushes.
+const flushRows = 256
+
+// rowWriter writes a Response whose rows are streamed to the client as they
+// are produced rather than collected first. The status and the head of the
+// response are only written with the first row, so that a query that fails
+// before producing any rows can still be answered with an error.
+type rowWriter struct {
+	w       http.ResponseWriter
+	db      store.Database
+	started bool
+	n       int
+}
+
+func (rw *rowWriter) start() error {
+	rw.started = true
+	token, err := json.Marshal(rw.db.Token())
+	if err != nil {
+		return err
+	}
+	rw.w.Header().Set("Content-Type", "application/json")
+	rw.w.WriteHeader(http.StatusOK)
+	_, err = fmt.Fprintf(rw.w, `{"basis":%d,"token":%s,"rows":[`, rw.db.Basis.ID(), token)
+	return err
+}
+
+func (rw *rowWriter) write(row []store.Value) error {
+	if !rw.started {
+		if err := rw.start(); err != nil {
+			return err
+		}
+	}
+	encoded, err := json.Marshal(row)
+	if err != nil {
+		return err
+	}
+	if rw.n > 0 {
+		encoded = append([]byte{','}, encoded...)
+	}
+	if _, err := rw.w.Write(encoded); err != nil {
+		return err
+	}
+	rw.n++
+	if rw.n%flushRows == 0 {
+		// Flushing is best effort, since not every writer supports it.
+		_ = http.NewResponseController(rw.w).Flush()
+	}
+	return nil
+}
+
+func (rw *rowWriter) finish() error {
+	if !rw.started {
+		if err := rw.start(); err != nil {
+			return err
+		}
+	}
+	_, err := io.WriteString(rw.w, "]}\n")
+	return err
+}
+
+func writeJSON(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
@@ -0,0 +1,578 @@
+/*
+Copyright 2024 Andrew Meredith
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package query
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/kendru/canter/internal/store"
+)
+
+// Parse compiles a query written in an EDN-like syntax:
+//
+//	[:find ?name ?email
+//	 :in $ $before
+//	 :where
+//	 [?e :person/email ?email]
+//	 [$before ?e :person/name ?name]]
+//
+// The :find section lists the variables to return, :in names the databases
+// that the query takes (by default, a single database named $), and :where
+// lists the patterns to match. A pattern is a vector of an optional source
+// followed by an entity, attribute, and value. A function clause is a vector
+// of a list that calls a function (see store.FunctionRegistry) with its
+// arguments: [(> ?age 21)] keeps the bindings for which the function returns
+// true, and [(str/upper ?name) ?upper] binds the function's result. A source
+// followed by clauses, e.g. [$before [?e :person/name ?name] [?e :person/age
+// ?age]], matches each of the clauses against that source.
+//
+// Terms are written as follows:
+//
+//   - ?name is a variable, and _ is a variable that is not shared with any
+//     other term.
+//   - :ns/name is an ident. It names the attribute of a pattern, and in the
+//     entity or value position it stands for the entity with that ident.
+//   - A vector of an attribute and a value, e.g. [:person/email "a@b.c"], is a
+//     lookup of the entity with that unique value. It may only be used as an
+//     entity.
+//   - An integer in the entity position is an entity ID.
+//   - Strings, integers, floats, true, false, and #inst "2024-01-02T15:04:05Z"
+//     are constant values.
+//
+// Commas are whitespace, and a semicolon begins a comment that runs to the
+// end of the line.
+func Parse(src string) (store.Query, error) {
+	r := &reader{src: src, line: 1, col: 1}
+	top, err := r.read()
+	if err != nil {
+		return store.Query{}, err
+	}
+	r.skipSpace()
+	if r.off < len(r.src) {
+		return store.Query{}, r.errorf(r.pos(), "unexpected input after query")
+	}
+
+	c := &compiler{}
+	q, err := c.compile(top)
+	if err != nil {
+		return store.Query{}, err
+	}
+	if err := q.Validate(); err != nil {
+		return store.Query{}, fmt.Errorf("invalid query: %w", err)
+	}
+	return q, nil
+}
+
+// MustParse is like Parse, but it panics if the query is invalid.
+func MustParse(src string) store.Query {
+	q, err := Parse(src)
+	if err != nil {
+		panic(err)
+	}
+	return q
+}
+
+// ParseEntity parses a reference to an entity written as it would be in the
+// entity position of a query: an integer entity ID, a keyword naming an
+// ident, or a lookup vector such as [:person/email "alice@example.com"].
+func ParseEntity(src string) (store.Resolver, error) {
+	r := &reader{src: src, line: 1, col: 1}
+	n, err := r.read()
+	if err != nil {
+		return nil, err
+	}
+	r.skipSpace()
+	if r.off < len(r.src) {
+		return nil, r.errorf(r.pos(), "unexpected input after entity")
+	}
+
+	c := &compiler{}
+	if n.kind == nodeSymbol {
+		return nil, c.errorf(n, "expected an entity, got %s", n.describe())
+	}
+	term, err := c.entityTerm(n)
+	if err != nil {
+		return nil, err
+	}
+	switch v := term.(type) {
+	case string:
+		return store.Ident{Name: v}, nil
+	case store.Resolver:
+		return v, nil
+	default:
+		return nil, c.errorf(n, "expected an entity, got %s", n.describe())
+	}
+}
+
+// SyntaxError describes a malformed query.
+type SyntaxError struct {
+	Line, Col int
+	Msg       string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("%d:%d: %s", e.Line, e.Col, e.Msg)
+}
+
+type position struct {
+	line, col int
+}
+
+type nodeKind int
+
+const (
+	nodeVector nodeKind = iota
+	nodeList
+	nodeKeyword
+	nodeSymbol
+	nodeValue
+	nodeNil
+)
+
+// node is a form read from the source of a query.
+type node struct {
+	kind nodeKind
+	pos  position
+	// name is the name of a keyword, without its colon, or a symbol.
+	name string
+	// val is the value of a literal.
+	val store.Value
+	// items are the elements of a vector or list.
+	items []node
+}
+
+func (n node) describe() string {
+	switch n.kind {
+	case nodeVector:
+		return "vector"
+	case nodeList:
+		return "list"
+	case nodeKeyword:
+		return ":" + n.name
+	case nodeSymbol:
+		return n.name
+	case nodeNil:
+		return "nil"
+	default:
+		return fmt.Sprintf("%#v", n.val)
+	}
+}
+
+// reader reads forms from the source of a query.
+type reader struct {
+	src       string
+	off       int
+	line, col int
+}
+
+func (r *reader) pos() position {
+	return position{line: r.line, col: r.col}
+}
+
+func (r *reader) errorf(pos position, format string, args ...any) error {
+	return &SyntaxError{Line: pos.line, Col: pos.col, Msg: fmt.Sprintf(format, args...)}
+}
+
+func (r *reader) peek() byte {
+	return r.src[r.off]
+}
+
+func (r *reader) advance() byte {
+	b := r.src[r.off]
+	r.off++
+	if b == '\n' {
+		r.line++
+		r.col = 1
+	} else {
+		r.col++
+	}
+	return b
+}
+
+func (r *reader) skipSpace() {
+	for r.off < len(r.src) {
+		switch b := r.peek(); {
+		case b == ';':
+			for r.off < len(r.src) && r.peek() != '\n' {
+				r.advance()
+			}
+		case b == ',' || unicode.IsSpace(rune(b)):
+			r.advance()
+		default:
+			return
+		}
+	}
+}
+
+func isDelimiter(b byte) bool {
+	return b == ',' || b == ';' || b == '"' || strings.IndexByte("[](){}", b) >= 0 || unicode.IsSpace(rune(b))
+}
+
+func (r *reader) read() (node, error) {
+	r.skipSpace()
+	pos := r.pos()
+	if r.off >= len(r.src) {
+		return node{}, r.errorf(pos, "unexpected end of query")
+	}
+	switch b := r.peek(); b {
+	case '[':
+		r.advance()
+		items, err := r.readSeq(']')
+		return node{kind: nodeVector, pos: pos, items: items}, err
+	case '(':
+		r.advance()
+		items, err := r.readSeq(')')
+		return node{kind: nodeList, pos: pos, items: items}, err
+	case ']', ')', '{', '}':
+		return node{}, r.errorf(pos, "unexpected %q", b)
+	case '"':
+		s, err := r.readString()
+		return node{kind: nodeValue, pos: pos, val: s}, err
+	case '#':
+		return r.readTagged()
+	default:
+		return r.readAtom()
+	}
+}
+
+func (r *reader) readSeq(end byte) ([]node, error) {
+	var items []node
+	for {
+		r.skipSpace()
+		if r.off >= len(r.src) {
+			return nil, r.errorf(r.pos(), "unexpected end of query, expected %q", end)
+		}
+		if r.peek() == end {
+			r.advance()
+			return items, nil
+		}
+		item, err := r.read()
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+}
+
+func (r *reader) readString() (string, error) {
+	pos := r.pos()
+	start := r.off
+	r.advance()
+	for r.off < len(r.src) {
+		switch r.advance() {
+		case '\\':
+			if r.off < len(r.src) {
+				r.advance()
+			}
+		case '"':
+			s, err := strconv.Unquote(r.src[start:r.off])
+			if err != nil {
+				return "", r.errorf(pos, "invalid string: %v", err)
+			}
+			return s, nil
+		}
+	}
+	return "", r.errorf(pos, "unterminated string")
+}
+
+func (r *reader) readToken() string {
+	start := r.off
+	for r.off < len(r.src) && !isDelimiter(r.peek()) {
+		r.advance()
+	}
+	return r.src[start:r.off]
+}
+
+func (r *reader) readTagged() (node, error) {
+	pos := r.pos()
+	r.advance()
+	tag := r.readToken()
+	if tag != "inst" {
+		return node{}, r.errorf(pos, "unknown tag #%s", tag)
+	}
+	r.skipSpace()
+	if r.off >= len(r.src) || r.peek() != '"' {
+		return node{}, r.errorf(r.pos(), "#inst must be followed by a string")
+	}
+	s, err := r.readString()
+	if err != nil {
+		return node{}, err
+	}
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		return node{}, r.errorf(pos, "invalid #inst: %v", err)
+	}
+	return node{kind: nodeValue, pos: pos, val: t}, nil
+}
+
+func (r *reader) readAtom() (node, error) {
+	pos := r.pos()
+	tok := r.readToken()
+	switch {
+	case tok == "":
+		return node{}, r.errorf(pos, "unexpected %q", r.peek())
+	case tok == "nil":
+		return node{kind: nodeNil, pos: pos}, nil
+	case tok == "true" || tok == "false":
+		return node{kind: nodeValue, pos: pos, val: tok == "true"}, nil
+	case tok[0] == ':':
+		if len(tok) == 1 {
+			return node{}, r.errorf(pos, "empty keyword")
+		}
+		return node{kind: nodeKeyword, pos: pos, name: tok[1:]}, nil
+	}
+	if isNumberStart(tok) {
+		if n, err := strconv.ParseInt(tok, 10, 64); err == nil {
+			return node{kind: nodeValue, pos: pos, val: n}, nil
+		}
+		f, err := strconv.ParseFloat(tok, 64)
+		if err != nil {
+			return node{}, r.errorf(pos, "invalid number %q", tok)
+		}
+		return node{kind: nodeValue, pos: pos, val: f}, nil
+	}
+	return node{kind: nodeSymbol, pos: pos, name: tok}, nil
+}
+
+func isNumberStart(tok string) bool {
+	if tok[0] == '-' || tok[0] == '+' {
+		tok = tok[1:]
+	}
+	return tok != "" && tok[0] >= '0' && tok[0] <= '9'
+}
+
+// compiler compiles the forms of a query to a store.Query.
+type compiler struct {
+	// wildcards counts the _ variables, each of which is given a unique name.
+	wildcards int
+}
+
+func (c *compiler) errorf(n node, format string, args ...any) error {
+	return &SyntaxError{Line: n.pos.line, Col: n.pos.col, Msg: fmt.Sprintf(format, args...)}
+}
+
+func (c *compiler) compile(top node) (store.Query, error) {
+	var q store.Query
+	if top.kind != nodeVector {
+		return q, c.errorf(top, "query must be a vector, not %s", top.describe())
+	}
+
+	var section string
+	seen := make(map[string]bool)
+	var errs []error
+	for _, n := range top.items {
+		if n.kind == nodeKeyword {
+			switch n.name {
+			case "find", "in", "where":
+			default:
+				return q, c.errorf(n, "unknown section :%s", n.name)
+			}
+			if seen[n.name] {
+				return q, c.errorf(n, "duplicate section :%s", n.name)
+			}
+			seen[n.name] = true
+			section = n.name
+			continue
+		}
+
+		var err error
+		switch section {
+		case "":
+			err = c.errorf(n, "expected :find, got %s", n.describe())
+		case "find":
+			if n.kind != nodeSymbol || !isVar(n.name) {
+				err = c.errorf(n, ":find expects variables, got %s", n.describe())
+				break
+			}
+			q.Find = append(q.Find, store.Var(n.name))
+		case "in":
+			if n.kind != nodeSymbol || !strings.HasPrefix(n.name, "$") {
+				err = c.errorf(n, ":in expects sources, got %s", n.describe())
+				break
+			}
+			q.In = append(q.In, n.name)
+		case "where":
+			var clause store.Clause
+			clause, err = c.clause(n)
+			if err == nil {
+				q.Where = append(q.Where, clause)
+			}
+		}
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if !seen["find"] {
+		errs = append(errs, c.errorf(top, "query has no :find section"))
+	}
+	return q, errors.Join(errs...)
+}
+
+func (c *compiler) clause(n node) (store.Clause, error) {
+	if n.kind != nodeVector {
+		return nil, c.errorf(n, "expected a pattern, got %s", n.describe())
+	}
+	items := n.items
+	if len(items) > 0 && items[0].kind == nodeList {
+		return c.functionClause(n)
+	}
+	var source string
+	if len(items) > 0 && items[0].kind == nodeSymbol && strings.HasPrefix(items[0].name, "$") {
+		source = items[0].name
+		items = items[1:]
+		if isGroup(items) {
+			return c.group(source, items)
+		}
+	}
+	if len(items) != 3 {
+		return nil, c.errorf(n, "pattern must have an entity, attribute, and value, got %d terms", len(items))
+	}
+	entity, err := c.entityTerm(items[0])
+	if err != nil {
+		return nil, err
+	}
+	attribute, err := c.attributeTerm(items[1])
+	if err != nil {
+		return nil, err
+	}
+	value, err := c.valueTerm(items[2])
+	if err != nil {
+		return nil, err
+	}
+	return store.Pattern{
+		Source:    source,
+		Entity:    entity,
+		Attribute: attribute,
+		Value:     value,
+	}, nil
+}
+
+// isGroup reports whether the items that follow a source are clauses rather
+// than the terms of a pattern. Since the attribute of a pattern is never a
+// vector, items that are all vectors are clauses.
+func isGroup(items []node) bool {
+	for _, item := range items {
+		if item.kind != nodeVector {
+			return false
+		}
+	}
+	return len(items) > 0
+}
+
+// group compiles a group of clauses against a source, [$src clauses...].
+func (c *compiler) group(source string, items []node) (store.Clause, error) {
+	g := store.Group{Source: source}
+	for _, item := range items {
+		clause, err := c.clause(item)
+		if err != nil {
+			return nil, err
+		}
+		g.Clauses = append(g.Clauses, clause)
+	}
+	return g, nil
+}
+
+// functionClause compiles a Predicate, [(fn args...)], or a Call,
+// [(fn args...) ?out].
+func (c *compiler) functionClause(n node) (store.Clause, error) {
+	call := n.items[0]
+	if len(call.items) == 0 || call.items[0].kind != nodeSymbol {
+		return nil, c.errorf(call, "function call must begin with a function name")
+	}
+	fn := call.items[0].name
+	args := make([]any, len(call.items)-1)
+	for i, item := range call.items[1:] {
+		arg, err := c.valueTerm(item)
+		if err != nil {
+			return nil, err
+		}
+		args[i] = arg
+	}
+	switch len(n.items) {
+	case 1:
+		return store.Predicate{Fn: fn, Args: args}, nil
+	case 2:
+		if n.items[1].kind != nodeSymbol {
+			return nil, c.errorf(n.items[1], "expected a variable to bind, got %s", n.items[1].describe())
+		}
+		bind, err := c.variable(n.items[1])
+		if err != nil {
+			return nil, err
+		}
+		return store.Call{Fn: fn, Args: args, Bind: bind}, nil
+	default:
+		return nil, c.errorf(n, "function clause must be a call followed by at most one variable")
+	}
+}
+
+// variable returns the variable named by a symbol.
+func (c *compiler) variable(n node) (store.Var, error) {
+	if n.name == "_" {
+		c.wildcards++
+		return store.Var(fmt.Sprintf("?_%d", c.wildcards)), nil
+	}
+	if !isVar(n.name) {
+		return "", c.errorf(n, "unknown symbol %s; variables begin with \"?\"", n.name)
+	}
+	return store.Var(n.name), nil
+}
+
+func (c *compiler) entityTerm(n node) (any, error) {
+	switch n.kind {
+	case nodeSymbol:
+		return c.variable(n)
+	case nodeKeyword:
+		return n.name, nil
+	case nodeVector:
+		if len(n.items) != 2 || n.items[0].kind != nodeKeyword || n.items[1].kind != nodeValue {
+			return nil, c.errorf(n, "lookup must be a vector of an attribute and a value")
+		}
+		return store.NewLookup(n.items[0].name, n.items[1].val), nil
+	case nodeValue:
+		if id, ok := n.val.(int64); ok {
+			return store.ID(id), nil
+		}
+	}
+	return nil, c.errorf(n, "expected an entity, got %s", n.describe())
+}
+
+func (c *compiler) attributeTerm(n node) (any, error) {
+	switch n.kind {
+	case nodeSymbol:
+		return c.variable(n)
+	case nodeKeyword:
+		return n.name, nil
+	}
+	return nil, c.errorf(n, "expected an attribute, got %s", n.describe())
+}
+
+func (c *compiler) valueTerm(n node) (any, error) {
+	switch n.kind {
+	case nodeSymbol:
+		return c.variable(n)
+	case nodeKeyword:
+		return n.name, nil
+	case nodeValue:
+		return n.val, nil
+	}
+	return nil, c.errorf(n, "expected a value, got %s", n.describe())
+}
@@ -0,0 +1,263 @@
+/*
+Copyright 2024 Andrew Meredith
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package query_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kendru/canter/internal/store"
+	"github.com/kendru/canter/internal/store/query"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParse(t *testing.T) {
+	q, err := query.Parse(`
+		; Who changed their name?
+		[:find ?old ?new, ?t
+		 :in $ $before
+		 :where
+		 [?e :person/email "ada@example.com"]
+		 [$before ?e :person/name ?old]
+		 [?e :person/name ?new]
+		 [[:person/email "bo@example.com"] _ ?t]
+		 [42 :person/age -7]
+		 [?e :person/born #inst "2024-01-02T15:04:05Z"]
+		 [?e :person/score 1.5]
+		 [?e :person/active true]
+		 [?e :person/friend :person/nobody]
+		 [?e _ "tab\there"]]`)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, store.Query{
+		Find: []store.Var{"?old", "?new", "?t"},
+		In:   []string{"$", "$before"},
+		Where: []store.Clause{
+			store.Pattern{Entity: store.Var("?e"), Attribute: "person/email", Value: "ada@example.com"},
+			store.Pattern{Source: "$before", Entity: store.Var("?e"), Attribute: "person/name", Value: store.Var("?old")},
+			store.Pattern{Entity: store.Var("?e"), Attribute: "person/name", Value: store.Var("?new")},
+			store.Pattern{Entity: store.NewLookup("person/email", "bo@example.com"), Attribute: store.Var("?_1"), Value: store.Var("?t")},
+			store.Pattern{Entity: store.ID(42), Attribute: "person/age", Value: int64(-7)},
+			store.Pattern{Entity: store.Var("?e"), Attribute: "person/born", Value: time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC)},
+			store.Pattern{Entity: store.Var("?e"), Attribute: "person/score", Value: 1.5},
+			store.Pattern{Entity: store.Var("?e"), Attribute: "person/active", Value: true},
+			store.Pattern{Entity: store.Var("?e"), Attribute: "person/friend", Value: "person/nobody"},
+			store.Pattern{Entity: store.Var("?e"), Attribute: store.Var("?_2"), Value: "tab\there"},
+		},
+	}, q)
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		src      string
+		contains string
+	}{
+		{`[:find ?e :where [?e :a/b]`, `1:27: unexpected end of query, expected ']'`},
+		{`[:find ?e :where [?e :a/b ?v]] extra`, "unexpected input after query"},
+		{`{:find ?e}`, `unexpected '{'`},
+		{`[:where [?e :a/b ?v]]`, "query has no :find section"},
+		{`[:find e :where [?e :a/b ?v]]`, ":find expects variables, got e"},
+		{`[:find ?e :in db :where [?e :a/b ?v]]`, ":in expects sources, got db"},
+		{`[:find ?e :with ?v]`, "unknown section :with"},
+		{`[:find ?e :find ?v]`, "duplicate section :find"},
+		{`[:find ?e :where [?e "a/b" ?v]]`, `expected an attribute, got "a/b"`},
+		{`[:find ?e :where [?e :a/b]]`, "got 2 terms"},
+		{`[:find ?e :where [?e :a/b nil]]`, "expected a value, got nil"},
+		{`[:find ?e :where [?e :a/b v]]`, `unknown symbol v`},
+		{`[:find ?e :where [[:a/b] :a/b ?v]]`, "lookup must be a vector"},
+		{`[:find ?e :where [?e :a/b "unterminated]]`, "unterminated string"},
+		{`[:find ?e :where [?e :a/b #uuid "x"]]`, "unknown tag #uuid"},
+		{`[:find ?e :where [?e :a/b #inst "yesterday"]]`, "invalid #inst"},
+		{`[:find ?e :where [?e :a/b 1.2.3]]`, `invalid number "1.2.3"`},
+		{`[:find ?e ?x :where [?e :a/b ?v]]`, "find variable ?x is not bound"},
+		{`[:find ?e :where (foo ?e)]`, "expected a pattern, got list"},
+		{`[:find ?e :where [$ [?e :a/b ?v] ?e]]`, "got 2 terms"},
+		{`[:find ?e :where [$ [?e :a/b ?v] [?e :a/b]]]`, "got 2 terms"},
+		{`[:find ?e :where [?e :a/b ?v] [(1 ?v)]]`, "function call must begin with a function name"},
+		{`[:find ?e :where [?e :a/b ?v] [(inc ?v) 1]]`, "expected a variable to bind, got 1"},
+		{`[:find ?e :where [?e :a/b ?v] [(inc ?v) ?w ?x]]`, "at most one variable"},
+		{`[:find ?e :where [?e :a/b ?v] [(> ?x 1)]]`, "function argument ?x is not bound"},
+	}
+	for _, tt := range tests {
+		_, err := query.Parse(tt.src)
+		if assert.Error(t, err, tt.src) {
+			assert.Contains(t, err.Error(), tt.contains, tt.src)
+		}
+	}
+
+	_, err := query.Parse("[:find ?e\n :where [?e :a/b]]")
+	var syntaxErr *query.SyntaxError
+	if assert.True(t, errors.As(err, &syntaxErr)) {
+		assert.Equal(t, 2, syntaxErr.Line)
+		assert.Equal(t, 9, syntaxErr.Col)
+	}
+}
+
+func TestParseFunctions(t *testing.T) {
+	q := query.MustParse(`
+		[:find ?upper
+		 :where [?e :person/age ?age]
+		        [(>= ?age 18)]
+		        [?e :person/name ?name]
+		        [(str/upper ?name) ?upper]]`)
+	assert.Equal(t, []store.Clause{
+		store.Pattern{Entity: store.Var("?e"), Attribute: "person/age", Value: store.Var("?age")},
+		store.Predicate{Fn: ">=", Args: []any{store.Var("?age"), int64(18)}},
+		store.Pattern{Entity: store.Var("?e"), Attribute: "person/name", Value: store.Var("?name")},
+		store.Call{Fn: "str/upper", Args: []any{store.Var("?name")}, Bind: "?upper"},
+	}, q.Where)
+
+	conn := newConn(t)
+	rows, err := conn.DB().Query(q)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"ADA", "WHO"}, names(rows))
+}
+
+func TestParseGroups(t *testing.T) {
+	q := query.MustParse(`
+		[:find ?name
+		 :in $ $other
+		 :where [$other [?e :person/name ?name] [(str/starts-with? ?name "A")]]
+		        [$other ?e :person/age 36]
+		        [?e2 :person/name ?name]]`)
+	assert.Equal(t, []store.Clause{
+		store.Group{Source: "$other", Clauses: []store.Clause{
+			store.Pattern{Entity: store.Var("?e"), Attribute: "person/name", Value: store.Var("?name")},
+			store.Predicate{Fn: "str/starts-with?", Args: []any{store.Var("?name"), "A"}},
+		}},
+		store.Pattern{Source: "$other", Entity: store.Var("?e"), Attribute: "person/age", Value: int64(36)},
+		store.Pattern{Entity: store.Var("?e2"), Attribute: "person/name", Value: store.Var("?name")},
+	}, q.Where)
+
+	conn, other := newConn(t), newConn(t)
+	rows, err := store.RunQuery(q, conn.DB(), other.DB())
+	assert.NoError(t, err)
+	assert.Equal(t, [][]store.Value{{"Ada"}}, rows)
+}
+
+func TestParseAndRun(t *testing.T) {
+	conn := newConn(t)
+	rows, err := conn.DB().Query(query.MustParse(`
+		[:find ?name
+		 :where [?e :person/age 17] [?e :person/name ?name]]`))
+	assert.NoError(t, err)
+	assert.Equal(t, [][]store.Value{{"Bo"}}, rows)
+
+	h := query.Handler(conn.Connection)
+	post := func(body string) (int, map[string]any) {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/query", strings.NewReader(body)))
+		var resp map[string]any
+		assert.NoError(t, json.NewDecoder(rec.Body).Decode(&resp))
+		return rec.Code, resp
+	}
+	code, resp := post(`[:find ?name :where [[:person/email "ada@example.com"] :person/name ?name]]`)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, []any{[]any{"Ada"}}, resp["rows"])
+	assert.Equal(t, float64(conn.DB().Basis.ID()), resp["basis"])
+
+	assert.Equal(t, conn.DB().Token(), resp["token"])
+
+	code, resp = post(`[:find ?name :where [?e :person/name ?name] [?e :person/age 99]]`)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, []any{}, resp["rows"])
+
+	code, resp = post(`[:find ?name`)
+	assert.Equal(t, http.StatusBadRequest, code)
+	assert.Contains(t, resp["error"], "unexpected end of query")
+
+	code, _ = post(`[:find ?v :where [[:person/name "Ada"] :person/age ?v]]`)
+	assert.Equal(t, http.StatusUnprocessableEntity, code)
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/query", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+
+	since := func(token string) int {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/query", strings.NewReader(`[:find ?name :where [?e :person/age 17] [?e :person/name ?name]]`))
+		req.Header.Set(query.SinceHeader, token)
+		ctx, cancel := context.WithTimeout(req.Context(), 20*time.Millisecond)
+		defer cancel()
+		h.ServeHTTP(rec, req.WithContext(ctx))
+		return rec.Code
+	}
+	assert.Equal(t, http.StatusOK, since(conn.DB().Token()))
+	assert.Equal(t, http.StatusBadRequest, since("not a token"))
+}
+
+func TestHandlerStreaming(t *testing.T) {
+	conn := newConn(t)
+	var people []store.Assertable
+	for i := 0; i < 300; i++ {
+		people = append(people, store.EntityData{"person/email": fmt.Sprintf("p%d@example.com", i)})
+	}
+	conn.MustAssert(people...)
+
+	// Rows are flushed in batches as they are written.
+	rec := httptest.NewRecorder()
+	query.Handler(conn.Connection).ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/query",
+		strings.NewReader(`[:find ?email :where [?e :person/email ?email]]`)))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.True(t, rec.Flushed)
+	var resp query.Response
+	if assert.NoError(t, json.NewDecoder(rec.Body).Decode(&resp)) {
+		assert.Len(t, resp.Rows, 303)
+		assert.Equal(t, conn.DB().Basis.ID(), resp.Basis)
+	}
+
+	// QueryEach stops at the first error from its callback.
+	stop := errors.New("stop")
+	var n int
+	err := conn.DB().QueryEach(query.MustParse(`[:find ?email :where [?e :person/email ?email]]`), func(row []store.Value) error {
+		n++
+		if n == 10 {
+			return stop
+		}
+		return nil
+	})
+	assert.ErrorIs(t, err, stop)
+	assert.Equal(t, 10, n)
+}
+
+func TestParseEntity(t *testing.T) {
+	for src, want := range map[string]store.Resolver{
+		`42`:                         store.ID(42),
+		`:person/nobody`:             store.Ident{Name: "person/nobody"},
+		`[:person/email "a@b.c"]`:    store.NewLookup("person/email", "a@b.c"),
+		` [:person/id 7] ; comment `: store.NewLookup("person/id", int64(7)),
+	} {
+		got, err := query.ParseEntity(src)
+		if assert.NoError(t, err, src) {
+			assert.Equal(t, want, got, src)
+		}
+	}
+
+	for _, src := range []string{`?e`, `"alice"`, `[:person/email]`, `42 43`, `[`} {
+		_, err := query.ParseEntity(src)
+		var syntaxErr *query.SyntaxError
+		assert.ErrorAs(t, err, &syntaxErr, src)
+	}
+}
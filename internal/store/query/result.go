@@ -0,0 +1,361 @@
+/*
+Copyright 2024 Andrew Meredith
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package query
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/kendru/canter/internal/store"
+)
+
+// ErrNoRows is returned by Result.Scan when a single row is scanned from a
+// result that has none.
+var ErrNoRows = errors.New("query returned no rows")
+
+// Result is the result of a query: a row of values for each distinct binding
+// of the query's Find variables.
+type Result struct {
+	Vars []store.Var
+	Rows [][]store.Value
+}
+
+// Exec runs a query against dbs and returns its result. See store.RunQuery.
+func Exec(q store.Query, dbs ...store.Database) (*Result, error) {
+	rows, err := store.RunQuery(q, dbs...)
+	if err != nil {
+		return nil, err
+	}
+	return &Result{Vars: q.Find, Rows: rows}, nil
+}
+
+// Exec builds the query, runs it against dbs, and returns its result.
+func (b Builder) Exec(dbs ...store.Database) (*Result, error) {
+	q, err := b.Build()
+	if err != nil {
+		return nil, err
+	}
+	return Exec(q, dbs...)
+}
+
+// Len returns the number of rows in the result.
+func (r *Result) Len() int {
+	return len(r.Rows)
+}
+
+// Index returns the column of the variable v, or -1 if v is not one of the
+// result's variables. The "?" of v may be omitted.
+func (r *Result) Index(v string) int {
+	if !isVar(v) {
+		v = "?" + v
+	}
+	for i, name := range r.Vars {
+		if string(name) == v {
+			return i
+		}
+	}
+	return -1
+}
+
+// Scan copies the result into dest, which must be a pointer to a struct or to
+// a slice of structs or struct pointers. A struct receives the first row, or
+// ErrNoRows if there is none, and a slice has every row appended to it.
+//
+// Each exported field of the struct receives the value of the variable named
+// by its `canter` tag, e.g. `canter:"?name"`, or, if it has no tag, of the
+// variable whose name matches the field's name case-insensitively. Fields
+// tagged `canter:"-"`, and untagged fields that match no variable, are left
+// unchanged. Values are converted to the types of their fields as by Get.
+func (r *Result) Scan(dest any) error {
+	ptr := reflect.ValueOf(dest)
+	if ptr.Kind() != reflect.Pointer || ptr.IsNil() {
+		return fmt.Errorf("scan destination must be a non-nil pointer, got %T", dest)
+	}
+	target := ptr.Elem()
+
+	if target.Kind() == reflect.Slice {
+		elemType := target.Type().Elem()
+		structType := elemType
+		if structType.Kind() == reflect.Pointer {
+			structType = structType.Elem()
+		}
+		m, err := r.mapper(structType)
+		if err != nil {
+			return err
+		}
+		out := target
+		for _, row := range r.Rows {
+			elem := reflect.New(structType)
+			if err := m.scan(row, elem.Elem()); err != nil {
+				return err
+			}
+			if elemType.Kind() != reflect.Pointer {
+				elem = elem.Elem()
+			}
+			out = reflect.Append(out, elem)
+		}
+		target.Set(out)
+		return nil
+	}
+
+	m, err := r.mapper(target.Type())
+	if err != nil {
+		return err
+	}
+	if len(r.Rows) == 0 {
+		return ErrNoRows
+	}
+	return m.scan(r.Rows[0], target)
+}
+
+// Column returns the values of the variable v in every row of the result,
+// converted to T as by Get.
+func Column[T any](r *Result, v string) ([]T, error) {
+	i := r.Index(v)
+	if i < 0 {
+		return nil, fmt.Errorf("result has no variable %s", v)
+	}
+	out := make([]T, len(r.Rows))
+	for j, row := range r.Rows {
+		val, err := Get[T](row, i)
+		if err != nil {
+			return nil, fmt.Errorf("row %d: %w", j, err)
+		}
+		out[j] = val
+	}
+	return out, nil
+}
+
+// Tuple2 is a row of a query that finds two variables.
+type Tuple2[A, B any] struct {
+	V1 A
+	V2 B
+}
+
+// Tuple3 is a row of a query that finds three variables.
+type Tuple3[A, B, C any] struct {
+	V1 A
+	V2 B
+	V3 C
+}
+
+// Tuples2 returns the rows of a result of two variables as tuples.
+func Tuples2[A, B any](r *Result) ([]Tuple2[A, B], error) {
+	out := make([]Tuple2[A, B], len(r.Rows))
+	for i, row := range r.Rows {
+		if err := checkWidth(row, 2); err != nil {
+			return nil, err
+		}
+		var errs [2]error
+		out[i].V1, errs[0] = Get[A](row, 0)
+		out[i].V2, errs[1] = Get[B](row, 1)
+		if err := errors.Join(errs[:]...); err != nil {
+			return nil, fmt.Errorf("row %d: %w", i, err)
+		}
+	}
+	return out, nil
+}
+
+// Tuples3 returns the rows of a result of three variables as tuples.
+func Tuples3[A, B, C any](r *Result) ([]Tuple3[A, B, C], error) {
+	out := make([]Tuple3[A, B, C], len(r.Rows))
+	for i, row := range r.Rows {
+		if err := checkWidth(row, 3); err != nil {
+			return nil, err
+		}
+		var errs [3]error
+		out[i].V1, errs[0] = Get[A](row, 0)
+		out[i].V2, errs[1] = Get[B](row, 1)
+		out[i].V3, errs[2] = Get[C](row, 2)
+		if err := errors.Join(errs[:]...); err != nil {
+			return nil, fmt.Errorf("row %d: %w", i, err)
+		}
+	}
+	return out, nil
+}
+
+func checkWidth(row []store.Value, n int) error {
+	if len(row) != n {
+		return fmt.Errorf("expected rows of %d values, got %d", n, len(row))
+	}
+	return nil
+}
+
+// Get returns the i-th value of a row as a T. Values are converted between
+// numeric types, e.g. an int64 may be read as an int or a store.ID, as long
+// as the value fits, and between string types. A pointer type receives a
+// pointer to the converted value.
+func Get[T any](row []store.Value, i int) (T, error) {
+	var out T
+	if i < 0 || i >= len(row) {
+		return out, fmt.Errorf("column %d is out of range for a row of %d values", i, len(row))
+	}
+	if val, ok := row[i].(T); ok {
+		return val, nil
+	}
+	val, err := convert(row[i], reflect.TypeOf(&out).Elem())
+	if err != nil {
+		return out, fmt.Errorf("column %d: %w", i, err)
+	}
+	return val.Interface().(T), nil
+}
+
+// convert converts a query value to the type t.
+func convert(val store.Value, t reflect.Type) (reflect.Value, error) {
+	if val == nil {
+		return reflect.Zero(t), nil
+	}
+	v := reflect.ValueOf(val)
+	if v.Type().AssignableTo(t) {
+		return v, nil
+	}
+	if t.Kind() == reflect.Pointer {
+		elem, err := convert(val, t.Elem())
+		if err != nil {
+			return reflect.Value{}, err
+		}
+		ptr := reflect.New(t.Elem())
+		ptr.Elem().Set(elem)
+		return ptr, nil
+	}
+
+	out := reflect.New(t).Elem()
+	switch {
+	case isInt(v.Kind()) && isInt(t.Kind()):
+		if n := v.Int(); !out.OverflowInt(n) {
+			out.SetInt(n)
+			return out, nil
+		}
+	case isInt(v.Kind()) && isUint(t.Kind()):
+		if n := v.Int(); n >= 0 && !out.OverflowUint(uint64(n)) {
+			out.SetUint(uint64(n))
+			return out, nil
+		}
+	case isInt(v.Kind()) && isFloat(t.Kind()):
+		out.SetFloat(float64(v.Int()))
+		return out, nil
+	case isFloat(v.Kind()) && isFloat(t.Kind()):
+		if f := v.Float(); !out.OverflowFloat(f) {
+			out.SetFloat(f)
+			return out, nil
+		}
+	case v.Kind() == reflect.String && t.Kind() == reflect.String:
+		out.SetString(v.String())
+		return out, nil
+	default:
+		return reflect.Value{}, fmt.Errorf("cannot convert %T to %s", val, t)
+	}
+	return reflect.Value{}, fmt.Errorf("value %v of type %T overflows %s", val, val, t)
+}
+
+func isInt(k reflect.Kind) bool {
+	return k >= reflect.Int && k <= reflect.Int64
+}
+
+func isUint(k reflect.Kind) bool {
+	return k >= reflect.Uint && k <= reflect.Uintptr
+}
+
+func isFloat(k reflect.Kind) bool {
+	return k == reflect.Float32 || k == reflect.Float64
+}
+
+// structMapper maps the columns of a result to the fields of a struct.
+type structMapper struct {
+	// fields are the indexes of the fields, by column. A field index is nil
+	// for columns that are not scanned.
+	fields [][]int
+}
+
+// structFields caches the variable names of the fields of struct types.
+var structFields sync.Map // map[reflect.Type][]structField
+
+type structField struct {
+	index []int
+	// name is the name of the variable that the field receives, without its
+	// "?".
+	name string
+	// tagged is set if the name was given by a tag.
+	tagged bool
+}
+
+// fieldsOf returns the fields of a struct type that may receive values.
+func fieldsOf(t reflect.Type) []structField {
+	if cached, ok := structFields.Load(t); ok {
+		return cached.([]structField)
+	}
+	var fields []structField
+	for _, f := range reflect.VisibleFields(t) {
+		if !f.IsExported() || f.Anonymous {
+			continue
+		}
+		tag := f.Tag.Get("canter")
+		switch {
+		case tag == "-":
+			continue
+		case tag != "":
+			fields = append(fields, structField{index: f.Index, name: strings.TrimPrefix(tag, "?"), tagged: true})
+		default:
+			fields = append(fields, structField{index: f.Index, name: f.Name})
+		}
+	}
+	structFields.Store(t, fields)
+	return fields
+}
+
+func (r *Result) mapper(t reflect.Type) (structMapper, error) {
+	if t.Kind() != reflect.Struct {
+		return structMapper{}, fmt.Errorf("cannot scan into %s; expected a struct", t)
+	}
+	m := structMapper{fields: make([][]int, len(r.Vars))}
+	for _, f := range fieldsOf(t) {
+		col := -1
+		for i, v := range r.Vars {
+			name := strings.TrimPrefix(string(v), "?")
+			if name == f.name || (!f.tagged && strings.EqualFold(name, f.name)) {
+				col = i
+				break
+			}
+		}
+		if col < 0 {
+			if f.tagged {
+				return structMapper{}, fmt.Errorf("field %s of %s: result has no variable ?%s", t.FieldByIndex(f.index).Name, t, f.name)
+			}
+			continue
+		}
+		m.fields[col] = f.index
+	}
+	return m, nil
+}
+
+func (m structMapper) scan(row []store.Value, dest reflect.Value) error {
+	for col, index := range m.fields {
+		if index == nil {
+			continue
+		}
+		field := dest.FieldByIndex(index)
+		val, err := convert(row[col], field.Type())
+		if err != nil {
+			return fmt.Errorf("field %s: %w", dest.Type().FieldByIndex(index).Name, err)
+		}
+		field.Set(val)
+	}
+	return nil
+}
@@ -0,0 +1,130 @@
+/*
+Copyright 2024 Andrew Meredith
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package query_test
+
+import (
+	"sort"
+	"testing"
+
+	"github.com/kendru/canter/internal/store"
+	"github.com/kendru/canter/internal/store/query"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResultScan(t *testing.T) {
+	conn := newConn(t)
+	res, err := query.Find("?e", "?name", "?age").
+		Where("?e", "person/name", "?name").
+		Where("?e", "person/age", "?age").
+		Exec(conn.DB())
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, 3, res.Len())
+	assert.Equal(t, 1, res.Index("?name"))
+	assert.Equal(t, 2, res.Index("age"))
+	assert.Equal(t, -1, res.Index("?email"))
+
+	type person struct {
+		ID      store.ID `canter:"?e"`
+		Name    string
+		Years   int `canter:"age"`
+		Ignored string
+		Skipped int64 `canter:"-"`
+	}
+	var people []person
+	if assert.NoError(t, res.Scan(&people)) {
+		sort.Slice(people, func(i, j int) bool { return people[i].Name < people[j].Name })
+		assert.Len(t, people, 3)
+		assert.Equal(t, "Ada", people[0].Name)
+		assert.Equal(t, 36, people[0].Years)
+		assert.NotZero(t, people[0].ID)
+		assert.Empty(t, people[0].Ignored)
+	}
+
+	var ptrs []*person
+	if assert.NoError(t, res.Scan(&ptrs)) {
+		assert.Len(t, ptrs, 3)
+	}
+
+	var one struct {
+		Name *string
+		Age  float64
+	}
+	if assert.NoError(t, res.Scan(&one)) {
+		assert.NotNil(t, one.Name)
+		assert.NotZero(t, one.Age)
+	}
+
+	var small struct{ Age int8 }
+	assert.NoError(t, res.Scan(&small))
+	var wrong struct{ Name int }
+	assert.ErrorContains(t, res.Scan(&wrong), "field Name: cannot convert string to int")
+	var missing struct {
+		Email string `canter:"?email"`
+	}
+	assert.ErrorContains(t, res.Scan(&missing), "result has no variable ?email")
+	assert.ErrorContains(t, res.Scan(one), "must be a non-nil pointer")
+	var n int
+	assert.ErrorContains(t, res.Scan(&n), "expected a struct")
+
+	empty, err := query.Find("?name").Where("?e", "person/name", "?name").Where("?e", "person/age", int64(99)).Exec(conn.DB())
+	if assert.NoError(t, err) {
+		var p struct{ Name string }
+		assert.ErrorIs(t, empty.Scan(&p), query.ErrNoRows)
+		var ps []struct{ Name string }
+		assert.NoError(t, empty.Scan(&ps))
+		assert.Empty(t, ps)
+	}
+}
+
+func TestResultTuples(t *testing.T) {
+	conn := newConn(t)
+	res, err := query.Find("?name", "?age").
+		Where("?e", "person/name", "?name").
+		Where("?e", "person/age", "?age").
+		Exec(conn.DB())
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	ages, err := query.Column[int](res, "?age")
+	assert.NoError(t, err)
+	sort.Ints(ages)
+	assert.Equal(t, []int{17, 36, 50}, ages)
+	_, err = query.Column[int](res, "?name")
+	assert.ErrorContains(t, err, "cannot convert string to int")
+	_, err = query.Column[int](res, "?email")
+	assert.ErrorContains(t, err, "result has no variable ?email")
+
+	pairs, err := query.Tuples2[string, uint](res)
+	assert.NoError(t, err)
+	sort.Slice(pairs, func(i, j int) bool { return pairs[i].V1 < pairs[j].V1 })
+	assert.Equal(t, []query.Tuple2[string, uint]{{"Ada", 36}, {"Bo", 17}, {"Who", 50}}, pairs)
+	_, err = query.Tuples3[string, int, int](res)
+	assert.ErrorContains(t, err, "expected rows of 3 values, got 2")
+
+	name, err := query.Get[string]([]store.Value{"Ada"}, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, "Ada", name)
+	_, err = query.Get[int8]([]store.Value{int64(300)}, 0)
+	assert.ErrorContains(t, err, "overflows int8")
+	_, err = query.Get[uint]([]store.Value{int64(-1)}, 0)
+	assert.ErrorContains(t, err, "overflows uint")
+	_, err = query.Get[string]([]store.Value{"Ada"}, 1)
+	assert.ErrorContains(t, err, "out of range")
+}
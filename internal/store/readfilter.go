@@ -0,0 +1,113 @@
+/*
+Copyright 2024 Andrew Meredith
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+// A view of the database may carry a read filter that hides attributes from
+// a caller, e.g. so that a server which embeds the store can expose
+// person/ssn only to privileged users without duplicating its read logic:
+//
+//	db := conn.WithReadFilter(func(attr store.Ident, eid store.ID) bool {
+//		return attr.Name != "person/ssn" || user.IsAdmin()
+//	})
+//
+// Facts that the filter rejects are invisible to every read of entity data
+// through the view: GetEntity, GetEntities, Pull, EntitiesBy, AttributeFacts,
+// EntityHistory, and the patterns of queries, so a query can neither project
+// nor match on a hidden attribute. A lookup ref on a hidden attribute resolves
+// as though no entity held the value. Computed attributes are derived from the
+// visible attributes only. Schema reads and transactions are not filtered.
+
+// ReadFilter reports whether the attribute attr of the entity eid may be
+// read. It is called for system attributes too. It must be safe for
+// concurrent use.
+type ReadFilter func(attr Ident, eid ID) bool
+
+// WithReadFilter returns a view of the database that only reads the facts
+// that filter allows. If the view already has a filter, a fact must be
+// allowed by both, so a filter can only narrow what a view reads.
+func (db Database) WithReadFilter(filter ReadFilter) Database {
+	if outer := db.readFilter; outer != nil {
+		db.readFilter = func(attr Ident, eid ID) bool {
+			return outer(attr, eid) && filter(attr, eid)
+		}
+	} else {
+		db.readFilter = filter
+	}
+	return db
+}
+
+// WithReadFilter returns a view of the latest database that only reads the
+// facts that filter allows. See Database.WithReadFilter.
+func (conn *Connection) WithReadFilter(filter ReadFilter) Database {
+	return conn.DB().WithReadFilter(filter)
+}
+
+// readFilterCache memoizes the idents of the attributes passed to a read
+// filter over the course of one read.
+type readFilterCache map[ID]Ident
+
+// readable reports whether the view's read filter allows the attribute attrID
+// of the entity eid.
+func (db Database) readable(attrID, eid ID, idents readFilterCache) bool {
+	if db.readFilter == nil {
+		return true
+	}
+	ident, ok := idents[attrID]
+	if !ok {
+		var err error
+		if ident, err = ResolveIdent(db.conn, attrID); err != nil {
+			// Attributes without idents are passed by ID alone.
+			ident = Ident{ID: attrID}
+		}
+		idents[attrID] = ident
+	}
+	return db.readFilter(ident, eid)
+}
+
+// filterFacts removes the facts that the view's read filter rejects, in
+// place.
+func (db Database) filterFacts(facts []Fact) []Fact {
+	if db.readFilter == nil {
+		return facts
+	}
+	idents := make(readFilterCache)
+	visible := facts[:0]
+	for i := range facts {
+		if db.readable(facts[i].Attribute, facts[i].EntityID, idents) {
+			visible = append(visible, facts[i])
+		}
+	}
+	return visible
+}
+
+// filterEntity returns a copy of ent without the attributes that the view's
+// read filter rejects. Entities are shared through the entity cache, so they
+// are never modified in place.
+func (db Database) filterEntity(ent Entity) Entity {
+	if db.readFilter == nil {
+		return ent
+	}
+	idents := make(readFilterCache)
+	filtered := ent
+	filtered.state = make(map[ID]Value, len(ent.state))
+	for attrID, val := range ent.state {
+		if db.readable(attrID, ent.eid, idents) {
+			filtered.state[attrID] = val
+		}
+	}
+	return filtered
+}
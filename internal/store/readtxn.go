@@ -0,0 +1,89 @@
+/*
+Copyright 2024 Andrew Meredith
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// ReadTxn is a read-only transaction. Every read made through the database
+// returned by DB() observes the same snapshot of the indexes, regardless of
+// any transactions committed after the ReadTxn was opened. A ReadTxn must be
+// closed to release the snapshot.
+type ReadTxn struct {
+	db   Database
+	snap IndexSnapshot
+	conn *Connection
+	once sync.Once
+}
+
+// ReadTxn opens a read transaction pinned to the latest committed state of the
+// database.
+func (conn *Connection) ReadTxn() (*ReadTxn, error) {
+	// Load the basis before taking the snapshot so that the snapshot is
+	// guaranteed to include the basis transaction.
+	db := conn.DB()
+	rt := &ReadTxn{conn: conn}
+	if err := conn.lifecycle.beginReadTxn(rt); err != nil {
+		return nil, err
+	}
+	snap, err := conn.indexer.Snapshot()
+	if err != nil {
+		conn.lifecycle.endReadTxn(rt)
+		return nil, fmt.Errorf("opening index snapshot: %w", err)
+	}
+	db.snapshot = snap
+	rt.db = db
+	rt.snap = snap
+	return rt, nil
+}
+
+// DB returns a view of the database pinned to the snapshot of the read
+// transaction. Views derived from it via ValidAt() or AsOf() share the same
+// snapshot.
+func (rt *ReadTxn) DB() Database {
+	return rt.db
+}
+
+// Backup writes a backup of the store as of the read transaction to w. Since
+// the read transaction is pinned to a snapshot, the backup is consistent even
+// though transactions continue to be committed while it is written, and it
+// includes every transaction up to DB().Basis. It fails with
+// errors.ErrUnsupported if the storage cannot write backups.
+func (rt *ReadTxn) Backup(w io.Writer) error {
+	snap, ok := rt.snap.(BackupSnapshot)
+	if !ok {
+		return fmt.Errorf("backing up: %w", errors.ErrUnsupported)
+	}
+	if err := snap.Backup(w); err != nil {
+		return fmt.Errorf("backing up: %w", err)
+	}
+	return nil
+}
+
+// Close releases the snapshot. The ReadTxn and any databases obtained from it
+// must not be used after Close is called. Closing the connection closes any
+// ReadTxn that is still open once Close's context is done.
+func (rt *ReadTxn) Close() {
+	rt.once.Do(func() {
+		rt.snap.Release()
+		rt.conn.lifecycle.endReadTxn(rt)
+	})
+}
@@ -0,0 +1,226 @@
+/*
+Copyright 2024 Andrew Meredith
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/gofrs/uuid/v5"
+	"github.com/oklog/ulid/v2"
+)
+
+// This file writes the transaction log of a store to a file and replays such
+// a file into another store. Replaying a log writes every transaction with
+// the IDs, commit time, and facts that it was originally committed with, so a
+// store can be reconstructed as of any transaction to reproduce a bug, and
+// the indexes that are rebuilt from the log can be compared with the
+// original ones.
+
+func init() {
+	// The concrete types of the values that may be stored. Values of the
+	// other types are predeclared types, which gob registers itself.
+	gob.Register(ID(0))
+	gob.Register(Tuple(nil))
+	gob.Register([]Value(nil))
+	gob.Register(time.Time{})
+	gob.Register(uuid.UUID{})
+	gob.Register(ulid.ULID{})
+	gob.Register(BlobDigest{})
+}
+
+// txLogRecord is the encoding of a TxLogEntry in a transaction log file.
+type txLogRecord struct {
+	Tx         ID
+	CommitTime time.Time
+	Facts      []txLogFact
+	Idents     []Ident
+}
+
+type txLogFact struct {
+	Fact
+	Mode AssertMode
+}
+
+// TxLogWriter writes transactions to a file that can be read by a
+// TxLogReader. Blob contents are not written, so blob values in a replayed
+// store refer to blobs that must be copied separately.
+type TxLogWriter struct {
+	enc *gob.Encoder
+}
+
+func NewTxLogWriter(w io.Writer) *TxLogWriter {
+	return &TxLogWriter{enc: gob.NewEncoder(w)}
+}
+
+// Write appends a transaction to the log.
+func (w *TxLogWriter) Write(entry TxLogEntry) error {
+	rec := txLogRecord{
+		Tx:         entry.Tx,
+		CommitTime: entry.CommitTime,
+		Facts:      make([]txLogFact, len(entry.Data)),
+		Idents:     entry.Idents,
+	}
+	for i, ra := range entry.Data {
+		rec.Facts[i] = txLogFact{Fact: ra.Fact, Mode: ra.mode}
+	}
+	if err := w.enc.Encode(rec); err != nil {
+		return fmt.Errorf("writing transaction %d: %w", entry.Tx, err)
+	}
+	return nil
+}
+
+// TxLogReader reads the transactions written by a TxLogWriter.
+type TxLogReader struct {
+	dec *gob.Decoder
+}
+
+func NewTxLogReader(r io.Reader) *TxLogReader {
+	return &TxLogReader{dec: gob.NewDecoder(r)}
+}
+
+// Read returns the next transaction of the log, or io.EOF once every
+// transaction has been read.
+func (r *TxLogReader) Read() (TxLogEntry, error) {
+	var rec txLogRecord
+	if err := r.dec.Decode(&rec); err != nil {
+		if errors.Is(err, io.EOF) {
+			return TxLogEntry{}, io.EOF
+		}
+		return TxLogEntry{}, fmt.Errorf("reading transaction log: %w", err)
+	}
+	entry := TxLogEntry{
+		Tx:         rec.Tx,
+		CommitTime: rec.CommitTime,
+		Data:       make([]ResolvedAssertion, len(rec.Facts)),
+		Idents:     rec.Idents,
+	}
+	for i, fct := range rec.Facts {
+		entry.Data[i] = NewResolvedAssertion(fct.Fact, fct.Mode)
+	}
+	return entry, nil
+}
+
+// IDReserver is implemented by IDManagers that can be told of IDs that were
+// written without being allocated, so that they are never allocated later.
+type IDReserver interface {
+	// ReserveIDs ensures that no ID up to and including through is
+	// allocated afterwards. A PartitionedIDManager only needs to reserve
+	// the IDs of through's partition.
+	ReserveIDs(through ID) error
+}
+
+// Replay commits a transaction read from the log of another store exactly as
+// it was originally committed. Transactions must be replayed in commit order,
+// starting with the first transaction of the log in an empty store, so that
+// the system schema is replayed before anything that depends on it. A
+// transaction that is not after the latest one in the store fails with
+// ErrReplayed, so a replay may be resumed by skipping such transactions.
+// Replayed transactions are not validated, since they were validated when
+// they were first committed, but a transaction whose facts do not match its
+// Merkle root fails with ErrIntegrity. The IDs of replayed transactions are
+// reserved so that transactions committed after the replay do not reuse them.
+// The store should not be shared with other connections during a replay.
+func (conn *Connection) Replay(entry TxLogEntry) error {
+	if conn.readOnly {
+		return ErrReadOnly
+	}
+	if conn.transactor != nil {
+		return fmt.Errorf("replaying through a peer: %w", errors.ErrUnsupported)
+	}
+	reserver, ok := conn.idManager.(IDReserver)
+	if !ok {
+		return fmt.Errorf("replaying: %w", errors.ErrUnsupported)
+	}
+	if err := conn.lifecycle.begin(); err != nil {
+		return err
+	}
+	defer conn.lifecycle.end()
+
+	// The highest ID of each partition is reserved, since each partition is
+	// allocated from its own sequence.
+	highest := map[Partition]ID{0: entry.Tx}
+	see := func(id ID) {
+		p := id.Partition()
+		highest[p] = max(highest[p], id)
+	}
+	for _, ra := range entry.Data {
+		if ra.Tx != entry.Tx {
+			return fmt.Errorf("replaying transaction %d: fact of transaction %d", entry.Tx, ra.Tx)
+		}
+		see(ra.EntityID)
+	}
+	for _, ident := range entry.Idents {
+		see(ident.ID)
+	}
+	if _, err := verifyTxLogEntry(entry); err != nil {
+		return fmt.Errorf("replaying transaction %d: %w", entry.Tx, err)
+	}
+
+	conn.writeMu.Lock()
+	latest, err := conn.latestTx()
+	if err == nil && entry.Tx <= latest {
+		err = fmt.Errorf("latest transaction is %d: %w", latest, ErrReplayed)
+	}
+	if err != nil {
+		conn.writeMu.Unlock()
+		return fmt.Errorf("replaying transaction %d: %w", entry.Tx, err)
+	}
+	err = conn.retryPolicy.Do("reserving IDs", func() error {
+		for _, id := range highest {
+			if err := reserver.ReserveIDs(id); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err == nil {
+		err = conn.retryPolicy.Do("writing assertions", func() error {
+			return conn.indexer.Write(entry.Data, entry.Idents)
+		})
+	}
+	if err != nil {
+		conn.writeMu.Unlock()
+		return fmt.Errorf("replaying transaction %d: %w", entry.Tx, err)
+	}
+	conn.observeTx(entry.Data, entry.Idents)
+	conn.reportMu.Lock()
+	conn.writeMu.Unlock()
+
+	conn.reportTx(TxReport{
+		Tx:      entry.Tx,
+		DBAfter: conn.DB().AsOf(entry.Tx),
+		TxData:  entry.Data,
+	})
+	return nil
+}
+
+// latestTx returns the ID of the latest transaction in storage, or zero if
+// there is none. The basis is loaded from storage when the connection is
+// opened, so it is only read again if that failed.
+func (conn *Connection) latestTx() (ID, error) {
+	if basis := conn.DB().Basis.ID(); basis != 0 {
+		return basis, nil
+	}
+	if err := conn.loadBasis(); err != nil {
+		return 0, err
+	}
+	return conn.DB().Basis.ID(), nil
+}
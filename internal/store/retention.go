@@ -0,0 +1,301 @@
+/*
+Copyright 2024 Andrew Meredith
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The history of an attribute may be limited by asserting db/historyRetention
+// on the attribute, or on a namespace entity to limit the history of every
+// attribute in the namespace:
+//
+//	store.EntityData{
+//		"db/ident":            "db.namespace/session",
+//		"db/historyRetention": "90d",
+//	}
+//
+// A retention is a number of days, such as "90d", or a duration that
+// time.ParseDuration accepts, such as "36h". The retention of an attribute
+// takes precedence over that of its namespace.
+//
+// Retention only discards history that no longer matters to recent views of
+// the database: an assertion is discarded once it has been retracted or
+// replaced for longer than the retention, along with the retraction. Facts
+// that are still asserted are always kept, however old they are, so as-of
+// views of any transaction within the retention are unaffected. History is
+// discarded by a HistoryCollector.
+
+// RetentionPolicy limits how long the history of attributes is kept.
+type RetentionPolicy struct {
+	// Attribute is the ident of an attribute, or the name of a namespace
+	// followed by "/*" for every attribute in the namespace.
+	Attribute string
+	// Keep is how long an assertion is kept after it is retracted or
+	// replaced.
+	Keep time.Duration
+}
+
+// parseRetention parses a db/historyRetention value.
+func parseRetention(s string) (time.Duration, error) {
+	var keep time.Duration
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.ParseInt(days, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid retention %q", s)
+		}
+		keep = time.Duration(n) * 24 * time.Hour
+	} else {
+		var err error
+		if keep, err = time.ParseDuration(s); err != nil {
+			return 0, fmt.Errorf("invalid retention %q: %w", s, err)
+		}
+	}
+	if keep <= 0 {
+		return 0, fmt.Errorf("retention %q is not positive", s)
+	}
+	return keep, nil
+}
+
+// RetentionPolicies returns the retention policies declared by the schema,
+// ordered by attribute.
+func (db Database) RetentionPolicies() ([]RetentionPolicy, error) {
+	retentionAttr := IDHistoryRetention
+	facts, err := db.scan(nil, &retentionAttr)
+	if err != nil {
+		return nil, fmt.Errorf("scanning retention policies: %w", err)
+	}
+	policies := make([]RetentionPolicy, 0, len(facts))
+	for _, fct := range facts {
+		ident, err := ResolveIdent(db.conn, fct.EntityID)
+		if err != nil {
+			return nil, fmt.Errorf("resolving ident of entity %d: %w", fct.EntityID, err)
+		}
+		keep, err := parseRetention(fct.Value.(string))
+		if err != nil {
+			return nil, fmt.Errorf("db/historyRetention of %s: %w", ident.Name, err)
+		}
+		name := ident.Name
+		if namespace, ok := strings.CutPrefix(name, namespacePrefix); ok {
+			name = namespace + "/*"
+		}
+		policies = append(policies, RetentionPolicy{Attribute: name, Keep: keep})
+	}
+	sort.Slice(policies, func(i, j int) bool { return policies[i].Attribute < policies[j].Attribute })
+	return policies, nil
+}
+
+// PreviewRetention returns the history entries that enforcing policies now
+// would discard, ordered by attribute, entity, and transaction. If no policies
+// are given, the policies declared by the schema are previewed, which shows
+// what the next run of a HistoryCollector would discard.
+func (db Database) PreviewRetention(policies ...RetentionPolicy) ([]ResolvedAssertion, error) {
+	if len(policies) == 0 {
+		var err error
+		if policies, err = db.RetentionPolicies(); err != nil {
+			return nil, err
+		}
+	}
+	keeps, err := db.retentionByAttribute(policies)
+	if err != nil {
+		return nil, err
+	}
+	attrIDs := make([]ID, 0, len(keeps))
+	for attrID := range keeps {
+		attrIDs = append(attrIDs, attrID)
+	}
+	sort.Slice(attrIDs, func(i, j int) bool { return attrIDs[i] < attrIDs[j] })
+
+	now := db.conn.commitClock.hlc.physical.Now()
+	var expired []ResolvedAssertion
+	for _, attrID := range attrIDs {
+		cutoff, err := db.conn.TxAt(now.Add(-keeps[attrID]))
+		if errors.Is(err, ErrNoSuchEntity) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("finding retention cutoff: %w", err)
+		}
+		attrExpired, err := db.expiredHistory(attrID, cutoff)
+		if err != nil {
+			return nil, err
+		}
+		expired = append(expired, attrExpired...)
+	}
+	return expired, nil
+}
+
+// retentionByAttribute resolves policies to the retention of each attribute
+// that they cover. Policies for attributes take precedence over those for
+// namespaces.
+func (db Database) retentionByAttribute(policies []RetentionPolicy) (map[ID]time.Duration, error) {
+	var attrs []Ident
+	byNamespace := make(map[string]time.Duration)
+	byAttr := make(map[ID]time.Duration)
+	for _, policy := range policies {
+		if policy.Keep <= 0 {
+			return nil, fmt.Errorf("retention of %s is not positive", policy.Attribute)
+		}
+		if namespace, ok := strings.CutSuffix(policy.Attribute, "/*"); ok {
+			byNamespace[namespace] = policy.Keep
+			continue
+		}
+		ident, err := ResolveIdent(db.conn, policy.Attribute)
+		if err != nil {
+			return nil, fmt.Errorf("resolving attribute %s: %w", policy.Attribute, err)
+		}
+		byAttr[ident.ID] = policy.Keep
+	}
+	if len(byNamespace) > 0 {
+		var err error
+		if attrs, err = db.attributes(); err != nil {
+			return nil, err
+		}
+	}
+	for _, attr := range attrs {
+		if _, ok := byAttr[attr.ID]; ok {
+			continue
+		}
+		namespace, _ := namespaceOf(attr.Name)
+		if keep, ok := byNamespace[namespace]; ok {
+			byAttr[attr.ID] = keep
+		}
+	}
+	return byAttr, nil
+}
+
+// expiredHistory returns the history entries of an attribute that no as-of
+// view of cutoff or any later transaction depends on: every entry that was
+// superseded by cutoff, and the latest entry as of cutoff if it is a
+// retraction. Entries are grouped the same way that foldHistory groups them.
+func (db Database) expiredHistory(attrID ID, cutoff ID) ([]ResolvedAssertion, error) {
+	cardinality, err := db.cardinalityOf(attrID)
+	if err != nil {
+		return nil, err
+	}
+	scan, err := db.reader().ScanHistoryAEVT(attrID, nil)
+	if err != nil {
+		return nil, fmt.Errorf("scanning AEVT history: %w", err)
+	}
+	scope := db.conn.memory.scope("retention")
+	defer scope.close()
+	assertions, err := collect(scope, scan, assertionSize)
+	if err != nil {
+		return nil, err
+	}
+
+	type factKey struct {
+		eid       ID
+		validFrom int64
+		value     string
+	}
+	var order []factKey
+	groups := make(map[factKey][]*ResolvedAssertion)
+	for _, ra := range assertions {
+		if ra.Tx > cutoff {
+			continue
+		}
+		key := factKey{eid: ra.EntityID, validFrom: ra.ValidFrom.UnixNano()}
+		if cardinality == IDCardinalityMany {
+			key.value = fmt.Sprintf("%#v", ra.Value)
+		}
+		if _, ok := groups[key]; !ok {
+			order = append(order, key)
+		}
+		groups[key] = append(groups[key], ra)
+	}
+
+	var expired []ResolvedAssertion
+	for _, key := range order {
+		group := groups[key]
+		latest := group[len(group)-1]
+		for _, ra := range group[:len(group)-1] {
+			expired = append(expired, *ra)
+		}
+		if latest.Mode() != AssertModeAddition {
+			expired = append(expired, *latest)
+		}
+	}
+	sort.SliceStable(expired, func(i, j int) bool {
+		if expired[i].EntityID != expired[j].EntityID {
+			return expired[i].EntityID < expired[j].EntityID
+		}
+		return expired[i].Tx < expired[j].Tx
+	})
+	return expired, nil
+}
+
+// HistoryCollector discards the history that the retention policies declared
+// by the schema no longer require.
+type HistoryCollector struct {
+	conn     *Connection
+	interval time.Duration
+}
+
+// NewHistoryCollector returns a collector that discards expired history every
+// interval. Only one collector should run against a database at a time.
+func (conn *Connection) NewHistoryCollector(interval time.Duration) *HistoryCollector {
+	return &HistoryCollector{conn: conn, interval: interval}
+}
+
+// Run discards expired history immediately and then every interval until ctx
+// is done, history cannot be discarded, or the connection is closed, in which
+// case it returns ErrClosed.
+func (c *HistoryCollector) Run(ctx context.Context) error {
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+	for {
+		if _, err := c.Collect(); err != nil {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Collect discards the history that has expired and returns the number of
+// history entries discarded.
+func (c *HistoryCollector) Collect() (int, error) {
+	conn := c.conn
+	if conn.readOnly {
+		return 0, ErrReadOnly
+	}
+	if err := conn.lifecycle.begin(); err != nil {
+		return 0, err
+	}
+	defer conn.lifecycle.end()
+	expired, err := conn.DB().PreviewRetention()
+	if err != nil || len(expired) == 0 {
+		return 0, err
+	}
+	err = conn.retryPolicy.Do("discarding history", func() error {
+		return conn.indexer.DeleteHistory(expired)
+	})
+	if err != nil {
+		return 0, fmt.Errorf("discarding history: %w", err)
+	}
+	return len(expired), nil
+}
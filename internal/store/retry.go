@@ -0,0 +1,101 @@
+/*
+Copyright 2024 Andrew Meredith
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrTransient marks a storage error that may succeed if the operation is
+// retried, such as a write conflict. Storage implementations should join it
+// with the errors that they return for such failures.
+var ErrTransient = errors.New("transient storage error")
+
+// RetryPolicy controls how storage operations that fail with a transient error
+// are retried. The delay before each retry grows exponentially from
+// InitialBackoff up to MaxBackoff.
+type RetryPolicy struct {
+	// MaxAttempts is the number of times that an operation is attempted,
+	// including the first attempt. A value of 1 or less disables retries.
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	// Multiplier is the factor by which the backoff grows after each retry.
+	Multiplier float64
+	// Sleep waits out the backoff between attempts. If nil, time.Sleep is
+	// used. Simulations replace it to run retries on a virtual clock.
+	Sleep func(time.Duration)
+}
+
+// DefaultRetryPolicy returns the retry policy that a Connection uses when none
+// is configured.
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts:    5,
+		InitialBackoff: 10 * time.Millisecond,
+		MaxBackoff:     time.Second,
+		Multiplier:     2,
+	}
+}
+
+// RetriesExhaustedError is returned when a storage operation still fails with a
+// transient error after every attempt allowed by the retry policy.
+type RetriesExhaustedError struct {
+	Op       string
+	Attempts int
+	Err      error
+}
+
+func (e *RetriesExhaustedError) Error() string {
+	return fmt.Sprintf("%s failed after %d attempts: %v", e.Op, e.Attempts, e.Err)
+}
+
+func (e *RetriesExhaustedError) Unwrap() error {
+	return e.Err
+}
+
+// Do calls fn until it succeeds, fails with an error that is not transient, or
+// the policy's attempts are exhausted. Errors are transient if they wrap
+// ErrTransient.
+func (p RetryPolicy) Do(op string, fn func() error) error {
+	backoff := p.InitialBackoff
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || !errors.Is(err, ErrTransient) {
+			return err
+		}
+		if attempt >= p.MaxAttempts {
+			return &RetriesExhaustedError{
+				Op:       op,
+				Attempts: attempt,
+				Err:      err,
+			}
+		}
+
+		if p.Sleep != nil {
+			p.Sleep(backoff)
+		} else {
+			time.Sleep(backoff)
+		}
+		backoff = time.Duration(float64(backoff) * p.Multiplier)
+		if p.MaxBackoff > 0 && backoff > p.MaxBackoff {
+			backoff = p.MaxBackoff
+		}
+	}
+}
@@ -0,0 +1,122 @@
+/*
+Copyright 2024 Andrew Meredith
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"fmt"
+)
+
+// SchemaAttribute is the schema of an attribute, read from its schema entity
+// with the defaults of any missing schema flags applied, so that callers
+// never need to distinguish a flag that is absent from one that is false.
+type SchemaAttribute struct {
+	ID ID
+	// Type is the value type of the attribute, such as IDTypeString, or 0 if
+	// the entity is not an attribute.
+	Type ID
+	// Cardinality is IDCardinalityOne or IDCardinalityMany. It defaults to
+	// IDCardinalityOne.
+	Cardinality ID
+	// Unique is IDUniqueIdentity, IDUniqueValue, or 0 if the attribute is
+	// not unique. Boolean db/unique values written by older releases are
+	// mapped to their enumerated equivalents.
+	Unique   ID
+	Indexed  bool
+	Interned bool
+	// Deprecated is set if the attribute is deprecated, in which case
+	// ReplacedBy is the attribute that replaces it, or 0 if it has no
+	// replacement.
+	Deprecated bool
+	ReplacedBy ID
+	Inferred   bool
+	Doc        string
+}
+
+// IsAttribute reports whether the schema entity declares an attribute, as
+// opposed to an ident such as an enumerated value.
+func (s SchemaAttribute) IsAttribute() bool {
+	return s.Type != 0
+}
+
+// Many reports whether the attribute has cardinality many.
+func (s SchemaAttribute) Many() bool {
+	return s.Cardinality == IDCardinalityMany
+}
+
+// SchemaFor returns the schema of an attribute in the latest database.
+// attribute may either be an ident name or an ID. See Database.SchemaFor.
+func (conn *Connection) SchemaFor(attribute any) (SchemaAttribute, error) {
+	return conn.DB().SchemaFor(attribute)
+}
+
+// SchemaFor returns the schema of an attribute in this view of the database.
+// attribute may either be an ident name or an ID. Schema entities are cached
+// by the connection, so repeated calls are cheap. An ident that is not an
+// attribute has a schema whose IsAttribute is false.
+func (db Database) SchemaFor(attribute any) (SchemaAttribute, error) {
+	var attrID ID
+	if id, ok := attribute.(ID); ok {
+		attrID = id
+	} else {
+		ident, err := ResolveIdent(db.conn, attribute)
+		if err != nil {
+			return SchemaAttribute{}, fmt.Errorf("resolving attribute ident: %w", err)
+		}
+		attrID = ident.ID
+	}
+	return db.schemaFor(attrID)
+}
+
+// schemaFor returns the schema of the attribute with the given ID.
+func (db Database) schemaFor(attrID ID) (SchemaAttribute, error) {
+	ent, err := db.getSchemaEntity(attrID)
+	if err != nil {
+		return SchemaAttribute{}, fmt.Errorf("fetching attribute schema: %w", err)
+	}
+	return parseSchemaAttribute(ent)
+}
+
+// parseSchemaAttribute reads the schema flags of a schema entity.
+func parseSchemaAttribute(ent Entity) (SchemaAttribute, error) {
+	s := SchemaAttribute{
+		ID:          ent.eid,
+		Cardinality: IDCardinalityOne,
+	}
+	s.Type, _ = ent.state[IDType].(ID)
+	if cardinality, ok := ent.state[IDCardinality].(ID); ok {
+		s.Cardinality = cardinality
+	}
+	switch v := ent.state[IDUnique].(type) {
+	case nil:
+	case ID:
+		s.Unique = v
+	case bool:
+		// Schemas written before db/unique was enumerated hold booleans.
+		if v {
+			s.Unique = IDUniqueIdentity
+		}
+	default:
+		return SchemaAttribute{}, fmt.Errorf("unexpected db/unique value of type %T", v)
+	}
+	s.Indexed, _ = ent.state[IDIndexed].(bool)
+	s.Interned, _ = ent.state[IDInterned].(bool)
+	s.Deprecated, _ = ent.state[IDDeprecated].(bool)
+	s.ReplacedBy, _ = ent.state[IDReplacedBy].(ID)
+	s.Inferred, _ = ent.state[IDInferred].(bool)
+	s.Doc, _ = ent.state[IDDoc].(string)
+	return s, nil
+}
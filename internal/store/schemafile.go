@@ -0,0 +1,384 @@
+/*
+Copyright 2024 Andrew Meredith
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// A schema file is an EDN vector of maps, one per entity with an ident:
+// attributes, namespace entities, and enumerated values. Each map is keyed by
+// attribute idents written as keywords, and it has a :db/ident that names the
+// entity. References to other entities are written as their idents, the
+// values of cardinality-many attributes as vectors, and tuples as vectors as
+// well:
+//
+//	[{:db/ident :color/red}
+//	 {:db/ident       :person/email
+//	  :db/cardinality :db.cardinality/one
+//	  :db/type        :db.type/string
+//	  :db/unique      :db.unique/identity}]
+//
+// Entities appear after the entities that they refer to, so a schema file can
+// be applied in a single transaction.
+
+// schemaKind orders the kinds of entities in a schema file.
+type schemaKind int
+
+const (
+	schemaNamespace schemaKind = iota
+	schemaEnum
+	schemaAttribute
+)
+
+// schemaEntityFacts is an entity of a schema file along with its facts.
+type schemaEntityFacts struct {
+	ident Ident
+	kind  schemaKind
+	facts []Fact
+}
+
+// ExportSchema writes every entity with an ident outside of the system
+// partition to w as a schema file, which ApplySchema can apply to another
+// database.
+func (db Database) ExportSchema(w io.Writer) error {
+	entities, err := db.schemaEntities()
+	if err != nil {
+		return err
+	}
+	names := make(map[ID]string, len(entities))
+	for _, ent := range entities {
+		names[ent.ident.ID] = ent.ident.Name
+	}
+	nameOf := func(id ID) (string, error) {
+		if name, ok := names[id]; ok {
+			return name, nil
+		}
+		ident, err := ResolveIdent(db.conn, id)
+		if err != nil {
+			return "", fmt.Errorf("entity %d is referred to by the schema but has no ident: %w", id, err)
+		}
+		names[id] = ident.Name
+		return ident.Name, nil
+	}
+	var encode func(val Value) (any, error)
+	encode = func(val Value) (any, error) {
+		switch v := val.(type) {
+		case ID:
+			name, err := nameOf(v)
+			return ednKeyword(name), err
+		case Tuple:
+			out := make([]any, len(v))
+			for i, elem := range v {
+				var err error
+				if out[i], err = encode(elem); err != nil {
+					return nil, err
+				}
+			}
+			return out, nil
+		default:
+			return val, nil
+		}
+	}
+
+	var b strings.Builder
+	b.WriteString("[")
+	for i, ent := range sortSchemaEntities(entities) {
+		if i > 0 {
+			b.WriteString("\n ")
+		}
+		b.WriteString("{:db/ident ")
+		if err := writeEDN(&b, ednKeyword(ent.ident.Name)); err != nil {
+			return err
+		}
+
+		// Attributes are written in order of their names, and the values of
+		// cardinality-many attributes are gathered into vectors.
+		values := make(map[string][]any)
+		attrIDs := make(map[string]ID)
+		var attrNames []string
+		for _, fct := range ent.facts {
+			if fct.Attribute == IDIdent {
+				continue
+			}
+			attrName, err := nameOf(fct.Attribute)
+			if err != nil {
+				return err
+			}
+			val, err := encode(fct.Value)
+			if err != nil {
+				return fmt.Errorf("exporting %s of %s: %w", attrName, ent.ident.Name, err)
+			}
+			if _, ok := values[attrName]; !ok {
+				attrNames = append(attrNames, attrName)
+				attrIDs[attrName] = fct.Attribute
+			}
+			values[attrName] = append(values[attrName], val)
+		}
+		sort.Strings(attrNames)
+		for _, attrName := range attrNames {
+			cardinality, err := db.cardinalityOf(attrIDs[attrName])
+			if err != nil {
+				return err
+			}
+			var val any = values[attrName]
+			if cardinality != IDCardinalityMany {
+				val = values[attrName][0]
+			}
+			b.WriteString("\n  :")
+			b.WriteString(attrName)
+			b.WriteByte(' ')
+			if err := writeEDN(&b, val); err != nil {
+				return fmt.Errorf("exporting %s of %s: %w", attrName, ent.ident.Name, err)
+			}
+		}
+		b.WriteString("}")
+	}
+	b.WriteString("]\n")
+	_, err = io.WriteString(w, b.String())
+	return err
+}
+
+// schemaEntities returns every entity with an ident outside of the system
+// partition along with its facts.
+func (db Database) schemaEntities() ([]schemaEntityFacts, error) {
+	identAttr := IDIdent
+	identFacts, err := db.scan(nil, &identAttr)
+	if err != nil {
+		return nil, fmt.Errorf("scanning idents: %w", err)
+	}
+	var ids []any
+	for _, fct := range identFacts {
+		if !fct.EntityID.IsSystem() {
+			ids = append(ids, fct.EntityID)
+		}
+	}
+	idents, err := db.conn.ResolveIdents(ids)
+	if err != nil {
+		return nil, fmt.Errorf("resolving idents: %w", err)
+	}
+	entities := make([]schemaEntityFacts, len(idents))
+	for i, ident := range idents {
+		eid := ident.ID
+		facts, err := db.scan(&eid, nil)
+		if err != nil {
+			return nil, fmt.Errorf("reading %s: %w", ident.Name, err)
+		}
+		ent := schemaEntityFacts{ident: ident, kind: schemaEnum, facts: facts}
+		switch {
+		case strings.HasPrefix(ident.Name, namespacePrefix):
+			ent.kind = schemaNamespace
+		default:
+			for _, fct := range facts {
+				if fct.Attribute == IDType {
+					ent.kind = schemaAttribute
+				}
+			}
+		}
+		entities[i] = ent
+	}
+	return entities, nil
+}
+
+// sortSchemaEntities orders entities after every other entity that they
+// refer to, either as an attribute or as a value. Otherwise, namespaces come
+// first, then enumerated values, then attributes, each ordered by name.
+// Entities that refer to one another in a cycle are ordered arbitrarily.
+func sortSchemaEntities(entities []schemaEntityFacts) []schemaEntityFacts {
+	sort.Slice(entities, func(i, j int) bool {
+		if entities[i].kind != entities[j].kind {
+			return entities[i].kind < entities[j].kind
+		}
+		return entities[i].ident.Name < entities[j].ident.Name
+	})
+	byID := make(map[ID]int, len(entities))
+	for i, ent := range entities {
+		byID[ent.ident.ID] = i
+	}
+
+	out := make([]schemaEntityFacts, 0, len(entities))
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make([]int, len(entities))
+	var visit func(i int)
+	visit = func(i int) {
+		if state[i] != unvisited {
+			return
+		}
+		state[i] = visiting
+		dep := func(id ID) {
+			if j, ok := byID[id]; ok && j != i {
+				visit(j)
+			}
+		}
+		for _, fct := range entities[i].facts {
+			dep(fct.Attribute)
+			switch v := fct.Value.(type) {
+			case ID:
+				dep(v)
+			case Tuple:
+				for _, elem := range v {
+					if id, ok := elem.(ID); ok {
+						dep(id)
+					}
+				}
+			}
+		}
+		state[i] = visited
+		out = append(out, entities[i])
+	}
+	for i := range entities {
+		visit(i)
+	}
+	return out
+}
+
+// ApplySchemaFile applies the schema file at path. See ApplySchema.
+func (conn *Connection) ApplySchemaFile(path string) (*AssertResult, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("opening schema file: %w", err)
+	}
+	defer f.Close()
+	return conn.ApplySchema(f)
+}
+
+// ApplySchema applies a schema file, such as one written by
+// Database.ExportSchema, in a single transaction. Entities that already exist
+// are matched by their idents, so applying the same schema again leaves the
+// schema unchanged.
+func (conn *Connection) ApplySchema(r io.Reader) (*AssertResult, error) {
+	src, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("reading schema: %w", err)
+	}
+	entities, err := conn.parseSchema(string(src))
+	if err != nil {
+		return nil, err
+	}
+	return conn.Assert(entities...)
+}
+
+// parseSchema reads the entities of a schema file.
+func (conn *Connection) parseSchema(src string) ([]Assertable, error) {
+	rd := newEDNReader(src)
+	form, err := rd.read()
+	if err != nil {
+		return nil, fmt.Errorf("parsing schema: %w", err)
+	}
+	if !rd.atEnd() {
+		return nil, fmt.Errorf("parsing schema: %w", rd.errorf(rd.line, rd.col, "unexpected form after schema"))
+	}
+	maps, ok := form.([]any)
+	if !ok {
+		return nil, errors.New("parsing schema: schema must be a vector of maps")
+	}
+
+	// The types of the attributes that the schema defines, by name, which
+	// determine whether vectors are tuples or many values.
+	types := make(map[string]ednKeyword)
+	isTuple := func(attrName string) bool {
+		if attrName == "db/compositeComponents" {
+			return true
+		}
+		if typ, ok := types[attrName]; ok {
+			return typ == "db.type/tuple"
+		}
+		ident, err := ResolveIdent(conn, attrName)
+		if err != nil {
+			return false
+		}
+		schema, err := conn.DB().schemaFor(ident.ID)
+		return err == nil && schema.Type == IDTypeTuple
+	}
+	var decode func(val any) (Value, error)
+	decode = func(val any) (Value, error) {
+		switch v := val.(type) {
+		case ednKeyword:
+			return Ident{Name: string(v)}, nil
+		case []any:
+			out := make([]Value, len(v))
+			for i, elem := range v {
+				var err error
+				if out[i], err = decode(elem); err != nil {
+					return nil, err
+				}
+			}
+			return out, nil
+		case ednMap:
+			return nil, errors.New("nested maps are not supported")
+		case nil:
+			return nil, errors.New("nil is not a value")
+		default:
+			return v, nil
+		}
+	}
+
+	out := make([]Assertable, len(maps))
+	for i, form := range maps {
+		m, ok := form.(ednMap)
+		if !ok {
+			return nil, fmt.Errorf("parsing schema: entity %d is not a map", i)
+		}
+		data := make(EntityData, len(m.keys))
+		for j, key := range m.keys {
+			kw, ok := key.(ednKeyword)
+			if !ok {
+				return nil, fmt.Errorf("parsing schema: entity %d has a key that is not a keyword", i)
+			}
+			attrName := string(kw)
+			val, err := decode(m.values[j])
+			if err != nil {
+				return nil, fmt.Errorf("parsing schema: %s of entity %d: %w", attrName, i, err)
+			}
+			switch v := val.(type) {
+			case Ident:
+				if attrName == "db/ident" {
+					val = v.Name
+				}
+			case []Value:
+				if isTuple(attrName) {
+					val = Tuple(v)
+				} else {
+					vals := make([]any, len(v))
+					for k, elem := range v {
+						vals[k] = elem
+					}
+					val = vals
+				}
+			}
+			data[attrName] = val
+		}
+		ident, ok := data["db/ident"].(string)
+		if !ok {
+			return nil, fmt.Errorf("parsing schema: entity %d has no :db/ident keyword", i)
+		}
+		if typ, ok := data["db/type"].(Ident); ok {
+			types[ident] = ednKeyword(typ.Name)
+		}
+		out[i] = data
+	}
+	return out, nil
+}
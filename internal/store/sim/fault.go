@@ -0,0 +1,105 @@
+/*
+Copyright 2024 Andrew Meredith
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sim
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/kendru/canter/internal/store"
+)
+
+// FaultKind identifies a kind of injected fault.
+type FaultKind int
+
+const (
+	// FaultWriteFailure rejects an index write without applying it.
+	FaultWriteFailure FaultKind = iota
+	// FaultLostAck applies an index write but reports it as failed.
+	FaultLostAck
+	// FaultIDFailure fails an ID allocation.
+	FaultIDFailure
+)
+
+func (k FaultKind) String() string {
+	switch k {
+	case FaultWriteFailure:
+		return "write failure"
+	case FaultLostAck:
+		return "lost ack"
+	case FaultIDFailure:
+		return "ID failure"
+	default:
+		return fmt.Sprintf("FaultKind(%d)", int(k))
+	}
+}
+
+// Fault records a fault injected by the simulation.
+type Fault struct {
+	Kind FaultKind
+	// At is the simulated time at which the fault was injected.
+	At time.Time
+}
+
+// ErrInjected is joined with every error returned by an injected fault.
+var ErrInjected = errors.New("injected fault")
+
+type storage interface {
+	store.Indexer
+	store.IdentManager
+	store.IDManager
+	store.BlobStore
+}
+
+// faultyStorage injects faults into the operations of the storage that it
+// wraps. Reads are never faulted.
+type faultyStorage struct {
+	storage
+	sim *Sim
+}
+
+func injectedErr(kind FaultKind) error {
+	return errors.Join(fmt.Errorf("%w: %s", ErrInjected, kind), store.ErrTransient)
+}
+
+func (f *faultyStorage) Write(assertions []store.ResolvedAssertion, idents []store.Ident) error {
+	if f.sim.inject(FaultWriteFailure, f.sim.cfg.WriteFailureRate) {
+		return injectedErr(FaultWriteFailure)
+	}
+	if err := f.storage.Write(assertions, idents); err != nil {
+		return err
+	}
+	if f.sim.inject(FaultLostAck, f.sim.cfg.LostAckRate) {
+		return injectedErr(FaultLostAck)
+	}
+	return nil
+}
+
+func (f *faultyStorage) NextID() (store.ID, error) {
+	if f.sim.inject(FaultIDFailure, f.sim.cfg.IDFailureRate) {
+		return 0, injectedErr(FaultIDFailure)
+	}
+	return f.storage.NextID()
+}
+
+func (f *faultyStorage) NextIDs(n int) ([]store.ID, error) {
+	if f.sim.inject(FaultIDFailure, f.sim.cfg.IDFailureRate) {
+		return nil, injectedErr(FaultIDFailure)
+	}
+	return f.storage.NextIDs(n)
+}
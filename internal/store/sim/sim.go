@@ -0,0 +1,209 @@
+/*
+Copyright 2024 Andrew Meredith
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package sim is a deterministic simulation harness for the store. A Sim runs
+// a Connection against Badger storage that injects faults, takes commit times
+// and retry backoff from a virtual clock, and interleaves the operations of
+// several clients in an order chosen by a seeded random source. Two runs with
+// the same seed and the same clients inject the same faults in the same
+// order.
+package sim
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/kendru/canter/internal/store"
+	badgerImpl "github.com/kendru/canter/internal/store/badger"
+)
+
+// Config configures a simulation.
+type Config struct {
+	// Seed seeds every random choice that the simulation makes.
+	Seed int64
+
+	// Dir is the directory in which the database is stored. If empty, the
+	// database is kept in memory and survives Restart but not Crash.
+	Dir string
+
+	// WriteFailureRate is the probability that an index write is rejected
+	// with a transient error before it is applied.
+	WriteFailureRate float64
+	// LostAckRate is the probability that an index write is applied but
+	// reported to the connection as a transient failure. Index writes are
+	// atomic, so this is how a partially completed write appears to the
+	// transactor.
+	LostAckRate float64
+	// IDFailureRate is the probability that an ID allocation fails with a
+	// transient error.
+	IDFailureRate float64
+
+	// RetryPolicy is the retry policy of the simulated connection. Its Sleep
+	// function is replaced by the simulation's clock. If nil,
+	// store.DefaultRetryPolicy() is used.
+	RetryPolicy *store.RetryPolicy
+}
+
+// Sim is a running simulation. It is not safe for concurrent use.
+type Sim struct {
+	cfg   Config
+	rng   *rand.Rand
+	clock *Clock
+
+	db      *badger.DB
+	storage *faultyStorage
+	conn    *store.Connection
+
+	faults []Fault
+}
+
+// New starts a simulation with an initialized database.
+func New(cfg Config) (*Sim, error) {
+	s := &Sim{
+		cfg:   cfg,
+		rng:   rand.New(rand.NewSource(cfg.Seed)),
+		clock: NewClock(time.Unix(0, 0).UTC()),
+	}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Clock returns the simulation's virtual clock.
+func (s *Sim) Clock() *Clock {
+	return s.clock
+}
+
+// Conn returns the connection of the current transactor.
+func (s *Sim) Conn() *store.Connection {
+	return s.conn
+}
+
+// Rand returns the simulation's random source. Clients should draw their own
+// random choices from it so that they are reproduced along with the faults.
+func (s *Sim) Rand() *rand.Rand {
+	return s.rng
+}
+
+// Faults returns every fault injected so far, in the order injected.
+func (s *Sim) Faults() []Fault {
+	return s.faults
+}
+
+// Restart simulates a transactor failover: the current connection is
+// abandoned and a new one is opened on the same storage.
+func (s *Sim) Restart() error {
+	s.conn = s.newConnection()
+	return s.conn.InitializeDB()
+}
+
+// Crash simulates a crash of the whole process. The database is closed and
+// reopened, so Badger recovers it from its files as it would after a crash.
+// Crash requires Config.Dir.
+func (s *Sim) Crash() error {
+	if s.cfg.Dir == "" {
+		return fmt.Errorf("crash requires an on-disk database")
+	}
+	if err := s.db.Close(); err != nil {
+		return fmt.Errorf("closing database: %w", err)
+	}
+	return s.open()
+}
+
+// Close releases the simulation's database.
+func (s *Sim) Close() error {
+	return s.db.Close()
+}
+
+func (s *Sim) open() error {
+	opts := badger.DefaultOptions(s.cfg.Dir).WithLogger(nil)
+	if s.cfg.Dir == "" {
+		opts = opts.WithInMemory(true)
+	}
+	db, err := badger.Open(opts)
+	if err != nil {
+		return fmt.Errorf("opening database: %w", err)
+	}
+	sto, err := badgerImpl.New(db)
+	if err != nil {
+		db.Close()
+		return fmt.Errorf("opening store: %w", err)
+	}
+	s.db = db
+	s.storage = &faultyStorage{storage: sto, sim: s}
+	return s.Restart()
+}
+
+func (s *Sim) newConnection() *store.Connection {
+	retryPolicy := store.DefaultRetryPolicy()
+	if s.cfg.RetryPolicy != nil {
+		retryPolicy = *s.cfg.RetryPolicy
+	}
+	retryPolicy.Sleep = s.clock.Sleep
+
+	return store.NewConnection(store.Config{
+		IdentManager: s.storage,
+		IDManager:    s.storage,
+		Indexer:      s.storage,
+		BlobStore:    s.storage,
+		RetryPolicy:  &retryPolicy,
+		Clock:        s.clock,
+	})
+}
+
+// Step is a single operation performed by a client.
+type Step func(conn *store.Connection) error
+
+// Client is a sequence of steps that are performed in order.
+type Client []Step
+
+// Run interleaves the steps of the clients. At each turn, a client with steps
+// remaining is chosen at random and its next step is performed, so the steps of
+// each client run in order but the clients are reordered relative to each
+// other. Run stops at the first step that returns an error.
+func (s *Sim) Run(clients ...Client) error {
+	next := make([]int, len(clients))
+	for {
+		var ready []int
+		for i, client := range clients {
+			if next[i] < len(client) {
+				ready = append(ready, i)
+			}
+		}
+		if len(ready) == 0 {
+			return nil
+		}
+		i := ready[s.rng.Intn(len(ready))]
+		step := clients[i][next[i]]
+		next[i]++
+		if err := step(s.conn); err != nil {
+			return fmt.Errorf("client %d step %d: %w", i, next[i]-1, err)
+		}
+	}
+}
+
+// inject reports whether a fault with the given probability occurs, recording
+// it if so.
+func (s *Sim) inject(kind FaultKind, rate float64) bool {
+	if rate <= 0 || s.rng.Float64() >= rate {
+		return false
+	}
+	s.faults = append(s.faults, Fault{Kind: kind, At: s.clock.Now()})
+	return true
+}
@@ -0,0 +1,188 @@
+/*
+Copyright 2024 Andrew Meredith
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sim_test
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/kendru/canter/internal/store"
+	"github.com/kendru/canter/internal/store/sim"
+	"github.com/stretchr/testify/assert"
+)
+
+// workload asserts items from several clients and records which of the
+// assertions were acknowledged.
+type workload struct {
+	acked  map[string]int64
+	failed map[string]int64
+}
+
+func newWorkload() *workload {
+	return &workload{
+		acked:  make(map[string]int64),
+		failed: make(map[string]int64),
+	}
+}
+
+func (w *workload) schema(conn *store.Connection) error {
+	_, err := conn.Assert(
+		store.EntityData{"db/ident": "item/key", "db/type": "db.type/string", "db/unique": true, "db/cardinality": "db.cardinality/one"},
+		store.EntityData{"db/ident": "item/count", "db/type": "db.type/int64", "db/cardinality": "db.cardinality/one"},
+	)
+	return err
+}
+
+func (w *workload) clients(s *sim.Sim, n, steps int) []sim.Client {
+	clients := make([]sim.Client, n)
+	for i := range clients {
+		for j := 0; j < steps; j++ {
+			key := fmt.Sprintf("item-%d-%d", i, j)
+			clients[i] = append(clients[i], func(conn *store.Connection) error {
+				count := s.Rand().Int63n(1000)
+				_, err := conn.Assert(store.EntityData{"item/key": key, "item/count": count})
+				var exhausted *store.RetriesExhaustedError
+				switch {
+				case err == nil:
+					w.acked[key] = count
+				case errors.As(err, &exhausted):
+					w.failed[key] = count
+				default:
+					return err
+				}
+				return nil
+			})
+		}
+	}
+	return clients
+}
+
+// verify checks that every acknowledged item was stored and that every item
+// whose assertion failed was stored either completely or not at all.
+func (w *workload) verify(t *testing.T, conn *store.Connection) {
+	t.Helper()
+	for key, count := range w.acked {
+		data, err := conn.DB().Pull(store.NewLookup("item/key", key), store.PullAttr{Attribute: "item/count"})
+		if assert.NoError(t, err, "acknowledged item %s", key) {
+			assert.Equal(t, count, data["item/count"], "acknowledged item %s", key)
+		}
+	}
+	for key, count := range w.failed {
+		data, err := conn.DB().Pull(store.NewLookup("item/key", key), store.PullAttr{Attribute: "item/count"})
+		if errors.Is(err, store.ErrNoSuchEntity) {
+			continue
+		}
+		if assert.NoError(t, err, "failed item %s", key) {
+			assert.Equal(t, count, data["item/count"], "failed item %s", key)
+		}
+	}
+}
+
+func newSim(t *testing.T, cfg sim.Config) *sim.Sim {
+	t.Helper()
+	if cfg.RetryPolicy == nil {
+		cfg.RetryPolicy = &store.RetryPolicy{
+			MaxAttempts:    4,
+			InitialBackoff: 10 * time.Millisecond,
+			MaxBackoff:     time.Second,
+			Multiplier:     2,
+		}
+	}
+	s, err := sim.New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestSimulatedFaults(t *testing.T) {
+	s := newSim(t, sim.Config{
+		Seed:             42,
+		WriteFailureRate: 0.3,
+		LostAckRate:      0.2,
+		IDFailureRate:    0.1,
+	})
+	w := newWorkload()
+	if !assert.NoError(t, w.schema(s.Conn())) {
+		return
+	}
+
+	assert.NoError(t, s.Run(w.clients(s, 3, 20)...))
+	assert.NotEmpty(t, s.Faults())
+	assert.NotEmpty(t, w.acked)
+	// Retries sleep on the virtual clock.
+	assert.True(t, s.Clock().Now().After(time.Unix(0, 0)))
+
+	// Everything acknowledged survives a transactor failover.
+	if !assert.NoError(t, s.Restart()) {
+		return
+	}
+	w.verify(t, s.Conn())
+}
+
+func TestSimulationIsDeterministic(t *testing.T) {
+	run := func() ([]sim.Fault, *workload) {
+		s := newSim(t, sim.Config{
+			Seed:             7,
+			WriteFailureRate: 0.25,
+			LostAckRate:      0.25,
+		})
+		w := newWorkload()
+		if !assert.NoError(t, w.schema(s.Conn())) {
+			return nil, w
+		}
+		assert.NoError(t, s.Run(w.clients(s, 4, 10)...))
+		return s.Faults(), w
+	}
+
+	faults1, w1 := run()
+	faults2, w2 := run()
+	assert.Equal(t, faults1, faults2)
+	assert.Equal(t, w1.acked, w2.acked)
+	assert.Equal(t, w1.failed, w2.failed)
+}
+
+func TestSimulatedCrash(t *testing.T) {
+	s := newSim(t, sim.Config{
+		Seed:        3,
+		Dir:         t.TempDir(),
+		LostAckRate: 0.2,
+	})
+	w := newWorkload()
+	if !assert.NoError(t, w.schema(s.Conn())) {
+		return
+	}
+	clients := w.clients(s, 2, 10)
+	// Crash the process midway through the first client's work.
+	crashAt := len(clients[0]) / 2
+	step := clients[0][crashAt]
+	clients[0][crashAt] = func(conn *store.Connection) error {
+		if err := s.Crash(); err != nil {
+			return err
+		}
+		return step(s.Conn())
+	}
+
+	assert.NoError(t, s.Run(clients...))
+	if !assert.NoError(t, s.Crash()) {
+		return
+	}
+	w.verify(t, s.Conn())
+}
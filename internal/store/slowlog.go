@@ -0,0 +1,207 @@
+/*
+Copyright 2024 Andrew Meredith
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// DefaultSlowLogSize is the number of entries that the slow log keeps when
+// SlowLogConfig.Size is zero.
+const DefaultSlowLogSize = 100
+
+// SlowLogConfig configures the log of slow transactions and queries. See
+// Connection.SlowLog.
+type SlowLogConfig struct {
+	// TxThreshold is the duration beyond which a transaction is slow. If
+	// zero, transactions are not logged.
+	TxThreshold time.Duration
+	// QueryThreshold is the duration beyond which a query is slow. If zero,
+	// queries are not logged.
+	QueryThreshold time.Duration
+	// Size is the number of entries that the log keeps. Once it is full, each
+	// new entry replaces the oldest. If zero, DefaultSlowLogSize is used.
+	Size int
+	// Logger, if set, is sent a warning for every slow transaction and query
+	// in addition to the entry in the log.
+	Logger *slog.Logger
+}
+
+// SlowLogKind is the kind of operation recorded by a SlowLogEntry.
+type SlowLogKind string
+
+const (
+	SlowLogTx    SlowLogKind = "tx"
+	SlowLogQuery SlowLogKind = "query"
+)
+
+// SlowLogEntry describes a transaction or query that took longer than its
+// threshold.
+type SlowLogEntry struct {
+	Kind SlowLogKind
+	// Time is when the operation finished.
+	Time     time.Time
+	Duration time.Duration
+	// Stages are the durations of the stages of the operation, in order.
+	// They add up to Duration. An operation that failed ends with the stage
+	// in which it failed.
+	Stages []StageTiming
+	// Err is the error with which the operation failed, if any.
+	Err error
+
+	// Tx is the ID of a transaction, or zero if it failed before its ID was
+	// allocated, and Assertions is the number of assertions that it wrote.
+	Tx         ID
+	Assertions int
+
+	// Clauses are the clauses of a query, with rules and groups expanded, in
+	// the order that they were evaluated, and Rows is the number of rows that
+	// the query returned.
+	Clauses []Clause
+	Rows    int
+}
+
+// StageTiming is the duration of a stage of a transaction or query.
+//
+// The stages of a transaction are "add", the time spent adding assertions to
+// it, "admit", the time spent waiting to be admitted by an
+// AdmissionController, if the connection has one, "resolve", "validate", and
+// "write". The stages of a query are "plan",
+// "evaluate", and "project".
+type StageTiming struct {
+	Stage    string
+	Duration time.Duration
+}
+
+// SlowLog returns the most recent slow transactions and queries committed or
+// run through the connection, oldest first.
+func (conn *Connection) SlowLog() []SlowLogEntry {
+	return conn.slowLog.entries()
+}
+
+// slowLog is a ring buffer of slow operations.
+type slowLog struct {
+	cfg SlowLogConfig
+
+	mu   sync.Mutex
+	ring []SlowLogEntry
+	// next is the index of the ring at which the next entry is stored.
+	next int
+	full bool
+}
+
+func newSlowLog(cfg SlowLogConfig) *slowLog {
+	if cfg.Size <= 0 {
+		cfg.Size = DefaultSlowLogSize
+	}
+	return &slowLog{cfg: cfg, ring: make([]SlowLogEntry, cfg.Size)}
+}
+
+// threshold returns the threshold for operations of a kind, or zero if they
+// are not logged.
+func (l *slowLog) threshold(kind SlowLogKind) time.Duration {
+	if kind == SlowLogTx {
+		return l.cfg.TxThreshold
+	}
+	return l.cfg.QueryThreshold
+}
+
+// record adds the entry to the log if the operation was slow.
+func (l *slowLog) record(entry SlowLogEntry) {
+	threshold := l.threshold(entry.Kind)
+	if threshold <= 0 || entry.Duration < threshold {
+		return
+	}
+	entry.Time = time.Now()
+
+	l.mu.Lock()
+	l.ring[l.next] = entry
+	l.next = (l.next + 1) % len(l.ring)
+	if l.next == 0 {
+		l.full = true
+	}
+	l.mu.Unlock()
+
+	if l.cfg.Logger != nil {
+		attrs := []any{
+			slog.Duration("duration", entry.Duration),
+		}
+		for _, stage := range entry.Stages {
+			attrs = append(attrs, slog.Duration(stage.Stage, stage.Duration))
+		}
+		switch entry.Kind {
+		case SlowLogTx:
+			attrs = append(attrs, slog.Int64("tx", int64(entry.Tx)), slog.Int("assertions", entry.Assertions))
+		case SlowLogQuery:
+			attrs = append(attrs, slog.Int("clauses", len(entry.Clauses)), slog.Int("rows", entry.Rows))
+		}
+		if entry.Err != nil {
+			attrs = append(attrs, slog.String("error", entry.Err.Error()))
+		}
+		l.cfg.Logger.Warn("slow "+string(entry.Kind), attrs...)
+	}
+}
+
+func (l *slowLog) entries() []SlowLogEntry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.full {
+		return append([]SlowLogEntry(nil), l.ring[:l.next]...)
+	}
+	out := make([]SlowLogEntry, 0, len(l.ring))
+	out = append(out, l.ring[l.next:]...)
+	return append(out, l.ring[:l.next]...)
+}
+
+// stageTimer measures the stages of an operation.
+type stageTimer struct {
+	// stage is the name of the current stage, and start is when it began.
+	stage  string
+	start  time.Time
+	stages []StageTiming
+}
+
+// begin ends the current stage, if any, and begins the next.
+func (t *stageTimer) begin(stage string) {
+	t.end()
+	t.stage = stage
+	t.start = time.Now()
+}
+
+// end ends the current stage, if any.
+func (t *stageTimer) end() {
+	if t.stage != "" {
+		t.add(t.stage, time.Since(t.start))
+		t.stage = ""
+	}
+}
+
+// add records the duration of a stage that was measured separately.
+func (t *stageTimer) add(stage string, d time.Duration) {
+	t.stages = append(t.stages, StageTiming{Stage: stage, Duration: d})
+}
+
+// total returns the sum of the durations of the stages.
+func (t *stageTimer) total() time.Duration {
+	var total time.Duration
+	for _, stage := range t.stages {
+		total += stage.Duration
+	}
+	return total
+}
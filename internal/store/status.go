@@ -0,0 +1,97 @@
+/*
+Copyright 2024 Andrew Meredith
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"fmt"
+	"time"
+)
+
+// Status describes the state of a connection, for use by health checks.
+type Status struct {
+	// Basis is the latest transaction that the connection has observed.
+	Basis ID
+	// IdentsLoaded reports whether every ident in storage has been loaded
+	// into the connection's ident cache. Until then, idents that are not
+	// cached are resolved from storage. It is always set for a bounded ident
+	// cache, which is filled as idents are used.
+	IdentsLoaded bool
+	// IdentCache describes the use of the connection's ident cache.
+	IdentCache IdentCacheStats
+	// Transactor reports whether the connection writes to storage itself, as
+	// opposed to a peer, which forwards its writes to a transactor.
+	Transactor bool
+	// TransactorBasis is the latest transaction that the connection's
+	// transactor has committed. For a transactor, it is Basis.
+	TransactorBasis ID
+	// Lag is how far the connection trails its transactor: the time between
+	// the commits of Basis and TransactorBasis. It is zero for a transactor.
+	Lag time.Duration
+	// Admission describes the decisions of the connection's
+	// AdmissionController. It is zero if the connection has none.
+	Admission AdmissionStats
+	// Memory describes the memory accounted for by the connection.
+	Memory MemoryStats
+}
+
+// Status returns the current state of the connection.
+func (conn *Connection) Status() (Status, error) {
+	status := Status{
+		Basis:        ID(conn.basis.Load()),
+		IdentsLoaded: conn.identCache.hydrated.Load(),
+		IdentCache:   conn.identCache.stats(),
+		Transactor:   conn.transactor == nil,
+		Memory:       conn.memory.stats(),
+	}
+	if conn.admission != nil {
+		status.Admission = conn.admission.Stats()
+	}
+	status.TransactorBasis = status.Basis
+	if conn.transactor != nil {
+		status.TransactorBasis = ID(conn.transactor.basis.Load())
+	}
+	if status.TransactorBasis > status.Basis {
+		lag, err := conn.lag(status.Basis, status.TransactorBasis)
+		if err != nil {
+			return status, err
+		}
+		status.Lag = lag
+	}
+	return status, nil
+}
+
+// commitTimeOf returns the commit time of a transaction, or the zero time if
+// txID is zero because no transaction has been observed.
+func (conn *Connection) commitTimeOf(txID ID) (time.Time, error) {
+	if txID == 0 {
+		return time.Time{}, nil
+	}
+	facts, err := conn.DB().systemFacts(txID)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("reading transaction %d: %w", txID, err)
+	}
+	t, _ := facts[IDTxCommitTime].(time.Time)
+	return t, nil
+}
+
+// Ping checks that the connection's storage is reachable by reading from it.
+func (conn *Connection) Ping() error {
+	if _, err := conn.DB().systemVersion(); err != nil {
+		return fmt.Errorf("reading from storage: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,358 @@
+/*
+Copyright 2024 Andrew Meredith
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// QueryDelta describes how the results of a live query changed as the result
+// of a single transaction.
+type QueryDelta struct {
+	Tx      ID
+	Added   [][]Value
+	Removed [][]Value
+}
+
+// Subscription is a live query. Whenever a transaction touches an attribute
+// that the query depends on, the query is re-evaluated for just the bindings
+// that the transaction's facts take part in, and the changes to the results
+// are delivered as deltas.
+type Subscription struct {
+	query    Query
+	patterns []livePattern
+	attrs    map[ID]struct{}
+	allAttr  bool
+
+	initial [][]Value
+	current map[string][]Value
+	// basis is the latest transaction reflected in current, and db is a view
+	// of the database as of basis.
+	basis ID
+	db    Database
+
+	reports *txReportQueue
+	deltas  chan QueryDelta
+	done    chan struct{}
+	once    sync.Once
+
+	mu  sync.Mutex
+	err error
+}
+
+// livePattern is a pattern of a live query, along with the ID of its
+// attribute if the attribute is given directly.
+type livePattern struct {
+	Pattern
+	attr ID
+}
+
+// Subscribe registers a live query against the current database. The query
+// must take a single database. Deltas are computed relative to the results
+// returned by Initial().
+//
+// A subscription does not delay the transactions of its connection. If it
+// falls so far behind that the reports of 16 transactions are waiting to be
+// evaluated, e.g. because its deltas are not read, it is stopped: Deltas()
+// is closed and Err() returns ErrSlowConsumer.
+func (conn *Connection) Subscribe(q Query) (*Subscription, error) {
+	if len(q.In) > 1 {
+		return nil, errors.New("live queries must take a single database")
+	}
+	patterns, err := livePatterns(conn, q)
+	if err != nil {
+		return nil, fmt.Errorf("analyzing query dependencies: %w", err)
+	}
+	// If any pattern has a variable attribute, the query may depend on every
+	// attribute.
+	attrs := make(map[ID]struct{})
+	var allAttrs bool
+	for _, p := range patterns {
+		if p.attr == 0 {
+			allAttrs = true
+		}
+		attrs[p.attr] = struct{}{}
+	}
+
+	// Register for reports before evaluating the initial results so that no
+	// transaction can be missed between the two. The initial results are
+	// read as of the basis, and the reports of transactions up to the basis
+	// are skipped.
+	reports := conn.txReports.add(16, true)
+	basis := conn.DB().Basis.ID()
+	db := conn.DB().AsOf(basis)
+	initial, err := RunQuery(q, db)
+	if err != nil {
+		reports.remove()
+		return nil, err
+	}
+
+	sub := &Subscription{
+		query:    q,
+		patterns: patterns,
+		attrs:    attrs,
+		allAttr:  allAttrs,
+		initial:  initial,
+		current:  rowSet(initial),
+		basis:    basis,
+		db:       db,
+		reports:  reports,
+		deltas:   make(chan QueryDelta, 16),
+		done:     make(chan struct{}),
+	}
+	go sub.run()
+
+	return sub, nil
+}
+
+// Initial returns the results of the query at the time that the subscription
+// was created.
+func (s *Subscription) Initial() [][]Value {
+	return s.initial
+}
+
+// Deltas returns a channel of changes to the query results. The channel is
+// closed when the subscription is closed or fails, in which case Err()
+// returns the cause.
+func (s *Subscription) Deltas() <-chan QueryDelta {
+	return s.deltas
+}
+
+// Err returns the error that terminated the subscription, if any.
+func (s *Subscription) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// Close stops the subscription.
+func (s *Subscription) Close() {
+	s.once.Do(func() {
+		close(s.done)
+		s.reports.remove()
+	})
+}
+
+func (s *Subscription) fail(err error) {
+	s.mu.Lock()
+	s.err = err
+	s.mu.Unlock()
+	s.Close()
+}
+
+func (s *Subscription) run() {
+	defer close(s.deltas)
+	for report := range s.reports.ch {
+		if report.Tx <= s.basis {
+			continue
+		}
+		if !s.affectedBy(report) {
+			s.basis, s.db = report.Tx, report.DBAfter
+			continue
+		}
+		delta, err := s.reevaluate(report)
+		if err != nil {
+			s.fail(err)
+			return
+		}
+		s.basis, s.db = report.Tx, report.DBAfter
+		if len(delta.Added) == 0 && len(delta.Removed) == 0 {
+			continue
+		}
+		select {
+		case s.deltas <- delta:
+		case <-s.done:
+			return
+		}
+	}
+	if s.reports.dropped.Load() {
+		s.fail(ErrSlowConsumer)
+	}
+}
+
+// affectedBy reports whether a transaction touched any attribute that the
+// query depends on.
+func (s *Subscription) affectedBy(report TxReport) bool {
+	if s.allAttr {
+		return true
+	}
+	for _, ra := range report.TxData {
+		if _, ok := s.attrs[ra.Attribute]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// reevaluate computes the changes that a transaction makes to the results.
+// Queries only join facts, so a row can only be added by a derivation that
+// includes a fact that the transaction added, and a row can only be removed
+// if the transaction changed an attribute of an entity that one of its
+// derivations read. The query is evaluated for the bindings of those facts
+// alone, before and after the transaction.
+func (s *Subscription) reevaluate(report TxReport) (QueryDelta, error) {
+	delta := QueryDelta{Tx: report.Tx}
+	// derived holds the rows that are known to be results after the
+	// transaction.
+	derived := make(map[string]struct{})
+	for _, seed := range s.seeds(report.TxData, true) {
+		err := s.eval(report.DBAfter, seed, func(key string, row []Value) error {
+			derived[key] = struct{}{}
+			if _, ok := s.current[key]; !ok {
+				s.current[key] = row
+				delta.Added = append(delta.Added, row)
+			}
+			return nil
+		})
+		if err != nil {
+			return QueryDelta{}, fmt.Errorf("re-evaluating live query: %w", err)
+		}
+	}
+
+	var candidates [][]Value
+	for _, seed := range s.seeds(report.TxData, false) {
+		err := s.eval(s.db, seed, func(key string, row []Value) error {
+			if _, ok := derived[key]; ok {
+				return nil
+			}
+			if _, ok := s.current[key]; ok {
+				derived[key] = struct{}{}
+				candidates = append(candidates, row)
+			}
+			return nil
+		})
+		if err != nil {
+			return QueryDelta{}, fmt.Errorf("re-evaluating live query: %w", err)
+		}
+	}
+	// A row that the transaction's facts took part in may still be derived
+	// in another way.
+	for _, row := range candidates {
+		seed := make(binding, len(row))
+		for i, v := range s.query.Find {
+			seed[v] = row[i]
+		}
+		var holds bool
+		err := s.eval(report.DBAfter, seed, func(string, []Value) error {
+			holds = true
+			return errStopScan
+		})
+		if err != nil && !errors.Is(err, errStopScan) {
+			return QueryDelta{}, fmt.Errorf("re-evaluating live query: %w", err)
+		}
+		if !holds {
+			delete(s.current, rowKey(row))
+			delta.Removed = append(delta.Removed, row)
+		}
+	}
+
+	return delta, nil
+}
+
+// eval evaluates the query against db, starting from seed.
+func (s *Subscription) eval(db Database, seed binding, emit func(key string, row []Value) error) error {
+	_, err := runQuery(s.query, []Database{db}, seed, &stageTimer{}, func(row []Value) error {
+		return emit(rowKey(row), row)
+	})
+	return err
+}
+
+// seeds returns the distinct bindings of the query's patterns to the facts of
+// a transaction. If withValues is set, the patterns are bound to the entity,
+// attribute, and value of every fact that the transaction added. Otherwise,
+// they are bound to the entity and attribute of every fact that the
+// transaction changed, which also covers values of the attribute that the
+// transaction replaced.
+func (s *Subscription) seeds(data []ResolvedAssertion, withValues bool) []binding {
+	var out []binding
+	seen := make(map[string]struct{})
+	for _, ra := range data {
+		if withValues && ra.mode != AssertModeAddition {
+			continue
+		}
+		for _, p := range s.patterns {
+			if p.attr != 0 && p.attr != ra.Attribute {
+				continue
+			}
+			seed := make(binding, 3)
+			ok := seed.bind(p.Entity, ra.EntityID) && seed.bind(p.Attribute, ra.Attribute)
+			if ok && withValues {
+				ok = seed.bind(p.Value, ra.Value)
+			}
+			if !ok {
+				continue
+			}
+			key := fmt.Sprintf("%#v", seed)
+			if _, ok := seen[key]; ok {
+				continue
+			}
+			seen[key] = struct{}{}
+			out = append(out, seed)
+		}
+	}
+	return out
+}
+
+// bind binds the term to val if it is a variable. It reports false if the
+// variable is already bound to a different value.
+func (b binding) bind(term any, val Value) bool {
+	v, ok := term.(Var)
+	if !ok {
+		return true
+	}
+	if existing, ok := b[v]; ok {
+		return ValueEqual(existing, val)
+	}
+	b[v] = val
+	return true
+}
+
+func rowKey(row []Value) string {
+	return fmt.Sprintf("%#v", row)
+}
+
+func rowSet(rows [][]Value) map[string][]Value {
+	set := make(map[string][]Value, len(rows))
+	for _, row := range rows {
+		set[rowKey(row)] = row
+	}
+	return set
+}
+
+// livePatterns returns the patterns of a query, which may be nested in groups,
+// resolving the attributes that are given directly.
+func livePatterns(conn *Connection, q Query) ([]livePattern, error) {
+	var out []livePattern
+	for _, c := range flattenClauses(q.Where, "") {
+		p, ok := c.(Pattern)
+		if !ok {
+			continue
+		}
+		lp := livePattern{Pattern: p}
+		if _, ok := p.Attribute.(Var); !ok {
+			ident, err := ResolveIdent(conn, p.Attribute)
+			if err != nil {
+				return nil, err
+			}
+			lp.attr = ident.ID
+		}
+		out = append(out, lp)
+	}
+	return out, nil
+}
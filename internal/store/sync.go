@@ -0,0 +1,117 @@
+/*
+Copyright 2024 Andrew Meredith
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import "fmt"
+
+// SyncEntity reconciles an existing entity with data, which describes the
+// desired state of the attributes that it contains. Values that the entity
+// already holds are left alone, values that differ are asserted, and values of
+// cardinality-many attributes that are not in data are retracted. A nil value
+// retracts every value of the attribute. Attributes that are not in data are
+// not modified.
+//
+// If the entity already matches data, no transaction is committed and the
+// result holds no data.
+func (conn *Connection) SyncEntity(idResolver Resolver, data EntityData) (*AssertResult, error) {
+	if conn.readOnly {
+		return nil, ErrReadOnly
+	}
+	// The current indexes keep one value of an attribute per entity and
+	// valid time, so the values that the entity holds are read from history,
+	// which keeps every value of cardinality-many attributes.
+	db := conn.DB()
+	ent, err := db.AsOf(db.Basis.ID()).GetEntity(idResolver)
+	if err != nil {
+		return nil, err
+	}
+	eid := ent.ID()
+
+	// Desired values are resolved by the transaction so that they can be
+	// compared with the stored values.
+	desired := EntityData{"db/id": eid}
+	var cleared []any
+	for attr, val := range data {
+		switch {
+		case attr == "db/id":
+			continue
+		case val == nil:
+			cleared = append(cleared, attr)
+		default:
+			desired[attr] = val
+		}
+	}
+	tx := conn.NewTx()
+	if err := tx.Add(desired); err != nil {
+		return nil, err
+	}
+	if err := tx.flush(); err != nil {
+		return nil, tx.fail(err)
+	}
+
+	wanted := make(map[ID][]Value)
+	for _, assertion := range tx.resolved {
+		attr := assertion.attribute.(ID)
+		wanted[attr] = append(wanted[attr], assertion.value)
+	}
+	clearedIdents, err := conn.ResolveIdents(cleared)
+	if err != nil {
+		return nil, tx.fail(fmt.Errorf("resolving attribute idents: %w", err))
+	}
+	for _, ident := range clearedIdents {
+		wanted[ident.ID] = nil
+	}
+
+	// Retractions precede additions so that a replaced value never clobbers
+	// its replacement.
+	var retractions []Assertion
+	for attr, vals := range wanted {
+		cardinality, err := conn.cardinalityOf(attr)
+		if err != nil {
+			return nil, tx.fail(err)
+		}
+		if cardinality != IDCardinalityMany && vals != nil {
+			// Asserting a new value replaces the current one.
+			continue
+		}
+		for _, cur := range attributeValues(ent.state[attr]) {
+			if !containsValue(vals, cur) {
+				retractions = append(retractions, Assertion{
+					entityID:  eid,
+					attribute: attr,
+					value:     cur,
+					mode:      AssertModeRetraction,
+				})
+			}
+		}
+	}
+	additions := make([]Assertion, 0, len(tx.resolved))
+	for _, assertion := range tx.resolved {
+		attr := assertion.attribute.(ID)
+		if containsValue(attributeValues(ent.state[attr]), assertion.value) {
+			continue
+		}
+		additions = append(additions, assertion)
+	}
+
+	if len(retractions) == 0 && len(additions) == 0 {
+		tx.done = true
+		return &AssertResult{DB: conn.DB()}, nil
+	}
+	tx.resolved = append(retractions, additions...)
+	return tx.Commit()
+}
@@ -0,0 +1,324 @@
+/*
+Copyright 2024 Andrew Meredith
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+// systemSchemaVersion is the version of the system schema defined by this
+// release. It must be incremented whenever systemSchema changes.
+const systemSchemaVersion int64 = 14
+
+// systemEntity declares a built-in ident along with the facts that
+// InitializeDB asserts about it.
+type systemEntity struct {
+	ID   ID
+	Name string
+	// Facts holds every fact about the entity other than its db/ident.
+	Facts map[ID]any
+	// Reserved entities are known to the ident cache but are not yet
+	// installed in the database.
+	Reserved bool
+}
+
+// systemSchema is the single definition of the system partition. Both the
+// ident cache's builtin idents and the schema facts asserted by InitializeDB
+// are derived from it.
+var systemSchema = []systemEntity{
+	// Attributes.
+	{
+		ID:   IDID,
+		Name: "db/id",
+		Facts: map[ID]any{
+			IDType:        IDTypeInt64,
+			IDCardinality: IDCardinalityOne,
+			IDUnique:      IDUniqueIdentity,
+			IDDoc:         "Entity ID",
+		},
+	},
+	{
+		ID:   IDIdent,
+		Name: "db/ident",
+		Facts: map[ID]any{
+			IDType:        IDTypeRef,
+			IDCardinality: IDCardinalityOne,
+			IDUnique:      IDUniqueIdentity,
+			IDDoc:         "Global ident. Should be applied to schema entities and global values like enum variants.",
+		},
+	},
+	{
+		ID:   IDType,
+		Name: "db/type",
+		Facts: map[ID]any{
+			IDType:        IDTypeRef,
+			IDCardinality: IDCardinalityOne,
+			IDDoc:         "Schema entity type",
+		},
+	},
+	{
+		ID:   IDCompositeComponents,
+		Name: "db/compositeComponents",
+		Facts: map[ID]any{
+			IDType:        IDTypeTuple,
+			IDCardinality: IDCardinalityOne,
+			IDDoc:         "Attributes whose values make up the value of a composite attribute, in order.",
+		},
+	},
+	{
+		ID:   IDCardinality,
+		Name: "db/cardinality",
+		Facts: map[ID]any{
+			IDType:        IDTypeRef,
+			IDCardinality: IDCardinalityOne,
+			IDDoc:         "Cardinality of an attribute. Enumerated value: db.cardinality/one or db.cardinality/many",
+		},
+	},
+	{
+		ID:   IDUnique,
+		Name: "db/unique",
+		Facts: map[ID]any{
+			IDType:        IDTypeRef,
+			IDCardinality: IDCardinalityOne,
+			IDDoc:         "Uniqueness of an attribute. Enumerated value: db.unique/identity or db.unique/value. Only one entity may have a given value of a unique attribute.",
+		},
+	},
+	{
+		ID:   IDIndexed,
+		Name: "db/indexed",
+		Facts: map[ID]any{
+			IDType:        IDTypeBoolean,
+			IDCardinality: IDCardinalityOne,
+			IDDoc:         "Whether an attribute is indexed. If true, the attribute will be indexed in the AVET index.",
+		},
+	},
+	{
+		ID:   IDDoc,
+		Name: "db/doc",
+		Facts: map[ID]any{
+			IDType:        IDTypeString,
+			IDCardinality: IDCardinalityOne,
+			IDDoc:         "Documentation for an attribute or entity.",
+		},
+	},
+	{
+		ID:   IDAlias,
+		Name: "db/alias",
+		Facts: map[ID]any{
+			IDType:        IDTypeString,
+			IDCardinality: IDCardinalityMany,
+			IDUnique:      IDUniqueIdentity,
+			IDDoc:         "Alternate name for an entity. An alias resolves to the same entity as its db/ident.",
+		},
+	},
+	{
+		ID:   IDInterned,
+		Name: "db/interned",
+		Facts: map[ID]any{
+			IDType:        IDTypeBoolean,
+			IDCardinality: IDCardinalityOne,
+			IDDoc:         "Whether the values of an attribute are interned. Interned values are stored once in a dictionary and referenced by ID from index entries, which suits attributes with few distinct values.",
+		},
+	},
+	{
+		ID:   IDTxCommitTime,
+		Name: "db.tx/commitTime",
+		Facts: map[ID]any{
+			IDType:        IDTypeTimestamp,
+			IDCardinality: IDCardinalityOne,
+			IDDoc:         "Timestamp of the transaction commit.",
+		},
+	},
+	{
+		ID:   IDTxHash,
+		Name: "db.tx/hash",
+		Facts: map[ID]any{
+			IDType:        IDTypeBinary,
+			IDCardinality: IDCardinalityOne,
+			IDDoc:         "Merkle root of the facts of the transaction, which verifies that they have not changed since it was committed.",
+		},
+	},
+	{
+		ID:   IDOutboxTopic,
+		Name: "db.outbox/topic",
+		Facts: map[ID]any{
+			IDType:        IDTypeString,
+			IDCardinality: IDCardinalityOne,
+			IDDoc:         "Topic of an event in the transactional outbox. Events are retracted once they have been published.",
+		},
+	},
+	{
+		ID:   IDOutboxKey,
+		Name: "db.outbox/key",
+		Facts: map[ID]any{
+			IDType:        IDTypeBinary,
+			IDCardinality: IDCardinalityOne,
+			IDDoc:         "Partitioning key of an event in the transactional outbox.",
+		},
+	},
+	{
+		ID:   IDOutboxPayload,
+		Name: "db.outbox/payload",
+		Facts: map[ID]any{
+			IDType:        IDTypeBinary,
+			IDCardinality: IDCardinalityOne,
+			IDDoc:         "Payload of an event in the transactional outbox.",
+		},
+	},
+	{
+		ID:   IDTriggerName,
+		Name: "db.trigger/name",
+		Facts: map[ID]any{
+			IDType:        IDTypeString,
+			IDCardinality: IDCardinalityOne,
+			IDUnique:      IDUniqueIdentity,
+			IDDoc:         "Name of a trigger whose progress is recorded by the entity.",
+		},
+	},
+	{
+		ID:   IDTriggerTx,
+		Name: "db.trigger/tx",
+		Facts: map[ID]any{
+			IDType:        IDTypeRef,
+			IDCardinality: IDCardinalityOne,
+			IDDoc:         "The last transaction that a trigger has processed.",
+		},
+	},
+	{
+		ID:   IDOwner,
+		Name: "db/owner",
+		Facts: map[ID]any{
+			IDType:        IDTypeString,
+			IDCardinality: IDCardinalityMany,
+			IDDoc:         "Owner of an attribute or namespace, such as a team or person responsible for it.",
+		},
+	},
+	{
+		ID:   IDDeprecated,
+		Name: "db/deprecated",
+		Facts: map[ID]any{
+			IDType:        IDTypeBoolean,
+			IDCardinality: IDCardinalityOne,
+			IDDoc:         "Whether an attribute or namespace is deprecated. No attributes may be added to a deprecated namespace.",
+		},
+	},
+	{
+		ID:   IDReplacedBy,
+		Name: "db/replacedBy",
+		Facts: map[ID]any{
+			IDType:        IDTypeRef,
+			IDCardinality: IDCardinalityOne,
+			IDDoc:         "Attribute that replaces a deprecated attribute.",
+		},
+	},
+	{
+		ID:   IDHistoryRetention,
+		Name: "db/historyRetention",
+		Facts: map[ID]any{
+			IDType:        IDTypeString,
+			IDCardinality: IDCardinalityOne,
+			IDDoc:         "How long the history of an attribute, or of every attribute in a namespace, is kept after it is retracted or replaced, such as \"90d\" or \"36h\".",
+		},
+	},
+	{
+		ID:   IDInferred,
+		Name: "db/inferred",
+		Facts: map[ID]any{
+			IDType:        IDTypeBoolean,
+			IDCardinality: IDCardinalityOne,
+			IDDoc:         "Whether an attribute was created by schema inference and has not yet been reviewed.",
+		},
+	},
+	{
+		ID:   IDAttributePattern,
+		Name: "db/attributePattern",
+		Facts: map[ID]any{
+			IDType:        IDTypeString,
+			IDCardinality: IDCardinalityOne,
+			IDDoc:         "Regular expression that the names of new attributes in a namespace must match, excluding the namespace.",
+		},
+	},
+	{
+		ID:   IDSystemVersion,
+		Name: "db.system/version",
+		Facts: map[ID]any{
+			IDType:        IDTypeInt64,
+			IDCardinality: IDCardinalityOne,
+			IDDoc:         "Version of the system schema that the database was initialized with.",
+		},
+	},
+
+	// The system entity.
+	{
+		ID:   IDSystem,
+		Name: "db/system",
+		Facts: map[ID]any{
+			IDSystemVersion: systemSchemaVersion,
+			IDDoc:           "The database's system entity.",
+		},
+	},
+
+	// Enumerated values.
+	systemEnum(IDCardinalityOne, "db.cardinality/one", "An attribute has at most one value per entity."),
+	systemEnum(IDCardinalityMany, "db.cardinality/many", "An attribute may have any number of values per entity."),
+	systemEnum(IDUniqueIdentity, "db.unique/identity", "A unique attribute whose value identifies an entity. Asserting a value that another entity holds upserts that entity."),
+	systemEnum(IDUniqueValue, "db.unique/value", "A unique attribute whose value may not be held by two entities. Asserting a value that another entity holds is a conflict."),
+	systemEnum(IDTypeString, "db.type/string", "UTF-8 string."),
+	systemEnum(IDTypeBoolean, "db.type/boolean", "Boolean."),
+	systemEnum(IDTypeInt64, "db.type/int64", "Signed 64-bit integer."),
+	systemEnum(IDTypeInt32, "db.type/int32", "Signed 32-bit integer."),
+	systemEnum(IDTypeInt16, "db.type/int16", "Signed 16-bit integer."),
+	systemEnum(IDTypeInt8, "db.type/int8", "Signed 8-bit integer."),
+	systemEnum(IDTypeFloat64, "db.type/float64", "64-bit floating point number."),
+	systemEnum(IDTypeFloat32, "db.type/float32", "32-bit floating point number."),
+	systemEnum(IDTypeDecimal, "db.type/decimal", "Arbitrary-precision decimal number."),
+	systemEnum(IDTypeTimestamp, "db.type/timestamp", "Instant in time."),
+	systemEnum(IDTypeDate, "db.type/date", "Calendar date."),
+	systemEnum(IDTypeRef, "db.type/ref", "Reference to another entity."),
+	systemEnum(IDTypeBinary, "db.type/binary", "Arbitrary bytes stored inline."),
+	systemEnum(IDTypeUUID, "db.type/uuid", "UUID."),
+	systemEnum(IDTypeULID, "db.type/ulid", "ULID."),
+	systemEnum(IDTypeComposite, "db.type/composite", "Tuple of other attribute values."),
+	systemEnum(IDTypeBlob, "db.type/blob", "Reference to content in the blob store."),
+	systemEnum(IDTypeTuple, "db.type/tuple", "Ordered sequence of values of any type."),
+}
+
+func systemEnum(id ID, name, doc string) systemEntity {
+	return systemEntity{
+		ID:   id,
+		Name: name,
+		Facts: map[ID]any{
+			IDDoc: doc,
+		},
+	}
+}
+
+// systemIdents returns the idents of every entity in the system schema.
+func systemIdents() []Ident {
+	idents := make([]Ident, len(systemSchema))
+	for i, ent := range systemSchema {
+		idents[i] = Ident{ID: ent.ID, Name: ent.Name}
+	}
+	return idents
+}
+
+// facts returns the facts that InitializeDB asserts about the entity,
+// including its db/ident.
+func (ent systemEntity) facts() map[ID]any {
+	facts := make(map[ID]any, len(ent.Facts)+1)
+	facts[IDIdent] = ent.ID
+	for attr, value := range ent.Facts {
+		facts[attr] = value
+	}
+	return facts
+}
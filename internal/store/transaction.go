@@ -19,6 +19,7 @@ package store
 import (
 	"errors"
 	"fmt"
+	"time"
 )
 
 type Assertable interface {
@@ -45,6 +46,8 @@ type Assertion struct {
 	attribute any
 	value     any
 	mode      AssertMode
+	validFrom time.Time
+	validTo   time.Time
 	err       error
 }
 
@@ -53,6 +56,16 @@ type ResolvedAssertion struct {
 	mode AssertMode
 }
 
+// NewResolvedAssertion constructs a ResolvedAssertion from a fact that has
+// already been resolved. This is primarily used by Indexer implementations
+// that need to reproduce assertions read from history.
+func NewResolvedAssertion(fct Fact, mode AssertMode) ResolvedAssertion {
+	return ResolvedAssertion{
+		Fact: fct,
+		mode: mode,
+	}
+}
+
 func (ra ResolvedAssertion) Mode() AssertMode {
 	return ra.mode
 }
@@ -90,6 +103,45 @@ func Redact(eid any, attribute any, value any) Assertion {
 	panic("Redact() not yet implemented")
 }
 
+// ValidDuring returns a copy of the assertion that only holds during the
+// valid-time period [from, to). Either bound may be the zero time to leave the
+// period unbounded on that side.
+func (a Assertion) ValidDuring(from, to time.Time) Assertion {
+	a.validFrom = from
+	a.validTo = to
+	a.checkAndSetErr()
+	return a
+}
+
+// ValidDuring wraps one or more Assertables such that every assertion they
+// produce only holds during the valid-time period [from, to).
+func ValidDuring(from, to time.Time, assertables ...Assertable) Assertable {
+	return validTimeAssertable{
+		from:        from,
+		to:          to,
+		assertables: assertables,
+	}
+}
+
+type validTimeAssertable struct {
+	from, to    time.Time
+	assertables []Assertable
+}
+
+func (v validTimeAssertable) Assertions(conn *Connection) ([]Assertion, error) {
+	var out []Assertion
+	for _, a := range v.assertables {
+		assertions, err := a.Assertions(conn)
+		if err != nil {
+			return nil, err
+		}
+		for _, assertion := range assertions {
+			out = append(out, assertion.ValidDuring(v.from, v.to))
+		}
+	}
+	return out, nil
+}
+
 // checkAndSetErr validates that the EntityID, Attribute, and Value of the
 // assertion. If any are invalid, the `err` property is set
 func (a *Assertion) checkAndSetErr() {
@@ -98,6 +150,7 @@ func (a *Assertion) checkAndSetErr() {
 		guardEntityID(a.entityID),
 		guardAttribute(a.attribute),
 		guardValue(a.value),
+		guardValidTime(a.validFrom, a.validTo),
 	)
 }
 
@@ -111,8 +164,10 @@ func guardMode(mode AssertMode) error {
 }
 
 func guardEntityID(eid any) error {
-	switch eid.(type) {
-	case string, ID, tempID:
+	switch v := eid.(type) {
+	case tempID:
+		return v.validate()
+	case string, ID:
 		return nil
 	default:
 		return fmt.Errorf("invalid type for entityID: %T", eid)
@@ -129,5 +184,24 @@ func guardAttribute(attr any) error {
 }
 
 func guardValue(val any) error {
+	if tid, ok := val.(tempID); ok {
+		return tid.validate()
+	}
+	return nil
+}
+
+func guardValidTime(from, to time.Time) error {
+	if !from.IsZero() && !to.IsZero() && !from.Before(to) {
+		return fmt.Errorf("invalid valid-time period: %s is not before %s", from, to)
+	}
+	return nil
+}
+
+// guardUserPartition ensures that an ID allocated by an IDManager belongs to the
+// user partition.
+func guardUserPartition(id ID) error {
+	if id <= 0 {
+		return fmt.Errorf("allocated ID %d is outside of the user partition", id)
+	}
 	return nil
 }
@@ -0,0 +1,334 @@
+/*
+Copyright 2024 Andrew Meredith
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/kendru/canter/pkg/dataflow"
+)
+
+// Trigger runs code after every transaction that asserts or retracts facts of
+// an attribute, e.g. to maintain denormalized data or to start a workflow.
+// Triggers are run by a TriggerRunner.
+type Trigger struct {
+	// Name identifies the trigger. The progress of the trigger is recorded in
+	// the database under its name, so a trigger that is renamed processes
+	// every matching transaction again.
+	Name string
+	// Attribute is the attribute whose facts the trigger matches. It may be
+	// an ident name, Ident, or ID.
+	Attribute any
+	// Filter, if set, restricts the trigger to facts whose values match it.
+	Filter ValuePredicate
+	// Retractions makes the trigger match retracted facts as well as
+	// asserted ones. Only explicit retractions are matched: replacing the
+	// value of a cardinality-one attribute records just the new value.
+	Retractions bool
+
+	// Handler, if set, is called with the matching facts of each
+	// transaction. If it returns an error, the transaction is delivered again
+	// the next time the trigger runs.
+	Handler func(ctx context.Context, evt TriggerEvent) error
+	// Then, if set, derives a follow-up transaction from the matching facts
+	// of each transaction. The follow-up transaction is committed atomically
+	// with the trigger's progress, so it is committed exactly once.
+	Then func(evt TriggerEvent) ([]Assertable, error)
+}
+
+// TriggerEvent is delivered to a trigger for each transaction that it
+// matches.
+type TriggerEvent struct {
+	Trigger string
+	Tx      ID
+	// Facts are the facts of the transaction that matched the trigger. Their
+	// Mode tells assertions from retractions.
+	Facts []ResolvedAssertion
+	// DB is the database as of the transaction.
+	DB Database
+}
+
+// TriggerRunner delivers committed transactions to triggers, in the order in
+// which they were committed.
+//
+// The progress of the triggers is recorded in the database at the end of each
+// run, in a single transaction along with their follow-up transactions, so
+// delivery is at least once: a transaction may be delivered again if the
+// runner stops before recording its progress.
+type TriggerRunner struct {
+	conn     *Connection
+	triggers []Trigger
+}
+
+// NewTriggerRunner returns a runner for triggers against the connection's
+// database. Only one runner should run a given trigger at a time.
+func (conn *Connection) NewTriggerRunner(triggers ...Trigger) (*TriggerRunner, error) {
+	names := make(map[string]struct{}, len(triggers))
+	for _, t := range triggers {
+		if t.Name == "" {
+			return nil, errors.New("trigger has no name")
+		}
+		if _, ok := names[t.Name]; ok {
+			return nil, fmt.Errorf("duplicate trigger: %s", t.Name)
+		}
+		names[t.Name] = struct{}{}
+		if t.Attribute == nil {
+			return nil, fmt.Errorf("trigger %s has no attribute", t.Name)
+		}
+		if t.Handler == nil && t.Then == nil {
+			return nil, fmt.Errorf("trigger %s has neither a handler nor a follow-up transaction", t.Name)
+		}
+	}
+	return &TriggerRunner{conn: conn, triggers: triggers}, nil
+}
+
+// Run delivers pending transactions, then delivers every subsequent
+// transaction committed through the connection, until ctx is done, a trigger
+// fails, or the connection is closed, in which case it returns ErrClosed.
+// Writers never wait for the runner, and once it has caught up, each run reads
+// only the transactions committed since the last.
+func (r *TriggerRunner) Run(ctx context.Context) error {
+	return r.conn.runAfterCommits(ctx, func(reports []TxReport, complete bool) error {
+		if !complete {
+			_, err := r.RunPending(ctx)
+			return err
+		}
+		_, err := r.deliver(ctx, func(t Trigger, processed ID) ([]TriggerEvent, error) {
+			return r.reportEvents(t, processed, reports)
+		})
+		return err
+	})
+}
+
+// RunPending delivers every transaction that each trigger has not yet
+// processed and returns the number of deliveries.
+func (r *TriggerRunner) RunPending(ctx context.Context) (int, error) {
+	// Events are bounded by the latest transaction in storage rather than the
+	// in-memory basis alone, which may not be known yet for a reopened store.
+	latest, err := r.conn.latestTx()
+	if err != nil {
+		return 0, fmt.Errorf("reading latest transaction: %w", err)
+	}
+	db := r.conn.DB()
+	return r.deliver(ctx, func(t Trigger, processed ID) ([]TriggerEvent, error) {
+		return r.pendingEvents(db, t, processed, latest)
+	})
+}
+
+// deliver delivers the events that pending finds for each trigger after the
+// last transaction that the trigger has processed, and records the progress
+// of every trigger, along with their follow-up transactions, in a single
+// transaction. Progress is recorded up to the first failed delivery.
+func (r *TriggerRunner) deliver(ctx context.Context, pending func(t Trigger, processed ID) ([]TriggerEvent, error)) (int, error) {
+	db := r.conn.DB()
+	progress := r.conn.newTx(false)
+	var delivered int
+	var recorded bool
+	var runErr error
+	for _, t := range r.triggers {
+		processed, err := triggerProgress(db, t.Name)
+		if err != nil {
+			runErr = fmt.Errorf("running trigger %s: %w", t.Name, err)
+			break
+		}
+		events, err := pending(t, processed)
+		if err != nil {
+			runErr = fmt.Errorf("running trigger %s: %w", t.Name, err)
+			break
+		}
+		n, err := r.runTrigger(ctx, t, events, progress)
+		delivered += n
+		recorded = recorded || n > 0
+		if err != nil {
+			runErr = fmt.Errorf("running trigger %s: %w", t.Name, err)
+			break
+		}
+	}
+	if recorded {
+		if _, err := progress.Commit(); err != nil {
+			return delivered, errors.Join(runErr, fmt.Errorf("recording trigger progress: %w", err))
+		}
+	}
+	return delivered, runErr
+}
+
+// runTrigger delivers events to a trigger, adding its follow-up transactions
+// and its progress to the progress transaction. It returns the number of
+// events that were delivered before any failure.
+func (r *TriggerRunner) runTrigger(ctx context.Context, t Trigger, events []TriggerEvent, progress *TxBuilder) (int, error) {
+	var handled int
+	var err error
+	for _, evt := range events {
+		if err = ctx.Err(); err != nil {
+			break
+		}
+		if t.Handler != nil {
+			if err = t.Handler(ctx, evt); err != nil {
+				err = fmt.Errorf("handling transaction %d: %w", evt.Tx, err)
+				break
+			}
+		}
+		if t.Then != nil {
+			var followUp []Assertable
+			if followUp, err = t.Then(evt); err != nil {
+				err = fmt.Errorf("deriving follow-up to transaction %d: %w", evt.Tx, err)
+				break
+			}
+			if err = progress.Add(followUp...); err != nil {
+				err = fmt.Errorf("adding follow-up to transaction %d: %w", evt.Tx, err)
+				break
+			}
+		}
+		handled++
+	}
+	if handled > 0 {
+		last := events[handled-1].Tx
+		addErr := progress.Add(EntityData{
+			"db.trigger/name": t.Name,
+			"db.trigger/tx":   last,
+		})
+		if addErr != nil {
+			return 0, fmt.Errorf("recording progress after transaction %d: %w", last, addErr)
+		}
+	}
+	return handled, err
+}
+
+// triggerProgress returns the last transaction that the named trigger has
+// processed, or zero if it has processed none.
+func triggerProgress(db Database, name string) (ID, error) {
+	eid, err := NewLookup("db.trigger/name", name).resolveIn(db)
+	if errors.Is(err, ErrNoSuchEntity) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("reading trigger progress: %w", err)
+	}
+	attr := IDTriggerTx
+	facts, err := db.scan(&eid, &attr)
+	if err != nil || len(facts) == 0 {
+		return 0, err
+	}
+	return facts[0].Value.(ID), nil
+}
+
+// triggerMatcher reports whether an assertion matches a trigger.
+type triggerMatcher func(ra *ResolvedAssertion) bool
+
+// matcher returns the matcher of a trigger, and the attribute that it
+// matches. If the attribute has not been installed yet, it has no facts, and
+// matcher returns a nil matcher.
+func (r *TriggerRunner) matcher(db Database, t Trigger) (ID, triggerMatcher, error) {
+	attr, err := ResolveIdent(r.conn, t.Attribute)
+	if errors.Is(err, ErrNoSuchIdent) {
+		return 0, nil, nil
+	}
+	if err != nil {
+		return 0, nil, fmt.Errorf("resolving attribute: %w", err)
+	}
+	filter := t.Filter
+	if filter != nil {
+		if filter, err = db.resolvePredicate(attr.ID, filter); err != nil {
+			return 0, nil, fmt.Errorf("resolving filter: %w", err)
+		}
+	}
+	return attr.ID, func(ra *ResolvedAssertion) bool {
+		switch {
+		case ra.Attribute != attr.ID:
+			return false
+		case ra.Mode() == AssertModeRetraction && !t.Retractions:
+			return false
+		case filter != nil && !filter.MatchValue(ra.Value):
+			return false
+		}
+		return true
+	}, nil
+}
+
+// reportEvents returns the events for the reported transactions after
+// processed that match a trigger.
+func (r *TriggerRunner) reportEvents(t Trigger, processed ID, reports []TxReport) ([]TriggerEvent, error) {
+	_, match, err := r.matcher(r.conn.DB(), t)
+	if err != nil || match == nil {
+		return nil, err
+	}
+	var events []TriggerEvent
+	for _, report := range reports {
+		if report.Tx <= processed {
+			continue
+		}
+		var facts []ResolvedAssertion
+		for i := range report.TxData {
+			if match(&report.TxData[i]) {
+				facts = append(facts, report.TxData[i])
+			}
+		}
+		if len(facts) > 0 {
+			events = append(events, TriggerEvent{
+				Trigger: t.Name,
+				Tx:      report.Tx,
+				Facts:   facts,
+				DB:      report.DBAfter,
+			})
+		}
+	}
+	return events, nil
+}
+
+// pendingEvents returns the events for the transactions after processed, up
+// to and including latest, that match a trigger. It reads the whole history
+// of the trigger's attribute.
+func (r *TriggerRunner) pendingEvents(db Database, t Trigger, processed, latest ID) ([]TriggerEvent, error) {
+	attrID, match, err := r.matcher(db, t)
+	if err != nil || match == nil {
+		return nil, err
+	}
+
+	scan, err := db.reader().ScanHistoryAEVT(attrID, nil)
+	if err != nil {
+		return nil, fmt.Errorf("scanning AEVT history: %w", err)
+	}
+	assertions, err := dataflow.CollectIntoSlice(dataflow.NewContext(context.Background()), scan)
+	if err != nil {
+		return nil, fmt.Errorf("scanning AEVT history: %w", err)
+	}
+
+	byTx := make(map[ID][]ResolvedAssertion)
+	for _, ra := range assertions {
+		if ra.Tx <= processed || ra.Tx > latest || !match(ra) {
+			continue
+		}
+		byTx[ra.Tx] = append(byTx[ra.Tx], *ra)
+	}
+
+	events := make([]TriggerEvent, 0, len(byTx))
+	for tx, facts := range byTx {
+		events = append(events, TriggerEvent{
+			Trigger: t.Name,
+			Tx:      tx,
+			Facts:   facts,
+			DB:      db.AsOf(tx),
+		})
+	}
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].Tx < events[j].Tx
+	})
+	return events, nil
+}
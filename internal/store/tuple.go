@@ -0,0 +1,86 @@
+/*
+Copyright 2024 Andrew Meredith
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/gofrs/uuid/v5"
+	"github.com/oklog/ulid/v2"
+)
+
+// Tuple is an ordered sequence of values. It is the value type of
+// db.type/tuple attributes, which model ordered to-many relationships such as
+// the tracks of a playlist: where a cardinality-many attribute holds an
+// unordered set of values, a tuple attribute holds a single value whose
+// elements keep the order in which they were asserted.
+//
+// The elements of a tuple may be of different types. Strings, booleans,
+// integers, floats, timestamps, byte slices, UUIDs, and ULIDs are stored as
+// given, and int values are stored as int64. Refs are given as IDs, tempIDs,
+// lookups, or resolved idents, and are stored as IDs. Since a string element
+// is always stored as a string, an ident in a tuple must be given as an Ident
+// rather than by name.
+//
+// Unlike EntityData values of other slice types, a Tuple is asserted as one
+// value rather than split into a value per element.
+type Tuple []Value
+
+// resolveTupleElement resolves an element of a tuple value, recording any
+// tempID that it uses.
+func (tx *TxBuilder) resolveTupleElement(elem Value) (Value, error) {
+	switch v := elem.(type) {
+	case string, bool, int64, int32, int16, int8, float64, float32,
+		time.Time, []byte, uuid.UUID, ulid.ULID, ID:
+		return v, nil
+	case int:
+		return int64(v), nil
+	case tempID:
+		if err := v.validate(); err != nil {
+			return nil, err
+		}
+		tx.recordTempID(v)
+		return v, nil
+	case Lookup:
+		id, err := tx.resolveLookup(v)
+		if err != nil {
+			return nil, err
+		}
+		return id, nil
+	case Ident:
+		if staged, ok := tx.stagedIdents[identName(v)]; ok {
+			return staged.ID, nil
+		}
+		return v.Resolve(tx.conn)
+	default:
+		return nil, fmt.Errorf("unsupported type for tuple element: %T", elem)
+	}
+}
+
+// withTempIDs returns a copy of the tuple in which tempIDs are replaced by
+// the IDs that they resolved to.
+func (t Tuple) withTempIDs(ids TempIDs) Tuple {
+	out := make(Tuple, len(t))
+	for i, elem := range t {
+		if tid, ok := elem.(tempID); ok {
+			elem = ids[tid.symbol]
+		}
+		out[i] = elem
+	}
+	return out
+}
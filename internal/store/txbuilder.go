@@ -0,0 +1,1147 @@
+/*
+Copyright 2024 Andrew Meredith
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gofrs/uuid/v5"
+	"github.com/kendru/canter/internal/util"
+	"github.com/kendru/canter/pkg/dataflow"
+	"github.com/oklog/ulid/v2"
+)
+
+// txChunkSize is the number of added assertions that a TxBuilder buffers before
+// resolving them.
+const txChunkSize = 1024
+
+// TxBuilder builds a transaction incrementally. Assertions are resolved in bounded
+// chunks as they are added, so a large transaction never needs to hold every
+// Assertable and its expansion in memory at once. Nothing is stored until the
+// transaction is committed. Since assertions are resolved as they are added,
+// an ident that is introduced by the transaction must be added before any
+// assertion that refers to it by name.
+//
+// A TxBuilder is not safe for concurrent use. Once an Add fails or the transaction has
+// been committed, the TxBuilder may not be used again.
+type TxBuilder struct {
+	conn        *Connection
+	allowSystem bool
+	// skipOutbox is set for the transactions of the outbox relay, which must
+	// not emit events of their own.
+	skipOutbox bool
+	// preconditions are checked against the latest database when the
+	// transaction is written.
+	preconditions []precondition
+	// noResolveUnique and isolateTempIDs are set by TxOptions.
+	noResolveUnique bool
+	isolateTempIDs  bool
+	// dryRun is set for the transactions of AssertDryRun, which are
+	// validated but never written.
+	dryRun bool
+	// addTime is the time spent in Add, which is reported to the slow log.
+	addTime time.Duration
+	// admissionKey is the key under which the transaction is admitted by the
+	// connection's AdmissionController.
+	admissionKey string
+	// ctx is passed to the connection's BeforeCommit hook.
+	ctx context.Context
+	// partition is the partition that new entities are allocated in.
+	partition Partition
+
+	// pending holds assertions that have been added but not yet resolved.
+	pending []Assertion
+	// resolved holds assertions whose attributes, values, and entities have
+	// been resolved, except for tempIDs.
+	resolved []Assertion
+
+	tempIDs TempIDs
+	// names holds the names of the NamedTempIDs used in the transaction.
+	names map[string]struct{}
+	// newEntities holds the IDs allocated for tempIDs that did not resolve to
+	// existing entities.
+	newEntities  []ID
+	stagedIdents map[string]Ident
+	// stagedSchema holds the schema of the attributes that a dry run inferred
+	// but did not create.
+	stagedSchema map[ID]SchemaAttribute
+	// lookups caches the lookups that were resolved in a batch.
+	lookups map[lookupKey]ID
+
+	err  error
+	done bool
+}
+
+// NewTx starts a new transaction configured by opts. Like Assert, the
+// transaction may not modify entities in the system partition.
+func (conn *Connection) NewTx(opts ...TxOption) *TxBuilder {
+	tx := conn.newTx(false)
+	for _, opt := range opts {
+		opt.apply(tx)
+	}
+	return tx
+}
+
+func (conn *Connection) newTx(allowSystem bool) *TxBuilder {
+	return &TxBuilder{
+		conn:         conn,
+		allowSystem:  allowSystem,
+		tempIDs:      make(TempIDs),
+		admissionKey: conn.admissionKey,
+		ctx:          context.Background(),
+		names:        make(map[string]struct{}),
+		stagedIdents: make(map[string]Ident),
+		lookups:      make(map[lookupKey]ID),
+	}
+}
+
+// Add adds the assertions produced by the assertables to the transaction. If
+// the transaction would exceed the connection's limit on facts per
+// transaction, Add fails with ErrTxTooLarge.
+func (tx *TxBuilder) Add(assertables ...Assertable) error {
+	if err := tx.usable(); err != nil {
+		return err
+	}
+	defer func(start time.Time) { tx.addTime += time.Since(start) }(time.Now())
+
+	for _, a := range assertables {
+		if opt, ok := a.(TxOption); ok {
+			if tx.size() > 0 {
+				return tx.fail(errors.New("transaction options must be added before any assertions"))
+			}
+			opt.apply(tx)
+			continue
+		}
+
+		assertions, err := a.Assertions(tx.conn)
+		if err != nil {
+			return tx.fail(fmt.Errorf("resolving facts for assertion: %w", err))
+		}
+		if tx.isolateTempIDs {
+			isolate(assertions, tx.conn.idSource)
+		}
+
+		// Return if any assertions have validation errors.
+		assertionErrors := util.Map(assertions, func(assertion Assertion) error {
+			return assertion.err
+		})
+		if err := errors.Join(assertionErrors...); err != nil {
+			return tx.fail(fmt.Errorf("invalid assertions: %w", err))
+		}
+		for _, assertion := range assertions {
+			if err := tx.conn.checkNotComputed(assertion); err != nil {
+				return tx.fail(err)
+			}
+		}
+
+		if max := tx.conn.maxTxFacts; max > 0 && tx.size()+len(assertions) > max {
+			return tx.fail(errors.Join(
+				fmt.Errorf("transaction exceeds the limit of %d facts", max),
+				ErrTxTooLarge,
+			))
+		}
+
+		if tx.pending == nil {
+			tx.pending = assertionPool.get(txChunkSize)
+		}
+		tx.pending = append(tx.pending, assertions...)
+		if len(tx.pending) >= txChunkSize {
+			if err := tx.flush(); err != nil {
+				return tx.fail(err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Commit resolves any remaining assertions and commits the transaction. If
+// the connection's AdmissionController does not admit the transaction, Commit
+// fails with ErrThrottled, and the transaction may be committed again later.
+func (tx *TxBuilder) Commit() (*AssertResult, error) {
+	if err := tx.usable(); err != nil {
+		return nil, err
+	}
+
+	timer := &stageTimer{}
+	timer.add("add", tx.addTime)
+	// Dry runs never write, so they are not subject to admission.
+	if tx.conn.admission != nil && !tx.dryRun {
+		timer.begin("admit")
+		release, err := tx.conn.admission.admit(tx.admissionKey)
+		if err != nil {
+			return nil, err
+		}
+		defer release()
+	}
+	tx.done = true
+
+	res, err := tx.commit(timer)
+	timer.end()
+	entry := SlowLogEntry{Kind: SlowLogTx, Duration: timer.total(), Stages: timer.stages, Err: err}
+	if res != nil {
+		entry.Tx = res.TxID()
+		entry.Assertions = len(res.Data)
+	}
+	tx.conn.slowLog.record(entry)
+	return res, err
+}
+
+// commit resolves and writes the transaction, timing each stage with timer.
+func (tx *TxBuilder) commit(timer *stageTimer) (*AssertResult, error) {
+	timer.begin("resolve")
+
+	if err := tx.flush(); err != nil {
+		return nil, err
+	}
+
+	if err := tx.allocateTempIDs(); err != nil {
+		return nil, err
+	}
+
+	// Second pass: Replace tempIDs with resolved IDs, and populate
+	// ResolvedAssertions. The transaction's ID is assigned when it is written.
+	resolved := make([]ResolvedAssertion, len(tx.resolved))
+	for idx, assertion := range tx.resolved {
+		ra := ResolvedAssertion{
+			Fact: Fact{
+				Attribute: assertion.attribute.(ID),
+				ValidFrom: assertion.validFrom,
+				ValidTo:   assertion.validTo,
+			},
+			mode: assertion.mode,
+		}
+
+		switch v := assertion.entityID.(type) {
+		case ID:
+			ra.Fact.EntityID = v
+		case tempID:
+			ra.Fact.EntityID = tx.tempIDs[v.symbol]
+		default:
+			panic(fmt.Sprintf("unhandled entityID type: %T", assertion.entityID))
+		}
+		if ra.EntityID.IsSystem() && !tx.allowSystem {
+			return nil, errors.Join(
+				fmt.Errorf("entity %d is in the system partition", ra.EntityID),
+				ErrSystemEntity,
+			)
+		}
+
+		switch v := assertion.value.(type) {
+		case tempID:
+			ra.Value = tx.tempIDs[v.symbol]
+		case Tuple:
+			ra.Value = v.withTempIDs(tx.tempIDs)
+		default:
+			ra.Value = assertion.value
+		}
+
+		resolved[idx] = ra
+	}
+	tx.releaseBuffers()
+
+	timer.begin("validate")
+	var err error
+	if resolved, err = tx.deriveComposites(resolved); err != nil {
+		return nil, err
+	}
+	if err := tx.checkUniqueValues(resolved); err != nil {
+		return nil, err
+	}
+	if err := tx.checkNamespaces(resolved); err != nil {
+		return nil, err
+	}
+
+	if tx.conn.outbox != nil && !tx.skipOutbox {
+		if resolved, err = tx.conn.appendOutboxEvents(resolved); err != nil {
+			return nil, err
+		}
+	}
+
+	if tx.conn.beforeCommit != nil {
+		if err := tx.conn.beforeCommit(tx.ctx, resolved); err != nil {
+			return nil, err
+		}
+	}
+
+	newIdents, err := tx.aliasIdents(resolved)
+	if err != nil {
+		return nil, err
+	}
+	newIdents = append(util.Values(tx.stagedIdents), newIdents...)
+
+	timer.begin("write")
+	var res *AssertResult
+	if tx.dryRun {
+		res, err = tx.conn.checkAssert(resolved, tx.tempIDs, tx.preconditions...)
+	} else {
+		res, err = tx.conn.assert(resolved, newIdents, tx.tempIDs, tx.preconditions...)
+	}
+	if err != nil {
+		return nil, err
+	}
+	res.Names = make(map[string]ID, len(tx.names))
+	for name := range tx.names {
+		res.Names[name] = tx.tempIDs[name]
+	}
+	res.newEntities = tx.newEntities
+	res.tx = txFromAssertions(res.TxID(), res.Data)
+	return res, nil
+}
+
+// aliasIdents returns an alias ident for every db/alias added by the resolved
+// assertions. Aliases are stored alongside the transaction's new idents, so
+// the alias resolves to the entity once the transaction commits.
+func (tx *TxBuilder) aliasIdents(resolved []ResolvedAssertion) ([]Ident, error) {
+	var aliases []Ident
+	for _, ra := range resolved {
+		if ra.Attribute != IDAlias || ra.mode != AssertModeAddition {
+			continue
+		}
+		name := ra.Value.(string)
+		if strings.HasPrefix(name, "db/") && !tx.allowSystem {
+			return nil, errors.New(`the "db" namespace is reserved for system identifiers`)
+		}
+		aliases = append(aliases, Ident{
+			ID:    ra.EntityID,
+			Name:  name,
+			Alias: true,
+		})
+	}
+	return aliases, nil
+}
+
+func (tx *TxBuilder) usable() error {
+	if tx.conn.readOnly {
+		return ErrReadOnly
+	}
+	if tx.conn.lifecycle.isClosed() {
+		return ErrClosed
+	}
+	if tx.err != nil {
+		return tx.err
+	}
+	if tx.done {
+		return ErrTxDone
+	}
+	return nil
+}
+
+func (tx *TxBuilder) fail(err error) error {
+	tx.err = err
+	return err
+}
+
+// size is the number of assertions added to the transaction.
+func (tx *TxBuilder) size() int {
+	return len(tx.resolved) + len(tx.pending)
+}
+
+// releaseBuffers returns the transaction's assertion buffers to the pool once
+// its assertions have been resolved.
+func (tx *TxBuilder) releaseBuffers() {
+	assertionPool.put(tx.pending)
+	assertionPool.put(tx.resolved)
+	tx.pending, tx.resolved = nil, nil
+}
+
+// flush resolves the pending assertions.
+func (tx *TxBuilder) flush() error {
+	// In soft schema mode, unknown attributes are created before anything
+	// else is resolved.
+	if tx.conn.inferSchema {
+		if err := tx.inferAttributes(); err != nil {
+			return err
+		}
+	}
+
+	// Allocate any idents that are being asserted for the first time. New
+	// idents are staged and only become visible once the transaction commits.
+	if err := tx.conn.allocateIdents(tx.pending, tx.stagedIdents); err != nil {
+		return err
+	}
+
+	// Lookups in the value position are resolved in a single batch.
+	var lookups []Lookup
+	for _, assertion := range tx.pending {
+		if l, ok := assertion.value.(Lookup); ok {
+			lookups = append(lookups, l)
+		}
+	}
+	if err := tx.resolveLookups(lookups); err != nil {
+		return err
+	}
+
+	// First pass:
+	// 1. Collect tempIDs in the Value position.
+	// 2. Resolve lookups in the Value position.
+	// 3. Resolve idents in the Attribute and Value positions.
+	attrs := identPool.get(len(tx.pending))[:len(tx.pending)]
+	defer identPool.put(attrs)
+	for idx := range tx.pending {
+		attr, err := tx.resolveValue(&tx.pending[idx])
+		if err != nil {
+			return err
+		}
+		attrs[idx] = attr
+	}
+
+	// Unique attributes that may identify a tempID are resolved in a single
+	// batch.
+	lookups = lookups[:0]
+	for idx, assertion := range tx.pending {
+		if _, ok := assertion.entityID.(tempID); !ok {
+			continue
+		}
+		if attr := attrs[idx].ID; attr == IDID || attr == IDIdent || tx.noResolveUnique {
+			continue
+		}
+		schema, err := tx.schemaFor(attrs[idx].ID)
+		if err != nil {
+			return err
+		}
+		if schema.Unique == IDUniqueIdentity {
+			lookups = append(lookups, NewLookup(attrs[idx].Name, assertion.value))
+		}
+	}
+	if err := tx.resolveLookups(lookups); err != nil {
+		return err
+	}
+
+	// Second pass: Collect tempIDs and resolve idents and lookups in the
+	// Entity position.
+	for idx := range tx.pending {
+		if err := tx.resolveEntity(&tx.pending[idx], attrs[idx]); err != nil {
+			return err
+		}
+	}
+	tx.resolved = append(tx.resolved, tx.pending...)
+	tx.pending = tx.pending[:0]
+	return nil
+}
+
+// resolveLookups resolves lookups in a batch and caches the results for
+// resolveLookup.
+func (tx *TxBuilder) resolveLookups(lookups []Lookup) error {
+	if len(lookups) == 0 {
+		return nil
+	}
+	resolved, err := tx.conn.DB().resolveLookups(lookups)
+	if err != nil {
+		return err
+	}
+	for key, id := range resolved {
+		tx.lookups[key] = id
+	}
+	return nil
+}
+
+// resolveLookup resolves a lookup from the batch cache, falling back to
+// resolving it individually.
+func (tx *TxBuilder) resolveLookup(l Lookup) (ID, error) {
+	if attr, ok := tx.conn.identCache.lookupByName(l.AttributeName); ok {
+		if id, ok := tx.lookups[newLookupKey(attr.ID, l.Value)]; ok {
+			if id == unresolvedEntityID {
+				return 0, ErrNoSuchEntity
+			}
+			return id, nil
+		}
+	}
+	return l.Resolve(tx.conn)
+}
+
+// allocateTempIDs allocates IDs for tempIDs. Symbols that were already set via
+// db/id, db/ident, or a unique attribute are skipped.
+func (tx *TxBuilder) allocateTempIDs() error {
+	var unresolvedSymbols []string
+	for symbol, id := range tx.tempIDs {
+		if id == unresolvedEntityID {
+			unresolvedSymbols = append(unresolvedSymbols, symbol)
+		}
+	}
+	if len(unresolvedSymbols) == 0 {
+		return nil
+	}
+
+	// Sort so that IDs are assigned deterministically.
+	sort.Strings(unresolvedSymbols)
+	newIDs, err := tx.nextIDs(unresolvedSymbols)
+	if err != nil {
+		return fmt.Errorf("allocating IDs for tempIDs: %w", err)
+	}
+	for idx, symbol := range unresolvedSymbols {
+		if err := guardPartition(newIDs[idx], tx.partition); err != nil {
+			return fmt.Errorf("allocating ID for tempID %q: %w", symbol, err)
+		}
+		tx.tempIDs[symbol] = newIDs[idx]
+		tx.newEntities = append(tx.newEntities, newIDs[idx])
+	}
+	sort.Slice(tx.newEntities, func(i, j int) bool {
+		return tx.newEntities[i] < tx.newEntities[j]
+	})
+	return nil
+}
+
+// nextIDs allocates an ID for each of symbols, in order, in the
+// transaction's partition. See NOTE [ENTITY-PARTITIONS].
+func (tx *TxBuilder) nextIDs(symbols []string) ([]ID, error) {
+	var ids []ID
+	if tx.partition == 0 {
+		err := tx.conn.retryPolicy.Do("allocating IDs", func() (err error) {
+			ids, err = tx.conn.idManager.NextIDs(len(symbols))
+			return err
+		})
+		return ids, err
+	}
+
+	pm, ok := tx.conn.idManager.(PartitionedIDManager)
+	if !ok {
+		return nil, fmt.Errorf("ID manager cannot allocate IDs in partition %d", tx.partition)
+	}
+	err := tx.conn.retryPolicy.Do("allocating IDs", func() (err error) {
+		ids, err = pm.NextIDsIn(tx.partition, len(symbols))
+		return err
+	})
+	return ids, err
+}
+
+func (tx *TxBuilder) resolveIdent(ident any) (Ident, error) {
+	if staged, ok := tx.stagedIdents[identName(ident)]; ok {
+		return staged, nil
+	}
+	return ResolveIdent(tx.conn, ident)
+}
+
+// schemaFor returns the schema of an attribute, including those staged by the
+// transaction.
+func (tx *TxBuilder) schemaFor(attrID ID) (SchemaAttribute, error) {
+	if schema, ok := tx.stagedSchema[attrID]; ok {
+		return schema, nil
+	}
+	return tx.conn.DB().schemaFor(attrID)
+}
+
+// recordTempID adds a tempID to tx.tempIDs if it is not already present.
+func (tx *TxBuilder) recordTempID(tid tempID) {
+	if tid.named {
+		tx.names[tid.symbol] = struct{}{}
+	}
+	if _, ok := tx.tempIDs[tid.symbol]; !ok {
+		tx.tempIDs[tid.symbol] = unresolvedEntityID
+	}
+}
+
+func (tx *TxBuilder) isIDConflict(sym string, newID ID) bool {
+	resolvedID, ok := tx.tempIDs[sym]
+	return ok &&
+		resolvedID != unresolvedEntityID &&
+		resolvedID != newID
+}
+
+// resolveValue resolves the attribute and value of an assertion in place,
+// recording any tempIDs that it uses. It returns the resolved attribute.
+func (tx *TxBuilder) resolveValue(assertion *Assertion) (Ident, error) {
+	conn := tx.conn
+
+	/////////////////
+	// Attribute Resolution
+
+	// Resolve Attribute to an ID.
+	attribute, err := tx.resolveIdent(assertion.attribute)
+	if err != nil {
+		return NullIdent, err
+	}
+	assertion.attribute = attribute.ID
+
+	/////////////////
+	// Value Resolution
+
+	// Get schema ident. Value resolution is dependent on the type that the
+	// attributes refers to.
+	schema, err := tx.schemaFor(attribute.ID)
+	if err != nil {
+		return NullIdent, err
+	}
+	if !schema.IsAttribute() {
+		return NullIdent, fmt.Errorf("attribute entity %d is not a schema entity", attribute.ID)
+	}
+	valueTypeID := schema.Type
+
+	// db/unique was once a boolean attribute, and true still declares an
+	// identity attribute.
+	isUniqueEnum := attribute.ID == IDUnique && valueTypeID == IDTypeRef
+	if isUniqueEnum && assertion.value == true {
+		assertion.value = IDUniqueIdentity
+	}
+
+	// Resolve value based on attribute type.
+	switch valueTypeID {
+	case IDTypeRef:
+		if asStr, ok := assertion.value.(string); ok {
+			assertion.value = Ident{Name: asStr}
+		}
+		if asIdent, ok := assertion.value.(Ident); ok && asIdent.ID == 0 {
+			if staged, ok := tx.stagedIdents[asIdent.Name]; ok {
+				assertion.value = staged.ID
+			}
+		}
+
+		switch v := assertion.value.(type) {
+		case ID:
+			// Nothing to do - value is already an ID.
+		case tempID:
+			tx.recordTempID(v)
+		default:
+			// Resolve lookups and idents in the Value position.
+			asResolver, ok := assertion.value.(Resolver)
+			if !ok {
+				return NullIdent, fmt.Errorf("value for ref attribute %q must resolve to an ID", attribute.Name)
+			}
+			// New idents asserted via db/ident were allocated before the
+			// first pass, so they resolve here like any other ident. The
+			// subsequent EntityID resolution pass will resolve the tempID
+			// for all attributes in this entity to the ident's ID.
+			var resolvedID ID
+			if l, ok := asResolver.(Lookup); ok {
+				resolvedID, err = tx.resolveLookup(l)
+			} else {
+				resolvedID, err = asResolver.Resolve(conn)
+			}
+			if err != nil {
+				return NullIdent, fmt.Errorf("resolving value of ref attribute %q: %w", attribute.Name, err)
+			}
+			assertion.value = resolvedID
+		}
+
+	case IDTypeString, IDTypeInt64, IDTypeInt32, IDTypeInt16, IDTypeInt8,
+		IDTypeBoolean, IDTypeFloat64, IDTypeFloat32, IDTypeTimestamp, IDTypeDate,
+		IDTypeBinary, IDTypeUUID, IDTypeULID:
+		if assertion.value, err = convertValue(valueTypeID, attribute.Name, assertion.value); err != nil {
+			return NullIdent, err
+		}
+
+	case IDTypeDecimal:
+		panic("TODO: decimal type not implemented")
+
+	case IDTypeComposite:
+		return NullIdent, fmt.Errorf("composite attribute %q cannot be asserted directly; its value is derived from its components", attribute.Name)
+
+	case IDTypeTuple:
+		tuple, ok := assertion.value.(Tuple)
+		if !ok {
+			return NullIdent, fmt.Errorf("value for tuple attribute %q must be a store.Tuple", attribute.Name)
+		}
+		resolved := make(Tuple, len(tuple))
+		for i, elem := range tuple {
+			if resolved[i], err = tx.resolveTupleElement(elem); err != nil {
+				return NullIdent, fmt.Errorf("resolving element %d of value for tuple attribute %q: %w", i, attribute.Name, err)
+			}
+		}
+		assertion.value = resolved
+
+	case IDTypeBlob:
+		digest, ok := assertion.value.(BlobDigest)
+		if !ok {
+			return NullIdent, fmt.Errorf("value for blob attribute %q is not a BlobDigest", attribute.Name)
+		}
+		// Blobs must be stored before facts may refer to them.
+		if _, err := conn.BlobSize(digest); err != nil {
+			return NullIdent, fmt.Errorf("value for blob attribute %q: %w", attribute.Name, err)
+		}
+
+	default:
+		panic(fmt.Sprintf("unhandled attribute type: %s", valueTypeID))
+	}
+
+	if isUniqueEnum && assertion.value != IDUniqueIdentity && assertion.value != IDUniqueValue {
+		return NullIdent, errors.New("value of db/unique must be db.unique/identity or db.unique/value")
+	}
+
+	return attribute, nil
+}
+
+// convertValue converts a value to the type of an attribute that holds scalar
+// values, such as converting an int to an int64 for an int64 attribute. Values
+// of other types, such as refs and tuples, are returned as they are.
+func convertValue(valueType ID, attrName string, val Value) (Value, error) {
+	switch valueType {
+	case IDTypeString:
+		switch v := val.(type) {
+		case string:
+			// Nothing to do - value is already a string.
+		case []byte:
+			val = string(v)
+		default:
+			return nil, fmt.Errorf("value for string attribute %q is not assignable to a string", attrName)
+		}
+
+	case IDTypeInt64:
+		switch v := val.(type) {
+		case int64:
+			// Nothing to do - value is already an int64.
+		case uint64:
+			val = int64(v)
+		case int:
+			val = int64(v)
+		case uint:
+			val = int64(v)
+		case int32:
+			val = int64(v)
+		case uint32:
+			val = int64(v)
+		case int16:
+			val = int64(v)
+		case uint16:
+			val = int64(v)
+		case int8:
+			val = int64(v)
+		case uint8:
+			val = int64(v)
+		default:
+			return nil, fmt.Errorf("value for int64 attribute %q is not assignable to an int64", attrName)
+		}
+
+	case IDTypeInt32:
+		switch v := val.(type) {
+		case int64:
+			if v > math.MaxInt32 || v < math.MinInt32 {
+				return nil, fmt.Errorf("value for int32 attribute %q is out of range", attrName)
+			}
+			val = int32(v)
+		case uint64:
+			if v > math.MaxInt32 {
+				return nil, fmt.Errorf("value for int32 attribute %q is out of range", attrName)
+			}
+			val = int32(v)
+		case int:
+			if v > math.MaxInt32 || v < math.MinInt32 {
+				return nil, fmt.Errorf("value for int32 attribute %q is out of range", attrName)
+			}
+			val = int32(v)
+		case uint:
+			if v > math.MaxInt32 {
+				return nil, fmt.Errorf("value for int32 attribute %q is out of range", attrName)
+			}
+			val = int32(v)
+		case int32:
+			// Nothing to do - value is already an int32.
+		case uint32:
+			if v > math.MaxInt32 {
+				return nil, fmt.Errorf("value for int32 attribute %q is out of range", attrName)
+			}
+			val = int32(v)
+		case int16:
+			val = int32(v)
+		case uint16:
+			val = int32(v)
+		case int8:
+			val = int32(v)
+		case uint8:
+			val = int32(v)
+		default:
+			return nil, fmt.Errorf("value for int32 attribute %q is not assignable to an int32", attrName)
+		}
+
+	case IDTypeInt16:
+		switch v := val.(type) {
+		case int64:
+			if v > math.MaxInt16 || v < math.MinInt16 {
+				return nil, fmt.Errorf("value for int16 attribute %q is out of range", attrName)
+			}
+			val = int16(v)
+		case uint64:
+			if v > math.MaxInt16 {
+				return nil, fmt.Errorf("value for int16 attribute %q is out of range", attrName)
+			}
+			val = int16(v)
+		case int:
+			if v > math.MaxInt16 || v < math.MinInt16 {
+				return nil, fmt.Errorf("value for int16 attribute %q is out of range", attrName)
+			}
+			val = int16(v)
+		case uint:
+			if v > math.MaxInt16 {
+				return nil, fmt.Errorf("value for int16 attribute %q is out of range", attrName)
+			}
+			val = int16(v)
+		case int32:
+			if v > math.MaxInt16 || v < math.MinInt16 {
+				return nil, fmt.Errorf("value for int16 attribute %q is out of range", attrName)
+			}
+			val = int16(v)
+		case uint32:
+			if v > math.MaxInt16 {
+				return nil, fmt.Errorf("value for int16 attribute %q is out of range", attrName)
+			}
+			val = int16(v)
+		case int16:
+			// Nothing to do - value is already an int16.
+		case uint16:
+			if v > math.MaxInt16 {
+				return nil, fmt.Errorf("value for int16 attribute %q is out of range", attrName)
+			}
+			val = int16(v)
+		case int8:
+			val = int16(v)
+		case uint8:
+			val = int16(v)
+		default:
+			return nil, fmt.Errorf("value for int16 attribute %q is not assignable to an int16", attrName)
+		}
+
+	case IDTypeInt8:
+		switch v := val.(type) {
+		case int64:
+			if v > math.MaxInt8 || v < math.MinInt8 {
+				return nil, fmt.Errorf("value for int8 attribute %q is out of range", attrName)
+			}
+			val = int8(v)
+		case uint64:
+			if v > math.MaxInt8 {
+				return nil, fmt.Errorf("value for int8 attribute %q is out of range", attrName)
+			}
+			val = int8(v)
+		case int:
+			if v > math.MaxInt8 || v < math.MinInt8 {
+				return nil, fmt.Errorf("value for int8 attribute %q is out of range", attrName)
+			}
+			val = int8(v)
+		case uint:
+			if v > math.MaxInt8 {
+				return nil, fmt.Errorf("value for int8 attribute %q is out of range", attrName)
+			}
+			val = int8(v)
+		case int32:
+			if v > math.MaxInt8 || v < math.MinInt8 {
+				return nil, fmt.Errorf("value for int8 attribute %q is out of range", attrName)
+			}
+			val = int8(v)
+		case uint32:
+			if v > math.MaxInt8 {
+				return nil, fmt.Errorf("value for int8 attribute %q is out of range", attrName)
+			}
+			val = int8(v)
+		case int16:
+			if v > math.MaxInt8 || v < math.MinInt8 {
+				return nil, fmt.Errorf("value for int8 attribute %q is out of range", attrName)
+			}
+			val = int8(v)
+		case uint16:
+			if v > math.MaxInt8 {
+				return nil, fmt.Errorf("value for int8 attribute %q is out of range", attrName)
+			}
+			val = int8(v)
+		case int8:
+			// Nothing to do - value is already an int8.
+		case uint8:
+			if v > math.MaxInt8 {
+				return nil, fmt.Errorf("value for int8 attribute %q is out of range", attrName)
+			}
+			val = int8(v)
+
+		default:
+			return nil, fmt.Errorf("value for int8 attribute %q is not assignable to an int8", attrName)
+		}
+
+	case IDTypeBoolean:
+		switch val.(type) {
+		case bool:
+			// Nothing to do - value is already a bool.
+		default:
+			return nil, fmt.Errorf("value for boolean attribute %q is not assignable to a bool", attrName)
+		}
+
+	case IDTypeFloat64:
+		switch v := val.(type) {
+		case float64:
+			// Nothing to do - value is already a float64.
+		case float32:
+			val = float64(v)
+		case int64:
+			val = float64(v)
+		case uint64:
+			val = float64(v)
+		case int:
+			val = float64(v)
+		case uint:
+			val = float64(v)
+		case int32:
+			val = float64(v)
+		case uint32:
+			val = float64(v)
+		case int16:
+			val = float64(v)
+		case uint16:
+			val = float64(v)
+		case int8:
+			val = float64(v)
+		case uint8:
+			val = float64(v)
+		default:
+			return nil, fmt.Errorf("value for float64 attribute %q is not assignable to a float64", attrName)
+		}
+
+	case IDTypeFloat32:
+		switch v := val.(type) {
+		case float64:
+			if v > math.MaxFloat32 || v < -math.MaxFloat32 {
+				return nil, fmt.Errorf("value for float32 attribute %q is out of range", attrName)
+			}
+			val = float32(v)
+		case float32:
+			// Nothing to do - value is already a float32.
+		case int64:
+			val = float32(v)
+		case uint64:
+			val = float32(v)
+		case int:
+			val = float32(v)
+		case uint:
+			val = float32(v)
+		case int32:
+			val = float32(v)
+		case uint32:
+			val = float32(v)
+		case int16:
+			val = float32(v)
+		case uint16:
+			val = float32(v)
+		case int8:
+			val = float32(v)
+		case uint8:
+			val = float32(v)
+		default:
+			return nil, fmt.Errorf("value for float32 attribute %q is not assignable to a float32", attrName)
+		}
+
+	case IDTypeTimestamp:
+		switch v := val.(type) {
+		case time.Time:
+			// Nothing to do - value is already a time.Time.
+		case int64:
+			val = time.Unix(v, 0)
+		case uint64:
+			val = time.Unix(int64(v), 0)
+		case int:
+			val = time.Unix(int64(v), 0)
+		case uint:
+			val = time.Unix(int64(v), 0)
+		case int32:
+			val = time.Unix(int64(v), 0)
+		case uint32:
+			val = time.Unix(int64(v), 0)
+		case int16:
+			val = time.Unix(int64(v), 0)
+		case uint16:
+			val = time.Unix(int64(v), 0)
+		case int8:
+			val = time.Unix(int64(v), 0)
+		case uint8:
+			val = time.Unix(int64(v), 0)
+		case string:
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				return nil, fmt.Errorf("value for timestamp attribute %q is not a valid RFC3339 string", attrName)
+			}
+			val = t
+		default:
+			return nil, fmt.Errorf("value for timestamp attribute %q is not assignable to a time.Time", attrName)
+		}
+
+	case IDTypeDate:
+		var t time.Time
+		switch v := val.(type) {
+		case time.Time:
+			// Nothing to do - value is already a time.Time.
+		case int64:
+			t = time.Unix(v, 0)
+		case uint64:
+			t = time.Unix(int64(v), 0)
+		case int:
+			t = time.Unix(int64(v), 0)
+		case uint:
+			t = time.Unix(int64(v), 0)
+		case int32:
+			t = time.Unix(int64(v), 0)
+		case uint32:
+			t = time.Unix(int64(v), 0)
+		case int16:
+			t = time.Unix(int64(v), 0)
+		case uint16:
+			t = time.Unix(int64(v), 0)
+		case int8:
+			t = time.Unix(int64(v), 0)
+		case uint8:
+			t = time.Unix(int64(v), 0)
+		case string:
+			parsedTime, err := time.Parse("2006-01-02", v)
+			if err != nil {
+				return nil, fmt.Errorf("value for date attribute %q is not a valid date string (YYYY-MM-DD)", attrName)
+			}
+			t = parsedTime
+		default:
+			return nil, fmt.Errorf("value for date attribute %q is not assignable to a time.Time", attrName)
+		}
+		val = t.UTC().Truncate(24 * time.Hour)
+
+	case IDTypeBinary:
+		switch v := val.(type) {
+		case []byte:
+			// Nothing to do - value is already a []byte.
+		case string:
+			val = []byte(v)
+		default:
+			return nil, fmt.Errorf("value for binary attribute %q is not assignable to a []byte", attrName)
+		}
+
+	case IDTypeUUID:
+		switch v := val.(type) {
+		case uuid.UUID:
+			// Nothing to do - value is already a uuid.UUID.
+		case string:
+			parsedUUID, err := uuid.FromString(v)
+			if err != nil {
+				return nil, fmt.Errorf("value for uuid attribute %q is not a valid uuid string", attrName)
+			}
+			val = parsedUUID
+		case []byte:
+			parsedUUID, err := uuid.FromBytes(v)
+			if err != nil {
+				return nil, fmt.Errorf("value for uuid attribute %q is not a valid uuid byte slice", attrName)
+			}
+			val = parsedUUID
+		default:
+			return nil, fmt.Errorf("value for uuid attribute %q is not assignable to a uuid.UUID", attrName)
+		}
+
+	case IDTypeULID:
+		switch v := val.(type) {
+		case ulid.ULID:
+			// Nothing to do - value is already a ulid.ULID.
+		case string:
+			parsedULID, err := ulid.Parse(v)
+			if err != nil {
+				return nil, fmt.Errorf("value for ulid attribute %q is not a valid ulid string", attrName)
+			}
+			val = parsedULID
+		default:
+			return nil, fmt.Errorf("value for ulid attribute %q is not assignable to a ulid.ULID", attrName)
+		}
+
+	}
+	return val, nil
+}
+
+// resolveEntity resolves the entity of an assertion whose attribute and value
+// have already been resolved, recording any tempIDs that it uses.
+func (tx *TxBuilder) resolveEntity(assertion *Assertion, attribute Ident) error {
+	conn := tx.conn
+
+	/////////////////
+	// ID Resolution
+
+	// Mark tx.tempIDs for resolution, and resolve idents and lookups.
+	switch v := assertion.entityID.(type) {
+	case ID:
+		// Already resolved.
+
+	case tempID:
+		tx.recordTempID(v)
+
+		// Special cases for ID resolution of tx.tempIDs.
+		switch assertion.attribute {
+		case IDID:
+			// ID was specified as db/id.
+			id, ok := assertion.value.(ID)
+			if !ok {
+				return fmt.Errorf("value for db/id must resolve to an ID")
+			}
+			scan, err := conn.indexer.ScanEAVT(attribute.ID, &id)
+			if err != nil {
+				return fmt.Errorf("scanning for existing entity with db/id %d: %w", id, err)
+			}
+			facts, err := dataflow.CollectIntoSlice(dataflow.NewContext(context.Background()), scan)
+			if err != nil {
+				return fmt.Errorf("scanning for existing entity with db/id %d: %w", id, err)
+			}
+			if len(facts) == 0 {
+				return fmt.Errorf("no entity found with db/id %d", id)
+			}
+			if tx.isIDConflict(v.symbol, id) {
+				return errors.Join(
+					fmt.Errorf("db/id %d conflicts with an already-resolved ID for tempid %q", id, v.symbol),
+					ErrConflict,
+				)
+			}
+			tx.tempIDs[v.symbol] = id
+
+		case IDIdent:
+			// ID was allocated on the first pass through the assertions.
+			id := assertion.value.(ID)
+			if tx.isIDConflict(v.symbol, id) {
+				return errors.Join(
+					fmt.Errorf("db/ident %q conflicts with an already-resolved ID for tempid %s", assertion.value, v.symbol),
+					ErrConflict,
+				)
+			}
+			tx.tempIDs[v.symbol] = id
+
+		default:
+			// If identity attribute, resolve to an ID.
+			if tx.noResolveUnique {
+				break
+			}
+			schema, err := tx.schemaFor(attribute.ID)
+			if err != nil {
+				return err
+			}
+			if schema.Unique == IDUniqueIdentity {
+				id, err := tx.resolveLookup(NewLookup(attribute.Name, assertion.value))
+				switch err {
+				case nil:
+					if tx.isIDConflict(v.symbol, id) {
+						return errors.Join(
+							fmt.Errorf("unique attribute %q conflicts with an already-resolved ID for tempid %q", attribute.Name, v.symbol),
+							ErrConflict,
+						)
+					}
+					tx.tempIDs[v.symbol] = id
+				case ErrNoSuchEntity:
+					// This is fine - we will create a new entity.
+				default:
+					return fmt.Errorf("resolving lookup: %w", err)
+				}
+			}
+		}
+
+	case string:
+		// Assume the string is an ident name, and resolve it.
+		ident, err := tx.resolveIdent(v)
+		if err != nil {
+			return err
+		}
+		assertion.entityID = ident.ID
+	}
+
+	return nil
+}
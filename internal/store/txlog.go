@@ -0,0 +1,133 @@
+/*
+Copyright 2024 Andrew Meredith
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/kendru/canter/pkg/dataflow"
+)
+
+// TxLogEntry is a committed transaction along with every assertion that it
+// made, including retractions.
+type TxLogEntry struct {
+	Tx         ID
+	CommitTime time.Time
+	Data       []ResolvedAssertion
+	// Idents are the names and aliases that the transaction gave to
+	// entities, which are stored apart from its assertions. Names are as of
+	// the latest transaction.
+	Idents []Ident
+}
+
+// TxLog returns up to limit transactions, starting with the earliest one whose
+// ID is at least from, in commit order. A limit of zero or less returns every
+// such transaction. For a view as of an earlier transaction, later
+// transactions are not included.
+//
+// The indexes are not ordered by transaction, so TxLog replays the history of
+// every attribute to find the assertions of the transactions. It is intended
+// for inspecting a store rather than for use on hot paths.
+func (db Database) TxLog(from ID, limit int) ([]TxLogEntry, error) {
+	var entries []TxLogEntry
+	byTx := make(map[ID]int)
+	err := db.conn.scanCommitTimes(nil, func(tx ID, committed time.Time) bool {
+		if (db.asOf != nil && tx > *db.asOf) || (limit > 0 && len(entries) == limit) {
+			return false
+		}
+		if tx >= from {
+			byTx[tx] = len(entries)
+			entries = append(entries, TxLogEntry{Tx: tx, CommitTime: committed})
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 {
+		return nil, nil
+	}
+
+	typeAttr := IDType
+	attrs, err := db.scanCurrent(nil, &typeAttr, nil)
+	if err != nil {
+		return nil, fmt.Errorf("scanning attributes: %w", err)
+	}
+	for _, attr := range attrs {
+		scan, err := db.reader().ScanHistoryAEVT(attr.EntityID, nil)
+		if err != nil {
+			return nil, fmt.Errorf("scanning AEVT history: %w", err)
+		}
+		assertions, err := dataflow.CollectIntoSlice(dataflow.NewContext(context.Background()), scan)
+		if err != nil {
+			return nil, fmt.Errorf("scanning AEVT history: %w", err)
+		}
+		for _, ra := range assertions {
+			if i, ok := byTx[ra.Tx]; ok {
+				entries[i].Data = append(entries[i].Data, *ra)
+			}
+		}
+	}
+
+	for i, entry := range entries {
+		if entries[i].Idents, err = db.txIdents(entry.Data); err != nil {
+			return nil, fmt.Errorf("reading idents of transaction %d: %w", entry.Tx, err)
+		}
+		sort.SliceStable(entry.Data, func(i, j int) bool {
+			if entry.Data[i].EntityID != entry.Data[j].EntityID {
+				return entry.Data[i].EntityID < entry.Data[j].EntityID
+			}
+			return entry.Data[i].Attribute < entry.Data[j].Attribute
+		})
+	}
+	return entries, nil
+}
+
+// txIdents returns the idents that were named or aliased by the assertions of
+// a transaction. System idents are not stored, so they are not included.
+func (db Database) txIdents(assertions []ResolvedAssertion) ([]Ident, error) {
+	var ids []ID
+	var aliases []Ident
+	for _, ra := range assertions {
+		if ra.mode != AssertModeAddition || ra.EntityID < 0 {
+			continue
+		}
+		switch ra.Attribute {
+		case IDIdent:
+			ids = append(ids, ra.EntityID)
+		case IDAlias:
+			if name, ok := ra.Value.(string); ok {
+				aliases = append(aliases, Ident{ID: ra.EntityID, Name: name, Alias: true})
+			}
+		}
+	}
+	if len(ids) == 0 {
+		return aliases, nil
+	}
+	names, err := db.conn.identManager.LookupIdentNames(ids)
+	if err != nil {
+		return nil, err
+	}
+	idents := make([]Ident, len(ids), len(ids)+len(aliases))
+	for i, id := range ids {
+		idents[i] = Ident{ID: id, Name: names[i]}
+	}
+	return append(idents, aliases...), nil
+}
@@ -0,0 +1,123 @@
+/*
+Copyright 2024 Andrew Meredith
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import "context"
+
+// A TxOption configures how a transaction resolves its assertions. Options
+// may be passed to NewTx, or, since a TxOption is also an Assertable that
+// contributes no assertions, to Assert and TxBuilder.Add ahead of the
+// assertables that they apply to:
+//
+//	conn.Assert(store.WithNoResolveUnique(), records...)
+//
+// Options apply to the whole transaction, so they must be added before any
+// assertions.
+type TxOption struct {
+	apply func(tx *TxBuilder)
+}
+
+// Assertions implements Assertable.
+func (TxOption) Assertions(*Connection) ([]Assertion, error) {
+	return nil, nil
+}
+
+// WithNoResolveUnique prevents tempIDs from resolving to existing entities
+// through db.unique/identity attributes. Every tempID that is not resolved
+// by db/id or db/ident becomes a new entity, and asserting a value of an
+// identity attribute that another entity already holds fails with
+// ErrConflict, as it does for db.unique/value attributes.
+func WithNoResolveUnique() TxOption {
+	return TxOption{apply: func(tx *TxBuilder) {
+		tx.noResolveUnique = true
+	}}
+}
+
+// WithIsolatedTempIDs scopes the names of NamedTempIDs to the Assertable
+// that uses them, so that the same name in two Assertables refers to two
+// different entities rather than one. This suits transactions that batch
+// independent records which reuse the same names. The entities of isolated
+// names are not reported in AssertResult.Names.
+func WithIsolatedTempIDs() TxOption {
+	return TxOption{apply: func(tx *TxBuilder) {
+		tx.isolateTempIDs = true
+	}}
+}
+
+// WithAdmissionKey admits the transaction under key rather than under the
+// AdmissionKey of its connection. Bulk loaders may use their own key so that
+// the rate limit of the connection's key is left to interactive
+// transactions. It has no effect on a connection without an
+// AdmissionController.
+func WithAdmissionKey(key string) TxOption {
+	return TxOption{apply: func(tx *TxBuilder) {
+		tx.admissionKey = key
+	}}
+}
+
+// WithContext sets the context that is passed to the connection's BeforeCommit
+// hook, e.g. to carry the identity of the user on whose behalf the
+// transaction is committed. Without it, the hook is passed
+// context.Background().
+func WithContext(ctx context.Context) TxOption {
+	return TxOption{apply: func(tx *TxBuilder) {
+		tx.ctx = ctx
+	}}
+}
+
+// WithPartition allocates the new entities of the transaction in partition p
+// rather than in partition 0. The connection's IDManager must be a
+// PartitionedIDManager unless p is 0. See NOTE [ENTITY-PARTITIONS].
+func WithPartition(p Partition) TxOption {
+	return TxOption{apply: func(tx *TxBuilder) {
+		tx.partition = p
+	}}
+}
+
+// isolate replaces the named tempIDs of the assertions of one Assertable with
+// tempIDs that are not shared with any other Assertable. The symbols of the
+// new tempIDs are generated by ids.
+func isolate(assertions []Assertion, ids IDSource) {
+	scope := make(map[string]tempID)
+	rename := func(v any) any {
+		tid, ok := v.(tempID)
+		// Invalid names are left in place to be rejected when the tempID is
+		// recorded.
+		if !ok || !tid.named || tid.validate() != nil {
+			return v
+		}
+		isolated, ok := scope[tid.symbol]
+		if !ok {
+			isolated = tempID{symbol: ids.NewULID().String()}
+			scope[tid.symbol] = isolated
+		}
+		return isolated
+	}
+	for i := range assertions {
+		assertions[i].entityID = rename(assertions[i].entityID)
+		switch v := assertions[i].value.(type) {
+		case tempID:
+			assertions[i].value = rename(v)
+		case Tuple:
+			tuple := make(Tuple, len(v))
+			for j, elem := range v {
+				tuple[j] = rename(elem)
+			}
+			assertions[i].value = tuple
+		}
+	}
+}
@@ -0,0 +1,219 @@
+/*
+Copyright 2024 Andrew Meredith
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// TxReport describes a transaction that was committed through a connection.
+type TxReport struct {
+	// Tx is the ID of the transaction entity.
+	Tx ID
+	// DBAfter is a view of the database as of the transaction. Transaction
+	// IDs follow the order in which transactions are written, so it includes
+	// exactly the transactions committed up to and including this one, no
+	// matter when it is read.
+	DBAfter Database
+	// TxData contains every assertion made by the transaction.
+	TxData []ResolvedAssertion
+	// TempIDs maps the tempIDs used in the transaction to their resolved IDs.
+	TempIDs TempIDs
+}
+
+// reportTx delivers the report of a committed transaction to the tx report
+// queues and to the AfterCommit hook. It must be called with reportMu held,
+// which it releases once the report is queued.
+func (conn *Connection) reportTx(report TxReport) {
+	conn.txReports.publish(report)
+	conn.reportMu.Unlock()
+	if conn.afterCommit != nil {
+		conn.afterCommit(report)
+	}
+}
+
+// TxReportQueue returns a channel that receives a report for every transaction
+// committed through this connection after the queue is created, along with a
+// function that removes the queue. Reports are delivered in the order that
+// transactions were written, which is also the order of their IDs. A full
+// queue applies backpressure to writers, so callers must either keep up with
+// the queue or remove it. The channel is closed when the queue is removed or
+// the connection is closed.
+func (conn *Connection) TxReportQueue(size int) (<-chan TxReport, func()) {
+	q := conn.txReports.add(size, false)
+	return q.ch, q.remove
+}
+
+type txReportQueue struct {
+	ch     chan TxReport
+	done   chan struct{}
+	remove func()
+	// A queue that drops when full is removed rather than applying
+	// backpressure to writers once it is full, and dropped is set.
+	dropWhenFull bool
+	dropped      atomic.Bool
+	// feed, if set, receives the reports instead of ch.
+	feed *txReportFeed
+}
+
+// txReportFeed collects the reports of committed transactions for a
+// background runner without ever blocking writers. Reports accumulate until
+// the runner takes them, and wake is signaled whenever there are reports to
+// take. If more than limit reports accumulate, they are discarded and the
+// feed records that it is incomplete, so that the runner can catch up from
+// storage instead.
+type txReportFeed struct {
+	wake  chan struct{}
+	limit int
+
+	mu         sync.Mutex
+	reports    []TxReport
+	incomplete bool
+}
+
+func (f *txReportFeed) add(report TxReport) {
+	f.mu.Lock()
+	if len(f.reports) < f.limit {
+		f.reports = append(f.reports, report)
+	} else {
+		f.reports = nil
+		f.incomplete = true
+	}
+	f.mu.Unlock()
+	select {
+	case f.wake <- struct{}{}:
+	default:
+	}
+}
+
+// take returns the reports collected since the last call, and whether they
+// are every report published since then.
+func (f *txReportFeed) take() ([]TxReport, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	reports, complete := f.reports, !f.incomplete
+	f.reports, f.incomplete = nil, false
+	return reports, complete
+}
+
+type txReportQueues struct {
+	mu     sync.RWMutex
+	nextID int
+	queues map[int]*txReportQueue
+	closed bool
+}
+
+// add adds a queue of the given size. If dropWhenFull is set, a report that
+// does not fit in the queue removes the queue instead of waiting for room.
+func (qs *txReportQueues) add(size int, dropWhenFull bool) *txReportQueue {
+	return qs.register(&txReportQueue{
+		ch:           make(chan TxReport, size),
+		dropWhenFull: dropWhenFull,
+	})
+}
+
+// addFeed adds a queue whose reports are collected by a feed of the given
+// limit rather than sent on its channel.
+func (qs *txReportQueues) addFeed(limit int) *txReportQueue {
+	return qs.register(&txReportQueue{
+		ch:   make(chan TxReport),
+		feed: &txReportFeed{wake: make(chan struct{}, 1), limit: limit},
+	})
+}
+
+func (qs *txReportQueues) register(q *txReportQueue) *txReportQueue {
+	qs.mu.Lock()
+	defer qs.mu.Unlock()
+	q.done = make(chan struct{})
+	if qs.closed {
+		close(q.done)
+		close(q.ch)
+		q.remove = func() {}
+		return q
+	}
+	if qs.queues == nil {
+		qs.queues = make(map[int]*txReportQueue)
+	}
+	id := qs.nextID
+	qs.nextID++
+	qs.queues[id] = q
+
+	var once sync.Once
+	remove := func() {
+		once.Do(func() {
+			// Closing done first unblocks any publisher waiting on this queue
+			// so that it releases its read lock.
+			close(q.done)
+			qs.mu.Lock()
+			delete(qs.queues, id)
+			close(q.ch)
+			qs.mu.Unlock()
+		})
+	}
+	q.remove = remove
+	return q
+}
+
+// close removes every queue and closes the queues that are added later.
+func (qs *txReportQueues) close() {
+	qs.mu.Lock()
+	qs.closed = true
+	queues := make([]*txReportQueue, 0, len(qs.queues))
+	for _, q := range qs.queues {
+		queues = append(queues, q)
+	}
+	qs.mu.Unlock()
+	for _, q := range queues {
+		q.remove()
+	}
+}
+
+func (qs *txReportQueues) publish(report TxReport) {
+	// Hold the read lock while sending so that a queue cannot be closed out
+	// from under the publisher.
+	qs.mu.RLock()
+	defer qs.mu.RUnlock()
+
+	for _, q := range qs.queues {
+		if q.feed != nil {
+			q.feed.add(report)
+			continue
+		}
+		if !q.dropWhenFull {
+			select {
+			case q.ch <- report:
+			case <-q.done:
+			}
+			continue
+		}
+		// Once a report has been dropped, no later report may be delivered
+		// in its place.
+		if q.dropped.Load() {
+			continue
+		}
+		select {
+		case q.ch <- report:
+		case <-q.done:
+		default:
+			q.dropped.Store(true)
+			// Removing the queue takes the write lock, so it must wait
+			// until the publisher releases its read lock.
+			go q.remove()
+		}
+	}
+}
@@ -0,0 +1,134 @@
+/*
+Copyright 2024 Andrew Meredith
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/kendru/canter/pkg/dataflow"
+)
+
+// errStopScan is returned by a scan consumer to end the scan early.
+var errStopScan = errors.New("stop scan")
+
+// TxAt returns the ID of the latest transaction committed at or before t. If no
+// transaction was committed by t, ErrNoSuchEntity is returned.
+func (conn *Connection) TxAt(t time.Time) (ID, error) {
+	var txID ID
+	var latest time.Time
+	err := conn.scanCommitTimes(ValueRange{Max: t}, func(tx ID, committed time.Time) bool {
+		if txID == 0 || committed.After(latest) || (committed.Equal(latest) && tx > txID) {
+			txID, latest = tx, committed
+		}
+		return true
+	})
+	if err != nil {
+		return 0, err
+	}
+	if txID == 0 {
+		return 0, ErrNoSuchEntity
+	}
+	return txID, nil
+}
+
+// TxRange returns the IDs of the transactions committed at or after from and
+// before to, in commit order.
+func (conn *Connection) TxRange(from, to time.Time) ([]ID, error) {
+	type txTime struct {
+		tx        ID
+		committed time.Time
+	}
+	var txs []txTime
+	err := conn.scanCommitTimes(ValueRange{Min: from, Max: to, MaxExclusive: true}, func(tx ID, committed time.Time) bool {
+		txs = append(txs, txTime{tx, committed})
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(txs, func(i, j int) bool {
+		if !txs[i].committed.Equal(txs[j].committed) {
+			return txs[i].committed.Before(txs[j].committed)
+		}
+		return txs[i].tx < txs[j].tx
+	})
+	var txIDs []ID
+	for _, tx := range txs {
+		txIDs = append(txIDs, tx.tx)
+	}
+	return txIDs, nil
+}
+
+// scanCommitTimes calls fn with the commit time of each transaction whose
+// commit time matches pred, in order of transaction ID, until fn returns
+// false. A nil pred matches every transaction.
+//
+// The AEVT index orders commit times by transaction ID rather than by time,
+// and transactions written by different transactors of a store need not have
+// been committed in the order of their IDs, so callers that select
+// transactions by time consider every match rather than stopping at the first
+// one that is out of range. The predicate is evaluated as the index is
+// scanned, so transactions that do not match are not produced.
+func (conn *Connection) scanCommitTimes(pred ValuePredicate, fn func(tx ID, committed time.Time) bool) error {
+	var scan dataflow.Producer[Fact]
+	var err error
+	if pred == nil {
+		scan, err = conn.indexer.ScanAEVT(IDTxCommitTime, nil)
+	} else {
+		scan, err = conn.indexer.ScanAEVTWhere(IDTxCommitTime, pred)
+	}
+	if err != nil {
+		return fmt.Errorf("scanning AEVT index: %w", err)
+	}
+	err = scan.Produce(dataflow.NewContext(context.Background()), func(_ dataflow.DataflowCtx, fct *Fact) error {
+		if fct == nil {
+			return nil
+		}
+		committed, ok := fct.Value.(time.Time)
+		if !ok {
+			return fmt.Errorf("commit time of transaction %d is a %T", fct.EntityID, fct.Value)
+		}
+		if !fn(fct.EntityID, committed) {
+			return errStopScan
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, errStopScan) {
+		return fmt.Errorf("scanning commit times: %w", err)
+	}
+	return nil
+}
+
+// loadBasis advances the basis to the latest transaction in storage.
+func (conn *Connection) loadBasis() error {
+	var latest ID
+	err := conn.scanCommitTimes(nil, func(tx ID, _ time.Time) bool {
+		if tx > latest {
+			latest = tx
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	conn.advanceBasis(latest)
+	return nil
+}
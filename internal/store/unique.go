@@ -0,0 +1,163 @@
+/*
+Copyright 2024 Andrew Meredith
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"errors"
+	"fmt"
+)
+
+// An attribute is unique if its schema has a db/unique value. There are two
+// kinds of uniqueness:
+//
+//   - db.unique/identity: the value identifies an entity. An entity that is
+//     asserted with a tempID and a value that another entity already holds
+//     resolves to that entity, so the assertion upserts it.
+//   - db.unique/value: the value may only be held by one entity. Asserting a
+//     value that another entity already holds fails with ErrConflict.
+//
+// Either kind of unique attribute may be used in a Lookup.
+
+// uniqueness returns the uniqueness of an attribute: IDUniqueIdentity,
+// IDUniqueValue, or 0 if the attribute is not unique.
+func (db Database) uniqueness(attrID ID) (ID, error) {
+	schema, err := db.schemaFor(attrID)
+	if err != nil {
+		return 0, err
+	}
+	return schema.Unique, nil
+}
+
+// isIdentity reports whether an attribute is a db.unique/identity attribute.
+func (db Database) isIdentity(attrID ID) (bool, error) {
+	uniqueness, err := db.uniqueness(attrID)
+	return uniqueness == IDUniqueIdentity, err
+}
+
+// migrateUniqueness returns the assertions that replace the boolean db/unique
+// values of user attributes with their enumerated equivalents. The values of
+// system entities are replaced along with the rest of the system schema.
+func (db Database) migrateUniqueness() ([]ResolvedAssertion, error) {
+	attr := IDUnique
+	facts, err := db.scan(nil, &attr)
+	if err != nil {
+		return nil, err
+	}
+	var assertions []ResolvedAssertion
+	for _, fct := range facts {
+		unique, ok := fct.Value.(bool)
+		if !ok || fct.EntityID.IsSystem() {
+			continue
+		}
+		ra := ResolvedAssertion{
+			Fact: Fact{EntityID: fct.EntityID, Attribute: IDUnique, Value: IDUniqueIdentity},
+			mode: AssertModeAddition,
+		}
+		if !unique {
+			ra.Value = false
+			ra.mode = AssertModeRetraction
+		}
+		assertions = append(assertions, ra)
+	}
+	return assertions, nil
+}
+
+// checkUniqueValues adds a precondition to the transaction that no value of a
+// db.unique/value attribute that it asserts is held by another entity. With
+// WithNoResolveUnique, the same holds for db.unique/identity attributes.
+func (tx *TxBuilder) checkUniqueValues(resolved []ResolvedAssertion) error {
+	type claim struct {
+		attr   ID
+		entity ID
+		value  Value
+	}
+	db := tx.conn.DB()
+	kinds := make(map[ID]ID)
+	var claims []claim
+	retracted := make(map[lookupKey]map[ID]struct{})
+	for _, ra := range resolved {
+		kind, ok := kinds[ra.Attribute]
+		if !ok {
+			var err error
+			if kind, err = db.uniqueness(ra.Attribute); err != nil {
+				return err
+			}
+			kinds[ra.Attribute] = kind
+		}
+		// Identity attributes that may not upsert must not be duplicated
+		// either.
+		if kind != IDUniqueValue && !(kind == IDUniqueIdentity && tx.noResolveUnique) {
+			continue
+		}
+		if ra.mode == AssertModeAddition {
+			claims = append(claims, claim{attr: ra.Attribute, entity: ra.EntityID, value: ra.Value})
+			continue
+		}
+		key := newLookupKey(ra.Attribute, ra.Value)
+		if retracted[key] == nil {
+			retracted[key] = make(map[ID]struct{})
+		}
+		retracted[key][ra.EntityID] = struct{}{}
+	}
+	if len(claims) == 0 {
+		return nil
+	}
+
+	// Uniqueness is checked when the transaction is written, so that no
+	// other transaction can claim the same values in between.
+	tx.preconditions = append(tx.preconditions, func(db Database) error {
+		holders := make(map[lookupKey]ID, len(claims))
+		for _, c := range claims {
+			key := newLookupKey(c.attr, c.value)
+			holder, ok := holders[key]
+			if !ok {
+				var err error
+				holder, err = db.lookupEntity(c.attr, c.value)
+				switch {
+				case errors.Is(err, ErrNoSuchEntity):
+					holder = c.entity
+				case err != nil:
+					return err
+				}
+				// A value that the transaction retracts from its holder may
+				// be claimed by another entity.
+				if _, ok := retracted[key][holder]; ok {
+					holder = c.entity
+				}
+				holders[key] = holder
+			}
+			if holder != c.entity {
+				return uniqueConflict(db, c.attr, c.value, holder)
+			}
+		}
+		return nil
+	})
+	return nil
+}
+
+// uniqueConflict returns an error reporting that a value of a unique
+// attribute is already held by another entity.
+func uniqueConflict(db Database, attr ID, value Value, holder ID) error {
+	name := attr.String()
+	if ident, err := ResolveIdent(db.conn, attr); err == nil {
+		name = ident.Name
+	}
+	return errors.Join(
+		fmt.Errorf("unique attribute %q value %v is already held by entity %d", name, value, holder),
+		ErrConflict,
+	)
+}
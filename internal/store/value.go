@@ -17,11 +17,17 @@ limitations under the License.
 package store
 
 import (
+	"bytes"
+	"cmp"
 	"encoding/binary"
 	"fmt"
 	"io"
+	"reflect"
+	"time"
 
+	"github.com/gofrs/uuid/v5"
 	"github.com/kendru/canter/pkg/rtype"
+	"github.com/oklog/ulid/v2"
 )
 
 type TypeTag uint8
@@ -41,6 +47,143 @@ const (
 // TupleHeader).
 type Value any
 
+// ValueEqual reports whether two values are equal. Values of different types
+// are never equal, even if they are numerically equal, whereas times are equal
+// if they denote the same instant in any location, and byte slices and tuples
+// are equal if their elements are. ValueEqual(a, b) holds exactly when
+// CompareValues(a, b) is 0 for values of the types that the store supports.
+func ValueEqual(a, b Value) bool {
+	if valueRank(a) == rankOther || valueRank(b) == rankOther {
+		return reflect.DeepEqual(a, b)
+	}
+	return CompareValues(a, b) == 0
+}
+
+// CompareValues returns -1, 0, or 1 as a is less than, equal to, or greater
+// than b. It orders every pair of values, so it may sort values of mixed
+// types: values of the same type are ordered naturally, with NaN before other
+// floats and false before true, and values of different types are ordered by
+// type, with nil first. Tuples are ordered element by element, and a tuple
+// that is a prefix of another is less than it. Values of types that the store
+// does not support are ordered after all others by their Go syntax.
+func CompareValues(a, b Value) int {
+	if ra, rb := valueRank(a), valueRank(b); ra != rb {
+		return cmp.Compare(ra, rb)
+	}
+	switch a := a.(type) {
+	case nil:
+		return 0
+	case bool:
+		b := b.(bool)
+		switch {
+		case a == b:
+			return 0
+		case b:
+			return -1
+		default:
+			return 1
+		}
+	case int8:
+		return cmp.Compare(a, b.(int8))
+	case int16:
+		return cmp.Compare(a, b.(int16))
+	case int32:
+		return cmp.Compare(a, b.(int32))
+	case int64:
+		return cmp.Compare(a, b.(int64))
+	case float32:
+		return cmp.Compare(a, b.(float32))
+	case float64:
+		return cmp.Compare(a, b.(float64))
+	case string:
+		return cmp.Compare(a, b.(string))
+	case []byte:
+		return bytes.Compare(a, b.([]byte))
+	case time.Time:
+		return a.Compare(b.(time.Time))
+	case ID:
+		return cmp.Compare(a, b.(ID))
+	case uuid.UUID:
+		b := b.(uuid.UUID)
+		return bytes.Compare(a[:], b[:])
+	case ulid.ULID:
+		return a.Compare(b.(ulid.ULID))
+	case BlobDigest:
+		b := b.(BlobDigest)
+		return bytes.Compare(a[:], b[:])
+	case Tuple:
+		b := b.(Tuple)
+		for i := 0; i < len(a) && i < len(b); i++ {
+			if c := CompareValues(a[i], b[i]); c != 0 {
+				return c
+			}
+		}
+		return cmp.Compare(len(a), len(b))
+	default:
+		return cmp.Compare(fmt.Sprintf("%T%#v", a, a), fmt.Sprintf("%T%#v", b, b))
+	}
+}
+
+// Ranks of the types of values, which order values of different types.
+const (
+	rankNil = iota
+	rankBool
+	rankInt8
+	rankInt16
+	rankInt32
+	rankInt64
+	rankFloat32
+	rankFloat64
+	rankString
+	rankBytes
+	rankTime
+	rankID
+	rankUUID
+	rankULID
+	rankBlob
+	rankTuple
+	rankOther
+)
+
+func valueRank(val Value) int {
+	switch val.(type) {
+	case nil:
+		return rankNil
+	case bool:
+		return rankBool
+	case int8:
+		return rankInt8
+	case int16:
+		return rankInt16
+	case int32:
+		return rankInt32
+	case int64:
+		return rankInt64
+	case float32:
+		return rankFloat32
+	case float64:
+		return rankFloat64
+	case string:
+		return rankString
+	case []byte:
+		return rankBytes
+	case time.Time:
+		return rankTime
+	case ID:
+		return rankID
+	case uuid.UUID:
+		return rankUUID
+	case ulid.ULID:
+		return rankULID
+	case BlobDigest:
+		return rankBlob
+	case Tuple:
+		return rankTuple
+	default:
+		return rankOther
+	}
+}
+
 // EncodedValue is a value that has been encoded into a byte slice.
 type EncodedValue []byte
 
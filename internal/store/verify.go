@@ -0,0 +1,215 @@
+/*
+Copyright 2024 Andrew Meredith
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/kendru/canter/pkg/dataflow"
+)
+
+// LogVerification is the result of verifying a store against a transaction
+// log that was exported from it or from the store that it replicates.
+type LogVerification struct {
+	// Verified is the number of transactions of the log that the store holds
+	// with the same facts, and Later the number of transactions of the store
+	// that were committed after the last one in the log.
+	Verified, Later int
+	// Failed holds an error for each transaction that the log and the store
+	// disagree about, and for each index whose state differs from the state
+	// that the log produces.
+	Failed []error
+	// Root chains the roots of the transactions of the log, as
+	// TxLogVerification.Root does for a store.
+	Root []byte
+	// StateRoot is the Merkle root of the facts that the current indexes
+	// hold after the last transaction of the log, computed from the log
+	// alone.
+	StateRoot []byte
+	// IndexesChecked reports whether the indexes were compared with
+	// StateRoot, which is only possible when the store has no later
+	// transactions.
+	IndexesChecked bool
+}
+
+// VerifyLog verifies the database against a transaction log written by a
+// TxLogWriter, which proves that the database holds exactly the history that
+// the log records. Every transaction of the log must match its own Merkle root
+// and the facts and root of the same transaction in the database, and every
+// transaction of the database up to the last one of the log must be in the log.
+// If the database has no later transactions, the facts of its EAVT and AEVT
+// indexes must also be the facts that the log leaves current.
+//
+// The log is trusted only as far as its roots are: it should come from a
+// backup that has not been writable since it was taken. The database should
+// be pinned by a ReadTxn if the store may be written during the verification.
+func (db Database) VerifyLog(r *TxLogReader) (LogVerification, error) {
+	var res LogVerification
+	stored, err := db.TxLog(0, 0)
+	if err != nil {
+		return res, err
+	}
+	byTx := make(map[ID]TxLogEntry, len(stored))
+	for _, entry := range stored {
+		byTx[entry.Tx] = entry
+	}
+	fail := func(format string, args ...any) {
+		res.Failed = append(res.Failed, fmt.Errorf(format+": %w", append(args, ErrIntegrity)...))
+	}
+
+	chain := sha256.New()
+	var last ID
+	var history []*ResolvedAssertion
+	for {
+		entry, err := r.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return res, fmt.Errorf("reading transaction log: %w", err)
+		}
+		last = entry.Tx
+		logRoot, err := TxRoot(entry.Data)
+		if err != nil {
+			return res, err
+		}
+		chainTxRoot(chain, entry.Tx, logRoot)
+		for i := range entry.Data {
+			history = append(history, &entry.Data[i])
+		}
+
+		if _, err := verifyTxLogEntry(entry); err != nil {
+			if !errors.Is(err, ErrIntegrity) {
+				return res, err
+			}
+			res.Failed = append(res.Failed, fmt.Errorf("log: %w", err))
+			continue
+		}
+		have, ok := byTx[entry.Tx]
+		if !ok {
+			fail("transaction %d of the log is not in the store", entry.Tx)
+			continue
+		}
+		delete(byTx, entry.Tx)
+		storeRoot, err := TxRoot(have.Data)
+		if err != nil {
+			return res, err
+		}
+		if !bytes.Equal(storeRoot, logRoot) {
+			fail("transaction %d has facts that hash to %x in the store but %x in the log", entry.Tx, storeRoot, logRoot)
+			continue
+		}
+		res.Verified++
+	}
+	res.Root = chain.Sum(nil)
+	for tx := range byTx {
+		if tx > last {
+			res.Later++
+		} else {
+			fail("transaction %d of the store is not in the log", tx)
+		}
+	}
+
+	// The current indexes hold the latest assertion of each (entity,
+	// attribute, valid from) triple, unless it is a retraction.
+	type indexKey struct {
+		eid       ID
+		attr      ID
+		validFrom int64
+	}
+	current := make(map[indexKey]*ResolvedAssertion)
+	for _, ra := range history {
+		current[indexKey{ra.EntityID, ra.Attribute, ra.ValidFrom.UnixNano()}] = ra
+	}
+	leaves := make([][]byte, 0, len(current))
+	for _, ra := range current {
+		if ra.mode != AssertModeAddition {
+			continue
+		}
+		leaf, err := HashFact(*ra)
+		if err != nil {
+			return res, err
+		}
+		leaves = append(leaves, leaf[:])
+	}
+	res.StateRoot = merkleRoot(leaves)
+	if res.Later > 0 {
+		return res, nil
+	}
+	res.IndexesChecked = true
+	eavt, aevt, err := db.indexRoots()
+	if err != nil {
+		return res, err
+	}
+	if !bytes.Equal(eavt, res.StateRoot) {
+		fail("EAVT index has state %x, but the log produces %x", eavt, res.StateRoot)
+	}
+	if !bytes.Equal(aevt, res.StateRoot) {
+		fail("AEVT index has state %x, but the log produces %x", aevt, res.StateRoot)
+	}
+	return res, nil
+}
+
+// indexRoots returns the Merkle roots of the current facts of the EAVT and
+// AEVT indexes, as VerifyLog computes them.
+func (db Database) indexRoots() (eavt, aevt []byte, err error) {
+	scans, err := db.reader().ScanEAVTPartitions(1)
+	if err != nil {
+		return nil, nil, fmt.Errorf("scanning EAVT index: %w", err)
+	}
+	var leaves [][]byte
+	attrs := make(map[ID]struct{})
+	for _, scan := range scans {
+		err := scan.Produce(dataflow.NewContext(context.Background()), func(_ dataflow.DataflowCtx, fct *Fact) error {
+			if fct == nil {
+				return nil
+			}
+			leaf, err := HashFact(ResolvedAssertion{Fact: *fct, mode: AssertModeAddition})
+			if err != nil {
+				return err
+			}
+			leaves = append(leaves, leaf[:])
+			attrs[fct.Attribute] = struct{}{}
+			return nil
+		})
+		if err != nil {
+			return nil, nil, fmt.Errorf("scanning EAVT index: %w", err)
+		}
+	}
+	eavt = merkleRoot(leaves)
+
+	leaves = leaves[:0:0]
+	for attr := range attrs {
+		err := db.reader().VisitAEVT(attr, nil, func(fct *Fact) error {
+			leaf, err := HashFact(ResolvedAssertion{Fact: *fct, mode: AssertModeAddition})
+			if err != nil {
+				return err
+			}
+			leaves = append(leaves, leaf[:])
+			return nil
+		})
+		if err != nil {
+			return nil, nil, fmt.Errorf("scanning AEVT index: %w", err)
+		}
+	}
+	return eavt, merkleRoot(leaves), nil
+}
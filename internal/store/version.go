@@ -0,0 +1,123 @@
+/*
+Copyright 2024 Andrew Meredith
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/kendru/canter/pkg/dataflow"
+)
+
+// precondition is checked against the latest database when a transaction is
+// written. If it returns an error, the transaction fails with that error.
+type precondition func(db Database) error
+
+// EntityVersion returns the ID of the last transaction, up to the database's
+// basis, that asserted or retracted a fact about the entity. A web app may
+// use the version of an entity, e.g. as an ETag, to update the entity only if
+// it is unchanged since it was read (see AssertIfUnchanged). If no fact about
+// the entity has ever been asserted, EntityVersion returns ErrNoSuchEntity.
+func (db Database) EntityVersion(eid ID) (ID, error) {
+	scan, err := db.reader().ScanHistoryEAVT(eid, nil)
+	if err != nil {
+		return 0, fmt.Errorf("scanning EAVT history: %w", err)
+	}
+	assertions, err := dataflow.CollectIntoSlice(dataflow.NewContext(context.Background()), scan)
+	if err != nil {
+		return 0, fmt.Errorf("scanning EAVT history: %w", err)
+	}
+	basis := db.Basis.ID()
+	var version ID
+	for _, ra := range assertions {
+		if ra.Tx <= basis && ra.Tx > version {
+			version = ra.Tx
+		}
+	}
+	if version == 0 {
+		return 0, ErrNoSuchEntity
+	}
+	return version, nil
+}
+
+// EntityHistory returns every assertion and retraction that has been made
+// about the entity, in transaction order. For a view as of an earlier
+// transaction, the assertions of later transactions are not included.
+func (db Database) EntityHistory(idResolver Resolver) ([]ResolvedAssertion, error) {
+	eid, err := db.resolve(idResolver)
+	if err != nil {
+		return nil, fmt.Errorf("resolving entity ID: %w", err)
+	}
+	scan, err := db.reader().ScanHistoryEAVT(eid, nil)
+	if err != nil {
+		return nil, fmt.Errorf("scanning EAVT history: %w", err)
+	}
+	assertions, err := dataflow.CollectIntoSlice(dataflow.NewContext(context.Background()), scan)
+	if err != nil {
+		return nil, fmt.Errorf("scanning EAVT history: %w", err)
+	}
+	idents := make(readFilterCache)
+	history := make([]ResolvedAssertion, 0, len(assertions))
+	for _, ra := range assertions {
+		if (db.asOf == nil || ra.Tx <= *db.asOf) && db.readable(ra.Attribute, ra.EntityID, idents) {
+			history = append(history, *ra)
+		}
+	}
+	// The history of each attribute is in transaction order already.
+	sort.SliceStable(history, func(i, j int) bool { return history[i].Tx < history[j].Tx })
+	return history, nil
+}
+
+// IfUnchanged makes the transaction fail with an *EntityChangedError if any
+// transaction after expectedBasis has changed the entity. expectedBasis may be
+// the entity's version or the basis of the database that the entity was read
+// from. The check is made atomically with the write of the transaction.
+func (tx *TxBuilder) IfUnchanged(entity Resolver, expectedBasis ID) error {
+	if err := tx.usable(); err != nil {
+		return err
+	}
+	eid, err := entity.Resolve(tx.conn)
+	if err != nil {
+		return tx.fail(fmt.Errorf("resolving entity: %w", err))
+	}
+	tx.preconditions = append(tx.preconditions, func(db Database) error {
+		version, err := db.EntityVersion(eid)
+		if err != nil {
+			return fmt.Errorf("reading version of entity %d: %w", eid, err)
+		}
+		if version > expectedBasis {
+			return &EntityChangedError{Entity: eid, Expected: expectedBasis, Version: version}
+		}
+		return nil
+	})
+	return nil
+}
+
+// AssertIfUnchanged is like Assert, but it fails with an *EntityChangedError,
+// which matches ErrConflict, if the entity has been changed by a transaction
+// after expectedBasis. See TxBuilder.IfUnchanged.
+func (conn *Connection) AssertIfUnchanged(entity Resolver, expectedBasis ID, assertables ...Assertable) (*AssertResult, error) {
+	tx := conn.newTx(false)
+	if err := tx.IfUnchanged(entity, expectedBasis); err != nil {
+		return nil, err
+	}
+	if err := tx.Add(assertables...); err != nil {
+		return nil, err
+	}
+	return tx.Commit()
+}
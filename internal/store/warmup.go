@@ -0,0 +1,174 @@
+/*
+Copyright 2024 Andrew Meredith
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sort"
+	"time"
+)
+
+// warmupBatchSize is the number of values whose AVET entries Warmup reads at
+// once.
+const warmupBatchSize = 1024
+
+// WarmupSpec selects the hot attributes that Connection.Warmup loads in
+// addition to the idents and schema.
+type WarmupSpec struct {
+	Attributes []WarmupAttribute
+	// Entities loads the entities that have a hot attribute into the
+	// connection's entity cache, until the cache is full. It has no effect on
+	// a connection without an entity cache.
+	Entities bool
+}
+
+// WarmupAttribute is a hot attribute, whose index entries Warmup reads so
+// that the storage engine caches them.
+type WarmupAttribute struct {
+	Attribute any
+	// Values limits the warm-up to the AVET entries of these values. If
+	// empty, every fact of the attribute is read from the AEVT index and the
+	// AVET entries of their values are read.
+	Values []Value
+}
+
+// WarmupStats reports what Warmup loaded.
+type WarmupStats struct {
+	Idents         int
+	SchemaEntities int
+	// Entries is the number of index entries of hot attributes that were
+	// read.
+	Entries  int
+	Entities int
+	Duration time.Duration
+}
+
+// Warmup preloads the ident cache, the schema of every attribute, and the
+// index entries of the hot attributes of spec, so that the first requests
+// served by the connection do not pay for cold caches. Servers call it once
+// at startup, before they report that they are ready. Warmup stops early with
+// ctx's error if ctx is done.
+func (conn *Connection) Warmup(ctx context.Context, spec WarmupSpec) (WarmupStats, error) {
+	start := time.Now()
+	var stats WarmupStats
+	if err := conn.lifecycle.begin(); err != nil {
+		return stats, err
+	}
+	defer conn.lifecycle.end()
+
+	idents, err := conn.identManager.LoadIdents()
+	if err != nil {
+		return stats, fmt.Errorf("loading idents: %w", err)
+	}
+	conn.identCache.store(idents)
+	conn.identCache.hydrated.Store(true)
+	stats.Idents = len(idents)
+
+	db := conn.DB()
+	var attrs []ID
+	err = db.reader().VisitAEVT(IDType, nil, func(fct *Fact) error {
+		attrs = append(attrs, fct.EntityID)
+		return nil
+	})
+	if err != nil {
+		return stats, fmt.Errorf("scanning schema: %w", err)
+	}
+	for _, attr := range attrs {
+		if err := ctx.Err(); err != nil {
+			return stats, err
+		}
+		if _, err := db.getSchemaEntity(attr); err != nil {
+			return stats, fmt.Errorf("loading schema of attribute %d: %w", attr, err)
+		}
+		stats.SchemaEntities++
+	}
+
+	for _, hot := range spec.Attributes {
+		if err := conn.warmAttribute(ctx, db, hot, spec.Entities, &stats); err != nil {
+			return stats, fmt.Errorf("warming attribute %v: %w", hot.Attribute, err)
+		}
+	}
+	stats.Duration = time.Since(start)
+	return stats, nil
+}
+
+// warmAttribute reads the index entries of a hot attribute and, if entities
+// is set, loads the entities that have it into the entity cache.
+func (conn *Connection) warmAttribute(ctx context.Context, db Database, hot WarmupAttribute, entities bool, stats *WarmupStats) error {
+	ident, err := ResolveIdent(conn, hot.Attribute)
+	if err != nil {
+		return err
+	}
+	var eids []ID
+	vals := hot.Values
+	if len(vals) == 0 {
+		err := db.reader().VisitAEVT(ident.ID, nil, func(fct *Fact) error {
+			stats.Entries++
+			vals = append(vals, fct.Clone().Value)
+			if entities {
+				eids = append(eids, fct.EntityID)
+			}
+			return ctx.Err()
+		})
+		if err != nil {
+			return err
+		}
+		// Entities that share a value share its AVET entries.
+		sort.Slice(vals, func(i, j int) bool {
+			return CompareValues(vals[i], vals[j]) < 0
+		})
+		vals = slices.CompactFunc(vals, ValueEqual)
+	}
+
+	for start := 0; start < len(vals); start += warmupBatchSize {
+		batch := vals[start:min(start+warmupBatchSize, len(vals))]
+		err := db.reader().VisitAVETValues(ident.ID, batch, func(fct *Fact) error {
+			stats.Entries++
+			if entities && len(hot.Values) > 0 {
+				eids = append(eids, fct.EntityID)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+	}
+
+	seen := make(map[ID]struct{}, len(eids))
+	for _, eid := range eids {
+		if conn.entityCache.full() {
+			break
+		}
+		if _, ok := seen[eid]; ok {
+			continue
+		}
+		seen[eid] = struct{}{}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if _, err := db.GetEntity(eid); err != nil {
+			return fmt.Errorf("loading entity %d: %w", eid, err)
+		}
+		stats.Entities++
+	}
+	return nil
+}
@@ -0,0 +1,191 @@
+/*
+Copyright 2024 Andrew Meredith
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"sort"
+	"sync"
+)
+
+// EntityChange describes the attribute-level changes made to an entity by a
+// single transaction.
+type EntityChange struct {
+	Tx       ID
+	EntityID ID
+	Changes  []AttributeChange
+	// Err is set if the watch could not compute the change, in which case it
+	// is the last value delivered before the channel is closed.
+	Err error
+}
+
+// AttributeChange lists the values of an attribute that were added and
+// removed. Replacing the value of a cardinality-one attribute appears as both
+// an addition of the new value and a removal of the old one.
+type AttributeChange struct {
+	Attribute ID
+	Added     []Value
+	Removed   []Value
+}
+
+// WatchEntity returns a channel that receives an EntityChange whenever a
+// transaction modifies the entity, along with a function that stops the watch
+// and closes the channel. Transactions that touch the entity without changing
+// any of its values do not produce a change.
+//
+// A watch does not delay the transactions of its connection. If it falls so
+// far behind that the reports of 16 transactions are waiting to be compared,
+// e.g. because its changes are not read, it is stopped, and the last change
+// that it delivers has an Err of ErrSlowConsumer.
+func (conn *Connection) WatchEntity(eid ID) (<-chan EntityChange, func()) {
+	reports := conn.txReports.add(16, true)
+	changes := make(chan EntityChange, 16)
+	done := make(chan struct{})
+
+	// Read the entity as of the basis after registering for reports so that
+	// no change is missed. The reports of transactions up to the basis are
+	// skipped.
+	basis := conn.DB().Basis.ID()
+	prev, err := conn.DB().AsOf(basis).GetEntity(eid)
+
+	go func() {
+		defer close(changes)
+		send := func(change EntityChange) bool {
+			select {
+			case changes <- change:
+				return true
+			case <-done:
+				return false
+			}
+		}
+		if err != nil {
+			send(EntityChange{EntityID: eid, Err: err})
+			return
+		}
+
+		for report := range reports.ch {
+			if report.Tx <= basis || !touchesEntity(report, eid) {
+				continue
+			}
+			next, err := report.DBAfter.GetEntity(eid)
+			if err != nil {
+				send(EntityChange{Tx: report.Tx, EntityID: eid, Err: err})
+				return
+			}
+			diff := diffEntityState(prev.state, next.state)
+			prev = next
+			if len(diff) == 0 {
+				continue
+			}
+			if !send(EntityChange{Tx: report.Tx, EntityID: eid, Changes: diff}) {
+				return
+			}
+		}
+		if reports.dropped.Load() {
+			send(EntityChange{EntityID: eid, Err: ErrSlowConsumer})
+		}
+	}()
+
+	var once sync.Once
+	return changes, func() {
+		once.Do(func() {
+			close(done)
+			reports.remove()
+		})
+	}
+}
+
+func touchesEntity(report TxReport, eid ID) bool {
+	for _, ra := range report.TxData {
+		if ra.EntityID == eid {
+			return true
+		}
+	}
+	return false
+}
+
+// diffEntityState computes the attribute-level differences between two states
+// of an entity, ordered by attribute, with the values of each change in value
+// order.
+func diffEntityState(before, after map[ID]Value) []AttributeChange {
+	var changes []AttributeChange
+	for attr, afterVal := range after {
+		added, removed := diffValues(before[attr], afterVal)
+		if len(added) > 0 || len(removed) > 0 {
+			changes = append(changes, AttributeChange{
+				Attribute: attr,
+				Added:     added,
+				Removed:   removed,
+			})
+		}
+	}
+	for attr, beforeVal := range before {
+		if _, ok := after[attr]; ok {
+			continue
+		}
+		_, removed := diffValues(beforeVal, nil)
+		changes = append(changes, AttributeChange{
+			Attribute: attr,
+			Removed:   removed,
+		})
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Attribute < changes[j].Attribute })
+	return changes
+}
+
+// diffValues compares the values of a single attribute, where cardinality-many
+// attributes hold a []Value.
+func diffValues(before, after Value) (added, removed []Value) {
+	beforeVals := attributeValues(before)
+	afterVals := attributeValues(after)
+	for _, v := range afterVals {
+		if !containsValue(beforeVals, v) {
+			added = append(added, v)
+		}
+	}
+	for _, v := range beforeVals {
+		if !containsValue(afterVals, v) {
+			removed = append(removed, v)
+		}
+	}
+	sortValues(added)
+	sortValues(removed)
+	return added, removed
+}
+
+func sortValues(vals []Value) {
+	sort.Slice(vals, func(i, j int) bool { return CompareValues(vals[i], vals[j]) < 0 })
+}
+
+func attributeValues(val Value) []Value {
+	switch v := val.(type) {
+	case nil:
+		return nil
+	case []Value:
+		return v
+	default:
+		return []Value{v}
+	}
+}
+
+func containsValue(vals []Value, val Value) bool {
+	for _, v := range vals {
+		if ValueEqual(v, val) {
+			return true
+		}
+	}
+	return false
+}
@@ -58,3 +58,13 @@ func Keys[K comparable, V any](m map[K]V) []K {
 	}
 	return out
 }
+
+func Values[K comparable, V any](m map[K]V) []V {
+	out := make([]V, len(m))
+	i := 0
+	for _, v := range m {
+		out[i] = v
+		i++
+	}
+	return out
+}
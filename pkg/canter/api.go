@@ -0,0 +1,219 @@
+/*
+Copyright 2024 Andrew Meredith
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package canter
+
+import (
+	"net/http"
+
+	"github.com/kendru/canter/internal/store"
+	"github.com/kendru/canter/internal/store/federation"
+	"github.com/kendru/canter/internal/store/query"
+)
+
+// Connections and databases.
+type (
+	// Connection writes to a store and provides the Database of its latest
+	// basis.
+	Connection = store.Connection
+	// Database is an immutable view of a store as of a basis.
+	Database = store.Database
+	// PeerConfig configures a peer of a Connection. See Connection.NewPeer.
+	PeerConfig = store.PeerConfig
+	// ReadTxn pins a consistent snapshot of a store. See Connection.ReadTxn.
+	ReadTxn = store.ReadTxn
+	// Subscription delivers the results of a query as they change. See
+	// Connection.Subscribe.
+	Subscription = store.Subscription
+	// ReadFilter hides attributes from the reads of a view of the database.
+	// See Database.WithReadFilter.
+	ReadFilter = store.ReadFilter
+	// Partition is a numbered range of entity IDs whose entities may be kept
+	// in a store of their own. See Options.Partitions.
+	Partition = store.Partition
+	// WarmupSpec selects the hot attributes that Connection.Warmup preloads.
+	WarmupSpec = store.WarmupSpec
+	// WarmupAttribute is a hot attribute to preload.
+	WarmupAttribute = store.WarmupAttribute
+	// WarmupStats reports what Connection.Warmup preloaded.
+	WarmupStats = store.WarmupStats
+	// ReadOpts configures the consistency of a read. See Consistency.
+	ReadOpts = store.ReadOpts
+	// Consistency is the freshness that a read requires.
+	Consistency = store.Consistency
+)
+
+// Consistency levels of reads.
+const (
+	ConsistencyEventual = store.ConsistencyEventual
+	ConsistencyBounded  = store.ConsistencyBounded
+	ConsistencyStrong   = store.ConsistencyStrong
+)
+
+// Schema.
+type (
+	// SchemaAttribute is the schema of an attribute with the defaults of
+	// missing schema flags applied. See Database.SchemaFor.
+	SchemaAttribute = store.SchemaAttribute
+	// InferredAttribute describes an attribute created in soft schema mode.
+	// See Database.InferredSchema.
+	InferredAttribute = store.InferredAttribute
+)
+
+// Entities and values.
+type (
+	// ID identifies an entity, including attributes and transactions.
+	ID = store.ID
+	// Value is a value of an attribute.
+	Value = store.Value
+	// Ident is the name of an entity, such as an attribute.
+	Ident = store.Ident
+	// Lookup identifies an entity by the value of a unique attribute.
+	Lookup = store.Lookup
+	// Resolver is anything that identifies an entity: an ID, an Ident, a
+	// Lookup, or a temporary ID.
+	Resolver = store.Resolver
+	// Entity is the attributes of an entity as of a basis.
+	Entity = store.Entity
+	// EntityData is an entity to be asserted, keyed by attribute name. The
+	// "db/id" key, if present, identifies the entity.
+	EntityData = store.EntityData
+	// Fact is a single assertion or retraction of a value.
+	Fact = store.Fact
+	// Tuple is the value of a tuple attribute.
+	Tuple = store.Tuple
+)
+
+// Transactions.
+type (
+	// Assertable is anything that a transaction may assert: EntityData, an
+	// Assertion, or the result of ValidDuring.
+	Assertable = store.Assertable
+	// Assertion asserts or retracts a single value.
+	Assertion = store.Assertion
+	// AssertResult describes a committed transaction.
+	AssertResult = store.AssertResult
+	// TxBuilder accumulates a transaction. See Connection.NewTx.
+	TxBuilder = store.TxBuilder
+	// TxOption changes how a transaction is committed.
+	TxOption = store.TxOption
+	// TxReport describes a transaction to the connections that observe it.
+	TxReport = store.TxReport
+	// TxLogVerification summarizes the verification of a transaction log.
+	// See Database.VerifyTxLog.
+	TxLogVerification = store.TxLogVerification
+	// LogVerification is the result of verifying a store against an
+	// exported transaction log. See Database.VerifyLog.
+	LogVerification = store.LogVerification
+)
+
+// Queries.
+type (
+	// Query is a parsed or built query.
+	Query = store.Query
+	// QueryBuilder builds a Query programmatically. See Find.
+	QueryBuilder = query.Builder
+	// QueryResult holds the rows of a query run by Exec.
+	QueryResult = query.Result
+)
+
+// Federation of several stores, such as per-tenant shards.
+type (
+	// Federation runs queries and pulls across the connections registered
+	// with it. See NewFederation.
+	Federation = federation.Federation
+	// FederatedQueryResult holds the merged rows of a federated query.
+	FederatedQueryResult = federation.QueryResult
+	// FederatedPullResult holds the merged data of a federated pull.
+	FederatedPullResult = federation.PullResult
+	// ShardError is the error of one shard of a federated operation.
+	ShardError = federation.ShardError
+)
+
+// NewFederation returns a Federation without shards.
+var NewFederation = federation.New
+
+var (
+	// Assert asserts that the attribute of an entity has a value.
+	Assert = store.Assert
+	// Retract retracts the value of the attribute of an entity.
+	Retract = store.Retract
+	// ValidDuring limits the valid time of the assertables to [from, to).
+	ValidDuring = store.ValidDuring
+	// NamedTempID returns a temporary ID that refers to the same new entity
+	// wherever it appears in a transaction.
+	NamedTempID = store.NamedTempID
+	// NewLookup identifies the entity whose unique attribute has a value.
+	NewLookup = store.NewLookup
+	// ValueEqual reports whether two values are equal.
+	ValueEqual = store.ValueEqual
+	// CompareValues orders two values of any types.
+	CompareValues = store.CompareValues
+
+	// WithContext bounds the commit of a transaction by a context.
+	WithContext = store.WithContext
+	// WithIsolatedTempIDs scopes the names of the temporary IDs of a
+	// transaction to the Assertable that uses them.
+	WithIsolatedTempIDs = store.WithIsolatedTempIDs
+	// WithNoResolveUnique keeps the temporary IDs of a transaction from
+	// resolving to existing entities through identity attributes.
+	WithNoResolveUnique = store.WithNoResolveUnique
+	// WithPartition allocates the new entities of a transaction in a
+	// partition.
+	WithPartition = store.WithPartition
+)
+
+var (
+	// ParseQuery parses the text of a query.
+	ParseQuery = query.Parse
+	// MustParseQuery is like ParseQuery, except that it panics if the query
+	// does not parse.
+	MustParseQuery = query.MustParse
+	// Find begins a query that finds the values of vars.
+	Find = query.Find
+	// RunQuery runs a query against one or more databases.
+	RunQuery = store.RunQuery
+	// Exec runs a query and returns a QueryResult, whose rows may be scanned
+	// into structs.
+	Exec = query.Exec
+)
+
+// QueryHandler serves the queries POSTed to it against the latest database of
+// conn. See the query package of the canter server for the protocol.
+func QueryHandler(conn *Connection) http.Handler {
+	return query.Handler(conn)
+}
+
+// Errors that the store returns, which may be matched with errors.Is.
+var (
+	ErrNoSuchEntity    = store.ErrNoSuchEntity
+	ErrNoSuchIdent     = store.ErrNoSuchIdent
+	ErrConflict        = store.ErrConflict
+	ErrSystemEntity    = store.ErrSystemEntity
+	ErrTxTooLarge      = store.ErrTxTooLarge
+	ErrTxDone          = store.ErrTxDone
+	ErrReadOnly        = store.ErrReadOnly
+	ErrClosed          = store.ErrClosed
+	ErrInvalidTempID   = store.ErrInvalidTempID
+	ErrInvalidCursor   = store.ErrInvalidCursor
+	ErrSchemaViolation = store.ErrSchemaViolation
+	ErrThrottled       = store.ErrThrottled
+	ErrMemoryBudget    = store.ErrMemoryBudget
+	ErrStaleBasis      = store.ErrStaleBasis
+	ErrInvalidToken    = store.ErrInvalidToken
+	ErrIntegrity       = store.ErrIntegrity
+	ErrCrossPartition  = store.ErrCrossPartition
+)
@@ -0,0 +1,92 @@
+/*
+Copyright 2024 Andrew Meredith
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package canter embeds a canter store in another program.
+//
+// It is the stable API of canter: the names that it exports keep their
+// meaning across minor releases, whereas the packages under internal may
+// change at any time. A store is opened with Open, written through the
+// Connection, and read through the Database of a basis:
+//
+//	conn, err := canter.Open(canter.Options{Dir: "/var/lib/app"})
+//	if err != nil {
+//		return err
+//	}
+//	defer conn.Close(ctx)
+//
+//	_, err = conn.ApplySchemaFile("schema.edn")
+//	res, err := conn.Assert(canter.EntityData{
+//		"person/email": "ada@example.com",
+//		"person/name":  "Ada",
+//	})
+//	rows, err := canter.Find("?name").
+//		Where("?e", "person/email", "ada@example.com").
+//		Where("?e", "person/name", "?name").
+//		Run(res.DB)
+//
+// The types of the package are aliases of the types of the store, so the
+// values that it returns may be used with every method of those types.
+// Methods that are not documented on this page, such as those that tune the
+// storage engine, are outside of the stable API.
+package canter
+
+import (
+	"github.com/kendru/canter/internal/config"
+)
+
+// Options configures a store opened by Open.
+type Options struct {
+	// Dir is the directory that holds the store. If empty, the store is held
+	// in memory until its connection is closed.
+	Dir string
+	// ReadOnly opens the store for reading only. It may not be set for a
+	// store that is held in memory.
+	ReadOnly bool
+	// EntityCacheSize is the number of recently read entities that the
+	// connection caches. If zero, entities are not cached.
+	EntityCacheSize int
+	// MaxTxFacts limits the number of facts that a single transaction may
+	// assert. If zero, transactions are unlimited.
+	MaxTxFacts int
+	// InferSchema enables soft schema mode, in which asserting an unknown
+	// attribute creates it with a type inferred from its value. See
+	// Database.InferredSchema.
+	InferSchema bool
+	// Partitions is the number of entity partitions, numbered from 1, that
+	// are kept in stores of their own in subdirectories of Dir. Entities are
+	// allocated in a partition by WithPartition.
+	Partitions int
+}
+
+// Open opens the store described by opts and returns a connection to it. A
+// writable store is initialized, or its system schema upgraded, before Open
+// returns. Closing the connection closes the store.
+func Open(opts Options) (*Connection, error) {
+	cfg := config.Default()
+	if opts.Dir == "" {
+		cfg.Storage.Backend = config.BackendMemory
+	}
+	cfg.Storage.Dir = opts.Dir
+	cfg.Storage.ReadOnly = opts.ReadOnly
+	cfg.Cache.Entities = opts.EntityCacheSize
+	cfg.Limits.MaxTxFacts = opts.MaxTxFacts
+	cfg.Schema.Infer = opts.InferSchema
+	cfg.Storage.Partitions = opts.Partitions
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg.Open()
+}
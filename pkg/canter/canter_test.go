@@ -0,0 +1,131 @@
+/*
+Copyright 2024 Andrew Meredith
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package canter_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/kendru/canter/pkg/canter"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEmbedding(t *testing.T) {
+	conn, err := canter.Open(canter.Options{})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close(context.Background())
+
+	_, err = conn.ApplySchema(strings.NewReader(`
+		[{:db/ident :person/email :db/type :db.type/string :db/cardinality :db.cardinality/one :db/unique :db.unique/identity}
+		 {:db/ident :person/name :db/type :db.type/string :db/cardinality :db.cardinality/one}]`))
+	if !assert.NoError(t, err) {
+		return
+	}
+	res, err := conn.Assert(canter.EntityData{
+		"db/id":        canter.NamedTempID("ada"),
+		"person/email": "ada@example.com",
+		"person/name":  "Ada",
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	ada, _ := res.TempIDs.LookupTempID(canter.NamedTempID("ada"))
+
+	var db canter.Database = res.DB
+	ent, err := db.GetEntity(canter.NewLookup("person/email", "ada@example.com"))
+	if assert.NoError(t, err) {
+		assert.Equal(t, ada, ent.ID())
+	}
+	rows, err := canter.Find("?name").
+		Where("?e", "person/email", "ada@example.com").
+		Where("?e", "person/name", "?name").
+		Run(db)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]canter.Value{{"Ada"}}, rows)
+	rows, err = canter.RunQuery(canter.MustParseQuery(`[:find ?e :where [?e :person/name "Ada"]]`), db)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]canter.Value{{ada}}, rows)
+
+	_, err = conn.Assert(canter.Assert(ada, "person/nickname", "A"))
+	assert.ErrorIs(t, err, canter.ErrNoSuchIdent)
+	_, err = db.GetEntity(canter.NewLookup("person/email", "bo@example.com"))
+	assert.ErrorIs(t, err, canter.ErrNoSuchEntity)
+
+	_, err = canter.Open(canter.Options{ReadOnly: true})
+	assert.Error(t, err)
+}
+
+func TestEmbeddingInferSchema(t *testing.T) {
+	conn, err := canter.Open(canter.Options{InferSchema: true})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close(context.Background())
+
+	res, err := conn.Assert(canter.EntityData{"person/nickname": "A"})
+	if !assert.NoError(t, err) {
+		return
+	}
+	inferred, err := res.DB.InferredSchema()
+	if assert.NoError(t, err) && assert.Len(t, inferred, 1) {
+		assert.Equal(t, "person/nickname", inferred[0].Attribute.Name)
+		assert.Equal(t, "db.type/string", inferred[0].Type.Name)
+	}
+}
+
+func TestEmbeddingFederation(t *testing.T) {
+	fed := canter.NewFederation()
+	for _, name := range []string{"a", "b"} {
+		conn, err := canter.Open(canter.Options{InferSchema: true})
+		if !assert.NoError(t, err) {
+			return
+		}
+		defer conn.Close(context.Background())
+		_, err = conn.Assert(canter.EntityData{"tenant/name": name})
+		assert.NoError(t, err)
+		assert.NoError(t, fed.Register(name, conn))
+	}
+	res, err := fed.Query(context.Background(), canter.MustParseQuery(`[:find ?n :where [?e :tenant/name ?n]]`))
+	if assert.NoError(t, err) {
+		assert.Equal(t, [][]canter.Value{{"a"}, {"b"}}, res.Rows)
+	}
+}
+
+func TestEmbeddingPartitions(t *testing.T) {
+	conn, err := canter.Open(canter.Options{Partitions: 2})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close(context.Background())
+
+	_, err = conn.Assert(canter.EntityData{"db/ident": "tenant/name", "db/type": "db.type/string"})
+	assert.NoError(t, err)
+	res, err := conn.Assert(canter.WithPartition(1), canter.EntityData{"db/id": canter.NamedTempID("a"), "tenant/name": "a"})
+	if assert.NoError(t, err) {
+		assert.Equal(t, canter.Partition(1), res.Names["a"].Partition())
+	}
+	_, err = conn.Assert(canter.WithPartition(2), canter.EntityData{"tenant/name": "b"})
+	assert.NoError(t, err)
+
+	rows, err := conn.DB().Query(canter.MustParseQuery(`[:find ?n :where [?e :tenant/name ?n]]`))
+	if assert.NoError(t, err) {
+		assert.ElementsMatch(t, [][]canter.Value{{"a"}, {"b"}}, rows)
+	}
+}
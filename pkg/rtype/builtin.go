@@ -22,6 +22,7 @@ import (
 	"math"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gofrs/uuid/v5"
 	"github.com/oklog/ulid/v2"
@@ -123,6 +124,20 @@ var (
 		},
 	}
 
+	RTypeTimestamp = &BaseType{
+		Tag: "timestamp",
+		Parse: func(in string) (any, error) {
+			if in == "" {
+				return nil, ErrNoInput
+			}
+			t, err := time.Parse(time.RFC3339Nano, in)
+			if err != nil {
+				return nil, errors.Join(err, ErrMalformed)
+			}
+			return t, nil
+		},
+	}
+
 	RTypeType = &BaseType{
 		Tag: "type",
 		Parse: func(in string) (any, error) {
@@ -21,8 +21,15 @@ import (
 	"fmt"
 )
 
+// Parse parses a type expression using the default registry.
 func Parse(typeStr string) (ConcreteType, error) {
-	return newParser(typeStr).parse()
+	return ParseWithRegistry(globalReg, typeStr)
+}
+
+// ParseWithRegistry parses a type expression, resolving all type tags against
+// the supplied registry rather than the default registry.
+func ParseWithRegistry(reg *Registry, typeStr string) (ConcreteType, error) {
+	return newParserWithRegistry(reg, typeStr).parse()
 }
 
 func MustParse(typeStr string) ConcreteType {
@@ -60,7 +67,7 @@ func Encode(ct ConcreteType) string {
 			case "int64", "float64", "boolean":
 				fmt.Fprintf(&buf, "%v", actualParam)
 			case "string", "uuid", "ulid":
-				fmt.Fprintf(&buf, "%q", actualParam)
+				buf.WriteString(quoteString(fmt.Sprint(actualParam)))
 			case "type":
 				encodedType := Encode(actualParam.(ConcreteType))
 				buf.WriteString(encodedType)
@@ -17,8 +17,8 @@ limitations under the License.
 package rtype
 
 import (
-	"fmt"
 	"strconv"
+	"strings"
 )
 
 type booleanLiteral struct {
@@ -93,7 +93,12 @@ func NewFloat64Literal(val float64) *float64Literal {
 }
 
 func (t *float64Literal) TypeTag() string {
-	return strconv.FormatFloat(t.val, 'f', -1, 64)
+	tag := strconv.FormatFloat(t.val, 'f', -1, 64)
+	if !strings.ContainsRune(tag, '.') {
+		// Without a decimal point, the tag would parse as an integer literal.
+		tag += ".0"
+	}
+	return tag
 }
 
 func (t *float64Literal) ParseString(in string) (any, error) {
@@ -123,7 +128,7 @@ func NewStringLiteral(val string) *stringLiteral {
 }
 
 func (t *stringLiteral) TypeTag() string {
-	return fmt.Sprintf("%q", t.val)
+	return quoteString(t.val)
 }
 
 func (t *stringLiteral) ParseString(in string) (any, error) {
@@ -143,3 +148,37 @@ func (t *stringLiteral) concreteTypeMarker() {}
 func (t *stringLiteral) parentType() ConcreteType {
 	return RTypeString
 }
+
+// quoteString quotes s as a string literal, escaping only the characters that
+// the scanner recognizes in escape sequences.
+func quoteString(s string) string {
+	var buf strings.Builder
+	buf.Grow(len(s) + 2)
+	buf.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c == '\\' || c == '"' {
+			buf.WriteByte('\\')
+		}
+		buf.WriteByte(s[i])
+	}
+	buf.WriteByte('"')
+	return buf.String()
+}
+
+// unquoteString reverses quoteString. The input must be a string literal
+// that was accepted by the scanner.
+func unquoteString(s string) string {
+	s = s[1 : len(s)-1]
+	if !strings.ContainsRune(s, '\\') {
+		return s
+	}
+	var buf strings.Builder
+	buf.Grow(len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' {
+			i++
+		}
+		buf.WriteByte(s[i])
+	}
+	return buf.String()
+}
@@ -23,12 +23,18 @@ import (
 )
 
 type parser struct {
+	reg    *Registry
 	scn    *scanner
 	peeked *token
 }
 
 func newParser(buf string) *parser {
+	return newParserWithRegistry(globalReg, buf)
+}
+
+func newParserWithRegistry(reg *Registry, buf string) *parser {
 	return &parser{
+		reg: reg,
 		scn: newScanner(buf),
 	}
 }
@@ -42,6 +48,12 @@ func (p *parser) parseUnion() (ConcreteType, error) {
 	if err != nil {
 		return nil, err
 	}
+	return p.parseUnionFrom(variant)
+}
+
+// parseUnionFrom continues parsing a union whose first variant has already
+// been parsed.
+func (p *parser) parseUnionFrom(variant ConcreteType) (ConcreteType, error) {
 	variants := []ConcreteType{variant}
 	for {
 		if !p.nextTokenIs(ttPipe) {
@@ -65,14 +77,19 @@ func (p *parser) parseUnion() (ConcreteType, error) {
 func (p *parser) parseBase() (ConcreteType, error) {
 	tok, ok := p.nextToken()
 	if !ok {
-		return nil, p.scn.err
+		if p.scn.err != nil {
+			return nil, p.scn.err
+		}
+		return nil, errors.New("unexpected EOF")
 	}
+	return p.parseBaseFrom(tok)
+}
+
+// parseBaseFrom parses a base type whose first token has already been consumed.
+func (p *parser) parseBaseFrom(tok token) (ConcreteType, error) {
 	switch tok.tokenType {
 	case ttString:
-		// TODO: parse string
-		stringSource := tok.String()
-		val := stringSource[1 : len(stringSource)-1]
-		return NewStringLiteral(val), nil
+		return NewStringLiteral(unquoteString(tok.String())), nil
 	case ttInteger:
 		val, err := strconv.ParseInt(tok.String(), 10, 64)
 		if err != nil {
@@ -94,7 +111,7 @@ func (p *parser) parseBase() (ConcreteType, error) {
 	case ttIdent:
 		tag := tok.String()
 		if p.nextTokenIs(ttLBracket) {
-			gt, ok := LookupGeneric(tag)
+			gt, ok := p.reg.LookupGeneric(tag)
 			if !ok {
 				return nil, fmt.Errorf("generic type %s not found", tag)
 			}
@@ -105,7 +122,7 @@ func (p *parser) parseBase() (ConcreteType, error) {
 			}
 			return InstantiateParameterized(gt, params)
 		}
-		ct, ok := Lookup(tag)
+		ct, ok := p.reg.Lookup(tag)
 		if !ok {
 			return nil, fmt.Errorf("type %s not found", tag)
 		}
@@ -140,10 +157,13 @@ func (p *parser) parseParamList(t *GenericType) (map[string]any, error) {
 		}
 
 		var param = t.Parameters[i]
+		// identTok holds a leading identifier that turned out not to be a
+		// parameter name, so it must be parsed as the start of the value.
+		var identTok *token
 		if tok.tokenType == ttIdent {
 			ident := tok.String()
 			p.nextToken()
-			if tok, _ := p.peek(); tok.tokenType == ttEqual {
+			if next, _ := p.peek(); next.tokenType == ttEqual {
 				// If the next token is an equal sign, then this is a named
 				// parameter assignment.
 				var found bool
@@ -160,6 +180,8 @@ func (p *parser) parseParamList(t *GenericType) (map[string]any, error) {
 
 				// Skip the equal sign and advance tok to the start of the value.
 				_, _ = p.nextToken()
+			} else {
+				identTok = &tok
 			}
 		}
 
@@ -170,7 +192,16 @@ func (p *parser) parseParamList(t *GenericType) (map[string]any, error) {
 		// we parse the parameter as a type and extract the underlying
 		// value as appropriate for the parameter type.
 		var paramVal any
-		valAsType, err := p.parseUnion()
+		var valAsType ConcreteType
+		var err error
+		if identTok != nil {
+			var first ConcreteType
+			if first, err = p.parseBaseFrom(*identTok); err == nil {
+				valAsType, err = p.parseUnionFrom(first)
+			}
+		} else {
+			valAsType, err = p.parseUnion()
+		}
 		if err != nil {
 			return nil, err
 		}
@@ -180,10 +211,12 @@ func (p *parser) parseParamList(t *GenericType) (map[string]any, error) {
 				return nil, err
 			}
 		case "string", "uuid", "uri":
-			str := valAsType.TypeTag()
-			if paramVal, err = param.Type.ParseString(str[1 : len(str)-1]); err != nil {
+			if paramVal, err = param.Type.ParseString(unquoteString(valAsType.TypeTag())); err != nil {
 				return nil, err
 			}
+		case "type":
+			// Type parameters are already parsed as types.
+			paramVal = valAsType
 		default:
 			panic(fmt.Errorf("TODO: implement non-literal parameter parsing! %T", t))
 		}
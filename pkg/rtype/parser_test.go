@@ -175,3 +175,26 @@ func TestParseParameterized(t *testing.T) {
 		})
 	}
 }
+
+func FuzzParse(f *testing.F) {
+	f.Add(`"my string"`)
+	f.Add(`345.543`)
+	f.Add(`"test"|int64|true|12.34`)
+	f.Add(`decimal<precision = 10, scale=3>`)
+	f.Add(`decimal<8, scale = 2>`)
+	f.Fuzz(func(t *testing.T, in string) {
+		ct, err := Parse(in)
+		if err != nil {
+			return
+		}
+		// Any type that parses must survive an encode/parse round trip.
+		encoded := Encode(ct)
+		reparsed, err := Parse(encoded)
+		if err != nil {
+			t.Fatalf("parsing encoded form %q of %q: %v", encoded, in, err)
+		}
+		if reencoded := Encode(reparsed); reencoded != encoded {
+			t.Fatalf("round trip of %q changed encoding from %q to %q", in, encoded, reencoded)
+		}
+	})
+}
@@ -0,0 +1,299 @@
+/*
+Copyright 2024 Andrew Meredith
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rtype
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+var RTypeRangeGen = &GenericType{
+	Tag: "range",
+	Parameters: []TypeParameter{
+		{
+			Name: "elem",
+			Type: RTypeType,
+		},
+	},
+	Instantiate: func(params map[string]any) (ValueParser, error) {
+		elem := params["elem"].(ConcreteType)
+		switch RootType(elem).TypeTag() {
+		case "int64", "float64", "string", "timestamp":
+			return NewRTypeRange(elem), nil
+		default:
+			return nil, fmt.Errorf("range.elem must be an ordered type: %s", elem.TypeTag())
+		}
+	},
+}
+
+// RTypeRange parses ranges over an ordered element type. The textual form of a
+// range uses interval notation, where a square bracket denotes an inclusive
+// bound and a parenthesis denotes an exclusive bound. Either bound may be
+// omitted to produce a range that is unbounded on that side, e.g.:
+//
+//	[1, 10)
+//	(2024-01-01T00:00:00Z, ]
+//
+// A bound may be quoted as a Go string literal, and string bounds that contain
+// a comma must be, since the bounds are otherwise separated at the first
+// comma. A quoted empty string is a bound rather than the absence of one:
+//
+//	["a, b", "c"]
+//	["", "m")
+type RTypeRange struct {
+	elem ConcreteType
+}
+
+func NewRTypeRange(elem ConcreteType) *RTypeRange {
+	return &RTypeRange{
+		elem: elem,
+	}
+}
+
+func (t RTypeRange) ParseString(in string) (any, error) {
+	in = strings.TrimSpace(in)
+	if in == "" {
+		return nil, ErrNoInput
+	}
+	if len(in) < 3 {
+		return nil, fmt.Errorf("range too short: %w", ErrMalformed)
+	}
+
+	var r Range
+	switch in[0] {
+	case '[':
+		r.LowerInclusive = true
+	case '(':
+	default:
+		return nil, fmt.Errorf("range must start with '[' or '(': %w", ErrMalformed)
+	}
+	switch in[len(in)-1] {
+	case ']':
+		r.UpperInclusive = true
+	case ')':
+	default:
+		return nil, fmt.Errorf("range must end with ']' or ')': %w", ErrMalformed)
+	}
+
+	lower, lowerQuoted, rest, err := readRangeBound(in[1 : len(in)-1])
+	if err != nil {
+		return nil, fmt.Errorf("parsing lower bound: %w", err)
+	}
+	rest, found := strings.CutPrefix(strings.TrimSpace(rest), ",")
+	if !found {
+		return nil, fmt.Errorf("range must contain a ',' separating bounds: %w", ErrMalformed)
+	}
+	upper, upperQuoted, rest, err := readRangeBound(rest)
+	if err != nil {
+		return nil, fmt.Errorf("parsing upper bound: %w", err)
+	}
+	if rest = strings.TrimSpace(rest); rest != "" {
+		if rest[0] == ',' {
+			return nil, fmt.Errorf("range contains more than one ','; bounds that contain commas must be quoted: %w", ErrMalformed)
+		}
+		return nil, fmt.Errorf("unexpected input after upper bound: %w", ErrMalformed)
+	}
+	if lower != "" || lowerQuoted {
+		if r.Lower, err = t.elem.ParseString(lower); err != nil {
+			return nil, fmt.Errorf("parsing lower bound: %w", err)
+		}
+	} else {
+		r.LowerInclusive = false
+	}
+	if upper != "" || upperQuoted {
+		if r.Upper, err = t.elem.ParseString(upper); err != nil {
+			return nil, fmt.Errorf("parsing upper bound: %w", err)
+		}
+	} else {
+		r.UpperInclusive = false
+	}
+
+	if r.Lower != nil && r.Upper != nil {
+		cmp, ok := compareOrdered(r.Lower, r.Upper)
+		if !ok {
+			return nil, fmt.Errorf("range bounds are not comparable: %w", ErrMalformed)
+		}
+		if cmp > 0 {
+			return nil, errors.Join(errors.New("lower bound is greater than upper bound"), ErrOutOfRange)
+		}
+	}
+
+	return r, nil
+}
+
+// readRangeBound reads a bound from the start of in, returning the bound and
+// the input that follows it. A bound is either quoted as a Go string literal,
+// or else runs up to the next ',' and has surrounding space trimmed.
+func readRangeBound(in string) (bound string, quoted bool, rest string, err error) {
+	in = strings.TrimLeftFunc(in, unicode.IsSpace)
+	if !strings.HasPrefix(in, `"`) {
+		end := strings.IndexByte(in, ',')
+		if end < 0 {
+			end = len(in)
+		}
+		return strings.TrimSpace(in[:end]), false, in[end:], nil
+	}
+	for i := 1; i < len(in); i++ {
+		switch in[i] {
+		case '\\':
+			i++
+		case '"':
+			bound, err := strconv.Unquote(in[:i+1])
+			if err != nil {
+				return "", false, "", fmt.Errorf("invalid quoted bound %s: %w", in[:i+1], ErrMalformed)
+			}
+			return bound, true, in[i+1:], nil
+		}
+	}
+	return "", false, "", fmt.Errorf("unterminated quoted bound: %w", ErrMalformed)
+}
+
+// Range is a (possibly unbounded) interval of ordered values. A nil Lower or
+// Upper bound indicates that the range is unbounded on that side.
+type Range struct {
+	Lower, Upper                   any
+	LowerInclusive, UpperInclusive bool
+}
+
+// IsEmpty reports whether the range cannot contain any value, e.g. [1, 1).
+func (r Range) IsEmpty() bool {
+	if r.Lower == nil || r.Upper == nil {
+		return false
+	}
+	cmp, ok := compareOrdered(r.Lower, r.Upper)
+	if !ok {
+		return true
+	}
+	return cmp > 0 || (cmp == 0 && !(r.LowerInclusive && r.UpperInclusive))
+}
+
+// Contains reports whether val falls within the range. Values that are not
+// comparable to the bounds of the range are never contained in it.
+func (r Range) Contains(val any) bool {
+	if r.Lower != nil {
+		cmp, ok := compareOrdered(r.Lower, val)
+		if !ok || cmp > 0 || (cmp == 0 && !r.LowerInclusive) {
+			return false
+		}
+	}
+	if r.Upper != nil {
+		cmp, ok := compareOrdered(val, r.Upper)
+		if !ok || cmp > 0 || (cmp == 0 && !r.UpperInclusive) {
+			return false
+		}
+	}
+	return true
+}
+
+// Overlaps reports whether there is any value that is contained in both
+// ranges.
+func (r Range) Overlaps(other Range) bool {
+	if r.IsEmpty() || other.IsEmpty() {
+		return false
+	}
+	return boundBefore(r.Lower, r.LowerInclusive, other.Upper, other.UpperInclusive) &&
+		boundBefore(other.Lower, other.LowerInclusive, r.Upper, r.UpperInclusive)
+}
+
+func (r Range) String() string {
+	var sb strings.Builder
+	if r.LowerInclusive {
+		sb.WriteByte('[')
+	} else {
+		sb.WriteByte('(')
+	}
+	if r.Lower != nil {
+		sb.WriteString(formatBound(r.Lower))
+	}
+	sb.WriteString(", ")
+	if r.Upper != nil {
+		sb.WriteString(formatBound(r.Upper))
+	}
+	if r.UpperInclusive {
+		sb.WriteByte(']')
+	} else {
+		sb.WriteByte(')')
+	}
+	return sb.String()
+}
+
+// boundBefore reports whether a lower bound admits values at or below an upper
+// bound. Nil bounds are treated as unbounded.
+func boundBefore(lower any, lowerInclusive bool, upper any, upperInclusive bool) bool {
+	if lower == nil || upper == nil {
+		return true
+	}
+	cmp, ok := compareOrdered(lower, upper)
+	if !ok {
+		return false
+	}
+	return cmp < 0 || (cmp == 0 && lowerInclusive && upperInclusive)
+}
+
+// formatBound formats a bound as ParseString reads it. Strings that would not
+// read back as themselves, such as those that contain a comma, are quoted.
+func formatBound(val any) string {
+	switch v := val.(type) {
+	case time.Time:
+		return v.Format(time.RFC3339Nano)
+	case string:
+		if v == "" || v != strings.TrimSpace(v) || strings.ContainsAny(v, `,"`) {
+			return strconv.Quote(v)
+		}
+		return v
+	default:
+		return fmt.Sprintf("%v", val)
+	}
+}
+
+// compareOrdered compares two values of the same ordered type, returning -1, 0,
+// or 1. The second return value is false if the values cannot be compared.
+func compareOrdered(a, b any) (int, bool) {
+	switch a := a.(type) {
+	case int64:
+		b, ok := b.(int64)
+		if !ok {
+			return 0, false
+		}
+		return cmp.Compare(a, b), true
+	case float64:
+		b, ok := b.(float64)
+		if !ok {
+			return 0, false
+		}
+		return cmp.Compare(a, b), true
+	case string:
+		b, ok := b.(string)
+		if !ok {
+			return 0, false
+		}
+		return strings.Compare(a, b), true
+	case time.Time:
+		b, ok := b.(time.Time)
+		if !ok {
+			return 0, false
+		}
+		return a.Compare(b), true
+	default:
+		return 0, false
+	}
+}
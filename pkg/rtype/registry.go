@@ -16,19 +16,30 @@ limitations under the License.
 
 package rtype
 
-import "errors"
+import (
+	"errors"
+	"sync"
+)
 
 var globalReg = NewRegistry()
 
 func init() {
-	registerBuiltins()
+	globalReg.registerBuiltins()
 }
 
+// Registry holds the set of concrete and generic types that may be referenced
+// by tag when parsing type expressions. A Registry is safe for concurrent use.
+// Most callers should create their own registry with NewRegistryWithBuiltins()
+// rather than mutating the default registry so that custom types remain
+// isolated to a single database or test.
 type Registry struct {
+	mu       sync.RWMutex
 	concrete map[string]ConcreteType
 	generic  map[string]*GenericType
 }
 
+// NewRegistry returns an empty registry. Note that an empty registry cannot
+// resolve even the builtin types.
 func NewRegistry() *Registry {
 	return &Registry{
 		concrete: make(map[string]ConcreteType),
@@ -36,12 +47,30 @@ func NewRegistry() *Registry {
 	}
 }
 
+// NewRegistryWithBuiltins returns a new registry that has been populated with
+// all of the builtin types.
+func NewRegistryWithBuiltins() *Registry {
+	r := NewRegistry()
+	r.registerBuiltins()
+	return r
+}
+
+// DefaultRegistry returns the process-wide registry that is used by the
+// package-level functions in this package.
+func DefaultRegistry() *Registry {
+	return globalReg
+}
+
 func (r *Registry) Lookup(tag string) (ConcreteType, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
 	rt, ok := r.concrete[tag]
 	return rt, ok
 }
 
 func (r *Registry) Register(t ConcreteType) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
 	if _, ok := r.concrete[t.TypeTag()]; ok {
 		return errors.New("type already registered")
 	}
@@ -49,12 +78,22 @@ func (r *Registry) Register(t ConcreteType) error {
 	return nil
 }
 
+func (r *Registry) MustRegister(t ConcreteType) {
+	if err := r.Register(t); err != nil {
+		panic(err)
+	}
+}
+
 func (r *Registry) LookupGeneric(tag string) (*GenericType, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
 	rt, ok := r.generic[tag]
 	return rt, ok
 }
 
 func (r *Registry) RegisterGeneric(t *GenericType) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
 	if _, ok := r.generic[t.Tag]; ok {
 		return errors.New("generic type already registered")
 	}
@@ -62,6 +101,21 @@ func (r *Registry) RegisterGeneric(t *GenericType) error {
 	return nil
 }
 
+func (r *Registry) MustRegisterGeneric(t *GenericType) {
+	if err := r.RegisterGeneric(t); err != nil {
+		panic(err)
+	}
+}
+
+// Parse parses a type expression, resolving any type tags against this
+// registry.
+func (r *Registry) Parse(typeStr string) (ConcreteType, error) {
+	return ParseWithRegistry(r, typeStr)
+}
+
+// Lookup finds a concrete type in the default registry.
+//
+// Deprecated: Use a *Registry and call its Lookup method instead.
 func Lookup(tag string) (ConcreteType, bool) {
 	return globalReg.Lookup(tag)
 }
@@ -71,11 +125,12 @@ func Register(t ConcreteType) error {
 }
 
 func MustRegister(t ConcreteType) {
-	if err := Register(t); err != nil {
-		panic(err)
-	}
+	globalReg.MustRegister(t)
 }
 
+// LookupGeneric finds a generic type in the default registry.
+//
+// Deprecated: Use a *Registry and call its LookupGeneric method instead.
 func LookupGeneric(tag string) (*GenericType, bool) {
 	return globalReg.LookupGeneric(tag)
 }
@@ -85,32 +140,34 @@ func RegisterGeneric(t *GenericType) error {
 }
 
 func MustRegisterGeneric(t *GenericType) {
-	if err := RegisterGeneric(t); err != nil {
-		panic(err)
-	}
+	globalReg.MustRegisterGeneric(t)
 }
 
 func resetGlobal() {
+	globalReg.mu.Lock()
 	for k := range globalReg.concrete {
 		delete(globalReg.concrete, k)
 	}
 	for k := range globalReg.generic {
 		delete(globalReg.generic, k)
 	}
-	registerBuiltins()
-}
-
-func registerBuiltins() {
-	MustRegister(RTypeString)
-	MustRegister(NewAliasType("text", RTypeString))
-	MustRegister(RTypeInt64)
-	MustRegister(RTypeFloat64)
-	MustRegister(RTypeBool)
-	MustRegister(RTypeIRI)
-	MustRegister(RTypeULID)
-	MustRegister(RTypeUUID)
-	MustRegister(RTypeType)
-
-	MustRegisterGeneric(RTypeListGen)
-	MustRegisterGeneric(RTypeDecimalGen)
+	globalReg.mu.Unlock()
+	globalReg.registerBuiltins()
+}
+
+func (r *Registry) registerBuiltins() {
+	r.MustRegister(RTypeString)
+	r.MustRegister(NewAliasType("text", RTypeString))
+	r.MustRegister(RTypeInt64)
+	r.MustRegister(RTypeFloat64)
+	r.MustRegister(RTypeBool)
+	r.MustRegister(RTypeIRI)
+	r.MustRegister(RTypeULID)
+	r.MustRegister(RTypeUUID)
+	r.MustRegister(RTypeTimestamp)
+	r.MustRegister(RTypeType)
+
+	r.MustRegisterGeneric(RTypeListGen)
+	r.MustRegisterGeneric(RTypeDecimalGen)
+	r.MustRegisterGeneric(RTypeRangeGen)
 }
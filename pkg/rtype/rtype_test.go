@@ -20,6 +20,7 @@ import (
 	"errors"
 	"fmt"
 	"testing"
+	"time"
 
 	"github.com/gofrs/uuid/v5"
 	"github.com/oklog/ulid/v2"
@@ -418,6 +419,10 @@ func TestParseTypes(t *testing.T) {
 			in:       "uuid",
 			expected: RTypeUUID,
 		},
+		{
+			in:       "timestamp",
+			expected: RTypeTimestamp,
+		},
 		{
 			in:       "type",
 			expected: RTypeType,
@@ -460,3 +465,91 @@ func TestEncodeType(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, `decimal<precision = 6, scale = 2>`, Encode(decimalInst))
 }
+
+func TestIsolatedRegistry(t *testing.T) {
+	reg := NewRegistryWithBuiltins()
+	tMyString := NewAliasType("my_isolated_string", RTypeString)
+	assert.NoError(t, reg.Register(tMyString))
+
+	found, err := ParseWithRegistry(reg, "my_isolated_string|int64")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, NewUnionType(tMyString, RTypeInt64), found)
+
+	_, err = Parse("my_isolated_string")
+	assert.Error(t, err, "type should not leak into the default registry")
+
+	_, err = ParseWithRegistry(NewRegistry(), "string")
+	assert.Error(t, err, "empty registry should not resolve builtins")
+}
+
+func TestRangeType(t *testing.T) {
+	intRange, err := Parse("range<int64>")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "range", intRange.TypeTag())
+	assert.Equal(t, "range<elem = int64>", Encode(intRange))
+
+	val, err := intRange.ParseString("[1, 10)")
+	if !assert.NoError(t, err) {
+		return
+	}
+	r := val.(Range)
+	assert.Equal(t, Range{Lower: int64(1), Upper: int64(10), LowerInclusive: true}, r)
+	assert.Equal(t, "[1, 10)", r.String())
+	assert.True(t, r.Contains(int64(1)))
+	assert.True(t, r.Contains(int64(9)))
+	assert.False(t, r.Contains(int64(10)))
+	assert.False(t, r.Contains("5"), "incomparable values are not contained")
+
+	unbounded, err := intRange.ParseString("(, 3]")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.True(t, unbounded.(Range).Contains(int64(-1000)))
+	assert.True(t, r.Overlaps(unbounded.(Range)))
+	assert.False(t, r.Overlaps(Range{Lower: int64(10), Upper: int64(20), LowerInclusive: true}))
+	assert.True(t, Range{Lower: int64(1), Upper: int64(1), LowerInclusive: true}.IsEmpty())
+
+	_, err = intRange.ParseString("[10, 1]")
+	assert.ErrorIs(t, err, ErrOutOfRange)
+	_, err = intRange.ParseString("1, 10")
+	assert.ErrorIs(t, err, ErrMalformed)
+
+	tsRange, err := Parse("range<timestamp>")
+	if !assert.NoError(t, err) {
+		return
+	}
+	val, err = tsRange.ParseString("[2024-01-01T00:00:00Z, 2025-01-01T00:00:00Z)")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.True(t, val.(Range).Contains(time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)))
+	assert.False(t, val.(Range).Contains(time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)))
+
+	// String bounds that contain commas are quoted, and ranges in which a
+	// comma is ambiguous are rejected.
+	strRange, err := Parse("range<string>")
+	if !assert.NoError(t, err) {
+		return
+	}
+	val, err = strRange.ParseString(`["a, b", "c\"d")`)
+	if assert.NoError(t, err) {
+		assert.Equal(t, Range{Lower: "a, b", Upper: `c"d`, LowerInclusive: true}, val)
+		assert.Equal(t, `["a, b", "c\"d")`, val.(Range).String())
+	}
+	val, err = strRange.ParseString(`["", m)`)
+	if assert.NoError(t, err) {
+		assert.Equal(t, Range{Lower: "", Upper: "m", LowerInclusive: true}, val)
+		assert.Equal(t, `["", m)`, val.(Range).String())
+	}
+	for _, in := range []string{`[a, b, c]`, `["a, b]`, `["a" x, b]`, `[a, "b" c]`} {
+		_, err = strRange.ParseString(in)
+		assert.ErrorIs(t, err, ErrMalformed, in)
+	}
+
+	_, err = Parse("range<boolean>")
+	assert.Error(t, err, "unordered element types cannot form a range")
+}
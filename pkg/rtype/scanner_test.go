@@ -92,3 +92,22 @@ func TestScanner(t *testing.T) {
 		assert.Equal(t, nextExpected.expectedString, tok.String())
 	}
 }
+
+func FuzzScanner(f *testing.F) {
+	f.Add(`    "hello"	12 12.34 ,<>|= true false null my_ident`)
+	f.Add(`decimal<precision = 10, scale=3>`)
+	f.Add(`"unterminated`)
+	f.Fuzz(func(t *testing.T, in string) {
+		// Every token consumes input, so the scanner must stop within one
+		// token per byte.
+		scn := newScanner(in)
+		for i := 0; ; i++ {
+			if i > len(in)+1 {
+				t.Fatalf("scanner did not terminate on %q", in)
+			}
+			if _, ok := scn.next(); !ok {
+				break
+			}
+		}
+	})
+}